@@ -2,18 +2,35 @@ package internal
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sort"
+	"strings"
 )
 
 // ErrInvalidUsage when returned by a Handler the usage message is displayed.
 var ErrInvalidUsage = errors.New("invalid usage")
 
-// Command is a cli subcommand.
+// ExitError is returned by handlers that need a specific exit code,
+// e.g. to tell scripts an operation failed while its output is printed.
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// Command is a cli subcommand, commands with blank Desc are hidden.
 type Command struct {
 	Name      string
 	Alias     string
@@ -23,6 +40,38 @@ type Command struct {
 	ParseFunc func(*flag.FlagSet)
 }
 
+// group is a command tree node, def is the default subcommand.
+type group struct {
+	def  *Command
+	cmds []*Command
+}
+
+// groups maps commands created with Group to their subcommands.
+var groups = map[*Command]*group{}
+
+// Group returns a command that runs one of cmds selected by the first
+// argument, the def command runs when it doesn't match any of them,
+// so `twin DEVICE` works next to `twin edit DEVICE`, def can be blank.
+func Group(name, alias, desc, def string, cmds []*Command) *Command {
+	g := &group{cmds: sortCommands(cmds)}
+	if def != "" {
+		if g.def = findCommand(cmds, def); g.def == nil {
+			panic(fmt.Sprintf("default command %q is not in the group", def))
+		}
+	}
+	cmd := &Command{
+		Name:  name,
+		Alias: alias,
+		Help:  "{COMMAND} [ARGS]...",
+		Desc:  desc,
+		Handler: func(context.Context, *flag.FlagSet) error {
+			return ErrInvalidUsage // dispatched by CLI.Run
+		},
+	}
+	groups[cmd] = g
+	return cmd
+}
+
 // HandlerFunc is a subcommand handler, fs is already parsed.
 type HandlerFunc func(ctx context.Context, fs *flag.FlagSet) error
 
@@ -31,30 +80,62 @@ type FlagFunc func(fs *flag.FlagSet)
 
 // CLI is a cli subcommands executor.
 type CLI struct {
-	desc string
-	cmds []*Command
-	main FlagFunc
+	desc    string
+	prog    string
+	cmds    []*Command
+	main    FlagFunc
+	aliases map[string]string
+	compls  map[string]CompleteFunc
 }
 
-// New creates new cli executor.
+// New creates new cli executor,
+// the completion command is added to cmds.
 func New(desc string, f FlagFunc, cmds []*Command) (*CLI, error) {
 	r := &CLI{
-		desc: desc,
-		cmds: make([]*Command, len(cmds)),
-		main: f,
+		desc:    desc,
+		main:    f,
+		aliases: map[string]string{},
+		compls:  map[string]CompleteFunc{},
 	}
-	copy(r.cmds, cmds)
+	r.cmds = sortCommands(append(cmds,
+		&Command{
+			"completion", "",
+			"SHELL", "print the bash, zsh or fish completion script to be sourced",
+			r.completion,
+			nil,
+		},
+		&Command{
+			completeCommand, "",
+			"[WORD]...", "",
+			r.complete,
+			nil,
+		},
+	))
+	return r, nil
+}
+
+// Aliases maps old command names to paths of commands that replace them,
+// e.g. "create-device" to "device create", old names are hidden from usage.
+func (r *CLI) Aliases(m map[string]string) {
+	for k, v := range m {
+		r.aliases[k] = v
+	}
+}
 
-	// sort subcommands alphabetically
-	sort.Slice(r.cmds, func(i, j int) bool {
-		return r.cmds[i].Name < r.cmds[j].Name
+// sortCommands returns a copy of cmds sorted alphabetically.
+func sortCommands(cmds []*Command) []*Command {
+	l := make([]*Command, len(cmds))
+	copy(l, cmds)
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Name < l[j].Name
 	})
-	return r, nil
+	return l
 }
 
 const (
 	commonUsage  = "usage: %s [FLAGS...] {COMMAND} [FLAGS...] [ARGS]...\n\n%s\n\ncommands:\n"
 	commandUsage = "usage: %s [FLAGS...] %s [FLAGS....] %s\n\nflags:\n"
+	groupUsage   = "usage: %s [FLAGS...] %s {COMMAND} [FLAGS...] [ARGS]...\n\n%s\n\ncommands:\n"
 )
 
 // Run runs one or the given commands based on argv.
@@ -68,15 +149,11 @@ func (r *CLI) Run(ctx context.Context, argv ...string) error {
 		panic("empty argv")
 	}
 
-	sm := flag.NewFlagSet(argv[0], flag.ContinueOnError)
-	if r.main != nil {
-		r.main(sm)
-	}
+	r.prog = filepath.Base(argv[0])
+	sm, name := r.flags(argv[0])
 	sm.Usage = func() {
 		fmt.Fprintf(os.Stderr, commonUsage, sm.Name(), r.desc)
-		for _, cmd := range r.cmds {
-			fmt.Fprintf(os.Stderr, "  %-22s %s\n", cmd.Name+","+cmd.Alias, cmd.Desc)
-		}
+		printCommands(r.cmds)
 		fmt.Fprintln(os.Stderr)
 		fmt.Fprintln(os.Stderr, "common flags: ")
 		sm.PrintDefaults()
@@ -88,21 +165,71 @@ func (r *CLI) Run(ctx context.Context, argv ...string) error {
 		}
 		return err
 	}
+	if err := checkFormat(format); err != nil {
+		return err
+	}
+	p, err := LoadProfile(ConfigPath(), *name)
+	if err != nil {
+		return err
+	}
+	profile = p
 
 	if sm.NArg() == 0 {
 		sm.Usage()
 		return ErrInvalidUsage
 	}
 
-	cmd := r.findCommand(sm.Arg(0))
+	args := sm.Args()
+	if path, ok := r.aliases[args[0]]; ok && findCommand(r.cmds, args[0]) == nil {
+		args = append(strings.Fields(path), args[1:]...)
+	}
+	cmd := findCommand(r.cmds, args[0])
 	if cmd == nil {
 		sm.Usage()
 		return ErrInvalidUsage
 	}
+	return r.dispatch(ctx, sm, args[0], cmd, args[1:])
+}
 
-	sc := flag.NewFlagSet(sm.Arg(0), flag.ContinueOnError)
+// flags returns the common flags set, name is the selected profile name.
+func (r *CLI) flags(prog string) (sm *flag.FlagSet, name *string) {
+	sm = flag.NewFlagSet(prog, flag.ContinueOnError)
+	sm.StringVar(&format, "output", FormatJSON, "output format <json|jsonl|yaml|table>")
+	name = sm.String("profile", os.Getenv("IOTHUB_PROFILE"), "config file profile, see "+ConfigPath())
+	if r.main != nil {
+		r.main(sm)
+	}
+	return sm, name
+}
+
+// dispatch runs cmd with args, path is the command names
+// typed so far, groups pass the rest to their subcommands.
+func (r *CLI) dispatch(
+	ctx context.Context, sm *flag.FlagSet, path string, cmd *Command, args []string,
+) error {
+	if g, ok := groups[cmd]; ok {
+		if len(args) != 0 {
+			if sub := findCommand(g.cmds, args[0]); sub != nil {
+				return r.dispatch(ctx, sm, path+" "+args[0], sub, args[1:])
+			}
+		}
+		if g.def == nil || len(args) == 0 || isHelpFlag(args[0]) {
+			fmt.Fprintf(os.Stderr, groupUsage, sm.Name(), path, cmd.Desc)
+			printCommands(g.cmds)
+			if g.def != nil {
+				fmt.Fprintf(os.Stderr, "\n%q runs when no command is given.\n", g.def.Name)
+			}
+			fmt.Fprintln(os.Stderr)
+			fmt.Fprintln(os.Stderr, "common flags: ")
+			sm.PrintDefaults()
+			return ErrInvalidUsage
+		}
+		cmd = g.def
+	}
+
+	sc := flag.NewFlagSet(path, flag.ContinueOnError)
 	sc.Usage = func() {
-		fmt.Fprintf(os.Stderr, commandUsage, sm.Name(), sm.Arg(0), cmd.Help)
+		fmt.Fprintf(os.Stderr, commandUsage, sm.Name(), path, cmd.Help)
 		sc.PrintDefaults()
 		fmt.Fprintln(os.Stderr)
 		fmt.Fprintln(os.Stderr, "common flags: ")
@@ -111,7 +238,7 @@ func (r *CLI) Run(ctx context.Context, argv ...string) error {
 	if cmd.ParseFunc != nil {
 		cmd.ParseFunc(sc)
 	}
-	if err := sc.Parse(sm.Args()[1:]); err != nil {
+	if err := sc.Parse(args); err != nil {
 		if err == flag.ErrHelp {
 			return ErrInvalidUsage
 		}
@@ -126,15 +253,49 @@ func (r *CLI) Run(ctx context.Context, argv ...string) error {
 	return nil
 }
 
-func (r *CLI) findCommand(k string) *Command {
-	for _, cmd := range r.cmds {
-		if cmd.Name == k || cmd.Alias == k {
+func findCommand(cmds []*Command, k string) *Command {
+	for _, cmd := range cmds {
+		if cmd.Name == k || cmd.Alias != "" && cmd.Alias == k {
 			return cmd
 		}
 	}
 	return nil
 }
 
+func printCommands(cmds []*Command) {
+	for _, cmd := range cmds {
+		if cmd.Desc == "" {
+			continue
+		}
+		name := cmd.Name
+		if cmd.Alias != "" {
+			name += "," + cmd.Alias
+		}
+		fmt.Fprintf(os.Stderr, "  %-22s %s\n", name, cmd.Desc)
+	}
+}
+
+func isHelpFlag(s string) bool {
+	switch s {
+	case "-h", "-help", "--h", "--help":
+		return true
+	default:
+		return false
+	}
+}
+
+// IsFlagSet reports whether the named flag is passed explicitly,
+// so defaults from the profile don't override it.
+func IsFlagSet(fs *flag.FlagSet, name string) bool {
+	var ok bool
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			ok = true
+		}
+	})
+	return ok
+}
+
 // sliceToMap converts sequence of arguments into a key-value map.
 // [a, b, c, d] => {a: b, c: d} or errors when number of args is not even.
 func ArgsToMap(s []string) (map[string]string, error) {
@@ -148,22 +309,21 @@ func ArgsToMap(s []string) (map[string]string, error) {
 	return m, nil
 }
 
+// ReadPayload returns s as is, or reads the file when it's @FILE,
+// "-" and "@-" read STDIN.
+func ReadPayload(s string) ([]byte, error) {
+	switch {
+	case s == "-" || s == "@-":
+		return ioutil.ReadAll(os.Stdin)
+	case strings.HasPrefix(s, "@"):
+		return ioutil.ReadFile(s[1:])
+	default:
+		return []byte(s), nil
+	}
+}
+
 // OutputLine prints the given string to stdout appending a new-line char.
 func OutputLine(format string) error {
 	_, err := fmt.Println(format)
 	return err
 }
-
-// OutputJSON prints indented json to stdout.
-func OutputJSON(v interface{}, compress bool) error {
-	indent := "\t"
-	if compress {
-		indent = ""
-	}
-	b, err := json.MarshalIndent(v, "", indent)
-	if err != nil {
-		return err
-	}
-	fmt.Println(string(b))
-	return nil
-}
@@ -95,3 +95,130 @@ func TestArgsToMap(t *testing.T) {
 		}
 	}
 }
+
+func TestReadPayload(t *testing.T) {
+	t.Parallel()
+
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.WriteString(`{"file":true}`); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for s, want := range map[string]string{
+		`{"a":1}`:      `{"a":1}`,
+		"":             "",
+		"@" + f.Name(): `{"file":true}`,
+	} {
+		b, err := ReadPayload(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("ReadPayload(%q) = %q, want %q", s, b, want)
+		}
+	}
+	if _, err = ReadPayload("@" + f.Name() + ".missing"); err == nil {
+		t.Error("ReadPayload of missing file error = nil")
+	}
+}
+
+func TestGroup(t *testing.T) {
+	// not parallel, Run and flags set package variables
+	var called string
+	handler := func(name string) HandlerFunc {
+		return func(_ context.Context, f *flag.FlagSet) error {
+			called = name + " " + strings.Join(f.Args(), " ")
+			return nil
+		}
+	}
+	var tagsFlag bool
+	cli, err := New("test desc", nil, []*Command{
+		Group("twin", "t", "manage twins", "get", []*Command{
+			{"get", "g", "DEVICE", "get the twin", handler("get"), nil},
+			{"edit", "e", "DEVICE", "edit the twin", handler("edit"), func(f *flag.FlagSet) {
+				f.BoolVar(&tagsFlag, "tags", false, "edit tags")
+			}},
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Aliases(map[string]string{"edit-twin": "twin edit"})
+
+	for _, s := range []struct {
+		argv []string
+		want string
+		tags bool
+	}{
+		{[]string{"twin", "dev"}, "get dev", false},
+		{[]string{"t", "g", "dev"}, "get dev", false},
+		{[]string{"twin", "edit", "-tags", "dev"}, "edit dev", true},
+		{[]string{"edit-twin", "dev"}, "edit dev", false},
+	} {
+		called = ""
+		if err := cli.Run(context.Background(), append([]string{"run"}, s.argv...)...); err != nil {
+			t.Fatalf("Run(%v) error = %s", s.argv, err)
+		}
+		if called != s.want {
+			t.Errorf("Run(%v) called %q, want %q", s.argv, called, s.want)
+		}
+		if tagsFlag != s.tags {
+			t.Errorf("Run(%v) tags = %t, want %t", s.argv, tagsFlag, s.tags)
+		}
+	}
+}
+
+func TestCompletions(t *testing.T) {
+	// not parallel, Run and flags set package variables
+	noop := func(context.Context, *flag.FlagSet) error { return nil }
+	cli, err := New("test desc", func(f *flag.FlagSet) {
+		f.Bool("debug", false, "debug mode")
+	}, []*Command{
+		Group("device", "d", "manage devices", "get", []*Command{
+			{"get", "", "DEVICE", "get a device", noop, nil},
+			{"delete", "", "DEVICE...", "delete devices", noop, nil},
+		}),
+		{"send", "s", "DEVICE PAYLOAD", "send a message", noop, func(f *flag.FlagSet) {
+			f.String("mid", "", "message id")
+			f.Bool("ack", false, "request acknowledgement")
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Complete("DEVICE", func(_ context.Context, prefix string) []string {
+		return []string{"dev1", "dev2", "other"}
+	})
+
+	for _, s := range []struct {
+		words []string
+		want  []string
+	}{
+		{[]string{""}, []string{"completion", "device", "send"}},
+		{[]string{"-debug", "s"}, []string{"send"}},
+		{[]string{"-"}, []string{"-debug", "-output", "-profile"}},
+		{[]string{"device", ""}, []string{"delete", "get", "dev1", "dev2", "other"}},
+		{[]string{"device", "d"}, []string{"delete", "dev1", "dev2"}},
+		{[]string{"device", "delete", "dev1", "o"}, []string{"other"}},
+		{[]string{"device", "dev1", ""}, nil},
+		{[]string{"send", "-mid", "x", "-ack", "d"}, []string{"dev1", "dev2"}},
+		{[]string{"send", "dev1", ""}, nil},
+		{[]string{"send", "-"}, []string{"-ack", "-mid"}},
+		{[]string{"unknown", ""}, nil},
+	} {
+		got := cli.completions(context.Background(), s.words)
+		if len(got) == 0 && len(s.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(got, s.want) {
+			t.Errorf("completions(%q) = %q, want %q", s.words, got, s.want)
+		}
+	}
+}
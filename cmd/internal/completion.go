@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// CompleteFunc returns suggestions for an argument starting with prefix,
+// e.g. device ids from the registry, errors should be ignored.
+type CompleteFunc func(ctx context.Context, prefix string) []string
+
+// Complete registers fn for completing arguments named placeholder
+// in commands' help, e.g. DEVICE in "DEVICE [KEY VALUE]...".
+func (r *CLI) Complete(placeholder string, fn CompleteFunc) {
+	r.compls[placeholder] = fn
+}
+
+// completeCommand is the hidden command scripts call with the words
+// typed so far, it prints suggestions for the last one line by line.
+const completeCommand = "__complete"
+
+// completionScripts are shell scripts calling the __complete command,
+// {{fn}} is the program name usable as a function name.
+var completionScripts = map[string]string{
+	"bash": `_{{fn}}() {
+	local IFS=$'\n'
+	COMPREPLY=($({{prog}} ` + completeCommand + ` -- "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+}
+complete -o default -F _{{fn}} {{prog}}
+`,
+	"zsh": `#compdef {{prog}}
+_{{fn}}() {
+	local -a completions
+	completions=(${(f)"$({{prog}} ` + completeCommand + ` -- "${(@)words[2,$CURRENT]}" 2>/dev/null)"})
+	compadd -a completions
+}
+compdef _{{fn}} {{prog}}
+`,
+	"fish": `function __{{fn}}_complete
+	set -l args (commandline -opc) (commandline -ct)
+	set -e args[1]
+	{{prog}} ` + completeCommand + ` -- $args 2>/dev/null
+end
+complete -c {{prog}} -f -a '(__{{fn}}_complete)'
+`,
+}
+
+func (r *CLI) completion(_ context.Context, fs *flag.FlagSet) error {
+	if fs.NArg() != 1 {
+		return ErrInvalidUsage
+	}
+	script, ok := completionScripts[fs.Arg(0)]
+	if !ok {
+		return fmt.Errorf("unsupported shell %q, want bash, zsh or fish", fs.Arg(0))
+	}
+	fn := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, r.prog)
+	_, err := fmt.Print(strings.NewReplacer("{{fn}}", fn, "{{prog}}", r.prog).Replace(script))
+	return err
+}
+
+func (r *CLI) complete(ctx context.Context, fs *flag.FlagSet) error {
+	for _, s := range r.completions(ctx, fs.Args()) {
+		if err := OutputLine(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// completions returns suggestions for the last of words,
+// that are command line arguments without the program name.
+func (r *CLI) completions(ctx context.Context, words []string) []string {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	cur, prev := words[len(words)-1], words[:len(words)-1]
+
+	fs, _ := r.flags(r.prog)
+	top := fs
+	cmds := r.cmds
+	var cmd *Command
+	var g *group
+	var args []string // positional arguments of cmd
+	for i := 0; i < len(prev); i++ {
+		w := prev[i]
+		if strings.HasPrefix(w, "-") && w != "-" {
+			name := strings.TrimLeft(w, "-")
+			if !strings.Contains(name, "=") && takesValue(fs, name) && i+1 < len(prev) {
+				i++
+				if fs == top {
+					_ = fs.Set(name, prev[i]) // to respect -profile
+				}
+			}
+			continue
+		}
+		if cmds != nil && len(args) == 0 {
+			if cmd == nil {
+				if path, ok := r.aliases[w]; ok && findCommand(cmds, w) == nil {
+					w = strings.Fields(path)[0]
+				}
+			}
+			if sub := findCommand(cmds, w); sub != nil {
+				cmd, g, cmds = sub, groups[sub], nil
+				fs = flag.NewFlagSet(sub.Name, flag.ContinueOnError)
+				switch {
+				case g == nil:
+					if sub.ParseFunc != nil {
+						sub.ParseFunc(fs)
+					}
+				case g.def != nil:
+					cmds = g.cmds
+					if g.def.ParseFunc != nil {
+						g.def.ParseFunc(fs)
+					}
+				default:
+					cmds = g.cmds
+				}
+				continue
+			}
+			if cmd == nil {
+				return nil // unknown command
+			}
+			cmds = nil // the default command's argument
+		}
+		args = append(args, w)
+	}
+	if IsFlagSet(top, "profile") {
+		if p, err := LoadProfile(ConfigPath(), top.Lookup("profile").Value.String()); err == nil {
+			profile = p
+		}
+	}
+
+	var l []string
+	switch {
+	case strings.HasPrefix(cur, "-"):
+		fs.VisitAll(func(f *flag.Flag) {
+			l = append(l, "-"+f.Name)
+		})
+	case cmds != nil && len(args) == 0:
+		for _, c := range cmds {
+			if c.Desc != "" {
+				l = append(l, c.Name)
+			}
+		}
+		if g != nil && g.def != nil {
+			l = append(l, r.completeArg(ctx, g.def.Help, 0, cur)...)
+		}
+	case cmd != nil:
+		help := cmd.Help
+		if g != nil && g.def != nil {
+			help = g.def.Help
+		}
+		l = r.completeArg(ctx, help, len(args), cur)
+	}
+
+	res := l[:0]
+	for _, s := range l {
+		if strings.HasPrefix(s, cur) {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// completeArg completes the i-th argument described by help,
+// the last one is repeated when it ends with an ellipsis.
+func (r *CLI) completeArg(ctx context.Context, help string, i int, prefix string) []string {
+	fields := strings.Fields(help)
+	if len(fields) == 0 {
+		return nil
+	}
+	if i >= len(fields) {
+		if !strings.HasSuffix(fields[len(fields)-1], "...") {
+			return nil
+		}
+		i = len(fields) - 1
+	}
+	fn, ok := r.compls[strings.Trim(fields[i], "[]{}.")]
+	if !ok {
+		return nil
+	}
+	return fn(ctx, prefix)
+}
+
+// takesValue reports whether the named flag consumes the next argument.
+func takesValue(fs *flag.FlagSet, name string) bool {
+	f := fs.Lookup(name)
+	if f == nil {
+		return false
+	}
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return !ok || !b.IsBoolFlag()
+}
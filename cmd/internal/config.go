@@ -0,0 +1,218 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Profile is a named set of credentials and defaults from the config file,
+// so secrets don't have to be passed in the command line:
+//
+//	# ~/.config/iothub/config.yaml
+//	default: prod
+//	profiles:
+//	  prod:
+//	    service-connection-string: HostName=...;SharedAccessKeyName=...
+//	    device-connection-string: HostName=...;DeviceId=...
+//	    device-id: dev1
+//	    consumer-group: cli
+//
+// Every value can be overridden with an IOTHUB_* environment variable,
+// e.g. IOTHUB_SERVICE_CONNECTION_STRING, they work without the file too,
+// the older SERVICE_CONNECTION_STRING and DEVICE_CONNECTION_STRING
+// variables are still supported.
+type Profile struct {
+	Name                    string
+	ServiceConnectionString string
+	DeviceConnectionString  string
+	DeviceID                string
+	ConsumerGroup           string
+}
+
+// profileKeys maps config keys to profile fields and
+// environment variables, the first non-empty variable wins.
+var profileKeys = []struct {
+	key   string
+	env   []string
+	field func(p *Profile) *string
+}{
+	{"service-connection-string", []string{"IOTHUB_SERVICE_CONNECTION_STRING", "SERVICE_CONNECTION_STRING"},
+		func(p *Profile) *string { return &p.ServiceConnectionString }},
+	{"device-connection-string", []string{"IOTHUB_DEVICE_CONNECTION_STRING", "DEVICE_CONNECTION_STRING"},
+		func(p *Profile) *string { return &p.DeviceConnectionString }},
+	{"device-id", []string{"IOTHUB_DEVICE_ID"},
+		func(p *Profile) *string { return &p.DeviceID }},
+	{"consumer-group", []string{"IOTHUB_CONSUMER_GROUP"},
+		func(p *Profile) *string { return &p.ConsumerGroup }},
+}
+
+// profile is the profile of the running command, it's set by CLI.Run.
+var profile = &Profile{}
+
+// CurrentProfile returns the profile selected with the -profile flag
+// or $IOTHUB_PROFILE, values are empty when nothing is configured.
+func CurrentProfile() *Profile {
+	return profile
+}
+
+// ConfigPath is $IOTHUB_CONFIG or config.yaml
+// in the iothub directory of the user's config dir.
+func ConfigPath() string {
+	if p := os.Getenv("IOTHUB_CONFIG"); p != "" {
+		return p
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "iothub", "config.yaml")
+}
+
+// LoadProfile reads the named profile from the config file at path,
+// blank name selects the file's default one. A missing file is not
+// an error unless a profile is requested explicitly.
+func LoadProfile(path, name string) (*Profile, error) {
+	p := &Profile{Name: name}
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		cfg, err := parseConfig(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		if p.Name == "" {
+			p.Name = cfg.def
+		}
+		if p.Name != "" {
+			m, ok := cfg.profiles[p.Name]
+			if !ok {
+				return nil, fmt.Errorf("%s: profile %q not found", path, p.Name)
+			}
+			for _, k := range profileKeys {
+				*k.field(p) = m[k.key]
+			}
+		}
+	case os.IsNotExist(err) && name == "":
+	default:
+		return nil, err
+	}
+	for _, k := range profileKeys {
+		for _, env := range k.env {
+			if v := os.Getenv(env); v != "" {
+				*k.field(p) = v
+				break
+			}
+		}
+	}
+	return p, nil
+}
+
+type config struct {
+	def      string
+	profiles map[string]map[string]string
+}
+
+// parseConfig parses the subset of yaml the config file needs: the default
+// key and the profiles map of string maps, comments and quoting.
+func parseConfig(b []byte) (*config, error) {
+	cfg := &config{profiles: map[string]map[string]string{}}
+	var section, name string
+	var profIndent int // indentation of profile names
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimRight(s.Text(), " \t\r")
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", n)
+		}
+		kv := strings.SplitN(trimmed, ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("line %d: want KEY: VALUE", n)
+		}
+		key := strings.TrimSpace(kv[0])
+		val, err := configValue(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+
+		switch indent := len(line) - len(trimmed); {
+		case indent == 0:
+			section, name = key, ""
+			switch key {
+			case "default":
+				cfg.def = val
+			case "profiles":
+				if val != "" {
+					return nil, fmt.Errorf("line %d: profiles must be a map", n)
+				}
+			default:
+				return nil, fmt.Errorf("line %d: unknown key %q", n, key)
+			}
+		case section != "profiles":
+			return nil, fmt.Errorf("line %d: unexpected indentation", n)
+		case name == "" || indent <= profIndent:
+			if name == "" {
+				profIndent = indent
+			} else if indent != profIndent {
+				return nil, fmt.Errorf("line %d: unexpected indentation", n)
+			}
+			if val != "" {
+				return nil, fmt.Errorf("line %d: profile %q must be a map", n, key)
+			}
+			name = key
+			cfg.profiles[name] = map[string]string{}
+		default:
+			if !knownProfileKey(key) {
+				return nil, fmt.Errorf("line %d: unknown profile key %q", n, key)
+			}
+			cfg.profiles[name][key] = val
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func knownProfileKey(key string) bool {
+	for _, k := range profileKeys {
+		if k.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// configValue unquotes v and strips trailing comments, connection
+// strings contain '=' and ';' but no ' #' so they can be left unquoted.
+func configValue(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, "#"):
+		return "", nil
+	case strings.HasPrefix(v, `"`):
+		i := strings.LastIndex(v, `"`)
+		if i == 0 {
+			return "", fmt.Errorf("unterminated string %s", v)
+		}
+		return strconv.Unquote(v[:i+1])
+	case strings.HasPrefix(v, "'"):
+		i := strings.LastIndex(v, "'")
+		if i == 0 {
+			return "", fmt.Errorf("unterminated string %s", v)
+		}
+		return strings.Replace(v[1:i], "''", "'", -1), nil
+	}
+	if i := strings.Index(v, " #"); i != -1 {
+		v = strings.TrimSpace(v[:i])
+	}
+	return v, nil
+}
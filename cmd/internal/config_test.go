@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iothub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	if err = ioutil.WriteFile(path, []byte(`# profiles
+default: prod
+profiles:
+  prod:
+    service-connection-string: HostName=prod.azure-devices.net;SharedAccessKeyName=iothubowner;SharedAccessKey=a2V5
+    consumer-group: "cli" # comment
+  dev:
+    device-id: 'dev''s'
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := LoadProfile(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "prod" || p.ConsumerGroup != "cli" ||
+		p.ServiceConnectionString != "HostName=prod.azure-devices.net;SharedAccessKeyName=iothubowner;SharedAccessKey=a2V5" {
+		t.Errorf("LoadProfile(default) = %+v", p)
+	}
+
+	os.Setenv("IOTHUB_CONSUMER_GROUP", "env")
+	defer os.Unsetenv("IOTHUB_CONSUMER_GROUP")
+	if p, err = LoadProfile(path, "dev"); err != nil {
+		t.Fatal(err)
+	}
+	if p.DeviceID != "dev's" || p.ConsumerGroup != "env" || p.ServiceConnectionString != "" {
+		t.Errorf("LoadProfile(dev) = %+v", p)
+	}
+
+	if _, err = LoadProfile(path, "missing"); err == nil {
+		t.Error("LoadProfile(missing) error = nil")
+	}
+	if _, err = LoadProfile(filepath.Join(dir, "none.yaml"), ""); err != nil {
+		t.Errorf("LoadProfile without the file error = %v", err)
+	}
+	if _, err = LoadProfile(filepath.Join(dir, "none.yaml"), "prod"); err == nil {
+		t.Error("LoadProfile(prod) without the file error = nil")
+	}
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, s := range []string{
+		"unknown: x\n",
+		"profiles: x\n",
+		"profiles:\n  p:\n    password: x\n",
+		"profiles:\n  p: x\n",
+		"default:\n  nested: x\n",
+		"profiles:\n  p:\n    device-id: \"x\n",
+	} {
+		if _, err := parseConfig([]byte(s)); err == nil {
+			t.Errorf("parseConfig(%q) error = nil", s)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package internal
+
+import (
+	"github.com/goautomotive/iothub/common"
+)
+
+// MQTTCredentials are parameters for connecting to the hub
+// with generic MQTT clients, e.g. mosquitto_pub:
+//
+//	mosquitto_pub -h $host -p $port -i $clientId -u $username -P $password \
+//		-t $topic --capath /etc/ssl/certs -V mqttv311 -m '{"a":1}'
+type MQTTCredentials struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	ClientID string `json:"clientId"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Topic    string `json:"topic"` // device-to-cloud messages
+}
+
+// NewMQTTCredentials returns credentials of the device or
+// the module when moduleID is not blank, sas is used as password.
+func NewMQTTCredentials(hostname, deviceID, moduleID, sas string) *MQTTCredentials {
+	clientID, topic := deviceID, "devices/"+deviceID
+	if moduleID != "" {
+		clientID += "/" + moduleID
+		topic += "/modules/" + moduleID
+	}
+	return &MQTTCredentials{
+		Host:     hostname,
+		Port:     8883,
+		ClientID: clientID,
+		Username: hostname + "/" + clientID + "/api-version=" + common.APIVersion,
+		Password: sas,
+		Topic:    topic + "/messages/events/",
+	}
+}
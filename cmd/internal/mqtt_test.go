@@ -0,0 +1,25 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/goautomotive/iothub/common"
+)
+
+func TestNewMQTTCredentials(t *testing.T) {
+	t.Parallel()
+
+	got := NewMQTTCredentials("hub.azure-devices.net", "dev", "mod", "sas")
+	want := &MQTTCredentials{
+		Host:     "hub.azure-devices.net",
+		Port:     8883,
+		ClientID: "dev/mod",
+		Username: "hub.azure-devices.net/dev/mod/api-version=" + common.APIVersion,
+		Password: "sas",
+		Topic:    "devices/dev/modules/mod/messages/events/",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("NewMQTTCredentials = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,257 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Output formats selected with the common -output flag.
+const (
+	FormatJSON  = "json"  // indented json unless -compress is set
+	FormatJSONL = "jsonl" // compact json, lists are printed one item per line
+	FormatYAML  = "yaml"
+	FormatTable = "table" // lists of objects as rows, objects as key-value pairs
+)
+
+// format is the output format of the running command, it's set by CLI.Run.
+var format = FormatJSON
+
+func checkFormat(s string) error {
+	switch s {
+	case FormatJSON, FormatJSONL, FormatYAML, FormatTable:
+		return nil
+	default:
+		return fmt.Errorf("unknown output format %q", s)
+	}
+}
+
+// OutputJSON prints v to stdout in the format selected
+// with the -output flag, indented json by default.
+func OutputJSON(v interface{}, compress bool) error {
+	return output(os.Stdout, format, v, compress)
+}
+
+func output(w io.Writer, format string, v interface{}, compress bool) error {
+	if format == FormatJSON {
+		indent := "\t"
+		if compress {
+			indent = ""
+		}
+		b, err := json.MarshalIndent(v, "", indent)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(b))
+		return err
+	}
+
+	// other formats work on the json representation
+	// to respect field names and omitempty tags
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var x interface{}
+	if err = d.Decode(&x); err != nil {
+		return err
+	}
+	switch format {
+	case FormatJSONL:
+		return outputJSONL(w, x)
+	case FormatYAML:
+		var buf bytes.Buffer
+		writeYAML(&buf, x, 0)
+		_, err = w.Write(buf.Bytes())
+		return err
+	case FormatTable:
+		return outputTable(w, x)
+	default:
+		return checkFormat(format)
+	}
+}
+
+func outputJSONL(w io.Writer, x interface{}) error {
+	l, ok := x.([]interface{})
+	if !ok {
+		l = []interface{}{x}
+	}
+	for _, v := range l {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if _, err = fmt.Fprintln(w, string(b)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func outputTable(w io.Writer, x interface{}) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	switch v := x.(type) {
+	case []interface{}:
+		// columns are the union of the objects keys
+		var cols []string
+		seen := map[string]bool{}
+		for _, r := range v {
+			m, ok := r.(map[string]interface{})
+			if !ok {
+				fmt.Fprintln(tw, cell(r))
+				continue
+			}
+			for _, k := range sortedKeys(m) {
+				if !seen[k] {
+					seen[k] = true
+					cols = append(cols, k)
+				}
+			}
+		}
+		if len(cols) != 0 {
+			fmt.Fprintln(tw, strings.ToUpper(strings.Join(cols, "\t")))
+		}
+		for _, r := range v {
+			m, ok := r.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			row := make([]string, len(cols))
+			for i, k := range cols {
+				if c, ok := m[k]; ok {
+					row[i] = cell(c)
+				}
+			}
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+	case map[string]interface{}:
+		fmt.Fprintln(tw, "KEY\tVALUE")
+		for _, k := range sortedKeys(v) {
+			fmt.Fprintf(tw, "%s\t%s\n", k, cell(v[k]))
+		}
+	default:
+		fmt.Fprintln(tw, cell(v))
+	}
+	return tw.Flush()
+}
+
+// cell formats a table cell, nested values are printed as compact json.
+func cell(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+func writeYAML(b *bytes.Buffer, x interface{}, depth int) {
+	indent := strings.Repeat("  ", depth)
+	switch v := x.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			b.WriteString(indent + "{}\n")
+			return
+		}
+		for _, k := range sortedKeys(v) {
+			b.WriteString(indent + yamlString(k) + ":")
+			if isYAMLCollection(v[k]) {
+				b.WriteString("\n")
+				writeYAML(b, v[k], depth+1)
+			} else {
+				b.WriteString(" " + yamlScalar(v[k]) + "\n")
+			}
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			b.WriteString(indent + "[]\n")
+			return
+		}
+		for _, e := range v {
+			if !isYAMLCollection(e) {
+				b.WriteString(indent + "- " + yamlScalar(e) + "\n")
+				continue
+			}
+			// the first line of the nested item goes after the dash
+			var nb bytes.Buffer
+			writeYAML(&nb, e, depth+1)
+			b.WriteString(indent + "- " + strings.TrimPrefix(nb.String(), indent+"  "))
+		}
+	default:
+		b.WriteString(indent + yamlScalar(v) + "\n")
+	}
+}
+
+// isYAMLCollection reports whether v is a non-empty map or list
+// that is printed on separate lines.
+func isYAMLCollection(v interface{}) bool {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return len(v) != 0
+	case []interface{}:
+		return len(v) != 0
+	default:
+		return false
+	}
+}
+
+func yamlScalar(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return yamlString(v)
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case map[string]interface{}:
+		return "{}"
+	case []interface{}:
+		return "[]"
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// yamlString quotes s when it can be read as something other than a plain
+// string, json quoting is valid in yaml since it's a subset of it.
+func yamlString(s string) string {
+	switch strings.ToLower(s) {
+	case "", "null", "~", "true", "false", "yes", "no", "on", "off":
+		return strconv.Quote(s)
+	}
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		return strconv.Quote(s)
+	}
+	if strings.ContainsAny(s, ":#{}[],&*!|>'\"%@`\n\t\\") ||
+		strings.HasPrefix(s, "-") || strings.HasPrefix(s, "?") ||
+		strings.TrimSpace(s) != s {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestOutput(t *testing.T) {
+	t.Parallel()
+
+	type device struct {
+		DeviceID string                 `json:"deviceId"`
+		Status   string                 `json:"status,omitempty"`
+		Tags     map[string]interface{} `json:"tags,omitempty"`
+	}
+	list := []*device{
+		{DeviceID: "a", Status: "enabled"},
+		{DeviceID: "b", Tags: map[string]interface{}{"env": "prod"}},
+	}
+	twin := map[string]interface{}{
+		"deviceId": "a",
+		"version":  3,
+		"tags":     map[string]interface{}{},
+		"properties": map[string]interface{}{
+			"desired": map[string]interface{}{"interval": 10.5, "mode": "true"},
+			"list":    []interface{}{1, map[string]interface{}{"x": nil, "y": "a: b"}},
+		},
+	}
+
+	for _, s := range []struct {
+		format string
+		v      interface{}
+		want   string
+	}{
+		{FormatJSONL, list, `{"deviceId":"a","status":"enabled"}` + "\n" +
+			`{"deviceId":"b","tags":{"env":"prod"}}` + "\n"},
+		{FormatTable, list, "" +
+			"DEVICEID  STATUS   TAGS\n" +
+			"a         enabled  \n" +
+			"b                  {\"env\":\"prod\"}\n"},
+		{FormatTable, map[string]int{"version": 1}, "" +
+			"KEY      VALUE\n" +
+			"version  1\n"},
+		{FormatYAML, twin, "" +
+			"deviceId: a\n" +
+			"properties:\n" +
+			"  desired:\n" +
+			"    interval: 10.5\n" +
+			"    mode: \"true\"\n" +
+			"  list:\n" +
+			"    - 1\n" +
+			"    - x: null\n" +
+			"      y: \"a: b\"\n" +
+			"tags: {}\n" +
+			"version: 3\n"},
+	} {
+		var b bytes.Buffer
+		if err := output(&b, s.format, s.v, false); err != nil {
+			t.Fatalf("%s: %s", s.format, err)
+		}
+		if b.String() != s.want {
+			t.Errorf("%s output =\n%s\nwant\n%s", s.format, b.String(), s.want)
+		}
+	}
+	if err := output(&bytes.Buffer{}, "xml", list, false); err == nil {
+		t.Error("unknown format error = nil")
+	}
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"reflect"
+	"sort"
+)
+
+// MergePatch returns a json merge patch (RFC 7386) that turns a into b,
+// removed keys are set to nil, it's empty when there are no changes.
+func MergePatch(a, b map[string]interface{}) map[string]interface{} {
+	p := map[string]interface{}{}
+	for k := range a {
+		if _, ok := b[k]; !ok {
+			p[k] = nil
+		}
+	}
+	for k, v := range b {
+		old, ok := a[k]
+		if !ok {
+			p[k] = v
+			continue
+		}
+		om, ok1 := old.(map[string]interface{})
+		nm, ok2 := v.(map[string]interface{})
+		if ok1 && ok2 {
+			if sub := MergePatch(om, nm); len(sub) != 0 {
+				p[k] = sub
+			}
+			continue
+		}
+		if !reflect.DeepEqual(old, v) {
+			p[k] = v
+		}
+	}
+	return p
+}
+
+// PatchPaths lists dot-separated paths of the patch leaves, sorted.
+func PatchPaths(p map[string]interface{}) []string {
+	var l []string
+	var walk func(prefix string, m map[string]interface{})
+	walk = func(prefix string, m map[string]interface{}) {
+		for k, v := range m {
+			if sub, ok := v.(map[string]interface{}); ok && len(sub) != 0 {
+				walk(prefix+k+".", sub)
+				continue
+			}
+			l = append(l, prefix+k)
+		}
+	}
+	walk("", p)
+	sort.Strings(l)
+	return l
+}
+
+// ApplyPatch returns a copy of doc with the json merge patch applied.
+func ApplyPatch(doc, patch map[string]interface{}) map[string]interface{} {
+	m := make(map[string]interface{}, len(doc)+len(patch))
+	for k, v := range doc {
+		m[k] = v
+	}
+	for k, v := range patch {
+		if v == nil {
+			delete(m, k)
+			continue
+		}
+		if pm, ok := v.(map[string]interface{}); ok {
+			dm, _ := m[k].(map[string]interface{})
+			m[k] = ApplyPatch(dm, pm)
+			continue
+		}
+		m[k] = v
+	}
+	return m
+}
+
+// Change is a difference between two documents at the dot-separated path,
+// Old or New is nil when the value is added or removed.
+type Change struct {
+	Path string      `json:"path"`
+	Old  interface{} `json:"old"`
+	New  interface{} `json:"new"`
+}
+
+// Diff lists changes that turn a into b sorted by path.
+func Diff(a, b map[string]interface{}) []*Change {
+	var l []*Change
+	diff(&l, "", a, b)
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].Path < l[j].Path
+	})
+	return l
+}
+
+func diff(l *[]*Change, prefix string, a, b map[string]interface{}) {
+	for k, v := range a {
+		if _, ok := b[k]; !ok {
+			*l = append(*l, &Change{Path: prefix + k, Old: v})
+		}
+	}
+	for k, v := range b {
+		old, ok := a[k]
+		if !ok {
+			*l = append(*l, &Change{Path: prefix + k, New: v})
+			continue
+		}
+		om, ok1 := old.(map[string]interface{})
+		nm, ok2 := v.(map[string]interface{})
+		if ok1 && ok2 {
+			diff(l, prefix+k+".", om, nm)
+			continue
+		}
+		if !reflect.DeepEqual(old, v) {
+			*l = append(*l, &Change{Path: prefix + k, Old: old, New: v})
+		}
+	}
+}
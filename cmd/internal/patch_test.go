@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergePatch(t *testing.T) {
+	t.Parallel()
+
+	a := map[string]interface{}{
+		"interval": 10.0,
+		"mode":     "eco",
+		"removed":  true,
+		"nested": map[string]interface{}{
+			"a": 1.0,
+			"b": []interface{}{1.0, 2.0},
+		},
+		"same": map[string]interface{}{"x": "y"},
+	}
+	b := map[string]interface{}{
+		"interval": 20.0,
+		"mode":     "eco",
+		"added":    "yes",
+		"nested": map[string]interface{}{
+			"a": 1.0,
+			"b": []interface{}{1.0},
+		},
+		"same": map[string]interface{}{"x": "y"},
+	}
+	want := map[string]interface{}{
+		"interval": 20.0,
+		"removed":  nil,
+		"added":    "yes",
+		"nested": map[string]interface{}{
+			"b": []interface{}{1.0},
+		},
+	}
+	p := MergePatch(a, b)
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("MergePatch = %v, want %v", p, want)
+	}
+	if paths, want := PatchPaths(p), []string{
+		"added", "interval", "nested.b", "removed",
+	}; !reflect.DeepEqual(paths, want) {
+		t.Errorf("PatchPaths = %v, want %v", paths, want)
+	}
+	if p = MergePatch(a, a); len(p) != 0 {
+		t.Errorf("MergePatch of equal maps = %v, want empty", p)
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	t.Parallel()
+
+	doc := map[string]interface{}{
+		"a": 1.0,
+		"b": map[string]interface{}{"c": "d", "e": "f"},
+	}
+	got := ApplyPatch(doc, map[string]interface{}{
+		"a": nil,
+		"b": map[string]interface{}{"e": nil, "g": true},
+		"h": map[string]interface{}{"i": 2.0},
+	})
+	want := map[string]interface{}{
+		"b": map[string]interface{}{"c": "d", "g": true},
+		"h": map[string]interface{}{"i": 2.0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ApplyPatch = %v, want %v", got, want)
+	}
+	if _, ok := doc["a"]; !ok {
+		t.Error("ApplyPatch modified the document")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	t.Parallel()
+
+	got := Diff(map[string]interface{}{
+		"a": 1.0,
+		"b": map[string]interface{}{"c": "d", "e": "f"},
+	}, map[string]interface{}{
+		"b": map[string]interface{}{"c": "x", "e": "f"},
+		"g": true,
+	})
+	want := []*Change{
+		{Path: "a", Old: 1.0},
+		{Path: "b.c", Old: "d", New: "x"},
+		{Path: "g", New: true},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Diff = %v, want %v", got, want)
+	}
+}
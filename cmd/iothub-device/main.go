@@ -8,12 +8,18 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/goautomotive/iothub/cmd/internal"
+	"github.com/goautomotive/iothub/common"
 	"github.com/goautomotive/iothub/iotdevice"
 	"github.com/goautomotive/iothub/iotdevice/transport"
+	"github.com/goautomotive/iothub/iotdevice/transport/amqp"
+	"github.com/goautomotive/iothub/iotdevice/transport/http"
 	"github.com/goautomotive/iothub/iotdevice/transport/mqtt"
 )
 
@@ -21,11 +27,14 @@ var transports = map[string]func() (transport.Transport, error){
 	"mqtt": func() (transport.Transport, error) {
 		return mqtt.New(mqtt.WithLogger(mklog("[mqtt]   "))), nil
 	},
+	"mqtt-ws": func() (transport.Transport, error) {
+		return mqtt.New(mqtt.WithLogger(mklog("[mqtt]   ")), mqtt.WithWebSocket(true)), nil
+	},
 	"amqp": func() (transport.Transport, error) {
-		return nil, errors.New("not implemented")
+		return amqp.New(amqp.WithLogger(mklog("[amqp]   "))), nil
 	},
 	"http": func() (transport.Transport, error) {
-		return nil, errors.New("not implemented")
+		return http.New(http.WithLogger(mklog("[http]   ")), http.WithPollInterval(10*time.Second)), nil
 	},
 }
 
@@ -43,6 +52,14 @@ var (
 	tlsKeyFlag   string
 	deviceIDFlag string
 	hostnameFlag string
+
+	// edge gateway flags
+	gatewayFlag string
+	caFileFlag  string
+
+	// token flags
+	ttlFlag  time.Duration
+	mqttFlag bool
 )
 
 func main() {
@@ -55,17 +72,19 @@ func main() {
 }
 
 const help = `iothub-device helps iothub devices to communicate with the cloud.
-The $DEVICE_CONNECTION_STRING environment variable is required unless you use x509 authentication.`
+The $DEVICE_CONNECTION_STRING environment variable or a config file profile is required unless you use x509 authentication.`
 
 func run() error {
 	cli, err := internal.New(help, func(f *flag.FlagSet) {
 		f.BoolVar(&debugFlag, "debug", false, "enable debug mode")
 		f.BoolVar(&compressFlag, "compress", false, "compress data (remove JSON indentations)")
-		f.StringVar(&transportFlag, "transport", "mqtt", "transport to use <mqtt|amqp|http>")
+		f.StringVar(&transportFlag, "transport", "mqtt", "transport to use <mqtt|mqtt-ws|amqp|http>")
 		f.StringVar(&tlsCertFlag, "tls-cert", "", "path to x509 cert file")
 		f.StringVar(&tlsKeyFlag, "tls-key", "", "path to x509 key file")
 		f.StringVar(&deviceIDFlag, "device-id", "", "device id, required for x509")
 		f.StringVar(&hostnameFlag, "hostname", "", "hostname to connect to, required for x509")
+		f.StringVar(&gatewayFlag, "gateway", "", "IoT Edge gateway hostname to connect through")
+		f.StringVar(&caFileFlag, "ca-file", "", "path to trusted CA certificates, e.g. the gateway's")
 	}, []*internal.Command{
 		{
 			"send", "s",
@@ -85,13 +104,33 @@ func run() error {
 			wrap(watchEvents),
 			nil,
 		},
-		{
-			"watch-twin", "wt",
-			"",
-			"subscribe to desired twin state updates",
-			wrap(watchTwin),
-			nil,
-		},
+		internal.Group(
+			"twin", "t",
+			"inspect and update the device twin", "",
+			[]*internal.Command{
+				{
+					"get", "g",
+					"",
+					"retrieve desired and reported states",
+					wrap(twin),
+					nil,
+				},
+				{
+					"update", "u",
+					"[KEY VALUE]...",
+					"updates the twin device deported state, null means delete the key",
+					wrap(updateTwin),
+					nil,
+				},
+				{
+					"watch", "w",
+					"",
+					"subscribe to desired twin state updates",
+					wrap(watchTwin),
+					nil,
+				},
+			},
+		),
 		{
 			"direct-method", "dm",
 			"NAME",
@@ -102,29 +141,59 @@ func run() error {
 			},
 		},
 		{
-			"twin-state", "ts",
+			"watch-methods", "wm",
 			"",
-			"retrieve desired and reported states",
-			wrap(twin),
-			nil,
+			"respond to all direct methods by running a shell command",
+			wrap(watchMethods),
+			watchMethodsFlags,
 		},
 		{
-			"update-twin", "ut",
-			"[KEY VALUE]...",
-			"updates the twin device deported state, null means delete the key",
-			wrap(updateTwin),
+			"upload-file", "uf",
+			"PATH [BLOB]",
+			"upload the named file to the hub's storage account",
+			wrap(uploadFile),
 			nil,
 		},
+		{
+			"simulate", "sim",
+			"",
+			"send templated telemetry at a rate, optionally from many devices",
+			simulate,
+			simulateFlags,
+		},
+		{
+			"token", "tk",
+			"",
+			"generate a SAS token of the device for connecting with MQTT clients",
+			token,
+			func(f *flag.FlagSet) {
+				f.DurationVar(&ttlFlag, "ttl", time.Hour, "token validity time")
+				f.BoolVar(&mqttFlag, "mqtt", false, "print all MQTT connection parameters")
+			},
+		},
 	})
 	if err != nil {
 		return err
 	}
+
+	// commands moved into groups
+	cli.Aliases(map[string]string{
+		"twin-state":  "twin get",
+		"ts":          "twin get",
+		"update-twin": "twin update",
+		"ut":          "twin update",
+		"watch-twin":  "twin watch",
+		"wt":          "twin watch",
+	})
 	return cli.Run(context.Background(), os.Args...)
 }
 
 func wrap(fn func(context.Context, *flag.FlagSet, *iotdevice.Client) error) internal.HandlerFunc {
 	return func(ctx context.Context, f *flag.FlagSet) error {
 		var auth iotdevice.ClientOption
+		if deviceIDFlag == "" {
+			deviceIDFlag = internal.CurrentProfile().DeviceID
+		}
 		if tlsCertFlag != "" && tlsKeyFlag != "" {
 			if hostnameFlag == "" {
 				return errors.New("hostname is required for x509 authentication")
@@ -135,37 +204,53 @@ func wrap(fn func(context.Context, *flag.FlagSet, *iotdevice.Client) error) inte
 			auth = iotdevice.WithX509FromFile(deviceIDFlag, hostnameFlag, tlsCertFlag, tlsKeyFlag)
 		} else {
 			// we cannot accept connection string from parameters
-			cs := os.Getenv("DEVICE_CONNECTION_STRING")
+			cs := internal.CurrentProfile().DeviceConnectionString
 			if cs == "" {
-				return errors.New("$DEVICE_CONNECTION_STRING is empty")
+				return errors.New("$DEVICE_CONNECTION_STRING is empty and no profile sets it")
 			}
 			auth = iotdevice.WithConnectionString(cs)
 		}
 
-		mk, ok := transports[transportFlag]
-		if !ok {
-			return fmt.Errorf("unknown transport %q", transportFlag)
-		}
-		t, err := mk()
+		c, err := connect(ctx, auth)
 		if err != nil {
 			return err
 		}
-		c, err := iotdevice.NewClient(
-			iotdevice.WithDebug(debugFlag),
-			iotdevice.WithLogger(mklog("[iothub] ")),
-			iotdevice.WithTransport(t),
-			auth,
-		)
-		if err != nil {
-			return err
-		}
-		if err := c.Connect(ctx); err != nil {
-			return err
-		}
 		return fn(ctx, f, c)
 	}
 }
 
+// connect creates a client with the global flags applied and connects it.
+func connect(ctx context.Context, auth iotdevice.ClientOption) (*iotdevice.Client, error) {
+	mk, ok := transports[transportFlag]
+	if !ok {
+		return nil, fmt.Errorf("unknown transport %q", transportFlag)
+	}
+	t, err := mk()
+	if err != nil {
+		return nil, err
+	}
+	opts := []iotdevice.ClientOption{
+		iotdevice.WithDebug(debugFlag),
+		iotdevice.WithLogger(mklog("[iothub] ")),
+		iotdevice.WithTransport(t),
+		auth,
+	}
+	if gatewayFlag != "" {
+		opts = append(opts, iotdevice.WithGatewayHostName(gatewayFlag))
+	}
+	if caFileFlag != "" {
+		opts = append(opts, iotdevice.WithTrustBundleFromFile(caFileFlag))
+	}
+	c, err := iotdevice.NewClient(opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Connect(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
 // mklog enables logging only when debug mode is on
 func mklog(prefix string) *log.Logger {
 	if !debugFlag {
@@ -278,19 +363,10 @@ func twin(ctx context.Context, _ *flag.FlagSet, c *iotdevice.Client) error {
 		return err
 	}
 
-	b, err := json.Marshal(desired)
-	if err != nil {
-		return err
-	}
-	fmt.Println("desired:  " + string(b))
-
-	b, err = json.Marshal(reported)
-	if err != nil {
-		return err
-	}
-	fmt.Println("reported: " + string(b))
-
-	return nil
+	return internal.OutputJSON(map[string]iotdevice.TwinState{
+		"desired":  desired,
+		"reported": reported,
+	}, compressFlag)
 }
 
 func updateTwin(ctx context.Context, f *flag.FlagSet, c *iotdevice.Client) error {
@@ -314,6 +390,62 @@ func updateTwin(ctx context.Context, f *flag.FlagSet, c *iotdevice.Client) error
 	if err != nil {
 		return err
 	}
-	fmt.Printf("version: %d\n", ver)
-	return nil
+	return internal.OutputJSON(map[string]int{"version": ver}, compressFlag)
+}
+
+func uploadFile(ctx context.Context, f *flag.FlagSet, c *iotdevice.Client) error {
+	if f.NArg() != 1 && f.NArg() != 2 {
+		return internal.ErrInvalidUsage
+	}
+	name := filepath.Base(f.Arg(0))
+	if f.NArg() == 2 {
+		name = f.Arg(1)
+	}
+	file, err := os.Open(f.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return c.UploadFile(ctx, name, file)
+}
+
+// token signs a token with the connection string's key,
+// it doesn't need to connect to the hub.
+func token(ctx context.Context, f *flag.FlagSet) error {
+	if f.NArg() != 0 {
+		return internal.ErrInvalidUsage
+	}
+	cs := internal.CurrentProfile().DeviceConnectionString
+	if cs == "" {
+		return errors.New("$DEVICE_CONNECTION_STRING is empty and no profile sets it")
+	}
+	parsed, err := common.ParseConnString(cs)
+	if err != nil {
+		return err
+	}
+	creds := parsed.Credentials()
+	if creds.DeviceID == "" {
+		return errors.New("DeviceId is blank")
+	}
+	if ttlFlag <= 0 {
+		return errors.New("ttl must be positive")
+	}
+	uri := creds.HostName + "/devices/" + url.PathEscape(creds.DeviceID)
+	if creds.ModuleID != "" {
+		uri += "/modules/" + url.PathEscape(creds.ModuleID)
+	}
+	sas, err := creds.SAS(uri, ttlFlag)
+	if err != nil {
+		return err
+	}
+	if !mqttFlag {
+		return internal.OutputLine(sas)
+	}
+	mc := internal.NewMQTTCredentials(creds.HostName, creds.DeviceID, creds.ModuleID, sas)
+	if gatewayFlag != "" {
+		mc.Host = gatewayFlag
+	} else if creds.GatewayHostName != "" {
+		mc.Host = creds.GatewayHostName
+	}
+	return internal.OutputJSON(mc, compressFlag)
 }
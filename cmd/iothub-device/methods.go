@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+
+	"github.com/goautomotive/iothub/cmd/internal"
+	"github.com/goautomotive/iothub/iotdevice"
+)
+
+var (
+	execFlag  string
+	shellFlag string
+)
+
+func watchMethodsFlags(f *flag.FlagSet) {
+	f.StringVar(&execFlag, "exec", "", "shell command handling all methods, {method} is replaced with the method name")
+	f.StringVar(&shellFlag, "shell", "sh", "shell the command is executed with")
+	f.BoolVar(&quiteFlag, "quite", false, "don't log invocations to STDERR")
+}
+
+// watchMethods responds to every direct method by running the -exec command,
+// the payload is piped to its STDIN, STDOUT is the response that's wrapped
+// into a json string when it's not valid json, a non-zero exit code makes
+// the status 500. Name of the method is also in $IOTHUB_METHOD_NAME.
+func watchMethods(ctx context.Context, f *flag.FlagSet, c *iotdevice.Client) error {
+	if f.NArg() != 0 || execFlag == "" {
+		return internal.ErrInvalidUsage
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	if err := c.HandleDefault(ctx, execMethod); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func execMethod(ctx context.Context, b []byte) (int, []byte, error) {
+	name := iotdevice.MethodName(ctx)
+	script := strings.Replace(execFlag, "{method}", shellQuote(name), -1)
+	rc, out, stderr, err := runMethod(ctx, shellFlag, script, name, b)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !quiteFlag {
+		fmt.Fprintf(os.Stderr, "%s(%s) = %d\n", name, b, rc)
+		if len(stderr) != 0 {
+			os.Stderr.Write(stderr)
+		}
+	}
+	return rc, out, nil
+}
+
+// runMethod executes script with the payload on STDIN and
+// turns its output into the method status and response.
+func runMethod(ctx context.Context, shell, script, name string, b []byte) (int, []byte, []byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, shell, "-c", script)
+	cmd.Env = append(os.Environ(), "IOTHUB_METHOD_NAME="+name)
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+
+	rc := 200
+	var ee *exec.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &ee):
+		rc, err = 500, nil
+	default:
+		return 0, nil, nil, err
+	}
+
+	out := bytes.TrimSpace(stdout.Bytes())
+	switch {
+	case len(out) == 0 && rc != 200:
+		out, err = json.Marshal(map[string]interface{}{
+			"error":    strings.TrimSpace(stderr.String()),
+			"exitCode": ee.ExitCode(),
+		})
+	case len(out) == 0:
+		out = []byte("null")
+	case !json.Valid(out):
+		out, err = json.Marshal(string(out))
+	}
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return rc, out, stderr.Bytes(), nil
+}
+
+// shellQuote quotes s for POSIX shells.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
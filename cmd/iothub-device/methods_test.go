@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+)
+
+func TestRunMethod(t *testing.T) {
+	t.Parallel()
+
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+	for _, tc := range []struct {
+		script string
+		rc     int
+		out    string
+	}{
+		{"cat", 200, `{"a":1}`},
+		{`echo "$IOTHUB_METHOD_NAME"`, 200, `"reboot"`},
+		{"true", 200, "null"},
+		{"echo failed >&2; exit 3", 500, `{"error":"failed","exitCode":3}`},
+		{"echo '[1]'; exit 1", 500, "[1]"},
+		{"echo " + shellQuote("it's"), 200, `"it's"`},
+	} {
+		rc, out, _, err := runMethod(context.Background(), "sh", tc.script, "reboot", []byte(`{"a":1}`))
+		if err != nil {
+			t.Errorf("%s: %s", tc.script, err)
+			continue
+		}
+		if rc != tc.rc || string(out) != tc.out {
+			t.Errorf("%s: result = %d %s, want %d %s", tc.script, rc, out, tc.rc, tc.out)
+		}
+	}
+
+	if _, _, _, err := runMethod(context.Background(), "no-such-shell", "true", "a", nil); err == nil {
+		t.Error("runMethod() with a missing shell = nil error")
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	t.Parallel()
+
+	for s, want := range map[string]string{
+		"reboot":   "'reboot'",
+		"it's":     `'it'\''s'`,
+		"$(x); y'": `'$(x); y'\'''`,
+	} {
+		if g := shellQuote(s); g != want {
+			t.Errorf("shellQuote(%q) = %s, want %s", s, g, want)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/goautomotive/iothub/cmd/internal"
+	"github.com/goautomotive/iothub/iotdevice"
+	"github.com/goautomotive/iothub/iotservice"
+)
+
+var (
+	intervalFlag        time.Duration
+	countFlag           int
+	payloadTemplateFlag string
+	devicesFlag         int
+	devicePrefixFlag    string
+	keepDevicesFlag     bool
+)
+
+func simulateFlags(f *flag.FlagSet) {
+	f.DurationVar(&intervalFlag, "interval", time.Second, "interval between messages of a device")
+	f.IntVar(&countFlag, "count", 0, "number of messages sent by each device, 0 means until interrupted")
+	f.StringVar(&payloadTemplateFlag, "payload-template", `{"seq":{{.Seq}}}`,
+		"payload text/template, supports {{.Seq}}, {{.DeviceID}}, {{.Time}}, {{rand MIN MAX}} and {{randf MIN MAX}}")
+	f.IntVar(&devicesFlag, "devices", 1, "number of simulated devices, more than one requires $SERVICE_CONNECTION_STRING")
+	f.StringVar(&devicePrefixFlag, "device-prefix", "simulated-", "simulated devices ids prefix")
+	f.BoolVar(&keepDevicesFlag, "keep", false, "do not delete simulated devices on exit")
+}
+
+// payloadData is passed to payload templates.
+type payloadData struct {
+	Seq      int
+	DeviceID string
+	Time     string // RFC3339
+}
+
+var payloadFuncs = template.FuncMap{
+	"rand": func(min, max int) int {
+		if max <= min {
+			return min
+		}
+		return min + rand.Intn(max-min+1)
+	},
+	"randf": func(min, max float64) string {
+		return strconv.FormatFloat(min+rand.Float64()*(max-min), 'f', 2, 64)
+	},
+}
+
+func parsePayloadTemplate(text string) (*template.Template, error) {
+	return template.New("payload").Funcs(payloadFuncs).Parse(text)
+}
+
+// simulate sends templated telemetry from the device of the connection
+// string or from a number of devices created for the simulation.
+func simulate(ctx context.Context, f *flag.FlagSet) error {
+	if f.NArg() != 0 {
+		return internal.ErrInvalidUsage
+	}
+	if intervalFlag <= 0 {
+		return errors.New("interval must be positive")
+	}
+	tpl, err := parsePayloadTemplate(payloadTemplateFlag)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	var sent, failed uint64
+	start := time.Now()
+	defer func() {
+		d := time.Since(start)
+		internal.OutputJSON(map[string]interface{}{
+			"sent":     atomic.LoadUint64(&sent),
+			"failed":   atomic.LoadUint64(&failed),
+			"duration": d.Round(time.Millisecond).String(),
+			"rate":     float64(atomic.LoadUint64(&sent)) / d.Seconds(),
+		}, compressFlag)
+	}()
+
+	run := func(ctx context.Context, c *iotdevice.Client) error {
+		defer c.Close()
+		return simulateDevice(ctx, c, tpl, &sent, &failed)
+	}
+	if devicesFlag <= 1 {
+		return wrap(func(ctx context.Context, _ *flag.FlagSet, c *iotdevice.Client) error {
+			return run(ctx, c)
+		})(ctx, f)
+	}
+
+	cs := internal.CurrentProfile().ServiceConnectionString
+	if cs == "" {
+		return errors.New("$SERVICE_CONNECTION_STRING is empty and no profile sets it")
+	}
+	sc, err := iotservice.NewClient(iotservice.WithConnectionString(cs))
+	if err != nil {
+		return err
+	}
+	defer sc.Close()
+
+	var wg sync.WaitGroup
+	errc := make(chan error, devicesFlag)
+	for i := 0; i < devicesFlag; i++ {
+		id := devicePrefixFlag + strconv.Itoa(i)
+		d, err := sc.CreateDevice(ctx, &iotservice.Device{DeviceID: id})
+		if err != nil {
+			return err
+		}
+		if !keepDevicesFlag {
+			// ctx may be canceled by the interrupt
+			defer sc.DeleteDevice(context.Background(), id)
+		}
+		dcs, err := sc.DeviceConnectionString(d, false)
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := connect(ctx, iotdevice.WithConnectionString(dcs))
+			if err != nil {
+				errc <- fmt.Errorf("%s: %s", id, err)
+				return
+			}
+			if err = run(ctx, c); err != nil {
+				errc <- fmt.Errorf("%s: %s", id, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errc)
+	return <-errc
+}
+
+// simulateDevice sends countFlag messages every intervalFlag,
+// sending errors are counted and printed to stderr.
+func simulateDevice(
+	ctx context.Context, c *iotdevice.Client,
+	tpl *template.Template, sent, failed *uint64,
+) error {
+	t := time.NewTicker(intervalFlag)
+	defer t.Stop()
+	var b bytes.Buffer
+	for seq := 0; countFlag == 0 || seq < countFlag; seq++ {
+		b.Reset()
+		if err := tpl.Execute(&b, &payloadData{
+			Seq:      seq,
+			DeviceID: c.DeviceID(),
+			Time:     time.Now().UTC().Format(time.RFC3339),
+		}); err != nil {
+			return err
+		}
+		if err := c.SendEvent(ctx, b.Bytes()); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			atomic.AddUint64(failed, 1)
+			fmt.Fprintf(os.Stderr, "%s: %s\n", c.DeviceID(), err)
+		} else {
+			atomic.AddUint64(sent, 1)
+		}
+		if countFlag != 0 && seq == countFlag-1 {
+			break
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return nil
+}
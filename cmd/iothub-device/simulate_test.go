@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPayloadTemplate(t *testing.T) {
+	t.Parallel()
+
+	tpl, err := parsePayloadTemplate(
+		`{"seq":{{.Seq}},"id":"{{.DeviceID}}","t":"{{.Time}}","n":{{rand 5 7}},"m":{{randf 1 2}},"k":{{rand 3 3}}}`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		var b bytes.Buffer
+		if err = tpl.Execute(&b, &payloadData{Seq: i, DeviceID: "dev", Time: "2020-01-01T00:00:00Z"}); err != nil {
+			t.Fatal(err)
+		}
+		g := b.String()
+		prefix := `{"seq":` + strconv.Itoa(i) + `,"id":"dev","t":"2020-01-01T00:00:00Z","n":`
+		if !strings.HasPrefix(g, prefix) || !strings.HasSuffix(g, `,"k":3}`) {
+			t.Fatalf("payload = %s", g)
+		}
+		var n int
+		var m float64
+		if _, err = fmt.Sscanf(strings.TrimPrefix(g, prefix), `%d,"m":%f`, &n, &m); err != nil {
+			t.Fatalf("payload = %s: %s", g, err)
+		}
+		if n < 5 || n > 7 || m < 1 || m > 2 {
+			t.Errorf("payload = %s, random values are out of range", g)
+		}
+	}
+
+	if _, err = parsePayloadTemplate("{{rand}"); err == nil {
+		t.Error("parsePayloadTemplate() of a malformed template = nil error")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/goautomotive/iothub/cmd/internal"
+	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/iotservice"
+)
+
+var (
+	tagsFlag bool
+)
+
+func editTwinFlags(f *flag.FlagSet) {
+	f.BoolVar(&tagsFlag, "tags", false, "edit tags instead of desired properties")
+}
+
+// editTwin opens the twin's desired properties or tags in $EDITOR and
+// patches only the changed keys, the patch is conditional on the fetched
+// etag so edits made by somebody else in the meantime are not overwritten.
+func editTwin(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
+	if f.NArg() != 1 {
+		return internal.ErrInvalidUsage
+	}
+	t, err := c.GetTwin(ctx, f.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	var orig map[string]interface{}
+	if tagsFlag {
+		orig = t.Tags
+	} else if t.Properties != nil {
+		orig = make(map[string]interface{}, len(t.Properties.Desired))
+		for k, v := range t.Properties.Desired {
+			// read-only system properties
+			if k == "$metadata" || k == "$version" {
+				continue
+			}
+			orig[k] = v
+		}
+	}
+	if orig == nil {
+		orig = map[string]interface{}{}
+	}
+
+	edited, err := editJSON(orig)
+	if err != nil {
+		return err
+	}
+	patch := internal.MergePatch(orig, edited)
+	if len(patch) == 0 {
+		fmt.Fprintln(os.Stderr, "no changes")
+		return nil
+	}
+	for _, p := range internal.PatchPaths(patch) {
+		fmt.Fprintf(os.Stderr, "changed: %s\n", p)
+	}
+
+	upd := &iotservice.Twin{ETag: t.ETag}
+	if tagsFlag {
+		upd.Tags = patch
+	} else {
+		upd.Properties = &iotservice.Properties{Desired: patch}
+	}
+	t, err = c.UpdateTwin(ctx, f.Arg(0), upd, "")
+	if err != nil {
+		if errors.Is(err, common.ErrPreconditionFailed) {
+			return errors.New("twin was modified concurrently, changes are not applied")
+		}
+		return err
+	}
+	return internal.OutputJSON(t, compressFlag)
+}
+
+// editJSON writes v to a temporary file, runs the user's editor on it
+// and decodes the result, the editor is $VISUAL, $EDITOR or vi.
+func editJSON(v map[string]interface{}) (map[string]interface{}, error) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile("", "iothub-twin-*.json")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err = tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	args := strings.Fields(editor) // e.g. "code --wait"
+	cmd := exec.Command(args[0], append(args[1:], tmp.Name())...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %s", editor, err)
+	}
+
+	b, err = ioutil.ReadFile(tmp.Name())
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err = json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("edited twin is not a json object: %s", err)
+	}
+	if m == nil {
+		m = map[string]interface{}{}
+	}
+	return m, nil
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/goautomotive/iothub/cmd/internal"
+	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/iotservice"
+)
+
+var (
+	fileFlag   string
+	formatFlag string
+)
+
+func importFlags(f *flag.FlagSet) {
+	f.StringVar(&fileFlag, "file", "", "CSV or JSON file with devices, - reads STDIN")
+	f.StringVar(&formatFlag, "format", "", "file format <csv|json>, detected by the file extension by default")
+	f.IntVar(&concurrencyFlag, "concurrency", 4, "number of devices imported in parallel")
+}
+
+// importRow is a device identity to create or update, CSV files have a
+// header with the same column names, tags are either a json object in
+// the tags column or plain strings in tags.NAME columns.
+type importRow struct {
+	DeviceID            string                 `json:"deviceId"`
+	Status              string                 `json:"status,omitempty"`
+	PrimaryKey          string                 `json:"primaryKey,omitempty"`
+	SecondaryKey        string                 `json:"secondaryKey,omitempty"`
+	PrimaryThumbprint   string                 `json:"primaryThumbprint,omitempty"`
+	SecondaryThumbprint string                 `json:"secondaryThumbprint,omitempty"`
+	CA                  bool                   `json:"ca,omitempty"`
+	Edge                bool                   `json:"edge,omitempty"`
+	Tags                map[string]interface{} `json:"tags,omitempty"`
+
+	row int // starting from 1, CSV header is not counted
+}
+
+// importResult is a row of the error report.
+type importResult struct {
+	Row      int    `json:"row"`
+	DeviceID string `json:"deviceId"`
+	Error    string `json:"error"`
+}
+
+func importFile(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
+	if f.NArg() != 0 || fileFlag == "" {
+		return internal.ErrInvalidUsage
+	}
+	if concurrencyFlag < 1 {
+		return errors.New("concurrency must be positive")
+	}
+	rows, err := readImportFile(fileFlag, formatFlag)
+	if err != nil {
+		return err
+	}
+
+	var (
+		mu     sync.Mutex
+		done   int
+		failed []*importResult
+	)
+	bar := newProgressBar(len(rows))
+	sem := make(chan struct{}, concurrencyFlag)
+	var wg sync.WaitGroup
+	for _, r := range rows {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(r *importRow) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			err := importDevice(ctx, c, r)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed = append(failed, &importResult{
+					Row:      r.row,
+					DeviceID: r.DeviceID,
+					Error:    err.Error(),
+				})
+			}
+			done++
+			bar.draw(done)
+		}(r)
+	}
+	wg.Wait()
+	bar.finish()
+
+	fmt.Fprintf(os.Stderr, "imported %d of %d devices\n", len(rows)-len(failed), len(rows))
+	if len(failed) == 0 {
+		return nil
+	}
+	sort.Slice(failed, func(i, j int) bool {
+		return failed[i].Row < failed[j].Row
+	})
+	if err = internal.OutputJSON(failed, compressFlag); err != nil {
+		return err
+	}
+	return &internal.ExitError{
+		Code: 2,
+		Err:  fmt.Errorf("%d rows failed", len(failed)),
+	}
+}
+
+// importDevice creates the device or updates it when it already exists,
+// then merges tags into its twin.
+func importDevice(ctx context.Context, c *iotservice.Client, r *importRow) error {
+	a, err := r.authentication()
+	if err != nil {
+		return err
+	}
+	d := &iotservice.Device{
+		DeviceID:       r.DeviceID,
+		Status:         r.Status,
+		Authentication: a,
+	}
+	if r.Edge {
+		d.Capabilities = map[string]interface{}{"iotEdge": true}
+	}
+	if _, err = c.CreateDevice(ctx, d); err != nil {
+		if !errors.Is(err, common.ErrDeviceAlreadyExists) {
+			return err
+		}
+		cur, err := c.GetDevice(ctx, r.DeviceID)
+		if err != nil {
+			return err
+		}
+		if r.Status != "" {
+			cur.Status = r.Status
+		}
+		if a != nil {
+			cur.Authentication = a
+		}
+		if r.Edge {
+			cur.Capabilities = d.Capabilities
+		}
+		if _, err = c.UpdateDevice(ctx, cur); err != nil {
+			return err
+		}
+	}
+	if len(r.Tags) == 0 {
+		return nil
+	}
+	_, err = c.UpdateTwin(ctx, r.DeviceID, &iotservice.Twin{
+		Tags: r.Tags,
+	}, "*")
+	return err
+}
+
+// authentication returns nil when no credentials are given
+// so new devices get keys generated by the hub.
+func (r *importRow) authentication() (*iotservice.Authentication, error) {
+	var n int
+	var a *iotservice.Authentication
+	if r.PrimaryKey != "" || r.SecondaryKey != "" {
+		n++
+		a = iotservice.NewSASAuthentication(r.PrimaryKey, r.SecondaryKey)
+	}
+	if r.PrimaryThumbprint != "" || r.SecondaryThumbprint != "" {
+		n++
+		a = &iotservice.Authentication{
+			Type: iotservice.AuthSelfSigned,
+			X509Thumbprint: &iotservice.X509Thumbprint{
+				PrimaryThumbprint:   r.PrimaryThumbprint,
+				SecondaryThumbprint: r.SecondaryThumbprint,
+			},
+		}
+	}
+	if r.CA {
+		n++
+		a = &iotservice.Authentication{Type: iotservice.AuthCA}
+	}
+	if n > 1 {
+		return nil, errors.New("more than one authentication type provided")
+	}
+	return a, nil
+}
+
+func readImportFile(name, format string) ([]*importRow, error) {
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(name)) {
+		case ".json":
+			format = "json"
+		default:
+			format = "csv"
+		}
+	}
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var rows []*importRow
+	var err error
+	switch format {
+	case "csv":
+		rows, err = readImportCSV(r)
+	case "json":
+		rows, err = readImportJSON(r)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	seen := make(map[string]int, len(rows))
+	for _, r := range rows {
+		if r.DeviceID == "" {
+			return nil, fmt.Errorf("%s: row %d: deviceId is empty", name, r.row)
+		}
+		if n, ok := seen[r.DeviceID]; ok {
+			return nil, fmt.Errorf("%s: row %d: device %q is already defined in row %d",
+				name, r.row, r.DeviceID, n)
+		}
+		seen[r.DeviceID] = r.row
+	}
+	return rows, nil
+}
+
+func readImportJSON(r io.Reader) ([]*importRow, error) {
+	var rows []*importRow
+	if err := json.NewDecoder(r).Decode(&rows); err != nil {
+		return nil, err
+	}
+	for i, r := range rows {
+		if r == nil {
+			return nil, fmt.Errorf("row %d: null device", i+1)
+		}
+		r.row = i + 1
+	}
+	return rows, nil
+}
+
+func readImportCSV(r io.Reader) ([]*importRow, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	for _, col := range header {
+		if _, ok := csvColumns[col]; !ok && !strings.HasPrefix(col, "tags.") {
+			return nil, fmt.Errorf("unknown column %q", col)
+		}
+	}
+
+	var rows []*importRow
+	for {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return rows, nil
+		} else if err != nil {
+			return nil, err
+		}
+		row := &importRow{row: len(rows) + 1}
+		for i, col := range header {
+			if rec[i] == "" {
+				continue
+			}
+			if strings.HasPrefix(col, "tags.") {
+				if row.Tags == nil {
+					row.Tags = map[string]interface{}{}
+				}
+				row.Tags[strings.TrimPrefix(col, "tags.")] = rec[i]
+				continue
+			}
+			if err = csvColumns[col](row, rec[i]); err != nil {
+				return nil, fmt.Errorf("row %d: %s: %s", row.row, col, err)
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+// csvColumns sets importRow fields from CSV values.
+var csvColumns = map[string]func(r *importRow, v string) error{
+	"deviceId":            func(r *importRow, v string) error { r.DeviceID = v; return nil },
+	"status":              func(r *importRow, v string) error { r.Status = v; return nil },
+	"primaryKey":          func(r *importRow, v string) error { r.PrimaryKey = v; return nil },
+	"secondaryKey":        func(r *importRow, v string) error { r.SecondaryKey = v; return nil },
+	"primaryThumbprint":   func(r *importRow, v string) error { r.PrimaryThumbprint = v; return nil },
+	"secondaryThumbprint": func(r *importRow, v string) error { r.SecondaryThumbprint = v; return nil },
+	"ca": func(r *importRow, v string) (err error) {
+		r.CA, err = strconv.ParseBool(v)
+		return err
+	},
+	"edge": func(r *importRow, v string) (err error) {
+		r.Edge, err = strconv.ParseBool(v)
+		return err
+	},
+	"tags": func(r *importRow, v string) error {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(v), &m); err != nil {
+			return err
+		}
+		if r.Tags == nil {
+			r.Tags = m
+			return nil
+		}
+		for k, v := range m {
+			r.Tags[k] = v
+		}
+		return nil
+	},
+}
+
+// progressBar is drawn to STDERR only when it's a terminal,
+// so it doesn't pollute logs and pipes.
+type progressBar struct {
+	total int
+	tty   bool
+}
+
+func newProgressBar(total int) *progressBar {
+	fi, err := os.Stderr.Stat()
+	return &progressBar{
+		total: total,
+		tty:   err == nil && fi.Mode()&os.ModeCharDevice != 0,
+	}
+}
+
+const progressWidth = 40
+
+func (b *progressBar) draw(n int) {
+	if !b.tty || b.total == 0 {
+		return
+	}
+	w := progressWidth * n / b.total
+	fmt.Fprintf(os.Stderr, "\r[%s%s] %d/%d",
+		strings.Repeat("=", w), strings.Repeat(" ", progressWidth-w), n, b.total)
+}
+
+func (b *progressBar) finish() {
+	if b.tty && b.total != 0 {
+		fmt.Fprintln(os.Stderr)
+	}
+}
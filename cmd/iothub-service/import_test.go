@@ -0,0 +1,100 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/goautomotive/iothub/iotservice"
+)
+
+func TestReadImportFile(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	write := func(name, s string) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	want := []*importRow{
+		{DeviceID: "a", Status: "disabled", PrimaryKey: "a2V5", Tags: map[string]interface{}{
+			"env": "prod", "site": "x",
+		}, row: 1},
+		{DeviceID: "b", CA: true, Edge: true, row: 2},
+	}
+
+	for _, tc := range []struct {
+		name, format, data string
+	}{
+		{"devices.csv", "", "" +
+			"deviceId, status, primaryKey, ca, edge, tags, tags.site\n" +
+			`a, disabled, a2V5, , , "{""env"":""prod""}", x` + "\n" +
+			"b, , , true, 1, , \n"},
+		{"devices.JSON", "", `[
+			{"deviceId":"a","status":"disabled","primaryKey":"a2V5","tags":{"env":"prod","site":"x"}},
+			{"deviceId":"b","ca":true,"edge":true}
+		]`},
+		{"devices.txt", "json", `[
+			{"deviceId":"a","status":"disabled","primaryKey":"a2V5","tags":{"env":"prod","site":"x"}},
+			{"deviceId":"b","ca":true,"edge":true}
+		]`},
+	} {
+		rows, err := readImportFile(write(tc.name, tc.data), tc.format)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(rows, want) {
+			t.Errorf("%s: rows = %+v, want %+v", tc.name, rows, want)
+		}
+	}
+
+	for _, tc := range []struct {
+		name, format, data, err string
+	}{
+		{"column.csv", "", "deviceId,color\na,red\n", `unknown column "color"`},
+		{"bool.csv", "", "deviceId,ca\na,maybe\n", "row 1: ca:"},
+		{"dup.csv", "", "deviceId\na\nb\na\n", `row 3: device "a" is already defined in row 1`},
+		{"blank.json", "", `[{"deviceId":"a"},{"status":"enabled"}]`, "row 2: deviceId is empty"},
+		{"null.json", "", `[null]`, "row 1: null device"},
+		{"devices.xml", "xml", "", `unknown format "xml"`},
+	} {
+		_, err := readImportFile(write(tc.name, tc.data), tc.format)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: error = %v, want %q", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestImportRowAuthentication(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		row  importRow
+		want iotservice.AuthType
+	}{
+		{importRow{}, ""},
+		{importRow{SecondaryKey: "a2V5"}, iotservice.AuthSAS},
+		{importRow{PrimaryThumbprint: "aa"}, iotservice.AuthSelfSigned},
+		{importRow{CA: true}, iotservice.AuthCA},
+	} {
+		a, err := tc.row.authentication()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a == nil && tc.want != "" || a != nil && a.Type != tc.want {
+			t.Errorf("authentication(%+v) = %+v, want %s", tc.row, a, tc.want)
+		}
+	}
+
+	r := &importRow{PrimaryKey: "a2V5", CA: true}
+	if _, err := r.authentication(); err == nil {
+		t.Error("authentication() with keys and CA = nil error")
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/goautomotive/iothub/cmd/internal"
+	"github.com/goautomotive/iothub/iotservice"
+)
+
+var (
+	methodFlag       string
+	startFlag        string
+	maxExecutionFlag time.Duration
+	jobDevicesFlag   bool
+	jobTypeFlag      string
+	jobStatusFlag    string
+)
+
+func jobCreateFlags(f *flag.FlagSet) {
+	f.StringVar(&methodFlag, "method", "", "call the named direct method instead of updating twins")
+	f.StringVar(&payloadFlag, "payload", "{}", "method JSON payload, @FILE reads it from the file, - from STDIN")
+	f.IntVar(&connectTimeoutFlag, "c", 0, "method connect timeout in seconds")
+	f.IntVar(&responseTimeoutFlag, "r", 30, "method response timeout in seconds")
+	f.StringVar(&startFlag, "start", "", "start time in RFC3339 format, immediately by default")
+	f.DurationVar(&maxExecutionFlag, "max-execution-time", 0, "maximum job running time")
+	f.BoolVar(&waitFlag, "wait", false, "wait for the job to finish and print per-device results")
+}
+
+func jobShowFlags(f *flag.FlagSet) {
+	f.BoolVar(&jobDevicesFlag, "devices", false, "print per-device results")
+	f.BoolVar(&waitFlag, "wait", false, "wait for the job to finish and print per-device results")
+}
+
+func jobListFlags(f *flag.FlagSet) {
+	f.StringVar(&jobTypeFlag, "type", "", "show only jobs of the type <twin|method>")
+	f.StringVar(&jobStatusFlag, "status", "", "show only jobs with the status, e.g. running")
+}
+
+// jobCreate schedules a desired twin update or, when -method is set,
+// a direct method call on devices matching the query condition.
+func jobCreate(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
+	opts, err := scheduleOptions(startFlag, maxExecutionFlag)
+	if err != nil {
+		return err
+	}
+
+	var job *iotservice.ScheduledJob
+	if methodFlag == "" {
+		if f.NArg() < 4 {
+			return internal.ErrInvalidUsage
+		}
+		var twin *iotservice.Twin
+		if twin, err = desiredTwin(f.Args()[2:]); err != nil {
+			return err
+		}
+		if job, err = c.ScheduleTwinUpdate(ctx, f.Arg(0), f.Arg(1), twin, opts...); err != nil {
+			return err
+		}
+	} else {
+		if f.NArg() != 2 {
+			return internal.ErrInvalidUsage
+		}
+		b, err := internal.ReadPayload(payloadFlag)
+		if err != nil {
+			return err
+		}
+		call, err := newMethodCall(methodFlag, b, connectTimeoutFlag, responseTimeoutFlag)
+		if err != nil {
+			return err
+		}
+		if job, err = c.ScheduleMethodCall(ctx, f.Arg(0), f.Arg(1), call, opts...); err != nil {
+			return err
+		}
+	}
+	return outputScheduledJob(ctx, c, job)
+}
+
+// scheduleOptions parses the job start time and
+// maximum execution time flags, both are optional.
+func scheduleOptions(start string, maxExecution time.Duration) ([]iotservice.ScheduleOption, error) {
+	var opts []iotservice.ScheduleOption
+	if start != "" {
+		t, err := time.Parse(time.RFC3339, start)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, iotservice.WithScheduleStartTime(t))
+	}
+	if maxExecution != 0 {
+		opts = append(opts, iotservice.WithScheduleMaxExecutionTime(maxExecution))
+	}
+	return opts, nil
+}
+
+// newMethodCall makes the direct method call of a job, payload is json.
+func newMethodCall(name string, payload []byte, connectTimeout, responseTimeout int) (*iotservice.MethodCall, error) {
+	call := &iotservice.MethodCall{MethodName: name}
+	if err := json.Unmarshal(payload, &call.Payload); err != nil {
+		return nil, fmt.Errorf("payload: %s", err)
+	}
+	for _, opt := range []iotservice.CallOption{
+		iotservice.WithCallConnectTimeout(connectTimeout),
+		iotservice.WithCallResponseTimeout(responseTimeout),
+	} {
+		if err := opt(call); err != nil {
+			return nil, err
+		}
+	}
+	return call, nil
+}
+
+func jobShow(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
+	if f.NArg() != 1 {
+		return internal.ErrInvalidUsage
+	}
+	job, err := c.ScheduledJobStatus(ctx, f.Arg(0))
+	if err != nil {
+		return err
+	}
+	return outputScheduledJob(ctx, c, job)
+}
+
+func jobCancel(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
+	if f.NArg() != 1 {
+		return internal.ErrInvalidUsage
+	}
+	job, err := c.CancelScheduledJob(ctx, f.Arg(0))
+	if err != nil {
+		return err
+	}
+	return internal.OutputJSON(job, compressFlag)
+}
+
+func jobList(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
+	if f.NArg() != 0 {
+		return internal.ErrInvalidUsage
+	}
+	typ, err := parseJobType(jobTypeFlag)
+	if err != nil {
+		return err
+	}
+	l, err := c.ListScheduledJobs(ctx, typ, jobStatusFlag)
+	if err != nil {
+		return err
+	}
+	return internal.OutputJSON(l, compressFlag)
+}
+
+// parseJobType converts the -type flag value into a job type, blank matches any.
+func parseJobType(s string) (string, error) {
+	switch s {
+	case "":
+		return "", nil
+	case "twin":
+		return iotservice.JobTypeScheduleUpdateTwin, nil
+	case "method":
+		return iotservice.JobTypeScheduleDeviceMethod, nil
+	default:
+		return "", fmt.Errorf("unknown job type %q", s)
+	}
+}
+
+// scheduledJobResult is a scheduled job with per-device results.
+type scheduledJobResult struct {
+	*iotservice.ScheduledJob
+	Devices []*iotservice.DeviceJob `json:"devices,omitempty"`
+}
+
+// outputScheduledJob prints the job waiting for it to finish when -wait
+// is set, then it exits with 2 when the job failed on any of devices.
+func outputScheduledJob(ctx context.Context, c *iotservice.Client, job *iotservice.ScheduledJob) error {
+	if !waitFlag && !jobDevicesFlag {
+		return internal.OutputJSON(job, compressFlag)
+	}
+	if waitFlag {
+		var err error
+		job, err = c.WaitScheduledJob(ctx, job.JobID, 5*time.Second)
+		if err != nil {
+			return err
+		}
+	}
+	devices, err := c.ScheduledJobDevices(ctx, job.JobID)
+	if err != nil {
+		return err
+	}
+	if err = internal.OutputJSON(&scheduledJobResult{
+		ScheduledJob: job,
+		Devices:      devices,
+	}, compressFlag); err != nil {
+		return err
+	}
+	if !waitFlag {
+		return nil
+	}
+	if jobFailed(job) {
+		return &internal.ExitError{
+			Code: 2,
+			Err:  fmt.Errorf("job %s failed", job.JobID),
+		}
+	}
+	return nil
+}
+
+// jobFailed reports whether the job failed on the whole or on any of devices.
+func jobFailed(job *iotservice.ScheduledJob) bool {
+	return job.Status == iotservice.JobStatusFailed ||
+		job.DeviceJobStatistics != nil && job.DeviceJobStatistics.FailedCount != 0
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/goautomotive/iothub/iotservice"
+)
+
+func TestScheduleOptions(t *testing.T) {
+	t.Parallel()
+
+	opts, err := scheduleOptions("2020-01-02T03:04:05+01:00", 90*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := &iotservice.ScheduledJob{}
+	for _, opt := range opts {
+		opt(job)
+	}
+	if job.StartTime != "2020-01-02T02:04:05Z" || job.MaxExecutionTimeInSeconds != 90 {
+		t.Errorf("job = %+v", job)
+	}
+
+	if opts, err = scheduleOptions("", 0); err != nil || len(opts) != 0 {
+		t.Errorf("scheduleOptions() without flags = %d options, %v", len(opts), err)
+	}
+	if _, err = scheduleOptions("tomorrow", 0); err == nil {
+		t.Error("scheduleOptions() with malformed start = nil error")
+	}
+}
+
+func TestNewMethodCall(t *testing.T) {
+	t.Parallel()
+
+	call, err := newMethodCall("reboot", []byte(`{"delay":1}`), 5, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &iotservice.MethodCall{
+		MethodName:      "reboot",
+		ConnectTimeout:  5,
+		ResponseTimeout: 30,
+		Payload:         map[string]interface{}{"delay": 1.0},
+	}
+	if !reflect.DeepEqual(call, want) {
+		t.Errorf("newMethodCall() = %+v, want %+v", call, want)
+	}
+	if _, err = newMethodCall("reboot", []byte("[1]"), 0, 30); err == nil {
+		t.Error("newMethodCall() with non-object payload = nil error")
+	}
+}
+
+func TestParseJobType(t *testing.T) {
+	t.Parallel()
+
+	for s, want := range map[string]string{
+		"":       "",
+		"twin":   iotservice.JobTypeScheduleUpdateTwin,
+		"method": iotservice.JobTypeScheduleDeviceMethod,
+	} {
+		if g, err := parseJobType(s); err != nil || g != want {
+			t.Errorf("parseJobType(%q) = %q, %v, want %q", s, g, err, want)
+		}
+	}
+	if _, err := parseJobType("export"); err == nil {
+		t.Error("parseJobType(export) = nil error")
+	}
+}
+
+func TestJobFailed(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		job  *iotservice.ScheduledJob
+		want bool
+	}{
+		{&iotservice.ScheduledJob{Status: iotservice.JobStatusCompleted}, false},
+		{&iotservice.ScheduledJob{Status: iotservice.JobStatusFailed}, true},
+		{&iotservice.ScheduledJob{
+			Status:              iotservice.JobStatusCompleted,
+			DeviceJobStatistics: &iotservice.DeviceJobStats{FailedCount: 1},
+		}, true},
+	} {
+		if g := jobFailed(tc.job); g != tc.want {
+			t.Errorf("jobFailed(%+v) = %t, want %t", tc.job, g, tc.want)
+		}
+	}
+}
+
+func TestDesiredTwin(t *testing.T) {
+	t.Parallel()
+
+	twin, err := desiredTwin([]string{"a", "1", "b", "null"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]interface{}{"a": "1", "b": nil}; !reflect.DeepEqual(twin.Properties.Desired, want) {
+		t.Errorf("desired = %v, want %v", twin.Properties.Desired, want)
+	}
+	if _, err = desiredTwin([]string{"a"}); err == nil {
+		t.Error("desiredTwin() with odd arguments = nil error")
+	}
+}
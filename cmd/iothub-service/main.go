@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/url"
 	"os"
@@ -33,9 +36,18 @@ var (
 	cidFlag             string
 	expFlag             time.Duration
 	ackFlag             string
+	waitFeedbackFlag    time.Duration
 	connectTimeoutFlag  int
 	responseTimeoutFlag int
 
+	// broadcast
+	concurrencyFlag int
+
+	// call
+	moduleFlag  string
+	payloadFlag string
+	timeoutFlag time.Duration
+
 	// create device
 	autoGenerateFlag bool
 
@@ -46,13 +58,25 @@ var (
 	secondaryThumbprintFlag string
 	caFlag                  bool
 
-	// sas and connection string
+	// sas, token and connection string
 	secondaryFlag bool
+	deviceFlag    string
+
+	// token
+	ttlFlag  time.Duration
+	mqttFlag bool
 
 	// sas
 	uriFlag      string
 	durationFlag time.Duration
 
+	// import/export devices
+	excludeKeysFlag bool
+	waitFlag        bool
+
+	// query
+	pageSizeFlag int
+
 	// watch events
 	ehcsFlag string
 	ehcgFlag string
@@ -63,12 +87,16 @@ func main() {
 		if err != internal.ErrInvalidUsage {
 			fmt.Fprintf(os.Stderr, "error: %s\n", err)
 		}
+		var e *internal.ExitError
+		if errors.As(err, &e) {
+			os.Exit(e.Code)
+		}
 		os.Exit(1)
 	}
 }
 
 const help = `Helps with interacting and managing your iothub devices. 
-The $SERVICE_CONNECTION_STRING environment variable is required for authentication.`
+The $SERVICE_CONNECTION_STRING environment variable or a config file profile is required for authentication.`
 
 func run() error {
 	cli, err := internal.New(help, func(f *flag.FlagSet) {
@@ -86,6 +114,19 @@ func run() error {
 				f.StringVar(&midFlag, "mid", "", "identifier for the message")
 				f.StringVar(&cidFlag, "cid", "", "message identifier in a request-reply")
 				f.DurationVar(&expFlag, "exp", 0, "message lifetime")
+				f.DurationVar(&waitFeedbackFlag, "wait-feedback", 0, "wait for the delivery feedback requested with -ack up to the duration")
+			},
+		},
+		{
+			"broadcast", "bc",
+			"PAYLOAD DEVICE...",
+			"send the same message to all the named devices (C2D)",
+			wrap(broadcast),
+			func(f *flag.FlagSet) {
+				f.StringVar(&ackFlag, "ack", "", "type of ack feedback")
+				f.StringVar(&uidFlag, "uid", "golang-iothub", "origin of the message")
+				f.DurationVar(&expFlag, "exp", 0, "message lifetime")
+				f.IntVar(&concurrencyFlag, "concurrency", 4, "number of batches sent in parallel")
 			},
 		},
 		{
@@ -97,6 +138,18 @@ func run() error {
 				f.StringVar(&ehcgFlag, "ehcg", "$Default", "eventhub consumer group")
 			},
 		},
+		{
+			"watch", "w",
+			"DEVICE", "print twin changes and lifecycle events of the named device",
+			wrap(watch),
+			watchFlags,
+		},
+		{
+			"monitor-events", "me",
+			"", "stream decoded device messages (D2C) matching the filters",
+			wrap(monitorEvents),
+			monitorFlags,
+		},
 		{
 			"watch-feedback", "wf",
 			"", "monitor message feedback send by devices",
@@ -104,68 +157,194 @@ func run() error {
 			nil,
 		},
 		{
-			"call", "c",
-			"DEVICE METHOD PAYLOAD", "call a direct method on a device",
-			wrap(call),
-			func(f *flag.FlagSet) {
-				f.IntVar(&connectTimeoutFlag, "c", 0, "connect timeout in seconds")
-				f.IntVar(&responseTimeoutFlag, "r", 30, "response timeout in seconds")
-			},
-		},
-		{
-			"device", "d",
-			"DEVICE", "get device information",
-			wrap(device),
+			"purge-queue", "pq",
+			"DEVICE", "delete pending cloud-to-device messages of the named device",
+			wrap(purgeQueue),
 			nil,
 		},
 		{
-			"devices", "ds",
-			"", "list all available devices",
-			wrap(devices),
+			"watch-file-notifications", "wfn",
+			"", "monitor files uploaded by devices",
+			wrap(watchFileNotifications),
 			nil,
 		},
 		{
-			"create-device", "cd",
-			"DEVICE", "creates a new device",
-			wrap(createDevice),
+			"call", "c",
+			"DEVICE METHOD [PAYLOAD]", "call a direct method on a device, exits with 2 when the status is not 200",
+			wrap(call),
 			func(f *flag.FlagSet) {
-				f.BoolVar(&autoGenerateFlag, "auto", false, "auto generate keys")
-				f.StringVar(&primaryKeyFlag, "primary-key", "", "primary key (base64)")
-				f.StringVar(&secondaryKeyFlag, "secondary-key", "", "secondary key (base64)")
-				f.StringVar(&primaryThumbprintFlag, "primary-thumbprint", "", "x509 primary thumbprint")
-				f.StringVar(&secondaryThumbprintFlag, "secondary-thumbprint", "", "x509 secondary thumbprint")
-				f.BoolVar(&caFlag, "ca", false, "use certificate authority authentication")
+				f.IntVar(&connectTimeoutFlag, "c", 0, "connect timeout in seconds")
+				f.IntVar(&responseTimeoutFlag, "r", 30, "response timeout in seconds")
+				f.DurationVar(&timeoutFlag, "timeout", 0, "response timeout, overrides -r")
+				f.StringVar(&moduleFlag, "module", "", "call the method on the named module")
+				f.StringVar(&payloadFlag, "payload", "", "JSON payload, @FILE reads it from the file, - from STDIN")
 			},
 		},
-		{
-			"update-device", "ud",
-			"DEVICE", "updates the named device",
-			wrap(updateDevice),
-			func(f *flag.FlagSet) {
-				f.StringVar(&primaryKeyFlag, "primary-key", "", "primary key (base64)")
-				f.StringVar(&secondaryKeyFlag, "secondary-key", "", "secondary key (base64)")
-				f.StringVar(&primaryThumbprintFlag, "primary-thumbprint", "", "x509 primary thumbprint")
-				f.StringVar(&secondaryThumbprintFlag, "secondary-thumbprint", "", "x509 secondary thumbprint")
-				f.BoolVar(&caFlag, "ca", false, "use certificate authority authentication")
+		internal.Group(
+			"device", "d",
+			"manage device identities", "get",
+			[]*internal.Command{
+				{
+					"get", "g",
+					"DEVICE", "get device information",
+					wrap(device),
+					nil,
+				},
+				{
+					"list", "ls",
+					"", "list all available devices",
+					wrap(devices),
+					nil,
+				},
+				{
+					"create", "c",
+					"DEVICE", "creates a new device",
+					wrap(createDevice),
+					func(f *flag.FlagSet) {
+						f.BoolVar(&autoGenerateFlag, "auto", false, "auto generate keys")
+						f.StringVar(&primaryKeyFlag, "primary-key", "", "primary key (base64)")
+						f.StringVar(&secondaryKeyFlag, "secondary-key", "", "secondary key (base64)")
+						f.StringVar(&primaryThumbprintFlag, "primary-thumbprint", "", "x509 primary thumbprint")
+						f.StringVar(&secondaryThumbprintFlag, "secondary-thumbprint", "", "x509 secondary thumbprint")
+						f.BoolVar(&caFlag, "ca", false, "use certificate authority authentication")
+					},
+				},
+				{
+					"update", "u",
+					"DEVICE", "updates the named device",
+					wrap(updateDevice),
+					func(f *flag.FlagSet) {
+						f.StringVar(&primaryKeyFlag, "primary-key", "", "primary key (base64)")
+						f.StringVar(&secondaryKeyFlag, "secondary-key", "", "secondary key (base64)")
+						f.StringVar(&primaryThumbprintFlag, "primary-thumbprint", "", "x509 primary thumbprint")
+						f.StringVar(&secondaryThumbprintFlag, "secondary-thumbprint", "", "x509 secondary thumbprint")
+						f.BoolVar(&caFlag, "ca", false, "use certificate authority authentication")
+					},
+				},
+				{
+					"delete", "rm",
+					"DEVICE", "delete the named device",
+					wrap(deleteDevice),
+					nil,
+				},
 			},
-		},
+		),
+		internal.Group(
+			"module", "m",
+			"manage module identities", "get",
+			[]*internal.Command{
+				{
+					"get", "g",
+					"DEVICE MODULE", "get module information",
+					wrap(module),
+					nil,
+				},
+				{
+					"list", "ls",
+					"DEVICE", "list modules of the named device",
+					wrap(modules),
+					nil,
+				},
+				{
+					"create", "c",
+					"DEVICE MODULE", "creates a new module on the named device",
+					wrap(createModule),
+					func(f *flag.FlagSet) {
+						f.BoolVar(&autoGenerateFlag, "auto", false, "auto generate keys")
+						f.StringVar(&primaryKeyFlag, "primary-key", "", "primary key (base64)")
+						f.StringVar(&secondaryKeyFlag, "secondary-key", "", "secondary key (base64)")
+						f.StringVar(&primaryThumbprintFlag, "primary-thumbprint", "", "x509 primary thumbprint")
+						f.StringVar(&secondaryThumbprintFlag, "secondary-thumbprint", "", "x509 secondary thumbprint")
+						f.BoolVar(&caFlag, "ca", false, "use certificate authority authentication")
+					},
+				},
+				{
+					"delete", "rm",
+					"DEVICE MODULE", "delete the named module",
+					wrap(deleteModule),
+					nil,
+				},
+				{
+					"twin", "t",
+					"DEVICE MODULE", "inspect the named module twin",
+					wrap(moduleTwin),
+					nil,
+				},
+			},
+		),
+		internal.Group(
+			"configuration", "cf",
+			"manage automatic device configurations", "get",
+			[]*internal.Command{
+				{
+					"get", "g",
+					"ID", "inspect the named configuration",
+					wrap(configuration),
+					nil,
+				},
+				{
+					"list", "ls",
+					"", "list all configurations",
+					wrap(configurations),
+					nil,
+				},
+				{
+					"delete", "rm",
+					"ID", "delete the named configuration",
+					wrap(deleteConfiguration),
+					nil,
+				},
+				{
+					"apply", "a",
+					"DEVICE CONTENT", "apply configuration content (JSON) to the named device",
+					wrap(applyConfiguration),
+					nil,
+				},
+			},
+		),
 		{
-			"delete-device", "dd",
-			"DEVICE", "delete the named device",
-			wrap(deleteDevice),
+			"apply-deployment", "adp",
+			"DEVICE MANIFEST", "apply the IoT Edge deployment manifest file to the named device",
+			wrap(applyDeployment),
 			nil,
 		},
-		{
+		internal.Group(
 			"twin", "t",
-			"", "inspect the named twin device",
-			wrap(twin),
+			"inspect and update device twins", "get",
+			[]*internal.Command{
+				{
+					"get", "g",
+					"", "inspect the named twin device",
+					wrap(twin),
+					nil,
+				},
+				{
+					"update", "u",
+					"DEVICE [KEY VALUE]...", "update the named twin device",
+					wrap(updateTwin),
+					nil,
+				},
+				{
+					"edit", "e",
+					"DEVICE", "edit desired properties of the named twin device in $EDITOR",
+					wrap(editTwin),
+					editTwinFlags,
+				},
+			},
+		),
+		{
+			"digital-twin", "dt",
+			"DEVICE", "inspect the named device's digital twin",
+			wrap(digitalTwin),
 			nil,
 		},
 		{
-			"update-twin", "ut",
-			"DEVICE [KEY VALUE]...", "update the named twin device",
-			wrap(updateTwin),
-			nil,
+			"query", "q",
+			"QUERY", "query device twins, e.g. \"SELECT * FROM devices\"",
+			wrap(query),
+			func(f *flag.FlagSet) {
+				f.IntVar(&pageSizeFlag, "page-size", 0, "number of rows fetched by a request")
+			},
 		},
 		{
 			"stats", "st",
@@ -173,35 +352,118 @@ func run() error {
 			wrap(stats),
 			nil,
 		},
+		internal.Group(
+			"bulk-job", "bj",
+			"manage device import/export jobs", "",
+			[]*internal.Command{
+				{
+					"list", "ls",
+					"", "list the last import/export jobs",
+					wrap(jobs),
+					nil,
+				},
+				{
+					"show", "s",
+					"ID", "get the status of a import/export job",
+					wrap(job),
+					nil,
+				},
+				{
+					"cancel", "cl",
+					"ID", "cancel a import/export job",
+					wrap(cancelJob),
+					nil,
+				},
+			},
+		),
 		{
-			"jobs", "js",
-			"", "list the last import/export jobs",
-			wrap(jobs),
-			nil,
+			"export-devices", "ed",
+			"CONTAINER_URI", "export all devices to a blob container",
+			wrap(exportDevices),
+			func(f *flag.FlagSet) {
+				f.BoolVar(&excludeKeysFlag, "exclude-keys", false, "don't export authentication keys")
+				f.BoolVar(&waitFlag, "wait", false, "wait for the job to finish")
+			},
 		},
 		{
-			"job", "j",
-			"ID", "get the status of a import/export job",
-			wrap(job),
-			nil,
+			"import-devices", "id",
+			"INPUT_URI OUTPUT_URI", "import devices from a blob container",
+			wrap(importDevices),
+			func(f *flag.FlagSet) {
+				f.BoolVar(&waitFlag, "wait", false, "wait for the job to finish")
+			},
 		},
 		{
-			"cancel-job", "cj",
-			"", "cancel a import/export job",
-			wrap(cancelJob),
-			nil,
+			"import", "im",
+			"", "create or update devices listed in a CSV or JSON file",
+			wrap(importFile),
+			importFlags,
+		},
+		internal.Group(
+			"job", "j",
+			"manage scheduled twin update and direct method jobs", "show",
+			[]*internal.Command{
+				{
+					"create", "c",
+					"JOB QUERY [KEY VALUE]...", "schedule a desired twin update or a direct method call on matching devices",
+					wrap(jobCreate),
+					jobCreateFlags,
+				},
+				{
+					"show", "s",
+					"JOB", "get the status of a scheduled job",
+					wrap(jobShow),
+					jobShowFlags,
+				},
+				{
+					"cancel", "cl",
+					"JOB", "cancel a scheduled job",
+					wrap(jobCancel),
+					nil,
+				},
+				{
+					"list", "ls",
+					"", "list scheduled jobs",
+					wrap(jobList),
+					jobListFlags,
+				},
+			},
+		),
+		{
+			"schedule-call", "sc",
+			"JOB QUERY METHOD PAYLOAD", "",
+			wrap(scheduleCall),
+			func(f *flag.FlagSet) {
+				f.IntVar(&connectTimeoutFlag, "c", 0, "connect timeout in seconds")
+				f.IntVar(&responseTimeoutFlag, "r", 30, "response timeout in seconds")
+				f.BoolVar(&waitFlag, "wait", false, "wait for the job to finish")
+			},
 		},
 		{
 			"connection-string", "cs",
-			"DEVICE", "get a device's connection string",
+			"[DEVICE [MODULE]]", "get a device's or a module's connection string",
 			wrap(connectionString),
 			func(f *flag.FlagSet) {
 				f.BoolVar(&secondaryFlag, "secondary", false, "use the secondary key instead")
+				f.StringVar(&deviceFlag, "device", "", "device id, instead of the argument")
+				f.StringVar(&moduleFlag, "module", "", "module id, instead of the argument")
+			},
+		},
+		{
+			"token", "tk",
+			"", "generate a device's or a module's SAS token for connecting with MQTT clients",
+			wrap(token),
+			func(f *flag.FlagSet) {
+				f.StringVar(&deviceFlag, "device", "", "device id, required")
+				f.StringVar(&moduleFlag, "module", "", "module id")
+				f.DurationVar(&ttlFlag, "ttl", time.Hour, "token validity time")
+				f.BoolVar(&secondaryFlag, "secondary", false, "use the secondary key instead")
+				f.BoolVar(&mqttFlag, "mqtt", false, "print all MQTT connection parameters")
 			},
 		},
 		{
 			"access-signature", "sas",
-			"DEVICE", "generate a SAS token",
+			"DEVICE [MODULE]", "generate a device's or a module's SAS token",
 			wrap(sas),
 			func(f *flag.FlagSet) {
 				f.StringVar(&uriFlag, "uri", "", "storage resource uri")
@@ -213,15 +475,56 @@ func run() error {
 	if err != nil {
 		return err
 	}
+
+	// commands moved into groups
+	cli.Aliases(map[string]string{
+		"devices":              "device list",
+		"ds":                   "device list",
+		"create-device":        "device create",
+		"cd":                   "device create",
+		"update-device":        "device update",
+		"ud":                   "device update",
+		"delete-device":        "device delete",
+		"dd":                   "device delete",
+		"modules":              "module list",
+		"ms":                   "module list",
+		"create-module":        "module create",
+		"cm":                   "module create",
+		"delete-module":        "module delete",
+		"dm":                   "module delete",
+		"module-twin":          "module twin",
+		"mt":                   "module twin",
+		"configurations":       "configuration list",
+		"cfs":                  "configuration list",
+		"delete-configuration": "configuration delete",
+		"dcf":                  "configuration delete",
+		"apply-configuration":  "configuration apply",
+		"acf":                  "configuration apply",
+		"update-twin":          "twin update",
+		"ut":                   "twin update",
+		"edit-twin":            "twin edit",
+		"et":                   "twin edit",
+		"jobs":                 "bulk-job list",
+		"js":                   "bulk-job list",
+		"cancel-job":           "bulk-job cancel",
+		"cj":                   "bulk-job cancel",
+		"schedule-twin":        "job create",
+		"stw":                  "job create",
+		"scheduled-job":        "job show",
+		"sj":                   "job show",
+		"cancel-scheduled-job": "job cancel",
+		"csj":                  "job cancel",
+	})
+	cli.Complete("DEVICE", completeDevices)
 	return cli.Run(context.Background(), os.Args...)
 }
 
 func wrap(fn func(context.Context, *flag.FlagSet, *iotservice.Client) error) internal.HandlerFunc {
 	return func(ctx context.Context, f *flag.FlagSet) error {
-		// accept only from environment
-		cs := os.Getenv("SERVICE_CONNECTION_STRING")
+		// accept only from environment or the config file
+		cs := internal.CurrentProfile().ServiceConnectionString
 		if cs == "" {
-			return errors.New("SERVICE_CONNECTION_STRING is blank")
+			return errors.New("SERVICE_CONNECTION_STRING is blank and no profile sets it")
 		}
 
 		var logger *log.Logger
@@ -243,6 +546,36 @@ func wrap(fn func(context.Context, *flag.FlagSet, *iotservice.Client) error) int
 	}
 }
 
+// completeDevices suggests device ids from the registry for shell completion.
+func completeDevices(ctx context.Context, prefix string) []string {
+	cs := internal.CurrentProfile().ServiceConnectionString
+	if cs == "" {
+		return nil
+	}
+	c, err := iotservice.NewClient(
+		iotservice.WithLogger(nil),
+		iotservice.WithConnectionString(cs),
+	)
+	if err != nil {
+		return nil
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	l, err := c.ListDevices(ctx)
+	if err != nil {
+		return nil
+	}
+	ids := make([]string, 0, len(l))
+	for _, d := range l {
+		if strings.HasPrefix(d.DeviceID, prefix) {
+			ids = append(ids, d.DeviceID)
+		}
+	}
+	return ids
+}
+
 func device(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
 	if f.NArg() != 1 {
 		return internal.ErrInvalidUsage
@@ -305,7 +638,7 @@ func updateDevice(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) er
 	d, err := c.UpdateDevice(ctx, &iotservice.Device{
 		DeviceID:       f.Arg(0),
 		Authentication: a,
-	})
+	}, iotservice.WithIfMatch("*"))
 	if err != nil {
 		return err
 	}
@@ -346,6 +679,131 @@ func deleteDevice(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) er
 	return c.DeleteDevice(ctx, f.Arg(0))
 }
 
+func module(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
+	if f.NArg() != 2 {
+		return internal.ErrInvalidUsage
+	}
+	m, err := c.GetModule(ctx, f.Arg(0), f.Arg(1))
+	if err != nil {
+		return err
+	}
+	return internal.OutputJSON(m, compressFlag)
+}
+
+func modules(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
+	if f.NArg() != 1 {
+		return internal.ErrInvalidUsage
+	}
+	m, err := c.ListModules(ctx, f.Arg(0))
+	if err != nil {
+		return err
+	}
+	return internal.OutputJSON(m, compressFlag)
+}
+
+func createModule(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
+	if f.NArg() != 2 {
+		return internal.ErrInvalidUsage
+	}
+	if autoGenerateFlag {
+		var err error
+		primaryKeyFlag, err = iotservice.NewSymmetricKey()
+		if err != nil {
+			return err
+		}
+		secondaryKeyFlag, err = iotservice.NewSymmetricKey()
+		if err != nil {
+			return err
+		}
+	}
+	a, err := mkAuthentication()
+	if err != nil {
+		return err
+	}
+	m, err := c.CreateModule(ctx, &iotservice.Module{
+		DeviceID:       f.Arg(0),
+		ModuleID:       f.Arg(1),
+		Authentication: a,
+	})
+	if err != nil {
+		return err
+	}
+	return internal.OutputJSON(m, compressFlag)
+}
+
+func deleteModule(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
+	if f.NArg() != 2 {
+		return internal.ErrInvalidUsage
+	}
+	return c.DeleteModule(ctx, f.Arg(0), f.Arg(1))
+}
+
+func configurations(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
+	if f.NArg() != 0 {
+		return internal.ErrInvalidUsage
+	}
+	l, err := c.ListConfigurations(ctx)
+	if err != nil {
+		return err
+	}
+	return internal.OutputJSON(l, compressFlag)
+}
+
+func configuration(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
+	if f.NArg() != 1 {
+		return internal.ErrInvalidUsage
+	}
+	v, err := c.GetConfiguration(ctx, f.Arg(0))
+	if err != nil {
+		return err
+	}
+	return internal.OutputJSON(v, compressFlag)
+}
+
+func deleteConfiguration(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
+	if f.NArg() != 1 {
+		return internal.ErrInvalidUsage
+	}
+	return c.DeleteConfiguration(ctx, f.Arg(0))
+}
+
+func applyConfiguration(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
+	if f.NArg() != 2 {
+		return internal.ErrInvalidUsage
+	}
+	var v iotservice.ConfigurationContent
+	if err := json.Unmarshal([]byte(f.Arg(1)), &v); err != nil {
+		return err
+	}
+	return c.ApplyConfigurationContent(ctx, f.Arg(0), &v)
+}
+
+func applyDeployment(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
+	if f.NArg() != 2 {
+		return internal.ErrInvalidUsage
+	}
+	b, err := ioutil.ReadFile(f.Arg(1))
+	if err != nil {
+		return err
+	}
+	d, err := iotservice.ParseDeployment(b)
+	if err != nil {
+		return err
+	}
+	return c.ApplyDeployment(ctx, f.Arg(0), d)
+}
+
+func moduleTwin(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
+	if f.NArg() != 2 {
+		return internal.ErrInvalidUsage
+	}
+	t, err := c.GetModuleTwin(ctx, f.Arg(0), f.Arg(1))
+	if err != nil {
+		return err
+	}
+	return internal.OutputJSON(t, compressFlag)
+}
+
 func stats(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
 	if f.NArg() != 0 {
 		return internal.ErrInvalidUsage
@@ -368,16 +826,60 @@ func twin(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
 	return internal.OutputJSON(t, compressFlag)
 }
 
+func digitalTwin(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
+	if f.NArg() != 1 {
+		return internal.ErrInvalidUsage
+	}
+	t, err := c.GetDigitalTwin(ctx, f.Arg(0))
+	if err != nil {
+		return err
+	}
+	return internal.OutputJSON(t.Properties, compressFlag)
+}
+
+func query(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
+	if f.NArg() != 1 {
+		return internal.ErrInvalidUsage
+	}
+	var opts []iotservice.QueryOption
+	if pageSizeFlag > 0 {
+		opts = append(opts, iotservice.WithQueryPageSize(pageSizeFlag))
+	}
+	it := c.QueryTwins(ctx, f.Arg(0), opts...)
+	for it.Next() {
+		var v interface{}
+		if err := it.ScanStruct(&v); err != nil {
+			return err
+		}
+		if err := internal.OutputJSON(v, compressFlag); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
 func updateTwin(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
 	if f.NArg() < 3 {
 		return internal.ErrInvalidUsage
 	}
 
-	m, err := internal.ArgsToMap(f.Args()[1:])
+	twin, err := desiredTwin(f.Args()[1:])
+	if err != nil {
+		return err
+	}
+	twin, err = c.UpdateTwin(ctx, f.Arg(0), twin, "*")
 	if err != nil {
 		return err
 	}
+	return internal.OutputJSON(twin, compressFlag)
+}
 
+// desiredTwin makes a twin patch from KEY VALUE pairs, null values remove keys.
+func desiredTwin(args []string) (*iotservice.Twin, error) {
+	m, err := internal.ArgsToMap(args)
+	if err != nil {
+		return nil, err
+	}
 	twin := &iotservice.Twin{
 		Properties: &iotservice.Properties{
 			Desired: make(map[string]interface{}, len(m)),
@@ -390,30 +892,56 @@ func updateTwin(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) erro
 			twin.Properties.Desired[k] = v
 		}
 	}
-
-	twin, err = c.UpdateTwin(ctx, f.Arg(0), twin, "*")
-	if err != nil {
-		return err
-	}
-	return internal.OutputJSON(twin, compressFlag)
+	return twin, nil
 }
 
 func call(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
-	if f.NArg() != 3 {
+	var payload string
+	switch {
+	case f.NArg() == 3 && payloadFlag == "":
+		payload = f.Arg(2)
+	case f.NArg() == 2:
+		payload = payloadFlag
+	default:
 		return internal.ErrInvalidUsage
 	}
-	var v map[string]interface{}
-	if err := json.Unmarshal([]byte(f.Arg(2)), &v); err != nil {
+	b, err := internal.ReadPayload(payload)
+	if err != nil {
 		return err
 	}
-	r, err := c.Call(ctx, f.Arg(0), f.Arg(1), v,
+	var v map[string]interface{}
+	if len(b) != 0 {
+		if err := json.Unmarshal(b, &v); err != nil {
+			return fmt.Errorf("payload: %s", err)
+		}
+	}
+	rt := responseTimeoutFlag
+	if timeoutFlag != 0 {
+		rt = int(timeoutFlag / time.Second)
+	}
+	opts := []iotservice.CallOption{
 		iotservice.WithCallConnectTimeout(connectTimeoutFlag),
-		iotservice.WithCallResponseTimeout(responseTimeoutFlag),
-	)
+		iotservice.WithCallResponseTimeout(rt),
+	}
+	var r *iotservice.Result
+	if moduleFlag != "" {
+		r, err = c.CallModule(ctx, f.Arg(0), moduleFlag, f.Arg(1), v, opts...)
+	} else {
+		r, err = c.Call(ctx, f.Arg(0), f.Arg(1), v, opts...)
+	}
 	if err != nil {
 		return err
 	}
-	return internal.OutputJSON(r, compressFlag)
+	if err = internal.OutputJSON(r, compressFlag); err != nil {
+		return err
+	}
+	if r.Status != 200 {
+		return &internal.ExitError{
+			Code: 2,
+			Err:  fmt.Errorf("method returned status %d", r.Status),
+		}
+	}
+	return nil
 }
 
 func send(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
@@ -433,6 +961,24 @@ func send(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
 	if expFlag != 0 {
 		expiryTime = time.Now().Add(expFlag)
 	}
+
+	// subscribe before sending not to miss the feedback
+	var sub *iotservice.FeedbackSub
+	if waitFeedbackFlag != 0 {
+		if ackFlag == "" || ackFlag == iotservice.AckNone {
+			return errors.New("-wait-feedback requires -ack")
+		}
+		if midFlag == "" {
+			if midFlag, err = newMessageID(); err != nil {
+				return err
+			}
+		}
+		sub, err = c.ReceiveFeedback(ctx, iotservice.WithFeedbackMessageIDs(midFlag))
+		if err != nil {
+			return err
+		}
+		defer sub.Close()
+	}
 	if err := c.SendEvent(ctx, f.Arg(0), []byte(f.Arg(1)),
 		iotservice.WithSendMessageID(midFlag),
 		iotservice.WithSendAck(ackFlag),
@@ -443,9 +989,99 @@ func send(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
 	); err != nil {
 		return err
 	}
+	if sub == nil {
+		return nil
+	}
+	return outputFeedback(ctx, sub.Recv, midFlag, waitFeedbackFlag)
+}
+
+// deliveryResults maps feedback status codes to delivery results.
+var deliveryResults = map[string]string{
+	iotservice.FeedbackSuccess:               "delivered",
+	iotservice.FeedbackExpired:               "expired",
+	iotservice.FeedbackDeliveryCountExceeded: "expired",
+	iotservice.FeedbackRejected:              "rejected",
+	iotservice.FeedbackPurged:                "purged",
+}
+
+type deliveryResult struct {
+	MessageID string               `json:"messageId"`
+	Result    string               `json:"result"`
+	Feedback  *iotservice.Feedback `json:"feedback"`
+}
+
+// outputFeedback waits for the first feedback record of the message up to
+// timeout and prints it, it exits with 2 when the message wasn't delivered.
+func outputFeedback(
+	ctx context.Context,
+	recv func(context.Context) (*iotservice.Feedback, error),
+	mid string,
+	timeout time.Duration,
+) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	fb, err := recv(ctx)
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("no feedback for message %s received in %s", mid, timeout)
+	} else if err != nil {
+		return err
+	}
+	res, ok := deliveryResults[fb.StatusCode]
+	if !ok {
+		res = strings.ToLower(fb.StatusCode)
+	}
+	if err = internal.OutputJSON(&deliveryResult{
+		MessageID: fb.OriginalMessageID,
+		Result:    res,
+		Feedback:  fb,
+	}, compressFlag); err != nil {
+		return err
+	}
+	if fb.StatusCode != iotservice.FeedbackSuccess {
+		return &internal.ExitError{
+			Code: 2,
+			Err:  fmt.Errorf("message %s is %s", fb.OriginalMessageID, res),
+		}
+	}
 	return nil
 }
 
+// newMessageID generates a random message id
+// for matching messages with their feedback.
+func newMessageID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func broadcast(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
+	if f.NArg() < 2 {
+		return internal.ErrInvalidUsage
+	}
+	if concurrencyFlag < 1 {
+		return errors.New("concurrency must be positive")
+	}
+	expiryTime := time.Time{}
+	if expFlag != 0 {
+		expiryTime = time.Now().Add(expFlag)
+	}
+	err := c.Broadcast(ctx, f.Args()[1:], []byte(f.Arg(0)), concurrencyFlag,
+		iotservice.WithSendAck(ackFlag),
+		iotservice.WithSendUserID(uidFlag),
+		iotservice.WithSentExpiryTime(expiryTime),
+	)
+	if serr, ok := err.(*iotservice.SendError); ok {
+		for i, err := range serr.Errors {
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", f.Arg(i+1), err)
+			}
+		}
+	}
+	return err
+}
+
 func watchEvents(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
 	if f.NArg() != 0 {
 		return internal.ErrInvalidUsage
@@ -466,7 +1102,11 @@ func watchEvents(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) err
 		if err != nil {
 			return err
 		}
-		return eh.SubscribePartitions(ctx, name, ehcgFlag, func(m *amqp.Message) {
+		group := ehcgFlag
+		if p := internal.CurrentProfile(); !internal.IsFlagSet(f, "ehcg") && p.ConsumerGroup != "" {
+			group = p.ConsumerGroup
+		}
+		return eh.SubscribePartitions(ctx, name, group, func(m *amqp.Message) {
 			msg := commonamqp.FromAMQPMessage(m)
 			if err := internal.OutputJSON(msg, compressFlag); err != nil {
 				panic(err)
@@ -500,6 +1140,37 @@ func watchFeedback(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) e
 	return <-errc
 }
 
+func purgeQueue(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
+	if f.NArg() != 1 {
+		return internal.ErrInvalidUsage
+	}
+	n, err := c.PurgeQueue(ctx, f.Arg(0))
+	if err != nil {
+		return err
+	}
+	return internal.OutputJSON(map[string]int{"totalMessagesPurged": n}, compressFlag)
+}
+
+func watchFileNotifications(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
+	if f.NArg() != 0 {
+		return internal.ErrInvalidUsage
+	}
+	sub, err := c.SubscribeFileNotifications(ctx)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+	for {
+		n, err := sub.Recv(ctx)
+		if err != nil {
+			return err
+		}
+		if err = internal.OutputJSON(n, compressFlag); err != nil {
+			return err
+		}
+	}
+}
+
 func jobs(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
 	if f.NArg() != 0 {
 		return internal.ErrInvalidUsage
@@ -522,6 +1193,62 @@ func job(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
 	return internal.OutputJSON(v, compressFlag)
 }
 
+func exportDevices(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
+	if f.NArg() != 1 {
+		return internal.ErrInvalidUsage
+	}
+	job, err := c.ExportDevices(ctx, f.Arg(0), excludeKeysFlag)
+	if err != nil {
+		return err
+	}
+	return outputJob(ctx, c, job)
+}
+
+func importDevices(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
+	if f.NArg() != 2 {
+		return internal.ErrInvalidUsage
+	}
+	job, err := c.ImportDevices(ctx, f.Arg(0), f.Arg(1))
+	if err != nil {
+		return err
+	}
+	return outputJob(ctx, c, job)
+}
+
+func outputJob(ctx context.Context, c *iotservice.Client, job *iotservice.Job) error {
+	if waitFlag {
+		var err error
+		job, err = c.WaitJob(ctx, job.JobID, 5*time.Second)
+		if err != nil {
+			return err
+		}
+	}
+	return internal.OutputJSON(job, compressFlag)
+}
+
+func scheduleCall(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
+	if f.NArg() != 4 {
+		return internal.ErrInvalidUsage
+	}
+	call := &iotservice.MethodCall{MethodName: f.Arg(2)}
+	if err := json.Unmarshal([]byte(f.Arg(3)), &call.Payload); err != nil {
+		return err
+	}
+	for _, opt := range []iotservice.CallOption{
+		iotservice.WithCallConnectTimeout(connectTimeoutFlag),
+		iotservice.WithCallResponseTimeout(responseTimeoutFlag),
+	} {
+		if err := opt(call); err != nil {
+			return err
+		}
+	}
+	job, err := c.ScheduleMethodCall(ctx, f.Arg(0), f.Arg(1), call)
+	if err != nil {
+		return err
+	}
+	return outputScheduledJob(ctx, c, job)
+}
+
 func cancelJob(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
 	if f.NArg() != 1 {
 		return internal.ErrInvalidUsage
@@ -534,11 +1261,23 @@ func cancelJob(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error
 }
 
 func connectionString(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
-	if f.NArg() != 1 {
-		return internal.ErrInvalidUsage
+	deviceID, moduleID, err := identityArgs(f)
+	if err != nil {
+		return err
+	}
+	if moduleID != "" {
+		m, err := c.GetModule(ctx, deviceID, moduleID)
+		if err != nil {
+			return err
+		}
+		cs, err := c.ModuleConnectionString(m, secondaryFlag)
+		if err != nil {
+			return err
+		}
+		return internal.OutputLine(cs)
 	}
 
-	d, err := c.GetDevice(ctx, f.Arg(0))
+	d, err := c.GetDevice(ctx, deviceID)
 	if err != nil {
 		return err
 	}
@@ -549,10 +1288,65 @@ func connectionString(ctx context.Context, f *flag.FlagSet, c *iotservice.Client
 	return internal.OutputLine(cs)
 }
 
+// identityArgs returns the device and module ids passed
+// either as arguments or with -device and -module flags.
+func identityArgs(f *flag.FlagSet) (deviceID, moduleID string, err error) {
+	switch {
+	case deviceFlag != "" && f.NArg() == 0:
+		return deviceFlag, moduleFlag, nil
+	case deviceFlag == "" && moduleFlag == "" && (f.NArg() == 1 || f.NArg() == 2):
+		return f.Arg(0), f.Arg(1), nil
+	default:
+		return "", "", internal.ErrInvalidUsage
+	}
+}
+
+func token(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
+	if f.NArg() != 0 || deviceFlag == "" {
+		return internal.ErrInvalidUsage
+	}
+	var sas string
+	if moduleFlag != "" {
+		m, err := c.GetModule(ctx, deviceFlag, moduleFlag)
+		if err != nil {
+			return err
+		}
+		if sas, err = c.ModuleSAS(m, ttlFlag, secondaryFlag); err != nil {
+			return err
+		}
+	} else {
+		d, err := c.GetDevice(ctx, deviceFlag)
+		if err != nil {
+			return err
+		}
+		if sas, err = c.DeviceSAS(d, ttlFlag, secondaryFlag); err != nil {
+			return err
+		}
+	}
+	if !mqttFlag {
+		return internal.OutputLine(sas)
+	}
+	return internal.OutputJSON(
+		internal.NewMQTTCredentials(c.HostName(), deviceFlag, moduleFlag, sas),
+		compressFlag,
+	)
+}
+
 func sas(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
-	if f.NArg() != 1 {
+	if f.NArg() != 1 && f.NArg() != 2 {
 		return internal.ErrInvalidUsage
 	}
+	if f.NArg() == 2 {
+		m, err := c.GetModule(ctx, f.Arg(0), f.Arg(1))
+		if err != nil {
+			return err
+		}
+		sas, err := c.ModuleSAS(m, durationFlag, secondaryFlag)
+		if err != nil {
+			return err
+		}
+		return internal.OutputLine(sas)
+	}
 	d, err := c.GetDevice(ctx, f.Arg(0))
 	if err != nil {
 		return err
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goautomotive/iothub/cmd/internal"
+	"github.com/goautomotive/iothub/iotservice"
+)
+
+func TestOutputFeedback(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		code string
+		err  string // blank means success
+	}{
+		{iotservice.FeedbackSuccess, ""},
+		{iotservice.FeedbackRejected, "message 1 is rejected"},
+		{iotservice.FeedbackDeliveryCountExceeded, "message 1 is expired"},
+		{"Lost", "message 1 is lost"},
+	} {
+		err := outputFeedback(context.Background(), func(context.Context) (*iotservice.Feedback, error) {
+			return &iotservice.Feedback{OriginalMessageID: "1", StatusCode: tc.code}, nil
+		}, "1", time.Second)
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%s: error = %v", tc.code, err)
+			}
+			continue
+		}
+		var e *internal.ExitError
+		if !errors.As(err, &e) || e.Code != 2 || e.Err.Error() != tc.err {
+			t.Errorf("%s: error = %v, want exit code 2 with %q", tc.code, err, tc.err)
+		}
+	}
+
+	err := outputFeedback(context.Background(), func(ctx context.Context) (*iotservice.Feedback, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}, "1", time.Millisecond)
+	if err == nil || !strings.HasPrefix(err.Error(), "no feedback for message 1") {
+		t.Errorf("error = %v, want timeout", err)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goautomotive/iothub/cmd/internal"
+	"github.com/goautomotive/iothub/iotservice"
+)
+
+var (
+	deviceIDFlag       string
+	consumerGroupFlag  string
+	sinceFlag          time.Duration
+	propertyFilterFlag keyValueFlag
+)
+
+func monitorFlags(f *flag.FlagSet) {
+	f.StringVar(&deviceIDFlag, "device-id", "", "show only events of the named device")
+	f.StringVar(&consumerGroupFlag, "consumer-group", "$Default", "events endpoint consumer group")
+	f.DurationVar(&sinceFlag, "since", 0, "start from events enqueued this long ago, latest events by default")
+	f.Var(&propertyFilterFlag, "property-filter", "show only events with the KEY=VALUE property, can be repeated")
+}
+
+// keyValueFlag is a repeatable KEY=VALUE flag.
+type keyValueFlag map[string]string
+
+func (f *keyValueFlag) String() string {
+	s := make([]string, 0, len(*f))
+	for k, v := range *f {
+		s = append(s, k+"="+v)
+	}
+	return strings.Join(s, ",")
+}
+
+func (f *keyValueFlag) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("malformed filter %q, want KEY=VALUE", s)
+	}
+	if *f == nil {
+		*f = keyValueFlag{}
+	}
+	(*f)[kv[0]] = kv[1]
+	return nil
+}
+
+// monitoredEvent is a telemetry message with the payload
+// decoded as json when it's valid, otherwise as a string.
+type monitoredEvent struct {
+	DeviceID     string            `json:"deviceId"`
+	EnqueuedTime *time.Time        `json:"enqueuedTime,omitempty"`
+	PartitionID  string            `json:"partitionId"`
+	Offset       string            `json:"offset"`
+	Properties   map[string]string `json:"properties,omitempty"`
+	Payload      interface{}       `json:"payload"`
+}
+
+func monitorEvents(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
+	if f.NArg() != 0 {
+		return internal.ErrInvalidUsage
+	}
+	if sinceFlag < 0 {
+		return errors.New("since is negative")
+	}
+	group := consumerGroupFlag
+	if p := internal.CurrentProfile(); !internal.IsFlagSet(f, "consumer-group") && p.ConsumerGroup != "" {
+		group = p.ConsumerGroup
+	}
+	opts := []iotservice.ConsumerOption{
+		iotservice.WithConsumerGroup(group),
+	}
+	if sinceFlag != 0 {
+		opts = append(opts, iotservice.WithConsumerPosition(
+			iotservice.EventsFromEnqueuedTime(time.Now().Add(-sinceFlag)),
+		))
+	}
+	ec, err := c.NewEventConsumer(ctx, opts...)
+	if err != nil {
+		return err
+	}
+	defer ec.Close()
+
+	var mu sync.Mutex // serializes output
+	errc := make(chan error, len(ec.Partitions()))
+	for _, p := range ec.Partitions() {
+		go func(p *iotservice.PartitionReceiver) {
+			for e := range p.C() {
+				if !matchEvent(e, deviceIDFlag, propertyFilterFlag) {
+					continue
+				}
+				mu.Lock()
+				err := internal.OutputJSON(decodeEvent(e), compressFlag)
+				mu.Unlock()
+				if err != nil {
+					errc <- err
+					return
+				}
+			}
+			errc <- p.Err()
+		}(p)
+	}
+	select {
+	case err = <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// matchEvent reports whether e is sent by the named device, blank
+// matches any, and it has all the given properties.
+func matchEvent(e *iotservice.Event, deviceID string, props map[string]string) bool {
+	if deviceID != "" && e.ConnectionDeviceID != deviceID {
+		return false
+	}
+	for k, v := range props {
+		if e.Properties[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func decodeEvent(e *iotservice.Event) *monitoredEvent {
+	var payload interface{}
+	if err := json.Unmarshal(e.Payload, &payload); err != nil {
+		payload = string(e.Payload)
+	}
+	return &monitoredEvent{
+		DeviceID:     e.ConnectionDeviceID,
+		EnqueuedTime: e.EnqueuedTime,
+		PartitionID:  e.PartitionID,
+		Offset:       e.Offset,
+		Properties:   e.Properties,
+		Payload:      payload,
+	}
+}
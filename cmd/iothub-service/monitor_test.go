@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"testing"
+
+	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/iotservice"
+)
+
+func TestKeyValueFlag(t *testing.T) {
+	t.Parallel()
+
+	var v keyValueFlag
+	f := flag.NewFlagSet("test", flag.ContinueOnError)
+	f.Var(&v, "p", "")
+	if err := f.Parse([]string{"-p", "a=1", "-p", "b=x=y", "-p", "c="}); err != nil {
+		t.Fatal(err)
+	}
+	if want := (keyValueFlag{"a": "1", "b": "x=y", "c": ""}); !reflect.DeepEqual(v, want) {
+		t.Errorf("keyValueFlag = %v, want %v", v, want)
+	}
+	for _, s := range []string{"a", "=1"} {
+		if err := v.Set(s); err == nil {
+			t.Errorf("Set(%q) = nil error", s)
+		}
+	}
+}
+
+func TestMatchEvent(t *testing.T) {
+	t.Parallel()
+
+	e := &iotservice.Event{Message: &common.Message{
+		ConnectionDeviceID: "dev",
+		Properties:         map[string]string{"a": "1", "b": "2"},
+	}}
+	for _, tc := range []struct {
+		deviceID string
+		props    map[string]string
+		want     bool
+	}{
+		{"", nil, true},
+		{"dev", map[string]string{"a": "1", "b": "2"}, true},
+		{"other", nil, false},
+		{"", map[string]string{"a": "2"}, false},
+		{"dev", map[string]string{"c": ""}, true}, // missing properties are blank
+		{"dev", map[string]string{"a": "1", "c": "3"}, false},
+	} {
+		if g := matchEvent(e, tc.deviceID, tc.props); g != tc.want {
+			t.Errorf("matchEvent(%q, %v) = %t, want %t", tc.deviceID, tc.props, g, tc.want)
+		}
+	}
+}
+
+func TestDecodeEvent(t *testing.T) {
+	t.Parallel()
+
+	for payload, want := range map[string]interface{}{
+		`{"a":1}`: map[string]interface{}{"a": 1.0},
+		`hello`:   "hello",
+	} {
+		e := &iotservice.Event{
+			Message:     &common.Message{ConnectionDeviceID: "dev", Payload: []byte(payload)},
+			PartitionID: "1",
+			Offset:      "42",
+		}
+		g := decodeEvent(e)
+		if g.DeviceID != "dev" || g.PartitionID != "1" || g.Offset != "42" || !reflect.DeepEqual(g.Payload, want) {
+			t.Errorf("decodeEvent(%s) = %+v", payload, g)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/goautomotive/iothub/cmd/internal"
+	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/iotservice"
+)
+
+func watchFlags(f *flag.FlagSet) {
+	f.StringVar(&consumerGroupFlag, "consumer-group", "$Default", "events endpoint consumer group")
+	f.DurationVar(&sinceFlag, "since", 0, "start from events enqueued this long ago, latest events by default")
+}
+
+// Sources of events the hub routes to the built-in endpoint
+// when the corresponding routes are enabled.
+const (
+	sourceTwinChange      = "twinChangeEvents"
+	sourceLifecycle       = "deviceLifecycleEvents"
+	sourceConnectionState = "deviceConnectionStateEvents"
+)
+
+// watchedEvent is a twin change or lifecycle event,
+// Changes are computed against the previously seen twin.
+type watchedEvent struct {
+	DeviceID     string             `json:"deviceId"`
+	Source       string             `json:"source"`
+	OpType       string             `json:"opType,omitempty"`
+	EnqueuedTime *time.Time         `json:"enqueuedTime,omitempty"`
+	Version      interface{}        `json:"version,omitempty"`
+	Changes      []*internal.Change `json:"changes,omitempty"`
+}
+
+func watch(ctx context.Context, f *flag.FlagSet, c *iotservice.Client) error {
+	if f.NArg() != 1 {
+		return internal.ErrInvalidUsage
+	}
+	if sinceFlag < 0 {
+		return errors.New("since is negative")
+	}
+	deviceID := f.Arg(0)
+
+	// changes are relative to the current twin state, when the device
+	// is not created yet it comes with the creation event
+	state := map[string]interface{}{}
+	t, err := c.GetTwin(ctx, deviceID)
+	switch {
+	case err == nil:
+		if state, err = twinState(t); err != nil {
+			return err
+		}
+	case !errors.Is(err, common.ErrDeviceNotFound):
+		return err
+	}
+
+	group := consumerGroupFlag
+	if p := internal.CurrentProfile(); !internal.IsFlagSet(f, "consumer-group") && p.ConsumerGroup != "" {
+		group = p.ConsumerGroup
+	}
+	opts := []iotservice.ConsumerOption{
+		iotservice.WithConsumerGroup(group),
+	}
+	if sinceFlag != 0 {
+		opts = append(opts, iotservice.WithConsumerPosition(
+			iotservice.EventsFromEnqueuedTime(time.Now().Add(-sinceFlag)),
+		))
+	}
+	ec, err := c.NewEventConsumer(ctx, opts...)
+	if err != nil {
+		return err
+	}
+	defer ec.Close()
+
+	var mu sync.Mutex // guards state and serializes output
+	errc := make(chan error, len(ec.Partitions()))
+	for _, p := range ec.Partitions() {
+		go func(p *iotservice.PartitionReceiver) {
+			for e := range p.C() {
+				if eventDeviceID(e) != deviceID {
+					continue
+				}
+				switch e.MessageSource {
+				case sourceTwinChange, sourceLifecycle, sourceConnectionState:
+				default:
+					continue
+				}
+				mu.Lock()
+				w, next := watchEvent(e, state)
+				state = next
+				err := internal.OutputJSON(w, compressFlag)
+				mu.Unlock()
+				if err != nil {
+					errc <- err
+					return
+				}
+			}
+			errc <- p.Err()
+		}(p)
+	}
+	select {
+	case err = <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// eventDeviceID is the deviceId property of notifications,
+// they may be sent on behalf of the hub not the device.
+func eventDeviceID(e *iotservice.Event) string {
+	if id := e.Properties["deviceId"]; id != "" {
+		return id
+	}
+	return e.ConnectionDeviceID
+}
+
+// watchEvent makes an output event and returns the twin state after it.
+func watchEvent(e *iotservice.Event, state map[string]interface{}) (*watchedEvent, map[string]interface{}) {
+	w := &watchedEvent{
+		DeviceID:     eventDeviceID(e),
+		Source:       e.MessageSource,
+		OpType:       e.Properties["opType"],
+		EnqueuedTime: e.EnqueuedTime,
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(e.Payload, &payload); err != nil {
+		return w, state
+	}
+	w.Version = payload["version"]
+
+	next := state
+	switch {
+	case e.MessageSource == sourceTwinChange && w.OpType == "updateTwin":
+		next = internal.ApplyPatch(state, stripTwin(payload))
+	case e.MessageSource == sourceTwinChange, w.OpType == "createDeviceIdentity":
+		// replaceTwin and creation events carry the whole twin
+		next = stripTwin(payload)
+	case w.OpType == "deleteDeviceIdentity":
+		next = map[string]interface{}{}
+	}
+	w.Changes = internal.Diff(state, next)
+	return w, next
+}
+
+func twinState(t *iotservice.Twin) (map[string]interface{}, error) {
+	b, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err = json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return stripTwin(m), nil
+}
+
+// stripTwin leaves only tags and properties of a twin document
+// without their metadata, that's what users care about.
+func stripTwin(m map[string]interface{}) map[string]interface{} {
+	s := map[string]interface{}{}
+	if tags, ok := m["tags"]; ok {
+		s["tags"] = tags
+	}
+	props, ok := m["properties"].(map[string]interface{})
+	if !ok {
+		return s
+	}
+	sp := map[string]interface{}{}
+	for _, k := range []string{"desired", "reported"} {
+		v, ok := props[k].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		p := make(map[string]interface{}, len(v))
+		for k, v := range v {
+			if k != "$metadata" && k != "$version" {
+				p[k] = v
+			}
+		}
+		sp[k] = p
+	}
+	s["properties"] = sp
+	return s
+}
@@ -0,0 +1,491 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cborCodec encodes values as CBOR, RFC 7049, following the encoding/json
+// conventions: struct fields are named after their json tags, types
+// implementing json.Marshaler are encoded as their JSON representation
+// and times are RFC 3339 strings tagged with 0. Unlike JSON, []byte
+// values are byte strings and map keys are sorted canonically.
+//
+// Decoding into anything but *interface{} goes through encoding/json.
+type cborCodec struct{}
+
+func (cborCodec) ContentType() string {
+	return "application/cbor"
+}
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := cborEncode(&b, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (cborCodec) Unmarshal(b []byte, v interface{}) error {
+	d := &cborDecoder{b: b}
+	x, err := d.decode(0)
+	if err != nil {
+		return err
+	}
+	if d.off != len(b) {
+		return errors.New("cbor: trailing data")
+	}
+	if p, ok := v.(*interface{}); ok {
+		*p = x
+		return nil
+	}
+	j, err := json.Marshal(x)
+	if err != nil {
+		return fmt.Errorf("cbor: %s", err)
+	}
+	return json.Unmarshal(j, v)
+}
+
+// CBOR major types.
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+)
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	timeType          = reflect.TypeOf(time.Time{})
+)
+
+func cborHead(b *bytes.Buffer, major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		b.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		b.Write([]byte{major | 24, byte(n)})
+	case n <= math.MaxUint16:
+		b.WriteByte(major | 25)
+		binary.Write(b, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		b.WriteByte(major | 26)
+		binary.Write(b, binary.BigEndian, uint32(n))
+	default:
+		b.WriteByte(major | 27)
+		binary.Write(b, binary.BigEndian, n)
+	}
+}
+
+func cborInt(b *bytes.Buffer, n int64) {
+	if n < 0 {
+		cborHead(b, cborNegInt, uint64(-(n + 1)))
+	} else {
+		cborHead(b, cborUint, uint64(n))
+	}
+}
+
+func cborEncode(b *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		b.WriteByte(0xf6) // null
+		return nil
+	}
+	if v.Type() == timeType {
+		b.WriteByte(0xc0) // tag 0, date/time string
+		s := v.Interface().(time.Time).Format(time.RFC3339Nano)
+		cborHead(b, cborText, uint64(len(s)))
+		b.WriteString(s)
+		return nil
+	}
+	if v.Type().Implements(jsonMarshalerType) &&
+		!(v.Kind() == reflect.Ptr && v.IsNil()) {
+		return cborEncodeJSON(b, v.Interface().(json.Marshaler))
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			b.WriteByte(0xf6)
+			return nil
+		}
+		return cborEncode(b, v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			b.WriteByte(0xf5)
+		} else {
+			b.WriteByte(0xf4)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		cborInt(b, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		cborHead(b, cborUint, v.Uint())
+	case reflect.Float32:
+		b.WriteByte(0xfa)
+		binary.Write(b, binary.BigEndian, math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		b.WriteByte(0xfb)
+		binary.Write(b, binary.BigEndian, math.Float64bits(v.Float()))
+	case reflect.String:
+		if v.Type() == reflect.TypeOf(json.Number("")) {
+			return cborEncodeNumber(b, json.Number(v.String()))
+		}
+		cborHead(b, cborText, uint64(v.Len()))
+		b.WriteString(v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			b.WriteByte(0xf6)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			cborHead(b, cborBytes, uint64(v.Len()))
+			for i := 0; i < v.Len(); i++ {
+				b.WriteByte(byte(v.Index(i).Uint()))
+			}
+			return nil
+		}
+		cborHead(b, cborArray, uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			if err := cborEncode(b, v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			b.WriteByte(0xf6)
+			return nil
+		}
+		kvs := make([][2][]byte, 0, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			var kb, vb bytes.Buffer
+			if err := cborEncode(&kb, iter.Key()); err != nil {
+				return err
+			}
+			if err := cborEncode(&vb, iter.Value()); err != nil {
+				return err
+			}
+			kvs = append(kvs, [2][]byte{kb.Bytes(), vb.Bytes()})
+		}
+		cborMapEntries(b, kvs)
+	case reflect.Struct:
+		var kvs [][2][]byte
+		if err := cborStructEntries(&kvs, v); err != nil {
+			return err
+		}
+		cborMapEntries(b, kvs)
+	default:
+		return fmt.Errorf("cbor: unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// cborMapEntries writes a map of encoded keys and values sorted
+// in the canonical order, shorter keys first then bytewise.
+func cborMapEntries(b *bytes.Buffer, kvs [][2][]byte) {
+	sort.Slice(kvs, func(i, j int) bool {
+		if len(kvs[i][0]) != len(kvs[j][0]) {
+			return len(kvs[i][0]) < len(kvs[j][0])
+		}
+		return bytes.Compare(kvs[i][0], kvs[j][0]) < 0
+	})
+	cborHead(b, cborMap, uint64(len(kvs)))
+	for _, kv := range kvs {
+		b.Write(kv[0])
+		b.Write(kv[1])
+	}
+}
+
+// cborStructEntries appends exported fields named after their json tags,
+// fields of untagged embedded structs are promoted like in encoding/json.
+func cborStructEntries(kvs *[][2][]byte, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts := tag, ""
+		if i := strings.Index(tag, ","); i != -1 {
+			name, opts = tag[:i], tag[i+1:]
+		}
+		fv := v.Field(i)
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					continue
+				}
+				ft, fv = ft.Elem(), fv.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				if err := cborStructEntries(kvs, fv); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		if strings.Contains(","+opts+",", ",omitempty,") && isEmptyValue(fv) {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		var kb, vb bytes.Buffer
+		cborHead(&kb, cborText, uint64(len(name)))
+		kb.WriteString(name)
+		if err := cborEncode(&vb, fv); err != nil {
+			return err
+		}
+		*kvs = append(*kvs, [2][]byte{kb.Bytes(), vb.Bytes()})
+	}
+	return nil
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// cborEncodeJSON encodes the value's JSON representation.
+func cborEncodeJSON(b *bytes.Buffer, m json.Marshaler) error {
+	j, err := m.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.UseNumber()
+	var x interface{}
+	if err = dec.Decode(&x); err != nil {
+		return err
+	}
+	return cborEncode(b, reflect.ValueOf(x))
+}
+
+func cborEncodeNumber(b *bytes.Buffer, n json.Number) error {
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		cborInt(b, i)
+		return nil
+	}
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		cborHead(b, cborUint, u)
+		return nil
+	}
+	f, err := strconv.ParseFloat(string(n), 64)
+	if err != nil {
+		return fmt.Errorf("cbor: malformed number %q", n)
+	}
+	return cborEncode(b, reflect.ValueOf(f))
+}
+
+// cborMaxDepth limits nesting of decoded values.
+const cborMaxDepth = 1000
+
+var errCBORTruncated = errors.New("cbor: unexpected end of data")
+
+// cborDecoder decodes values into nil, bool, int64, uint64, float64,
+// string, []byte, []interface{} and map[string]interface{},
+// non-string map keys are formatted with fmt.Sprint.
+type cborDecoder struct {
+	b   []byte
+	off int
+}
+
+func (d *cborDecoder) head() (major byte, info byte, n uint64, err error) {
+	if d.off >= len(d.b) {
+		return 0, 0, 0, errCBORTruncated
+	}
+	c := d.b[d.off]
+	d.off++
+	major, info = c>>5, c&0x1f
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(d.b)-d.off < size {
+			return 0, 0, 0, errCBORTruncated
+		}
+		for _, x := range d.b[d.off : d.off+size] {
+			n = n<<8 | uint64(x)
+		}
+		d.off += size
+		return major, info, n, nil
+	case info == 31:
+		return major, info, 0, nil // indefinite length
+	default:
+		return 0, 0, 0, fmt.Errorf("cbor: malformed initial byte 0x%02x", c)
+	}
+}
+
+func (d *cborDecoder) decode(depth int) (interface{}, error) {
+	if depth > cborMaxDepth {
+		return nil, errors.New("cbor: exceeded max depth")
+	}
+	major, info, n, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	indefinite := info == 31
+	if indefinite && (major == cborUint || major == cborNegInt || major == cborTag) {
+		return nil, fmt.Errorf("cbor: indefinite length of major type %d", major)
+	}
+
+	switch major {
+	case cborUint:
+		if n <= math.MaxInt64 {
+			return int64(n), nil
+		}
+		return n, nil
+	case cborNegInt:
+		if n > math.MaxInt64 {
+			return float64(-1) - float64(n), nil
+		}
+		return -1 - int64(n), nil
+	case cborBytes, cborText:
+		var s []byte
+		if indefinite {
+			for !d.isBreak() {
+				chunk, err := d.decode(depth + 1)
+				if err != nil {
+					return nil, err
+				}
+				switch c := chunk.(type) {
+				case []byte:
+					s = append(s, c...)
+				case string:
+					s = append(s, c...)
+				}
+			}
+		} else {
+			if n > uint64(len(d.b)-d.off) {
+				return nil, errCBORTruncated
+			}
+			s = append([]byte{}, d.b[d.off:d.off+int(n)]...)
+			d.off += int(n)
+		}
+		if major == cborText {
+			return string(s), nil
+		}
+		return s, nil
+	case cborArray:
+		var a []interface{}
+		for i := uint64(0); indefinite && !d.isBreak() || !indefinite && i < n; i++ {
+			if !indefinite && n-i > uint64(len(d.b)-d.off) {
+				return nil, errCBORTruncated // every item takes at least a byte
+			}
+			x, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, x)
+		}
+		if a == nil {
+			a = []interface{}{}
+		}
+		return a, nil
+	case cborMap:
+		m := map[string]interface{}{}
+		for i := uint64(0); indefinite && !d.isBreak() || !indefinite && i < n; i++ {
+			if !indefinite && n-i > uint64(len(d.b)-d.off) {
+				return nil, errCBORTruncated
+			}
+			k, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			v, err := d.decode(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			ks, ok := k.(string)
+			if !ok {
+				ks = fmt.Sprint(k)
+			}
+			m[ks] = v
+		}
+		return m, nil
+	case cborTag:
+		return d.decode(depth + 1) // tags are not interpreted
+	default:
+		switch info {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22, 23:
+			return nil, nil // null and undefined
+		case 25:
+			return halfToFloat(uint16(n)), nil
+		case 26:
+			return float64(math.Float32frombits(uint32(n))), nil
+		case 27:
+			return math.Float64frombits(n), nil
+		case 31:
+			return nil, errors.New("cbor: unexpected break")
+		default:
+			return nil, fmt.Errorf("cbor: unsupported simple value %d", n)
+		}
+	}
+}
+
+// isBreak consumes the break code ending indefinite length items.
+func (d *cborDecoder) isBreak() bool {
+	if d.off < len(d.b) && d.b[d.off] == 0xff {
+		d.off++
+		return true
+	}
+	return false
+}
+
+// halfToFloat converts an IEEE 754 half-precision float.
+func halfToFloat(h uint16) float64 {
+	exp, mant := int(h>>10)&0x1f, float64(h&0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
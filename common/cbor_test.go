@@ -0,0 +1,106 @@
+package common
+
+import (
+	"encoding/hex"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCBORMarshal(t *testing.T) {
+	t.Parallel()
+
+	// examples from RFC 7049, Appendix A
+	for _, tc := range []struct {
+		v    interface{}
+		want string
+	}{
+		{0, "00"},
+		{23, "17"},
+		{24, "1818"},
+		{1000, "1903e8"},
+		{uint64(18446744073709551615), "1bffffffffffffffff"},
+		{-1, "20"},
+		{-1000, "3903e7"},
+		{1.1, "fb3ff199999999999a"},
+		{float32(100000), "fa47c35000"},
+		{false, "f4"},
+		{true, "f5"},
+		{nil, "f6"},
+		{[]byte{1, 2, 3, 4}, "4401020304"},
+		{"IETF", "6449455446"},
+		{"ü", "62c3bc"},
+		{[]int{1, 2, 3}, "83010203"},
+		{[]interface{}{1, []int{2, 3}}, "8201820203"},
+		{map[string]string{"b": "B", "a": "A"}, "a26161614161626142"},
+		{map[int]int{1: 2, 3: 4}, "a201020304"},
+		{struct {
+			A int    `json:"a"`
+			B string `json:"b,omitempty"`
+			C bool   `json:"-"`
+			d int
+		}{A: 1}, "a1616101"},
+		{time.Date(2013, 3, 21, 20, 4, 0, 0, time.UTC), "c074323031332d30332d32315432303a30343a30305a"},
+	} {
+		b, err := CBORCodec.Marshal(tc.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(b); got != tc.want {
+			t.Errorf("Marshal(%#v) = %s, want %s", tc.v, got, tc.want)
+		}
+	}
+}
+
+func TestCBORUnmarshal(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		in   string
+		want interface{}
+	}{
+		{"00", int64(0)},
+		{"1bffffffffffffffff", uint64(18446744073709551615)},
+		{"3903e7", int64(-1000)},
+		{"f93c00", 1.0},
+		{"f9c400", -4.0},
+		{"f97c00", math.Inf(1)},
+		{"fa47c35000", 100000.0},
+		{"f7", nil},
+		{"c074323031332d30332d32315432303a30343a30305a", "2013-03-21T20:04:00Z"},
+		{"5f42010243030405ff", []byte{1, 2, 3, 4, 5}},
+		{"7f657374726561646d696e67ff", "streaming"},
+		{"9f018202039f0405ffff", []interface{}{int64(1), []interface{}{int64(2), int64(3)}, []interface{}{int64(4), int64(5)}}},
+		{"bf61610161629f0203ffff", map[string]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}}},
+		{"a201020304", map[string]interface{}{"1": int64(2), "3": int64(4)}},
+		{"80", []interface{}{}},
+	} {
+		b, _ := hex.DecodeString(tc.in)
+		var got interface{}
+		if err := CBORCodec.Unmarshal(b, &got); err != nil {
+			t.Errorf("Unmarshal(%s) error: %s", tc.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Unmarshal(%s) = %#v, want %#v", tc.in, got, tc.want)
+		}
+	}
+
+	for _, in := range []string{
+		"",
+		"18",                 // truncated uint
+		"62c3",               // truncated text
+		"9bffffffffffffffff", // huge array
+		"0000",               // trailing data
+		"ff",                 // unexpected break
+		"1c",                 // reserved additional info
+		"9f01",               // unterminated indefinite array
+	} {
+		b, _ := hex.DecodeString(in)
+		var v interface{}
+		if err := CBORCodec.Unmarshal(b, &v); err == nil {
+			t.Errorf("Unmarshal(%s) = %#v, want an error", in, v)
+		}
+	}
+}
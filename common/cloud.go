@@ -0,0 +1,64 @@
+package common
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// Cloud describes endpoints of an Azure cloud.
+type Cloud struct {
+	// HubSuffix is the hostname suffix of IoT hubs.
+	HubSuffix string
+
+	// DPSEndpoint is the global device endpoint of
+	// the Device Provisioning Service.
+	DPSEndpoint string
+}
+
+// Well-known Azure clouds.
+var (
+	AzurePublicCloud = Cloud{
+		HubSuffix:   "azure-devices.net",
+		DPSEndpoint: "global.azure-devices-provisioning.net",
+	}
+	AzureChinaCloud = Cloud{
+		HubSuffix:   "azure-devices.cn",
+		DPSEndpoint: "global.azure-devices-provisioning.cn",
+	}
+	AzureUSGovernmentCloud = Cloud{
+		HubSuffix:   "azure-devices.us",
+		DPSEndpoint: "global.azure-devices-provisioning.us",
+	}
+)
+
+// Hostname returns the hostname of the named hub in the cloud.
+func (c Cloud) Hostname(hub string) string {
+	return hub + "." + c.HubSuffix
+}
+
+// HubName returns the name of the hub, that's the first label of its hostname,
+// it doesn't depend on the cloud or on custom DNS names of private endpoints.
+func HubName(hostname string) string {
+	if i := strings.IndexByte(hostname, '.'); i != -1 {
+		return hostname[:i]
+	}
+	return hostname
+}
+
+// EndpointDialer returns a dialer that connects to addr instead of host
+// keeping the port, e.g. to reach a private endpoint that the hub's
+// hostname doesn't resolve to. TLS server names and token audiences are
+// unaffected, they're still the hub's hostname. Other hosts are dialed
+// as they are, dial is net.Dialer's default when it's nil.
+func EndpointDialer(dial Dialer, host, addr string) Dialer {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return func(ctx context.Context, network, hostport string) (net.Conn, error) {
+		if h, port, err := net.SplitHostPort(hostport); err == nil && strings.EqualFold(h, host) {
+			hostport = net.JoinHostPort(addr, port)
+		}
+		return dial(ctx, network, hostport)
+	}
+}
@@ -0,0 +1,53 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestCloud(t *testing.T) {
+	t.Parallel()
+
+	for c, w := range map[Cloud]string{
+		AzurePublicCloud:       "hub.azure-devices.net",
+		AzureChinaCloud:        "hub.azure-devices.cn",
+		AzureUSGovernmentCloud: "hub.azure-devices.us",
+	} {
+		if g := c.Hostname("hub"); g != w {
+			t.Errorf("Hostname(%q) = %q, want %q", "hub", g, w)
+		}
+		if g := HubName(w); g != "hub" {
+			t.Errorf("HubName(%q) = %q, want %q", w, g, "hub")
+		}
+	}
+}
+
+func TestEndpointDialer(t *testing.T) {
+	t.Parallel()
+
+	var dialed []string
+	dial := EndpointDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return nil, errors.New("unreachable")
+	}, "hub.azure-devices.net", "10.0.0.4")
+	for _, addr := range []string{
+		"hub.azure-devices.net:8883",
+		"HUB.azure-devices.net:443",
+		"acc.blob.core.windows.net:443",
+	} {
+		dial(context.Background(), "tcp", addr)
+	}
+
+	w := []string{"10.0.0.4:8883", "10.0.0.4:443", "acc.blob.core.windows.net:443"}
+	if len(dialed) != len(w) {
+		t.Fatalf("dialed %v, want %v", dialed, w)
+	}
+	for i := range w {
+		if dialed[i] != w[i] {
+			t.Errorf("dialed %v, want %v", dialed, w)
+			break
+		}
+	}
+}
@@ -0,0 +1,470 @@
+// Package cloudevents converts messages to and from CloudEvents 1.0
+// in both structured and binary HTTP modes, so telemetry can be handed
+// to Event Grid or Knative style consumers.
+//
+// See: https://github.com/cloudevents/spec/blob/v1.0/spec.md
+package cloudevents
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/goautomotive/iothub/common"
+)
+
+const (
+	// SpecVersion is the supported CloudEvents version.
+	SpecVersion = "1.0"
+
+	// ContentType is the media type of structured mode events.
+	ContentType = "application/cloudevents+json"
+
+	// TelemetryType is the event type of device-to-cloud
+	// messages, the same Event Grid uses for telemetry.
+	TelemetryType = "Microsoft.Devices.DeviceTelemetry"
+)
+
+// Extension attributes that system properties are mapped to,
+// application properties become extensions named after them
+// when the names are valid attribute names.
+const (
+	ExtDeviceID        = "iothubdeviceid"
+	ExtModuleID        = "iothubmoduleid"
+	ExtGenerationID    = "iothubgenerationid"
+	ExtAuthMethod      = "iothubauthmethod"
+	ExtMessageSource   = "iothubmessagesource"
+	ExtComponent       = "iothubcomponent"
+	ExtCorrelationID   = "iothubcorrelationid"
+	ExtUserID          = "iothubuserid"
+	ExtContentEncoding = "iothubencoding"
+	ExtCreationTime    = "iothubcreationtime"
+	ExtExpiryTime      = "iothubexpirytime"
+)
+
+// message properties that are set by the hub
+const (
+	moduleIDProperty   = "iothub-connection-module-id"
+	dataSchemaProperty = "dt-dataschema"
+)
+
+// Event is a CloudEvent, Data is the raw payload
+// that's encoded according to the mode it's sent in.
+type Event struct {
+	ID              string
+	Source          string
+	SpecVersion     string
+	Type            string
+	DataContentType string
+	DataSchema      string
+	Subject         string
+	Time            time.Time
+	Data            []byte
+	Extensions      map[string]string
+}
+
+// FromMessage converts a device-to-cloud message to an event,
+// source defaults to /devices/{deviceId}[/modules/{moduleId}],
+// a random id is generated for messages without MessageID.
+//
+// Application properties that are not valid attribute names, i.e.
+// lowercase alphanumeric up to 20 characters, or clash with
+// the standard ones are not converted.
+func FromMessage(msg *common.Message, source string) (*Event, error) {
+	subject := ""
+	if msg.ConnectionDeviceID != "" {
+		subject = "devices/" + msg.ConnectionDeviceID
+		if m := msg.Properties[moduleIDProperty]; m != "" {
+			subject += "/modules/" + m
+		}
+	}
+	if source == "" {
+		if subject == "" {
+			return nil, errors.New("cloudevents: source is blank and message has no device id")
+		}
+		source = "/" + subject
+	}
+	id := msg.MessageID
+	if id == "" {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		id = hex.EncodeToString(b)
+	}
+
+	e := &Event{
+		ID:              id,
+		Source:          source,
+		SpecVersion:     SpecVersion,
+		Type:            TelemetryType,
+		DataContentType: msg.ContentType,
+		DataSchema:      msg.Properties[dataSchemaProperty],
+		Subject:         subject,
+		Data:            msg.Payload,
+		Extensions:      map[string]string{},
+	}
+	if msg.EnqueuedTime != nil && !msg.EnqueuedTime.IsZero() {
+		e.Time = *msg.EnqueuedTime
+	} else if t, ok := msg.Created(); ok {
+		e.Time = t
+	}
+	for k, v := range msg.Properties {
+		if k != moduleIDProperty && k != dataSchemaProperty && isExtensionName(k) && !reserved[k] {
+			e.Extensions[k] = v
+		}
+	}
+	for k, v := range map[string]string{
+		ExtDeviceID:        msg.ConnectionDeviceID,
+		ExtModuleID:        msg.Properties[moduleIDProperty],
+		ExtGenerationID:    msg.ConnectionDeviceGenerationID,
+		ExtAuthMethod:      msg.ConnectionAuthMethod,
+		ExtMessageSource:   msg.MessageSource,
+		ExtComponent:       msg.ComponentName,
+		ExtCorrelationID:   msg.CorrelationID,
+		ExtUserID:          msg.UserID,
+		ExtContentEncoding: msg.ContentEncoding,
+	} {
+		if v != "" {
+			e.Extensions[k] = v
+		}
+	}
+	if t, ok := msg.Created(); ok {
+		e.Extensions[ExtCreationTime] = t.UTC().Format(time.RFC3339Nano)
+	}
+	if t, ok := msg.Expiry(); ok {
+		e.Extensions[ExtExpiryTime] = t.UTC().Format(time.RFC3339Nano)
+	}
+	if len(e.Extensions) == 0 {
+		e.Extensions = nil
+	}
+	return e, nil
+}
+
+// ToMessage converts the event back to a message,
+// unknown extensions become application properties.
+func ToMessage(e *Event) *common.Message {
+	msg := &common.Message{
+		MessageID:   e.ID,
+		ContentType: e.DataContentType,
+		Payload:     e.Data,
+		Properties:  map[string]string{},
+	}
+	if !e.Time.IsZero() {
+		t := e.Time
+		msg.EnqueuedTime = &t
+	}
+	if e.DataSchema != "" {
+		msg.Properties[dataSchemaProperty] = e.DataSchema
+	}
+	for k, v := range e.Extensions {
+		switch k {
+		case ExtDeviceID:
+			msg.ConnectionDeviceID = v
+		case ExtModuleID:
+			msg.Properties[moduleIDProperty] = v
+		case ExtGenerationID:
+			msg.ConnectionDeviceGenerationID = v
+		case ExtAuthMethod:
+			msg.ConnectionAuthMethod = v
+		case ExtMessageSource:
+			msg.MessageSource = v
+		case ExtComponent:
+			msg.ComponentName = v
+		case ExtCorrelationID:
+			msg.CorrelationID = v
+		case ExtUserID:
+			msg.UserID = v
+		case ExtContentEncoding:
+			msg.ContentEncoding = v
+		case ExtCreationTime, ExtExpiryTime:
+			t, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				msg.Properties[k] = v
+			} else if k == ExtCreationTime {
+				msg.CreationTime = &t
+			} else {
+				msg.ExpiryTime = &t
+			}
+		default:
+			msg.Properties[k] = v
+		}
+	}
+	return msg
+}
+
+// reserved are the standard attribute names.
+var reserved = map[string]bool{
+	"id":              true,
+	"source":          true,
+	"specversion":     true,
+	"type":            true,
+	"datacontenttype": true,
+	"dataschema":      true,
+	"subject":         true,
+	"time":            true,
+	"data":            true,
+	"data_base64":     true,
+}
+
+func isExtensionName(s string) bool {
+	if s == "" || len(s) > 20 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks that the required attributes are present.
+func (e *Event) Validate() error {
+	switch {
+	case e.SpecVersion != SpecVersion:
+		return fmt.Errorf("cloudevents: unsupported specversion %q", e.SpecVersion)
+	case e.ID == "":
+		return errors.New("cloudevents: id is blank")
+	case e.Source == "":
+		return errors.New("cloudevents: source is blank")
+	case e.Type == "":
+		return errors.New("cloudevents: type is blank")
+	}
+	for k := range e.Extensions {
+		if !isExtensionName(k) || reserved[k] {
+			return fmt.Errorf("cloudevents: invalid extension name %q", k)
+		}
+	}
+	return nil
+}
+
+// attributes returns non-blank context attributes but data.
+func (e *Event) attributes() map[string]string {
+	m := make(map[string]string, len(e.Extensions)+8)
+	for k, v := range e.Extensions {
+		m[k] = v
+	}
+	for k, v := range map[string]string{
+		"id":              e.ID,
+		"source":          e.Source,
+		"specversion":     e.SpecVersion,
+		"type":            e.Type,
+		"datacontenttype": e.DataContentType,
+		"dataschema":      e.DataSchema,
+		"subject":         e.Subject,
+	} {
+		if v != "" {
+			m[k] = v
+		}
+	}
+	if !e.Time.IsZero() {
+		m["time"] = e.Time.UTC().Format(time.RFC3339Nano)
+	}
+	return m
+}
+
+func (e *Event) setAttribute(k, v string) error {
+	switch k {
+	case "id":
+		e.ID = v
+	case "source":
+		e.Source = v
+	case "specversion":
+		e.SpecVersion = v
+	case "type":
+		e.Type = v
+	case "datacontenttype":
+		e.DataContentType = v
+	case "dataschema":
+		e.DataSchema = v
+	case "subject":
+		e.Subject = v
+	case "time":
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return fmt.Errorf("cloudevents: malformed time: %s", err)
+		}
+		e.Time = t
+	default:
+		if e.Extensions == nil {
+			e.Extensions = map[string]string{}
+		}
+		e.Extensions[k] = v
+	}
+	return nil
+}
+
+// isJSON reports whether data of the media type is JSON,
+// data of events without datacontenttype is JSON too.
+func isJSON(typ string) bool {
+	if typ == "" {
+		return true
+	}
+	typ, _, err := mime.ParseMediaType(typ)
+	if err != nil {
+		return false
+	}
+	return typ == "application/json" || typ == "text/json" || strings.HasSuffix(typ, "+json")
+}
+
+// MarshalJSON encodes the event in the structured mode, JSON data is
+// embedded as is, text as a string and anything else as data_base64.
+func (e *Event) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{}, len(e.Extensions)+9)
+	for k, v := range e.attributes() {
+		m[k] = v
+	}
+	switch {
+	case e.Data == nil:
+	case isJSON(e.DataContentType) && json.Valid(e.Data):
+		m["data"] = json.RawMessage(e.Data)
+	case strings.HasPrefix(e.DataContentType, "text/") && utf8.Valid(e.Data):
+		m["data"] = string(e.Data)
+	default:
+		m["data_base64"] = base64.StdEncoding.EncodeToString(e.Data)
+	}
+	return json.Marshal(m)
+}
+
+// UnmarshalJSON decodes a structured mode event,
+// non-string extensions are kept in their JSON form.
+func (e *Event) UnmarshalJSON(b []byte) error {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	*e = Event{}
+	for k, v := range m {
+		switch k {
+		case "data", "data_base64":
+			continue
+		}
+		s := string(v)
+		if len(v) != 0 && v[0] == '"' {
+			if err := json.Unmarshal(v, &s); err != nil {
+				return err
+			}
+		} else if s == "null" {
+			continue
+		}
+		if err := e.setAttribute(k, s); err != nil {
+			return err
+		}
+	}
+	if v, ok := m["data_base64"]; ok {
+		var s string
+		if err := json.Unmarshal(v, &s); err != nil {
+			return fmt.Errorf("cloudevents: malformed data_base64: %s", err)
+		}
+		data, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return fmt.Errorf("cloudevents: malformed data_base64: %s", err)
+		}
+		e.Data = data
+	} else if v, ok := m["data"]; ok {
+		e.Data = []byte(v)
+		if !isJSON(e.DataContentType) && len(v) != 0 && v[0] == '"' {
+			var s string
+			if err := json.Unmarshal(v, &s); err != nil {
+				return err
+			}
+			e.Data = []byte(s)
+		}
+	}
+	return nil
+}
+
+// ParseStructured decodes and validates a structured mode event.
+func ParseStructured(b []byte) (*Event, error) {
+	var e Event
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, err
+	}
+	if err := e.Validate(); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// headerPrefix is the prefix of binary mode attribute headers.
+const headerPrefix = "Ce-"
+
+// Header returns binary mode HTTP headers of the event,
+// that's sent with Data as the body.
+func (e *Event) Header() http.Header {
+	h := http.Header{}
+	attrs := e.attributes()
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if k == "datacontenttype" {
+			h.Set("Content-Type", attrs[k])
+			continue
+		}
+		h.Set(headerPrefix+k, escapeHeader(attrs[k]))
+	}
+	return h
+}
+
+// ParseBinary decodes and validates a binary mode event.
+func ParseBinary(h http.Header, body []byte) (*Event, error) {
+	e := &Event{Data: body}
+	for k, vs := range h {
+		if len(vs) == 0 || len(k) <= len(headerPrefix) ||
+			!strings.EqualFold(k[:len(headerPrefix)], headerPrefix) {
+			continue
+		}
+		v, err := url.PathUnescape(vs[0])
+		if err != nil {
+			return nil, fmt.Errorf("cloudevents: malformed %s header: %s", k, err)
+		}
+		if err = e.setAttribute(strings.ToLower(k[len(headerPrefix):]), v); err != nil {
+			return nil, err
+		}
+	}
+	e.DataContentType = h.Get("Content-Type")
+	if err := e.Validate(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// ParseHTTP decodes an event in either mode
+// depending on the Content-Type header.
+func ParseHTTP(h http.Header, body []byte) (*Event, error) {
+	typ, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if typ == ContentType {
+		return ParseStructured(body)
+	}
+	return ParseBinary(h, body)
+}
+
+// escapeHeader percent-encodes spaces, double quotes, percent signs
+// and characters outside of the printable ASCII range.
+func escapeHeader(s string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || c == '"' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
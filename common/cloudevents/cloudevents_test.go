@@ -0,0 +1,168 @@
+package cloudevents
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goautomotive/iothub/common"
+)
+
+func newMessage() *common.Message {
+	enq := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	created := enq.Add(-time.Second)
+	return &common.Message{
+		MessageID:          "mid",
+		CorrelationID:      "cid",
+		ContentType:        "application/json",
+		ContentEncoding:    "utf-8",
+		ConnectionDeviceID: "dev",
+		EnqueuedTime:       &enq,
+		CreationTime:       &created,
+		Payload:            []byte(`{"temperature":25}`),
+		Properties: map[string]string{
+			"level":                       "high",
+			"Not-Valid":                   "x",
+			"iothub-connection-module-id": "mod",
+		},
+	}
+}
+
+func TestFromMessage(t *testing.T) {
+	t.Parallel()
+
+	msg := newMessage()
+	e, err := FromMessage(msg, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if e.ID != "mid" || e.Source != "/devices/dev/modules/mod" ||
+		e.Subject != "devices/dev/modules/mod" || e.Type != TelemetryType ||
+		!e.Time.Equal(*msg.EnqueuedTime) {
+		t.Errorf("FromMessage(...) = %#v", e)
+	}
+	want := map[string]string{
+		"level":            "high",
+		ExtDeviceID:        "dev",
+		ExtModuleID:        "mod",
+		ExtCorrelationID:   "cid",
+		ExtContentEncoding: "utf-8",
+		ExtCreationTime:    "2020-05-01T09:59:59Z",
+	}
+	if !reflect.DeepEqual(e.Extensions, want) {
+		t.Errorf("extensions = %v, want %v", e.Extensions, want)
+	}
+
+	got := ToMessage(e)
+	delete(msg.Properties, "Not-Valid")
+	if !reflect.DeepEqual(got, msg) {
+		t.Errorf("ToMessage(FromMessage(msg)) = %#v, want %#v", got, msg)
+	}
+
+	if _, err = FromMessage(&common.Message{}, ""); err == nil {
+		t.Error("no error for blank source")
+	}
+	e, err = FromMessage(&common.Message{}, "/hub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.ID) != 32 {
+		t.Errorf("generated id = %q", e.ID)
+	}
+}
+
+func TestStructured(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		typ  string
+		data []byte
+		want string // data member
+	}{
+		{"application/json", []byte(`{"a":1}`), `"data":{"a":1}`},
+		{"", []byte(`[1]`), `"data":[1]`},
+		{"text/plain", []byte("hello"), `"data":"hello"`},
+		{"application/octet-stream", []byte{0, 1}, `"data_base64":"AAE="`},
+		{"application/json", []byte("not json"), `"data_base64":"bm90IGpzb24="`},
+	} {
+		e, err := FromMessage(&common.Message{
+			ContentType: tc.typ,
+			Payload:     tc.data,
+		}, "/hub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), tc.want) {
+			t.Errorf("MarshalJSON() = %s, want it contain %s", b, tc.want)
+		}
+		g, err := ParseStructured(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(g, e) {
+			t.Errorf("ParseStructured(%s) = %#v, want %#v", b, g, e)
+		}
+	}
+
+	for _, s := range []string{
+		`{"specversion":"0.3","id":"a","source":"b","type":"c"}`,
+		`{"specversion":"1.0","source":"b","type":"c"}`,
+		`{"specversion":"1.0","id":"a","source":"b","type":"c","Bad":"x"}`,
+		`{"specversion":"1.0","id":"a","source":"b","type":"c","time":"yesterday"}`,
+		`{"specversion":"1.0","id":"a","source":"b","type":"c","data_base64":"!"}`,
+	} {
+		if _, err := ParseStructured([]byte(s)); err == nil {
+			t.Errorf("ParseStructured(%s) error is nil", s)
+		}
+	}
+}
+
+func TestBinary(t *testing.T) {
+	t.Parallel()
+
+	e, err := FromMessage(newMessage(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Extensions["note"] = `50% "done"`
+	h := e.Header()
+	if got := h.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	if got := h.Get("ce-note"); got != "50%25%20%22done%22" {
+		t.Errorf("ce-note = %q", got)
+	}
+	g, err := ParseHTTP(h, e.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(g, e) {
+		t.Errorf("ParseHTTP() = %#v, want %#v", g, e)
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err = ParseHTTP(http.Header{"Content-Type": {ContentType + "; charset=utf-8"}}, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(g, e) {
+		t.Errorf("ParseHTTP() = %#v, want %#v", g, e)
+	}
+
+	if _, err = ParseBinary(http.Header{"Ce-Id": {"a"}}, nil); err == nil {
+		t.Error("binary event without required attributes is valid")
+	}
+}
@@ -0,0 +1,121 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+	"sync"
+)
+
+// Codec encodes and decodes message payloads of its content type.
+type Codec interface {
+	// ContentType is the media type put into the content type
+	// system property of encoded messages, e.g. `application/cbor`.
+	ContentType() string
+
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(b []byte, v interface{}) error
+}
+
+// Built-in codecs, they're registered by default.
+var (
+	JSONCodec     Codec = jsonCodec{}
+	CBORCodec     Codec = cborCodec{}
+	ProtobufCodec Codec = protobufCodec{}
+)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{}
+)
+
+func init() {
+	for _, c := range []Codec{JSONCodec, CBORCodec, ProtobufCodec} {
+		RegisterCodec(c)
+	}
+	codecs["application/protobuf"] = ProtobufCodec
+}
+
+// RegisterCodec makes the codec available for its content type,
+// it replaces the codec previously registered for the same type.
+func RegisterCodec(c Codec) {
+	codecsMu.Lock()
+	codecs[mediaType(c.ContentType())] = c
+	codecsMu.Unlock()
+}
+
+// LookupCodec returns the codec registered for the content type,
+// media type parameters like charset are ignored.
+func LookupCodec(contentType string) (Codec, bool) {
+	codecsMu.RLock()
+	c, ok := codecs[mediaType(contentType)]
+	codecsMu.RUnlock()
+	return c, ok
+}
+
+func mediaType(s string) string {
+	if typ, _, err := mime.ParseMediaType(s); err == nil {
+		return typ
+	}
+	return strings.ToLower(strings.TrimSpace(s))
+}
+
+// ErrUnknownContentType is matched by errors of
+// encoding and decoding payloads without a codec.
+var ErrUnknownContentType = errors.New("no codec for the content type")
+
+func codecFor(contentType string) (Codec, error) {
+	c, ok := LookupCodec(contentType)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownContentType, contentType)
+	}
+	return c, nil
+}
+
+// Encode sets the payload to v encoded with the codec
+// registered for the content type and updates the content type.
+func (m *Message) Encode(contentType string, v interface{}) error {
+	c, err := codecFor(contentType)
+	if err != nil {
+		return err
+	}
+	b, err := c.Marshal(v)
+	if err != nil {
+		return err
+	}
+	m.Payload = b
+	m.ContentType = c.ContentType()
+	return nil
+}
+
+// Decode decodes the payload into v with the codec registered for
+// the message's content type, payloads without one are treated as JSON.
+//
+// Compressed payloads have to be decompressed first.
+func (m *Message) Decode(v interface{}) error {
+	typ := m.ContentType
+	if typ == "" {
+		typ = JSONCodec.ContentType()
+	}
+	c, err := codecFor(typ)
+	if err != nil {
+		return err
+	}
+	return c.Unmarshal(m.Payload, v)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return "application/json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(b []byte, v interface{}) error {
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,104 @@
+package common
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type reading struct {
+	Temperature float64           `json:"temperature"`
+	Unit        string            `json:"unit,omitempty"`
+	Raw         []byte            `json:"raw"`
+	Tags        map[string]string `json:"tags"`
+}
+
+// protoReading mimics gogo/protobuf generated marshaling methods.
+type protoReading struct {
+	value string
+}
+
+func (r *protoReading) Marshal() ([]byte, error) {
+	return []byte(r.value), nil
+}
+
+func (r *protoReading) Unmarshal(b []byte) error {
+	r.value = string(b)
+	return nil
+}
+
+func TestMessageEncodeDecode(t *testing.T) {
+	t.Parallel()
+
+	want := &reading{
+		Temperature: 25.5,
+		Raw:         []byte{0, 1, 2},
+		Tags:        map[string]string{"room": "kitchen"},
+	}
+	for _, typ := range []string{"application/json", "application/cbor", "Application/CBOR; v=1"} {
+		var msg Message
+		if err := msg.Encode(typ, want); err != nil {
+			t.Fatal(err)
+		}
+		if msg.ContentType != mediaType(typ) {
+			t.Errorf("ContentType = %q, want %q", msg.ContentType, mediaType(typ))
+		}
+		var got reading
+		if err := msg.Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(&got, want) {
+			t.Errorf("Decode(Encode(%q)) = %#v, want %#v", typ, got, want)
+		}
+	}
+
+	var msg Message
+	if err := msg.Encode("application/x-protobuf", &protoReading{"pb"}); err != nil {
+		t.Fatal(err)
+	}
+	var pr protoReading
+	if err := msg.Decode(&pr); err != nil || pr.value != "pb" {
+		t.Errorf("Decode() = %v, %q, want nil, %q", err, pr.value, "pb")
+	}
+	if err := msg.Encode("application/x-protobuf", want); err == nil {
+		t.Error("protobuf encoding of a value without marshaling methods succeeds")
+	}
+
+	msg = Message{Payload: []byte(`{"temperature":1}`)}
+	var r reading
+	if err := msg.Decode(&r); err != nil || r.Temperature != 1 {
+		t.Errorf("Decode() without content type = %v, %v", err, r)
+	}
+	msg.ContentType = "text/csv"
+	if err := msg.Decode(&r); !errors.Is(err, ErrUnknownContentType) {
+		t.Errorf("Decode() = %v, want ErrUnknownContentType", err)
+	}
+}
+
+type textCodec struct{}
+
+func (textCodec) ContentType() string { return "text/x-test" }
+func (textCodec) Marshal(v interface{}) ([]byte, error) {
+	return []byte(v.(string)), nil
+}
+func (textCodec) Unmarshal(b []byte, v interface{}) error {
+	*(v.(*string)) = string(b)
+	return nil
+}
+
+func TestRegisterCodec(t *testing.T) {
+	t.Parallel()
+
+	RegisterCodec(textCodec{})
+	if c, ok := LookupCodec("text/x-test; charset=utf-8"); !ok || c != (textCodec{}) {
+		t.Fatalf("LookupCodec() = %v, %t", c, ok)
+	}
+	msg := &Message{}
+	if err := msg.Encode("text/x-test", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	var s string
+	if err := msg.Decode(&s); err != nil || s != "hello" {
+		t.Errorf("Decode() = %v, %q", err, s)
+	}
+}
@@ -0,0 +1,47 @@
+package commonamqp
+
+import (
+	"errors"
+	"net"
+
+	"github.com/goautomotive/iothub/common"
+	"pack.ag/amqp"
+)
+
+// ErrorThrottled is the condition of messages rejected
+// because the device or the hub exceeded its quota.
+const ErrorThrottled amqp.ErrorCondition = "com.microsoft:device-container-throttled"
+
+// FromAMQPError converts throttling errors into *common.ThrottledError,
+// others are returned as is. The hub doesn't hint retry delays over AMQP.
+func FromAMQPError(err error) error {
+	var e *amqp.Error
+	if errors.As(err, &e) && e.Condition == ErrorThrottled {
+		return &common.ThrottledError{Err: err}
+	}
+	return err
+}
+
+// IsConnError reports whether err means the connection or the session
+// is gone, so a new connection has to be established to proceed.
+func IsConnError(err error) bool {
+	if err == amqp.ErrConnClosed || err == amqp.ErrSessionClosed {
+		return true
+	}
+	var n net.Error
+	return errors.As(err, &n)
+}
+
+// IsLinkError reports whether err means that only the link is detached,
+// e.g. because of idle timeout, and it can be reopened on the same connection.
+func IsLinkError(err error) bool {
+	if err == amqp.ErrLinkClosed {
+		return true
+	}
+	var d amqp.DetachError
+	if errors.As(err, &d) {
+		return true
+	}
+	var p *amqp.DetachError
+	return errors.As(err, &p)
+}
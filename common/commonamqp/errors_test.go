@@ -0,0 +1,33 @@
+package commonamqp
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"pack.ag/amqp"
+)
+
+func TestIsConnError(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		err  error
+		conn bool
+		link bool
+	}{
+		{amqp.ErrConnClosed, true, false},
+		{amqp.ErrSessionClosed, true, false},
+		{&net.OpError{Op: "read", Err: errors.New("reset")}, true, false},
+		{amqp.ErrLinkClosed, false, true},
+		{amqp.DetachError{}, false, true},
+		{errors.New("unauthorized"), false, false},
+	} {
+		if got := IsConnError(tc.err); got != tc.conn {
+			t.Errorf("IsConnError(%v) = %t, want %t", tc.err, got, tc.conn)
+		}
+		if got := IsLinkError(tc.err); got != tc.link {
+			t.Errorf("IsLinkError(%v) = %t, want %t", tc.err, got, tc.link)
+		}
+	}
+}
@@ -23,7 +23,12 @@ func FromAMQPMessage(msg *amqp.Message) *common.Message {
 			m.CorrelationID = msg.Properties.CorrelationID.(string)
 		}
 		m.To = msg.Properties.To
+		m.ContentType = msg.Properties.ContentType
+		m.ContentEncoding = msg.Properties.ContentEncoding
 		m.ExpiryTime = &msg.Properties.AbsoluteExpiryTime
+		if !msg.Properties.CreationTime.IsZero() {
+			m.CreationTime = &msg.Properties.CreationTime
+		}
 	}
 	for k, v := range msg.Annotations {
 		switch k {
@@ -48,21 +53,29 @@ func FromAMQPMessage(msg *amqp.Message) *common.Message {
 	return m
 }
 
-// ToAMQPMessage converts amqp.Message into common.Message.
+// ToAMQPMessage converts common.Message into amqp.Message.
 func ToAMQPMessage(msg *common.Message) *amqp.Message {
 	props := make(map[string]interface{}, len(msg.Properties))
 	for k, v := range msg.Properties {
 		props[k] = v
 	}
-	return &amqp.Message{
+	am := &amqp.Message{
 		Data: [][]byte{msg.Payload},
 		Properties: &amqp.MessageProperties{
-			To:                 msg.To,
-			UserID:             []byte(msg.UserID),
-			MessageID:          msg.MessageID,
-			CorrelationID:      msg.CorrelationID,
-			AbsoluteExpiryTime: *msg.ExpiryTime,
+			To:              msg.To,
+			UserID:          []byte(msg.UserID),
+			MessageID:       msg.MessageID,
+			CorrelationID:   msg.CorrelationID,
+			ContentType:     msg.ContentType,
+			ContentEncoding: msg.ContentEncoding,
 		},
 		ApplicationProperties: props,
 	}
+	if t, ok := msg.Expiry(); ok {
+		am.Properties.AbsoluteExpiryTime = t
+	}
+	if t, ok := msg.Created(); ok {
+		am.Properties.CreationTime = t
+	}
+	return am
 }
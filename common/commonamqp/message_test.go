@@ -0,0 +1,33 @@
+package commonamqp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/goautomotive/iothub/common"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().UTC()
+	msg := common.NewMessage([]byte("hello")).
+		SetMessageID("mid").
+		SetContentType("application/json").
+		SetContentEncoding("utf-8").
+		SetCreationTime(now).
+		SetProperty("k", "v")
+
+	am := ToAMQPMessage(msg)
+	if !am.Properties.AbsoluteExpiryTime.IsZero() {
+		t.Errorf("AbsoluteExpiryTime = %v, want zero", am.Properties.AbsoluteExpiryTime)
+	}
+	got := FromAMQPMessage(am)
+	if got.MessageID != "mid" || got.ContentType != "application/json" ||
+		got.ContentEncoding != "utf-8" || got.Properties["k"] != "v" {
+		t.Errorf("FromAMQPMessage(ToAMQPMessage(msg)) = %#v", got)
+	}
+	if ts, ok := got.Created(); !ok || !ts.Equal(now) {
+		t.Errorf("Created() = %v, %t, want %v, true", ts, ok, now)
+	}
+}
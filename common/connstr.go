@@ -0,0 +1,159 @@
+package common
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ConnString is a connection string of a device, a module or a shared
+// access policy, including ones of devices behind IoT Edge gateways.
+//
+// Unlike ParseConnectionString it's strict, unknown and duplicate
+// keys are rejected and the fields are checked for consistency.
+type ConnString struct {
+	HostName            string
+	DeviceID            string
+	ModuleID            string
+	GatewayHostName     string
+	SharedAccessKey     string
+	SharedAccessKeyName string
+	X509                bool // authenticated with a client certificate
+}
+
+// ParseConnString parses and validates the connection string.
+func ParseConnString(s string) (*ConnString, error) {
+	cs, err := parseConnString(s, true)
+	if err != nil {
+		return nil, err
+	}
+	if err = cs.Validate(); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// parseConnString splits s into fields, when strict is false
+// unknown keys are ignored and duplicates override earlier values.
+func parseConnString(s string, strict bool) (*ConnString, error) {
+	cs := &ConnString{}
+	seen := map[string]bool{}
+	for _, chunk := range strings.Split(s, ";") {
+		if chunk == "" {
+			continue // trailing semicolons
+		}
+		kv := strings.SplitN(chunk, "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("malformed connection string")
+		}
+		if seen[kv[0]] && strict {
+			return nil, fmt.Errorf("duplicate %s", kv[0])
+		}
+		seen[kv[0]] = true
+
+		switch kv[0] {
+		case "HostName":
+			cs.HostName = kv[1]
+		case "DeviceId":
+			cs.DeviceID = kv[1]
+		case "ModuleId":
+			cs.ModuleID = kv[1]
+		case "GatewayHostName":
+			cs.GatewayHostName = kv[1]
+		case "SharedAccessKey":
+			cs.SharedAccessKey = kv[1]
+		case "SharedAccessKeyName":
+			cs.SharedAccessKeyName = kv[1]
+		case "x509":
+			if kv[1] != "true" && strict {
+				return nil, fmt.Errorf("x509 = %q, want true", kv[1])
+			}
+			cs.X509 = kv[1] == "true"
+		default:
+			if strict {
+				return nil, fmt.Errorf("unknown key %q", kv[0])
+			}
+		}
+	}
+	return cs, nil
+}
+
+// Validate checks that the connection string is complete.
+func (cs *ConnString) Validate() error {
+	if cs.HostName == "" {
+		return errors.New("HostName is blank")
+	}
+	if cs.ModuleID != "" && cs.DeviceID == "" {
+		return errors.New("ModuleId requires DeviceId")
+	}
+	if cs.X509 {
+		if cs.DeviceID == "" {
+			return errors.New("x509 requires DeviceId")
+		}
+		if cs.SharedAccessKey != "" || cs.SharedAccessKeyName != "" {
+			return errors.New("x509 cannot be combined with shared access keys")
+		}
+		return nil
+	}
+	if cs.SharedAccessKey == "" {
+		return errors.New("SharedAccessKey is blank")
+	}
+	if cs.DeviceID == "" && cs.SharedAccessKeyName == "" {
+		return errors.New("either DeviceId or SharedAccessKeyName is required")
+	}
+	if _, err := base64.StdEncoding.DecodeString(cs.SharedAccessKey); err != nil {
+		return errors.New("SharedAccessKey is not base64 encoded")
+	}
+	return nil
+}
+
+// Format returns the connection string with all the secrets, it's the
+// inverse of ParseConnString, use String for logging.
+func (cs *ConnString) Format() string {
+	return cs.format(cs.SharedAccessKey)
+}
+
+// String returns the connection string with the key redacted.
+func (cs *ConnString) String() string {
+	if cs.SharedAccessKey == "" {
+		return cs.format("")
+	}
+	return cs.format("<redacted>")
+}
+
+func (cs *ConnString) format(key string) string {
+	var b strings.Builder
+	add := func(k, v string) {
+		if v == "" {
+			return
+		}
+		if b.Len() != 0 {
+			b.WriteByte(';')
+		}
+		b.WriteString(k + "=" + v)
+	}
+	add("HostName", cs.HostName)
+	add("DeviceId", cs.DeviceID)
+	add("ModuleId", cs.ModuleID)
+	add("SharedAccessKeyName", cs.SharedAccessKeyName)
+	add("SharedAccessKey", key)
+	add("GatewayHostName", cs.GatewayHostName)
+	if cs.X509 {
+		add("x509", "true")
+	}
+	return b.String()
+}
+
+// Credentials converts the connection string into credentials,
+// that are used for signing tokens.
+func (cs *ConnString) Credentials() *Credentials {
+	return &Credentials{
+		HostName:            cs.HostName,
+		DeviceID:            cs.DeviceID,
+		ModuleID:            cs.ModuleID,
+		GatewayHostName:     cs.GatewayHostName,
+		SharedAccessKey:     cs.SharedAccessKey,
+		SharedAccessKeyName: cs.SharedAccessKeyName,
+	}
+}
@@ -0,0 +1,79 @@
+package common
+
+import "testing"
+
+func TestParseConnString(t *testing.T) {
+	t.Parallel()
+
+	for s, w := range map[string]*ConnString{
+		"HostName=test.azure-devices.net;DeviceId=devnull;SharedAccessKey=c2VjcmV0": {
+			HostName:        "test.azure-devices.net",
+			DeviceID:        "devnull",
+			SharedAccessKey: "c2VjcmV0",
+		},
+		"HostName=test.azure-devices.net;SharedAccessKeyName=iothubowner;SharedAccessKey=c2VjcmV0": {
+			HostName:            "test.azure-devices.net",
+			SharedAccessKeyName: "iothubowner",
+			SharedAccessKey:     "c2VjcmV0",
+		},
+		"HostName=test.azure-devices.net;DeviceId=devnull;ModuleId=mod;SharedAccessKey=c2VjcmV0;GatewayHostName=edge": {
+			HostName:        "test.azure-devices.net",
+			DeviceID:        "devnull",
+			ModuleID:        "mod",
+			GatewayHostName: "edge",
+			SharedAccessKey: "c2VjcmV0",
+		},
+		"HostName=test.azure-devices.net;DeviceId=devnull;x509=true": {
+			HostName: "test.azure-devices.net",
+			DeviceID: "devnull",
+			X509:     true,
+		},
+	} {
+		g, err := ParseConnString(s)
+		if err != nil {
+			t.Fatalf("ParseConnString(%q) error = %s", s, err)
+		}
+		if *g != *w {
+			t.Errorf("ParseConnString(%q) = %#v, want %#v", s, g, w)
+		}
+		if f := g.Format(); f != s {
+			t.Errorf("Format() = %q, want %q", f, s)
+		}
+	}
+}
+
+func TestParseConnStringInvalid(t *testing.T) {
+	t.Parallel()
+
+	for _, s := range []string{
+		"",
+		"DeviceId=devnull;SharedAccessKey=c2VjcmV0",
+		"HostName=test.azure-devices.net;DeviceId=devnull",
+		"HostName=test.azure-devices.net;SharedAccessKey=c2VjcmV0",
+		"HostName=test.azure-devices.net;DeviceId=devnull;SharedAccessKey=%%",
+		"HostName=test.azure-devices.net;ModuleId=mod;SharedAccessKey=c2VjcmV0",
+		"HostName=test.azure-devices.net;DeviceId=devnull;SharedAccessKey=c2VjcmV0;x509=true",
+		"HostName=test.azure-devices.net;DeviceId=devnull;x509=false",
+		"HostName=test.azure-devices.net;DeviceId=devnull;DeviceId=devnull;x509=true",
+		"HostName=test.azure-devices.net;DeviceId=devnull;Foo=bar;x509=true",
+		"HostName=test.azure-devices.net;DeviceId",
+	} {
+		if _, err := ParseConnString(s); err == nil {
+			t.Errorf("ParseConnString(%q) error = nil, want an error", s)
+		}
+	}
+}
+
+func TestConnStringString(t *testing.T) {
+	t.Parallel()
+
+	cs := &ConnString{
+		HostName:        "test.azure-devices.net",
+		DeviceID:        "devnull",
+		SharedAccessKey: "c2VjcmV0",
+	}
+	w := "HostName=test.azure-devices.net;DeviceId=devnull;SharedAccessKey=<redacted>"
+	if g := cs.String(); g != w {
+		t.Errorf("String() = %q, want %q", g, w)
+	}
+}
@@ -0,0 +1,45 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// Dialer establishes network connections, e.g. through SOCKS5 proxies,
+// VPN tunnels or specific network interfaces, it has the signature
+// of net.Dialer.DialContext that can be passed as it is.
+type Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// DialTLS establishes a TCP connection to addr with dial and
+// performs the TLS handshake over it, ServerName defaults to
+// the host of addr when it's not set in config.
+func DialTLS(ctx context.Context, dial Dialer, addr string, config *tls.Config) (net.Conn, error) {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" && !config.InsecureSkipVerify {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tc := tls.Client(conn, config)
+	if d, ok := ctx.Deadline(); ok {
+		tc.SetDeadline(d)
+	}
+	if err = tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
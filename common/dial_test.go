@@ -0,0 +1,45 @@
+package common
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDialTLS(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	s.Config.ErrorLog = log.New(io.Discard, "", 0) // failed handshakes are expected
+	s.StartTLS()
+	defer s.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+
+	var dialed string
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = network + " " + addr
+		return (&net.Dialer{}).DialContext(ctx, network, s.Listener.Addr().String())
+	}
+
+	// the test certificate is issued for example.com
+	conn, err := DialTLS(context.Background(), dial, "example.com:443", &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if dialed != "tcp example.com:443" {
+		t.Errorf("dialed %q, want %q", dialed, "tcp example.com:443")
+	}
+
+	if _, err = DialTLS(context.Background(), dial, "other.com:443", &tls.Config{RootCAs: pool}); err == nil {
+		t.Error("DialTLS() to a host not matching the certificate = nil error")
+	}
+}
@@ -0,0 +1,172 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Errors matched by *HubError with errors.Is,
+// ErrThrottled and ErrMessageTooLarge are matched too.
+var (
+	ErrBadRequest          = errors.New("bad request")
+	ErrUnauthorized        = errors.New("unauthorized")
+	ErrForbidden           = errors.New("forbidden")
+	ErrNotFound            = errors.New("not found")
+	ErrDeviceNotFound      = errors.New("device not found")
+	ErrModuleNotFound      = errors.New("module not found")
+	ErrDeviceAlreadyExists = errors.New("device already exists")
+	ErrPreconditionFailed  = errors.New("precondition failed")
+	ErrQuotaExceeded       = errors.New("quota exceeded")
+	ErrQueueDepthExceeded  = errors.New("device queue depth exceeded")
+	ErrServerError         = errors.New("server error")
+	ErrServiceUnavailable  = errors.New("service unavailable")
+)
+
+// HubError is an unsuccessful response of the hub.
+//
+//	var e *common.HubError
+//	if errors.As(err, &e) {
+//		log.Printf("%s failed, tracking id: %s", e.Code, e.TrackingID)
+//	}
+//	if errors.Is(err, common.ErrDeviceNotFound) {
+//		...
+//	}
+type HubError struct {
+	StatusCode int    // http or operation status code
+	Code       string // the hub's error code, e.g. DeviceNotFound, can be blank
+	TrackingID string // identifies the failure for the Azure support, can be blank
+	Body       []byte // raw response body
+}
+
+func (e *HubError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("code = %d, desc = %q", e.StatusCode, string(e.Body))
+	}
+	return fmt.Sprintf("code = %d (%s), desc = %q", e.StatusCode, e.Code, string(e.Body))
+}
+
+// Is matches errors by the error code or the status code when it's not known.
+func (e *HubError) Is(target error) bool {
+	switch target {
+	case ErrDeviceNotFound:
+		return e.Code == "DeviceNotFound"
+	case ErrModuleNotFound:
+		return e.Code == "ModuleNotFound"
+	case ErrDeviceAlreadyExists:
+		return e.Code == "DeviceAlreadyExists" || e.Code == "ModuleAlreadyExistsOnDevice"
+	case ErrQuotaExceeded:
+		return e.Code == "IotHubQuotaExceeded"
+	case ErrQueueDepthExceeded:
+		return e.Code == "DeviceMaximumQueueDepthExceeded"
+	case ErrMessageTooLarge:
+		return e.Code == "MessageTooLarge" || e.StatusCode == http.StatusRequestEntityTooLarge
+	case ErrBadRequest:
+		return e.StatusCode == http.StatusBadRequest
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrPreconditionFailed:
+		return e.StatusCode == http.StatusPreconditionFailed
+	case ErrThrottled:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrServerError:
+		return e.StatusCode >= http.StatusInternalServerError
+	case ErrServiceUnavailable:
+		return e.StatusCode == http.StatusServiceUnavailable
+	}
+	return false
+}
+
+// Temporary reports whether the request can be retried,
+// that's true for throttled requests and server errors.
+func (e *HubError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests ||
+		e.StatusCode >= http.StatusInternalServerError
+}
+
+// errorCodes are names of numeric error codes returned by newer api versions.
+var errorCodes = map[int]string{
+	400004: "ArgumentInvalid",
+	401002: "IotHubUnauthorizedAccess",
+	403002: "IotHubQuotaExceeded",
+	403004: "DeviceMaximumQueueDepthExceeded",
+	404001: "DeviceNotFound",
+	404010: "ModuleNotFound",
+	409001: "DeviceAlreadyExists",
+	409301: "ModuleAlreadyExistsOnDevice",
+	412002: "PreconditionFailed",
+	413001: "MessageTooLarge",
+	429001: "ThrottlingException",
+	500001: "ServerError",
+	503001: "ServiceUnavailable",
+}
+
+// NewHubError parses the hub's error response, the error code and
+// the tracking id are taken from headers or the body when they're present.
+//
+// Throttled responses are wrapped with *ThrottledError
+// that carries the Retry-After header delay.
+func NewHubError(code int, header http.Header, body []byte) error {
+	e := &HubError{StatusCode: code, Body: body}
+	if header != nil {
+		e.Code = header.Get("iothub-errorcode")
+	}
+	parseErrorBody(e, body)
+	if code != http.StatusTooManyRequests {
+		return e
+	}
+	var d string
+	if header != nil {
+		d = header.Get("Retry-After")
+	}
+	return &ThrottledError{RetryAfter: ParseRetryAfter(d), Err: e}
+}
+
+// parseErrorBody extracts the error code and the tracking id from body,
+// it's either {"Message":"ErrorCode:DeviceNotFound;...","ExceptionMessage":"Tracking ID:..."}
+// or {"errorCode":404001,"trackingId":"...","message":"..."}.
+func parseErrorBody(e *HubError, body []byte) {
+	var v struct {
+		Message          string      `json:"Message"`
+		ExceptionMessage string      `json:"ExceptionMessage"`
+		ErrorCode        interface{} `json:"errorCode"`
+		TrackingID       string      `json:"trackingId"`
+	}
+	if len(body) == 0 || json.Unmarshal(body, &v) != nil {
+		return
+	}
+	if e.Code == "" {
+		switch c := v.ErrorCode.(type) {
+		case float64:
+			e.Code = errorCodes[int(c)]
+		case string:
+			if n, err := strconv.Atoi(c); err == nil {
+				e.Code = errorCodes[n]
+			} else {
+				e.Code = c
+			}
+		}
+	}
+	if e.Code == "" && strings.HasPrefix(v.Message, "ErrorCode:") {
+		s := strings.TrimPrefix(v.Message, "ErrorCode:")
+		if i := strings.IndexByte(s, ';'); i != -1 {
+			s = s[:i]
+		}
+		e.Code = s
+	}
+	e.TrackingID = v.TrackingID
+	if i := strings.Index(v.ExceptionMessage, "Tracking ID:"); e.TrackingID == "" && i != -1 {
+		s := v.ExceptionMessage[i+len("Tracking ID:"):]
+		if i = strings.Index(s, "-TimeStamp:"); i != -1 {
+			s = s[:i]
+		}
+		e.TrackingID = strings.TrimSpace(s)
+	}
+}
@@ -0,0 +1,71 @@
+package common
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNewHubError(t *testing.T) {
+	t.Parallel()
+
+	for name, s := range map[string]struct {
+		code   int
+		header http.Header
+		body   string
+		is     error
+		ecode  string
+		track  string
+	}{
+		"legacy-body": {
+			http.StatusNotFound, nil,
+			`{"Message":"ErrorCode:DeviceNotFound;E2E_MISSING","ExceptionMessage":"Tracking ID:abc-G:10-TimeStamp:01/02/2020 03:04:05"}`,
+			ErrDeviceNotFound, "DeviceNotFound", "abc-G:10",
+		},
+		"numeric-code": {
+			http.StatusConflict, nil,
+			`{"errorCode":409001,"trackingId":"def","message":"exists"}`,
+			ErrDeviceAlreadyExists, "DeviceAlreadyExists", "def",
+		},
+		"header": {
+			http.StatusForbidden, http.Header{"Iothub-Errorcode": {"IotHubQuotaExceeded"}}, "",
+			ErrQuotaExceeded, "IotHubQuotaExceeded", "",
+		},
+		"status-only": {
+			http.StatusPreconditionFailed, nil, "not json",
+			ErrPreconditionFailed, "", "",
+		},
+		"unauthorized": {
+			http.StatusUnauthorized, nil, "",
+			ErrUnauthorized, "", "",
+		},
+	} {
+		err := NewHubError(s.code, s.header, []byte(s.body))
+		if !errors.Is(err, s.is) {
+			t.Errorf("%s: errors.Is(%v, %v) = false, want true", name, err, s.is)
+		}
+		var e *HubError
+		if !errors.As(err, &e) {
+			t.Fatalf("%s: errors.As(%v) = false, want true", name, err)
+		}
+		if e.Code != s.ecode || e.TrackingID != s.track {
+			t.Errorf("%s: code, tracking id = %q, %q, want %q, %q", name, e.Code, e.TrackingID, s.ecode, s.track)
+		}
+	}
+}
+
+func TestNewHubErrorThrottled(t *testing.T) {
+	t.Parallel()
+
+	err := NewHubError(http.StatusTooManyRequests, http.Header{"Retry-After": {"3"}}, nil)
+	if !errors.Is(err, ErrThrottled) || !IsTransient(err) {
+		t.Errorf("NewHubError(429) = %v, want a transient throttling error", err)
+	}
+	if d, ok := RetryAfter(err); !ok || d != 3*time.Second {
+		t.Errorf("RetryAfter(%v) = %s, %t, want 3s, true", err, d, ok)
+	}
+	if errors.Is(err, ErrNotFound) {
+		t.Errorf("errors.Is(%v, ErrNotFound) = true, want false", err)
+	}
+}
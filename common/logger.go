@@ -0,0 +1,76 @@
+package common
+
+import (
+	"fmt"
+	"log"
+)
+
+// LogLevel is a logging severity level.
+type LogLevel int
+
+const (
+	// LevelDebug is for messages produced only in debug mode.
+	LevelDebug LogLevel = iota
+
+	// LevelInfo is for notable events, e.g. connection state changes.
+	LevelInfo
+
+	// LevelWarn is for recoverable problems.
+	LevelWarn
+
+	// LevelError is for failures that need attention.
+	LevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// SDK components names passed to loggers.
+const (
+	ComponentClient    = "client"
+	ComponentTransport = "transport"
+	ComponentMux       = "mux"
+	ComponentAuth      = "auth"
+)
+
+// Logger is a leveled logger used across the SDK, it's easy
+// to adapt to any logging library, e.g. log/slog:
+//
+//	func (l *slogger) Logf(lvl common.LogLevel, component, format string, v ...interface{}) {
+//		l.Log(context.Background(), slog.Level(4*(lvl-1)), fmt.Sprintf(format, v...),
+//			"component", component,
+//		)
+//	}
+type Logger interface {
+	// Logf writes a message, component is the part
+	// of the SDK emitting it, see Component constants.
+	Logf(level LogLevel, component, format string, v ...interface{})
+}
+
+// NewStdLogger adapts the standard library logger, returns nil when l is nil.
+func NewStdLogger(l *log.Logger) Logger {
+	if l == nil {
+		return nil
+	}
+	return &stdLogger{l}
+}
+
+type stdLogger struct {
+	l *log.Logger
+}
+
+func (l *stdLogger) Logf(level LogLevel, component, format string, v ...interface{}) {
+	l.l.Printf("%s %s: %s", level, component, fmt.Sprintf(format, v...))
+}
@@ -0,0 +1,20 @@
+package common
+
+import (
+	"bytes"
+	"log"
+	"testing"
+)
+
+func TestStdLogger(t *testing.T) {
+	t.Parallel()
+
+	b := &bytes.Buffer{}
+	NewStdLogger(log.New(b, "", 0)).Logf(LevelWarn, ComponentTransport, "lost %d", 1)
+	if g, w := b.String(), "WARN transport: lost 1\n"; g != w {
+		t.Errorf("Logf(...) = %q, want %q", g, w)
+	}
+	if l := NewStdLogger(nil); l != nil {
+		t.Errorf("NewStdLogger(nil) = %v, want nil", l)
+	}
+}
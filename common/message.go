@@ -1,6 +1,9 @@
 package common
 
 import (
+	"errors"
+	"fmt"
+	"sync"
 	"time"
 )
 
@@ -27,6 +30,16 @@ type Message struct {
 	// UserID is an ID used to specify the origin of messages.
 	UserID string `json:"UserId,omitempty"`
 
+	// ContentType is the payload's media type, e.g. `application/json`,
+	// routing queries on the message body require it to be JSON.
+	ContentType string `json:"ContentType,omitempty"`
+
+	// ContentEncoding is the payload's character encoding, e.g. `utf-8`.
+	ContentEncoding string `json:"ContentEncoding,omitempty"`
+
+	// CreationTime is time the message was created on the device.
+	CreationTime *time.Time `json:"CreationTimeUtc,omitempty"`
+
 	// ConnectionDeviceID is an ID set by IoT Hub on device-to-cloud messages.
 	// It contains the deviceId of the device that sent the message.
 	ConnectionDeviceID string `json:"ConnectionDeviceId,omitempty"`
@@ -44,6 +57,18 @@ type Message struct {
 	// MessageSource determines a device-to-cloud message transport.
 	MessageSource string `json:"MessageSource,omitempty"`
 
+	// InputName is the name of an IoT Edge module input
+	// the message is delivered to, module clients only.
+	InputName string `json:"InputName,omitempty"`
+
+	// OutputName is the name of an IoT Edge module output
+	// the message is sent to, used by edgeHub for routing.
+	OutputName string `json:"OutputName,omitempty"`
+
+	// ComponentName is the IoT Plug and Play component
+	// the telemetry message belongs to.
+	ComponentName string `json:"ComponentName,omitempty"`
+
 	// Payload is message data.
 	Payload []byte `json:"Payload,omitempty"`
 
@@ -53,3 +78,161 @@ type Message struct {
 	// TransportOptions transport specific options.
 	TransportOptions map[string]interface{} `json:"-"`
 }
+
+const (
+	// MaxDeviceToCloudSize is the hub's device-to-cloud message size limit,
+	// it's applied to batches as a whole too.
+	MaxDeviceToCloudSize = 256 << 10
+
+	// MaxCloudToDeviceSize is the hub's cloud-to-device message size limit.
+	MaxCloudToDeviceSize = 64 << 10
+)
+
+// ErrMessageTooLarge is matched with errors.Is by errors
+// of messages exceeding the hub's size limits.
+var ErrMessageTooLarge = errors.New("message is too large")
+
+// MessageSizeError is returned when a message exceeds the size limit,
+// it's returned before the message is sent to the hub.
+type MessageSizeError struct {
+	Size  int // estimated message size
+	Limit int // size limit
+}
+
+func (e *MessageSizeError) Error() string {
+	return fmt.Sprintf("message is too large: %d bytes, limit is %d", e.Size, e.Limit)
+}
+
+// Is makes the error match ErrMessageTooLarge.
+func (e *MessageSizeError) Is(target error) bool {
+	return target == ErrMessageTooLarge
+}
+
+// Size estimates size of the message the hub takes
+// into account, that is payload plus all properties.
+func (m *Message) Size() int {
+	n := len(m.Payload) + len(m.MessageID) + len(m.CorrelationID) +
+		len(m.UserID) + len(m.To) + len(m.OutputName) +
+		len(m.ContentType) + len(m.ContentEncoding) + len(m.ComponentName)
+	for k, v := range m.Properties {
+		n += len(k) + len(v)
+	}
+	return n
+}
+
+// CheckSize returns a *MessageSizeError when the message exceeds limit.
+func (m *Message) CheckSize(limit int) error {
+	if n := m.Size(); n > limit {
+		return &MessageSizeError{Size: n, Limit: limit}
+	}
+	return nil
+}
+
+// NewMessage creates a message with the given payload,
+// properties can be set with the chainable Set* methods:
+//
+//	msg := common.NewMessage(b).
+//		SetContentType("application/json").
+//		SetProperty("severity", "high")
+func NewMessage(payload []byte) *Message {
+	return &Message{Payload: payload}
+}
+
+// SetMessageID sets the message id.
+func (m *Message) SetMessageID(id string) *Message {
+	m.MessageID = id
+	return m
+}
+
+// SetCorrelationID sets the correlation id.
+func (m *Message) SetCorrelationID(id string) *Message {
+	m.CorrelationID = id
+	return m
+}
+
+// SetUserID sets the user id.
+func (m *Message) SetUserID(id string) *Message {
+	m.UserID = id
+	return m
+}
+
+// SetContentType sets the payload's media type.
+func (m *Message) SetContentType(typ string) *Message {
+	m.ContentType = typ
+	return m
+}
+
+// SetContentEncoding sets the payload's character encoding.
+func (m *Message) SetContentEncoding(enc string) *Message {
+	m.ContentEncoding = enc
+	return m
+}
+
+// SetExpiryTime sets the message expiration time.
+func (m *Message) SetExpiryTime(t time.Time) *Message {
+	m.ExpiryTime = &t
+	return m
+}
+
+// SetCreationTime sets the message creation time.
+func (m *Message) SetCreationTime(t time.Time) *Message {
+	m.CreationTime = &t
+	return m
+}
+
+// SetProperty sets the named application property.
+func (m *Message) SetProperty(k, v string) *Message {
+	if m.Properties == nil {
+		m.Properties = map[string]string{}
+	}
+	m.Properties[k] = v
+	return m
+}
+
+// Property returns the named application property,
+// ok is false when it's not present.
+func (m *Message) Property(k string) (v string, ok bool) {
+	v, ok = m.Properties[k]
+	return v, ok
+}
+
+// Expiry returns the expiration time, ok is false when it's not set.
+func (m *Message) Expiry() (t time.Time, ok bool) {
+	if m.ExpiryTime == nil || m.ExpiryTime.IsZero() {
+		return time.Time{}, false
+	}
+	return *m.ExpiryTime, true
+}
+
+// Created returns the creation time, ok is false when it's not set.
+func (m *Message) Created() (t time.Time, ok bool) {
+	if m.CreationTime == nil || m.CreationTime.IsZero() {
+		return time.Time{}, false
+	}
+	return *m.CreationTime, true
+}
+
+var messagePool = sync.Pool{
+	New: func() interface{} {
+		return &Message{}
+	},
+}
+
+// AcquireMessage returns an empty message from the pool, high-rate senders
+// can return it with ReleaseMessage when they're done with it to reduce
+// allocations, its properties map is reused.
+func AcquireMessage() *Message {
+	return messagePool.Get().(*Message)
+}
+
+// ReleaseMessage resets the message and puts it back to the pool,
+// neither the message nor its properties can be used afterwards.
+// The payload is not reused since it's owned by the caller.
+func ReleaseMessage(m *Message) {
+	props := m.Properties
+	for k := range props {
+		delete(props, k)
+	}
+	*m = Message{Properties: props}
+	messagePool.Put(m)
+}
@@ -0,0 +1,80 @@
+package common
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMessageBuilder(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	msg := NewMessage([]byte("hello")).
+		SetMessageID("mid").
+		SetCorrelationID("cid").
+		SetUserID("uid").
+		SetContentType("application/json").
+		SetContentEncoding("utf-8").
+		SetExpiryTime(now.Add(time.Hour)).
+		SetCreationTime(now).
+		SetProperty("severity", "high")
+
+	if msg.MessageID != "mid" || msg.CorrelationID != "cid" || msg.UserID != "uid" ||
+		msg.ContentType != "application/json" || msg.ContentEncoding != "utf-8" {
+		t.Errorf("NewMessage(...) = %#v", msg)
+	}
+	if v, ok := msg.Property("severity"); !ok || v != "high" {
+		t.Errorf("Property(%q) = %q, %t, want %q, true", "severity", v, ok, "high")
+	}
+	if _, ok := msg.Property("missing"); ok {
+		t.Errorf("Property(%q) is present", "missing")
+	}
+	if exp, ok := msg.Expiry(); !ok || !exp.Equal(now.Add(time.Hour)) {
+		t.Errorf("Expiry() = %v, %t, want %v, true", exp, ok, now.Add(time.Hour))
+	}
+	if ts, ok := msg.Created(); !ok || !ts.Equal(now) {
+		t.Errorf("Created() = %v, %t, want %v, true", ts, ok, now)
+	}
+	if _, ok := NewMessage(nil).Expiry(); ok {
+		t.Error("Expiry() of a new message is set")
+	}
+}
+
+func TestCheckSize(t *testing.T) {
+	t.Parallel()
+
+	msg := NewMessage(make([]byte, 8)).SetProperty("k", "v")
+	if n := msg.Size(); n != 10 {
+		t.Errorf("Size() = %d, want 10", n)
+	}
+	if err := msg.CheckSize(10); err != nil {
+		t.Errorf("CheckSize(10) = %v, want nil", err)
+	}
+	err := msg.CheckSize(9)
+	if !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("CheckSize(9) = %v, want ErrMessageTooLarge", err)
+	}
+	var se *MessageSizeError
+	if !errors.As(err, &se) || se.Size != 10 || se.Limit != 9 {
+		t.Errorf("CheckSize(9) = %#v, want size 10 and limit 9", err)
+	}
+}
+
+func TestReleaseMessage(t *testing.T) {
+	t.Parallel()
+
+	msg := AcquireMessage().SetMessageID("mid").SetProperty("k", "v")
+	ReleaseMessage(msg)
+	if msg.MessageID != "" || len(msg.Properties) != 0 {
+		t.Errorf("released message is not reset: %#v", msg)
+	}
+}
+
+func BenchmarkAcquireMessage(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		msg := AcquireMessage().SetProperty("severity", "low")
+		ReleaseMessage(msg)
+	}
+}
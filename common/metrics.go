@@ -0,0 +1,56 @@
+package common
+
+// Metrics collects SDK health metrics, see the prometheus
+// sub-package for an exporter or adapt any other metrics system.
+//
+// Labels can be nil, implementations must be safe for concurrent use.
+type Metrics interface {
+	// Add increments the named counter by delta.
+	Add(name string, delta float64, labels map[string]string)
+
+	// Set sets the named gauge to v.
+	Set(name string, v float64, labels map[string]string)
+
+	// Observe records v in the named histogram.
+	Observe(name string, v float64, labels map[string]string)
+}
+
+// Metric names reported by the SDK.
+const (
+	// MetricMessagesSent counts sent messages.
+	MetricMessagesSent = "iothub_messages_sent_total"
+
+	// MetricMessagesReceived counts received messages.
+	MetricMessagesReceived = "iothub_messages_received_total"
+
+	// MetricDispatchSeconds is incoming messages and methods handling latency.
+	MetricDispatchSeconds = "iothub_dispatch_duration_seconds"
+
+	// MetricReconnects counts connection re-establishment attempts.
+	MetricReconnects = "iothub_reconnects_total"
+
+	// MetricTokenRenewals counts generated SAS tokens.
+	MetricTokenRenewals = "iothub_token_renewals_total"
+
+	// MetricThrottled counts requests rejected by the hub with 429 status.
+	MetricThrottled = "iothub_throttled_total"
+
+	// MetricRequestSeconds is REST requests latency.
+	MetricRequestSeconds = "iothub_request_duration_seconds"
+
+	// MetricMessagesDropped counts received messages discarded
+	// because subscribers couldn't keep up with them.
+	MetricMessagesDropped = "iothub_messages_dropped_total"
+
+	// MetricSubscriberLag is the number of messages waiting
+	// to be consumed by the most lagging subscriber.
+	MetricSubscriberLag = "iothub_subscriber_lag"
+
+	// MetricSubscriberStalledSeconds is how long the buffer
+	// of the most stalled subscriber has been full.
+	MetricSubscriberStalledSeconds = "iothub_subscriber_stalled_seconds"
+
+	// MetricSlowSubscribers counts slow subscriber reports,
+	// labeled with the subscriber name.
+	MetricSlowSubscribers = "iothub_slow_subscribers_total"
+)
@@ -0,0 +1,194 @@
+// Package prometheus implements common.Metrics that's exported
+// in the prometheus text format without any external dependencies.
+package prometheus
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are histogram buckets in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// New creates a metrics registry that serves collected metrics over http:
+//
+//	m := prometheus.New()
+//	http.Handle("/metrics", m)
+//	c, err := iotdevice.NewClient(iotdevice.WithMetrics(m), ...)
+func New() *Registry {
+	return &Registry{m: map[string]*family{}}
+}
+
+// Registry collects metrics and implements http.Handler.
+type Registry struct {
+	mu sync.Mutex
+	m  map[string]*family
+}
+
+type kind int
+
+const (
+	counter kind = iota
+	gauge
+	histogram
+)
+
+func (k kind) String() string {
+	switch k {
+	case counter:
+		return "counter"
+	case gauge:
+		return "gauge"
+	default:
+		return "histogram"
+	}
+}
+
+// family is a metric with all its label combinations.
+type family struct {
+	kind   kind
+	series map[string]*series // by encoded labels
+}
+
+type series struct {
+	value   float64  // counter and gauge value, histogram sum
+	count   uint64   // histogram only
+	buckets []uint64 // histogram only, counts per DefaultBuckets
+}
+
+// Add implements common.Metrics.
+func (r *Registry) Add(name string, delta float64, labels map[string]string) {
+	r.mu.Lock()
+	r.get(name, counter, labels).value += delta
+	r.mu.Unlock()
+}
+
+// Set implements common.Metrics.
+func (r *Registry) Set(name string, v float64, labels map[string]string) {
+	r.mu.Lock()
+	r.get(name, gauge, labels).value = v
+	r.mu.Unlock()
+}
+
+// Observe implements common.Metrics.
+func (r *Registry) Observe(name string, v float64, labels map[string]string) {
+	r.mu.Lock()
+	s := r.get(name, histogram, labels)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(DefaultBuckets))
+	}
+	for i, b := range DefaultBuckets {
+		if v <= b {
+			s.buckets[i]++
+		}
+	}
+	s.value += v
+	s.count++
+	r.mu.Unlock()
+}
+
+// get returns the series, mu has to be held.
+// A metric keeps the kind it's first used with.
+func (r *Registry) get(name string, k kind, labels map[string]string) *series {
+	f, ok := r.m[name]
+	if !ok {
+		f = &family{kind: k, series: map[string]*series{}}
+		r.m[name] = f
+	}
+	key := encodeLabels(labels)
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{}
+		f.series[key] = s
+	}
+	return s
+}
+
+// encodeLabels returns labels in the exposition format sorted by names.
+func encodeLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = k + `="` + labelEscaper.Replace(labels[k]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+// labelEscaper escapes label values, the text format escapes only
+// backslashes, double quotes and line feeds, unlike Go string literals.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// ServeHTTP writes all metrics in the prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	r.write(bw)
+	bw.Flush()
+}
+
+func (r *Registry) write(w *bufio.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.m))
+	for name := range r.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := r.m[name]
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, f.kind)
+		keys := make([]string, 0, len(f.series))
+		for k := range f.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s := f.series[k]
+			if f.kind != histogram {
+				fmt.Fprintf(w, "%s%s %s\n", name, braces(k), formatFloat(s.value))
+				continue
+			}
+			for i, b := range DefaultBuckets {
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, braces(join(k, `le="`+formatFloat(b)+`"`)), s.buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, braces(join(k, `le="+Inf"`)), s.count)
+			fmt.Fprintf(w, "%s_sum%s %s\n", name, braces(k), formatFloat(s.value))
+			fmt.Fprintf(w, "%s_count%s %d\n", name, braces(k), s.count)
+		}
+	}
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func join(labels, label string) string {
+	if labels == "" {
+		return label
+	}
+	return labels + "," + label
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,51 @@
+package prometheus
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	t.Parallel()
+
+	r := New()
+	r.Add("sent_total", 1, map[string]string{"client": "device"})
+	r.Add("sent_total", 2, map[string]string{"client": "device"})
+	r.Set("lag", 3, nil)
+	r.Observe("latency_seconds", 0.2, nil)
+	r.Observe("latency_seconds", 20, nil)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	g := w.Body.String()
+	for _, s := range []string{
+		"# TYPE lag gauge\nlag 3\n",
+		"# TYPE sent_total counter\nsent_total{client=\"device\"} 3\n",
+		"# TYPE latency_seconds histogram\n",
+		"latency_seconds_bucket{le=\"0.1\"} 0\n",
+		"latency_seconds_bucket{le=\"0.25\"} 1\n",
+		"latency_seconds_bucket{le=\"+Inf\"} 2\n",
+		"latency_seconds_sum 20.2\n",
+		"latency_seconds_count 2\n",
+	} {
+		if !strings.Contains(g, s) {
+			t.Errorf("metrics output doesn't contain %q:\n%s", s, g)
+		}
+	}
+}
+
+func TestEncodeLabels(t *testing.T) {
+	t.Parallel()
+
+	g := encodeLabels(map[string]string{
+		"b": "café\t\x01",
+		"a": "a\\b\"c\nd",
+	})
+	if want := "a=\"a\\\\b\\\"c\\nd\",b=\"café\t\x01\""; g != want {
+		t.Errorf("encodeLabels() = %s, want %s", g, want)
+	}
+	if g = encodeLabels(nil); g != "" {
+		t.Errorf("encodeLabels(nil) = %q, want empty", g)
+	}
+}
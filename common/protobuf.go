@@ -0,0 +1,45 @@
+package common
+
+import (
+	"encoding"
+	"fmt"
+)
+
+// protobufCodec encodes generated protobuf messages, it uses their own
+// marshaling methods not to make the module depend on a protobuf library:
+// `Marshal() ([]byte, error)` of gogo/protobuf, `MarshalVT` of vtprotobuf or
+// `encoding.BinaryMarshaler`, decoding methods are looked up in the same way.
+//
+// Messages generated by google.golang.org/protobuf need a thin codec
+// calling proto.Marshal registered with RegisterCodec instead.
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string {
+	return "application/x-protobuf"
+}
+
+func (protobufCodec) Marshal(v interface{}) ([]byte, error) {
+	switch m := v.(type) {
+	case interface{ MarshalVT() ([]byte, error) }:
+		return m.MarshalVT()
+	case interface{ Marshal() ([]byte, error) }:
+		return m.Marshal()
+	case encoding.BinaryMarshaler:
+		return m.MarshalBinary()
+	default:
+		return nil, fmt.Errorf("protobuf: %T has no marshaling methods", v)
+	}
+}
+
+func (protobufCodec) Unmarshal(b []byte, v interface{}) error {
+	switch m := v.(type) {
+	case interface{ UnmarshalVT([]byte) error }:
+		return m.UnmarshalVT(b)
+	case interface{ Unmarshal([]byte) error }:
+		return m.Unmarshal(b)
+	case encoding.BinaryUnmarshaler:
+		return m.UnmarshalBinary(b)
+	default:
+		return fmt.Errorf("protobuf: %T has no unmarshaling methods", v)
+	}
+}
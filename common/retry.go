@@ -0,0 +1,198 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy decides whether a failed operation should be retried.
+type RetryPolicy interface {
+	// Next returns delay before the given attempt, attempts are counted
+	// from 1 that's the first retry, false means no more retries.
+	Next(attempt int, err error) (time.Duration, bool)
+}
+
+// NoRetry never retries.
+func NoRetry() RetryPolicy {
+	return noRetry{}
+}
+
+type noRetry struct{}
+
+func (noRetry) Next(int, error) (time.Duration, bool) {
+	return 0, false
+}
+
+// LinearRetry retries transient errors up to the given number
+// of attempts increasing delay by interval every attempt.
+func LinearRetry(interval time.Duration, attempts int) RetryPolicy {
+	return &linearRetry{interval: interval, attempts: attempts}
+}
+
+type linearRetry struct {
+	interval time.Duration
+	attempts int
+}
+
+func (r *linearRetry) Next(attempt int, err error) (time.Duration, bool) {
+	if attempt > r.attempts || !IsTransient(err) {
+		return 0, false
+	}
+	return time.Duration(attempt) * r.interval, true
+}
+
+// ExponentialRetry retries transient errors up to the given number
+// of attempts doubling delay every attempt starting from min
+// but not exceeding max, delays are randomized to avoid
+// retrying simultaneously by multiple clients.
+func ExponentialRetry(min, max time.Duration, attempts int) RetryPolicy {
+	return &exponentialRetry{min: min, max: max, attempts: attempts}
+}
+
+type exponentialRetry struct {
+	min, max time.Duration
+	attempts int
+}
+
+func (r *exponentialRetry) Next(attempt int, err error) (time.Duration, bool) {
+	if attempt > r.attempts || !IsTransient(err) {
+		return 0, false
+	}
+	return backoff(r.min, r.max, attempt), true
+}
+
+// Backoff generates delays the same way ExponentialRetry does
+// but it never gives up, e.g. for reconnecting.
+// It's not safe for concurrent use.
+type Backoff struct {
+	Min, Max time.Duration
+	attempt  int
+}
+
+// Next returns the next delay.
+func (b *Backoff) Next() time.Duration {
+	b.attempt++
+	return backoff(b.Min, b.Max, b.attempt)
+}
+
+// backoff returns exponentially growing delay with equal jitter
+// for the given attempt that's counted from 1.
+func backoff(min, max time.Duration, attempt int) time.Duration {
+	d := max
+	if attempt < 32 { // avoid shift overflows
+		if x := min << uint(attempt-1); x > 0 && x < max {
+			d = x
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// IsTransient reports whether err is a temporary failure that makes sense
+// to retry, it is when err or any error it wraps has either
+// Temporary or Timeout method that returns true.
+//
+// Context cancellation errors are never transient.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var t interface{ Temporary() bool }
+	if errors.As(err, &t) && t.Temporary() {
+		return true
+	}
+	var o interface{ Timeout() bool }
+	return errors.As(err, &o) && o.Timeout()
+}
+
+// ErrThrottled is matched by errors of requests rejected by the hub
+// because of exceeding quotas, e.g. 429 responses or ThrottlingException.
+var ErrThrottled = errors.New("throttled")
+
+// ThrottledError is a throttled request failure, it's transient.
+type ThrottledError struct {
+	RetryAfter time.Duration // delay hinted by the hub, zero when not known
+	Err        error         // the hub's response
+}
+
+func (e *ThrottledError) Error() string {
+	if e.RetryAfter == 0 {
+		return fmt.Sprintf("throttled: %s", e.Err)
+	}
+	return fmt.Sprintf("throttled for %s: %s", e.RetryAfter, e.Err)
+}
+
+// Is makes the error match ErrThrottled.
+func (e *ThrottledError) Is(target error) bool {
+	return target == ErrThrottled
+}
+
+func (e *ThrottledError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary always returns true.
+func (e *ThrottledError) Temporary() bool {
+	return true
+}
+
+// RetryAfter returns the delay the hub asks to wait
+// before the next attempt when err is a *ThrottledError.
+func RetryAfter(err error) (time.Duration, bool) {
+	var e *ThrottledError
+	if !errors.As(err, &e) {
+		return 0, false
+	}
+	return e.RetryAfter, true
+}
+
+// ParseRetryAfter parses the Retry-After header value that's
+// either a number of seconds or an HTTP date, zero means it's blank
+// or malformed.
+func ParseRetryAfter(s string) time.Duration {
+	if s == "" {
+		return 0
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 0 {
+			return 0
+		}
+		return time.Duration(n) * time.Second
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// Retry invokes fn until it succeeds, p gives up or ctx is done.
+// When p is nil fn is called only once.
+//
+// Throttled attempts are delayed at least by the hub's hint,
+// see ThrottledError.
+func Retry(ctx context.Context, p RetryPolicy, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || p == nil {
+			return err
+		}
+		d, ok := p.Next(attempt, err)
+		if !ok {
+			return err
+		}
+		if hint, _ := RetryAfter(err); hint > d {
+			d = hint
+		}
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
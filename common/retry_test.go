@@ -0,0 +1,140 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+type tempErr struct{}
+
+func (tempErr) Error() string   { return "temporary" }
+func (tempErr) Temporary() bool { return true }
+
+func TestRetry(t *testing.T) {
+	t.Parallel()
+
+	for name, s := range map[string]struct {
+		policy RetryPolicy
+		err    error
+		calls  int
+	}{
+		"nil":             {nil, tempErr{}, 1},
+		"no-retry":        {NoRetry(), tempErr{}, 1},
+		"linear":          {LinearRetry(time.Millisecond, 2), tempErr{}, 3},
+		"exponential":     {ExponentialRetry(time.Millisecond, 2*time.Millisecond, 3), tempErr{}, 4},
+		"permanent-error": {ExponentialRetry(time.Millisecond, time.Millisecond, 3), errors.New("permanent"), 1},
+	} {
+		var calls int
+		err := Retry(context.Background(), s.policy, func() error {
+			calls++
+			return s.err
+		})
+		if err != s.err {
+			t.Errorf("%s: err = %v, want %v", name, err, s.err)
+		}
+		if calls != s.calls {
+			t.Errorf("%s: calls = %d, want %d", name, calls, s.calls)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	t.Parallel()
+
+	b := &Backoff{Min: time.Second, Max: 10 * time.Second}
+	for i, w := range []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+		10 * time.Second, 10 * time.Second, 10 * time.Second,
+	} {
+		if g := b.Next(); g < w/2 || g > w {
+			t.Errorf("attempt %d: Next() = %s, want within [%s, %s]", i, g, w/2, w)
+		}
+	}
+
+	// check there are no overflows after lots of attempts
+	b.attempt = 100
+	if g := b.Next(); g < 5*time.Second || g > 10*time.Second {
+		t.Errorf("Next() = %s after lots of attempts", g)
+	}
+}
+
+func TestRetryContext(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	err := Retry(ctx, LinearRetry(time.Hour, 1), func() error {
+		cancel()
+		return tempErr{}
+	})
+	if err != context.Canceled {
+		t.Fatalf("err = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	t.Parallel()
+
+	for err, w := range map[error]bool{
+		tempErr{}:                  true,
+		errors.New("permanent"):    false,
+		context.DeadlineExceeded:   false,
+		context.Canceled:           false,
+		&wrapErr{tempErr{}}:        true,
+		&wrapErr{context.Canceled}: false,
+	} {
+		if g := IsTransient(err); g != w {
+			t.Errorf("IsTransient(%v) = %t, want %t", err, g, w)
+		}
+	}
+}
+
+type wrapErr struct{ err error }
+
+func (e *wrapErr) Error() string { return "wrapped: " + e.err.Error() }
+func (e *wrapErr) Unwrap() error { return e.err }
+
+func TestRetryThrottled(t *testing.T) {
+	t.Parallel()
+
+	var calls int
+	start := time.Now()
+	err := Retry(context.Background(), LinearRetry(time.Millisecond, 1), func() error {
+		calls++
+		return &ThrottledError{RetryAfter: 50 * time.Millisecond, Err: errors.New("429")}
+	})
+	if !errors.Is(err, ErrThrottled) {
+		t.Errorf("err = %v, want %v", err, ErrThrottled)
+	}
+	if calls != 2 {
+		t.Errorf("calls = %d, want 2", calls)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("retried after %s, want at least the hinted delay", d)
+	}
+	if d, ok := RetryAfter(&wrapErr{err}); !ok || d != 50*time.Millisecond {
+		t.Errorf("RetryAfter(%v) = %s, %t, want 50ms, true", err, d, ok)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	t.Parallel()
+
+	for s, w := range map[string]time.Duration{
+		"":                              0,
+		"10":                            10 * time.Second,
+		"-1":                            0,
+		"garbage":                       0,
+		"Mon, 02 Jan 2006 15:04:05 GMT": 0,
+	} {
+		if g := ParseRetryAfter(s); g != w {
+			t.Errorf("ParseRetryAfter(%q) = %s, want %s", s, g, w)
+		}
+	}
+	s := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if d := ParseRetryAfter(s); d <= 0 || d > time.Minute {
+		t.Errorf("ParseRetryAfter(%q) = %s, want about a minute", s, d)
+	}
+}
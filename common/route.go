@@ -0,0 +1,913 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Route is a compiled message routing query, that lets testing routes
+// locally before configuring them on the hub, for example:
+//
+//	r, err := common.ParseRoute(`$body.temperature > 25 AND level = 'critical'`)
+//	if err != nil {
+//		return err
+//	}
+//	if r.Match(msg) {
+//		// the message is routed
+//	}
+//
+// Application properties are referenced by name, optionally prefixed with
+// `properties.`, system properties with `$`, e.g. `$contentType`, and
+// the body with `$body`, that's available only for messages with
+// `application/json` content type and UTF-8, -16 or -32 encoding.
+//
+// Twin queries (`$twin`) are not supported.
+//
+// See: https://docs.microsoft.com/en-us/azure/iot-hub/iot-hub-devguide-routing-query-syntax
+type Route struct {
+	query string
+	eval  routeFunc
+}
+
+// ParseRoute compiles the routing query.
+func ParseRoute(query string) (*Route, error) {
+	p := &routeParser{lex: routeLexer{s: query}}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	fn, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+	return &Route{query: query, eval: fn}, nil
+}
+
+// MatchRoute is a shortcut for parsing query and matching msg against it.
+func MatchRoute(query string, msg *Message) (bool, error) {
+	r, err := ParseRoute(query)
+	if err != nil {
+		return false, err
+	}
+	return r.Match(msg), nil
+}
+
+// Match reports whether the message is routed, that's when the query
+// evaluates to true. Like on the hub, references to missing properties
+// and comparisons of different types are undefined and never match.
+func (r *Route) Match(msg *Message) bool {
+	return r.eval(&routeEnv{msg: msg}) == true
+}
+
+// String returns the source query.
+func (r *Route) String() string {
+	return r.query
+}
+
+// undefined is the result of references to missing properties
+// and operations on values of unexpected types.
+type undefined struct{}
+
+// routeFunc evaluates to either undefined, nil (JSON null), bool,
+// float64, string, []interface{} or map[string]interface{}.
+type routeFunc func(env *routeEnv) interface{}
+
+type routeEnv struct {
+	msg     *Message
+	body    interface{}
+	decoded bool
+}
+
+// jsonBody returns the JSON-decoded message body,
+// it's undefined when the message is not JSON.
+func (env *routeEnv) jsonBody() interface{} {
+	if env.decoded {
+		return env.body
+	}
+	env.decoded, env.body = true, undefined{}
+	typ := strings.ToLower(strings.TrimSpace(strings.Split(env.msg.ContentType, ";")[0]))
+	if typ != "application/json" {
+		return env.body
+	}
+	switch strings.ToLower(env.msg.ContentEncoding) {
+	case "utf-8", "utf-16", "utf-32":
+	default:
+		return env.body
+	}
+	var v interface{}
+	if err := json.Unmarshal(env.msg.Payload, &v); err == nil {
+		env.body = v
+	}
+	return env.body
+}
+
+// systemProperty returns the named system property, unknown names
+// are looked up in properties that's where transports leave them.
+func (env *routeEnv) systemProperty(name string) interface{} {
+	m := env.msg
+	var v string
+	switch strings.ToLower(name) {
+	case "contenttype":
+		v = m.ContentType
+	case "contentencoding":
+		v = m.ContentEncoding
+	case "messageid":
+		v = m.MessageID
+	case "correlationid":
+		v = m.CorrelationID
+	case "userid":
+		v = m.UserID
+	case "to":
+		v = m.To
+	case "iothub-connection-device-id", "connectiondeviceid":
+		v = m.ConnectionDeviceID
+	case "iothub-connection-auth-generation-id", "connectiondevicegenerationid":
+		v = m.ConnectionDeviceGenerationID
+	case "iothub-connection-auth-method", "connectionauthmethod":
+		v = m.ConnectionAuthMethod
+	case "iothub-message-source", "messagesource":
+		v = m.MessageSource
+	case "dt-subject":
+		v = m.ComponentName
+	case "iothub-enqueuedtime":
+		if m.EnqueuedTime != nil {
+			v = m.EnqueuedTime.UTC().Format(time.RFC3339Nano)
+		}
+	default:
+		v = m.Properties[name]
+	}
+	if v == "" {
+		return undefined{}
+	}
+	return v
+}
+
+// property returns the named application property.
+func (env *routeEnv) property(name string) interface{} {
+	if v, ok := env.msg.Properties[name]; ok {
+		return v
+	}
+	if s := strings.TrimPrefix(name, "properties."); s != name {
+		if v, ok := env.msg.Properties[s]; ok {
+			return v
+		}
+	}
+	return undefined{}
+}
+
+type routeParser struct {
+	lex routeLexer
+	tok routeToken
+}
+
+func (p *routeParser) next() error {
+	var err error
+	p.tok, err = p.lex.next()
+	return err
+}
+
+func (p *routeParser) errorf(format string, v ...interface{}) error {
+	return fmt.Errorf("route: "+format+" at position %d", append(v, p.tok.pos+1)...)
+}
+
+// keyword reports whether the current token is the case-insensitive keyword.
+func (p *routeParser) keyword(kw string) bool {
+	return p.tok.kind == tokIdent && strings.EqualFold(p.tok.s, kw)
+}
+
+func (p *routeParser) parseOr() (routeFunc, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		if err = p.next(); err != nil {
+			return nil, err
+		}
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = orFunc(l, r)
+	}
+	return l, nil
+}
+
+func orFunc(l, r routeFunc) routeFunc {
+	return func(env *routeEnv) interface{} {
+		a, b := l(env), r(env)
+		if a == true || b == true {
+			return true
+		}
+		if a == false && b == false {
+			return false
+		}
+		return undefined{}
+	}
+}
+
+func (p *routeParser) parseAnd() (routeFunc, error) {
+	l, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		if err = p.next(); err != nil {
+			return nil, err
+		}
+		r, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l = andFunc(l, r)
+	}
+	return l, nil
+}
+
+func andFunc(l, r routeFunc) routeFunc {
+	return func(env *routeEnv) interface{} {
+		a, b := l(env), r(env)
+		if a == false || b == false {
+			return false
+		}
+		if a == true && b == true {
+			return true
+		}
+		return undefined{}
+	}
+}
+
+func (p *routeParser) parseNot() (routeFunc, error) {
+	if !p.keyword("NOT") {
+		return p.parseComparison()
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	fn, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	return func(env *routeEnv) interface{} {
+		if b, ok := fn(env).(bool); ok {
+			return !b
+		}
+		return undefined{}
+	}, nil
+}
+
+func (p *routeParser) parseComparison() (routeFunc, error) {
+	l, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokOp {
+		return l, nil
+	}
+	op := p.tok.s
+	switch op {
+	case "=", "!=", "<>", "<", "<=", ">", ">=":
+	default:
+		return l, nil
+	}
+	if err = p.next(); err != nil {
+		return nil, err
+	}
+	r, err := p.parseAdditive()
+	if err != nil {
+		return nil, err
+	}
+	return func(env *routeEnv) interface{} {
+		c, ok := compare(l(env), r(env))
+		if !ok {
+			return undefined{}
+		}
+		switch op {
+		case "=":
+			return c == 0
+		case "!=", "<>":
+			return c != 0
+		case "<":
+			return c < 0
+		case "<=":
+			return c <= 0
+		case ">":
+			return c > 0
+		default:
+			return c >= 0
+		}
+	}, nil
+}
+
+// compare compares two primitive values of the same type,
+// ok is false when they cannot be compared. Booleans and nulls
+// are only ordered to be tested for equality.
+func compare(a, b interface{}) (int, bool) {
+	switch x := a.(type) {
+	case float64:
+		y, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		default:
+			return 0, true
+		}
+	case string:
+		y, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(x, y), true
+	case bool:
+		y, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		if x == y {
+			return 0, true
+		}
+		return 1, true
+	case nil:
+		if b != nil {
+			return 0, false
+		}
+		return 0, true
+	default:
+		return 0, false
+	}
+}
+
+func (p *routeParser) parseAdditive() (routeFunc, error) {
+	l, err := p.parseMultiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok.kind == tokOp && (p.tok.s == "+" || p.tok.s == "-") {
+		op := p.tok.s
+		if err = p.next(); err != nil {
+			return nil, err
+		}
+		r, err := p.parseMultiplicative()
+		if err != nil {
+			return nil, err
+		}
+		l = arithFunc(op, l, r)
+	}
+	return l, nil
+}
+
+func (p *routeParser) parseMultiplicative() (routeFunc, error) {
+	l, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok.kind == tokOp && (p.tok.s == "*" || p.tok.s == "/" || p.tok.s == "%") {
+		op := p.tok.s
+		if err = p.next(); err != nil {
+			return nil, err
+		}
+		r, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l = arithFunc(op, l, r)
+	}
+	return l, nil
+}
+
+func arithFunc(op string, l, r routeFunc) routeFunc {
+	return func(env *routeEnv) interface{} {
+		x, ok := l(env).(float64)
+		if !ok {
+			return undefined{}
+		}
+		y, ok := r(env).(float64)
+		if !ok {
+			return undefined{}
+		}
+		switch op {
+		case "+":
+			return x + y
+		case "-":
+			return x - y
+		case "*":
+			return x * y
+		}
+		if y == 0 {
+			return undefined{}
+		}
+		if op == "/" {
+			return x / y
+		}
+		return math.Mod(x, y)
+	}
+}
+
+func (p *routeParser) parseUnary() (routeFunc, error) {
+	if p.tok.kind != tokOp || p.tok.s != "-" {
+		return p.parsePrimary()
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	fn, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	return func(env *routeEnv) interface{} {
+		if x, ok := fn(env).(float64); ok {
+			return -x
+		}
+		return undefined{}
+	}, nil
+}
+
+func (p *routeParser) parsePrimary() (routeFunc, error) {
+	tok := p.tok
+	switch tok.kind {
+	case tokNumber:
+		f, err := strconv.ParseFloat(tok.s, 64)
+		if err != nil {
+			return nil, p.errorf("malformed number %q", tok.s)
+		}
+		return constFunc(f), p.next()
+	case tokString:
+		return constFunc(tok.s), p.next()
+	case tokLParen:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		fn, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokRParen {
+			return nil, p.errorf("expected ')', got %s", p.tok)
+		}
+		return fn, p.next()
+	case tokIdent:
+		switch strings.ToLower(tok.s) {
+		case "true":
+			return constFunc(true), p.next()
+		case "false":
+			return constFunc(false), p.next()
+		case "null":
+			return constFunc(nil), p.next()
+		case "and", "or", "not":
+			return nil, p.errorf("unexpected %s", tok)
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind == tokLParen {
+			return p.parseCall(tok)
+		}
+		return p.parseReference(tok)
+	default:
+		return nil, p.errorf("unexpected %s", tok)
+	}
+}
+
+func constFunc(v interface{}) routeFunc {
+	return func(*routeEnv) interface{} {
+		return v
+	}
+}
+
+// routeSelector is a member name or an array index of $body paths.
+type routeSelector struct {
+	name  string
+	index int // when name is blank
+}
+
+// parseReference parses property and $body references, tok is already consumed.
+func (p *routeParser) parseReference(tok routeToken) (routeFunc, error) {
+	var path []routeSelector
+	for p.tok.kind == tokDot || p.tok.kind == tokLBracket {
+		if p.tok.kind == tokDot {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			if p.tok.kind != tokIdent {
+				return nil, p.errorf("expected property name, got %s", p.tok)
+			}
+			path = append(path, routeSelector{name: p.tok.s})
+		} else {
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			switch p.tok.kind {
+			case tokNumber:
+				i, err := strconv.Atoi(p.tok.s)
+				if err != nil || i < 0 {
+					return nil, p.errorf("malformed array index %q", p.tok.s)
+				}
+				path = append(path, routeSelector{index: i})
+			case tokString:
+				path = append(path, routeSelector{name: p.tok.s})
+			default:
+				return nil, p.errorf("expected array index, got %s", p.tok)
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+			if p.tok.kind != tokRBracket {
+				return nil, p.errorf("expected ']', got %s", p.tok)
+			}
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	if !strings.HasPrefix(tok.s, "$") {
+		name := tok.s
+		for _, sel := range path {
+			if sel.name == "" {
+				return nil, p.errorf("application property %q cannot be indexed", name)
+			}
+			name += "." + sel.name
+		}
+		return func(env *routeEnv) interface{} {
+			return env.property(name)
+		}, nil
+	}
+	switch name := tok.s[1:]; strings.ToLower(name) {
+	case "body":
+		return func(env *routeEnv) interface{} {
+			return selectPath(env.jsonBody(), path)
+		}, nil
+	case "twin":
+		return nil, p.errorf("twin queries are not supported")
+	default:
+		if len(path) != 0 {
+			return nil, p.errorf("system property %q has no members", tok.s)
+		}
+		return func(env *routeEnv) interface{} {
+			return env.systemProperty(name)
+		}, nil
+	}
+}
+
+func selectPath(v interface{}, path []routeSelector) interface{} {
+	for _, sel := range path {
+		switch x := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = x[sel.name]; !ok || sel.name == "" {
+				return undefined{}
+			}
+		case []interface{}:
+			if sel.name != "" || sel.index >= len(x) {
+				return undefined{}
+			}
+			v = x[sel.index]
+		default:
+			return undefined{}
+		}
+	}
+	return v
+}
+
+// parseCall parses built-in function calls, name is already consumed.
+func (p *routeParser) parseCall(name routeToken) (routeFunc, error) {
+	fn, ok := routeFuncs[strings.ToUpper(name.s)]
+	if !ok {
+		return nil, fmt.Errorf("route: unknown function %q at position %d", name.s, name.pos+1)
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	var args []routeFunc
+	for p.tok.kind != tokRParen {
+		if len(args) != 0 {
+			if p.tok.kind != tokComma {
+				return nil, p.errorf("expected ',' or ')', got %s", p.tok)
+			}
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	if len(args) < fn.min || fn.max >= 0 && len(args) > fn.max {
+		return nil, fmt.Errorf("route: wrong number of arguments to %s at position %d",
+			strings.ToUpper(name.s), name.pos+1)
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	return func(env *routeEnv) interface{} {
+		vs := make([]interface{}, len(args))
+		for i := range args {
+			vs[i] = args[i](env)
+		}
+		return fn.call(vs)
+	}, nil
+}
+
+// routeFuncs are built-in functions by their upper-cased names.
+var routeFuncs = map[string]struct {
+	min, max int // number of arguments, max is -1 for variadic functions
+	call     func(args []interface{}) interface{}
+}{
+	"IS_DEFINED": {1, 1, func(v []interface{}) interface{} {
+		_, ok := v[0].(undefined)
+		return !ok
+	}},
+	"IS_NULL": {1, 1, func(v []interface{}) interface{} {
+		return v[0] == nil
+	}},
+	"IS_BOOL": {1, 1, func(v []interface{}) interface{} {
+		_, ok := v[0].(bool)
+		return ok
+	}},
+	"IS_NUMBER": {1, 1, func(v []interface{}) interface{} {
+		_, ok := v[0].(float64)
+		return ok
+	}},
+	"IS_STRING": {1, 1, func(v []interface{}) interface{} {
+		_, ok := v[0].(string)
+		return ok
+	}},
+	"IS_ARRAY": {1, 1, func(v []interface{}) interface{} {
+		_, ok := v[0].([]interface{})
+		return ok
+	}},
+	"IS_OBJECT": {1, 1, func(v []interface{}) interface{} {
+		_, ok := v[0].(map[string]interface{})
+		return ok
+	}},
+	"IS_PRIMITIVE": {1, 1, func(v []interface{}) interface{} {
+		switch v[0].(type) {
+		case nil, bool, float64, string:
+			return true
+		default:
+			return false
+		}
+	}},
+	"ABS":     {1, 1, mathFunc(math.Abs)},
+	"CEILING": {1, 1, mathFunc(math.Ceil)},
+	"FLOOR":   {1, 1, mathFunc(math.Floor)},
+	"EXP":     {1, 1, mathFunc(math.Exp)},
+	"SQRT":    {1, 1, mathFunc(math.Sqrt)},
+	"SQUARE": {1, 1, mathFunc(func(x float64) float64 {
+		return x * x
+	})},
+	"SIGN": {1, 1, mathFunc(func(x float64) float64 {
+		switch {
+		case x > 0:
+			return 1
+		case x < 0:
+			return -1
+		default:
+			return 0
+		}
+	})},
+	"POWER": {2, 2, func(v []interface{}) interface{} {
+		x, ok1 := v[0].(float64)
+		y, ok2 := v[1].(float64)
+		if !ok1 || !ok2 {
+			return undefined{}
+		}
+		return math.Pow(x, y)
+	}},
+	"LENGTH": {1, 1, func(v []interface{}) interface{} {
+		s, ok := v[0].(string)
+		if !ok {
+			return undefined{}
+		}
+		return float64(len([]rune(s)))
+	}},
+	"LOWER": {1, 1, stringFunc(strings.ToLower)},
+	"UPPER": {1, 1, stringFunc(strings.ToUpper)},
+	"CONCAT": {2, -1, func(v []interface{}) interface{} {
+		var b strings.Builder
+		for _, x := range v {
+			s, ok := x.(string)
+			if !ok {
+				return undefined{}
+			}
+			b.WriteString(s)
+		}
+		return b.String()
+	}},
+	"SUBSTRING": {3, 3, func(v []interface{}) interface{} {
+		s, ok1 := v[0].(string)
+		i, ok2 := v[1].(float64)
+		n, ok3 := v[2].(float64)
+		if !ok1 || !ok2 || !ok3 {
+			return undefined{}
+		}
+		r := []rune(s)
+		start := int(math.Max(0, math.Min(i, float64(len(r)))))
+		end := int(math.Max(float64(start), math.Min(float64(start)+n, float64(len(r)))))
+		return string(r[start:end])
+	}},
+	"INDEX_OF": {2, 2, func(v []interface{}) interface{} {
+		s, sub, ok := stringArgs(v)
+		if !ok {
+			return undefined{}
+		}
+		i := strings.Index(s, sub)
+		if i < 0 {
+			return float64(-1)
+		}
+		return float64(len([]rune(s[:i])))
+	}},
+	"CONTAINS": {2, 2, func(v []interface{}) interface{} {
+		s, sub, ok := stringArgs(v)
+		if !ok {
+			return undefined{}
+		}
+		return strings.Contains(s, sub)
+	}},
+	"STARTS_WITH": {2, 2, func(v []interface{}) interface{} {
+		s, prefix, ok := stringArgs(v)
+		if !ok {
+			return undefined{}
+		}
+		return strings.HasPrefix(s, prefix)
+	}},
+	"ENDS_WITH": {2, 2, func(v []interface{}) interface{} {
+		s, suffix, ok := stringArgs(v)
+		if !ok {
+			return undefined{}
+		}
+		return strings.HasSuffix(s, suffix)
+	}},
+}
+
+func mathFunc(fn func(float64) float64) func([]interface{}) interface{} {
+	return func(v []interface{}) interface{} {
+		x, ok := v[0].(float64)
+		if !ok {
+			return undefined{}
+		}
+		return fn(x)
+	}
+}
+
+func stringFunc(fn func(string) string) func([]interface{}) interface{} {
+	return func(v []interface{}) interface{} {
+		s, ok := v[0].(string)
+		if !ok {
+			return undefined{}
+		}
+		return fn(s)
+	}
+}
+
+func stringArgs(v []interface{}) (string, string, bool) {
+	a, ok1 := v[0].(string)
+	b, ok2 := v[1].(string)
+	return a, b, ok1 && ok2
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+	tokLBracket
+	tokRBracket
+	tokDot
+	tokComma
+)
+
+type routeToken struct {
+	kind tokenKind
+	s    string
+	pos  int
+}
+
+func (t routeToken) String() string {
+	switch t.kind {
+	case tokEOF:
+		return "end of query"
+	case tokString:
+		return strconv.Quote(t.s)
+	default:
+		return "'" + t.s + "'"
+	}
+}
+
+type routeLexer struct {
+	s   string
+	pos int
+}
+
+func (l *routeLexer) next() (routeToken, error) {
+	for l.pos < len(l.s) && unicode.IsSpace(rune(l.s[l.pos])) {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos == len(l.s) {
+		return routeToken{kind: tokEOF, pos: start}, nil
+	}
+	tok := func(kind tokenKind, n int) (routeToken, error) {
+		l.pos += n
+		return routeToken{kind: kind, s: l.s[start:l.pos], pos: start}, nil
+	}
+
+	c := l.s[l.pos]
+	switch {
+	case c == '(':
+		return tok(tokLParen, 1)
+	case c == ')':
+		return tok(tokRParen, 1)
+	case c == '[':
+		return tok(tokLBracket, 1)
+	case c == ']':
+		return tok(tokRBracket, 1)
+	case c == ',':
+		return tok(tokComma, 1)
+	case c == '.' && !(l.pos+1 < len(l.s) && isDigit(l.s[l.pos+1])):
+		return tok(tokDot, 1)
+	case c == '\'' || c == '"':
+		return l.quoted(c)
+	case isDigit(c) || c == '.':
+		n := 0
+		for l.pos+n < len(l.s) && (isDigit(l.s[l.pos+n]) || l.s[l.pos+n] == '.' ||
+			(l.s[l.pos+n] == 'e' || l.s[l.pos+n] == 'E') ||
+			(n > 0 && (l.s[l.pos+n] == '+' || l.s[l.pos+n] == '-') &&
+				(l.s[l.pos+n-1] == 'e' || l.s[l.pos+n-1] == 'E'))) {
+			n++
+		}
+		return tok(tokNumber, n)
+	case c == '$' || isIdentStart(c):
+		n := 1
+		for l.pos+n < len(l.s) {
+			c := l.s[l.pos+n]
+			// hyphens are part of system property names, e.g. $iothub-enqueuedtime
+			if !isIdentStart(c) && !isDigit(c) && !(c == '-' && l.s[start] == '$') {
+				break
+			}
+			n++
+		}
+		if n == 1 && c == '$' {
+			return routeToken{}, fmt.Errorf("route: expected property name at position %d", start+2)
+		}
+		return tok(tokIdent, n)
+	}
+	for _, op := range []string{"!=", "<>", "<=", ">=", "=", "<", ">", "+", "-", "*", "/", "%"} {
+		if strings.HasPrefix(l.s[l.pos:], op) {
+			return tok(tokOp, len(op))
+		}
+	}
+	return routeToken{}, fmt.Errorf("route: unexpected character %q at position %d", c, start+1)
+}
+
+// quoted scans a string literal, quotes are escaped with backslashes.
+func (l *routeLexer) quoted(q byte) (routeToken, error) {
+	start := l.pos
+	var b bytes.Buffer
+	for l.pos++; l.pos < len(l.s); l.pos++ {
+		c := l.s[l.pos]
+		switch {
+		case c == q:
+			l.pos++
+			return routeToken{kind: tokString, s: b.String(), pos: start}, nil
+		case c == '\\' && l.pos+1 < len(l.s):
+			l.pos++
+			switch c = l.s[l.pos]; c {
+			case 'n':
+				c = '\n'
+			case 't':
+				c = '\t'
+			}
+		}
+		b.WriteByte(c)
+	}
+	return routeToken{}, fmt.Errorf("route: unterminated string at position %d", start+1)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
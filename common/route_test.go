@@ -0,0 +1,131 @@
+package common
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoute(t *testing.T) {
+	t.Parallel()
+
+	enq := time.Date(2020, 5, 1, 10, 0, 0, 0, time.UTC)
+	msg := &Message{
+		Payload: []byte(`{
+	"temperature": 30.5,
+	"weather": {"locations": ["kyiv", "tokyo"], "windy": true},
+	"note": null
+}`),
+		ContentType:        "application/json",
+		ContentEncoding:    "utf-8",
+		ConnectionDeviceID: "dev-1",
+		EnqueuedTime:       &enq,
+		Properties: map[string]string{
+			"level":                       "critical",
+			"count":                       "10",
+			"iothub-connection-module-id": "mod",
+		},
+	}
+
+	for query, want := range map[string]bool{
+		"true":  true,
+		"false": false,
+		`$body.temperature > 25 AND properties.level = 'critical'`:           true,
+		`$body.temperature > 25 AND level = "critical"`:                      true,
+		`$body.temperature > 25 AND level <> 'critical'`:                     false,
+		`$body.temperature >= 30.5 and $body.temperature <= 30.5`:            true,
+		`$body.temperature * 2 - 1 = 60`:                                     true,
+		`-$body.temperature < 0`:                                             true,
+		`$body.temperature % 2 = 0.5`:                                        true,
+		`$body.temperature / 0 = 1`:                                          false,
+		`$body.weather.locations[1] = 'tokyo'`:                               true,
+		`$body.weather['windy']`:                                             true,
+		`$body.weather.locations[2] = 'tokyo'`:                               false,
+		`$body.missing = 1 OR level = 'critical'`:                            true,
+		`NOT $body.missing = 1`:                                              false,
+		`NOT ($body.temperature < 0)`:                                        true,
+		`$body.note = null`:                                                  true,
+		`count = 10`:                                                         false, // properties are strings
+		`count = '10'`:                                                       true,
+		`$contentType = 'application/json'`:                                  true,
+		`$connectionDeviceId = 'dev-1'`:                                      true,
+		`$iothub-connection-device-id = 'dev-1'`:                             true,
+		`$iothub-connection-module-id = 'mod'`:                               true,
+		`$iothub-enqueuedtime > '2020-01-01'`:                                true,
+		`IS_DEFINED($body.temperature) AND NOT IS_DEFINED(foo)`:              true,
+		`IS_NULL($body.note) AND IS_OBJECT($body.weather)`:                   true,
+		`IS_ARRAY($body.weather.locations) AND IS_NUMBER($body.temperature)`: true,
+		`is_string(level) and is_bool($body.weather.windy)`:                  true,
+		`STARTS_WITH(level, 'crit') AND ENDS_WITH(level, 'cal')`:             true,
+		`CONTAINS(UPPER(level), 'TIC') AND LENGTH(level) = 8`:                true,
+		`CONCAT(level, '-', $connectionDeviceId) = 'critical-dev-1'`:         true,
+		`SUBSTRING(level, 2, 3) = 'iti' AND INDEX_OF(level, 'tic') = 3`:      true,
+		`FLOOR($body.temperature) = 30 AND CEILING($body.temperature) = 31`:  true,
+		`ABS(-2) = SQRT(4) AND POWER(2, 3) = 8 AND SQUARE(3) = 9`:            true,
+		`SIGN($body.temperature) = 1`:                                        true,
+		`1e2 = 100 AND .5 = 0.5`:                                             true,
+	} {
+		r, err := ParseRoute(query)
+		if err != nil {
+			t.Errorf("ParseRoute(%q) error: %s", query, err)
+			continue
+		}
+		if got := r.Match(msg); got != want {
+			t.Errorf("%q matches = %t, want %t", query, got, want)
+		}
+	}
+}
+
+func TestRouteNonJSONBody(t *testing.T) {
+	t.Parallel()
+
+	for _, msg := range []*Message{
+		{Payload: []byte(`{"a":1}`)},
+		{Payload: []byte(`{"a":1}`), ContentType: "application/json"},
+		{Payload: []byte(`{"a":1`), ContentType: "application/json", ContentEncoding: "utf-8"},
+	} {
+		ok, err := MatchRoute(`$body.a = 1`, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			t.Errorf("body of %#v is matched", msg)
+		}
+	}
+	ok, err := MatchRoute(`$body.a = 1`, &Message{
+		Payload:         []byte(`{"a":1}`),
+		ContentType:     "application/json; charset=utf-8",
+		ContentEncoding: "UTF-8",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("JSON body is not matched")
+	}
+}
+
+func TestParseRouteErrors(t *testing.T) {
+	t.Parallel()
+
+	for query, want := range map[string]string{
+		"":                     "unexpected end of query",
+		"a =":                  "unexpected end of query",
+		"(a = 1":               "expected ')'",
+		"a = 'b":               "unterminated string",
+		"a # 1":                "unexpected character",
+		"$twin.tags.a = 1":     "twin queries are not supported",
+		"NOPE(a)":              "unknown function",
+		"LOWER(a, b) = 'x'":    "wrong number of arguments",
+		"$contentType.a = 'x'": "has no members",
+		"a[0] = 1":             "cannot be indexed",
+		"$body.a[x] = 1":       "expected array index",
+		"a = 1 b":              "unexpected 'b'",
+		"$ = 1":                "expected property name",
+		"a = 1 AND":            "unexpected end of query",
+	} {
+		if _, err := ParseRoute(query); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("ParseRoute(%q) = %v, want %q error", query, err, want)
+		}
+	}
+}
@@ -14,27 +14,21 @@ import (
 
 // ParseConnectionString parses the given string into a Credentials struct.
 // If you use a shared access policy DeviceId is needed to be added manually.
+//
+// It's lenient, unknown keys are ignored, see ParseConnString
+// for the strict version.
 func ParseConnectionString(cs string) (*Credentials, error) {
-	chunks := strings.Split(cs, ";")
-	if len(chunks) != 3 && len(chunks) != 4 {
+	if len(strings.Split(cs, ";")) < 3 {
 		return nil, errors.New("malformed connection string")
 	}
-
-	m := &Credentials{}
-	for _, chunk := range chunks {
-		c := strings.SplitN(chunk, "=", 2)
-		switch c[0] {
-		case "HostName":
-			m.HostName = c[1]
-		case "DeviceId":
-			m.DeviceID = c[1]
-		case "SharedAccessKey":
-			m.SharedAccessKey = c[1]
-		case "SharedAccessKeyName":
-			m.SharedAccessKeyName = c[1]
-		}
+	c, err := parseConnString(cs, false)
+	if err != nil {
+		return nil, err
+	}
+	if c.HostName == "" {
+		return nil, errors.New("HostName is blank")
 	}
-	return m, nil
+	return c.Credentials(), nil
 }
 
 // Credentials contains all the required credentials
@@ -42,6 +36,8 @@ func ParseConnectionString(cs string) (*Credentials, error) {
 type Credentials struct {
 	HostName            string
 	DeviceID            string
+	ModuleID            string
+	GatewayHostName     string
 	SharedAccessKey     string
 	SharedAccessKeyName string
 
@@ -49,41 +45,84 @@ type Credentials struct {
 	now time.Time
 }
 
+// ValidateKey checks that key is a non-blank base64 encoded shared access key.
+func ValidateKey(key string) error {
+	if key == "" {
+		return errors.New("key is blank")
+	}
+	if _, err := base64.StdEncoding.DecodeString(key); err != nil {
+		return fmt.Errorf("malformed key: %s", err)
+	}
+	return nil
+}
+
 // SAS generates an access token for the given uri and duration.
 func (c *Credentials) SAS(uri string, duration time.Duration) (string, error) {
-	if uri == "" {
-		return "", errors.New("uri is blank")
-	}
 	if duration == 0 {
 		return "", errors.New("duration is zero")
 	}
 	if c.SharedAccessKey == "" {
 		return "", errors.New("SharedAccessKey is blank")
 	}
-
-	sr := url.QueryEscape(uri)
 	ts := time.Now()
 	if !c.now.IsZero() {
 		ts = c.now
 	}
-	se := ts.Add(duration).Unix()
-
-	b, err := base64.StdEncoding.DecodeString(c.SharedAccessKey)
+	sas, err := NewSharedAccessSignature(uri, c.SharedAccessKeyName, c.SharedAccessKey, ts.Add(duration))
 	if err != nil {
 		return "", err
 	}
+	return sas.String(), nil
+}
+
+// SharedAccessSignature is a token granting access to the resource
+// and all resources under it until it expires.
+type SharedAccessSignature struct {
+	Resource  string // e.g. {hostname}/devices/{device id}
+	Signature string
+	Expiry    time.Time
+	KeyName   string // blank for device and module keys
+}
+
+// NewSharedAccessSignature signs a token for the resource with the base64
+// encoded key, keyName is the shared access policy name if the key belongs
+// to one. Expiry is absolute, so the current time can be controlled by the
+// caller, e.g. in tests. Expiry is truncated to seconds.
+func NewSharedAccessSignature(
+	resource, keyName, key string,
+	expiry time.Time,
+) (*SharedAccessSignature, error) {
+	if resource == "" {
+		return nil, errors.New("resource is blank")
+	}
+	if key == "" {
+		return nil, errors.New("key is blank")
+	}
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
 
 	// generate signature from uri and expiration time.
-	e := fmt.Sprintf("%s\n%d", sr, se)
+	e := fmt.Sprintf("%s\n%d", url.QueryEscape(resource), expiry.Unix())
 	h := hmac.New(sha256.New, b)
-	_, err = h.Write([]byte(e))
-	if err != nil {
-		return "", err
+	if _, err = h.Write([]byte(e)); err != nil {
+		return nil, err
 	}
+	return &SharedAccessSignature{
+		Resource:  resource,
+		Signature: base64.StdEncoding.EncodeToString(h.Sum(nil)),
+		Expiry:    time.Unix(expiry.Unix(), 0),
+		KeyName:   keyName,
+	}, nil
+}
 
+// String returns the token in the form sent in Authorization
+// headers and put to AMQP claims-based security nodes.
+func (s *SharedAccessSignature) String() string {
 	return "SharedAccessSignature " +
-		"sr=" + sr +
-		"&sig=" + url.QueryEscape(base64.StdEncoding.EncodeToString(h.Sum(nil))) +
-		"&se=" + url.QueryEscape(strconv.FormatInt(se, 10)) +
-		"&skn=" + url.QueryEscape(c.SharedAccessKeyName), nil
+		"sr=" + url.QueryEscape(s.Resource) +
+		"&sig=" + url.QueryEscape(s.Signature) +
+		"&se=" + url.QueryEscape(strconv.FormatInt(s.Expiry.Unix(), 10)) +
+		"&skn=" + url.QueryEscape(s.KeyName)
 }
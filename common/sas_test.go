@@ -21,6 +21,22 @@ func TestParseConnectionString(t *testing.T) {
 			SharedAccessKey:     "c2VjcmV0",
 			SharedAccessKeyName: "device",
 		},
+		"HostName=test.azure-devices.net;DeviceId=devnull;ModuleId=mod;SharedAccessKey=c2VjcmV0;GatewayHostName=edge": {
+			HostName:        "test.azure-devices.net",
+			DeviceID:        "devnull",
+			ModuleID:        "mod",
+			GatewayHostName: "edge",
+			SharedAccessKey: "c2VjcmV0",
+		},
+		"HostName=test.azure-devices.net;DeviceId=devnull;x509=true;Foo=bar": {
+			HostName: "test.azure-devices.net",
+			DeviceID: "devnull",
+		},
+		"HostName=test.azure-devices.net;DeviceId=devnull;SharedAccessKey=c2VjcmV0;": {
+			HostName:        "test.azure-devices.net",
+			DeviceID:        "devnull",
+			SharedAccessKey: "c2VjcmV0",
+		},
 	} {
 		g, err := ParseConnectionString(s)
 		if err != nil {
@@ -51,3 +67,27 @@ func TestCredentials_SAS(t *testing.T) {
 		t.Errorf("SAS(time.Hour) = %q, want %q", g, w)
 	}
 }
+
+func TestNewSharedAccessSignature(t *testing.T) {
+	t.Parallel()
+
+	exp := time.Date(2017, 1, 1, 2, 1, 1, 0, time.UTC)
+	sas, err := NewSharedAccessSignature("test.azure-devices.net/devices/test", "", "c2VjcmV0", exp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sas.Expiry.Equal(exp) {
+		t.Errorf("Expiry = %v, want %v", sas.Expiry, exp)
+	}
+
+	w := "SharedAccessSignature sr=test.azure-devices.net%2Fdevices%2Ftest&sig=IMr3Y5GKbdixQSt96QgIEymAURnu3qzLvEHhGHPLxrU%3D&se=1483236061&skn="
+	if g := sas.String(); g != w {
+		t.Errorf("String() = %q, want %q", g, w)
+	}
+
+	for _, args := range [][2]string{{"", "c2VjcmV0"}, {"test", ""}, {"test", "%%"}} {
+		if _, err := NewSharedAccessSignature(args[0], "", args[1], exp); err == nil {
+			t.Errorf("NewSharedAccessSignature(%q, %q) error = nil, want an error", args[0], args[1])
+		}
+	}
+}
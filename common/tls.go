@@ -1,6 +1,7 @@
 package common
 
 import (
+	"crypto/tls"
 	"crypto/x509"
 )
 
@@ -106,6 +107,26 @@ ee5Ehr7XHuQe+w==
 -----END CERTIFICATE-----
 `)
 
+// MergeTLSConfig returns a copy of custom with the server name, root CAs
+// and client certificates taken from base when custom doesn't set them.
+// It returns base when custom is nil.
+func MergeTLSConfig(custom, base *tls.Config) *tls.Config {
+	if custom == nil {
+		return base
+	}
+	c := custom.Clone()
+	if c.ServerName == "" {
+		c.ServerName = base.ServerName
+	}
+	if c.RootCAs == nil {
+		c.RootCAs = base.RootCAs
+	}
+	if len(c.Certificates) == 0 && c.GetClientCertificate == nil {
+		c.Certificates = base.Certificates
+	}
+	return c
+}
+
 // RootCAs root CA certificates pool for connecting to the cloud.
 func RootCAs() *x509.CertPool {
 	p := x509.NewCertPool()
@@ -23,3 +23,36 @@ func TestTLSConfig(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestMergeTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	base := &tls.Config{
+		ServerName:   "example.com",
+		RootCAs:      RootCAs(),
+		Certificates: []tls.Certificate{{}},
+	}
+	if c := MergeTLSConfig(nil, base); c != base {
+		t.Errorf("MergeTLSConfig(nil, base) = %p, want %p", c, base)
+	}
+
+	custom := &tls.Config{
+		MinVersion: tls.VersionTLS13,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return nil, nil
+		},
+	}
+	c := MergeTLSConfig(custom, base)
+	if c == custom {
+		t.Fatal("MergeTLSConfig(custom, base) didn't copy custom")
+	}
+	if c.ServerName != base.ServerName || c.RootCAs != base.RootCAs || c.MinVersion != tls.VersionTLS13 {
+		t.Errorf("MergeTLSConfig(custom, base) = %+v, want base server name and root CAs", c)
+	}
+	if len(c.Certificates) != 0 {
+		t.Errorf("Certificates = %v, want none when GetClientCertificate is set", c.Certificates)
+	}
+	if custom.ServerName != "" {
+		t.Error("MergeTLSConfig modified custom")
+	}
+}
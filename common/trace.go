@@ -0,0 +1,49 @@
+package common
+
+import (
+	"context"
+)
+
+// Tracer creates tracing spans, it's the integration
+// point for OpenTelemetry or any other tracing system:
+//
+//	type otelTracer struct{ t trace.Tracer }
+//
+//	func (t *otelTracer) Start(ctx context.Context, name string, attrs map[string]string) (context.Context, common.Span) {
+//		ctx, span := t.t.Start(ctx, name)
+//		for k, v := range attrs {
+//			span.SetAttributes(attribute.String(k, v))
+//		}
+//		return ctx, &otelSpan{ctx: ctx, span: span}
+//	}
+//
+// where otelSpan injects the context with the otel propagator into a propagation.MapCarrier.
+type Tracer interface {
+	// Start starts a span and returns ctx carrying it.
+	Start(ctx context.Context, name string, attrs map[string]string) (context.Context, Span)
+}
+
+// Span is a single traced operation.
+type Span interface {
+	// End finishes the span, err is the operation result.
+	End(err error)
+
+	// Inject writes the span context into message properties,
+	// e.g. W3C traceparent and tracestate, so the message
+	// can be correlated with the span end-to-end.
+	Inject(props map[string]string)
+}
+
+// StartSpan starts a span with t, that can be nil
+// in which case a no-op span is returned.
+func StartSpan(ctx context.Context, t Tracer, name string, attrs map[string]string) (context.Context, Span) {
+	if t == nil {
+		return ctx, noopSpan{}
+	}
+	return t.Start(ctx, name, attrs)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) End(error)                {}
+func (noopSpan) Inject(map[string]string) {}
@@ -6,18 +6,24 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
-	"log"
+	"net"
+	"net/url"
 	"sync"
 	"time"
 
+	"github.com/goautomotive/iothub/common"
 	"pack.ag/amqp"
 )
 
 // Dial connects to the named amqp broker and returns an eventhub client.
 func Dial(addr string, tlsConfig *tls.Config) (*Client, error) {
-	conn, err := amqp.Dial(addr,
-		amqp.ConnTLSConfig(tlsConfig),
-	)
+	return DialContext(context.Background(), addr, tlsConfig, nil)
+}
+
+// DialContext is same as Dial, but the connection is established
+// with dial when it's not nil.
+func DialContext(ctx context.Context, addr string, tlsConfig *tls.Config, dial common.Dialer) (*Client, error) {
+	conn, err := DialAMQP(ctx, addr, tlsConfig, dial)
 	if err != nil {
 		return nil, err
 	}
@@ -33,12 +39,51 @@ func Dial(addr string, tlsConfig *tls.Config) (*Client, error) {
 	}, nil
 }
 
+// DialAMQP connects to the amqps broker at addr establishing the
+// connection with dial, it's amqp.Dial when dial is nil.
+func DialAMQP(
+	ctx context.Context, addr string, tlsConfig *tls.Config, dial common.Dialer, opts ...amqp.ConnOption,
+) (*amqp.Client, error) {
+	if dial == nil {
+		return amqp.Dial(addr, append([]amqp.ConnOption{amqp.ConnTLSConfig(tlsConfig)}, opts...)...)
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "amqps" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		port = "5671"
+	}
+	conn, err := common.DialTLS(ctx, dial, net.JoinHostPort(host, port), tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	c, err := amqp.New(conn, append([]amqp.ConnOption{amqp.ConnServerHostname(host)}, opts...)...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
 // Client is eventhub client.
 type Client struct {
-	mu   sync.Mutex
-	conn *amqp.Client
-	sess *amqp.Session
-	done chan struct{}
+	mu     sync.Mutex
+	conn   *amqp.Client
+	sess   *amqp.Session
+	done   chan struct{}
+	logger common.Logger
+}
+
+// SetLogger sets logger for background errors, nil disables logging.
+func (c *Client) SetLogger(l common.Logger) {
+	c.mu.Lock()
+	c.logger = l
+	c.mu.Unlock()
 }
 
 func (c *Client) Sess() *amqp.Session {
@@ -68,9 +113,7 @@ func SubscribePartitions(ctx context.Context, sess *amqp.Session, name, group st
 			amqp.LinkSourceAddress(fmt.Sprintf("/%s/ConsumerGroups/%s/Partitions/%s", name, group, id)),
 
 			// TODO: make it configurable
-			amqp.LinkSelectorFilter(fmt.Sprintf("amqp.annotation.x-opt-enqueuedtimeutc > '%d'",
-				time.Now().UnixNano()/int64(time.Millisecond)),
-			),
+			amqp.LinkSelectorFilter(EnqueuedTimeSelector(time.Now())),
 		)
 		if err != nil {
 			return err
@@ -116,7 +159,12 @@ func (c *Client) PutTokenContinuously(
 			select {
 			case <-time.After(time.Hour): // TODO: bigger update interval
 				if err := c.PutToken(ctx, audience, token); err != nil {
-					log.Printf("put token error: %s", err)
+					c.mu.Lock()
+					l := c.logger
+					c.mu.Unlock()
+					if l != nil {
+						l.Logf(common.LevelError, common.ComponentAuth, "put token error: %s", err)
+					}
 					return
 				}
 			case <-stopCh:
@@ -130,8 +178,34 @@ func (c *Client) PutTokenContinuously(
 func (c *Client) PutToken(ctx context.Context, audience, token string) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	return PutToken(ctx, c.sess, audience, token)
+}
+
+// PutJWT is same as PutToken but puts an Azure AD access token.
+func (c *Client) PutJWT(ctx context.Context, audience, token string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return PutJWT(ctx, c.sess, audience, token)
+}
+
+const (
+	tokenTypeSAS = "servicebus.windows.net:sastoken"
+	tokenTypeJWT = "jwt"
+)
 
-	send, err := c.sess.NewSender(
+// PutToken authorizes access to the audience with the SAS token
+// using the claims-based security node of the session's connection.
+func PutToken(ctx context.Context, sess *amqp.Session, audience, token string) error {
+	return putToken(ctx, sess, tokenTypeSAS, audience, token)
+}
+
+// PutJWT is same as PutToken but puts an Azure AD access token.
+func PutJWT(ctx context.Context, sess *amqp.Session, audience, token string) error {
+	return putToken(ctx, sess, tokenTypeJWT, audience, token)
+}
+
+func putToken(ctx context.Context, sess *amqp.Session, typ, audience, token string) error {
+	send, err := sess.NewSender(
 		amqp.LinkTargetAddress("$cbs"),
 	)
 	if err != nil {
@@ -139,7 +213,7 @@ func (c *Client) PutToken(ctx context.Context, audience, token string) error {
 	}
 	defer send.Close(context.Background())
 
-	recv, err := c.sess.NewReceiver(amqp.LinkSourceAddress("$cbs"))
+	recv, err := sess.NewReceiver(amqp.LinkSourceAddress("$cbs"))
 	if err != nil {
 		return err
 	}
@@ -153,7 +227,7 @@ func (c *Client) PutToken(ctx context.Context, audience, token string) error {
 		},
 		ApplicationProperties: map[string]interface{}{
 			"operation": "put-token",
-			"type":      "servicebus.windows.net:sastoken",
+			"type":      typ,
 			"name":      audience,
 		},
 	}); err != nil {
@@ -181,10 +255,12 @@ func (c *Client) Close() error {
 	default:
 		close(c.done)
 	}
-	if err := c.sess.Close(context.Background()); err != nil {
-		return err
+	// close the connection even when the session's already ended by the peer
+	err := c.sess.Close(context.Background())
+	if cerr := c.conn.Close(); err == nil {
+		err = cerr
 	}
-	return c.conn.Close()
+	return err
 }
 
 // RandString generates a random 32 bytes long string.
@@ -196,6 +272,35 @@ func RandString() (string, error) {
 	return fmt.Sprintf("%x", b), nil
 }
 
+// Special offsets of a partition.
+const (
+	StartOfStream = "-1"
+	EndOfStream   = "@latest"
+)
+
+// OffsetSelector returns the receiver filter expression that skips
+// events up to the given offset, inclusive makes it include the offset.
+func OffsetSelector(offset string, inclusive bool) string {
+	op := ">"
+	if inclusive {
+		op = ">="
+	}
+	return fmt.Sprintf("amqp.annotation.x-opt-offset %s '%s'", op, offset)
+}
+
+// EnqueuedTimeSelector returns the receiver filter expression
+// that skips events enqueued before t.
+func EnqueuedTimeSelector(t time.Time) string {
+	return fmt.Sprintf("amqp.annotation.x-opt-enqueuedtimeutc > '%d'",
+		t.UnixNano()/int64(time.Millisecond),
+	)
+}
+
+// PartitionIDs returns partition ids for the named eventhub.
+func PartitionIDs(ctx context.Context, sess *amqp.Session, name string) ([]string, error) {
+	return getPartitionIDs(ctx, sess, name)
+}
+
 // getPartitionIDs returns partition ids for the named eventhub.
 func getPartitionIDs(ctx context.Context, sess *amqp.Session, name string) ([]string, error) {
 	replyTo, err := RandString()
@@ -7,3 +7,5 @@ require (
 	golang.org/x/net v0.0.0-20180218175443-cbe0f9307d01
 	pack.ag/amqp v0.5.0
 )
+
+go 1.18
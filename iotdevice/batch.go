@@ -0,0 +1,112 @@
+package iotdevice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/iotdevice/transport"
+)
+
+// SendEventBatch sends the given device-to-cloud messages in batches
+// splitting them when the total size exceeds the hub limit, messages
+// that don't fit into the limit on their own fail with ErrMessageTooLarge.
+//
+// Batches are sized the way the transport encodes them, see
+// transport.BatchSizer. Transports that don't support batching,
+// like MQTT, send messages one by one in the given order.
+func (c *Client) SendEventBatch(ctx context.Context, msgs []*common.Message) error {
+	if err := c.checkConnection(ctx); err != nil {
+		return err
+	}
+	if !c.work.add() {
+		return ErrClosed
+	}
+	defer c.work.done()
+	var copied bool
+	for i, msg := range msgs {
+		if msg == nil {
+			panic("msg is nil")
+		}
+		if msg.Payload == nil {
+			return errors.New("payload is nil")
+		}
+		if err := c.validate(msg); err != nil {
+			return err
+		}
+		if c.compress != "" && msg.ContentEncoding == "" {
+			if !copied {
+				// don't modify the caller's messages
+				msgs = append([]*common.Message(nil), msgs...)
+				copied = true
+			}
+			m := *msg
+			if err := compress(&m, c.compress); err != nil {
+				return err
+			}
+			msgs[i] = &m
+		}
+	}
+	bs, ok := c.tr.(transport.BatchSender)
+	size := (*common.Message).Size
+	if bz, ok := c.tr.(transport.BatchSizer); ok {
+		size = bz.BatchSize
+	}
+	batches, err := splitBatch(msgs, common.MaxDeviceToCloudSize, size)
+	if err != nil {
+		return err
+	}
+
+	for _, batch := range batches {
+		if err := common.Retry(ctx, c.retry, func() error {
+			if ok {
+				if err := c.throttle(ctx); err != nil {
+					return err
+				}
+				return bs.SendBatch(ctx, batch)
+			}
+			for i, msg := range batch {
+				if err := c.throttle(ctx); err != nil {
+					batch = batch[i:]
+					return err
+				}
+				if err := c.tr.Send(ctx, msg); err != nil {
+					// don't resend already delivered messages when retrying
+					batch = batch[i:]
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if c.metrics != nil {
+			c.metrics.Add(common.MetricMessagesSent, float64(len(batch)), deviceLabels)
+		}
+		c.debugf(common.ComponentClient, "device-to-cloud batch: %d messages", len(batch))
+	}
+	return nil
+}
+
+// splitBatch splits msgs into consecutive batches that don't exceed
+// limit, size returns the number of bytes a message takes in a batch.
+func splitBatch(msgs []*common.Message, limit int, size func(*common.Message) int) ([][]*common.Message, error) {
+	var batches [][]*common.Message
+	var total, start int
+	for i, msg := range msgs {
+		n := size(msg)
+		if n > limit {
+			return nil, fmt.Errorf("message %d: %w", i, &common.MessageSizeError{Size: n, Limit: limit})
+		}
+		if total+n > limit {
+			batches = append(batches, msgs[start:i])
+			start, total = i, 0
+		}
+		total += n
+	}
+	if start < len(msgs) {
+		batches = append(batches, msgs[start:])
+	}
+	return batches, nil
+}
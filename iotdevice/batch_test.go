@@ -0,0 +1,66 @@
+package iotdevice
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/goautomotive/iothub/common"
+)
+
+func TestSplitBatch(t *testing.T) {
+	t.Parallel()
+
+	msgs := make([]*common.Message, 5)
+	for i := range msgs {
+		msgs[i] = &common.Message{Payload: make([]byte, 4)}
+	}
+
+	b, err := splitBatch(msgs, 10, (*common.Message).Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 3 || len(b[0]) != 2 || len(b[1]) != 2 || len(b[2]) != 1 {
+		t.Errorf("splitBatch(5 x 4b, 10) = %v, want 2-2-1 batches", b)
+	}
+
+	if _, err = splitBatch(msgs, 3, (*common.Message).Size); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("splitBatch() with an oversized message error = %v, want ErrMessageTooLarge", err)
+	}
+}
+
+// batchTransport sends batches with base64 encoded payloads.
+type batchTransport struct {
+	testTransport
+	batches [][]*common.Message
+}
+
+func (tr *batchTransport) SendBatch(_ context.Context, msgs []*common.Message) error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.batches = append(tr.batches, msgs)
+	return nil
+}
+
+func (tr *batchTransport) BatchSize(msg *common.Message) int {
+	return base64.StdEncoding.EncodedLen(len(msg.Payload))
+}
+
+func TestSendEventBatchSize(t *testing.T) {
+	t.Parallel()
+
+	// the messages fit the limit together but their encoding doesn't
+	tr := &batchTransport{}
+	c := newTestClient(t, tr)
+	msgs := []*common.Message{
+		{Payload: make([]byte, common.MaxDeviceToCloudSize/2-1)},
+		{Payload: make([]byte, common.MaxDeviceToCloudSize/2-1)},
+	}
+	if err := c.SendEventBatch(context.Background(), msgs); err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.batches) != 2 {
+		t.Errorf("sent %d batches, want 2", len(tr.batches))
+	}
+}
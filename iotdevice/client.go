@@ -3,14 +3,20 @@ package iotdevice
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/goautomotive/iothub/common"
 	"github.com/goautomotive/iothub/iotdevice/transport"
+	"github.com/goautomotive/iothub/iotdevice/twin"
 )
 
 // ClientOption is a client configuration option.
@@ -27,12 +33,136 @@ func WithDebug(t bool) ClientOption {
 
 // WithLogger changes default logger, default it an stdout logger.
 func WithLogger(l *log.Logger) ClientOption {
+	return WithStructuredLogger(common.NewStdLogger(l))
+}
+
+// WithStructuredLogger sets a leveled logger, it receives
+// debug messages only when debug mode is enabled.
+func WithStructuredLogger(l common.Logger) ClientOption {
 	return func(c *Client) error {
 		c.logger = l
 		return nil
 	}
 }
 
+// WithRetryPolicy sets the policy for retrying transient failures
+// of sending events and twin operations, by default nothing is retried.
+func WithRetryPolicy(p common.RetryPolicy) ClientOption {
+	return func(c *Client) error {
+		c.retry = p
+		return nil
+	}
+}
+
+// WithTracer enables tracing of sending events, twin operations and
+// direct methods dispatching, trace context of sent events is propagated
+// in their application properties.
+func WithTracer(t common.Tracer) ClientOption {
+	return func(c *Client) error {
+		c.tracer = t
+		c.dmMux.tracer = t
+		return nil
+	}
+}
+
+// WithMetrics enables collecting sent and received messages, methods
+// dispatching latency, reconnects, token renewals and subscribers lag metrics.
+func WithMetrics(m common.Metrics) ClientOption {
+	return func(c *Client) error {
+		c.metrics = m
+		c.evMux.metrics = m
+		c.dmMux.metrics = m
+		return nil
+	}
+}
+
+// WithManualSettlement disables automatic completion of cloud-to-device
+// messages, so they have to be settled with EventSub's methods.
+// Only transports implementing `transport.Settler` support it.
+func WithManualSettlement(enable bool) ClientOption {
+	return func(c *Client) error {
+		c.manual = enable
+		return nil
+	}
+}
+
+// DefaultMethodTimeout is the default direct method response timeout on the hub side.
+const DefaultMethodTimeout = 30 * time.Second
+
+// WithMethodTimeout sets the deadline of contexts passed to direct method
+// handlers, zero disables it. Transports don't tell the responseTimeout
+// the method is invoked with, so it should match the timeout used by
+// the invoking side, defaults to DefaultMethodTimeout.
+func WithMethodTimeout(d time.Duration) ClientOption {
+	return func(c *Client) error {
+		c.dmMux.timeout = d
+		return nil
+	}
+}
+
+// WithMethodConcurrency lets up to n direct methods run at the same time,
+// so a slow handler doesn't block other invocations, 1 forces serial
+// execution for handlers sharing state. Without the option MQTT dispatches
+// methods serially and AMQP doesn't limit them.
+//
+// Only transports implementing `transport.MethodConcurrencyLimiter` support it.
+func WithMethodConcurrency(n int) ClientOption {
+	if n < 1 {
+		panic("concurrency must be positive")
+	}
+	return func(c *Client) error {
+		c.mconc = n
+		return nil
+	}
+}
+
+// WithDialer sets the function for establishing network connections,
+// e.g. through SOCKS5 proxies, VPN tunnels or specific interfaces, it's
+// used by the transport and for uploading files unless WithHTTPClient is set.
+//
+// Only transports implementing `transport.CustomDialer` support it.
+func WithDialer(fn common.Dialer) ClientOption {
+	if fn == nil {
+		panic("fn is nil")
+	}
+	return func(c *Client) error {
+		c.dial = fn
+		return nil
+	}
+}
+
+// WithEndpoint makes the client connect to addr, a host name or an IP
+// address, instead of the hub's hostname, e.g. to reach a private endpoint
+// when the hostname doesn't resolve to it. TLS server names and tokens are
+// issued for the hub's hostname still. It's based on WithDialer.
+func WithEndpoint(addr string) ClientOption {
+	return func(c *Client) error {
+		if addr == "" {
+			return errors.New("endpoint is blank")
+		}
+		c.addr = addr
+		return nil
+	}
+}
+
+// WithFrameTrace makes the transport report protocol frames it sends and
+// receives to fn with payloads truncated to limit bytes, e.g. to debug
+// topics encoding and properties mapping without capturing the traffic.
+//
+// Only transports implementing `transport.FrameTracer` support it.
+func WithFrameTrace(fn transport.FrameHandler, limit int) ClientOption {
+	if fn == nil {
+		panic("fn is nil")
+	}
+	if limit < 0 {
+		panic("limit is negative")
+	}
+	return func(c *Client) error {
+		c.frames, c.flimit = fn, limit
+		return nil
+	}
+}
+
 // WithTransport changes default transport.
 func WithTransport(tr transport.Transport) ClientOption {
 	return func(c *Client) error {
@@ -54,6 +184,10 @@ func WithCredentials(creds transport.Credentials) ClientOption {
 
 // WithConnectionString same as WithCredentials,
 // but it parses the given connection string first.
+//
+// Leaf devices connect through an IoT Edge transparent gateway
+// when the connection string has the GatewayHostName attribute,
+// see WithGatewayHostName.
 func WithConnectionString(cs string) ClientOption {
 	return func(c *Client) error {
 		var err error
@@ -88,7 +222,75 @@ func WithX509FromFile(deviceID, hostname, certFile, keyFile string) ClientOption
 	}
 }
 
+// WithGatewayHostName makes the client connect through an IoT Edge
+// transparent gateway, it overrides GatewayHostName of the credentials.
+//
+// Only the network connection goes to the gateway, its hostname is used
+// for the TLS server name verification, but SAS tokens are still issued
+// for the hub's hostname, since the gateway passes them to the hub,
+// so it's not the gateway that has to be in the token's audience.
+// The gateway's certificate is usually issued by a private CA,
+// see WithTrustBundle.
+func WithGatewayHostName(hostname string) ClientOption {
+	return func(c *Client) error {
+		if hostname == "" {
+			return errors.New("gateway hostname is empty")
+		}
+		c.gateway = hostname
+		return nil
+	}
+}
+
+// WithTrustBundle adds the PEM encoded CA certificates to the trusted
+// roots along with the bundled cloud ones, e.g. the CA that issued
+// an IoT Edge gateway's server certificate.
+//
+// Root CAs set with WithTLSConfig take precedence over the bundle.
+func WithTrustBundle(pem []byte) ClientOption {
+	return func(c *Client) error {
+		if c.trust == nil {
+			c.trust = common.RootCAs()
+		}
+		if !c.trust.AppendCertsFromPEM(pem) {
+			return errors.New("trust bundle has no certificates")
+		}
+		return nil
+	}
+}
+
+// WithTrustBundleFromFile is same as WithTrustBundle
+// but reads the bundle from the named file.
+func WithTrustBundleFromFile(path string) ClientOption {
+	return func(c *Client) error {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return WithTrustBundle(b)(c)
+	}
+}
+
+// WithTLSConfig sets custom TLS configuration for connecting to the hub
+// and uploading files, e.g. to pin a gateway's CA, enforce a minimal TLS
+// version or provide client certificates with GetClientCertificate.
+//
+// The server name, root CAs and client certificates
+// are taken from the credentials when they're not set.
+func WithTLSConfig(config *tls.Config) ClientOption {
+	if config == nil {
+		panic("config is nil")
+	}
+	return func(c *Client) error {
+		c.tls = config
+		return nil
+	}
+}
+
 // NewClient returns new iothub client.
+//
+// When credentials contain a module id, e.g. the connection string
+// has the ModuleId attribute, the client acts as an IoT Edge module
+// and events subscriptions receive messages routed to module inputs.
 func NewClient(opts ...ClientOption) (*Client, error) {
 	c := &Client{
 		ready: make(chan struct{}),
@@ -98,7 +300,16 @@ func NewClient(opts ...ClientOption) (*Client, error) {
 
 	// need to pass done channel to muxes
 	c.evMux.done = c.done
-	c.tsMux.done = c.done
+	c.csMux.hook = c.onConnectionState
+	c.evMux.onErr = func(err error) {
+		c.logf(common.LevelError, common.ComponentMux, "message decompression error: %s", err)
+	}
+	c.tsMux.onErr = func(err error, b []byte) {
+		c.logf(common.LevelError, common.ComponentMux, "twin update dispatch error: %s", err)
+	}
+	c.dmMux.ctx, c.cancel = context.WithCancel(context.Background())
+	c.dmMux.timeout = DefaultMethodTimeout
+	c.dmMux.work = &c.work
 
 	for _, opt := range opts {
 		if err := opt(c); err != nil {
@@ -111,34 +322,190 @@ func NewClient(opts ...ClientOption) (*Client, error) {
 	if c.tr == nil {
 		return nil, errors.New("transport required")
 	}
+	// wrappers hide the rotation method
+	c.keys, _ = c.creds.(keyRotator)
+	if c.provision != nil {
+		if _, ok := c.tr.(transport.Redirector); !ok {
+			return nil, errors.New("transport doesn't support hub failover")
+		}
+		c.host = &hostCreds{Credentials: c.creds}
+		c.creds = c.host
+	}
+	if c.gateway != "" {
+		c.creds = &gatewayCreds{Credentials: c.creds, hostname: c.gateway}
+	}
+	if c.trust != nil {
+		tc := &tls.Config{}
+		if c.tls != nil {
+			tc = c.tls.Clone()
+		}
+		if tc.RootCAs == nil {
+			tc.RootCAs = c.trust
+		}
+		c.tls = tc
+	}
+	if c.tls != nil {
+		c.creds = &tlsCreds{Credentials: c.creds, config: c.tls}
+	}
+	if c.metrics != nil {
+		c.creds = &meteredCreds{Credentials: c.creds, metrics: c.metrics}
+	}
+	if c.limit != nil && c.limit.rate == 0 {
+		return nil, errors.New("send rate limit is not set")
+	}
+	if c.queue != nil {
+		if c.queue.cap == 0 {
+			return nil, errors.New("offline queue capacity is not set")
+		}
+		if c.queue.store == nil {
+			c.queue.store = NewMemoryStore(c.queue.cap)
+		}
+		if c.queue.rcmax == 0 {
+			c.queue.rcmin, c.queue.rcmax = time.Second, time.Minute
+		}
+	}
+	if c.coal != nil && c.coal.interval == 0 {
+		return nil, errors.New("twin coalescing interval is not set")
+	}
+	if c.model != "" {
+		a, ok := c.tr.(transport.ModelAnnouncer)
+		if !ok {
+			return nil, errors.New("transport doesn't support plug and play")
+		}
+		a.SetModelID(c.model)
+	}
+	if c.mconc != 0 {
+		l, ok := c.tr.(transport.MethodConcurrencyLimiter)
+		if !ok {
+			return nil, errors.New("transport doesn't support concurrent direct methods")
+		}
+		l.SetMethodConcurrency(c.mconc)
+	}
+	if c.addr != "" {
+		host := c.creds.Hostname()
+		if c.creds.GatewayHostName() != "" {
+			host = c.creds.GatewayHostName()
+		}
+		c.dial = common.EndpointDialer(c.dial, host, c.addr)
+	}
+	if c.dial != nil {
+		d, ok := c.tr.(transport.CustomDialer)
+		if !ok {
+			return nil, errors.New("transport doesn't support custom dialers")
+		}
+		d.SetDialer(c.dial)
+	}
+	if c.frames != nil {
+		t, ok := c.tr.(transport.FrameTracer)
+		if !ok {
+			return nil, errors.New("transport doesn't support frame tracing")
+		}
+		t.SetFrameHandler(c.frames, c.flimit)
+	}
+	if c.manual {
+		s, ok := c.tr.(transport.Settler)
+		if !ok {
+			return nil, ErrSettlementNotSupported
+		}
+		s.SetManualSettlement(true)
+	}
+	c.evMux.onInvalid = c.onInvalidMessage
+
+	// used only for files uploading, relies on bundled ca-certificates
+	if c.http == nil {
+		tc := c.creds.TLSConfig().Clone()
+		tc.ServerName = ""
+		c.http = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: tc,
+				DialContext:     c.dial,
+			},
+		}
+	}
+	// blobs are stored on storage accounts that aren't
+	// signed by the hub's CAs, so system roots are used
+	if c.blob == nil {
+		c.blob = &http.Client{
+			Transport: &http.Transport{
+				DialContext: c.dial,
+			},
+		}
+	}
 	return c, nil
 }
 
 // Client is iothub device client.
 type Client struct {
-	creds transport.Credentials
-	tr    transport.Transport
+	rver int64 // last known reported state version, first for 64-bit alignment
+
+	creds   transport.Credentials
+	keys    keyRotator     // nil when credentials don't support key rotation
+	tls     *tls.Config    // custom tls configuration
+	trust   *x509.CertPool // custom root CAs, nil when not set
+	gateway string         // overrides the credentials gateway when set
+	tr      transport.Transport
 
-	logger *log.Logger
-	debug  bool
+	provision Provisioner           // nil when failover is disabled
+	onHost    func(old, new string) // hostname change handler
+	host      *hostCreds            // switches the hub on failover
+	moving    uint32                // 1 when failover is in progress
 
-	mu    sync.RWMutex
-	ready chan struct{}
-	done  chan struct{}
+	compress Compression  // device-to-cloud payloads compression, none when blank
+	outbound Validator    // device-to-cloud messages validator, nil when not set
+	limit    *rateLimiter // nil when sending is not rate limited
+
+	logger  common.Logger
+	debug   bool
+	retry   common.RetryPolicy
+	tracer  common.Tracer
+	metrics common.Metrics
+	http    *http.Client
+	blob    *http.Client
+	manual  bool          // manual c2d messages settlement
+	mconc   int           // direct methods concurrency, transport default when zero
+	dial    common.Dialer // custom dialer, nil when not set
+	addr    string        // address connections are made to instead of the hub
+	frames  transport.FrameHandler
+	flimit  int // frame payloads limit
+	queue   *offlineQueue
+	coal    *coalescer
+	model   string  // pnp model id
+	online  uint32  // 1 when the transport is connected
+	work    tracker // in-flight operations, drained by Shutdown
+
+	mu     sync.RWMutex
+	ready  chan struct{}
+	done   chan struct{}
+	cancel context.CancelFunc // cancels running method handlers
 
 	evMux eventsMux
 	tsMux twinStateMux
 	dmMux methodMux
+	csMux connStateMux
 }
 
 // DirectMethodHandler handles direct method invocations.
 type DirectMethodHandler func(p map[string]interface{}) (map[string]interface{}, error)
 
+// ContextMethodHandler is same as DirectMethodHandler but ctx is canceled
+// when the method times out or the client is closed, see WithMethodTimeout.
+type ContextMethodHandler func(ctx context.Context, p map[string]interface{}) (map[string]interface{}, error)
+
+// RawMethodHandler handles direct method invocations with raw payloads,
+// it returns the response status code and body that has to be valid json.
+// A non-nil error produces a status 500 response with the error attribute.
+type RawMethodHandler func(ctx context.Context, b []byte) (rc int, data []byte, err error)
+
 // DeviceID returns iothub device id.
 func (c *Client) DeviceID() string {
 	return c.creds.DeviceID()
 }
 
+// ModuleID returns iothub module id, it's blank for regular devices.
+func (c *Client) ModuleID() string {
+	return c.creds.ModuleID()
+}
+
 // Connect connects to the iothub all subsequent calls
 // will block until this function finishes with no error so it's clien's
 // responsibility to connect in the background by running it in a goroutine
@@ -151,14 +518,80 @@ func (c *Client) Connect(ctx context.Context) error {
 		return errors.New("already connected")
 	default:
 	}
+	if err := c.tr.SubscribeConnectionState(ctx, &c.csMux); err != nil {
+		c.mu.Unlock()
+		return err
+	}
 	err := c.tr.Connect(ctx, c.creds)
+	if errors.Is(err, common.ErrUnauthorized) && c.provision != nil {
+		// the device might have been reassigned while it was offline
+		if moved, perr := c.reprovision(ctx); perr != nil {
+			c.logf(common.LevelError, common.ComponentTransport, "provisioning error: %s", perr)
+		} else if moved {
+			err = c.tr.Connect(ctx, c.creds)
+		}
+	}
 	if err == nil {
+		atomic.StoreUint32(&c.online, 1)
+		if c.queue != nil {
+			c.queue.setOnline(true)
+			go c.flushQueue()
+		}
 		close(c.ready)
 	}
 	c.mu.Unlock()
 	return err
 }
 
+// RotateKey replaces the shared access key used for signing SAS tokens
+// without recreating the client, the live connection is re-authenticated
+// with the new key when the transport implements `transport.Reauthenticator`,
+// others pick it up with the next request or reconnect.
+func (c *Client) RotateKey(newKey string) error {
+	if c.keys == nil {
+		return errors.New("credentials don't support key rotation")
+	}
+	if err := c.keys.RotateKey(newKey); err != nil {
+		return err
+	}
+	c.logf(common.LevelInfo, common.ComponentAuth, "shared access key rotated")
+
+	r, ok := c.tr.(transport.Reauthenticator)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return r.Reauthenticate(ctx)
+}
+
+// onConnectionState tracks whether the transport is connected
+// and sends queued messages when the connection is re-established.
+func (c *Client) onConnectionState(state transport.ConnectionState, err error) {
+	if state == transport.ConnectionReconnecting {
+		c.add(common.MetricReconnects)
+	}
+	if state == transport.ConnectionDisconnected && c.provision != nil &&
+		errors.Is(err, common.ErrUnauthorized) {
+		go c.failover()
+	}
+	if state != transport.ConnectionConnected {
+		atomic.StoreUint32(&c.online, 0)
+		if c.queue != nil {
+			c.queue.setOnline(false)
+		}
+		return
+	}
+	atomic.StoreUint32(&c.online, 1)
+	if c.queue != nil {
+		c.queue.setOnline(true)
+		go c.flushQueue()
+	}
+}
+
+// ErrMessageTooLarge is returned by messages exceeding the hub's size limit.
+var ErrMessageTooLarge = common.ErrMessageTooLarge
+
 // ErrClosed the client is already closed.
 var ErrClosed = errors.New("closed")
 
@@ -173,8 +606,28 @@ func (c *Client) checkConnection(ctx context.Context) error {
 	}
 }
 
+// Ping checks that the connection to the hub is alive with a
+// protocol-level round trip that isn't billed as a message and returns
+// its latency, e.g. for supervisors health-checking devices.
+//
+// It fails when the transport doesn't implement `transport.Pinger`.
+func (c *Client) Ping(ctx context.Context) (time.Duration, error) {
+	p, ok := c.tr.(transport.Pinger)
+	if !ok {
+		return 0, errors.New("transport doesn't support pinging")
+	}
+	if err := c.checkConnection(ctx); err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	if err := p.Ping(ctx); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
 // SubscribeEvents subscribes to cloud-to-device events and returns a subscription struct.
-func (c *Client) SubscribeEvents(ctx context.Context) (*EventSub, error) {
+func (c *Client) SubscribeEvents(ctx context.Context, opts ...SubscribeOption) (*EventSub, error) {
 	if err := c.checkConnection(ctx); err != nil {
 		return nil, err
 	}
@@ -183,19 +636,64 @@ func (c *Client) SubscribeEvents(ctx context.Context) (*EventSub, error) {
 	}); err != nil {
 		return nil, err
 	}
-	return c.evMux.sub(), nil
+	sub, err := c.evMux.sub(opts...)
+	if err != nil {
+		return nil, err
+	}
+	sub.settler, _ = c.tr.(transport.Settler)
+	return sub, nil
 }
 
-// UnsubscribeEvents makes the given subscription to stop receiving messages.
+// UnsubscribeEvents makes the given subscription to stop receiving messages,
+// its channel is closed.
 func (c *Client) UnsubscribeEvents(sub *EventSub) {
 	c.evMux.unsub(sub)
 }
 
+// SubscribeConnectionState subscribes to transport connection state changes,
+// it can be called before connecting to catch the initial connection.
+func (c *Client) SubscribeConnectionState(ctx context.Context) (*ConnectionStateSub, error) {
+	select {
+	case <-c.done:
+		return nil, ErrClosed
+	default:
+	}
+	return c.csMux.sub(), nil
+}
+
+// UnsubscribeConnectionState makes the given subscription to stop receiving
+// state changes, its channel is closed.
+func (c *Client) UnsubscribeConnectionState(sub *ConnectionStateSub) {
+	c.csMux.unsub(sub)
+}
+
 // RegisterMethod registers the given direct method handler,
 // returns an error when method is already registered.
 // If f returns an error and empty body its error string
 // used as value of the error attribute in the result json.
 func (c *Client) RegisterMethod(ctx context.Context, name string, fn DirectMethodHandler) error {
+	if fn == nil {
+		panic("fn is nil")
+	}
+	return c.RegisterMethodContext(ctx, name, func(
+		_ context.Context, p map[string]interface{},
+	) (map[string]interface{}, error) {
+		return fn(p)
+	})
+}
+
+// RegisterMethodContext is same as RegisterMethod but the handler
+// receives a context, so long-running handlers can abort on time.
+func (c *Client) RegisterMethodContext(ctx context.Context, name string, fn ContextMethodHandler) error {
+	return c.RegisterRawMethod(ctx, name, jsonHandler(fn))
+}
+
+// RegisterRawMethod is same as RegisterMethod but the handler
+// deals with raw payloads, e.g. json arrays or scalars.
+func (c *Client) RegisterRawMethod(ctx context.Context, name string, fn RawMethodHandler) error {
+	if fn == nil {
+		panic("fn is nil")
+	}
 	if err := c.checkConnection(ctx); err != nil {
 		return err
 	}
@@ -210,6 +708,43 @@ func (c *Client) RegisterMethod(ctx context.Context, name string, fn DirectMetho
 	return c.dmMux.handle(name, fn)
 }
 
+// HandleDefault registers the handler of all methods that have no
+// handler registered, e.g. for gateways forwarding methods downstream,
+// the method name is obtained with MethodName(ctx).
+//
+// Without it unregistered methods are responded with status 404.
+func (c *Client) HandleDefault(ctx context.Context, fn RawMethodHandler) error {
+	if fn == nil {
+		panic("fn is nil")
+	}
+	if err := c.checkConnection(ctx); err != nil {
+		return err
+	}
+	if err := c.dmMux.once(func() error {
+		return c.tr.RegisterDirectMethods(ctx, &c.dmMux)
+	}); err != nil {
+		return err
+	}
+	c.dmMux.handleDefault(fn)
+	return nil
+}
+
+// UseMethodMiddleware appends middleware to the chain every direct method
+// invocation runs through, the first one added is called first.
+func (c *Client) UseMethodMiddleware(mw ...MethodMiddleware) {
+	for _, fn := range mw {
+		if fn == nil {
+			panic("middleware is nil")
+		}
+	}
+	c.dmMux.use(mw...)
+}
+
+// UnregisterDefault removes the default method handler.
+func (c *Client) UnregisterDefault() {
+	c.dmMux.handleDefault(nil)
+}
+
 // UnregisterMethod unregisters the named method.
 func (c *Client) UnregisterMethod(name string) {
 	c.dmMux.remove(name)
@@ -226,38 +761,144 @@ func (s TwinState) Version() int {
 
 // RetrieveTwinState returns desired and reported twin device states.
 func (c *Client) RetrieveTwinState(ctx context.Context) (desired TwinState, reported TwinState, err error) {
-	if err := c.checkConnection(ctx); err != nil {
+	if err := c.GetTwinInto(ctx, &desired, &reported); err != nil {
 		return nil, nil, err
 	}
-	b, err := c.tr.RetrieveTwinProperties(ctx)
-	if err != nil {
-		return nil, nil, err
+	return desired, reported, nil
+}
+
+// GetTwinInto retrieves twin device states and unmarshals desired and
+// reported sections into the given values honoring their json tags,
+// any of them can be nil to skip the corresponding section.
+func (c *Client) GetTwinInto(ctx context.Context, desired, reported interface{}) (err error) {
+	ctx, span := common.StartSpan(ctx, c.tracer, "iothub.RetrieveTwinState", c.spanAttrs())
+	defer func() {
+		span.End(err)
+	}()
+	if err := c.checkConnection(ctx); err != nil {
+		return err
+	}
+	var b []byte
+	if err := common.Retry(ctx, c.retry, func() error {
+		var err error
+		b, err = c.tr.RetrieveTwinProperties(ctx)
+		return err
+	}); err != nil {
+		return err
 	}
 	var v struct {
-		Desired  TwinState `json:"desired"`
-		Reported TwinState `json:"reported"`
+		Desired  json.RawMessage `json:"desired"`
+		Reported json.RawMessage `json:"reported"`
 	}
 	if err := json.Unmarshal(b, &v); err != nil {
-		return nil, nil, err
+		return err
+	}
+	if desired != nil && v.Desired != nil {
+		if err := json.Unmarshal(v.Desired, desired); err != nil {
+			return err
+		}
 	}
-	return v.Desired, v.Reported, nil
+	if reported != nil && v.Reported != nil {
+		if err := json.Unmarshal(v.Reported, reported); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // UpdateTwinState updates twin device's state and returns new version.
 // To remove any attribute set its value to nil.
+//
+// With WithTwinCoalescing the update is merged with the pending ones
+// and sent later, see Flush, the returned version is the latest known one
+// then, not the version of the merged patch.
 func (c *Client) UpdateTwinState(ctx context.Context, s TwinState) (int, error) {
+	if c.coal == nil {
+		return c.UpdateReportedFromStruct(ctx, s)
+	}
+	if !c.work.add() {
+		return 0, ErrClosed
+	}
+	defer c.work.done()
+	c.coal.add(s, c.flushTwin)
+	return c.ReportedVersion(), nil
+}
+
+// UpdateReportedFromStruct is same as UpdateTwinState but accepts
+// any value that's marshaled to a json object, e.g. a tagged struct.
+func (c *Client) UpdateReportedFromStruct(ctx context.Context, v interface{}) (_ int, err error) {
+	ctx, span := common.StartSpan(ctx, c.tracer, "iothub.UpdateTwinState", c.spanAttrs())
+	defer func() {
+		span.End(err)
+	}()
 	if err := c.checkConnection(ctx); err != nil {
 		return 0, err
 	}
-	b, err := json.Marshal(s)
+	if !c.work.add() {
+		return 0, ErrClosed
+	}
+	defer c.work.done()
+	b, err := json.Marshal(v)
 	if err != nil {
 		return 0, err
 	}
-	return c.tr.UpdateTwinProperties(ctx, b)
+	return c.updateReported(ctx, b)
+}
+
+// updateReported sends the reported properties patch b.
+func (c *Client) updateReported(ctx context.Context, b []byte) (ver int, err error) {
+	if err = common.Retry(ctx, c.retry, func() error {
+		ver, err = c.tr.UpdateTwinProperties(ctx, b)
+		return err
+	}); err != nil {
+		return 0, err
+	}
+	atomic.StoreInt64(&c.rver, int64(ver))
+	return ver, nil
+}
+
+// ApplyPatch sends the reported properties patch and returns new version.
+func (c *Client) ApplyPatch(ctx context.Context, p *twin.Patch) (int, error) {
+	if p == nil {
+		panic("p is nil")
+	}
+	if p.Empty() {
+		return c.ReportedVersion(), nil
+	}
+	return c.UpdateReportedFromStruct(ctx, p)
+}
+
+// ReportedVersion returns the reported state version
+// received from the hub after the latest successful update,
+// it's zero when nothing has been updated yet.
+func (c *Client) ReportedVersion() int {
+	return int(atomic.LoadInt64(&c.rver))
+}
+
+// TwinSubscribeOption is a twin updates subscription option.
+type TwinSubscribeOption func(o *twinSubscribeOptions)
+
+type twinSubscribeOptions struct {
+	initial bool
 }
 
-// SubscribeTwinUpdates registers fn as a desired state changes handler.
-func (c *Client) SubscribeTwinUpdates(ctx context.Context) (*TwinStateSub, error) {
+// WithInitialDesiredState makes the subscription receive the full desired
+// state retrieved from the hub first and then its changes, changes that
+// are already included into the state are not delivered.
+//
+// By default only changes made after subscribing are received.
+func WithInitialDesiredState() TwinSubscribeOption {
+	return func(o *twinSubscribeOptions) {
+		o.initial = true
+	}
+}
+
+// SubscribeTwinUpdates subscribes to desired state changes.
+func (c *Client) SubscribeTwinUpdates(ctx context.Context, opts ...TwinSubscribeOption) (*TwinStateSub, error) {
+	var o twinSubscribeOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
 	if err := c.checkConnection(ctx); err != nil {
 		return nil, err
 	}
@@ -266,19 +907,79 @@ func (c *Client) SubscribeTwinUpdates(ctx context.Context) (*TwinStateSub, error
 	}); err != nil {
 		return nil, err
 	}
-	return c.tsMux.sub(), nil
+	sub := c.tsMux.sub(o.initial)
+	if !o.initial {
+		return sub, nil
+	}
+
+	// subscribe before retrieving the state to not miss any changes
+	var desired TwinState
+	if err := c.GetTwinInto(ctx, &desired, nil); err != nil {
+		c.tsMux.unsub(sub)
+		return nil, err
+	}
+	if desired == nil {
+		desired = TwinState{}
+	}
+	sub.release(desired)
+	return sub, nil
 }
 
-// UnsubscribeTwinUpdates unsubscribes the given handler from twin state updates.
+// UnsubscribeTwinUpdates unsubscribes the given handler from twin state updates,
+// its channel is closed.
 func (c *Client) UnsubscribeTwinUpdates(sub *TwinStateSub) {
 	c.tsMux.unsub(sub)
 }
 
+// DispatchErrorHandler handles malformed payloads received from
+// the hub that cannot be delivered to subscribers.
+type DispatchErrorHandler func(err error, payload []byte)
+
+// OnDispatchError sets the handler of twin updates that cannot be decoded,
+// by default such errors are written to the logger, nil discards them.
+func (c *Client) OnDispatchError(fn DispatchErrorHandler) {
+	c.tsMux.onError(fn)
+}
+
+// SubscribeTwinUpdatesInto is same as SubscribeTwinUpdates but desired
+// state changes are unmarshaled into values returned by fn, e.g.
+//
+//	sub, err := c.SubscribeTwinUpdatesInto(ctx, func() interface{} {
+//		return &Config{}
+//	})
+//	for v := range sub.C() {
+//		cfg := v.(*Config)
+//	}
+func (c *Client) SubscribeTwinUpdatesInto(ctx context.Context, fn func() interface{}) (*TypedTwinStateSub, error) {
+	if fn == nil {
+		panic("fn is nil")
+	}
+	if err := c.checkConnection(ctx); err != nil {
+		return nil, err
+	}
+	if err := c.tsMux.once(func() error {
+		return c.tr.SubscribeTwinUpdates(ctx, &c.tsMux)
+	}); err != nil {
+		return nil, err
+	}
+	return c.tsMux.typedSub(fn), nil
+}
+
+// UnsubscribeTwinUpdatesInto unsubscribes the given typed subscription,
+// its channel is closed.
+func (c *Client) UnsubscribeTwinUpdatesInto(sub *TypedTwinStateSub) {
+	c.tsMux.typedUnsub(sub)
+}
+
 // SendOption is a send event options.
 type SendOption func(msg *common.Message) error
 
 // WithSendQoS sets the quality of service (MQTT only).
 // Only 0 and 1 values are supported, defaults to 1.
+//
+// With QoS 0 messages are sent at most once and sending completes as soon
+// as they're written to the connection, with QoS 1 they're sent at least
+// once and sending completes when the hub acknowledges them.
 func WithSendQoS(qos int) SendOption {
 	return func(msg *common.Message) error {
 		if msg.TransportOptions == nil {
@@ -305,9 +1006,72 @@ func WithSendCorrelationID(cid string) SendOption {
 	}
 }
 
+// WithSendUserID sets message user id.
+func WithSendUserID(uid string) SendOption {
+	return func(msg *common.Message) error {
+		msg.UserID = uid
+		return nil
+	}
+}
+
+// WithSendExpiry makes the message expire after the given duration.
+func WithSendExpiry(d time.Duration) SendOption {
+	return func(msg *common.Message) error {
+		if d <= 0 {
+			return errors.New("expiry must be positive")
+		}
+		t := time.Now().Add(d)
+		msg.ExpiryTime = &t
+		return nil
+	}
+}
+
+// WithSendExpiryTime sets message expiration time.
+func WithSendExpiryTime(t time.Time) SendOption {
+	return func(msg *common.Message) error {
+		msg.ExpiryTime = &t
+		return nil
+	}
+}
+
+// WithSendContentType sets the payload's media type, e.g. `application/json`.
+func WithSendContentType(typ string) SendOption {
+	return func(msg *common.Message) error {
+		msg.ContentType = typ
+		return nil
+	}
+}
+
+// WithSendContentEncoding sets the payload's character encoding, e.g. `utf-8`.
+func WithSendContentEncoding(enc string) SendOption {
+	return func(msg *common.Message) error {
+		msg.ContentEncoding = enc
+		return nil
+	}
+}
+
+// WithSendCreationTime sets message creation time.
+func WithSendCreationTime(t time.Time) SendOption {
+	return func(msg *common.Message) error {
+		msg.CreationTime = &t
+		return nil
+	}
+}
+
+// WithSendOutputName sets IoT Edge module output name (modules only).
+func WithSendOutputName(name string) SendOption {
+	return func(msg *common.Message) error {
+		msg.OutputName = name
+		return nil
+	}
+}
+
 // WithSendProperty sets a message option.
 func WithSendProperty(k, v string) SendOption {
 	return func(msg *common.Message) error {
+		if k == "" {
+			return errors.New("property key is blank")
+		}
 		if msg.Properties == nil {
 			msg.Properties = map[string]string{}
 		}
@@ -329,41 +1093,228 @@ func WithSendProperties(m map[string]string) SendOption {
 	}
 }
 
-// SendEvent sends a device-to-cloud message.
-// Panics when event is nil.
-func (c *Client) SendEvent(ctx context.Context, payload []byte, opts ...SendOption) error {
+// SendEvent sends a device-to-cloud message, its system and application
+// properties are set with send options, for example:
+//
+//	c.SendEvent(ctx, b,
+//		iotdevice.WithSendMessageID(id),
+//		iotdevice.WithSendContentType("application/json"),
+//		iotdevice.WithSendExpiry(5*time.Minute),
+//		iotdevice.WithSendProperty("severity", "high"),
+//	)
+//
+// With MQTT QoS 1 it returns when the hub acknowledges the message,
+// so the waiting can be bounded by the context deadline.
+func (c *Client) SendEvent(ctx context.Context, payload []byte, opts ...SendOption) (err error) {
+	ctx, span := common.StartSpan(ctx, c.tracer, "iothub.SendEvent", c.spanAttrs())
+	defer func() {
+		span.End(err)
+	}()
 	if err := c.checkConnection(ctx); err != nil {
 		return err
 	}
+	if !c.work.add() {
+		return ErrClosed
+	}
+	defer c.work.done()
+	msg, err := c.newMessage(payload, span, opts)
+	if err != nil {
+		return err
+	}
+
+	// keep sending order when there are queued messages
+	if c.queue != nil && !c.queue.bypass() {
+		return c.enqueue(msg)
+	}
+	if err := c.throttle(ctx); err != nil {
+		return err
+	}
+	if err := common.Retry(ctx, c.retry, func() error {
+		return c.tr.Send(ctx, msg)
+	}); err != nil {
+		if c.queue != nil && common.IsTransient(err) {
+			return c.enqueue(msg)
+		}
+		return err
+	}
+	c.add(common.MetricMessagesSent)
+	c.debugf(common.ComponentClient, "device-to-cloud: %#v", msg)
+	return nil
+}
+
+// SendValue encodes v with the codec registered for the content type,
+// e.g. `application/cbor`, and sends it like SendEvent:
+//
+//	err := c.SendValue(ctx, "application/cbor", &Reading{Temperature: 25.5})
+//
+// The content type system property is set to the codec's one.
+func (c *Client) SendValue(ctx context.Context, contentType string, v interface{}, opts ...SendOption) error {
+	var msg common.Message
+	if err := msg.Encode(contentType, v); err != nil {
+		return err
+	}
+	return c.SendEvent(ctx, msg.Payload, append([]SendOption{
+		WithSendContentType(msg.ContentType),
+	}, opts...)...)
+}
+
+// SendEventAsync is same as SendEvent but it doesn't wait for the message
+// to be delivered, the returned channel receives the result instead.
+//
+// Transports implementing `transport.AsyncSender`, like MQTT, pipeline
+// messages preserving the order of calls, the rest send them in the
+// background. Failed messages are retried and queued offline like with
+// SendEvent, a retried message may be delivered after later ones.
+//
+// With WithSendRateLimit the call itself waits for the rate limit,
+// so the order of messages is kept.
+func (c *Client) SendEventAsync(ctx context.Context, payload []byte, opts ...SendOption) <-chan error {
+	ctx, span := common.StartSpan(ctx, c.tracer, "iothub.SendEvent", c.spanAttrs())
+	done := make(chan error, 1)
+	fail := func(err error) <-chan error {
+		span.End(err)
+		done <- err
+		return done
+	}
+	if err := c.checkConnection(ctx); err != nil {
+		return fail(err)
+	}
+	if !c.work.add() {
+		return fail(ErrClosed)
+	}
+	msg, err := c.newMessage(payload, span, opts)
+	if err != nil {
+		c.work.done()
+		return fail(err)
+	}
+
+	// keep sending order when there are queued messages
+	if c.queue != nil && !c.queue.bypass() {
+		err = c.enqueue(msg)
+		c.work.done()
+		return fail(err)
+	}
+	if err = c.throttle(ctx); err != nil {
+		c.work.done()
+		return fail(err)
+	}
+
+	var res <-chan error
+	if as, ok := c.tr.(transport.AsyncSender); ok {
+		res = as.SendAsync(ctx, msg)
+	} else {
+		ch := make(chan error, 1)
+		go func() {
+			ch <- c.tr.Send(ctx, msg)
+		}()
+		res = ch
+	}
+	go func() {
+		defer c.work.done()
+		first := true
+		err := common.Retry(ctx, c.retry, func() error {
+			if first {
+				first = false
+				return <-res
+			}
+			return c.tr.Send(ctx, msg)
+		})
+		if err != nil && c.queue != nil && common.IsTransient(err) {
+			err = c.enqueue(msg)
+			span.End(err)
+			done <- err
+			return
+		}
+		span.End(err)
+		if err == nil {
+			c.add(common.MetricMessagesSent)
+			c.debugf(common.ComponentClient, "device-to-cloud: %#v", msg)
+		}
+		done <- err
+	}()
+	return done
+}
+
+// onInvalidMessage reports cloud-to-device messages failed validation,
+// they're rejected when settled manually, otherwise the transport
+// has already completed them.
+func (c *Client) onInvalidMessage(verr *ValidationError) {
+	c.logf(common.LevelError, common.ComponentMux, "%s", verr)
+	if !c.manual {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := c.tr.(transport.Settler).Settle(ctx, verr.Message, transport.SettleReject); err != nil {
+			c.logf(common.LevelError, common.ComponentMux, "invalid message rejection error: %s", err)
+		}
+	}()
+}
+
+// newMessage builds up a device-to-cloud message ready to be sent,
+// it's not pooled since transports may keep it after sending.
+func (c *Client) newMessage(payload []byte, span common.Span, opts []SendOption) (*common.Message, error) {
 	if payload == nil {
-		return errors.New("payload is nil")
+		return nil, errors.New("payload is nil")
 	}
 	msg := &common.Message{Payload: payload}
 	for _, opt := range opts {
 		if err := opt(msg); err != nil {
-			return err
+			return nil, err
 		}
 	}
-	if err := c.tr.Send(ctx, msg); err != nil {
-		return err
+	if c.tracer != nil {
+		if msg.Properties == nil {
+			msg.Properties = map[string]string{}
+		}
+		span.Inject(msg.Properties)
 	}
-	c.debugf("device-to-cloud: %#v", msg)
-	return nil
+	if err := c.validate(msg); err != nil {
+		return nil, err
+	}
+	if c.compress != "" && msg.ContentEncoding == "" {
+		if err := compress(msg, c.compress); err != nil {
+			return nil, err
+		}
+	}
+	if err := msg.CheckSize(common.MaxDeviceToCloudSize); err != nil {
+		return nil, err
+	}
+	return msg, nil
 }
 
-func (c *Client) logf(format string, v ...interface{}) {
-	if c.logger != nil {
-		c.logger.Printf(format, v...)
+// add increments the named counter if metrics are enabled.
+func (c *Client) add(name string) {
+	if c.metrics != nil {
+		c.metrics.Add(name, 1, deviceLabels)
+	}
+}
+
+func (c *Client) spanAttrs() map[string]string {
+	attrs := map[string]string{
+		"iothub.hostname":  c.creds.Hostname(),
+		"iothub.device_id": c.creds.DeviceID(),
+	}
+	if c.creds.ModuleID() != "" {
+		attrs["iothub.module_id"] = c.creds.ModuleID()
 	}
+	return attrs
 }
 
-func (c *Client) debugf(format string, v ...interface{}) {
-	if c.logger != nil && c.debug {
-		c.logger.Printf(format, v...)
+func (c *Client) logf(level common.LogLevel, component, format string, v ...interface{}) {
+	if c.logger == nil || level == common.LevelDebug && !c.debug {
+		return
 	}
+	c.logger.Logf(level, component, format, v...)
 }
 
-// Close closes transport connection.
+func (c *Client) debugf(component, format string, v ...interface{}) {
+	c.logf(common.LevelDebug, component, format, v...)
+}
+
+// Close closes transport connection immediately,
+// see Shutdown for closing it gracefully.
 func (c *Client) Close() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -372,8 +1323,17 @@ func (c *Client) Close() error {
 		return nil
 	default:
 		close(c.done)
-		c.evMux.close(ErrClosed)
-		c.tsMux.close(ErrClosed)
-		return c.tr.Close()
+		c.cancel()
+		if c.coal != nil {
+			c.coal.stop()
+		}
+		c.evMux.close()
+		c.tsMux.close()
+
+		// connection state subscribers
+		// receive the last state change
+		err := c.tr.Close()
+		c.csMux.close()
+		return err
 	}
 }
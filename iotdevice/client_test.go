@@ -0,0 +1,558 @@
+package iotdevice
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/iotdevice/transport"
+)
+
+func TestSendOptions(t *testing.T) {
+	t.Parallel()
+
+	msg := &common.Message{}
+	for _, opt := range []SendOption{
+		WithSendMessageID("mid"),
+		WithSendCorrelationID("cid"),
+		WithSendUserID("uid"),
+		WithSendContentType("application/json"),
+		WithSendContentEncoding("utf-8"),
+		WithSendExpiry(time.Minute),
+		WithSendProperty("k", "v"),
+	} {
+		if err := opt(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if msg.MessageID != "mid" || msg.CorrelationID != "cid" || msg.UserID != "uid" ||
+		msg.ContentType != "application/json" || msg.ContentEncoding != "utf-8" ||
+		msg.Properties["k"] != "v" {
+		t.Errorf("send options = %#v", msg)
+	}
+	if exp, ok := msg.Expiry(); !ok || time.Until(exp) > time.Minute || time.Until(exp) < 0 {
+		t.Errorf("ExpiryTime = %v, want in a minute", msg.ExpiryTime)
+	}
+
+	for _, opt := range []SendOption{
+		WithSendExpiry(0),
+		WithSendProperty("", "v"),
+	} {
+		if err := opt(&common.Message{}); err == nil {
+			t.Error("invalid send option error = nil, want an error")
+		}
+	}
+}
+
+// testTransport records sent messages, it's connected straight away.
+type testTransport struct {
+	mu   sync.Mutex
+	sent []*common.Message
+	err  error
+	twin []byte // twin properties document
+}
+
+func (tr *testTransport) Connect(context.Context, transport.Credentials) error { return nil }
+func (tr *testTransport) Send(_ context.Context, msg *common.Message) error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.err != nil {
+		return tr.err
+	}
+	tr.sent = append(tr.sent, msg)
+	return nil
+}
+func (tr *testTransport) RegisterDirectMethods(context.Context, transport.MethodDispatcher) error {
+	return nil
+}
+func (tr *testTransport) SubscribeEvents(context.Context, transport.MessageDispatcher) error {
+	return nil
+}
+func (tr *testTransport) SubscribeTwinUpdates(context.Context, transport.TwinStateDispatcher) error {
+	return nil
+}
+func (tr *testTransport) RetrieveTwinProperties(context.Context) ([]byte, error) {
+	return tr.twin, nil
+}
+func (tr *testTransport) UpdateTwinProperties(context.Context, []byte) (int, error) {
+	return 0, nil
+}
+func (tr *testTransport) SubscribeConnectionState(context.Context, transport.ConnectionStateDispatcher) error {
+	return nil
+}
+func (tr *testTransport) Close() error { return nil }
+
+// testConnString is the device connection string used by tests.
+const testConnString = "HostName=test.azure-devices.net;DeviceId=dev;SharedAccessKey=a2V5"
+
+// newTestClient creates a client connected over tr,
+// it's closed when the test finishes.
+func newTestClient(t *testing.T, tr transport.Transport, opts ...ClientOption) *Client {
+	t.Helper()
+	c, err := NewClient(append([]ClientOption{
+		WithTransport(tr),
+		WithConnectionString(testConnString),
+	}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if err = c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestSendEventAsync(t *testing.T) {
+	t.Parallel()
+
+	tr := &testTransport{}
+	c := newTestClient(t, tr)
+
+	if err := <-c.SendEventAsync(context.Background(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-c.SendEventAsync(context.Background(), nil); err == nil {
+		t.Error("SendEventAsync(nil) = nil, want an error")
+	}
+	tr.err = errors.New("failed")
+	if err := <-c.SendEventAsync(context.Background(), []byte("hello")); err != tr.err {
+		t.Errorf("SendEventAsync() = %v, want %v", err, tr.err)
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if len(tr.sent) != 1 || string(tr.sent[0].Payload) != "hello" {
+		t.Errorf("sent = %v, want one message", tr.sent)
+	}
+}
+
+// flakyTransport fails sending with a transient error n times.
+type flakyTransport struct {
+	testTransport
+	n int
+}
+
+type transientError struct{}
+
+func (transientError) Error() string   { return "transient" }
+func (transientError) Temporary() bool { return true }
+
+func (tr *flakyTransport) Send(ctx context.Context, msg *common.Message) error {
+	tr.mu.Lock()
+	if tr.n > 0 {
+		tr.n--
+		tr.mu.Unlock()
+		return transientError{}
+	}
+	tr.mu.Unlock()
+	return tr.testTransport.Send(ctx, msg)
+}
+
+func (tr *flakyTransport) len() int {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return len(tr.sent)
+}
+
+func TestSendEventAsyncRetry(t *testing.T) {
+	t.Parallel()
+
+	tr := &flakyTransport{n: 2}
+	c := newTestClient(t, tr, WithRetryPolicy(common.LinearRetry(time.Millisecond, 2)))
+	if err := <-c.SendEventAsync(context.Background(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if n := tr.len(); n != 1 {
+		t.Errorf("sent %d messages, want 1", n)
+	}
+
+	// failed messages are queued and sent when flushing
+	tr = &flakyTransport{n: 1}
+	c = newTestClient(t, tr, WithOfflineQueue(10, DropOldest))
+	if err := <-c.SendEventAsync(context.Background(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); tr.len() != 1; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("queued message is not sent")
+		}
+	}
+}
+
+func TestSendValue(t *testing.T) {
+	t.Parallel()
+
+	tr := &testTransport{}
+	c := newTestClient(t, tr)
+
+	if err := c.SendValue(context.Background(), "application/cbor",
+		map[string]int{"a": 1}, WithSendProperty("k", "v"),
+	); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendValue(context.Background(), "text/csv", "a,b"); !errors.Is(err, common.ErrUnknownContentType) {
+		t.Errorf("SendValue(text/csv) = %v, want ErrUnknownContentType", err)
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if len(tr.sent) != 1 {
+		t.Fatalf("sent = %v, want one message", tr.sent)
+	}
+	var v map[string]int
+	if err := tr.sent[0].Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if tr.sent[0].ContentType != "application/cbor" || v["a"] != 1 || tr.sent[0].Properties["k"] != "v" {
+		t.Errorf("sent %#v, decoded %v", tr.sent[0], v)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	t.Parallel()
+
+	c := newTestClient(t, &testTransport{})
+
+	started, release := make(chan struct{}), make(chan struct{})
+	if err := c.RegisterRawMethod(context.Background(), "wait", func(context.Context, []byte) (int, []byte, error) {
+		close(started)
+		<-release
+		return 200, []byte(`{}`), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	rc := make(chan int, 1)
+	go func() {
+		n, _, _ := c.dmMux.Dispatch("wait", []byte(`{}`))
+		rc <- n
+	}()
+	<-started
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Shutdown(context.Background())
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown() = %v, want it to wait for the handler", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := c.SendEvent(context.Background(), []byte("hello")); err != ErrClosed {
+		t.Errorf("SendEvent() = %v, want %v", err, ErrClosed)
+	}
+	if n, _, _ := c.dmMux.Dispatch("wait", []byte(`{}`)); n != 503 {
+		t.Errorf("Dispatch() = %d, want 503", n)
+	}
+
+	close(release)
+	if n := <-rc; n != 200 {
+		t.Errorf("Dispatch() = %d, want 200", n)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	t.Parallel()
+
+	c, err := NewClient(
+		WithTransport(&testTransport{}),
+		WithConnectionString(testConnString),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.work.add() {
+		t.Fatal("add() = false, want true")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err = c.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	select {
+	case <-c.done:
+	default:
+		t.Error("client is not closed")
+	}
+}
+
+func TestSubscribeTwinUpdatesInitial(t *testing.T) {
+	t.Parallel()
+
+	c := newTestClient(t, &testTransport{twin: []byte(`{"desired":{"a":1,"$version":3}}`)})
+	sub, err := c.SubscribeTwinUpdates(context.Background(), WithInitialDesiredState())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.tsMux.Dispatch([]byte(`{"b":2,"$version":4}`))
+	for _, w := range []int{3, 4} {
+		s, err := sub.Recv(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Version() != w {
+			t.Errorf("Version() = %d, want %d", s.Version(), w)
+		}
+	}
+}
+
+func TestWatchDesired(t *testing.T) {
+	t.Parallel()
+
+	c := newTestClient(t, &testTransport{twin: []byte(`{"desired":{"config":{"interval":10},"$version":3}}`)})
+
+	type change struct {
+		v   interface{}
+		ver int
+	}
+	ch := make(chan change, 10)
+	w, err := c.WatchDesired(context.Background(), "config.interval", func(v interface{}, ver int) {
+		ch <- change{v, ver}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	c.tsMux.Dispatch([]byte(`{"other":1,"$version":4}`))
+	c.tsMux.Dispatch([]byte(`{"config":{"interval":20},"$version":5}`))
+	c.tsMux.Dispatch([]byte(`{"config":null,"$version":6}`))
+	for _, w := range []change{{float64(10), 3}, {float64(20), 5}, {nil, 6}} {
+		if g := <-ch; g != w {
+			t.Errorf("change = %v, want %v", g, w)
+		}
+	}
+}
+
+// discardTransport drops sent messages.
+type discardTransport struct {
+	testTransport
+}
+
+func (tr *discardTransport) Send(context.Context, *common.Message) error {
+	return nil
+}
+
+func BenchmarkSendEvent(b *testing.B) {
+	c, err := NewClient(
+		WithTransport(&discardTransport{}),
+		WithConnectionString(testConnString),
+	)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.Connect(context.Background()); err != nil {
+		b.Fatal(err)
+	}
+	payload := []byte(`{"temperature":25.5}`)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err = c.SendEvent(context.Background(), payload,
+			WithSendProperty("severity", "low"),
+		); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// concurrentTransport records the direct methods concurrency.
+type concurrentTransport struct {
+	testTransport
+	n int
+}
+
+func (tr *concurrentTransport) SetMethodConcurrency(n int) {
+	tr.n = n
+}
+
+func TestWithMethodConcurrency(t *testing.T) {
+	t.Parallel()
+
+	tr := &concurrentTransport{}
+	if _, err := NewClient(
+		WithTransport(tr),
+		WithConnectionString(testConnString),
+		WithMethodConcurrency(4),
+	); err != nil {
+		t.Fatal(err)
+	}
+	if tr.n != 4 {
+		t.Errorf("concurrency = %d, want %d", tr.n, 4)
+	}
+	if _, err := NewClient(
+		WithTransport(&testTransport{}),
+		WithConnectionString(testConnString),
+		WithMethodConcurrency(4),
+	); err == nil {
+		t.Error("NewClient() with unsupported method concurrency = nil error")
+	}
+}
+
+// pingTransport fails pings with err.
+type pingTransport struct {
+	testTransport
+	err error
+}
+
+func (tr *pingTransport) Ping(ctx context.Context) error {
+	time.Sleep(time.Millisecond)
+	return tr.err
+}
+
+func TestPing(t *testing.T) {
+	t.Parallel()
+
+	tr := &pingTransport{}
+	c, err := NewClient(
+		WithTransport(tr),
+		WithConnectionString(testConnString),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if _, err = c.Ping(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Ping() before connecting = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err = c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	d, err := c.Ping(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d < time.Millisecond {
+		t.Errorf("latency = %s, want at least 1ms", d)
+	}
+	tr.err = errors.New("link detached")
+	if _, err = c.Ping(context.Background()); err != tr.err {
+		t.Errorf("Ping() = %v, want %v", err, tr.err)
+	}
+
+	c, err = NewClient(
+		WithTransport(&testTransport{}),
+		WithConnectionString(testConnString),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = c.Ping(context.Background()); err == nil {
+		t.Error("Ping() with unsupported transport = nil error")
+	}
+}
+
+// frameTransport records the frame handler.
+type frameTransport struct {
+	testTransport
+	fn    transport.FrameHandler
+	limit int
+}
+
+func (tr *frameTransport) SetFrameHandler(fn transport.FrameHandler, limit int) {
+	tr.fn, tr.limit = fn, limit
+}
+
+func TestWithFrameTrace(t *testing.T) {
+	t.Parallel()
+
+	tr := &frameTransport{}
+	if _, err := NewClient(
+		WithTransport(tr),
+		WithConnectionString(testConnString),
+		WithFrameTrace(func(f *transport.Frame) {}, 64),
+	); err != nil {
+		t.Fatal(err)
+	}
+	if tr.fn == nil || tr.limit != 64 {
+		t.Errorf("handler, limit = %v, %d, want set, 64", tr.fn != nil, tr.limit)
+	}
+
+	if _, err := NewClient(
+		WithTransport(&testTransport{}),
+		WithConnectionString(testConnString),
+		WithFrameTrace(func(f *transport.Frame) {}, 64),
+	); err == nil {
+		t.Error("NewClient() with unsupported frame tracing = nil error")
+	}
+}
+
+// dialerTransport records the custom dialer.
+type dialerTransport struct {
+	testTransport
+	dial common.Dialer
+}
+
+func (tr *dialerTransport) SetDialer(fn common.Dialer) {
+	tr.dial = fn
+}
+
+func TestWithDialer(t *testing.T) {
+	t.Parallel()
+
+	var dialed string
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = addr
+		return nil, errors.New("unreachable")
+	}
+	tr := &dialerTransport{}
+	c, err := NewClient(
+		WithTransport(tr),
+		WithConnectionString(testConnString),
+		WithDialer(dial),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.dial == nil {
+		t.Error("dialer is not passed to the transport")
+	}
+	// files are uploaded with the dialer too
+	if _, err = c.blob.Get("https://blob.example.com/"); err == nil {
+		t.Fatal("upload client request = nil error")
+	}
+	if dialed != "blob.example.com:443" {
+		t.Errorf("upload client dialed %q, want %q", dialed, "blob.example.com:443")
+	}
+
+	if _, err := NewClient(
+		WithTransport(&testTransport{}),
+		WithConnectionString(testConnString),
+		WithDialer(dial),
+	); err == nil {
+		t.Error("NewClient() with unsupported dialer = nil error")
+	}
+}
+
+func TestWithEndpoint(t *testing.T) {
+	t.Parallel()
+
+	var dialed string
+	tr := &dialerTransport{}
+	if _, err := NewClient(
+		WithTransport(tr),
+		WithConnectionString(testConnString),
+		WithDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dialed = addr
+			return nil, errors.New("unreachable")
+		}),
+		WithEndpoint("10.0.0.4"),
+	); err != nil {
+		t.Fatal(err)
+	}
+	tr.dial(context.Background(), "tcp", "test.azure-devices.net:8883")
+	if dialed != "10.0.0.4:8883" {
+		t.Errorf("dialed %q, want %q", dialed, "10.0.0.4:8883")
+	}
+}
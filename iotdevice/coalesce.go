@@ -0,0 +1,230 @@
+package iotdevice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/goautomotive/iothub/common"
+)
+
+// WithTwinCoalescing makes UpdateTwinState merge reported properties
+// patches on the client side and send them at most once per interval,
+// that keeps devices reporting many small changes a second within
+// the hub's twin updates throttling limits.
+//
+// UpdateTwinState returns the latest known reported version as soon as
+// the patch is merged then, it's not the version the patch gets once
+// it's sent. Patches failing with transient errors are retried with the next
+// flush, the ones rejected by the hub are dropped, see WithTwinErrorHandler.
+// Flush sends pending patches right away, Shutdown flushes them too,
+// but Close discards them.
+func WithTwinCoalescing(interval time.Duration) ClientOption {
+	if interval <= 0 {
+		panic("interval must be positive")
+	}
+	return func(c *Client) error {
+		if c.coal == nil {
+			c.coal = &coalescer{}
+		}
+		c.coal.interval = interval
+		return nil
+	}
+}
+
+// TwinErrorHandler handles coalesced reported properties patches
+// dropped because sending them fails with a non-transient error.
+type TwinErrorHandler func(err error, patch TwinState)
+
+// WithTwinErrorHandler sets the handler of dropped coalesced patches,
+// by default they're written to the logger, it requires WithTwinCoalescing.
+func WithTwinErrorHandler(fn TwinErrorHandler) ClientOption {
+	if fn == nil {
+		panic("fn is nil")
+	}
+	return func(c *Client) error {
+		if c.coal == nil {
+			c.coal = &coalescer{}
+		}
+		c.coal.onErr = fn
+		return nil
+	}
+}
+
+// Flush sends reported properties patches held by twin updates
+// coalescing, it's a no-op when coalescing is not enabled.
+func (c *Client) Flush(ctx context.Context) error {
+	if c.coal == nil {
+		return nil
+	}
+	return c.coal.flush(ctx, c.sendPatch)
+}
+
+// sendPatch sends the coalesced reported properties patch.
+func (c *Client) sendPatch(ctx context.Context, p TwinState) error {
+	if err := c.checkConnection(ctx); err != nil {
+		return err
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	_, err = c.updateReported(ctx, b)
+	return err
+}
+
+// flushTwin is run by the coalescing timer, it waits for the connection,
+// drops patches rejected by the hub and reschedules the ones it fails to send.
+func (c *Client) flushTwin() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := c.coal.flush(ctx, func(ctx context.Context, p TwinState) error {
+		err := c.sendPatch(ctx, p)
+		if err != nil && !common.IsTransient(err) && !errors.Is(err, ErrClosed) && ctx.Err() == nil {
+			c.twinError(err, p)
+			return nil
+		}
+		return err
+	}); err != nil {
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+		c.logf(common.LevelError, common.ComponentClient, "twin update error: %s", err)
+		c.coal.schedule(c.flushTwin)
+	}
+}
+
+// twinError reports the dropped patch.
+func (c *Client) twinError(err error, p TwinState) {
+	if c.coal.onErr != nil {
+		c.coal.onErr(err, p)
+		return
+	}
+	c.logf(common.LevelError, common.ComponentClient, "twin update dropped: %s", err)
+}
+
+// coalescer merges reported properties patches.
+type coalescer struct {
+	interval time.Duration
+	onErr    TwinErrorHandler
+	sending  sync.Mutex // serializes flushes to keep patches order
+
+	mu      sync.Mutex
+	patches []TwinState // merged patches in the sending order
+	timer   *time.Timer // pending flush, nil when there's none
+	stopped bool
+}
+
+// add merges s into the pending patches and
+// schedules fn to flush them unless it's already.
+func (q *coalescer) add(s TwinState, fn func()) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if n := len(q.patches); n != 0 && mergeable(q.patches[n-1], s) {
+		mergePatch(q.patches[n-1], s)
+	} else {
+		q.patches = append(q.patches, mergePatch(TwinState{}, s))
+	}
+	q.scheduleLocked(fn)
+}
+
+// schedule makes fn run after the interval unless it's already scheduled.
+func (q *coalescer) schedule(fn func()) {
+	q.mu.Lock()
+	q.scheduleLocked(fn)
+	q.mu.Unlock()
+}
+
+func (q *coalescer) scheduleLocked(fn func()) {
+	if q.timer == nil && !q.stopped {
+		q.timer = time.AfterFunc(q.interval, fn)
+	}
+}
+
+// flush sends pending patches with fn in order, patches that
+// aren't sent are put back in front of the ones added meanwhile.
+func (q *coalescer) flush(ctx context.Context, fn func(ctx context.Context, p TwinState) error) error {
+	q.sending.Lock()
+	defer q.sending.Unlock()
+
+	q.mu.Lock()
+	patches := q.patches
+	q.patches = nil
+	if q.timer != nil {
+		q.timer.Stop()
+		q.timer = nil
+	}
+	q.mu.Unlock()
+
+	for i, p := range patches {
+		if err := fn(ctx, p); err != nil {
+			q.mu.Lock()
+			q.patches = append(patches[i:], q.patches...)
+			q.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// stop cancels the scheduled flush and discards pending patches.
+func (q *coalescer) stop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.stopped = true
+	q.patches = nil
+	if q.timer != nil {
+		q.timer.Stop()
+		q.timer = nil
+	}
+}
+
+// mergeable reports whether src applied after dst can be sent as a single
+// JSON merge patch, that's not the case when src sets attributes of
+// an object that dst deletes, because merging would keep the others.
+func mergeable(dst, src map[string]interface{}) bool {
+	for k, v := range src {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		d, ok := dst[k]
+		if ok && d == nil {
+			return false
+		}
+		if n, ok := d.(map[string]interface{}); ok && !mergeable(n, m) {
+			return false
+		}
+	}
+	return true
+}
+
+// mergePatch merges the patch src into dst keeping nil values that
+// delete attributes, src's objects are copied so it can be reused.
+func mergePatch(dst, src map[string]interface{}) map[string]interface{} {
+	for k, v := range src {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			dst[k] = v
+			continue
+		}
+		n, ok := dst[k].(map[string]interface{})
+		if !ok {
+			n = make(map[string]interface{}, len(m))
+		}
+		dst[k] = mergePatch(n, m)
+	}
+	return dst
+}
@@ -0,0 +1,211 @@
+package iotdevice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// twinTransport records reported properties patches.
+type twinTransport struct {
+	testTransport
+	mu      sync.Mutex
+	patches []string
+	err     error
+}
+
+func (tr *twinTransport) UpdateTwinProperties(_ context.Context, b []byte) (int, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.err != nil {
+		return 0, tr.err
+	}
+	tr.patches = append(tr.patches, string(b))
+	return len(tr.patches) + 1, nil
+}
+
+func (tr *twinTransport) sent() []string {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return append([]string(nil), tr.patches...)
+}
+
+func TestMergePatch(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		dst, src, want string
+		ok             bool
+	}{
+		{`{"a":1}`, `{"b":2}`, `{"a":1,"b":2}`, true},
+		{`{"a":1}`, `{"a":null}`, `{"a":null}`, true},
+		{`{"a":{"b":1}}`, `{"a":{"c":2}}`, `{"a":{"b":1,"c":2}}`, true},
+		{`{"a":{"b":1}}`, `{"a":2}`, `{"a":2}`, true},
+		{`{"a":2}`, `{"a":{"b":1}}`, `{"a":{"b":1}}`, true},
+		{`{"a":null}`, `{"a":{"b":1}}`, "", false},
+		{`{"a":{"b":null}}`, `{"a":{"b":{"c":1}}}`, "", false},
+	} {
+		var dst, src map[string]interface{}
+		if err := json.Unmarshal([]byte(tc.dst), &dst); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(tc.src), &src); err != nil {
+			t.Fatal(err)
+		}
+		if ok := mergeable(dst, src); ok != tc.ok {
+			t.Errorf("mergeable(%s, %s) = %t, want %t", tc.dst, tc.src, ok, tc.ok)
+			continue
+		}
+		if !tc.ok {
+			continue
+		}
+		b, err := json.Marshal(mergePatch(dst, src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tc.want {
+			t.Errorf("mergePatch(%s, %s) = %s, want %s", tc.dst, tc.src, b, tc.want)
+		}
+	}
+}
+
+func TestTwinCoalescing(t *testing.T) {
+	t.Parallel()
+
+	tr := &twinTransport{}
+	c := newTestClient(t, tr, WithTwinCoalescing(time.Hour))
+
+	for _, s := range []TwinState{
+		{"a": 1, "b": map[string]interface{}{"c": 1}},
+		{"a": 2, "b": map[string]interface{}{"d": 2}},
+		{"e": nil},
+		{"e": map[string]interface{}{"f": 3}}, // can't be merged with deletion
+	} {
+		if _, err := c.UpdateTwinState(context.Background(), s); err != nil {
+			t.Fatal(err)
+		}
+		s["a"] = 0 // patches are copied
+	}
+	if got := tr.sent(); len(got) != 0 {
+		t.Fatalf("patches are sent before flushing: %v", got)
+	}
+
+	tr.err = errors.New("throttled")
+	if err := c.Flush(context.Background()); err != tr.err {
+		t.Fatalf("Flush() = %v, want %v", err, tr.err)
+	}
+	tr.err = nil
+	if err := c.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`{"a":2,"b":{"c":1,"d":2},"e":null}`, `{"e":{"f":3}}`}
+	if got := tr.sent(); !reflect.DeepEqual(got, want) {
+		t.Errorf("patches = %v, want %v", got, want)
+	}
+	if v := c.ReportedVersion(); v != 3 {
+		t.Errorf("ReportedVersion() = %d, want 3", v)
+	}
+
+	// shutdown sends the pending patches
+	if _, err := c.UpdateTwinState(context.Background(), TwinState{"g": 4}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := tr.sent(); len(got) != 3 || got[2] != `{"g":4}` {
+		t.Errorf("patches after shutdown = %v", got)
+	}
+}
+
+func TestTwinCoalescingInterval(t *testing.T) {
+	t.Parallel()
+
+	tr := &twinTransport{}
+	c, err := NewClient(
+		WithTransport(tr),
+		WithConnectionString(testConnString),
+		WithTwinCoalescing(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// updates wait for the connection
+	if _, err = c.UpdateTwinState(context.Background(), TwinState{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if got := tr.sent(); len(got) != 0 {
+		t.Fatalf("patches are sent before connecting: %v", got)
+	}
+	if err = c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; len(tr.sent()) == 0; i++ {
+		if i == 100 {
+			t.Fatal("patches are not flushed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got, want := tr.sent(), []string{`{"a":1}`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("patches = %v, want %v", got, want)
+	}
+}
+
+func TestTwinCoalescingErrors(t *testing.T) {
+	t.Parallel()
+
+	dropped := make(chan TwinState, 1)
+	tr := &twinTransport{err: transientError{}}
+	c := newTestClient(t, tr, WithTwinCoalescing(10*time.Millisecond),
+		WithTwinErrorHandler(func(err error, p TwinState) {
+			dropped <- p
+		}),
+	)
+
+	// transient failures are retried with the next flush
+	if _, err := c.UpdateTwinState(context.Background(), TwinState{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	tr.mu.Lock()
+	tr.err = nil
+	tr.mu.Unlock()
+	for i := 0; len(tr.sent()) == 0; i++ {
+		if i == 100 {
+			t.Fatal("patch is not retried")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// rejected patches are dropped
+	tr.mu.Lock()
+	tr.err = errors.New("rejected")
+	tr.mu.Unlock()
+	if _, err := c.UpdateTwinState(context.Background(), TwinState{"b": 2}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case p := <-dropped:
+		if want := (TwinState{"b": 2}); !reflect.DeepEqual(p, want) {
+			t.Errorf("dropped patch = %v, want %v", p, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("patch is not dropped")
+	}
+	tr.mu.Lock()
+	tr.err = nil
+	tr.mu.Unlock()
+	if err := c.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tr.sent(), []string{`{"a":1}`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("patches = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,105 @@
+package iotdevice
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/goautomotive/iothub/common"
+)
+
+// Compression is a message payload compression algorithm,
+// it's put into the content encoding system property.
+type Compression string
+
+const (
+	// Gzip is the gzip file format, RFC 1952.
+	Gzip Compression = "gzip"
+
+	// Deflate is the zlib format, RFC 1950, like in HTTP.
+	Deflate Compression = "deflate"
+)
+
+// WithCompression compresses payloads of all device-to-cloud messages
+// that don't set the content encoding explicitly.
+//
+// Note that the hub cannot route messages by their bodies when
+// they're compressed, so it's up to the backend to decompress them.
+func WithCompression(alg Compression) ClientOption {
+	return func(c *Client) error {
+		if err := checkCompression(alg); err != nil {
+			return err
+		}
+		c.compress = alg
+		return nil
+	}
+}
+
+// WithSendCompression compresses the message payload.
+func WithSendCompression(alg Compression) SendOption {
+	return func(msg *common.Message) error {
+		return compress(msg, alg)
+	}
+}
+
+func checkCompression(alg Compression) error {
+	switch alg {
+	case Gzip, Deflate:
+		return nil
+	default:
+		return fmt.Errorf("unsupported compression %q", alg)
+	}
+}
+
+// compress replaces the message payload with its compressed version.
+func compress(msg *common.Message, alg Compression) error {
+	if err := checkCompression(alg); err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	var w io.WriteCloser
+	if alg == Gzip {
+		w = gzip.NewWriter(&b)
+	} else {
+		w = zlib.NewWriter(&b)
+	}
+	if _, err := w.Write(msg.Payload); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	msg.Payload = b.Bytes()
+	msg.ContentEncoding = string(alg)
+	return nil
+}
+
+// decompress restores payloads of compressed cloud-to-device messages,
+// messages with other content encodings are left intact.
+func decompress(msg *common.Message) error {
+	var r io.ReadCloser
+	var err error
+	switch Compression(strings.ToLower(msg.ContentEncoding)) {
+	case Gzip:
+		r, err = gzip.NewReader(bytes.NewReader(msg.Payload))
+	case Deflate:
+		r, err = zlib.NewReader(bytes.NewReader(msg.Payload))
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	msg.Payload = b
+	msg.ContentEncoding = ""
+	return nil
+}
@@ -0,0 +1,37 @@
+package iotdevice
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/goautomotive/iothub/common"
+)
+
+func TestCompress(t *testing.T) {
+	t.Parallel()
+
+	payload := bytes.Repeat([]byte("telemetry "), 100)
+	for _, alg := range []Compression{Gzip, Deflate} {
+		msg := &common.Message{Payload: append([]byte(nil), payload...)}
+		if err := compress(msg, alg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.ContentEncoding != string(alg) || len(msg.Payload) >= len(payload) {
+			t.Errorf("compress(%q) = %d bytes with %q encoding", alg, len(msg.Payload), msg.ContentEncoding)
+		}
+		if err := decompress(msg); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg.Payload, payload) || msg.ContentEncoding != "" {
+			t.Errorf("decompress(compress(%q)) = %q with %q encoding", alg, msg.Payload, msg.ContentEncoding)
+		}
+	}
+
+	if err := compress(&common.Message{}, "br"); err == nil {
+		t.Error("compress(br) = nil, want an error")
+	}
+	msg := &common.Message{Payload: []byte("text"), ContentEncoding: "utf-8"}
+	if err := decompress(msg); err != nil || string(msg.Payload) != "text" {
+		t.Errorf("decompress(utf-8) = %v, payload %q", err, msg.Payload)
+	}
+}
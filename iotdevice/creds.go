@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"sync"
 	"time"
 
 	"github.com/goautomotive/iothub/common"
@@ -19,6 +20,7 @@ func NewSASCredentials(cs string) (transport.Credentials, error) {
 }
 
 type sasCreds struct {
+	mu    sync.RWMutex // protects creds.SharedAccessKey
 	creds *common.Credentials
 }
 
@@ -26,25 +28,55 @@ func (c *sasCreds) DeviceID() string {
 	return c.creds.DeviceID
 }
 
+func (c *sasCreds) ModuleID() string {
+	return c.creds.ModuleID
+}
+
 func (c *sasCreds) Hostname() string {
 	return c.creds.HostName
 }
 
+func (c *sasCreds) GatewayHostName() string {
+	return c.creds.GatewayHostName
+}
+
 func (c *sasCreds) IsSAS() bool {
 	return true
 }
 
 func (c *sasCreds) TLSConfig() *tls.Config {
+	serverName := c.creds.HostName
+	if c.creds.GatewayHostName != "" {
+		serverName = c.creds.GatewayHostName
+	}
 	return &tls.Config{
-		ServerName: c.creds.HostName,
+		ServerName: serverName,
 		RootCAs:    common.RootCAs(),
 	}
 }
 
 func (c *sasCreds) Token(ctx context.Context, uri string, d time.Duration) (string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	return c.creds.SAS(uri, d)
 }
 
+func (c *sasCreds) RotateKey(key string) error {
+	if err := common.ValidateKey(key); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.creds.SharedAccessKey = key
+	c.mu.Unlock()
+	return nil
+}
+
+// keyRotator is implemented by credentials
+// whose signing key can be replaced at runtime.
+type keyRotator interface {
+	RotateKey(key string) error
+}
+
 func NewX509Credentials(deviceID, hostname string, crt *tls.Certificate) (transport.Credentials, error) {
 	return &x509Creds{
 		deviceID:    deviceID,
@@ -63,10 +95,18 @@ func (c *x509Creds) DeviceID() string {
 	return c.deviceID
 }
 
+func (c *x509Creds) ModuleID() string {
+	return ""
+}
+
 func (c *x509Creds) Hostname() string {
 	return c.hostname
 }
 
+func (c *x509Creds) GatewayHostName() string {
+	return ""
+}
+
 func (c *x509Creds) IsSAS() bool {
 	return false
 }
@@ -82,3 +122,43 @@ func (c *x509Creds) TLSConfig() *tls.Config {
 func (c *x509Creds) Token(ctx context.Context, uri string, d time.Duration) (string, error) {
 	return "", errors.New("not supported")
 }
+
+// tlsCreds overrides the TLS configuration of credentials.
+type tlsCreds struct {
+	transport.Credentials
+	config *tls.Config
+}
+
+func (c *tlsCreds) TLSConfig() *tls.Config {
+	return common.MergeTLSConfig(c.config, c.Credentials.TLSConfig())
+}
+
+// gatewayCreds routes connections through a transparent gateway.
+type gatewayCreds struct {
+	transport.Credentials
+	hostname string
+}
+
+func (c *gatewayCreds) GatewayHostName() string {
+	return c.hostname
+}
+
+func (c *gatewayCreds) TLSConfig() *tls.Config {
+	tc := c.Credentials.TLSConfig().Clone()
+	tc.ServerName = c.hostname
+	return tc
+}
+
+// meteredCreds counts generated tokens.
+type meteredCreds struct {
+	transport.Credentials
+	metrics common.Metrics
+}
+
+func (c *meteredCreds) Token(ctx context.Context, uri string, d time.Duration) (string, error) {
+	token, err := c.Credentials.Token(ctx, uri, d)
+	if err == nil {
+		c.metrics.Add(common.MetricTokenRenewals, 1, deviceLabels)
+	}
+	return token, err
+}
@@ -0,0 +1,115 @@
+package iotdevice
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/goautomotive/iothub/iotdevice/transport"
+	"github.com/goautomotive/iothub/iotdevice/transport/mqtt"
+)
+
+// reauthTransport counts re-authentications and records the tokens.
+type reauthTransport struct {
+	testTransport
+	creds  transport.Credentials
+	tokens []string
+}
+
+func (tr *reauthTransport) Connect(_ context.Context, creds transport.Credentials) error {
+	tr.creds = creds
+	return nil
+}
+
+func (tr *reauthTransport) Reauthenticate(ctx context.Context) error {
+	token, err := tr.creds.Token(ctx, "test", time.Hour)
+	if err != nil {
+		return err
+	}
+	tr.tokens = append(tr.tokens, token)
+	return nil
+}
+
+func TestRotateKey(t *testing.T) {
+	t.Parallel()
+
+	creds, err := NewSASCredentials("HostName=test.azure-devices.net;DeviceId=dev;SharedAccessKey=a2V5MQ==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &reauthTransport{}
+	c, err := NewClient(WithCredentials(creds), WithTransport(tr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := c.creds.Token(context.Background(), "test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"", "not base64!"} {
+		if err := c.RotateKey(key); err == nil {
+			t.Errorf("RotateKey(%q) = nil, want an error", key)
+		}
+	}
+	if err := c.RotateKey("a2V5Mg=="); err != nil {
+		t.Fatal(err)
+	}
+	after, err := c.creds.Token(context.Background(), "test", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before == after {
+		t.Error("token is signed with the old key after rotation")
+	}
+	if len(tr.tokens) != 1 || tr.tokens[0] == before {
+		t.Errorf("re-authenticated with %v, want once with the new key", tr.tokens)
+	}
+}
+
+func TestGateway(t *testing.T) {
+	t.Parallel()
+
+	// a server certificate issued by a private CA
+	srv := httptest.NewTLSServer(nil)
+	srv.Close()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	c, err := NewClient(
+		WithConnectionString("HostName=test.azure-devices.net;DeviceId=dev;SharedAccessKey=a2V5MQ=="),
+		WithGatewayHostName("edgehub"),
+		WithTrustBundle(ca),
+		WithTransport(mqtt.New()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if c.creds.GatewayHostName() != "edgehub" || c.creds.Hostname() != "test.azure-devices.net" {
+		t.Errorf("hostnames = %q, %q, want the gateway and the hub",
+			c.creds.GatewayHostName(), c.creds.Hostname())
+	}
+	tc := c.creds.TLSConfig()
+	if tc.ServerName != "edgehub" {
+		t.Errorf("ServerName = %q, want %q", tc.ServerName, "edgehub")
+	}
+	if _, err = srv.Certificate().Verify(x509.VerifyOptions{Roots: tc.RootCAs}); err != nil {
+		t.Errorf("gateway certificate is not trusted: %s", err)
+	}
+
+	if _, err = NewClient(
+		WithConnectionString("HostName=test.azure-devices.net;DeviceId=dev;SharedAccessKey=a2V5MQ=="),
+		WithTrustBundle([]byte("garbage")),
+		WithTransport(mqtt.New()),
+	); err == nil {
+		t.Error("NewClient with a malformed trust bundle succeeded")
+	}
+}
@@ -0,0 +1,101 @@
+package edge
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/iotdevice/transport"
+)
+
+// NewCredentialsFromEnvironment is like NewCredentials
+// but it creates the client from the environment first.
+func NewCredentialsFromEnvironment(ctx context.Context) (transport.Credentials, error) {
+	env, err := EnvironmentFromOS()
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewClient(env)
+	if err != nil {
+		return nil, err
+	}
+	return NewCredentials(ctx, c)
+}
+
+// NewCredentials creates module credentials that sign SAS tokens with
+// the workload API, the trust bundle is fetched once, so the gateway's
+// server certificate issued by the Edge CA is accepted.
+//
+// Modules connect to the gateway when IOTEDGE_GATEWAYHOSTNAME is set.
+func NewCredentials(ctx context.Context, c *Client) (transport.Credentials, error) {
+	if c == nil {
+		panic("c is nil")
+	}
+	certs, err := c.TrustBundle(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pool := common.RootCAs()
+	for _, crt := range certs {
+		pool.AddCert(crt)
+	}
+	return &creds{client: c, pool: pool}, nil
+}
+
+type creds struct {
+	client *Client
+	pool   *x509.CertPool
+}
+
+func (c *creds) DeviceID() string {
+	return c.client.env.DeviceID
+}
+
+func (c *creds) ModuleID() string {
+	return c.client.env.ModuleID
+}
+
+func (c *creds) Hostname() string {
+	return c.client.env.HostName
+}
+
+func (c *creds) GatewayHostName() string {
+	return c.client.env.GatewayHostName
+}
+
+func (c *creds) IsSAS() bool {
+	return true
+}
+
+func (c *creds) TLSConfig() *tls.Config {
+	serverName := c.client.env.HostName
+	if c.client.env.GatewayHostName != "" {
+		serverName = c.client.env.GatewayHostName
+	}
+	return &tls.Config{
+		ServerName: serverName,
+		RootCAs:    c.pool,
+	}
+}
+
+// Token signs a token for the uri with the module's primary key.
+func (c *creds) Token(ctx context.Context, uri string, d time.Duration) (string, error) {
+	if d <= 0 {
+		return "", fmt.Errorf("duration %s is not positive", d)
+	}
+	se := time.Now().Add(d).Unix()
+	sig, err := c.client.Sign(ctx, "primary", []byte(fmt.Sprintf("%s\n%d", url.QueryEscape(uri), se)))
+	if err != nil {
+		return "", err
+	}
+	return (&common.SharedAccessSignature{
+		Resource:  uri,
+		Signature: base64.StdEncoding.EncodeToString(sig),
+		Expiry:    time.Unix(se, 0),
+	}).String(), nil
+}
@@ -0,0 +1,262 @@
+// Package edge implements a client of the IoT Edge workload API,
+// it signs tokens and issues certificates for modules running
+// on an Edge device, so they don't need embedded secrets.
+//
+// Modules are configured by the Edge runtime with IOTEDGE_*
+// environment variables and can be connected to their edgeHub with:
+//
+//	creds, err := edge.NewCredentialsFromEnvironment(ctx)
+//	if err != nil {
+//		return err
+//	}
+//	c, err := iotdevice.NewClient(
+//		iotdevice.WithTransport(mqtt.New()),
+//		iotdevice.WithCredentials(creds),
+//	)
+package edge
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultAPIVersion is used when IOTEDGE_APIVERSION is not set.
+const DefaultAPIVersion = "2019-01-30"
+
+// Environment is the module configuration provided by the Edge runtime.
+type Environment struct {
+	WorkloadURI     string // IOTEDGE_WORKLOADURI, unix:// or http(s)://
+	APIVersion      string // IOTEDGE_APIVERSION
+	HostName        string // IOTEDGE_IOTHUBHOSTNAME
+	GatewayHostName string // IOTEDGE_GATEWAYHOSTNAME
+	DeviceID        string // IOTEDGE_DEVICEID
+	ModuleID        string // IOTEDGE_MODULEID
+	GenerationID    string // IOTEDGE_MODULEGENERATIONID
+	AuthScheme      string // IOTEDGE_AUTHSCHEME, only sasToken is supported
+}
+
+// EnvironmentFromOS reads the module configuration
+// from environment variables and validates it.
+func EnvironmentFromOS() (*Environment, error) {
+	env := &Environment{
+		WorkloadURI:     os.Getenv("IOTEDGE_WORKLOADURI"),
+		APIVersion:      os.Getenv("IOTEDGE_APIVERSION"),
+		HostName:        os.Getenv("IOTEDGE_IOTHUBHOSTNAME"),
+		GatewayHostName: os.Getenv("IOTEDGE_GATEWAYHOSTNAME"),
+		DeviceID:        os.Getenv("IOTEDGE_DEVICEID"),
+		ModuleID:        os.Getenv("IOTEDGE_MODULEID"),
+		GenerationID:    os.Getenv("IOTEDGE_MODULEGENERATIONID"),
+		AuthScheme:      os.Getenv("IOTEDGE_AUTHSCHEME"),
+	}
+	if env.APIVersion == "" {
+		env.APIVersion = DefaultAPIVersion
+	}
+	if err := env.Validate(); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// Validate checks that all variables required
+// to authenticate the module are present.
+func (env *Environment) Validate() error {
+	for _, v := range []struct {
+		name, value string
+	}{
+		{"IOTEDGE_WORKLOADURI", env.WorkloadURI},
+		{"IOTEDGE_IOTHUBHOSTNAME", env.HostName},
+		{"IOTEDGE_DEVICEID", env.DeviceID},
+		{"IOTEDGE_MODULEID", env.ModuleID},
+		{"IOTEDGE_MODULEGENERATIONID", env.GenerationID},
+	} {
+		if v.value == "" {
+			return fmt.Errorf("edge: %s is not set", v.name)
+		}
+	}
+	if env.AuthScheme != "" && env.AuthScheme != "sasToken" {
+		return fmt.Errorf("edge: auth scheme %q is not supported", env.AuthScheme)
+	}
+	return nil
+}
+
+// Client is a workload API client, it's safe for concurrent use.
+type Client struct {
+	env  *Environment
+	base string // workload API url without the trailing slash
+	http *http.Client
+}
+
+// NewClient creates a workload API client for the module described by env.
+//
+// Unix sockets are dialed directly, http and https
+// uris are requested with the default transport.
+func NewClient(env *Environment) (*Client, error) {
+	if env == nil {
+		panic("env is nil")
+	}
+	if err := env.Validate(); err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(env.WorkloadURI)
+	if err != nil {
+		return nil, fmt.Errorf("edge: malformed workload uri: %s", err)
+	}
+	c := &Client{env: env, http: &http.Client{}}
+	switch u.Scheme {
+	case "unix":
+		path := u.Path
+		c.base = "http://workload"
+		c.http.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		}
+	case "http", "https":
+		c.base = strings.TrimSuffix(u.String(), "/")
+	default:
+		return nil, fmt.Errorf("edge: unsupported workload uri scheme %q", u.Scheme)
+	}
+	return c, nil
+}
+
+// Environment returns the module configuration the client is created for.
+func (c *Client) Environment() *Environment {
+	return c.env
+}
+
+// Sign signs data with the given key of the module using HMAC-SHA256,
+// keyID is usually "primary".
+func (c *Client) Sign(ctx context.Context, keyID string, data []byte) ([]byte, error) {
+	var res struct {
+		Digest string `json:"digest"`
+	}
+	if err := c.call(ctx, http.MethodPost, c.modulePath("sign"), map[string]string{
+		"keyId": keyID,
+		"algo":  "HMACSHA256",
+		"data":  base64.StdEncoding.EncodeToString(data),
+	}, &res); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(res.Digest)
+}
+
+// TrustBundle returns the CA certificates the Edge
+// runtime trusts, including the edgeHub's issuer.
+func (c *Client) TrustBundle(ctx context.Context) ([]*x509.Certificate, error) {
+	var res struct {
+		Certificate string `json:"certificate"`
+	}
+	if err := c.call(ctx, http.MethodGet, "/trust-bundle", nil, &res); err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	b := []byte(res.Certificate)
+	for {
+		var p *pem.Block
+		if p, b = pem.Decode(b); p == nil {
+			break
+		}
+		if p.Type != "CERTIFICATE" {
+			continue
+		}
+		crt, err := x509.ParseCertificate(p.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, crt)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("edge: trust bundle is empty")
+	}
+	return certs, nil
+}
+
+// ServerCertificate issues a server certificate for the module
+// valid until expiration, e.g. for modules that accept TLS connections.
+func (c *Client) ServerCertificate(
+	ctx context.Context, commonName string, expiration time.Time,
+) (*tls.Certificate, error) {
+	if commonName == "" {
+		return nil, errors.New("commonName is empty")
+	}
+	var res struct {
+		Certificate string `json:"certificate"`
+		PrivateKey  struct {
+			Type  string `json:"type"`
+			Bytes string `json:"bytes"`
+		} `json:"privateKey"`
+	}
+	if err := c.call(ctx, http.MethodPost, c.modulePath("certificate/server"), map[string]string{
+		"commonName": commonName,
+		"expiration": expiration.UTC().Format(time.RFC3339),
+	}, &res); err != nil {
+		return nil, err
+	}
+	if res.PrivateKey.Type != "key" {
+		return nil, fmt.Errorf("edge: private key type %q is not supported", res.PrivateKey.Type)
+	}
+	crt, err := tls.X509KeyPair([]byte(res.Certificate), []byte(res.PrivateKey.Bytes))
+	if err != nil {
+		return nil, err
+	}
+	return &crt, nil
+}
+
+func (c *Client) modulePath(elem string) string {
+	return "/modules/" + url.PathEscape(c.env.ModuleID) +
+		"/genid/" + url.PathEscape(c.env.GenerationID) + "/" + elem
+}
+
+func (c *Client) call(ctx context.Context, method, path string, req, res interface{}) error {
+	var body []byte
+	if req != nil {
+		var err error
+		if body, err = json.Marshal(req); err != nil {
+			return err
+		}
+	}
+	r, err := http.NewRequest(method,
+		c.base+path+"?api-version="+url.QueryEscape(c.env.APIVersion),
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return err
+	}
+	if req != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(r.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(b, &e) == nil && e.Message != "" {
+			return fmt.Errorf("edge: %s %s: %s", method, path, e.Message)
+		}
+		return fmt.Errorf("edge: %s %s: %s", method, path, resp.Status)
+	}
+	return json.Unmarshal(b, res)
+}
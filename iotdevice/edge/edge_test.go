@@ -0,0 +1,121 @@
+package edge
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goautomotive/iothub/common"
+)
+
+const testKey = "a2V5MQ=="
+
+func TestCredentials(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "edge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "workload.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// borrow a certificate for the trust bundle
+	ts := httptest.NewTLSServer(nil)
+	ts.Close()
+
+	srv := httptest.NewUnstartedServer(workload(t, ts.Certificate().Raw))
+	srv.Listener = l
+	srv.Start()
+	defer srv.Close()
+
+	c, err := NewClient(&Environment{
+		WorkloadURI:     "unix://" + sock,
+		APIVersion:      DefaultAPIVersion,
+		HostName:        "test.azure-devices.net",
+		GatewayHostName: "edgehub",
+		DeviceID:        "dev",
+		ModuleID:        "mod",
+		GenerationID:    "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := NewCredentials(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.TLSConfig().ServerName != "edgehub" {
+		t.Errorf("ServerName = %q, want %q", creds.TLSConfig().ServerName, "edgehub")
+	}
+
+	const uri = "test.azure-devices.net/devices/dev/modules/mod"
+	token, err := creds.Token(context.Background(), uri, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := strings.Index(token, "&se=") + 4
+	se, err := strconv.ParseInt(token[i:strings.Index(token, "&skn=")], 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sas, err := common.NewSharedAccessSignature(uri, "", testKey, time.Unix(se, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != sas.String() {
+		t.Errorf("Token() = %q, want %q", token, sas.String())
+	}
+}
+
+// workload emulates the workload API signing with testKey,
+// ca is the trust bundle.
+func workload(t *testing.T, ca []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("api-version") != DefaultAPIVersion {
+			t.Errorf("api-version = %q", r.URL.Query().Get("api-version"))
+		}
+		switch r.URL.Path {
+		case "/trust-bundle":
+			json.NewEncoder(w).Encode(map[string]string{
+				"certificate": string(pem.EncodeToMemory(&pem.Block{
+					Type:  "CERTIFICATE",
+					Bytes: ca,
+				})),
+			})
+		case "/modules/mod/genid/1/sign":
+			var v struct {
+				KeyID string `json:"keyId"`
+				Data  []byte `json:"data"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&v); err != nil || v.KeyID != "primary" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"message": "bad request"})
+				return
+			}
+			key, _ := base64.StdEncoding.DecodeString(testKey)
+			h := hmac.New(sha256.New, key)
+			h.Write(v.Data)
+			json.NewEncoder(w).Encode(map[string][]byte{"digest": h.Sum(nil)})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+}
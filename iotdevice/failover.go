@@ -0,0 +1,135 @@
+package iotdevice
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/iotdevice/transport"
+)
+
+// Provisioner discovers the hub the device is currently assigned to,
+// usually it registers the device with the Device Provisioning Service.
+type Provisioner func(ctx context.Context) (hostname string, err error)
+
+// WithProvisioner makes the client re-run provisioning when the hub refuses
+// the connection, e.g. after the device is reassigned to another hub or
+// the hub fails over, and move the connection to the hub it returns.
+//
+// The transport has to implement `transport.Redirector`.
+func WithProvisioner(fn Provisioner) ClientOption {
+	if fn == nil {
+		panic("fn is nil")
+	}
+	return func(c *Client) error {
+		c.provision = fn
+		return nil
+	}
+}
+
+// WithHostnameChangeHandler registers fn that is called when
+// the device is moved to another hub, see WithProvisioner.
+func WithHostnameChangeHandler(fn func(old, new string)) ClientOption {
+	if fn == nil {
+		panic("fn is nil")
+	}
+	return func(c *Client) error {
+		c.onHost = fn
+		return nil
+	}
+}
+
+// Hostname returns the hostname of the hub the client connects to.
+func (c *Client) Hostname() string {
+	return c.creds.Hostname()
+}
+
+// failover re-provisions the device when a reconnect is refused by the hub
+// and redirects the connection when it's assigned to another one.
+func (c *Client) failover() {
+	if !atomic.CompareAndSwapUint32(&c.moving, 0, 1) {
+		return
+	}
+	defer atomic.StoreUint32(&c.moving, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	go func() {
+		select {
+		case <-c.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	moved, err := c.reprovision(ctx)
+	if err != nil {
+		c.logf(common.LevelError, common.ComponentTransport, "provisioning error: %s", err)
+		return
+	}
+	if !moved {
+		return
+	}
+	if err = c.tr.(transport.Redirector).Redirect(ctx, c.creds); err != nil {
+		// the transport keeps reconnecting to the new hub
+		c.logf(common.LevelWarn, common.ComponentTransport, "redirect error: %s", err)
+	}
+}
+
+// reprovision runs the provisioner and switches credentials
+// to the returned hub, moved is false when it's the same one.
+func (c *Client) reprovision(ctx context.Context) (moved bool, err error) {
+	hostname, err := c.provision(ctx)
+	if err != nil {
+		return false, err
+	}
+	if hostname == "" {
+		return false, errors.New("provisioner returned a blank hostname")
+	}
+	old := c.creds.Hostname()
+	if hostname == old {
+		return false, nil
+	}
+	c.host.set(hostname)
+	c.logf(common.LevelInfo, common.ComponentTransport, "device is moved from %s to %s", old, hostname)
+	if c.onHost != nil {
+		c.onHost(old, hostname)
+	}
+	return true, nil
+}
+
+// hostCreds overrides the hostname of credentials once it's set.
+type hostCreds struct {
+	transport.Credentials
+	mu       sync.RWMutex
+	hostname string
+}
+
+func (c *hostCreds) set(hostname string) {
+	c.mu.Lock()
+	c.hostname = hostname
+	c.mu.Unlock()
+}
+
+func (c *hostCreds) Hostname() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.hostname == "" {
+		return c.Credentials.Hostname()
+	}
+	return c.hostname
+}
+
+func (c *hostCreds) TLSConfig() *tls.Config {
+	tc := c.Credentials.TLSConfig()
+	if c.GatewayHostName() != "" {
+		return tc
+	}
+	tc = tc.Clone()
+	tc.ServerName = c.Hostname()
+	return tc
+}
@@ -0,0 +1,100 @@
+package iotdevice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/iotdevice/transport"
+)
+
+// redirectTransport refuses connections to hubs the device isn't assigned to.
+type redirectTransport struct {
+	testTransport
+	hub   string
+	hosts chan string // hostnames of redirects
+}
+
+func (tr *redirectTransport) Connect(_ context.Context, creds transport.Credentials) error {
+	if creds.Hostname() != tr.hub {
+		return fmt.Errorf("%s: %w", creds.Hostname(), common.ErrUnauthorized)
+	}
+	return nil
+}
+
+func (tr *redirectTransport) Redirect(_ context.Context, creds transport.Credentials) error {
+	tr.hosts <- creds.Hostname() + " " + creds.TLSConfig().ServerName
+	return nil
+}
+
+func TestFailover(t *testing.T) {
+	t.Parallel()
+
+	tr := &redirectTransport{hub: "b.azure-devices.net", hosts: make(chan string, 1)}
+	changes := make(chan [2]string, 2)
+	c, err := NewClient(
+		WithTransport(tr),
+		WithConnectionString("HostName=a.azure-devices.net;DeviceId=dev;SharedAccessKey=a2V5"),
+		WithProvisioner(func(ctx context.Context) (string, error) {
+			return tr.hub, nil
+		}),
+		WithHostnameChangeHandler(func(old, new string) {
+			changes <- [2]string{old, new}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the device was reassigned while it was offline
+	if err = c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if g, w := c.Hostname(), "b.azure-devices.net"; g != w {
+		t.Errorf("Hostname() = %q, want %q", g, w)
+	}
+	if g, w := <-changes, [2]string{"a.azure-devices.net", "b.azure-devices.net"}; g != w {
+		t.Errorf("hostname change = %v, want %v", g, w)
+	}
+
+	// the live connection is moved after a refused reconnect
+	tr.hub = "c.azure-devices.net"
+	c.csMux.Dispatch(transport.ConnectionDisconnected, common.ErrUnauthorized)
+	select {
+	case g := <-tr.hosts:
+		if w := "c.azure-devices.net c.azure-devices.net"; g != w {
+			t.Errorf("redirected to %q, want %q", g, w)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection is not redirected")
+	}
+	if g, w := <-changes, [2]string{"b.azure-devices.net", "c.azure-devices.net"}; g != w {
+		t.Errorf("hostname change = %v, want %v", g, w)
+	}
+
+	// plain disconnects don't trigger provisioning
+	c.csMux.Dispatch(transport.ConnectionDisconnected, errors.New("EOF"))
+	select {
+	case g := <-tr.hosts:
+		t.Errorf("redirected to %q on a plain disconnect", g)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestFailoverNotSupported(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewClient(
+		WithTransport(&testTransport{}),
+		WithConnectionString(testConnString),
+		WithProvisioner(func(ctx context.Context) (string, error) {
+			return "", nil
+		}),
+	); err == nil {
+		t.Error("NewClient() with a provisioner = nil error, want an error")
+	}
+}
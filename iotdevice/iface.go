@@ -0,0 +1,20 @@
+package iotdevice
+
+import "context"
+
+// Sender sends device-to-cloud messages, applications can depend
+// on it instead of *Client to use a mock in tests, see iothubtest.
+type Sender interface {
+	SendEvent(ctx context.Context, payload []byte, opts ...SendOption) error
+}
+
+// TwinClient retrieves and updates the device twin state.
+type TwinClient interface {
+	RetrieveTwinState(ctx context.Context) (desired TwinState, reported TwinState, err error)
+	UpdateTwinState(ctx context.Context, s TwinState) (int, error)
+}
+
+var (
+	_ Sender     = (*Client)(nil)
+	_ TwinClient = (*Client)(nil)
+)
@@ -1,13 +1,17 @@
 package iotdevice
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/iotdevice/transport"
 )
 
 // once is like sync.Once but if fn returns an error it's considered
@@ -31,66 +35,561 @@ func once(i *uint32, mu *sync.RWMutex, fn func() error) error {
 	return nil
 }
 
-type eventsMux struct {
+// subscription is a mux subscription of any kind.
+type subscription interface {
+	comparable
+
+	// shutdown makes the subscription fail with err
+	// and closes its channel when the mux is closed.
+	shutdown(err error)
+}
+
+// subList is a list of subscriptions, it's not safe
+// for concurrent use so it's guarded by the mux's mutex.
+type subList[S subscription] []S
+
+func (l *subList[S]) add(s S) {
+	*l = append(*l, s)
+}
+
+// remove removes s from the list, ok is false when it's not there,
+// e.g. the mux is already closed.
+func (l *subList[S]) remove(s S) (ok bool) {
+	for i, ss := range *l {
+		if ss == s {
+			*l = append((*l)[:i], (*l)[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// shutdown shuts down and removes all subscriptions.
+func (l *subList[S]) shutdown(err error) {
+	for _, s := range *l {
+		s.shutdown(err)
+	}
+	*l = (*l)[0:0]
+}
+
+// mux holds subscriptions of one kind, dispatchers embed it.
+type mux[S subscription] struct {
 	on   uint32
 	mu   sync.RWMutex
-	subs []*EventSub
-	done chan struct{}
+	subs subList[S]
 }
 
-func (m *eventsMux) once(fn func() error) error {
+func (m *mux[S]) once(fn func() error) error {
 	return once(&m.on, &m.mu, fn)
 }
 
+// close closes all subscriptions, they fail with ErrClosed.
+func (m *mux[S]) close() {
+	m.mu.Lock()
+	m.subs.shutdown(ErrClosed)
+	m.mu.Unlock()
+}
+
+// outbox delivers values to a subscription channel in order from
+// a single goroutine, that's the only one sending on the channel and
+// closing it, so closing never races with sending and slow consumers
+// don't make muxes spawn goroutines per value.
+type outbox[T any] struct {
+	ch     chan T
+	mu     sync.Mutex
+	queue  []T
+	notify chan struct{}
+	stop   chan struct{}
+	once   sync.Once
+}
+
+// newOutbox starts delivering to ch.
+func newOutbox[T any](ch chan T) *outbox[T] {
+	o := &outbox[T]{
+		ch:     ch,
+		notify: make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+	}
+	go o.run()
+	return o
+}
+
+// push queues v for delivery, it's a no-op once the outbox is closed.
+func (o *outbox[T]) push(v T) {
+	o.mu.Lock()
+	select {
+	case <-o.stop:
+		o.mu.Unlock()
+		return
+	default:
+	}
+	o.queue = append(o.queue, v)
+	o.mu.Unlock()
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+}
+
+// close stops delivering, queued values that fit into the channel
+// buffer are still delivered and then the channel is closed.
+func (o *outbox[T]) close() {
+	o.once.Do(func() {
+		o.mu.Lock()
+		close(o.stop)
+		o.mu.Unlock()
+	})
+}
+
+func (o *outbox[T]) run() {
+	defer close(o.ch)
+	var zero T
+	for {
+		o.mu.Lock()
+		if len(o.queue) == 0 {
+			o.mu.Unlock()
+			select {
+			case <-o.notify:
+				continue
+			case <-o.stop:
+				return
+			}
+		}
+		v := o.queue[0]
+		o.queue[0] = zero
+		o.queue = o.queue[1:]
+		o.mu.Unlock()
+
+		select {
+		case o.ch <- v:
+		case <-o.stop:
+			o.flush(v)
+			return
+		}
+	}
+}
+
+// flush delivers v and the rest of the queue without blocking.
+func (o *outbox[T]) flush(v T) {
+	select {
+	case o.ch <- v:
+	default:
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, v := range o.queue {
+		select {
+		case o.ch <- v:
+		default:
+			return
+		}
+	}
+}
+
+// Sub is a subscription to values of type T delivered in order,
+// it's what subscriptions of all kinds but events are built on.
+type Sub[T any] struct {
+	ch   chan T
+	err  error
+	out  *outbox[T]
+	quit chan struct{} // closed on unsubscribe
+	once sync.Once
+}
+
+// init makes the channel of the given capacity and starts delivering.
+func (s *Sub[T]) init(size int) {
+	s.ch = make(chan T, size)
+	s.quit = make(chan struct{})
+	s.out = newOutbox(s.ch)
+}
+
+// C returns the channel values are delivered to,
+// it's closed when the subscription or the client is closed.
+func (s *Sub[T]) C() <-chan T {
+	return s.ch
+}
+
+// Err is the reason the channel is closed, nil when it's unsubscribed.
+func (s *Sub[T]) Err() error {
+	return s.err
+}
+
+// Recv waits for the next value until ctx is done, it returns
+// ErrClosed when the subscription or the client is closed.
+func (s *Sub[T]) Recv(ctx context.Context) (T, error) {
+	var zero T
+	select {
+	case v, ok := <-s.ch:
+		if !ok {
+			return zero, closedErr(s.err)
+		}
+		return v, nil
+	case <-s.quit:
+		return zero, ErrClosed
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
+
+func (s *Sub[T]) shutdown(err error) {
+	s.err = err
+	s.out.close()
+}
+
+// cancel stops delivering and closes the channel when it's unsubscribed.
+func (s *Sub[T]) cancel() {
+	s.once.Do(func() {
+		close(s.quit)
+	})
+	s.out.close()
+}
+
+type eventsMux struct {
+	mux[*EventSub]
+	done    chan struct{}
+	metrics common.Metrics
+	onErr   func(err error) // decompression errors handler
+
+	validator Validator                  // nil when inbound messages are not validated
+	onInvalid func(err *ValidationError) // invalid messages handler
+
+	seq     int                   // subscriptions counter for default names
+	slowAge time.Duration         // slow subscribers detection threshold, disabled when zero
+	onSlow  func(*SlowSubscriber) // slow subscribers handler, can be nil
+}
+
+// deviceLabels are labels of all metrics reported by the device client.
+var deviceLabels = map[string]string{"client": "device"}
+
 func (m *eventsMux) Dispatch(msg *common.Message) {
+	// undecodable messages are delivered as is
+	if err := decompress(msg); err != nil && m.onErr != nil {
+		m.onErr(err)
+	}
+	if m.validator != nil {
+		if err := m.validator.Validate(msg); err != nil {
+			if m.onInvalid != nil {
+				m.onInvalid(&ValidationError{Message: msg, Inbound: true, Err: err})
+			}
+			return
+		}
+	}
+
+	var lag int
+	var stalled time.Duration
+	var slow []*SlowSubscriber
+	now := time.Now()
 	m.mu.RLock()
 	for _, sub := range m.subs {
-		select {
-		case sub.ch <- msg:
-		default:
-			go func() {
-				select {
-				case sub.ch <- msg:
-				case <-m.done:
-				}
-			}()
+		// a subscription is stalled when it's still full on arrival
+		if m.slowAge > 0 {
+			d, r := sub.stall(now, m.slowAge)
+			if d > stalled {
+				stalled = d
+			}
+			if r != nil {
+				slow = append(slow, r)
+			}
+		}
+		sub.deliver(msg, m.done)
+		if n := sub.lag(); n > lag {
+			lag = n
 		}
 	}
 	m.mu.RUnlock()
+	if m.metrics != nil {
+		m.metrics.Add(common.MetricMessagesReceived, 1, deviceLabels)
+		m.metrics.Set(common.MetricSubscriberLag, float64(lag), deviceLabels)
+		if m.slowAge > 0 {
+			m.metrics.Set(common.MetricSubscriberStalledSeconds, stalled.Seconds(), deviceLabels)
+		}
+	}
+
+	// handlers are free to subscribe and unsubscribe
+	for _, r := range slow {
+		if m.metrics != nil {
+			m.metrics.Add(common.MetricSlowSubscribers, 1, map[string]string{
+				"client":     "device",
+				"subscriber": r.Name,
+			})
+		}
+		if m.onSlow != nil {
+			m.onSlow(r)
+		}
+	}
 }
 
-func (m *eventsMux) sub() *EventSub {
-	s := &EventSub{ch: make(chan *common.Message, 10)}
-	m.mu.Lock()
-	m.subs = append(m.subs, s)
-	m.mu.Unlock()
-	return s
+// SlowSubscriber describes an events subscription that doesn't
+// keep up with incoming messages, see WithSlowSubscriberHandler.
+type SlowSubscriber struct {
+	// Name identifies the subscription, see WithSubscriberName.
+	Name string
+
+	// Depth is the number of messages waiting to be consumed.
+	Depth int
+
+	// OldestAge is how long the subscription buffer has been full,
+	// the oldest waiting message has been there at least that long.
+	OldestAge time.Duration
 }
 
-func (m *eventsMux) unsub(s *EventSub) {
-	m.mu.Lock()
-	for i, ss := range m.subs {
-		if ss == s {
-			m.subs = append(m.subs[:i], m.subs[i+1:]...)
-			break
+// WithSlowSubscriberHandler reports events subscriptions which buffer
+// stays full longer than threshold to fn, at most once per threshold
+// for each subscription, fn can be nil when only metrics are needed.
+//
+// Subscriptions are checked when messages are dispatched, so fn is
+// called from the transport's goroutine and it shouldn't block.
+func WithSlowSubscriberHandler(threshold time.Duration, fn func(s *SlowSubscriber)) ClientOption {
+	if threshold <= 0 {
+		panic("threshold must be positive")
+	}
+	return func(c *Client) error {
+		c.evMux.slowAge = threshold
+		c.evMux.onSlow = fn
+		return nil
+	}
+}
+
+// sub subscribes to events, opts are validated
+// together since they depend on each other.
+func (m *eventsMux) sub(opts ...SubscribeOption) (*EventSub, error) {
+	s := &EventSub{
+		mux:     m,
+		size:    10,
+		backlog: DefaultBacklog,
+		quit:    make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	// dropping the oldest message never makes room in an unbuffered
+	// channel, dropping the newest one discards almost every message
+	// and blocking on zero slots of ordered delivery never ends
+	if s.bounded && s.size < 1 {
+		return nil, errors.New("overflow policies require buffer size of at least 1")
+	}
+	switch {
+	case s.ordered:
+		// the deque holds buffered messages instead of the channel
+		s.ch = make(chan *common.Message)
+		if s.bounded {
+			s.slots = make(chan struct{}, s.size)
 		}
+		s.notify = make(chan struct{}, 1)
+		s.stop = make(chan struct{})
+		go s.pump(m.done)
+	case !s.bounded:
+		// the deque holds the backlog overflowing the channel
+		s.ch = make(chan *common.Message, s.size)
+		s.notify = make(chan struct{}, 1)
+		s.stop = make(chan struct{})
+		go s.pump(m.done)
+	default:
+		s.ch = make(chan *common.Message, s.size)
 	}
+	m.mu.Lock()
+	m.seq++
+	if s.name == "" {
+		s.name = fmt.Sprintf("events-%d", m.seq)
+	}
+	m.subs.add(s)
 	m.mu.Unlock()
+	return s, nil
 }
 
-func (m *eventsMux) close(err error) {
+// unsub removes the subscription and closes its channel.
+func (m *eventsMux) unsub(s *EventSub) {
+	// unblock dispatching to the subscription first
+	s.once.Do(func() {
+		close(s.quit)
+	})
 	m.mu.Lock()
-	for _, s := range m.subs {
-		s.err = ErrClosed
+	// the pump closes the channel itself, the mux isn't
+	// dispatching to the subscription while it's locked
+	if m.subs.remove(s) && s.stop == nil {
 		close(s.ch)
 	}
-	m.subs = m.subs[0:0]
 	m.mu.Unlock()
 }
 
+// SubscribeOption is an events subscription option.
+type SubscribeOption func(s *EventSub)
+
+// WithSubscriberName names the subscription in slow subscribers reports,
+// subscriptions are named `events-{n}` in the subscribing order by default.
+func WithSubscriberName(name string) SubscribeOption {
+	return func(s *EventSub) {
+		s.name = name
+	}
+}
+
+// WithBuffer sets the subscription channel capacity, defaults to 10.
+func WithBuffer(n int) SubscribeOption {
+	if n < 0 {
+		panic("buffer size is negative")
+	}
+	return func(s *EventSub) {
+		s.size = n
+	}
+}
+
+// DefaultBacklog is the default number of messages held
+// in the background when the subscription buffer is full.
+const DefaultBacklog = 1000
+
+// WithBacklog sets how many messages are held in the background when
+// the subscription buffer is full and there's no overflow policy,
+// messages exceeding it are dropped, defaults to DefaultBacklog.
+func WithBacklog(n int) SubscribeOption {
+	if n < 0 {
+		panic("backlog size is negative")
+	}
+	return func(s *EventSub) {
+		s.backlog = n
+	}
+}
+
+// WithOverflowPolicy sets what happens to messages when the subscription
+// buffer is full: DropOldest and DropNewest discard messages and Block
+// makes the transport wait until the consumer catches up, which delays
+// all other incoming messages including twin and methods ones.
+//
+// By default messages are held in the background in order until there's
+// room, up to WithBacklog messages, newer ones are dropped.
+//
+// Overflow policies require WithBuffer of at least 1, subscribing fails otherwise.
+func WithOverflowPolicy(p DropPolicy) SubscribeOption {
+	return func(s *EventSub) {
+		s.policy = p
+		s.bounded = true
+	}
+}
+
+// WithOrderedDelivery guarantees messages are received in the order they
+// arrive even when the consumer falls behind, they're buffered in a deque
+// of the WithBuffer size and WithOverflowPolicy applies when it's full.
+//
+// Without overflow policy the deque holds up to WithBuffer plus
+// WithBacklog messages, newer ones are dropped.
+func WithOrderedDelivery() SubscribeOption {
+	return func(s *EventSub) {
+		s.ordered = true
+	}
+}
+
 type EventSub struct {
-	ch  chan *common.Message
-	err error
+	dropped uint64 // first for 64-bit alignment
+
+	ch   chan *common.Message
+	err  error
+	mux  *eventsMux
+	name string
+
+	size    int        // channel capacity
+	backlog int        // background queue limit without overflow policy
+	policy  DropPolicy // applied only when bounded is true
+	bounded bool
+	quit    chan struct{} // closed on unsubscribe
+	once    sync.Once
+
+	// ordered delivery and backlog, nil stop means there's no pump
+	ordered  bool
+	mu       sync.Mutex
+	deque    []*common.Message
+	inflight bool          // the pump is delivering a message taken off the deque
+	closed   bool          // the pump has closed the channel
+	full     time.Time     // when the buffer became full, zero when there's room
+	reported time.Time     // last time the subscription was reported as slow
+	slots    chan struct{} // taken by every queued message, bounded mode only
+	notify   chan struct{} // signals the pump about new messages
+	stop     chan struct{} // closed when the mux is closed
+
+	settler transport.Settler // nil when settlement is not supported
+}
+
+// deliver sends msg to the subscription according to its overflow policy.
+func (s *EventSub) deliver(msg *common.Message, done chan struct{}) {
+	if s.ordered {
+		s.enqueue(msg, done)
+		return
+	}
+	if !s.bounded {
+		s.hold(msg)
+		return
+	}
+	select {
+	case s.ch <- msg:
+		return
+	default:
+	}
+
+	switch s.policy {
+	case DropNewest:
+		s.drop()
+	case DropOldest:
+		for {
+			select {
+			case s.ch <- msg:
+				return
+			default:
+			}
+			select {
+			case <-s.ch:
+				s.drop()
+			default:
+			}
+		}
+	case Block:
+		select {
+		case s.ch <- msg:
+		case <-done:
+		case <-s.quit:
+		}
+	}
+}
+
+// hold sends msg to the channel if there's room and no backlog,
+// otherwise it's put into the backlog the pump delivers in order.
+func (s *EventSub) hold(msg *common.Message) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	if len(s.deque) == 0 && !s.inflight {
+		select {
+		case s.ch <- msg:
+			s.mu.Unlock()
+			return
+		default:
+		}
+	}
+	if len(s.deque) >= s.backlog {
+		s.mu.Unlock()
+		s.drop()
+		return
+	}
+	s.deque = append(s.deque, msg)
+	s.mu.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// drop counts a discarded message.
+func (s *EventSub) drop() {
+	atomic.AddUint64(&s.dropped, 1)
+	if s.mux.metrics != nil {
+		s.mux.metrics.Add(common.MetricMessagesDropped, 1, deviceLabels)
+	}
+}
+
+// Dropped is the number of messages discarded because
+// the subscriber couldn't keep up with them.
+func (s *EventSub) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
 }
 
 func (s *EventSub) C() <-chan *common.Message {
@@ -101,87 +600,438 @@ func (s *EventSub) Err() error {
 	return s.err
 }
 
-type twinStateMux struct {
-	on   uint32
-	mu   sync.RWMutex
-	subs []*TwinStateSub
-	done chan struct{}
+func (s *EventSub) shutdown(err error) {
+	s.err = err
+	if s.stop != nil {
+		close(s.stop) // the pump goroutine closes the channel
+		return
+	}
+	close(s.ch)
 }
 
-func (m *twinStateMux) once(fn func() error) error {
-	return once(&m.on, &m.mu, fn)
+// Recv waits for the next message until ctx is done, it returns
+// ErrClosed when the subscription or the client is closed.
+func (s *EventSub) Recv(ctx context.Context) (*common.Message, error) {
+	select {
+	case msg, ok := <-s.ch:
+		if !ok {
+			return nil, closedErr(s.err)
+		}
+		return msg, nil
+	case <-s.quit:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
-func (m *twinStateMux) Dispatch(b []byte) {
-	var v TwinState
-	if err := json.Unmarshal(b, &v); err != nil {
-		log.Printf("unmarshal error: %s", err) // TODO
-		return
+// Close unsubscribes and discards buffered messages,
+// it's same as calling the client's UnsubscribeEvents.
+func (s *EventSub) Close() error {
+	s.mux.unsub(s)
+	for {
+		select {
+		case _, ok := <-s.ch:
+			if !ok {
+				return nil
+			}
+		default:
+			return nil
+		}
 	}
+}
 
-	m.mu.RLock()
-	for _, sub := range m.subs {
+// Name returns the subscription name, see WithSubscriberName.
+func (s *EventSub) Name() string {
+	return s.name
+}
+
+// stall returns how long the buffer has been full and a report
+// when it's been full longer than threshold and not reported recently.
+func (s *EventSub) stall(now time.Time, threshold time.Duration) (time.Duration, *SlowSubscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var full bool
+	if s.ordered {
+		full = len(s.deque) != 0 && len(s.deque) >= s.size
+	} else {
+		full = len(s.deque) != 0 || cap(s.ch) != 0 && len(s.ch) == cap(s.ch)
+	}
+	if !full {
+		s.full = time.Time{}
+		return 0, nil
+	}
+	if s.full.IsZero() {
+		s.full = now
+	}
+	d := now.Sub(s.full)
+	if d < threshold || now.Sub(s.reported) < threshold {
+		return d, nil
+	}
+	s.reported = now
+	return d, &SlowSubscriber{
+		Name:      s.name,
+		Depth:     len(s.ch) + len(s.deque),
+		OldestAge: d,
+	}
+}
+
+// lag is the number of messages waiting to be consumed.
+func (s *EventSub) lag() int {
+	n := len(s.ch)
+	if s.stop != nil {
+		s.mu.Lock()
+		n += len(s.deque)
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// enqueue appends msg to the deque of the ordered subscription.
+func (s *EventSub) enqueue(msg *common.Message, done chan struct{}) {
+	if s.bounded {
 		select {
-		case sub.ch <- v:
+		case s.slots <- struct{}{}:
 		default:
-			go func() {
+			switch s.policy {
+			case DropNewest:
+				s.drop()
+				return
+			case DropOldest:
+				// reuse the slot of the oldest message if it's not
+				// being delivered at the moment, drop msg otherwise
+				s.drop()
+				s.mu.Lock()
+				if len(s.deque) == 0 {
+					s.mu.Unlock()
+					return
+				}
+				s.deque = append(s.deque[1:], msg)
+				s.mu.Unlock()
+				return
+			case Block:
 				select {
-				case sub.ch <- v:
-				case <-m.done:
+				case s.slots <- struct{}{}:
+				case <-done:
+					return
+				case <-s.quit:
+					return
+				case <-s.stop:
+					return
 				}
-			}()
+			}
 		}
 	}
+	s.mu.Lock()
+	if !s.bounded && len(s.deque) >= s.size+s.backlog {
+		s.mu.Unlock()
+		s.drop()
+		return
+	}
+	s.deque = append(s.deque, msg)
+	s.mu.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// pump moves messages from the deque to the channel one by one,
+// it closes the channel when returns so hold never sends on it after.
+func (s *EventSub) pump(done chan struct{}) {
+	defer func() {
+		s.mu.Lock()
+		s.closed = true
+		close(s.ch)
+		s.mu.Unlock()
+	}()
+	for {
+		s.mu.Lock()
+		if len(s.deque) == 0 {
+			s.mu.Unlock()
+			select {
+			case <-s.notify:
+				continue
+			case <-done:
+			case <-s.quit:
+			case <-s.stop:
+			}
+			return
+		}
+		msg := s.deque[0]
+		s.deque[0] = nil
+		s.deque = s.deque[1:]
+		s.inflight = true
+		s.mu.Unlock()
+
+		select {
+		case s.ch <- msg:
+		case <-done:
+			return
+		case <-s.quit:
+			return
+		case <-s.stop:
+			return
+		}
+		s.mu.Lock()
+		s.inflight = false
+		s.mu.Unlock()
+		if s.slots != nil {
+			<-s.slots
+		}
+	}
+}
+
+// ErrSettlementNotSupported is returned when the transport
+// doesn't support explicit messages settlement, e.g. MQTT.
+var ErrSettlementNotSupported = errors.New("messages settlement is not supported by the transport")
+
+// Complete completes the given message received from the subscription,
+// so the hub removes it from the device queue.
+func (s *EventSub) Complete(ctx context.Context, msg *common.Message) error {
+	return s.settle(ctx, msg, transport.SettleComplete)
+}
+
+// Reject rejects the given message, the hub doesn't try to deliver it again.
+func (s *EventSub) Reject(ctx context.Context, msg *common.Message) error {
+	return s.settle(ctx, msg, transport.SettleReject)
+}
+
+// Abandon abandons the given message, so the hub delivers it again later.
+func (s *EventSub) Abandon(ctx context.Context, msg *common.Message) error {
+	return s.settle(ctx, msg, transport.SettleAbandon)
+}
+
+func (s *EventSub) settle(ctx context.Context, msg *common.Message, v transport.Settlement) error {
+	if msg == nil {
+		panic("msg is nil")
+	}
+	if s.settler == nil {
+		return ErrSettlementNotSupported
+	}
+	return s.settler.Settle(ctx, msg, v)
+}
+
+type twinStateMux struct {
+	mux[*TwinStateSub]
+	tsubs subList[*TypedTwinStateSub]
+	onErr DispatchErrorHandler
+}
+
+// onError sets the dispatch error handler.
+func (m *twinStateMux) onError(fn DispatchErrorHandler) {
+	m.mu.Lock()
+	m.onErr = fn
+	m.mu.Unlock()
+}
+
+func (m *twinStateMux) Dispatch(b []byte) {
+	// handlers are called without holding the lock,
+	// so they're free to subscribe and unsubscribe
+	m.mu.RLock()
+	tsubs := append([]*TypedTwinStateSub(nil), m.tsubs...)
+	subs := append([]*TwinStateSub(nil), m.subs...)
+	onErr := m.onErr
 	m.mu.RUnlock()
+	fail := func(err error) {
+		if onErr != nil {
+			onErr(err, b)
+		}
+	}
+
+	// every typed subscription needs its own value
+	for _, sub := range tsubs {
+		v := sub.fn()
+		if err := json.Unmarshal(b, v); err != nil {
+			fail(err)
+			continue
+		}
+		sub.out.push(v)
+	}
+	if len(subs) == 0 {
+		return
+	}
+
+	var v TwinState
+	if err := json.Unmarshal(b, &v); err != nil {
+		fail(err)
+		return
+	}
+	for _, sub := range subs {
+		sub.deliver(v)
+	}
 }
 
-func (m *twinStateMux) sub() *TwinStateSub {
-	s := &TwinStateSub{ch: make(chan TwinState, 10)}
+// sub subscribes to desired state changes, held subscriptions
+// keep them until they're released with the initial state.
+func (m *twinStateMux) sub(hold bool) *TwinStateSub {
+	s := &TwinStateSub{mux: m, hold: hold}
+	s.init(10)
 	m.mu.Lock()
-	m.subs = append(m.subs, s)
+	m.subs.add(s)
 	m.mu.Unlock()
 	return s
 }
 
+// unsub removes the subscription and closes its channel.
 func (m *twinStateMux) unsub(s *TwinStateSub) {
 	m.mu.Lock()
-	for i, ss := range m.subs {
-		if ss == s {
-			m.subs = append(m.subs[:i], m.subs[i+1:]...)
-			break
-		}
-	}
+	m.subs.remove(s)
 	m.mu.Unlock()
+	s.cancel()
 }
 
-func (m *twinStateMux) close(err error) {
+func (m *twinStateMux) typedSub(fn func() interface{}) *TypedTwinStateSub {
+	s := &TypedTwinStateSub{fn: fn}
+	s.init(10)
 	m.mu.Lock()
-	for _, s := range m.subs {
-		s.err = ErrClosed
-		close(s.ch)
-	}
-	m.subs = m.subs[0:0]
+	m.tsubs.add(s)
 	m.mu.Unlock()
+	return s
+}
+
+// typedUnsub removes the subscription and closes its channel.
+func (m *twinStateMux) typedUnsub(s *TypedTwinStateSub) {
+	m.mu.Lock()
+	m.tsubs.remove(s)
+	m.mu.Unlock()
+	s.cancel()
 }
 
+func (m *twinStateMux) close() {
+	m.mu.Lock()
+	m.subs.shutdown(ErrClosed)
+	m.tsubs.shutdown(ErrClosed)
+	m.mu.Unlock()
+}
+
+// TwinStateSub receives desired state changes.
 type TwinStateSub struct {
-	ch  chan TwinState
-	err error
+	Sub[TwinState]
+	mux *twinStateMux
+
+	mu   sync.Mutex
+	hold bool        // changes are held until the initial state is delivered
+	held []TwinState // changes received before the initial state
 }
 
-func (s *TwinStateSub) C() <-chan TwinState {
-	return s.ch
+// deliver sends v to the subscription without blocking the mux.
+func (s *TwinStateSub) deliver(v TwinState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hold {
+		s.held = append(s.held, v)
+		return
+	}
+	s.out.push(v)
 }
 
-func (s *TwinStateSub) Err() error {
-	return s.err
+// release delivers the initial desired state followed by changes
+// received in the meantime that are newer than the state.
+func (s *TwinStateSub) release(initial TwinState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.out.push(initial)
+	for _, v := range s.held {
+		if v.Version() > initial.Version() {
+			s.out.push(v)
+		}
+	}
+	s.hold, s.held = false, nil
+}
+
+// Close unsubscribes and discards buffered state changes,
+// it's same as calling the client's UnsubscribeTwinUpdates.
+func (s *TwinStateSub) Close() error {
+	s.mux.unsub(s)
+	for {
+		select {
+		case _, ok := <-s.ch:
+			if !ok {
+				return nil
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// TypedTwinStateSub receives desired state changes
+// unmarshaled into values of the user-defined type.
+type TypedTwinStateSub struct {
+	Sub[interface{}]
+	fn func() interface{}
+}
+
+type connStateMux struct {
+	mux[*ConnectionStateSub]
+	hook func(state transport.ConnectionState, err error) // called before subscribers
+}
+
+func (m *connStateMux) Dispatch(state transport.ConnectionState, err error) {
+	if m.hook != nil {
+		m.hook(state, err)
+	}
+	v := &ConnectionStateChange{State: state, Err: err}
+
+	m.mu.RLock()
+	for _, sub := range m.subs {
+		sub.out.push(v)
+	}
+	m.mu.RUnlock()
 }
 
+func (m *connStateMux) sub() *ConnectionStateSub {
+	s := &ConnectionStateSub{}
+	s.init(10)
+	m.mu.Lock()
+	m.subs.add(s)
+	m.mu.Unlock()
+	return s
+}
+
+// unsub removes the subscription and closes its channel.
+func (m *connStateMux) unsub(s *ConnectionStateSub) {
+	m.mu.Lock()
+	m.subs.remove(s)
+	m.mu.Unlock()
+	s.cancel()
+}
+
+// ConnectionStateChange is a transport connection state transition.
+type ConnectionStateChange struct {
+	State transport.ConnectionState
+	Err   error // cause of the change, can be nil
+}
+
+// ConnectionStateSub receives connection state changes.
+type ConnectionStateSub = Sub[*ConnectionStateChange]
+
+// closedErr is the error of reading from a closed subscription channel,
+// err is nil when the subscription is closed by unsubscribing.
+func closedErr(err error) error {
+	if err == nil {
+		return ErrClosed
+	}
+	return err
+}
+
+// methodLabels are labels of direct methods dispatching metrics.
+var methodLabels = map[string]string{"client": "device", "kind": "method"}
+
 // methodMux is direct-methods dispatcher.
 type methodMux struct {
-	on uint32
-	mu sync.RWMutex
-	m  map[string]DirectMethodHandler
+	on      uint32
+	mu      sync.RWMutex
+	m       map[string]RawMethodHandler
+	df      RawMethodHandler // handles unregistered methods
+	tracer  common.Tracer
+	metrics common.Metrics
+	mw      []MethodMiddleware
+
+	ctx     context.Context // canceled when the client is closed
+	timeout time.Duration   // handlers deadline, zero means no deadline
+	work    *tracker        // running handlers, can be nil
 }
 
 func (m *methodMux) once(fn func() error) error {
@@ -189,13 +1039,13 @@ func (m *methodMux) once(fn func() error) error {
 }
 
 // handle registers the given direct-method handler.
-func (m *methodMux) handle(method string, fn DirectMethodHandler) error {
+func (m *methodMux) handle(method string, fn RawMethodHandler) error {
 	if fn == nil {
 		panic("fn is nil")
 	}
 	m.mu.Lock()
 	if m.m == nil {
-		m.m = map[string]DirectMethodHandler{}
+		m.m = map[string]RawMethodHandler{}
 	}
 	if _, ok := m.m[method]; ok {
 		m.mu.Unlock()
@@ -206,6 +1056,20 @@ func (m *methodMux) handle(method string, fn DirectMethodHandler) error {
 	return nil
 }
 
+// handleDefault sets the handler of unregistered methods, nil removes it.
+func (m *methodMux) handleDefault(fn RawMethodHandler) {
+	m.mu.Lock()
+	m.df = fn
+	m.mu.Unlock()
+}
+
+// use appends middleware to the chain.
+func (m *methodMux) use(mw ...MethodMiddleware) {
+	m.mu.Lock()
+	m.mw = append(m.mw, mw...)
+	m.mu.Unlock()
+}
+
 // remove deregisters the named method.
 func (m *methodMux) remove(method string) {
 	m.mu.Lock()
@@ -216,30 +1080,133 @@ func (m *methodMux) remove(method string) {
 }
 
 // Dispatch dispatches the named method, error is not nil only when dispatching fails.
+//
+// Unregistered methods are passed to the default handler if it's set,
+// otherwise they're responded with status 404.
 func (m *methodMux) Dispatch(method string, b []byte) (int, []byte, error) {
 	m.mu.RLock()
 	f, ok := m.m[method]
-	m.mu.RUnlock()
 	if !ok {
-		return 0, nil, fmt.Errorf("method %q is not registered", method)
+		f = m.df
+	}
+	mw := m.mw
+	m.mu.RUnlock()
+	if f == nil {
+		msg := fmt.Sprintf("method %q is not registered", method)
+		return 404, []byte(fmt.Sprintf(`{"error":%q}`, msg)), nil
+	}
+	if m.work != nil {
+		if !m.work.add() {
+			return 503, []byte(`{"error":"client is shutting down"}`), nil
+		}
+		defer m.work.done()
 	}
 
-	var v map[string]interface{}
-	if err := json.Unmarshal(b, &v); err != nil {
-		return jsonErr(err)
+	// the first middleware is the outermost one
+	for i := len(mw) - 1; i >= 0; i-- {
+		f = mw[i](f)
 	}
-	v, err := f(v)
-	if err != nil {
-		return jsonErr(err)
+
+	ctx := m.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx = context.WithValue(ctx, methodNameKey{}, method)
+	ctx, span := common.StartSpan(ctx, m.tracer, "iothub.DirectMethod", map[string]string{
+		"iothub.method": method,
+	})
+	if m.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.timeout)
+		defer cancel()
 	}
-	if v == nil {
-		v = map[string]interface{}{}
+	start := time.Now()
+	rc, b, err := f(ctx, b)
+	span.End(err)
+	if m.metrics != nil {
+		m.metrics.Observe(common.MetricDispatchSeconds, time.Since(start).Seconds(), methodLabels)
 	}
-	b, err = json.Marshal(v)
 	if err != nil {
 		return jsonErr(err)
 	}
-	return 200, b, nil
+	return rc, b, nil
+}
+
+// MethodMiddleware wraps direct method handlers, e.g. for logging or
+// collecting metrics, the method name is obtained with MethodName(ctx).
+type MethodMiddleware func(next RawMethodHandler) RawMethodHandler
+
+// RecoverMethodPanics is a middleware that converts handler
+// panics into status 500 responses instead of crashing the program.
+func RecoverMethodPanics(next RawMethodHandler) RawMethodHandler {
+	return func(ctx context.Context, b []byte) (rc int, data []byte, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				rc, data, err = 0, nil, fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return next(ctx, b)
+	}
+}
+
+type methodNameKey struct{}
+
+// MethodName returns the name of the direct method
+// being handled, ctx is the one passed to the handler.
+func MethodName(ctx context.Context) string {
+	name, _ := ctx.Value(methodNameKey{}).(string)
+	return name
+}
+
+// jsonHandler converts fn into a raw handler that
+// decodes and encodes payloads as json objects.
+func jsonHandler(fn ContextMethodHandler) RawMethodHandler {
+	if fn == nil {
+		panic("fn is nil")
+	}
+	return func(ctx context.Context, b []byte) (int, []byte, error) {
+		var v map[string]interface{}
+		if err := json.Unmarshal(b, &v); err != nil {
+			return 0, nil, err
+		}
+		v, err := fn(ctx, v)
+		if err != nil {
+			return 0, nil, err
+		}
+		if v == nil {
+			return 200, []byte("{}"), nil
+		}
+		b, err = marshalJSON(v)
+		if err != nil {
+			return 0, nil, err
+		}
+		return 200, b, nil
+	}
+}
+
+// jsonBufs are encoding buffers of method responses.
+var jsonBufs = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// marshalJSON is json.Marshal encoding v into a pooled buffer,
+// so only the result of the exact size is allocated.
+func marshalJSON(v interface{}) ([]byte, error) {
+	buf := jsonBufs.Get().(*bytes.Buffer)
+	defer func() {
+		// don't hold on to buffers of exceptionally large responses
+		if buf.Cap() <= 64<<10 {
+			jsonBufs.Put(buf)
+		}
+	}()
+	buf.Reset()
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	b := bytes.TrimSuffix(buf.Bytes(), []byte{'\n'})
+	return append(make([]byte, 0, len(b)), b...), nil
 }
 
 func jsonErr(err error) (int, []byte, error) {
@@ -2,14 +2,20 @@ package iotdevice
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/iotdevice/transport"
 )
 
 func TestEventsMux(t *testing.T) {
 	mux := &eventsMux{}
-	sub := mux.sub()
+	sub := subscribe(t, mux)
 	mux.Dispatch(&common.Message{
 		Payload: []byte("hello"),
 	})
@@ -21,10 +27,8 @@ func TestEventsMux(t *testing.T) {
 	mux.Dispatch(&common.Message{
 		Payload: []byte("hello"),
 	})
-	select {
-	case <-sub.C():
+	if _, ok := <-sub.C(); ok {
 		t.Fatal("C is not closed after unsub")
-	default:
 	}
 	if err := sub.Err(); err != nil {
 		t.Fatal(err)
@@ -33,21 +37,135 @@ func TestEventsMux(t *testing.T) {
 
 func TestEventsMuxClose(t *testing.T) {
 	mux := &eventsMux{}
+	sub := subscribe(t, mux)
+	mux.close()
+	if err := sub.Err(); err != ErrClosed {
+		t.Fatalf("closed mux sub err = %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestTwinStateMuxTyped(t *testing.T) {
+	type config struct {
+		Interval int `json:"interval"`
+	}
+
+	mux := &twinStateMux{}
+	tsub := mux.typedSub(func() interface{} { return &config{} })
+	sub := mux.sub(false)
+	mux.Dispatch([]byte(`{"interval":5,"$version":2}`))
+	if v := (<-tsub.C()).(*config); v.Interval != 5 {
+		t.Fatalf("typed sub interval = %d, want %d", v.Interval, 5)
+	}
+	if s := <-sub.C(); s.Version() != 2 {
+		t.Fatalf("sub version = %d, want %d", s.Version(), 2)
+	}
+	mux.close()
+	if err := tsub.Err(); err != ErrClosed {
+		t.Fatalf("closed mux typed sub err = %v, want %v", err, ErrClosed)
+	}
+}
+
+type testSettler struct {
+	msg *common.Message
+	s   transport.Settlement
+}
+
+func (s *testSettler) SetManualSettlement(bool) {}
+
+func (s *testSettler) Settle(_ context.Context, msg *common.Message, v transport.Settlement) error {
+	s.msg, s.s = msg, v
+	return nil
+}
+
+func TestEventSubSettle(t *testing.T) {
+	sub := subscribe(t, &eventsMux{})
+	msg := &common.Message{}
+	if err := sub.Complete(context.Background(), msg); err != ErrSettlementNotSupported {
+		t.Fatalf("Complete() = %v, want %v", err, ErrSettlementNotSupported)
+	}
+
+	st := &testSettler{}
+	sub.settler = st
+	if err := sub.Abandon(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if st.msg != msg || st.s != transport.SettleAbandon {
+		t.Errorf("settled %p with %d, want %p with %d", st.msg, st.s, msg, transport.SettleAbandon)
+	}
+}
+
+func TestConnStateMux(t *testing.T) {
+	mux := &connStateMux{}
 	sub := mux.sub()
-	mux.close(ErrClosed)
+	mux.Dispatch(transport.ConnectionDisconnected, ErrClosed)
+	v := <-sub.C()
+	if v.State != transport.ConnectionDisconnected || v.Err != ErrClosed {
+		t.Fatalf("state = %s, %v, want %s, %v", v.State, v.Err, transport.ConnectionDisconnected, ErrClosed)
+	}
+	mux.close()
+	if _, ok := <-sub.C(); ok {
+		t.Fatal("C is not closed")
+	}
 	if err := sub.Err(); err != ErrClosed {
 		t.Fatalf("closed mux sub err = %v, want %v", err, ErrClosed)
 	}
 }
 
+func TestConnStateMuxLateDispatch(t *testing.T) {
+	t.Parallel()
+
+	mux := &connStateMux{}
+	sub := mux.sub()
+	closed := mux.sub()
+
+	// more changes than the channel holds are pending when
+	// subscriptions are closed, dispatching goes on afterwards
+	for i := 0; i < 20; i++ {
+		mux.Dispatch(transport.ConnectionDisconnected, nil)
+	}
+	mux.unsub(sub)
+	mux.Dispatch(transport.ConnectionConnected, nil)
+	mux.close()
+	mux.Dispatch(transport.ConnectionConnected, nil)
+
+	// channels are closed once pending changes are delivered or dropped
+	for _, s := range []*ConnectionStateSub{sub, closed} {
+		for range s.C() {
+		}
+	}
+	if err := closed.Err(); err != ErrClosed {
+		t.Errorf("Err() = %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestSubRecv(t *testing.T) {
+	t.Parallel()
+
+	mux := &connStateMux{}
+	sub := mux.sub()
+	mux.Dispatch(transport.ConnectionConnected, nil)
+	v, err := sub.Recv(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.State != transport.ConnectionConnected {
+		t.Errorf("state = %s, want %s", v.State, transport.ConnectionConnected)
+	}
+
+	mux.unsub(sub)
+	if _, err = sub.Recv(context.Background()); err != ErrClosed {
+		t.Errorf("Recv() after unsubscribing = %v, want %v", err, ErrClosed)
+	}
+}
+
 func TestMethodMux(t *testing.T) {
 	t.Parallel()
 
 	m := methodMux{}
-	if err := m.handle("add", func(v map[string]interface{}) (map[string]interface{}, error) {
+	if err := m.handle("add", jsonHandler(func(_ context.Context, v map[string]interface{}) (map[string]interface{}, error) {
 		v["b"] = 2
 		return v, nil
-	}); err != nil {
+	})); err != nil {
 		t.Fatal(err)
 	}
 	defer m.remove("add")
@@ -64,3 +182,602 @@ func TestMethodMux(t *testing.T) {
 		t.Errorf("data = %q, want %q", data, w)
 	}
 }
+
+func TestMethodMuxRaw(t *testing.T) {
+	t.Parallel()
+
+	m := methodMux{}
+	if err := m.handle("sum", func(_ context.Context, b []byte) (int, []byte, error) {
+		if !bytes.Equal(b, []byte(`[1,2]`)) {
+			return 0, nil, errors.New("unexpected payload")
+		}
+		return 201, []byte(`3`), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	rc, data, err := m.Dispatch("sum", []byte(`[1,2]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc != 201 || !bytes.Equal(data, []byte(`3`)) {
+		t.Errorf("Dispatch(%q) = %d, %q, want %d, %q", "sum", rc, data, 201, `3`)
+	}
+	if rc, _, _ = m.Dispatch("sum", []byte(`{}`)); rc != 500 {
+		t.Errorf("rc = %d on handler error, want %d", rc, 500)
+	}
+}
+
+func TestMethodMuxContext(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m := methodMux{ctx: ctx, timeout: time.Hour}
+	if err := m.handle("wait", func(ctx context.Context, b []byte) (int, []byte, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			return 0, nil, errors.New("no deadline")
+		}
+		<-ctx.Done()
+		return 0, nil, ctx.Err()
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	rc, data, err := m.Dispatch("wait", []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := []byte(`{"error":"context canceled"}`)
+	if rc != 500 || !bytes.Equal(data, w) {
+		t.Errorf("Dispatch(%q) = %d, %q, want %d, %q", "wait", rc, data, 500, w)
+	}
+}
+
+func TestMethodMuxDefault(t *testing.T) {
+	t.Parallel()
+
+	m := methodMux{}
+	rc, data, err := m.Dispatch("missing", []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := []byte(`{"error":"method \"missing\" is not registered"}`)
+	if rc != 404 || !bytes.Equal(data, w) {
+		t.Errorf("Dispatch(%q) = %d, %q, want %d, %q", "missing", rc, data, 404, w)
+	}
+
+	m.handleDefault(func(ctx context.Context, b []byte) (int, []byte, error) {
+		return 200, []byte(`"` + MethodName(ctx) + `"`), nil
+	})
+	if rc, data, _ = m.Dispatch("missing", []byte(`{}`)); rc != 200 || string(data) != `"missing"` {
+		t.Errorf("Dispatch(%q) = %d, %q, want %d, %q", "missing", rc, data, 200, `"missing"`)
+	}
+}
+
+func TestMethodMuxMiddleware(t *testing.T) {
+	t.Parallel()
+
+	var g []string
+	trace := func(name string) MethodMiddleware {
+		return func(next RawMethodHandler) RawMethodHandler {
+			return func(ctx context.Context, b []byte) (int, []byte, error) {
+				g = append(g, name+":"+MethodName(ctx))
+				return next(ctx, b)
+			}
+		}
+	}
+
+	m := methodMux{}
+	m.use(trace("a"), trace("b"), RecoverMethodPanics)
+	if err := m.handle("crash", func(context.Context, []byte) (int, []byte, error) {
+		panic("boom")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	rc, data, err := m.Dispatch("crash", []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := []byte(`{"error":"panic: boom"}`)
+	if rc != 500 || !bytes.Equal(data, w) {
+		t.Errorf("Dispatch(%q) = %d, %q, want %d, %q", "crash", rc, data, 500, w)
+	}
+	if len(g) != 2 || g[0] != "a:crash" || g[1] != "b:crash" {
+		t.Errorf("middleware calls = %v, want [a:crash b:crash]", g)
+	}
+}
+
+func TestEventsMuxOverflow(t *testing.T) {
+	t.Parallel()
+
+	for policy, w := range map[DropPolicy]string{
+		DropOldest: "bc",
+		DropNewest: "ab",
+	} {
+		mux := &eventsMux{}
+		sub := subscribe(t, mux, WithBuffer(2), WithOverflowPolicy(policy))
+		for _, id := range []string{"a", "b", "c"} {
+			mux.Dispatch(&common.Message{MessageID: id})
+		}
+		g := (<-sub.C()).MessageID + (<-sub.C()).MessageID
+		if g != w {
+			t.Errorf("policy %d: received = %q, want %q", policy, g, w)
+		}
+	}
+}
+
+func TestEventsMuxOverflowBuffer(t *testing.T) {
+	t.Parallel()
+
+	for _, opts := range [][]SubscribeOption{
+		{WithBuffer(0), WithOverflowPolicy(DropOldest)},
+		{WithOverflowPolicy(DropNewest), WithBuffer(0)},
+		{WithOrderedDelivery(), WithBuffer(0), WithOverflowPolicy(DropOldest)},
+		{WithBuffer(0), WithOverflowPolicy(Block)},
+		{WithOrderedDelivery(), WithBuffer(0), WithOverflowPolicy(Block)},
+	} {
+		if _, err := (&eventsMux{}).sub(opts...); err == nil {
+			t.Errorf("sub(%d options) with zero buffer = nil error", len(opts))
+		}
+	}
+}
+
+func TestEventsMuxBlock(t *testing.T) {
+	t.Parallel()
+
+	mux := &eventsMux{}
+	sub := subscribe(t, mux, WithBuffer(1), WithOverflowPolicy(Block))
+	mux.Dispatch(&common.Message{})
+	done := make(chan struct{})
+	go func() {
+		mux.Dispatch(&common.Message{})
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Dispatch returned before the message is consumed")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// unsubscribing unblocks dispatching
+	mux.unsub(sub)
+	<-done
+}
+
+func TestEventsMuxOrderedBlock(t *testing.T) {
+	t.Parallel()
+
+	mux := &eventsMux{}
+	sub := subscribe(t, mux, WithOrderedDelivery(), WithBuffer(1), WithOverflowPolicy(Block))
+	done := make(chan struct{})
+	go func() {
+		for _, id := range []string{"a", "b", "c"} {
+			mux.Dispatch(&common.Message{MessageID: id})
+		}
+		close(done)
+	}()
+
+	var g string
+	for i := 0; i < 3; i++ {
+		g += (<-sub.C()).MessageID
+	}
+	if g != "abc" {
+		t.Errorf("received = %q, want %q", g, "abc")
+	}
+	<-done
+	mux.unsub(sub)
+}
+
+func TestEventsMuxOrdered(t *testing.T) {
+	t.Parallel()
+
+	mux := &eventsMux{}
+	sub := subscribe(t, mux, WithOrderedDelivery())
+	var w string
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("%d,", i)
+		w += id
+		mux.Dispatch(&common.Message{MessageID: id})
+	}
+
+	var g string
+	for i := 0; i < 100; i++ {
+		g += (<-sub.C()).MessageID
+	}
+	if g != w {
+		t.Errorf("received = %q, want %q", g, w)
+	}
+
+	mux.close()
+	if _, ok := <-sub.C(); ok {
+		t.Error("C is not closed after the mux is closed")
+	}
+	if err := sub.Err(); err != ErrClosed {
+		t.Errorf("closed mux sub err = %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestEventsMuxOrderedBounded(t *testing.T) {
+	t.Parallel()
+
+	mux := &eventsMux{}
+	sub := subscribe(t, mux, WithOrderedDelivery(), WithBuffer(2), WithOverflowPolicy(DropNewest))
+	for _, id := range []string{"a", "b", "c"} {
+		mux.Dispatch(&common.Message{MessageID: id})
+	}
+	g := (<-sub.C()).MessageID + (<-sub.C()).MessageID
+	if g != "ab" {
+		t.Errorf("received = %q, want %q", g, "ab")
+	}
+	select {
+	case msg := <-sub.C():
+		t.Errorf("received %q, want it to be dropped", msg.MessageID)
+	case <-time.After(10 * time.Millisecond):
+	}
+	mux.unsub(sub)
+}
+
+func TestEventsMuxBacklog(t *testing.T) {
+	t.Parallel()
+
+	m := &testMetrics{m: map[string]float64{}}
+	mux := &eventsMux{metrics: m}
+	sub := subscribe(t, mux, WithBuffer(1), WithBacklog(2))
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		mux.Dispatch(&common.Message{MessageID: id})
+	}
+	if g := sub.Dropped(); g != 2 {
+		t.Errorf("Dropped() = %d, want %d", g, 2)
+	}
+	if g := m.m[common.MetricMessagesDropped]; g != 2 {
+		t.Errorf("%s = %v, want %v", common.MetricMessagesDropped, g, 2)
+	}
+
+	var g string
+	for i := 0; i < 3; i++ {
+		g += (<-sub.C()).MessageID
+	}
+	if g != "abc" {
+		t.Errorf("received = %q, want %q", g, "abc")
+	}
+
+	// the backlog is drained so new messages are accepted
+	mux.Dispatch(&common.Message{MessageID: "f"})
+	if g := (<-sub.C()).MessageID; g != "f" {
+		t.Errorf("received = %q, want %q", g, "f")
+	}
+	mux.close()
+	if _, ok := <-sub.C(); ok {
+		t.Error("C is not closed after the mux is closed")
+	}
+}
+
+func TestTwinStateMuxDispatchError(t *testing.T) {
+	t.Parallel()
+
+	var (
+		gerr error
+		gb   []byte
+	)
+	mux := &twinStateMux{}
+	mux.onError(func(err error, b []byte) {
+		gerr, gb = err, b
+	})
+	mux.sub(false)
+	mux.Dispatch([]byte(`[1]`))
+	if gerr == nil || string(gb) != `[1]` {
+		t.Errorf("dispatch error = %v, %q, want an error, %q", gerr, gb, `[1]`)
+	}
+
+	// the handler isn't called under the lock and can unsubscribe
+	done := make(chan struct{})
+	mux.onError(func(err error, b []byte) {
+		mux.unsub(mux.sub(false))
+		close(done)
+	})
+	go mux.Dispatch([]byte(`[1]`))
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("dispatch error handler deadlocked")
+	}
+}
+
+type testTracer struct {
+	name  string
+	attrs map[string]string
+	err   error
+}
+
+func (t *testTracer) Start(ctx context.Context, name string, attrs map[string]string) (context.Context, common.Span) {
+	t.name, t.attrs = name, attrs
+	return ctx, t
+}
+
+func (t *testTracer) End(err error) {
+	t.err = err
+}
+
+func (t *testTracer) Inject(props map[string]string) {
+	props["traceparent"] = "00-1-2-01"
+}
+
+func TestMethodMuxTracer(t *testing.T) {
+	t.Parallel()
+
+	tr := &testTracer{}
+	m := methodMux{tracer: tr}
+	if err := m.handle("fail", func(context.Context, []byte) (int, []byte, error) {
+		return 0, nil, errors.New("failed")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := m.Dispatch("fail", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if tr.name != "iothub.DirectMethod" || tr.attrs["iothub.method"] != "fail" {
+		t.Errorf("span = %q %v, want the method span", tr.name, tr.attrs)
+	}
+	if tr.err == nil || tr.err.Error() != "failed" {
+		t.Errorf("span error = %v, want %q", tr.err, "failed")
+	}
+}
+
+type testMetrics struct {
+	mu sync.Mutex
+	m  map[string]float64
+}
+
+func (m *testMetrics) Add(name string, delta float64, _ map[string]string) {
+	m.mu.Lock()
+	m.m[name] += delta
+	m.mu.Unlock()
+}
+
+func (m *testMetrics) Set(name string, v float64, _ map[string]string) {
+	m.mu.Lock()
+	m.m[name] = v
+	m.mu.Unlock()
+}
+
+func (m *testMetrics) Observe(name string, v float64, _ map[string]string) {
+	m.Add(name+"_count", 1, nil)
+}
+
+func TestEventsMuxMetrics(t *testing.T) {
+	t.Parallel()
+
+	m := &testMetrics{m: map[string]float64{}}
+	mux := &eventsMux{metrics: m}
+	subscribe(t, mux)
+	mux.Dispatch(&common.Message{})
+	mux.Dispatch(&common.Message{})
+	if g := m.m[common.MetricMessagesReceived]; g != 2 {
+		t.Errorf("%s = %v, want %v", common.MetricMessagesReceived, g, 2)
+	}
+	if g := m.m[common.MetricSubscriberLag]; g != 2 {
+		t.Errorf("%s = %v, want %v", common.MetricSubscriberLag, g, 2)
+	}
+}
+
+func TestEventSubRecv(t *testing.T) {
+	t.Parallel()
+
+	mux := &eventsMux{done: make(chan struct{})}
+	sub := subscribe(t, mux)
+	mux.Dispatch(&common.Message{Payload: []byte("a")})
+	msg, err := sub.Recv(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Payload) != "a" {
+		t.Errorf("Recv() = %q, want %q", msg.Payload, "a")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err = sub.Recv(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Recv() = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	mux.Dispatch(&common.Message{Payload: []byte("b")})
+	if err = sub.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sub.Recv(context.Background()); err != ErrClosed {
+		t.Errorf("Recv() after Close = %v, want %v", err, ErrClosed)
+	}
+	if len(mux.subs) != 0 {
+		t.Errorf("len(subs) = %d, want 0", len(mux.subs))
+	}
+}
+
+func TestTwinStateSubRecv(t *testing.T) {
+	t.Parallel()
+
+	mux := &twinStateMux{}
+	sub := mux.sub(false)
+	mux.Dispatch([]byte(`{"$version":2}`))
+	s, err := sub.Recv(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Version() != 2 {
+		t.Errorf("Version() = %d, want 2", s.Version())
+	}
+	if err = sub.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sub.Recv(context.Background()); err != ErrClosed {
+		t.Errorf("Recv() after Close = %v, want %v", err, ErrClosed)
+	}
+
+	sub = mux.sub(false)
+	mux.close()
+	if _, err = sub.Recv(context.Background()); err != ErrClosed {
+		t.Errorf("Recv() of closed mux = %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestTwinStateSubHold(t *testing.T) {
+	t.Parallel()
+
+	mux := &twinStateMux{}
+	sub := mux.sub(true)
+	mux.Dispatch([]byte(`{"$version":2}`))
+	mux.Dispatch([]byte(`{"$version":4}`))
+	select {
+	case s := <-sub.C():
+		t.Fatalf("received %v before the initial state", s)
+	default:
+	}
+	sub.release(TwinState{"$version": float64(3)})
+	mux.Dispatch([]byte(`{"$version":5}`))
+	for _, w := range []int{3, 4, 5} {
+		if s := <-sub.C(); s.Version() != w {
+			t.Errorf("Version() = %d, want %d", s.Version(), w)
+		}
+	}
+}
+
+func TestTwinStateMuxHeldOrderOverflow(t *testing.T) {
+	t.Parallel()
+
+	// more changes than the channel holds are received before the initial
+	// state and after it, they're delivered in order nonetheless
+	mux := &twinStateMux{}
+	sub := mux.sub(true)
+	for v := 2; v <= 30; v++ {
+		mux.Dispatch([]byte(fmt.Sprintf(`{"$version":%d}`, v)))
+	}
+	sub.release(TwinState{"$version": float64(1)})
+	for v := 31; v <= 60; v++ {
+		mux.Dispatch([]byte(fmt.Sprintf(`{"$version":%d}`, v)))
+	}
+	for w := 1; w <= 60; w++ {
+		if s := <-sub.C(); s.Version() != w {
+			t.Fatalf("Version() = %d, want %d", s.Version(), w)
+		}
+	}
+	mux.unsub(sub)
+}
+
+func BenchmarkMethodMuxDispatch(b *testing.B) {
+	m := methodMux{}
+	if err := m.handle("add", jsonHandler(func(_ context.Context, v map[string]interface{}) (map[string]interface{}, error) {
+		v["b"] = 2
+		return v, nil
+	})); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := m.Dispatch("add", []byte(`{"a":1}`)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestEventsMuxSlowSubscriber(t *testing.T) {
+	t.Parallel()
+
+	m := &testMetrics{m: map[string]float64{}}
+	var slow []*SlowSubscriber
+	mux := &eventsMux{
+		metrics: m,
+		slowAge: 20 * time.Millisecond,
+		onSlow: func(s *SlowSubscriber) {
+			slow = append(slow, s)
+		},
+	}
+	sub := subscribe(t, mux, WithBuffer(2), WithOverflowPolicy(DropNewest), WithSubscriberName("slow"))
+	fast := subscribe(t, mux, WithBuffer(1))
+	if sub.Name() != "slow" || fast.Name() != "events-2" {
+		t.Errorf("names = %q, %q, want %q, %q", sub.Name(), fast.Name(), "slow", "events-2")
+	}
+	dispatch := func() {
+		mux.Dispatch(&common.Message{})
+		<-fast.C()
+	}
+
+	dispatch()
+	dispatch()
+	dispatch() // the buffer is full on arrival
+	time.Sleep(30 * time.Millisecond)
+	dispatch()
+	dispatch() // reported once per threshold
+	if len(slow) != 1 || slow[0].Name != "slow" || slow[0].Depth != 2 || slow[0].OldestAge < 20*time.Millisecond {
+		t.Fatalf("slow subscribers = %v, want one report of %q", slow, "slow")
+	}
+	if g := m.m[common.MetricSlowSubscribers]; g != 1 {
+		t.Errorf("%s = %v, want %v", common.MetricSlowSubscribers, g, 1)
+	}
+	if g := m.m[common.MetricSubscriberStalledSeconds]; g < 0.02 {
+		t.Errorf("%s = %v, want at least %v", common.MetricSubscriberStalledSeconds, g, 0.02)
+	}
+
+	// catching up resets the stall
+	<-sub.C()
+	<-sub.C()
+	dispatch()
+	if g := m.m[common.MetricSubscriberStalledSeconds]; g != 0 {
+		t.Errorf("%s = %v, want %v", common.MetricSubscriberStalledSeconds, g, 0)
+	}
+}
+
+// TestMuxCloseRace makes sure closing and unsubscribing never races with
+// dispatching, a send on a closed channel panics and fails the test.
+func TestMuxCloseRace(t *testing.T) {
+	t.Parallel()
+
+	for i := 0; i < 20; i++ {
+		done := make(chan struct{})
+		ev := &eventsMux{done: done}
+		ts := &twinStateMux{}
+		cs := &connStateMux{}
+
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for k := 0; k < 100; k++ {
+					ev.Dispatch(&common.Message{})
+					ts.Dispatch([]byte(`{"$version":1}`))
+					cs.Dispatch(transport.ConnectionConnected, nil)
+				}
+			}()
+		}
+		for j := 0; j < 20; j++ {
+			// subscriptions that are never read from
+			subscribe(t, ev, WithBuffer(1))
+			subscribe(t, ev, WithBuffer(1), WithOverflowPolicy(DropOldest))
+			subscribe(t, ev, WithOrderedDelivery())
+			ts.sub(false)
+			ts.typedSub(func() interface{} { return &map[string]interface{}{} })
+			cs.sub()
+
+			ev.unsub(subscribe(t, ev, WithBuffer(1)))
+			ev.unsub(subscribe(t, ev, WithBuffer(1), WithOverflowPolicy(Block)))
+			ts.unsub(ts.sub(false))
+			cs.unsub(cs.sub())
+		}
+		close(done)
+		ev.close()
+		ts.close()
+		cs.close()
+		wg.Wait()
+	}
+}
+
+// subscribe subscribes to the mux failing the test on errors.
+func subscribe(t *testing.T, m *eventsMux, opts ...SubscribeOption) *EventSub {
+	t.Helper()
+	s, err := m.sub(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
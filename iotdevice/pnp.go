@@ -0,0 +1,131 @@
+package iotdevice
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/goautomotive/iothub/common"
+)
+
+// WithModelID makes the client announce the given DTDL model id,
+// e.g. `dtmi:com:example:Thermostat;1`, when connecting to the hub,
+// so the device is recognized as an IoT Plug and Play device.
+// Only transports implementing `transport.ModelAnnouncer` support it.
+func WithModelID(id string) ClientOption {
+	return func(c *Client) error {
+		c.model = id
+		return nil
+	}
+}
+
+// ModelID returns the announced IoT Plug and Play model id.
+func (c *Client) ModelID() string {
+	return c.model
+}
+
+// WithSendComponent marks telemetry as belonging to the named PnP component.
+func WithSendComponent(name string) SendOption {
+	return func(msg *common.Message) error {
+		msg.ComponentName = name
+		return nil
+	}
+}
+
+// componentSeparator separates component and command names in method names.
+const componentSeparator = "*"
+
+// CommandName returns the direct method name of the component's command,
+// commands of the default component have no prefix.
+func CommandName(component, command string) string {
+	if component == "" {
+		return command
+	}
+	return component + componentSeparator + command
+}
+
+// ParseCommandName splits the direct method name into component
+// and command names, component is blank for the default component.
+func ParseCommandName(method string) (component, command string) {
+	if i := strings.Index(method, componentSeparator); i != -1 {
+		return method[:i], method[i+1:]
+	}
+	return "", method
+}
+
+// RegisterCommand registers the handler of the component's command,
+// the blank component stands for the default one.
+func (c *Client) RegisterCommand(ctx context.Context, component, command string, fn ContextMethodHandler) error {
+	if command == "" {
+		return errors.New("command cannot be blank")
+	}
+	return c.RegisterMethodContext(ctx, CommandName(component, command), fn)
+}
+
+// UnregisterCommand unregisters the component's command.
+func (c *Client) UnregisterCommand(component, command string) {
+	c.UnregisterMethod(CommandName(component, command))
+}
+
+// WritablePropertyResponse is the acknowledgement of a writable property
+// update, it's reported back to let the solution know its outcome.
+type WritablePropertyResponse struct {
+	Value       interface{} `json:"value"`
+	Code        int         `json:"ac"`
+	Version     int         `json:"av"`
+	Description string      `json:"ad,omitempty"`
+}
+
+// componentState wraps props with the component marker,
+// the default component's properties are kept at the root.
+func componentState(component string, props map[string]interface{}) TwinState {
+	if component == "" {
+		return TwinState(props)
+	}
+	v := make(map[string]interface{}, len(props)+1)
+	v["__t"] = "c"
+	for k, p := range props {
+		v[k] = p
+	}
+	return TwinState{component: v}
+}
+
+// ReportProperties reports read-only properties of the component
+// and returns new reported state version.
+func (c *Client) ReportProperties(ctx context.Context, component string, props map[string]interface{}) (int, error) {
+	return c.UpdateTwinState(ctx, componentState(component, props))
+}
+
+// AckWritableProperty reports the outcome of applying the desired
+// value of the component's writable property.
+func (c *Client) AckWritableProperty(
+	ctx context.Context, component, name string, resp *WritablePropertyResponse,
+) (int, error) {
+	if name == "" {
+		return 0, errors.New("name cannot be blank")
+	}
+	if resp == nil {
+		panic("resp is nil")
+	}
+	return c.ReportProperties(ctx, component, map[string]interface{}{name: resp})
+}
+
+// ComponentProperties returns properties of the named component from
+// the desired or reported state, or nil when the component is missing.
+// The blank component returns the state itself.
+func ComponentProperties(s TwinState, component string) map[string]interface{} {
+	if component == "" {
+		return s
+	}
+	v, ok := s[component].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	props := make(map[string]interface{}, len(v))
+	for k, p := range v {
+		if k != "__t" {
+			props[k] = p
+		}
+	}
+	return props
+}
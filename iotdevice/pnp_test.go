@@ -0,0 +1,39 @@
+package iotdevice
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCommandName(t *testing.T) {
+	t.Parallel()
+
+	for s, w := range map[string][2]string{
+		"reboot":                 {"", "reboot"},
+		"thermostat*getMaxMin":   {"thermostat", "getMaxMin"},
+		"thermostat*get*MaxMin":  {"thermostat", "get*MaxMin"},
+		CommandName("", "reset"): {"", "reset"},
+	} {
+		comp, cmd := ParseCommandName(s)
+		if comp != w[0] || cmd != w[1] {
+			t.Errorf("ParseCommandName(%q) = %q, %q, want %q, %q", s, comp, cmd, w[0], w[1])
+		}
+	}
+}
+
+func TestComponentState(t *testing.T) {
+	t.Parallel()
+
+	props := map[string]interface{}{"temp": 21.5}
+	s := componentState("thermostat", props)
+	w := TwinState{"thermostat": map[string]interface{}{"__t": "c", "temp": 21.5}}
+	if !reflect.DeepEqual(s, w) {
+		t.Errorf("componentState(%q) = %v, want %v", "thermostat", s, w)
+	}
+	if g := ComponentProperties(s, "thermostat"); !reflect.DeepEqual(g, props) {
+		t.Errorf("ComponentProperties(%q) = %v, want %v", "thermostat", g, props)
+	}
+	if g := componentState("", props); !reflect.DeepEqual(g, TwinState(props)) {
+		t.Errorf("componentState(%q) = %v, want %v", "", g, props)
+	}
+}
@@ -0,0 +1,316 @@
+package iotdevice
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/goautomotive/iothub/common"
+)
+
+// Store persists device-to-cloud messages queued while the client is offline.
+//
+// Implementations have to preserve the insertion order,
+// but they don't need to be safe for concurrent use.
+type Store interface {
+	// Push appends msg to the end of the store.
+	Push(msg *common.Message) error
+
+	// Front returns the oldest message, or nil if the store is empty.
+	Front() (*common.Message, error)
+
+	// Remove removes the oldest message.
+	Remove() error
+
+	// Len is the number of stored messages.
+	Len() int
+}
+
+// DropPolicy defines what happens to messages when
+// the offline queue or a subscription buffer is full.
+type DropPolicy int
+
+const (
+	// DropOldest removes the oldest queued message to fit the new one.
+	DropOldest DropPolicy = iota
+
+	// DropNewest discards the new message and returns ErrQueueFull.
+	DropNewest
+
+	// Block waits until there's room for the new message,
+	// it's supported only by events subscriptions.
+	Block
+)
+
+// ErrQueueFull is returned when a message is discarded by the offline queue.
+var ErrQueueFull = errors.New("offline queue is full")
+
+// WithOfflineQueue enables queueing of device-to-cloud messages while
+// the client is disconnected, the queued messages are sent in order
+// as soon as the connection is re-established.
+//
+// Transient sending errors are retried with the retry policy and then
+// with backoff while the client stays online, messages failing with
+// any other error are logged and dropped to not stall the queue.
+//
+// The in-memory store is used unless another one is set with WithOfflineStore.
+func WithOfflineQueue(capacity int, policy DropPolicy) ClientOption {
+	if capacity <= 0 {
+		panic("capacity must be positive")
+	}
+	if policy == Block {
+		panic("block policy is not supported by offline queue")
+	}
+	return func(c *Client) error {
+		if c.queue == nil {
+			c.queue = &offlineQueue{}
+		}
+		c.queue.cap = capacity
+		c.queue.policy = policy
+		return nil
+	}
+}
+
+// WithOfflineStore sets custom storage for the offline queue,
+// e.g. a disk-backed one to survive restarts, it requires WithOfflineQueue.
+func WithOfflineStore(s Store) ClientOption {
+	if s == nil {
+		panic("s is nil")
+	}
+	return func(c *Client) error {
+		if c.queue == nil {
+			c.queue = &offlineQueue{}
+		}
+		c.queue.store = s
+		return nil
+	}
+}
+
+// offlineQueue keeps messages until they can be sent.
+//
+// The connection state is tracked under the same lock as the queue,
+// so a message pushed while the client goes online is either seen by
+// the flush started on connecting or starts another one itself.
+type offlineQueue struct {
+	mu       sync.Mutex
+	store    Store
+	cap      int
+	policy   DropPolicy
+	online   bool
+	flushing bool
+
+	// delays between flushes of the queue failing with transient errors
+	rcmin, rcmax time.Duration
+}
+
+// push queues msg, online reports whether the queue has to be flushed.
+func (q *offlineQueue) push(msg *common.Message) (online bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.store.Len() >= q.cap {
+		if q.policy == DropNewest {
+			return q.online, ErrQueueFull
+		}
+		if err := q.store.Remove(); err != nil {
+			return q.online, err
+		}
+	}
+	return q.online, q.store.Push(msg)
+}
+
+// isOnline reports the connection state.
+func (q *offlineQueue) isOnline() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.online
+}
+
+// setOnline updates the connection state.
+func (q *offlineQueue) setOnline(online bool) {
+	q.mu.Lock()
+	q.online = online
+	q.mu.Unlock()
+}
+
+// bypass reports whether a message can be sent without queueing,
+// that's when the client is online and nothing is queued or being sent.
+func (q *offlineQueue) bypass() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.online && !q.flushing && q.store.Len() == 0
+}
+
+func (q *offlineQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.store.Len()
+}
+
+// flush sends queued messages with fn one by one until the queue is
+// empty or fn fails, in the last case the failed message stays queued.
+//
+// Only one flush can run at the same time, subsequent calls are no-op.
+func (q *offlineQueue) flush(fn func(msg *common.Message) error) error {
+	q.mu.Lock()
+	if q.flushing {
+		q.mu.Unlock()
+		return nil
+	}
+	q.flushing = true
+	q.mu.Unlock()
+
+	for {
+		q.mu.Lock()
+		msg, err := q.store.Front()
+		if err != nil || msg == nil {
+			// stop under the same lock the queue is seen empty,
+			// messages pushed afterwards start a new flush
+			q.flushing = false
+			q.mu.Unlock()
+			return err
+		}
+		q.mu.Unlock()
+		if err = fn(msg); err != nil {
+			q.stop()
+			return err
+		}
+		q.mu.Lock()
+		// the message can be evicted by DropOldest in the meantime
+		if m, err := q.store.Front(); err == nil && m == msg {
+			err = q.store.Remove()
+		}
+		if err != nil {
+			q.flushing = false
+		}
+		q.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// stop marks the running flush finished.
+func (q *offlineQueue) stop() {
+	q.mu.Lock()
+	q.flushing = false
+	q.mu.Unlock()
+}
+
+// enqueue pushes msg to the offline queue and if the client
+// is online, starts flushing queued messages.
+func (c *Client) enqueue(msg *common.Message) error {
+	online, err := c.queue.push(msg)
+	if err != nil {
+		return err
+	}
+	c.debugf(common.ComponentClient, "device-to-cloud queued: %#v", msg)
+	if online {
+		go c.flushQueue()
+	}
+	return nil
+}
+
+// flushQueue sends messages queued while the client was offline,
+// it keeps retrying transient failures until the client goes offline.
+func (c *Client) flushQueue() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	b := &common.Backoff{Min: c.queue.rcmin, Max: c.queue.rcmax}
+	for {
+		err := c.queue.flush(func(msg *common.Message) error {
+			err := common.Retry(ctx, c.retry, func() error {
+				return c.sendQueued(ctx, msg)
+			})
+			if err != nil && !common.IsTransient(err) && ctx.Err() == nil {
+				c.logf(common.LevelError, common.ComponentClient,
+					"offline queue dropped message %q: %s", msg.MessageID, err)
+				return nil
+			}
+			return err
+		})
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		c.logf(common.LevelWarn, common.ComponentClient, "offline queue flush error: %s", err)
+		if !common.IsTransient(err) || !c.queue.isOnline() {
+			return
+		}
+		select {
+		case <-time.After(b.Next()):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sendQueued sends a message taken from the offline queue.
+func (c *Client) sendQueued(ctx context.Context, msg *common.Message) error {
+	if c.limit != nil {
+		if err := c.limit.reserve(ctx); err != nil {
+			return err
+		}
+	}
+	if err := c.tr.Send(ctx, msg); err != nil {
+		return err
+	}
+	c.add(common.MetricMessagesSent)
+	return nil
+}
+
+// NewMemoryStore creates an in-memory ring buffer store with
+// the given initial size, it grows when more space is needed.
+func NewMemoryStore(size int) Store {
+	if size <= 0 {
+		size = 1
+	}
+	return &memoryStore{buf: make([]*common.Message, size)}
+}
+
+type memoryStore struct {
+	buf  []*common.Message
+	head int
+	n    int
+}
+
+func (s *memoryStore) Push(msg *common.Message) error {
+	if s.n == len(s.buf) {
+		buf := make([]*common.Message, len(s.buf)*2)
+		for i := 0; i < s.n; i++ {
+			buf[i] = s.buf[(s.head+i)%len(s.buf)]
+		}
+		s.buf, s.head = buf, 0
+	}
+	s.buf[(s.head+s.n)%len(s.buf)] = msg
+	s.n++
+	return nil
+}
+
+func (s *memoryStore) Front() (*common.Message, error) {
+	if s.n == 0 {
+		return nil, nil
+	}
+	return s.buf[s.head], nil
+}
+
+func (s *memoryStore) Remove() error {
+	if s.n == 0 {
+		return errors.New("store is empty")
+	}
+	s.buf[s.head] = nil
+	s.head = (s.head + 1) % len(s.buf)
+	s.n--
+	return nil
+}
+
+func (s *memoryStore) Len() int {
+	return s.n
+}
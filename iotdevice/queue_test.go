@@ -0,0 +1,191 @@
+package iotdevice
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/iotdevice/transport"
+)
+
+func TestMemoryStore(t *testing.T) {
+	t.Parallel()
+
+	s := NewMemoryStore(2)
+	for i := 0; i < 5; i++ {
+		if err := s.Push(&common.Message{MessageID: string(rune('a' + i))}); err != nil {
+			t.Fatal(err)
+		}
+		if i%2 == 1 {
+			if err := s.Remove(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var g string
+	for s.Len() != 0 {
+		msg, err := s.Front()
+		if err != nil {
+			t.Fatal(err)
+		}
+		g += msg.MessageID
+		if err = s.Remove(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if g != "cde" {
+		t.Errorf("stored messages = %q, want %q", g, "cde")
+	}
+	if msg, _ := s.Front(); msg != nil {
+		t.Errorf("Front() = %v on empty store, want nil", msg)
+	}
+}
+
+func TestOfflineQueue(t *testing.T) {
+	t.Parallel()
+
+	for policy, w := range map[DropPolicy]string{
+		DropOldest: "bc",
+		DropNewest: "ab",
+	} {
+		q := &offlineQueue{store: NewMemoryStore(1), cap: 2, policy: policy}
+		for _, id := range []string{"a", "b", "c"} {
+			_, err := q.push(&common.Message{MessageID: id})
+			if err != nil && (policy != DropNewest || err != ErrQueueFull) {
+				t.Fatal(err)
+			}
+		}
+
+		// the first flush fails keeping the failed message queued
+		var g string
+		fail := true
+		for q.len() != 0 {
+			q.flush(func(msg *common.Message) error {
+				if fail {
+					fail = false
+					return errors.New("send error")
+				}
+				g += msg.MessageID
+				return nil
+			})
+		}
+		if g != w {
+			t.Errorf("policy %d: sent = %q, want %q", policy, g, w)
+		}
+	}
+}
+
+func TestOfflineQueueFlushRace(t *testing.T) {
+	t.Parallel()
+
+	q := &offlineQueue{store: NewMemoryStore(1), cap: 1000, policy: DropNewest}
+	var (
+		mu   sync.Mutex
+		sent int
+		wg   sync.WaitGroup
+	)
+	flush := func() {
+		defer wg.Done()
+		if err := q.flush(func(*common.Message) error {
+			mu.Lock()
+			sent++
+			mu.Unlock()
+			return nil
+		}); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// messages are pushed while the client goes online and the queue
+	// is being flushed, every one of them has to be sent eventually
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				online, err := q.push(&common.Message{})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if online {
+					wg.Add(1)
+					go flush()
+				}
+			}
+		}()
+	}
+	q.setOnline(true)
+	wg.Add(1)
+	go flush()
+	wg.Wait()
+
+	if n := q.len(); n != 0 {
+		t.Errorf("%d messages are left in the queue", n)
+	}
+	if sent != 1000 {
+		t.Errorf("sent %d messages, want 1000", sent)
+	}
+}
+
+// poisonTransport fails sending messages with the given ids once
+// for transient errors and every time for the other ones.
+type poisonTransport struct {
+	testTransport
+	errs map[string]error
+}
+
+func (tr *poisonTransport) Send(ctx context.Context, msg *common.Message) error {
+	tr.mu.Lock()
+	err := tr.errs[msg.MessageID]
+	if common.IsTransient(err) {
+		delete(tr.errs, msg.MessageID)
+	}
+	tr.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return tr.testTransport.Send(ctx, msg)
+}
+
+func TestFlushQueue(t *testing.T) {
+	t.Parallel()
+
+	tr := &poisonTransport{errs: map[string]error{
+		"b": errors.New("message rejected"),
+		"c": transientError{},
+	}}
+	c := newTestClient(t, tr, WithOfflineQueue(10, DropNewest), func(c *Client) error {
+		c.queue.rcmin, c.queue.rcmax = time.Millisecond, time.Millisecond
+		return nil
+	})
+
+	c.csMux.Dispatch(transport.ConnectionDisconnected, errors.New("EOF"))
+	for _, id := range []string{"a", "b", "c", "d"} {
+		if err := c.SendEvent(context.Background(), []byte(id), WithSendMessageID(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.csMux.Dispatch(transport.ConnectionConnected, nil)
+
+	// the rejected message is dropped and the transient failure
+	// is retried without waiting for the next reconnect
+	for start := time.Now(); c.queue.len() != 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("%d messages are left in the queue", c.queue.len())
+		}
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	var g string
+	for _, msg := range tr.sent {
+		g += msg.MessageID
+	}
+	if g != "acd" {
+		t.Errorf("sent = %q, want %q", g, "acd")
+	}
+}
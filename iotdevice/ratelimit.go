@@ -0,0 +1,133 @@
+package iotdevice
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned when a device-to-cloud message exceeds
+// the send rate limit and the client doesn't wait for it.
+var ErrRateLimited = errors.New("send rate limit exceeded")
+
+// WithSendRateLimit limits device-to-cloud messages to msgsPerSec on
+// average allowing bursts of up to burst messages, so the device stays
+// within the hub's per-device throttling limits. Batches and messages
+// flushed from the offline queue are limited too, a batch counts as one.
+//
+// Sending waits until the message is allowed or ctx is done,
+// see WithSendRateLimitNoWait.
+func WithSendRateLimit(msgsPerSec float64, burst int) ClientOption {
+	if msgsPerSec <= 0 {
+		panic("rate must be positive")
+	}
+	if burst <= 0 {
+		panic("burst must be positive")
+	}
+	return func(c *Client) error {
+		if c.limit == nil {
+			c.limit = &rateLimiter{}
+		}
+		c.limit.rate = msgsPerSec
+		c.limit.burst = float64(burst)
+		c.limit.tokens = float64(burst)
+		return nil
+	}
+}
+
+// WithSendRateLimitNoWait makes sending fail with ErrRateLimited instead
+// of waiting when the limit is exceeded, it requires WithSendRateLimit.
+// Messages flushed from the offline queue always wait.
+func WithSendRateLimitNoWait() ClientOption {
+	return func(c *Client) error {
+		if c.limit == nil {
+			c.limit = &rateLimiter{}
+		}
+		c.limit.noWait = true
+		return nil
+	}
+}
+
+// throttle applies the send rate limit if it's set.
+func (c *Client) throttle(ctx context.Context) error {
+	if c.limit == nil {
+		return nil
+	}
+	return c.limit.wait(ctx)
+}
+
+// rateLimiter is a token bucket.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64 // negative when waiters reserved future tokens
+	last   time.Time
+	noWait bool
+	now    func() time.Time // time.Now when nil
+}
+
+// allow takes a token without waiting, ok is false when there's none.
+func (l *rateLimiter) allow() (ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.advance()
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// wait takes a token waiting until it's available when it's configured
+// to, otherwise it returns ErrRateLimited when the limit is exceeded.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if l.noWait {
+		if !l.allow() {
+			return ErrRateLimited
+		}
+		return nil
+	}
+	return l.reserve(ctx)
+}
+
+// reserve takes a token always waiting for it.
+func (l *rateLimiter) reserve(ctx context.Context) error {
+	l.mu.Lock()
+	l.advance()
+	l.tokens--
+	d := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		// give the token back to the following waiters
+		l.mu.Lock()
+		l.tokens++
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// advance refills the bucket according to the time passed, l.mu is held.
+func (l *rateLimiter) advance() {
+	now := time.Now()
+	if l.now != nil {
+		now = l.now()
+	}
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+}
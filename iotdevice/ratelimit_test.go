@@ -0,0 +1,78 @@
+package iotdevice
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(0, 0)
+	l := &rateLimiter{rate: 2, burst: 2, tokens: 2, noWait: true, now: func() time.Time {
+		return now
+	}}
+	for i, want := range []error{nil, nil, ErrRateLimited} {
+		if err := l.wait(context.Background()); err != want {
+			t.Errorf("wait() #%d = %v, want %v", i, err, want)
+		}
+	}
+
+	// a token per 500ms and never more than burst
+	now = now.Add(500 * time.Millisecond)
+	if !l.allow() {
+		t.Error("allow() = false after refill")
+	}
+	now = now.Add(time.Hour)
+	if !l.allow() || !l.allow() || l.allow() {
+		t.Error("bucket holds more tokens than burst")
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	t.Parallel()
+
+	l := &rateLimiter{rate: 50, burst: 1, tokens: 1}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := l.wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d < 35*time.Millisecond {
+		t.Errorf("3 messages at 50/s with burst 1 took %s", d)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	l = &rateLimiter{rate: 0.1, burst: 1}
+	if err := l.wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wait() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if l.tokens != 0 {
+		t.Errorf("tokens = %v after cancellation, want 0", l.tokens)
+	}
+}
+
+func TestSendRateLimit(t *testing.T) {
+	t.Parallel()
+
+	tr := &testTransport{}
+	c := newTestClient(t, tr, WithSendRateLimit(1, 1), WithSendRateLimitNoWait())
+	if err := c.SendEvent(context.Background(), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendEvent(context.Background(), []byte("b")); err != ErrRateLimited {
+		t.Errorf("SendEvent() = %v, want %v", err, ErrRateLimited)
+	}
+
+	if _, err := NewClient(
+		WithTransport(tr),
+		WithConnectionString(testConnString),
+		WithSendRateLimitNoWait(),
+	); err == nil {
+		t.Error("NewClient() without rate limit = nil error")
+	}
+}
@@ -0,0 +1,98 @@
+package iotdevice
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/goautomotive/iothub/common"
+)
+
+// Shutdown gracefully closes the client: it stops accepting new sends,
+// twin updates and method invocations, waits for in-flight messages to be
+// acknowledged, running method handlers and twin updates to finish, sends
+// messages held by the offline queue if the client is online and then
+// closes subscriptions and the transport.
+//
+// When ctx is done before all the work is finished
+// the client is closed anyway and ctx's error is returned.
+func (c *Client) Shutdown(ctx context.Context) error {
+	select {
+	case <-c.done:
+		return nil
+	default:
+	}
+	c.logf(common.LevelInfo, common.ComponentClient, "shutting down")
+
+	var err error
+	select {
+	case <-c.work.drain():
+		if c.coal != nil {
+			err = c.Flush(ctx)
+		}
+		if err == nil && c.queue != nil && atomic.LoadUint32(&c.online) == 1 {
+			err = c.queue.flush(func(msg *common.Message) error {
+				if err := c.tr.Send(ctx, msg); err != nil {
+					return err
+				}
+				c.add(common.MetricMessagesSent)
+				return nil
+			})
+		}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if cerr := c.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// tracker counts in-flight operations, once it's drained
+// no new operations are accepted.
+type tracker struct {
+	mu     sync.Mutex
+	n      int
+	closed bool
+	idle   chan struct{} // closed when n drops to zero after draining
+}
+
+// add registers a new operation, it returns false when the tracker
+// is drained, otherwise done has to be called when it's finished.
+func (t *tracker) add() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.n++
+	return true
+}
+
+func (t *tracker) done() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.n--
+	if t.n == 0 && t.idle != nil {
+		close(t.idle)
+		t.idle = nil
+	}
+}
+
+// drain stops accepting new operations and returns a channel
+// that's closed when all the running ones are finished.
+func (t *tracker) drain() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.idle != nil {
+		return t.idle
+	}
+	t.closed = true
+	ch := make(chan struct{})
+	if t.n == 0 {
+		close(ch)
+	} else {
+		t.idle = ch
+	}
+	return ch
+}
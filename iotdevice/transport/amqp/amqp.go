@@ -0,0 +1,733 @@
+// Package amqp implements the AMQP 1.0 device transport.
+//
+// Unlike the MQTT transport it doesn't reconnect automatically, connection
+// losses are reported to connection state subscribers instead.
+package amqp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/common/commonamqp"
+	"github.com/goautomotive/iothub/eventhub"
+	"github.com/goautomotive/iothub/iotdevice/transport"
+	"pack.ag/amqp"
+)
+
+// tokenTTL is the lifetime of SAS tokens put to the CBS node,
+// they're renewed a minute before expiring.
+const tokenTTL = time.Hour
+
+// TransportOption is a transport configuration option.
+type TransportOption func(tr *Transport)
+
+// WithLogger sets logger for errors and warnings
+// plus debug messages when it's enabled.
+func WithLogger(l *log.Logger) TransportOption {
+	return WithStructuredLogger(common.NewStdLogger(l))
+}
+
+// WithStructuredLogger is same as WithLogger but accepts a leveled logger.
+func WithStructuredLogger(l common.Logger) TransportOption {
+	return func(tr *Transport) {
+		tr.logger = l
+	}
+}
+
+// WithDebug enables debug mode.
+// All debug messages are written to the logger.
+func WithDebug(enable bool) TransportOption {
+	return func(tr *Transport) {
+		tr.debug = enable
+	}
+}
+
+// WithDialer sets the function for establishing connections
+// to the hub, the TLS handshake is done over them by the transport.
+func WithDialer(fn common.Dialer) TransportOption {
+	if fn == nil {
+		panic("fn is nil")
+	}
+	return func(tr *Transport) {
+		tr.dial = fn
+	}
+}
+
+// New returns new AMQP transport.
+// See more: https://docs.microsoft.com/en-us/azure/iot-hub/iot-hub-amqp-support
+func New(opts ...TransportOption) transport.Transport {
+	tr := &Transport{
+		done: make(chan struct{}),
+		resp: map[string]chan *amqp.Message{},
+		msgs: map[*common.Message]*amqp.Message{},
+	}
+	for _, opt := range opts {
+		opt(tr)
+	}
+	return tr
+}
+
+type Transport struct {
+	mu      sync.RWMutex
+	pool    *ClientPool // nil for dedicated connections
+	sess    *amqp.Session
+	release func() error // closes the connection or the pooled session
+	send    *amqp.Sender // telemetry link
+
+	creds transport.Credentials
+
+	did string // device id
+	mid string // module id, empty for plain devices
+
+	tmu   sync.Mutex // twin links
+	tsend *amqp.Sender
+	tmux  transport.TwinStateDispatcher
+	resp  map[string]chan *amqp.Message // twin responses by correlation id
+
+	smu    sync.Mutex
+	manual bool                              // manual c2d messages settlement
+	msgs   map[*common.Message]*amqp.Message // unsettled c2d messages
+
+	csmu  sync.RWMutex
+	csmux transport.ConnectionStateDispatcher
+
+	mconc int           // direct methods concurrency, unlimited when zero
+	msem  chan struct{} // running direct methods when limited
+
+	done chan struct{} // closed when the transport is closed
+	dial common.Dialer // custom dialer, nil when not set
+
+	frames transport.FrameTrace
+
+	logger common.Logger
+	debug  bool
+}
+
+func (tr *Transport) logf(level common.LogLevel, component, format string, v ...interface{}) {
+	if tr.logger == nil || level == common.LevelDebug && !tr.debug {
+		return
+	}
+	tr.logger.Logf(level, component, format, v...)
+}
+
+// SetFrameHandler implements transport.FrameTracer.
+func (tr *Transport) SetFrameHandler(fn transport.FrameHandler, limit int) {
+	tr.frames.SetFrameHandler(fn, limit)
+}
+
+// traceMessage reports the message transfer to the frame handler.
+func (tr *Transport) traceMessage(dir transport.Direction, addr string, am *amqp.Message) {
+	if !tr.frames.Enabled() {
+		return
+	}
+	var b []byte
+	if len(am.Data) != 0 {
+		b = am.Data[0]
+	}
+	props := make(map[string]string, len(am.ApplicationProperties)+len(am.Annotations)+2)
+	for k, v := range am.ApplicationProperties {
+		props[k] = fmt.Sprint(v)
+	}
+	for k, v := range am.Annotations {
+		props[fmt.Sprint(k)] = fmt.Sprint(v)
+	}
+	if p := am.Properties; p != nil {
+		if p.MessageID != nil {
+			props["message-id"] = fmt.Sprint(p.MessageID)
+		}
+		if p.CorrelationID != nil {
+			props["correlation-id"] = fmt.Sprint(p.CorrelationID)
+		}
+	}
+	tr.frames.Trace(dir, "transfer", addr, b, props)
+}
+
+// SetDialer implements transport.CustomDialer.
+func (tr *Transport) SetDialer(fn common.Dialer) {
+	tr.dial = fn
+}
+
+func (tr *Transport) errorf(format string, v ...interface{}) {
+	tr.logf(common.LevelError, common.ComponentTransport, format, v...)
+}
+
+func (tr *Transport) debugf(format string, v ...interface{}) {
+	tr.logf(common.LevelDebug, common.ComponentTransport, format, v...)
+}
+
+func (tr *Transport) Connect(ctx context.Context, creds transport.Credentials) error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.sess != nil {
+		return errors.New("already connected")
+	}
+
+	var sess *amqp.Session
+	var release func() error
+	var err error
+	if tr.pool != nil {
+		sess, release, err = tr.pool.session(ctx, creds, tr.dial)
+	} else {
+		sess, release, err = dial(ctx, creds, tr.dial)
+	}
+	if err != nil {
+		return err
+	}
+
+	tr.did = creds.DeviceID()
+	tr.mid = creds.ModuleID()
+	if creds.IsSAS() {
+		if err = tr.putToken(ctx, sess, creds); err != nil {
+			release()
+			return err
+		}
+	}
+
+	send, err := sess.NewSender(
+		amqp.LinkTargetAddress(tr.prefix() + "/messages/events"),
+	)
+	if err != nil {
+		release()
+		return err
+	}
+	if creds.IsSAS() {
+		// start renewing only when all links are up,
+		// otherwise it'd outlive the released session
+		go tr.renewToken(sess, creds)
+	}
+	tr.creds = creds
+	tr.sess = sess
+	tr.release = release
+	tr.send = send
+	tr.debugf("connection established")
+	tr.dispatchState(transport.ConnectionConnected, nil)
+	return nil
+}
+
+// dial opens a dedicated connection to the hub.
+func dial(ctx context.Context, creds transport.Credentials, fn common.Dialer) (*amqp.Session, func() error, error) {
+	conn, err := eventhub.DialContext(ctx, "amqps://"+broker(creds), creds.TLSConfig(), fn)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn.Sess(), conn.Close, nil
+}
+
+// broker returns the host to connect to, IoT Edge leaf devices and
+// modules connect to a gateway, but still authenticate against the hub itself.
+func broker(creds transport.Credentials) string {
+	if creds.GatewayHostName() != "" {
+		return creds.GatewayHostName()
+	}
+	return creds.Hostname()
+}
+
+// prefix returns links addresses prefix of the connected device or module.
+func (tr *Transport) prefix() string {
+	if tr.mid != "" {
+		return "/devices/" + tr.did + "/modules/" + tr.mid
+	}
+	return "/devices/" + tr.did
+}
+
+// putToken authorizes the device with a new SAS token.
+func (tr *Transport) putToken(ctx context.Context, sess *amqp.Session, creds transport.Credentials) error {
+	audience := creds.Hostname() + tr.prefix()
+	token, err := creds.Token(ctx, audience, tokenTTL)
+	if err != nil {
+		return err
+	}
+	return eventhub.PutToken(ctx, sess, audience, token)
+}
+
+// renewToken puts new tokens before the current ones expire.
+func (tr *Transport) renewToken(sess *amqp.Session, creds transport.Credentials) {
+	for {
+		select {
+		case <-time.After(tokenTTL - time.Minute):
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			err := tr.putToken(ctx, sess, creds)
+			cancel()
+			if err != nil {
+				tr.logf(common.LevelError, common.ComponentAuth, "token renewal error: %s", err)
+				tr.dispatchState(transport.ConnectionTokenExpired, err)
+				return
+			}
+			tr.debugf("token renewed")
+		case <-tr.done:
+			return
+		}
+	}
+}
+
+// Reauthenticate implements transport.Reauthenticator.
+func (tr *Transport) Reauthenticate(ctx context.Context) error {
+	tr.mu.RLock()
+	sess, creds := tr.sess, tr.creds
+	tr.mu.RUnlock()
+	if sess == nil || !creds.IsSAS() {
+		return nil
+	}
+	return tr.putToken(ctx, sess, creds)
+}
+
+func (tr *Transport) SubscribeConnectionState(ctx context.Context, mux transport.ConnectionStateDispatcher) error {
+	tr.csmu.Lock()
+	tr.csmux = mux
+	tr.csmu.Unlock()
+	return nil
+}
+
+func (tr *Transport) dispatchState(state transport.ConnectionState, err error) {
+	tr.csmu.RLock()
+	mux := tr.csmux
+	tr.csmu.RUnlock()
+	if mux != nil {
+		mux.Dispatch(state, err)
+	}
+}
+
+// lost reports that a link failed unless the transport is closed.
+func (tr *Transport) lost(err error) {
+	select {
+	case <-tr.done:
+		return
+	default:
+	}
+	tr.errorf("link error: %s", err)
+	tr.dispatchState(transport.ConnectionDisconnected, err)
+}
+
+// Ping implements transport.Pinger, the library doesn't expose
+// empty frames or flow exchanges, so the round trip is attaching
+// and detaching a telemetry sender link without sending anything.
+func (tr *Transport) Ping(ctx context.Context) error {
+	sess, err := tr.session()
+	if err != nil {
+		return err
+	}
+	addr := tr.prefix() + "/messages/events"
+	tr.frames.Trace(transport.Outbound, "attach", addr, nil, nil)
+	send, err := sess.NewSender(amqp.LinkTargetAddress(addr))
+	if err != nil {
+		return err
+	}
+	return send.Close(ctx)
+}
+
+func (tr *Transport) session() (*amqp.Session, error) {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	if tr.sess == nil {
+		return nil, errors.New("not connected")
+	}
+	return tr.sess, nil
+}
+
+// correlationLinks opens a pair of sender and receiver links
+// to addr that share the given correlation id.
+func (tr *Transport) correlationLinks(addr, correlationID string) (*amqp.Sender, *amqp.Receiver, error) {
+	sess, err := tr.session()
+	if err != nil {
+		return nil, nil, err
+	}
+	opts := []amqp.LinkOption{
+		amqp.LinkProperty("com.microsoft:api-version", common.APIVersion),
+		amqp.LinkProperty("com.microsoft:channel-correlation-id", correlationID),
+	}
+	send, err := sess.NewSender(append(opts, amqp.LinkTargetAddress(addr))...)
+	if err != nil {
+		return nil, nil, err
+	}
+	recv, err := sess.NewReceiver(append(opts, amqp.LinkSourceAddress(addr))...)
+	if err != nil {
+		send.Close(context.Background())
+		return nil, nil, err
+	}
+	return send, recv, nil
+}
+
+func (tr *Transport) SubscribeEvents(ctx context.Context, mux transport.MessageDispatcher) error {
+	sess, err := tr.session()
+	if err != nil {
+		return err
+	}
+
+	// modules receive messages routed to their inputs
+	addr := tr.prefix() + "/messages/devicebound"
+	if tr.mid != "" {
+		addr = tr.prefix() + "/messages/events"
+	}
+	recv, err := sess.NewReceiver(amqp.LinkSourceAddress(addr))
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer recv.Close(context.Background())
+		for {
+			am, err := recv.Receive(context.Background())
+			if err != nil {
+				tr.lost(err)
+				return
+			}
+			tr.traceMessage(transport.Inbound, addr, am)
+			if len(am.Data) == 0 {
+				am.Data = [][]byte{nil}
+			}
+			msg := commonamqp.FromAMQPMessage(am)
+			if name, ok := am.Annotations["x-opt-input-name"].(string); ok {
+				msg.InputName = name
+			}
+
+			tr.smu.Lock()
+			if tr.manual {
+				tr.msgs[msg] = am
+			} else {
+				am.Accept()
+			}
+			tr.smu.Unlock()
+			mux.Dispatch(msg)
+		}
+	}()
+	return nil
+}
+
+// SetManualSettlement implements transport.Settler.
+func (tr *Transport) SetManualSettlement(enable bool) {
+	tr.smu.Lock()
+	tr.manual = enable
+	tr.smu.Unlock()
+}
+
+// Settle implements transport.Settler.
+func (tr *Transport) Settle(ctx context.Context, msg *common.Message, s transport.Settlement) error {
+	tr.smu.Lock()
+	am, ok := tr.msgs[msg]
+	delete(tr.msgs, msg)
+	tr.smu.Unlock()
+	if !ok {
+		return errors.New("message is unknown or already settled")
+	}
+	switch s {
+	case transport.SettleComplete:
+		am.Accept()
+	case transport.SettleReject:
+		am.Reject(nil)
+	case transport.SettleAbandon:
+		am.Release()
+	default:
+		return fmt.Errorf("unknown settlement %d", s)
+	}
+	return nil
+}
+
+func (tr *Transport) RegisterDirectMethods(ctx context.Context, mux transport.MethodDispatcher) error {
+	addr := tr.prefix() + "/methods/devicebound"
+	send, recv, err := tr.correlationLinks(addr, "methods:"+tr.did)
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer send.Close(context.Background())
+		defer recv.Close(context.Background())
+		for {
+			req, err := recv.Receive(context.Background())
+			if err != nil {
+				tr.lost(err)
+				return
+			}
+			tr.traceMessage(transport.Inbound, addr, req)
+			req.Accept()
+			switch {
+			case tr.mconc == 1:
+				tr.handleMethod(send, req, mux)
+			case tr.msem != nil:
+				// stop receiving when the limit's reached
+				tr.msem <- struct{}{}
+				go func() {
+					defer func() { <-tr.msem }()
+					tr.handleMethod(send, req, mux)
+				}()
+			default:
+				go tr.handleMethod(send, req, mux)
+			}
+		}
+	}()
+	return nil
+}
+
+// SetMethodConcurrency implements transport.MethodConcurrencyLimiter,
+// the number of concurrent methods is not limited by default.
+func (tr *Transport) SetMethodConcurrency(n int) {
+	if n < 1 {
+		panic("concurrency must be positive")
+	}
+	tr.mconc = n
+	tr.msem = nil
+	if n > 1 {
+		tr.msem = make(chan struct{}, n)
+	}
+}
+
+func (tr *Transport) handleMethod(send *amqp.Sender, req *amqp.Message, mux transport.MethodDispatcher) {
+	method, _ := req.ApplicationProperties["IoThub-methodname"].(string)
+	if req.Properties == nil || method == "" {
+		tr.errorf("malformed method request")
+		return
+	}
+	var b []byte
+	if len(req.Data) != 0 {
+		b = req.Data[0]
+	}
+	rc, b, err := mux.Dispatch(method, b)
+	if err != nil {
+		tr.errorf("dispatch error: %s", err)
+		return
+	}
+	res := &amqp.Message{
+		Data: [][]byte{b},
+		Properties: &amqp.MessageProperties{
+			CorrelationID: req.Properties.CorrelationID,
+		},
+		ApplicationProperties: map[string]interface{}{
+			"IoThub-status": int32(rc),
+		},
+	}
+	tr.traceMessage(transport.Outbound, tr.prefix()+"/methods/devicebound", res)
+	if err = send.Send(context.Background(), res); err != nil {
+		tr.errorf("method response error: %s", err)
+	}
+}
+
+// enableTwin opens twin links once, responses are matched
+// to requests by correlation ids, the rest are desired state updates.
+func (tr *Transport) enableTwin() (*amqp.Sender, error) {
+	tr.tmu.Lock()
+	defer tr.tmu.Unlock()
+	if tr.tsend != nil {
+		return tr.tsend, nil
+	}
+	addr := tr.prefix() + "/twin"
+	send, recv, err := tr.correlationLinks(addr, "twin:"+tr.did)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		defer recv.Close(context.Background())
+		for {
+			msg, err := recv.Receive(context.Background())
+			if err != nil {
+				tr.lost(err)
+				return
+			}
+			tr.traceMessage(transport.Inbound, addr, msg)
+			msg.Accept()
+
+			var cid string
+			if msg.Properties != nil {
+				cid, _ = msg.Properties.CorrelationID.(string)
+			}
+			tr.tmu.Lock()
+			rc, ok := tr.resp[cid]
+			delete(tr.resp, cid)
+			mux := tr.tmux
+			tr.tmu.Unlock()
+			if ok {
+				rc <- msg
+				continue
+			}
+			if mux == nil || len(msg.Data) == 0 {
+				tr.logf(common.LevelWarn, common.ComponentTransport, "unknown twin message: %q", cid)
+				continue
+			}
+			mux.Dispatch(msg.Data[0])
+		}
+	}()
+	tr.tsend = send
+	return send, nil
+}
+
+// twinRequest sends a twin operation and waits for the response.
+func (tr *Transport) twinRequest(
+	ctx context.Context, operation, resource string, b []byte,
+) (*amqp.Message, error) {
+	send, err := tr.enableTwin()
+	if err != nil {
+		return nil, err
+	}
+	cid, err := eventhub.RandString()
+	if err != nil {
+		return nil, err
+	}
+	rc := make(chan *amqp.Message, 1)
+	tr.tmu.Lock()
+	tr.resp[cid] = rc
+	tr.tmu.Unlock()
+	defer func() {
+		tr.tmu.Lock()
+		delete(tr.resp, cid)
+		tr.tmu.Unlock()
+	}()
+
+	ann := amqp.Annotations{"operation": operation}
+	if resource != "" {
+		ann["resource"] = resource
+	}
+	msg := &amqp.Message{
+		Annotations: ann,
+		Properties:  &amqp.MessageProperties{CorrelationID: cid},
+	}
+	if b != nil {
+		msg.Data = [][]byte{b}
+	}
+	tr.traceMessage(transport.Outbound, tr.prefix()+"/twin", msg)
+	if err = send.Send(ctx, msg); err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-rc:
+		if err = checkTwinResponse(res); err != nil {
+			return nil, err
+		}
+		return res, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-tr.done:
+		return nil, errors.New("transport is closed")
+	}
+}
+
+// checkTwinResponse returns an error when the twin operation failed.
+func checkTwinResponse(msg *amqp.Message) error {
+	status, _ := msg.Annotations["status"].(int32)
+	if status >= 200 && status <= 299 {
+		return nil
+	}
+	var body []byte
+	if len(msg.Data) != 0 {
+		body = msg.Data[0]
+	}
+	return common.NewHubError(int(status), nil, body)
+}
+
+func (tr *Transport) SubscribeTwinUpdates(ctx context.Context, mux transport.TwinStateDispatcher) error {
+	tr.tmu.Lock()
+	tr.tmux = mux
+	tr.tmu.Unlock()
+	_, err := tr.twinRequest(ctx, "PUT", "/notifications/twin/properties/desired", nil)
+	return err
+}
+
+func (tr *Transport) RetrieveTwinProperties(ctx context.Context) ([]byte, error) {
+	res, err := tr.twinRequest(ctx, "GET", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Data) == 0 {
+		return nil, errors.New("twin response is empty")
+	}
+	return res.Data[0], nil
+}
+
+func (tr *Transport) UpdateTwinProperties(ctx context.Context, b []byte) (int, error) {
+	res, err := tr.twinRequest(ctx, "PATCH", "/properties/reported", b)
+	if err != nil {
+		return 0, err
+	}
+	ver, _ := res.Annotations["version"].(int64)
+	return int(ver), nil
+}
+
+func (tr *Transport) Send(ctx context.Context, msg *common.Message) error {
+	send, err := tr.sender()
+	if err != nil {
+		return err
+	}
+	am := eventMessage(msg)
+	tr.traceMessage(transport.Outbound, tr.prefix()+"/messages/events", am)
+	return commonamqp.FromAMQPError(send.Send(ctx, am))
+}
+
+// batchFormat is the message format of batched messages,
+// every data section of them is an encoded message.
+const batchFormat = 0x80013700
+
+// SendBatch implements transport.BatchSender, msgs are sent
+// as a single batched message the hub splits back.
+func (tr *Transport) SendBatch(ctx context.Context, msgs []*common.Message) error {
+	send, err := tr.sender()
+	if err != nil {
+		return err
+	}
+	am := &amqp.Message{Format: batchFormat, Data: make([][]byte, 0, len(msgs))}
+	for _, msg := range msgs {
+		b, err := eventMessage(msg).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		am.Data = append(am.Data, b)
+	}
+	tr.traceMessage(transport.Outbound, tr.prefix()+"/messages/events", am)
+	return commonamqp.FromAMQPError(send.Send(ctx, am))
+}
+
+// BatchSize implements transport.BatchSizer, it's the length of
+// the encoded msg plus its data section header.
+func (tr *Transport) BatchSize(msg *common.Message) int {
+	b, err := eventMessage(msg).MarshalBinary()
+	if err != nil {
+		return msg.Size()
+	}
+	if len(b) < 256 {
+		return len(b) + 5 // descriptor and vbin8 header
+	}
+	return len(b) + 8 // descriptor and vbin32 header
+}
+
+func (tr *Transport) sender() (*amqp.Sender, error) {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	if tr.send == nil {
+		return nil, errors.New("not connected")
+	}
+	return tr.send, nil
+}
+
+// eventMessage converts msg into a device-to-cloud message.
+func eventMessage(msg *common.Message) *amqp.Message {
+	am := commonamqp.ToAMQPMessage(msg)
+	if msg.OutputName != "" || msg.ComponentName != "" {
+		am.Annotations = amqp.Annotations{}
+		if msg.OutputName != "" {
+			am.Annotations["x-opt-output-name"] = msg.OutputName
+		}
+		if msg.ComponentName != "" {
+			am.Annotations["dt-subject"] = msg.ComponentName
+		}
+	}
+	return am
+}
+
+func (tr *Transport) Close() error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	select {
+	case <-tr.done:
+		return nil
+	default:
+		close(tr.done)
+	}
+	var err error
+	if tr.release != nil {
+		err = tr.release()
+		tr.debugf("disconnected")
+	}
+	tr.dispatchState(transport.ConnectionDisabled, nil)
+	return err
+}
@@ -0,0 +1,249 @@
+package amqp
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/iotdevice/transport"
+	"github.com/goautomotive/iothub/iotdevice/transport/transporttest"
+	"pack.ag/amqp"
+)
+
+func TestCheckTwinResponse(t *testing.T) {
+	t.Parallel()
+
+	for _, s := range []struct {
+		msg *amqp.Message
+		err string
+	}{
+		{&amqp.Message{Annotations: amqp.Annotations{"status": int32(200)}}, ""},
+		{&amqp.Message{Annotations: amqp.Annotations{"status": int32(204)}}, ""},
+		{&amqp.Message{
+			Annotations: amqp.Annotations{"status": int32(400)},
+			Data:        [][]byte{[]byte("bad request")},
+		}, `code = 400, desc = "bad request"`},
+		{&amqp.Message{}, `code = 0, desc = ""`},
+	} {
+		err := checkTwinResponse(s.msg)
+		if s.err == "" && err != nil || s.err != "" && (err == nil || err.Error() != s.err) {
+			t.Errorf("checkTwinResponse(%v) = %v, want %q", s.msg.Annotations, err, s.err)
+		}
+	}
+}
+
+func TestConnect(t *testing.T) {
+	t.Parallel()
+
+	b := newTestBroker(t)
+	tr := New(WithDialer(b.dial)).(*Transport)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tr.Connect(ctx, &transporttest.Credentials{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := <-b.tokens, "test.azure-devices.net/devices/dev"; got != want {
+		t.Errorf("token audience = %q, want %q", got, want)
+	}
+	want := []string{"$cbs", "$cbs", "/devices/dev/messages/events"}
+	if got := b.attached(); !reflect.DeepEqual(got, want) {
+		t.Errorf("attached links = %v, want %v", got, want)
+	}
+	if err := tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitClosed(t, b)
+}
+
+func TestConnectLinkError(t *testing.T) {
+	t.Parallel()
+
+	b := newTestBroker(t)
+	b.refuse = "/devices/dev/messages/events"
+	tr := New(WithDialer(b.dial)).(*Transport)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tr.Connect(ctx, &transporttest.Credentials{}); err == nil {
+		t.Fatal("Connect() = nil, want an error")
+	}
+
+	// the connection is released and the transport stays disconnected
+	waitClosed(t, b)
+	if err := tr.Send(ctx, &common.Message{}); err == nil {
+		t.Error("Send() = nil after failed Connect, want an error")
+	}
+}
+
+func TestSend(t *testing.T) {
+	t.Parallel()
+
+	b := newTestBroker(t)
+	tr := connectTestTransport(t, b)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tr.Send(ctx, &common.Message{
+		Payload:    []byte("hello"),
+		Properties: map[string]string{"k": "v"},
+		OutputName: "out",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-b.msgs
+	if msg.Addr != "/devices/dev/messages/events" || string(msg.Data) != "hello" ||
+		msg.AppProps["k"] != "v" || msg.Annotations["x-opt-output-name"] != "out" {
+		t.Errorf("sent message = %+v", msg)
+	}
+
+	if err := tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Send(ctx, &common.Message{}); err == nil {
+		t.Error("Send() on closed transport = nil, want an error")
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	t.Parallel()
+
+	b := newTestBroker(t)
+	tr := connectTestTransport(t, b)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tr.SendBatch(ctx, []*common.Message{
+		{Payload: []byte("a"), Properties: map[string]string{"k": "1"}},
+		{Payload: []byte("b"), OutputName: "out"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-b.msgs
+	if msg.Addr != "/devices/dev/messages/events" || msg.Format != batchFormat || len(msg.Sections) != 2 {
+		t.Fatalf("sent message = %+v", msg)
+	}
+	for i, want := range []string{"a", "b"} {
+		m, err := decodeMessage(msg.Sections[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(m.Data) != want {
+			t.Errorf("message %d: Data = %q, want %q", i, m.Data, want)
+		}
+	}
+	if m, _ := decodeMessage(msg.Sections[0]); m.AppProps["k"] != "1" {
+		t.Errorf("message 0: AppProps = %v, want k=1", m.AppProps)
+	}
+	if m, _ := decodeMessage(msg.Sections[1]); m.Annotations["x-opt-output-name"] != "out" {
+		t.Errorf("message 1: Annotations = %v, want x-opt-output-name=out", m.Annotations)
+	}
+}
+
+func TestBatchSize(t *testing.T) {
+	t.Parallel()
+
+	tr := New().(*Transport)
+	msgs := []*common.Message{
+		{Payload: []byte("a"), OutputName: "out"},
+		{Payload: make([]byte, 1000), Properties: map[string]string{"k": "v"}},
+	}
+	am := &amqp.Message{Format: batchFormat}
+	var n int
+	for _, msg := range msgs {
+		b, err := eventMessage(msg).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		am.Data = append(am.Data, b)
+		n += tr.BatchSize(msg)
+	}
+	b, err := am.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(b) {
+		t.Errorf("batch size = %d, want %d", n, len(b))
+	}
+}
+
+func TestSettle(t *testing.T) {
+	t.Parallel()
+
+	for _, s := range []struct {
+		manual bool
+		settle transport.Settlement
+		want   uint64
+	}{
+		{false, 0, codeAccepted},
+		{true, transport.SettleComplete, codeAccepted},
+		{true, transport.SettleReject, codeRejected},
+		{true, transport.SettleAbandon, codeReleased},
+	} {
+		b := newTestBroker(t)
+		tr := connectTestTransport(t, b)
+		tr.SetManualSettlement(s.manual)
+		msgc := make(chan *common.Message, 1)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := tr.SubscribeEvents(ctx, dispatchFunc(func(msg *common.Message) {
+			msgc <- msg
+		})); err != nil {
+			t.Fatal(err)
+		}
+		go b.send(0, "/devices/dev/messages/devicebound", &amqp.Message{Data: [][]byte{[]byte("c2d")}})
+
+		var msg *common.Message
+		select {
+		case msg = <-msgc:
+		case <-ctx.Done():
+			t.Fatal("message is not delivered")
+		}
+		if string(msg.Payload) != "c2d" {
+			t.Errorf("Payload = %q, want %q", msg.Payload, "c2d")
+		}
+		if s.manual {
+			if err := tr.Settle(ctx, msg, s.settle); err != nil {
+				t.Fatal(err)
+			}
+			if err := tr.Settle(ctx, msg, s.settle); err == nil {
+				t.Error("second Settle() = nil, want an error")
+			}
+		}
+		select {
+		case got := <-b.disps:
+			if got != s.want {
+				t.Errorf("manual = %t, settlement %d: outcome = %#x, want %#x", s.manual, s.settle, got, s.want)
+			}
+		case <-ctx.Done():
+			t.Fatalf("manual = %t, settlement %d: message is not settled", s.manual, s.settle)
+		}
+		cancel()
+	}
+}
+
+type dispatchFunc func(msg *common.Message)
+
+func (f dispatchFunc) Dispatch(msg *common.Message) {
+	f(msg)
+}
+
+// connectTestTransport returns a transport connected to b.
+func connectTestTransport(t *testing.T, b *testBroker) *Transport {
+	t.Helper()
+	tr := New(WithDialer(b.dial)).(*Transport)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tr.Connect(ctx, &transporttest.Credentials{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tr.Close() })
+	return tr
+}
+
+// waitClosed waits until the client closes its connection to b.
+func waitClosed(t *testing.T, b *testBroker) {
+	t.Helper()
+	select {
+	case <-b.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection is not closed")
+	}
+}
@@ -0,0 +1,610 @@
+package amqp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"pack.ag/amqp"
+)
+
+// AMQP 1.0 descriptors the test broker handles.
+const (
+	codeOpen        = 0x10
+	codeBegin       = 0x11
+	codeAttach      = 0x12
+	codeFlow        = 0x13
+	codeTransfer    = 0x14
+	codeDisposition = 0x15
+	codeDetach      = 0x16
+	codeEnd         = 0x17
+	codeClose       = 0x18
+	codeError       = 0x1d
+	codeAccepted    = 0x24
+	codeRejected    = 0x25
+	codeReleased    = 0x26
+	codeSource      = 0x28
+	codeTarget      = 0x29
+	codeAnnotations = 0x72
+	codeAppProps    = 0x74
+	codeData        = 0x75
+)
+
+// testBroker is a minimal AMQP 1.0 peer that serves a single connection
+// with a single session, it accepts put-token requests and records
+// messages sent to other links.
+type testBroker struct {
+	t  *testing.T
+	ln net.Listener
+
+	mu     sync.Mutex
+	conn   net.Conn
+	links  map[uint32]*testLink // by handle
+	sent   map[uint32]string    // addresses of deliveries sent to the client
+	addrs  []string             // attached links addresses
+	refuse string               // address attaching to which ends the session
+	ended  bool                 // the session is ended by the broker
+	nextID uint32               // next outgoing delivery id
+
+	tokens chan string       // put token audiences
+	msgs   chan *testMessage // messages received on non-cbs links
+	disps  chan uint64       // outcomes of deliveries settled by the client
+	closed chan struct{}     // closed when the client closes the connection
+}
+
+type testLink struct {
+	handle   uint32
+	addr     string
+	receiver bool          // the client's role
+	credit   chan struct{} // closed when the client issues credit
+	once     sync.Once
+}
+
+// testMessage is a decoded message, symbol keys are strings.
+type testMessage struct {
+	Addr        string
+	Format      uint64
+	Annotations map[interface{}]interface{}
+	AppProps    map[interface{}]interface{}
+	Data        []byte   // the first data section
+	Sections    [][]byte // all data sections
+}
+
+// described is a described AMQP value.
+type described struct {
+	code  uint64
+	value interface{}
+}
+
+// symbol is encoded as AMQP symbol instead of string.
+type symbol string
+
+func newTestBroker(t *testing.T) *testBroker {
+	t.Helper()
+	cert, err := testCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBroker{
+		t:      t,
+		ln:     ln,
+		links:  map[uint32]*testLink{},
+		sent:   map[uint32]string{},
+		tokens: make(chan string, 10),
+		msgs:   make(chan *testMessage, 10),
+		disps:  make(chan uint64, 10),
+		closed: make(chan struct{}),
+	}
+	t.Cleanup(func() {
+		ln.Close()
+		b.mu.Lock()
+		if b.conn != nil {
+			b.conn.Close()
+		}
+		b.mu.Unlock()
+	})
+	go b.serve()
+	return b
+}
+
+// testCertificate generates a self-signed certificate, clients skip verification.
+func testCertificate() (tls.Certificate, error) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	b, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"test.azure-devices.net"},
+		NotAfter:     time.Now().Add(time.Hour),
+	}, &x509.Certificate{SerialNumber: big.NewInt(1)}, pub, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{b}, PrivateKey: key}, nil
+}
+
+// dial connects to the broker whatever addr is.
+func (b *testBroker) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, b.ln.Addr().String())
+}
+
+// attached returns addresses of links attached so far.
+func (b *testBroker) attached() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.addrs...)
+}
+
+func (b *testBroker) serve() {
+	c, err := b.ln.Accept()
+	if err != nil {
+		return
+	}
+	b.mu.Lock()
+	b.conn = c
+	b.mu.Unlock()
+	defer c.Close()
+
+	hdr := make([]byte, 8)
+	if _, err = io.ReadFull(c, hdr); err != nil {
+		return
+	}
+	if _, err = c.Write(hdr); err != nil {
+		return
+	}
+	for {
+		ch, code, fields, payload, err := readFrame(c)
+		if err != nil {
+			return
+		}
+		if err = b.handle(ch, code, fields, payload); err != nil {
+			if err != io.EOF {
+				b.t.Errorf("broker: %s", err)
+			}
+			return
+		}
+	}
+}
+
+func (b *testBroker) handle(ch uint16, code uint64, f []interface{}, payload []byte) error {
+	switch code {
+	case codeOpen:
+		return b.write(ch, codeOpen, []interface{}{"broker"}, nil)
+	case codeBegin:
+		return b.write(ch, codeBegin, []interface{}{ch, uint32(0), uint32(5000), uint32(5000)}, nil)
+	case codeAttach:
+		l := &testLink{
+			handle:   uint32(field(f, 1).(uint64)),
+			receiver: field(f, 2).(bool),
+			credit:   make(chan struct{}),
+		}
+		terminus := field(f, 6)
+		if l.receiver {
+			terminus = field(f, 5)
+		}
+		if d, ok := terminus.(*described); ok {
+			if v, ok := field(d.value.([]interface{}), 0).(string); ok {
+				l.addr = v
+			}
+		}
+		b.mu.Lock()
+		b.links[l.handle] = l
+		b.addrs = append(b.addrs, l.addr)
+		refuse := b.refuse != "" && b.refuse == l.addr
+		b.ended = refuse
+		b.mu.Unlock()
+		if refuse {
+			return b.write(ch, codeEnd, []interface{}{
+				&described{codeError, []interface{}{symbol("amqp:not-found"), "refused"}},
+			}, nil)
+		}
+		if err := b.write(ch, codeAttach, []interface{}{
+			field(f, 0), l.handle, !l.receiver, nil, nil,
+			&described{codeSource, []interface{}{l.addr}},
+			&described{codeTarget, []interface{}{l.addr}},
+			nil, nil, uint32(0),
+		}, nil); err != nil {
+			return err
+		}
+		if l.receiver {
+			return nil
+		}
+		return b.write(ch, codeFlow, []interface{}{
+			uint32(0), uint32(5000), uint32(0), uint32(5000), l.handle, uint32(0), uint32(100),
+		}, nil)
+	case codeFlow:
+		if h, ok := field(f, 4).(uint64); ok {
+			if l := b.link(uint32(h)); l != nil {
+				l.once.Do(func() { close(l.credit) })
+			}
+		}
+		return nil
+	case codeTransfer:
+		l := b.link(uint32(field(f, 0).(uint64)))
+		if l == nil {
+			return errors.New("transfer to unknown link")
+		}
+		msg, err := decodeMessage(payload)
+		if err != nil {
+			return err
+		}
+		msg.Addr = l.addr
+		msg.Format, _ = field(f, 3).(uint64)
+		if l.addr == "$cbs" {
+			name, _ := msg.AppProps["name"].(string)
+			b.tokens <- name
+			go b.send(ch, "$cbs", &amqp.Message{
+				ApplicationProperties: map[string]interface{}{"status-code": int32(200)},
+			})
+		} else {
+			b.msgs <- msg
+		}
+		if settled, _ := field(f, 4).(bool); settled {
+			return nil
+		}
+		return b.write(ch, codeDisposition, []interface{}{
+			true, uint32(field(f, 1).(uint64)), nil, true, &described{codeAccepted, []interface{}{}},
+		}, nil)
+	case codeDisposition:
+		id := uint32(field(f, 1).(uint64))
+		b.mu.Lock()
+		addr := b.sent[id]
+		b.mu.Unlock()
+		if d, ok := field(f, 4).(*described); ok && addr != "$cbs" {
+			b.disps <- d.code
+		}
+		return nil
+	case codeDetach:
+		return b.write(ch, codeDetach, []interface{}{uint32(field(f, 0).(uint64)), true}, nil)
+	case codeEnd:
+		b.mu.Lock()
+		ended := b.ended
+		b.mu.Unlock()
+		if ended {
+			return nil
+		}
+		return b.write(ch, codeEnd, nil, nil)
+	case codeClose:
+		close(b.closed)
+		_ = b.write(ch, codeClose, nil, nil)
+		return io.EOF
+	default:
+		return fmt.Errorf("unexpected performative %#x", code)
+	}
+}
+
+func (b *testBroker) link(handle uint32) *testLink {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.links[handle]
+}
+
+// send delivers msg to the client's receiver attached to addr
+// once it issues credit, it returns the delivery id.
+func (b *testBroker) send(ch uint16, addr string, msg *amqp.Message) uint32 {
+	var l *testLink
+	for l == nil {
+		b.mu.Lock()
+		for _, v := range b.links {
+			if v.addr == addr && v.receiver {
+				l = v
+			}
+		}
+		b.mu.Unlock()
+		if l == nil {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	select {
+	case <-l.credit:
+	case <-b.closed:
+		return 0
+	}
+	p, err := msg.MarshalBinary()
+	if err != nil {
+		b.t.Error(err)
+		return 0
+	}
+	b.mu.Lock()
+	id := b.nextID
+	b.nextID++
+	b.sent[id] = addr
+	b.mu.Unlock()
+	tag := make([]byte, 4)
+	binary.BigEndian.PutUint32(tag, id)
+	if err = b.write(ch, codeTransfer, []interface{}{
+		l.handle, id, tag, uint32(0), false,
+	}, p); err != nil {
+		b.t.Error(err)
+	}
+	return id
+}
+
+func (b *testBroker) write(ch uint16, code uint64, fields []interface{}, payload []byte) error {
+	var body bytes.Buffer
+	encode(&body, &described{code, fields})
+	body.Write(payload)
+	hdr := make([]byte, 8)
+	binary.BigEndian.PutUint32(hdr, uint32(8+body.Len()))
+	hdr[4] = 2 // data offset in words
+	binary.BigEndian.PutUint16(hdr[6:], ch)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := b.conn.Write(append(hdr, body.Bytes()...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readFrame reads the next performative skipping empty frames.
+func readFrame(r io.Reader) (ch uint16, code uint64, fields []interface{}, payload []byte, err error) {
+	for {
+		hdr := make([]byte, 8)
+		if _, err = io.ReadFull(r, hdr); err != nil {
+			return 0, 0, nil, nil, err
+		}
+		b := make([]byte, binary.BigEndian.Uint32(hdr)-8)
+		if _, err = io.ReadFull(r, b); err != nil {
+			return 0, 0, nil, nil, err
+		}
+		b = b[int(hdr[4])*4-8:]
+		if len(b) == 0 {
+			continue // heartbeat
+		}
+		br := bytes.NewReader(b)
+		v, err := decode(br)
+		if err != nil {
+			return 0, 0, nil, nil, err
+		}
+		d, ok := v.(*described)
+		if !ok {
+			return 0, 0, nil, nil, fmt.Errorf("performative is %T", v)
+		}
+		fields, _ = d.value.([]interface{})
+		payload = b[len(b)-br.Len():]
+		return binary.BigEndian.Uint16(hdr[6:]), d.code, fields, payload, nil
+	}
+}
+
+// field returns the i-th list field, nil when it's omitted.
+func field(f []interface{}, i int) interface{} {
+	if i < len(f) {
+		return f[i]
+	}
+	return nil
+}
+
+func decodeMessage(b []byte) (*testMessage, error) {
+	msg := &testMessage{}
+	r := bytes.NewReader(b)
+	for r.Len() != 0 {
+		v, err := decode(r)
+		if err != nil {
+			return nil, err
+		}
+		d, ok := v.(*described)
+		if !ok {
+			return nil, fmt.Errorf("message section is %T", v)
+		}
+		switch d.code {
+		case codeAnnotations:
+			msg.Annotations, _ = d.value.(map[interface{}]interface{})
+		case codeAppProps:
+			msg.AppProps, _ = d.value.(map[interface{}]interface{})
+		case codeData:
+			b, _ := d.value.([]byte)
+			if msg.Sections == nil {
+				msg.Data = b
+			}
+			msg.Sections = append(msg.Sections, b)
+		}
+	}
+	return msg, nil
+}
+
+func encode(w *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		w.WriteByte(0x40)
+	case bool:
+		if v {
+			w.WriteByte(0x41)
+		} else {
+			w.WriteByte(0x42)
+		}
+	case uint16:
+		w.WriteByte(0x60)
+		_ = binary.Write(w, binary.BigEndian, v)
+	case uint32:
+		w.WriteByte(0x70)
+		_ = binary.Write(w, binary.BigEndian, v)
+	case uint64:
+		w.WriteByte(0x80)
+		_ = binary.Write(w, binary.BigEndian, v)
+	case string:
+		w.WriteByte(0xb1)
+		_ = binary.Write(w, binary.BigEndian, uint32(len(v)))
+		w.WriteString(v)
+	case symbol:
+		w.WriteByte(0xb3)
+		_ = binary.Write(w, binary.BigEndian, uint32(len(v)))
+		w.WriteString(string(v))
+	case []byte:
+		w.WriteByte(0xb0)
+		_ = binary.Write(w, binary.BigEndian, uint32(len(v)))
+		w.Write(v)
+	case []interface{}:
+		var b bytes.Buffer
+		for _, e := range v {
+			encode(&b, e)
+		}
+		w.WriteByte(0xd0)
+		_ = binary.Write(w, binary.BigEndian, uint32(4+b.Len()))
+		_ = binary.Write(w, binary.BigEndian, uint32(len(v)))
+		w.Write(b.Bytes())
+	case *described:
+		// descriptors are small ulongs, the library doesn't accept others
+		w.Write([]byte{0x00, 0x53, byte(v.code)})
+		encode(w, v.value)
+	default:
+		panic(fmt.Sprintf("cannot encode %T", v))
+	}
+}
+
+func decode(r *bytes.Reader) (interface{}, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if c == 0x00 {
+		desc, err := decode(r)
+		if err != nil {
+			return nil, err
+		}
+		v, err := decode(r)
+		if err != nil {
+			return nil, err
+		}
+		code, _ := desc.(uint64)
+		return &described{code, v}, nil
+	}
+	return decodeValue(r, c)
+}
+
+func decodeValue(r *bytes.Reader, c byte) (interface{}, error) {
+	n := func(size int) ([]byte, error) {
+		b := make([]byte, size)
+		_, err := io.ReadFull(r, b)
+		return b, err
+	}
+	size := func(wide bool) (int, error) {
+		if !wide {
+			b, err := r.ReadByte()
+			return int(b), err
+		}
+		b, err := n(4)
+		if err != nil {
+			return 0, err
+		}
+		return int(binary.BigEndian.Uint32(b)), nil
+	}
+	switch c {
+	case 0x40:
+		return nil, nil
+	case 0x41:
+		return true, nil
+	case 0x42:
+		return false, nil
+	case 0x56:
+		b, err := r.ReadByte()
+		return b != 0, err
+	case 0x43, 0x44:
+		return uint64(0), nil
+	case 0x50, 0x52, 0x53:
+		b, err := r.ReadByte()
+		return uint64(b), err
+	case 0x51, 0x54, 0x55:
+		b, err := r.ReadByte()
+		return int64(int8(b)), err
+	case 0x60:
+		b, err := n(2)
+		return uint64(binary.BigEndian.Uint16(b)), err
+	case 0x61:
+		b, err := n(2)
+		return int64(int16(binary.BigEndian.Uint16(b))), err
+	case 0x70:
+		b, err := n(4)
+		return uint64(binary.BigEndian.Uint32(b)), err
+	case 0x71:
+		b, err := n(4)
+		return int64(int32(binary.BigEndian.Uint32(b))), err
+	case 0x72, 0x73:
+		return n(4)
+	case 0x80:
+		b, err := n(8)
+		return binary.BigEndian.Uint64(b), err
+	case 0x81, 0x83:
+		b, err := n(8)
+		return int64(binary.BigEndian.Uint64(b)), err
+	case 0x82:
+		return n(8)
+	case 0x98:
+		return n(16)
+	case 0xa0, 0xb0, 0xa1, 0xb1, 0xa3, 0xb3:
+		l, err := size(c&0xf0 == 0xb0)
+		if err != nil {
+			return nil, err
+		}
+		b, err := n(l)
+		if err != nil || c == 0xa0 || c == 0xb0 {
+			return b, err
+		}
+		return string(b), nil
+	case 0x45:
+		return []interface{}{}, nil
+	case 0xc0, 0xd0, 0xc1, 0xd1:
+		wide := c&0xf0 == 0xd0
+		if _, err := size(wide); err != nil {
+			return nil, err
+		}
+		count, err := size(wide)
+		if err != nil {
+			return nil, err
+		}
+		l := make([]interface{}, count)
+		for i := range l {
+			if l[i], err = decode(r); err != nil {
+				return nil, err
+			}
+		}
+		if c == 0xc0 || c == 0xd0 {
+			return l, nil
+		}
+		m := make(map[interface{}]interface{}, count/2)
+		for i := 0; i+1 < len(l); i += 2 {
+			m[l[i]] = l[i+1]
+		}
+		return m, nil
+	case 0xe0, 0xf0:
+		wide := c == 0xf0
+		if _, err := size(wide); err != nil {
+			return nil, err
+		}
+		count, err := size(wide)
+		if err != nil {
+			return nil, err
+		}
+		ec, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		l := make([]interface{}, count)
+		for i := range l {
+			if l[i], err = decodeValue(r, ec); err != nil {
+				return nil, err
+			}
+		}
+		return l, nil
+	default:
+		return nil, fmt.Errorf("unsupported constructor %#x", c)
+	}
+}
@@ -0,0 +1,115 @@
+package amqp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/eventhub"
+	"github.com/goautomotive/iothub/iotdevice/transport"
+	"pack.ag/amqp"
+)
+
+// ClientPool shares a single AMQP connection between many device
+// identities, every device gets its own session authorized with its
+// own SAS token, that's useful for simulating lots of devices.
+//
+//	pool := amqp.NewClientPool()
+//	defer pool.Close()
+//	for _, cs := range connectionStrings {
+//		c, err := iotdevice.NewClient(
+//			iotdevice.WithTransport(pool.Transport()),
+//			iotdevice.WithConnectionString(cs),
+//		)
+//		...
+//	}
+//
+// The connection is opened with the first connecting device, all the
+// rest have to belong to the same hub. X.509 authentication is not
+// supported since certificates are bound to the connection.
+type ClientPool struct {
+	mu   sync.Mutex
+	conn *amqp.Client
+	host string
+	n    int // number of open sessions
+	done bool
+}
+
+// NewClientPool creates a new connection pool,
+// the connection is established lazily.
+func NewClientPool() *ClientPool {
+	return &ClientPool{}
+}
+
+// Transport returns a new transport that uses the pool's connection.
+func (p *ClientPool) Transport(opts ...TransportOption) transport.Transport {
+	tr := New(opts...).(*Transport)
+	tr.pool = p
+	return tr
+}
+
+// Len returns the number of devices using the connection.
+func (p *ClientPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.n
+}
+
+// session opens a new session for the device, dialing the hub when needed.
+// The connection is dialed with fn when it's not nil.
+func (p *ClientPool) session(ctx context.Context, creds transport.Credentials, fn common.Dialer) (*amqp.Session, func() error, error) {
+	if !creds.IsSAS() {
+		return nil, nil, errors.New("pooled connections support only sas authentication")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done {
+		return nil, nil, errors.New("pool is closed")
+	}
+	host := broker(creds)
+	if p.conn == nil {
+		conn, err := eventhub.DialAMQP(ctx, "amqps://"+host, creds.TLSConfig(), fn)
+		if err != nil {
+			return nil, nil, err
+		}
+		p.conn = conn
+		p.host = host
+	} else if host != p.host {
+		return nil, nil, fmt.Errorf("pool is connected to %q, not %q", p.host, host)
+	}
+
+	sess, err := p.conn.NewSession()
+	if err != nil {
+		return nil, nil, err
+	}
+	p.n++
+
+	var once sync.Once
+	return sess, func() error {
+		var err error
+		once.Do(func() {
+			p.mu.Lock()
+			p.n--
+			p.mu.Unlock()
+			err = sess.Close(context.Background())
+		})
+		return err
+	}, nil
+}
+
+// Close closes the connection along with all transports using it.
+func (p *ClientPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done {
+		return nil
+	}
+	p.done = true
+	if p.conn == nil {
+		return nil
+	}
+	return p.conn.Close()
+}
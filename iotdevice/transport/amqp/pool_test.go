@@ -0,0 +1,29 @@
+package amqp
+
+import (
+	"context"
+	"testing"
+
+	"github.com/goautomotive/iothub/iotdevice/transport/transporttest"
+)
+
+func TestClientPoolSession(t *testing.T) {
+	t.Parallel()
+
+	p := NewClientPool()
+	if _, _, err := p.session(context.Background(), &transporttest.Credentials{X509: true}, nil); err == nil {
+		t.Error("session(x509) = nil, want an error")
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := p.session(context.Background(), &transporttest.Credentials{}, nil); err == nil {
+		t.Error("session() on closed pool = nil, want an error")
+	}
+	if err := p.Transport().Connect(context.Background(), &transporttest.Credentials{}); err == nil {
+		t.Error("Connect() on closed pool = nil, want an error")
+	}
+	if n := p.Len(); n != 0 {
+		t.Errorf("Len() = %d, want 0", n)
+	}
+}
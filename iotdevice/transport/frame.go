@@ -0,0 +1,104 @@
+package transport
+
+import (
+	"sync"
+)
+
+// Direction is a frame direction.
+type Direction int
+
+const (
+	// Outbound frames are sent to the hub.
+	Outbound Direction = iota + 1
+
+	// Inbound frames are received from the hub.
+	Inbound
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Outbound:
+		return "out"
+	case Inbound:
+		return "in"
+	default:
+		return "unknown"
+	}
+}
+
+// Frame is a protocol frame as a transport sends or receives it,
+// e.g. an MQTT PUBLISH packet or an AMQP message transfer.
+type Frame struct {
+	Direction Direction
+	Type      string // PUBLISH, SUBSCRIBE for MQTT or transfer for AMQP
+	Address   string // MQTT topic or AMQP link address
+	Size      int    // payload size
+
+	// Payload is truncated to the frame tracer limit.
+	Payload []byte
+
+	// Properties are AMQP application properties and annotations,
+	// MQTT encodes them into topics.
+	Properties map[string]string
+}
+
+// FrameHandler receives traced frames, it's called synchronously
+// by transports, so it has to be quick.
+type FrameHandler func(f *Frame)
+
+// FrameTracer is implemented by transports that can
+// report frames they send and receive for debugging.
+type FrameTracer interface {
+	// SetFrameHandler makes the transport report frames to fn,
+	// payloads are truncated to limit bytes.
+	SetFrameHandler(fn FrameHandler, limit int)
+}
+
+// FrameTrace is a helper for implementing FrameTracer,
+// its zero value doesn't trace anything.
+type FrameTrace struct {
+	mu    sync.RWMutex
+	fn    FrameHandler
+	limit int
+}
+
+// SetFrameHandler implements FrameTracer.
+func (t *FrameTrace) SetFrameHandler(fn FrameHandler, limit int) {
+	if limit < 0 {
+		panic("limit is negative")
+	}
+	t.mu.Lock()
+	t.fn, t.limit = fn, limit
+	t.mu.Unlock()
+}
+
+// Enabled reports whether there's a handler, that's useful
+// for skipping collecting properties when there's none.
+func (t *FrameTrace) Enabled() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.fn != nil
+}
+
+// Trace reports a frame to the handler when it's set,
+// the payload is copied, so it can be reused afterwards.
+func (t *FrameTrace) Trace(dir Direction, typ, addr string, payload []byte, props map[string]string) {
+	t.mu.RLock()
+	fn, limit := t.fn, t.limit
+	t.mu.RUnlock()
+	if fn == nil {
+		return
+	}
+	n := len(payload)
+	if n > limit {
+		n = limit
+	}
+	fn(&Frame{
+		Direction:  dir,
+		Type:       typ,
+		Address:    addr,
+		Size:       len(payload),
+		Payload:    append([]byte(nil), payload[:n]...),
+		Properties: props,
+	})
+}
@@ -0,0 +1,36 @@
+package transport
+
+import (
+	"testing"
+)
+
+func TestFrameTrace(t *testing.T) {
+	t.Parallel()
+
+	var ft FrameTrace
+	ft.Trace(Outbound, "PUBLISH", "a", []byte("b"), nil) // no-op
+	if ft.Enabled() {
+		t.Fatal("Enabled() = true without a handler")
+	}
+
+	var got *Frame
+	ft.SetFrameHandler(func(f *Frame) {
+		got = f
+	}, 3)
+	b := []byte("hello")
+	ft.Trace(Inbound, "transfer", "/messages/devicebound", b, map[string]string{"k": "v"})
+	if got == nil {
+		t.Fatal("frame is not traced")
+	}
+	if got.Direction != Inbound || got.Type != "transfer" ||
+		got.Address != "/messages/devicebound" || got.Properties["k"] != "v" {
+		t.Errorf("frame = %+v", got)
+	}
+	if got.Size != 5 || string(got.Payload) != "hel" {
+		t.Errorf("size, payload = %d, %q, want 5, %q", got.Size, got.Payload, "hel")
+	}
+	b[0] = 'j'
+	if string(got.Payload) != "hel" {
+		t.Error("payload is not copied")
+	}
+}
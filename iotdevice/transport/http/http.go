@@ -0,0 +1,559 @@
+// Package http implements the HTTPS device transport.
+//
+// It's meant for devices that can reach the hub only over HTTPS, e.g.
+// behind gateways blocking everything else. Cloud-to-device messages
+// are polled, direct methods and twins are not supported by the hub.
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	gohttp "net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/iotdevice/transport"
+)
+
+const (
+	// DefaultPollInterval is how often cloud-to-device messages are polled,
+	// the hub recommends not to poll more than once in 25 minutes.
+	DefaultPollInterval = 25 * time.Minute
+
+	// DefaultLockTimeout is the default hub's cloud-to-device message lock timeout.
+	DefaultLockTimeout = time.Minute
+)
+
+// appPrefix is the prefix of headers carrying application properties.
+const appPrefix = "iothub-app-"
+
+// creationTimeProperty is the application property carrying the message
+// creation time, there's no dedicated system property for it over HTTPS.
+const creationTimeProperty = "iothub-creation-time-utc"
+
+// ErrNotSupported is returned by features unavailable over HTTPS.
+var ErrNotSupported = errors.New("not supported by http transport")
+
+// TransportOption is a transport configuration option.
+type TransportOption func(tr *Transport)
+
+// WithLogger sets logger for errors and warnings
+// plus debug messages when it's enabled.
+func WithLogger(l *log.Logger) TransportOption {
+	return WithStructuredLogger(common.NewStdLogger(l))
+}
+
+// WithStructuredLogger is same as WithLogger but accepts a leveled logger.
+func WithStructuredLogger(l common.Logger) TransportOption {
+	return func(tr *Transport) {
+		tr.logger = l
+	}
+}
+
+// WithDebug enables debug mode.
+// All debug messages are written to the logger.
+func WithDebug(enable bool) TransportOption {
+	return func(tr *Transport) {
+		tr.debug = enable
+	}
+}
+
+// WithPollInterval sets the interval of polling cloud-to-device messages,
+// the queue is drained completely on each poll.
+func WithPollInterval(d time.Duration) TransportOption {
+	if d <= 0 {
+		panic("d must be positive")
+	}
+	return func(tr *Transport) {
+		tr.poll = d
+	}
+}
+
+// WithLockTimeout sets the cloud-to-device message lock timeout configured
+// on the hub, messages settled manually after it are redelivered
+// by the hub, so settling them fails.
+func WithLockTimeout(d time.Duration) TransportOption {
+	if d <= 0 {
+		panic("d must be positive")
+	}
+	return func(tr *Transport) {
+		tr.lock = d
+	}
+}
+
+// WithDialer sets the function for establishing connections to the hub.
+func WithDialer(fn common.Dialer) TransportOption {
+	if fn == nil {
+		panic("fn is nil")
+	}
+	return func(tr *Transport) {
+		tr.dial = fn
+	}
+}
+
+// New returns new HTTPS transport.
+// See more: https://docs.microsoft.com/en-us/rest/api/iothub/device
+func New(opts ...TransportOption) transport.Transport {
+	tr := &Transport{
+		poll: DefaultPollInterval,
+		lock: DefaultLockTimeout,
+		done: make(chan struct{}),
+		msgs: map[*common.Message]*lockedMessage{},
+	}
+	for _, opt := range opts {
+		opt(tr)
+	}
+	return tr
+}
+
+type Transport struct {
+	mu    sync.RWMutex
+	creds transport.Credentials
+	host  string
+	http  *gohttp.Client
+
+	poll time.Duration
+	lock time.Duration
+
+	smu    sync.Mutex
+	manual bool                               // manual c2d messages settlement
+	msgs   map[*common.Message]*lockedMessage // unsettled c2d messages
+
+	csmu  sync.RWMutex
+	csmux transport.ConnectionStateDispatcher
+
+	done chan struct{} // closed when the transport is closed
+	dial common.Dialer // custom dialer, nil when not set
+
+	logger common.Logger
+	debug  bool
+}
+
+// lockedMessage is a received message waiting for settlement.
+type lockedMessage struct {
+	etag string
+	recv time.Time
+}
+
+func (tr *Transport) logf(level common.LogLevel, component, format string, v ...interface{}) {
+	if tr.logger == nil || level == common.LevelDebug && !tr.debug {
+		return
+	}
+	tr.logger.Logf(level, component, format, v...)
+}
+
+// SetDialer implements transport.CustomDialer.
+func (tr *Transport) SetDialer(fn common.Dialer) {
+	tr.dial = fn
+}
+
+func (tr *Transport) errorf(format string, v ...interface{}) {
+	tr.logf(common.LevelError, common.ComponentTransport, format, v...)
+}
+
+func (tr *Transport) debugf(format string, v ...interface{}) {
+	tr.logf(common.LevelDebug, common.ComponentTransport, format, v...)
+}
+
+// Connect only configures the transport, because
+// HTTPS requests are made independently from each other.
+func (tr *Transport) Connect(ctx context.Context, creds transport.Credentials) error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.creds != nil {
+		return errors.New("already connected")
+	}
+	if creds.ModuleID() != "" {
+		return errors.New("modules are not supported by http transport")
+	}
+	tr.creds = creds
+	tr.host = creds.Hostname()
+	if creds.GatewayHostName() != "" {
+		tr.host = creds.GatewayHostName()
+	}
+	tr.http = &gohttp.Client{
+		Transport: &gohttp.Transport{
+			Proxy:           gohttp.ProxyFromEnvironment,
+			TLSClientConfig: creds.TLSConfig(),
+			DialContext:     tr.dial,
+		},
+	}
+	tr.dispatchState(transport.ConnectionConnected, nil)
+	return nil
+}
+
+func (tr *Transport) SubscribeConnectionState(ctx context.Context, mux transport.ConnectionStateDispatcher) error {
+	tr.csmu.Lock()
+	tr.csmux = mux
+	tr.csmu.Unlock()
+	return nil
+}
+
+func (tr *Transport) dispatchState(state transport.ConnectionState, err error) {
+	tr.csmu.RLock()
+	mux := tr.csmux
+	tr.csmu.RUnlock()
+	if mux != nil {
+		mux.Dispatch(state, err)
+	}
+}
+
+// request makes a REST request to the device resource on the hub.
+func (tr *Transport) request(
+	ctx context.Context, method, path, query string, header gohttp.Header, b []byte,
+) (*gohttp.Response, []byte, error) {
+	tr.mu.RLock()
+	creds, host, client := tr.creds, tr.host, tr.http
+	tr.mu.RUnlock()
+	if creds == nil {
+		return nil, nil, errors.New("not connected")
+	}
+
+	uri := "https://" + host + "/devices/" + url.PathEscape(creds.DeviceID()) +
+		path + "?api-version=" + common.APIVersion
+	if query != "" {
+		uri += "&" + query
+	}
+	var r io.Reader
+	if b != nil {
+		r = bytes.NewReader(b)
+	}
+	req, err := gohttp.NewRequest(method, uri, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if creds.IsSAS() {
+		sas, err := creds.Token(ctx, creds.Hostname()+"/devices/"+url.PathEscape(creds.DeviceID()), time.Hour)
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Authorization", sas)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	tr.debugf("%s %s %d: %s", method, uri, res.StatusCode, body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, nil, common.NewHubError(res.StatusCode, res.Header, body)
+	}
+	return res, body, nil
+}
+
+// messageHeaders returns system and application properties of msg as headers.
+func messageHeaders(msg *common.Message) gohttp.Header {
+	h := make(gohttp.Header, len(msg.Properties)+5)
+	if msg.MessageID != "" {
+		h.Set("iothub-messageid", msg.MessageID)
+	}
+	if msg.CorrelationID != "" {
+		h.Set("iothub-correlationid", msg.CorrelationID)
+	}
+	if msg.UserID != "" {
+		h.Set("iothub-userid", msg.UserID)
+	}
+	if msg.To != "" {
+		h.Set("iothub-to", msg.To)
+	}
+	if msg.ContentType != "" {
+		h.Set("iothub-contenttype", msg.ContentType)
+	}
+	if msg.ContentEncoding != "" {
+		h.Set("iothub-contentencoding", msg.ContentEncoding)
+	}
+	if t, ok := msg.Expiry(); ok {
+		h.Set("iothub-expiry", t.UTC().Format(time.RFC3339))
+	}
+	for k, v := range appProperties(msg) {
+		h.Set(appPrefix+k, v)
+	}
+	return h
+}
+
+// appProperties returns application properties of msg including its creation time.
+func appProperties(msg *common.Message) map[string]string {
+	t, ok := msg.Created()
+	if !ok {
+		return msg.Properties
+	}
+	m := make(map[string]string, len(msg.Properties)+1)
+	for k, v := range msg.Properties {
+		m[k] = v
+	}
+	m[creationTimeProperty] = t.UTC().Format(time.RFC3339)
+	return m
+}
+
+func (tr *Transport) Send(ctx context.Context, msg *common.Message) error {
+	h := messageHeaders(msg)
+	h.Set("Content-Type", "application/octet-stream")
+	_, _, err := tr.request(ctx, gohttp.MethodPost, "/messages/events", "", h, msg.Payload)
+	return err
+}
+
+// batchMessage is a message in the JSON batch body.
+type batchMessage struct {
+	Body       []byte            `json:"body"`
+	Base64     bool              `json:"base64Encoded"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+// encodeBatch encodes msgs into the hub's batch format.
+func encodeBatch(msgs []*common.Message) ([]byte, error) {
+	v := make([]*batchMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		// only application properties can be set on batched messages
+		v = append(v, &batchMessage{Body: msg.Payload, Base64: true, Properties: appProperties(msg)})
+	}
+	return json.Marshal(v)
+}
+
+// BatchSize implements transport.BatchSizer, it's the length of
+// the msg's batchMessage encoding plus its separator.
+func (tr *Transport) BatchSize(msg *common.Message) int {
+	n := len(`,{"body":"","base64Encoded":true}`) + base64.StdEncoding.EncodedLen(len(msg.Payload))
+	if p := appProperties(msg); len(p) != 0 {
+		b, err := json.Marshal(p)
+		if err != nil {
+			return msg.Size()
+		}
+		n += len(`,"properties":`) + len(b)
+	}
+	return n
+}
+
+// SendBatch implements transport.BatchSender.
+func (tr *Transport) SendBatch(ctx context.Context, msgs []*common.Message) error {
+	b, err := encodeBatch(msgs)
+	if err != nil {
+		return err
+	}
+	h := gohttp.Header{}
+	h.Set("Content-Type", "application/vnd.microsoft.iothub.json")
+	_, _, err = tr.request(ctx, gohttp.MethodPost, "/messages/events", "", h, b)
+	return err
+}
+
+// SubscribeEvents starts polling cloud-to-device messages.
+func (tr *Transport) SubscribeEvents(ctx context.Context, mux transport.MessageDispatcher) error {
+	tr.mu.RLock()
+	connected := tr.creds != nil
+	tr.mu.RUnlock()
+	if !connected {
+		return errors.New("not connected")
+	}
+	go func() {
+		for {
+			if err := tr.drain(mux); err != nil {
+				tr.errorf("cloud-to-device poll error: %s", err)
+			}
+			select {
+			case <-time.After(tr.poll):
+			case <-tr.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// drain receives messages until the queue is empty.
+func (tr *Transport) drain(mux transport.MessageDispatcher) error {
+	tr.expire()
+	for {
+		select {
+		case <-tr.done:
+			return nil
+		default:
+		}
+		msg, etag, err := tr.receive(context.Background())
+		if err != nil || msg == nil {
+			return err
+		}
+
+		tr.smu.Lock()
+		manual := tr.manual
+		if manual {
+			tr.msgs[msg] = &lockedMessage{etag: etag, recv: time.Now()}
+		}
+		tr.smu.Unlock()
+		if !manual {
+			if err = tr.settle(context.Background(), etag, transport.SettleComplete); err != nil {
+				return err
+			}
+		}
+		mux.Dispatch(msg)
+	}
+}
+
+// expire forgets unsettled messages with expired locks.
+func (tr *Transport) expire() {
+	tr.smu.Lock()
+	defer tr.smu.Unlock()
+	for msg, lm := range tr.msgs {
+		if time.Since(lm.recv) > tr.lock {
+			delete(tr.msgs, msg)
+		}
+	}
+}
+
+// receive fetches the next cloud-to-device message and its lock token,
+// nil message means the queue is empty.
+func (tr *Transport) receive(ctx context.Context) (*common.Message, string, error) {
+	res, b, err := tr.request(ctx, gohttp.MethodGet, "/messages/deviceBound", "", nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if res.StatusCode == gohttp.StatusNoContent {
+		return nil, "", nil
+	}
+	msg, err := parseMessage(res.Header, b)
+	if err != nil {
+		return nil, "", err
+	}
+	return msg, strings.Trim(res.Header.Get("ETag"), `"`), nil
+}
+
+// parseMessage turns a received response into a message.
+func parseMessage(h gohttp.Header, b []byte) (*common.Message, error) {
+	if strings.Trim(h.Get("ETag"), `"`) == "" {
+		return nil, errors.New("message lock token is missing")
+	}
+	msg := &common.Message{
+		Payload:         b,
+		MessageID:       h.Get("iothub-messageid"),
+		CorrelationID:   h.Get("iothub-correlationid"),
+		UserID:          h.Get("iothub-userid"),
+		To:              h.Get("iothub-to"),
+		ContentType:     h.Get("iothub-contenttype"),
+		ContentEncoding: h.Get("iothub-contentencoding"),
+		Properties:      map[string]string{},
+	}
+	if s := h.Get("iothub-expiry"); s != "" {
+		t, err := parseTime(s)
+		if err != nil {
+			return nil, err
+		}
+		msg.ExpiryTime = &t
+	}
+	if s := h.Get("iothub-enqueuedtime"); s != "" {
+		t, err := parseTime(s)
+		if err != nil {
+			return nil, err
+		}
+		msg.EnqueuedTime = &t
+	}
+	for k := range h {
+		lk := strings.ToLower(k)
+		if !strings.HasPrefix(lk, appPrefix) {
+			continue
+		}
+		if lk[len(appPrefix):] == creationTimeProperty {
+			t, err := parseTime(h.Get(k))
+			if err != nil {
+				return nil, err
+			}
+			msg.CreationTime = &t
+			continue
+		}
+		msg.Properties[lk[len(appPrefix):]] = h.Get(k)
+	}
+	return msg, nil
+}
+
+// parseTime parses timestamps that the hub may send in different formats.
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, time.RFC1123, time.RFC1123Z} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("malformed time %q", s)
+}
+
+// SetManualSettlement implements transport.Settler.
+func (tr *Transport) SetManualSettlement(enable bool) {
+	tr.smu.Lock()
+	tr.manual = enable
+	tr.smu.Unlock()
+}
+
+// Settle implements transport.Settler.
+func (tr *Transport) Settle(ctx context.Context, msg *common.Message, s transport.Settlement) error {
+	tr.smu.Lock()
+	lm, ok := tr.msgs[msg]
+	delete(tr.msgs, msg)
+	tr.smu.Unlock()
+	if !ok {
+		return errors.New("message is unknown or already settled")
+	}
+	if time.Since(lm.recv) > tr.lock {
+		return errors.New("message lock has expired")
+	}
+	return tr.settle(ctx, lm.etag, s)
+}
+
+func (tr *Transport) settle(ctx context.Context, etag string, s transport.Settlement) error {
+	path := "/messages/deviceBound/" + url.PathEscape(etag)
+	var err error
+	switch s {
+	case transport.SettleComplete:
+		_, _, err = tr.request(ctx, gohttp.MethodDelete, path, "", nil, nil)
+	case transport.SettleReject:
+		_, _, err = tr.request(ctx, gohttp.MethodDelete, path, "reject", nil, nil)
+	case transport.SettleAbandon:
+		_, _, err = tr.request(ctx, gohttp.MethodPost, path+"/abandon", "", nil, nil)
+	default:
+		return fmt.Errorf("unknown settlement %d", s)
+	}
+	return err
+}
+
+func (tr *Transport) RegisterDirectMethods(ctx context.Context, mux transport.MethodDispatcher) error {
+	return ErrNotSupported
+}
+
+func (tr *Transport) SubscribeTwinUpdates(ctx context.Context, mux transport.TwinStateDispatcher) error {
+	return ErrNotSupported
+}
+
+func (tr *Transport) RetrieveTwinProperties(ctx context.Context) ([]byte, error) {
+	return nil, ErrNotSupported
+}
+
+func (tr *Transport) UpdateTwinProperties(ctx context.Context, b []byte) (int, error) {
+	return 0, ErrNotSupported
+}
+
+func (tr *Transport) Close() error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	select {
+	case <-tr.done:
+		return nil
+	default:
+		close(tr.done)
+	}
+	tr.dispatchState(transport.ConnectionDisabled, nil)
+	return nil
+}
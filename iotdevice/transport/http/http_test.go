@@ -0,0 +1,201 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	gohttp "net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/iotdevice/transport"
+	"github.com/goautomotive/iothub/iotdevice/transport/transporttest"
+)
+
+func TestParseMessage(t *testing.T) {
+	t.Parallel()
+
+	h := gohttp.Header{}
+	h.Set("ETag", `"lock"`)
+	h.Set("iothub-messageid", "mid")
+	h.Set("iothub-expiry", "2020-01-02T03:04:05Z")
+	h.Set("iothub-app-foo", "bar")
+	h.Set("iothub-app-iothub-creation-time-utc", "2020-01-01T00:00:00Z")
+	msg, err := parseMessage(h, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.MessageID != "mid" || string(msg.Payload) != "hello" {
+		t.Errorf("parseMessage() = %#v, want message %q with payload %q", msg, "mid", "hello")
+	}
+	if msg.ExpiryTime == nil || !msg.ExpiryTime.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Errorf("ExpiryTime = %v, want 2020-01-02T03:04:05Z", msg.ExpiryTime)
+	}
+	if msg.CreationTime == nil || !msg.CreationTime.Equal(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("CreationTime = %v, want 2020-01-01T00:00:00Z", msg.CreationTime)
+	}
+	if len(msg.Properties) != 1 || msg.Properties["foo"] != "bar" {
+		t.Errorf("Properties = %v, want only foo=bar", msg.Properties)
+	}
+
+	if _, err = parseMessage(gohttp.Header{}, nil); err == nil {
+		t.Error("parseMessage() without lock token = nil, want an error")
+	}
+}
+
+func TestEncodeBatch(t *testing.T) {
+	t.Parallel()
+
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	b, err := encodeBatch([]*common.Message{
+		{Payload: []byte("a"), MessageID: "1"},
+		{Payload: []byte("b"), Properties: map[string]string{"K": "v"}, CreationTime: &created},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v []*batchMessage
+	if err = json.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	if len(v) != 2 || string(v[0].Body) != "a" || !v[0].Base64 || v[0].Properties != nil {
+		t.Errorf("encodeBatch() = %s, want the first message without properties", b)
+	}
+	if want := map[string]string{
+		"K":                        "v",
+		"iothub-creation-time-utc": "2020-01-01T00:00:00Z",
+	}; len(v) != 2 || !reflect.DeepEqual(v[1].Properties, want) {
+		t.Errorf("encodeBatch() = %s, want the second message properties %v", b, want)
+	}
+}
+
+func TestBatchSize(t *testing.T) {
+	t.Parallel()
+
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	msgs := []*common.Message{
+		{Payload: make([]byte, 100<<10), MessageID: "1"},
+		{Payload: []byte("b\n"), Properties: map[string]string{"K": `"v"`}, CreationTime: &created},
+	}
+	b, err := encodeBatch(msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := New().(*Transport)
+	n := 1 // the closing bracket
+	for _, msg := range msgs {
+		n += tr.BatchSize(msg)
+	}
+	if n != len(b) {
+		t.Errorf("batch size = %d, want %d", n, len(b))
+	}
+}
+
+type testDispatcher chan *common.Message
+
+func (d testDispatcher) Dispatch(msg *common.Message) {
+	d <- msg
+}
+
+func TestPollAndSettle(t *testing.T) {
+	t.Parallel()
+
+	var mu sync.Mutex
+	var queue []string
+	var settled []string
+	srv := httptest.NewTLSServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("Authorization") != "token" {
+			w.WriteHeader(gohttp.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == gohttp.MethodGet && r.URL.Path == "/devices/dev/messages/deviceBound":
+			if len(queue) == 0 {
+				w.WriteHeader(gohttp.StatusNoContent)
+				return
+			}
+			w.Header().Set("ETag", `"`+queue[0]+`"`)
+			w.Write([]byte(queue[0]))
+			queue = queue[1:]
+		case r.Method == gohttp.MethodDelete:
+			s := strings.TrimPrefix(r.URL.Path, "/devices/dev/messages/deviceBound/")
+			if _, ok := r.URL.Query()["reject"]; ok {
+				s += ":reject"
+			}
+			settled = append(settled, s)
+			w.WriteHeader(gohttp.StatusNoContent)
+		default:
+			w.WriteHeader(gohttp.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	queue = []string{"a", "b"}
+	tr := New(WithPollInterval(time.Hour)).(*Transport)
+	defer tr.Close()
+	tr.SetManualSettlement(true)
+	if err := tr.Connect(context.Background(), &transporttest.Credentials{
+		Host: strings.TrimPrefix(srv.URL, "https://"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	d := make(testDispatcher, 2)
+	if err := tr.SubscribeEvents(context.Background(), d); err != nil {
+		t.Fatal(err)
+	}
+	a, b := <-d, <-d
+	if err := tr.Settle(context.Background(), a, transport.SettleComplete); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Settle(context.Background(), b, transport.SettleReject); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Settle(context.Background(), b, transport.SettleReject); err == nil {
+		t.Error("Settle() of already settled message = nil, want an error")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"a", "b:reject"}; strings.Join(settled, ",") != strings.Join(want, ",") {
+		t.Errorf("settled = %v, want %v", settled, want)
+	}
+}
+
+func TestDialer(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewTLSServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		w.WriteHeader(gohttp.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	var mu sync.Mutex
+	var dialed []string
+	tr := New(WithDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		dialed = append(dialed, addr)
+		mu.Unlock()
+		return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+	}))
+	defer tr.Close()
+	if err := tr.Connect(context.Background(), &transporttest.Credentials{Host: "hub.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Send(context.Background(), &common.Message{Payload: []byte("hello")}); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(dialed) != 1 || dialed[0] != "hub.example.com:443" {
+		t.Errorf("dialed %v, want [hub.example.com:443]", dialed)
+	}
+}
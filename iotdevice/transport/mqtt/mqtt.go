@@ -1,10 +1,12 @@
 package mqtt
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
@@ -13,6 +15,7 @@ import (
 	"time"
 
 	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
 	"github.com/goautomotive/iothub/common"
 	"github.com/goautomotive/iothub/iotdevice/transport"
 )
@@ -20,17 +23,89 @@ import (
 // DefaultQoS is the default quality of service value.
 const DefaultQoS = 1
 
+// DefaultTokenLifetime is the default lifetime of SAS tokens.
+const DefaultTokenLifetime = time.Hour
+
 // TransportOption is a transport configuration option.
 type TransportOption func(tr *Transport)
 
 // WithLogger sets logger for errors and warnings
 // plus debug messages when it's enabled.
 func WithLogger(l *log.Logger) TransportOption {
+	return WithStructuredLogger(common.NewStdLogger(l))
+}
+
+// WithStructuredLogger is same as WithLogger but accepts a leveled logger.
+func WithStructuredLogger(l common.Logger) TransportOption {
 	return func(tr *Transport) {
 		tr.logger = l
 	}
 }
 
+// WithAutoReconnect makes the transport re-establish lost connections
+// by itself using exponential backoff with jitter between min and max
+// delays, instead of relying on the mqtt library's fixed schedule.
+//
+// SAS tokens are regenerated and all active subscriptions
+// are restored every time the connection is re-established.
+func WithAutoReconnect(min, max time.Duration) TransportOption {
+	if min <= 0 || max < min {
+		panic("invalid backoff intervals")
+	}
+	return func(tr *Transport) {
+		tr.rcmin, tr.rcmax = min, max
+	}
+}
+
+// WithKeepAlive sets the interval of keepalive pings, the hub
+// drops connections idle for about 1.5 times of it, 30s by default.
+func WithKeepAlive(d time.Duration) TransportOption {
+	if d < time.Second {
+		panic("keepalive must be at least a second")
+	}
+	return func(tr *Transport) {
+		tr.keepalive = d
+	}
+}
+
+// WithCleanSession set to false makes the hub keep the session between
+// connections, so QoS 1 messages queue at the broker during short outages
+// and subscriptions survive reconnects, it's true by default.
+//
+// Messages queued during the outage are delivered to the subscribers
+// after reconnecting, including reconnects with renewed SAS tokens.
+func WithCleanSession(clean bool) TransportOption {
+	return func(tr *Transport) {
+		tr.clean = clean
+	}
+}
+
+// WithTokenLifetime sets the lifetime of SAS tokens generated on connect,
+// one hour by default.
+//
+// Non-zero margin makes the transport reconnect with a fresh token the margin
+// before the current one expires, otherwise the hub drops the connection
+// when it happens and the transport reconnects after that.
+func WithTokenLifetime(ttl, margin time.Duration) TransportOption {
+	if ttl <= 0 || margin < 0 || margin >= ttl {
+		panic("invalid token lifetime or renewal margin")
+	}
+	return func(tr *Transport) {
+		tr.ttl, tr.margin = ttl, margin
+	}
+}
+
+// WithDialer sets the function for establishing connections to the hub
+// or proxies, the TLS handshake is done over them by the transport.
+func WithDialer(fn common.Dialer) TransportOption {
+	if fn == nil {
+		panic("fn is nil")
+	}
+	return func(tr *Transport) {
+		tr.dial = fn
+	}
+}
+
 // WithDebug enables debug mode.
 // All debug messages are written to the logger.
 func WithDebug(enable bool) TransportOption {
@@ -42,7 +117,11 @@ func WithDebug(enable bool) TransportOption {
 // New returns new Transport transport.
 // See more: https://docs.microsoft.com/en-us/azure/iot-hub/iot-hub-mqtt-support
 func New(opts ...TransportOption) transport.Transport {
-	tr := &Transport{done: make(chan struct{})}
+	tr := &Transport{
+		done:  make(chan struct{}),
+		clean: true,
+		ttl:   DefaultTokenLifetime,
+	}
 	for _, opt := range opts {
 		opt(tr)
 	}
@@ -53,16 +132,39 @@ type Transport struct {
 	mu   sync.RWMutex
 	conn mqtt.Client
 
-	did string // device id
-	rid uint32 // request id, incremented each request
+	did   string // device id
+	mid   string // module id, empty for plain devices
+	model string // pnp model id
+	rid   uint32 // request id, incremented each request
 
-	subm sync.RWMutex // cannot use mu for protecting subs
-	subs []subFunc    // on-connect mqtt subscriptions
+	subm sync.RWMutex    // cannot use mu for protecting subs
+	subs []*subscription // on-connect mqtt subscriptions
 
 	done chan struct{}         // closed when the transport is closed
 	resp map[uint32]chan *resp // responses from iothub
 
-	logger *log.Logger
+	rcmin, rcmax time.Duration // auto-reconnect backoff, disabled when zero
+
+	opts      *mqtt.ClientOptions // used for creating clients on token renewals
+	keepalive time.Duration       // library default when zero
+	clean     bool                // mqtt clean session flag
+	ttl       time.Duration       // sas token lifetime
+	margin    time.Duration       // renewal margin, no proactive renewals when zero
+
+	msem chan struct{} // running direct methods, nil dispatches them serially
+
+	ws     bool                                  // connect over websockets
+	proxy  func(*http.Request) (*url.URL, error) // websockets proxy
+	tunnel *tunnel                               // proxy tunnel, nil when not used
+	dial   common.Dialer                         // custom dialer, nil when not set
+
+	frames transport.FrameTrace
+
+	csmu  sync.RWMutex
+	csmux transport.ConnectionStateDispatcher
+	texp  int64 // current sas token expiration time in unix nanoseconds
+
+	logger common.Logger
 	debug  bool
 }
 
@@ -73,16 +175,19 @@ type resp struct {
 	ver int // twin response only
 }
 
-func (tr *Transport) logf(format string, v ...interface{}) {
-	if tr.logger != nil {
-		tr.logger.Printf(format, v...)
+func (tr *Transport) logf(level common.LogLevel, component, format string, v ...interface{}) {
+	if tr.logger == nil || level == common.LevelDebug && !tr.debug {
+		return
 	}
+	tr.logger.Logf(level, component, format, v...)
+}
+
+func (tr *Transport) errorf(format string, v ...interface{}) {
+	tr.logf(common.LevelError, common.ComponentTransport, format, v...)
 }
 
 func (tr *Transport) debugf(format string, v ...interface{}) {
-	if tr.logger != nil && tr.debug {
-		tr.logger.Printf(format, v...)
-	}
+	tr.logf(common.LevelDebug, common.ComponentTransport, format, v...)
 }
 
 func (tr *Transport) Connect(ctx context.Context, creds transport.Credentials) error {
@@ -92,57 +197,342 @@ func (tr *Transport) Connect(ctx context.Context, creds transport.Credentials) e
 		return errors.New("already connected")
 	}
 
-	username := creds.Hostname() + "/" + creds.DeviceID() + "/api-version=" + common.APIVersion
+	o, err := tr.options(ctx, creds)
+	if err != nil {
+		return err
+	}
+	c := tr.newClient(o)
+	if err = contextToken(ctx, c.Connect()); err != nil {
+		if tr.tunnel != nil {
+			tr.tunnel.close()
+			tr.tunnel = nil
+		}
+		return connectError(err)
+	}
+
+	tr.did = creds.DeviceID()
+	tr.mid = creds.ModuleID()
+	tr.conn = c
+	tr.opts = o
+	if creds.IsSAS() && tr.margin != 0 {
+		go tr.renewToken()
+	}
+	return nil
+}
+
+// options returns the client options for connecting with creds,
+// ctx is used for generating tokens on the first connect.
+func (tr *Transport) options(ctx context.Context, creds transport.Credentials) (*mqtt.ClientOptions, error) {
+	// modules are identified as {device}/{module} pairs
+	clientID := creds.DeviceID()
+	resource := creds.Hostname()
+	if creds.ModuleID() != "" {
+		clientID += "/" + creds.ModuleID()
+		resource += "/devices/" + creds.DeviceID() + "/modules/" + creds.ModuleID()
+	}
+
+	// IoT Edge leaf devices and modules connect to a gateway,
+	// but still authenticate against the hub itself.
+	broker := creds.Hostname()
+	if creds.GatewayHostName() != "" {
+		broker = creds.GatewayHostName()
+	}
+
+	username := tr.username(creds.Hostname(), clientID)
 	o := mqtt.NewClientOptions()
-	o.SetTLSConfig(creds.TLSConfig())
-	o.AddBroker("tls://" + creds.Hostname() + ":8883")
-	o.SetClientID(creds.DeviceID())
+	if tr.ws {
+		uri, tc, err := tr.websocketBroker(broker, creds.TLSConfig())
+		if err != nil {
+			return nil, err
+		}
+		o.AddBroker(uri)
+		o.SetTLSConfig(tc)
+	} else if tr.dial != nil {
+		uri, tc, err := tr.dialerBroker(broker+":8883", creds.TLSConfig())
+		if err != nil {
+			return nil, err
+		}
+		o.AddBroker(uri)
+		o.SetTLSConfig(tc)
+	} else {
+		o.AddBroker("tls://" + broker + ":8883")
+		o.SetTLSConfig(creds.TLSConfig())
+	}
+	o.SetClientID(clientID)
 	o.SetCredentialsProvider(func() (string, string) {
 		if !creds.IsSAS() {
 			return username, ""
 		}
 		// TODO: renew token only when it expires in case an external token provider is used
 		// TODO: this can slow down the reconnect feature, so need to figure out max token lifetime
-		password, err := creds.Token(ctx, creds.Hostname(), time.Hour)
+
+		// the connect context is usually done by the time of reconnecting
+		tctx := ctx
+		if ctx.Err() != nil {
+			tctx = context.Background()
+		}
+		atomic.StoreInt64(&tr.texp, time.Now().Add(tr.ttl).UnixNano())
+		password, err := creds.Token(tctx, resource, tr.ttl)
 		if err != nil {
-			panic(err)
+			// sending a blank password makes the broker reject
+			// the connection that is retried later on
+			tr.logf(common.LevelError, common.ComponentAuth, "token error: %s", err)
+			return username, ""
 		}
 		return username, password
 	})
+	o.SetCleanSession(tr.clean)
+	if tr.keepalive != 0 {
+		o.SetKeepAlive(tr.keepalive)
+	}
 	o.SetMaxReconnectInterval(30 * time.Second) // default is 15min, way to long
-	o.SetOnConnectHandler(func(_ mqtt.Client) {
-		tr.debugf("connection established")
-	})
+	o.SetAutoReconnect(tr.rcmin == 0)
 	o.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
 		tr.debugf("connection lost: %v", err)
+		if creds.IsSAS() && time.Now().UnixNano() >= atomic.LoadInt64(&tr.texp) {
+			tr.dispatchState(transport.ConnectionTokenExpired, err)
+		} else {
+			tr.dispatchState(transport.ConnectionDisconnected, err)
+		}
+		// both the library and our own reconnect loop
+		// start reconnecting straight after this
+		tr.dispatchState(transport.ConnectionReconnecting, nil)
+		if tr.rcmin != 0 {
+			go tr.reconnect(tr.rcmin, tr.rcmax)
+		}
 	})
 	o.SetOnConnectHandler(func(c mqtt.Client) {
+		tr.debugf("connection established")
+		tr.dispatchState(transport.ConnectionConnected, nil)
 		tr.subm.RLock()
 		for _, sub := range tr.subs {
-			if err := sub(); err != nil {
-				tr.logger.Printf("on-connect error: %s", err)
+			if err := tr.subscribe(context.Background(), c, sub); err != nil {
+				tr.errorf("on-connect error: %s", err)
 			}
 		}
 		tr.subm.RUnlock()
 	})
 
-	c := mqtt.NewClient(o)
-	if err := contextToken(ctx, c.Connect()); err != nil {
-		return err
+	return o, nil
+}
+
+// renewToken reconnects with a fresh SAS token
+// the renewal margin before the current one expires.
+func (tr *Transport) renewToken() {
+	for {
+		d := time.Until(time.Unix(0, atomic.LoadInt64(&tr.texp))) - tr.margin
+		select {
+		case <-time.After(d):
+		case <-tr.done:
+			return
+		}
+		// the token could have been regenerated by a reconnect in the meantime
+		if time.Until(time.Unix(0, atomic.LoadInt64(&tr.texp))) > tr.margin {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		tr.refresh(ctx)
+		cancel()
 	}
+}
 
-	tr.did = creds.DeviceID()
+// Reauthenticate implements transport.Reauthenticator,
+// it reconnects because mqtt has no means to update credentials.
+func (tr *Transport) Reauthenticate(ctx context.Context) error {
+	tr.mu.RLock()
+	connected := tr.conn != nil
+	tr.mu.RUnlock()
+	if !connected {
+		return nil
+	}
+	return tr.refresh(ctx)
+}
+
+// refresh replaces the connection with a new one, the mqtt library
+// cannot reuse clients after disconnecting. The old connection is closed
+// first, otherwise the hub drops one of the two sharing the client id.
+func (tr *Transport) refresh(ctx context.Context) error {
+	tr.mu.Lock()
+	select {
+	case <-tr.done:
+		tr.mu.Unlock()
+		return errors.New("transport is closed")
+	default:
+	}
+	old := tr.conn
+	c := tr.newClient(tr.opts)
 	tr.conn = c
+	tr.mu.Unlock()
+
+	tr.logf(common.LevelInfo, common.ComponentAuth, "reconnecting with a new sas token")
+	tr.dispatchState(transport.ConnectionReconnecting, nil)
+	old.Disconnect(250)
+	err := connectError(contextToken(ctx, c.Connect()))
+	if err != nil {
+		tr.logf(common.LevelWarn, common.ComponentTransport, "reconnect error: %s", err)
+		tr.dispatchState(transport.ConnectionDisconnected, err)
+
+		// the library reconnects only connections lost after being established
+		min, max := tr.rcmin, tr.rcmax
+		if min == 0 {
+			min, max = time.Second, 30*time.Second
+		}
+		go tr.reconnect(min, max)
+	}
+	return err
+}
+
+// Redirect implements transport.Redirector, it reconnects to the hub
+// creds currently point to, keeping the subscriptions.
+func (tr *Transport) Redirect(ctx context.Context, creds transport.Credentials) error {
+	tr.mu.Lock()
+	if tr.conn == nil {
+		tr.mu.Unlock()
+		return errors.New("not connected")
+	}
+	tunnel := tr.tunnel
+	tr.tunnel = nil
+	o, err := tr.options(ctx, creds)
+	if err != nil {
+		tr.tunnel = tunnel
+		tr.mu.Unlock()
+		return err
+	}
+	tr.opts = o
+	tr.mu.Unlock()
+
+	err = tr.refresh(ctx)
+	if tunnel != nil {
+		tunnel.close()
+	}
+	return err
+}
+
+// SetFrameHandler implements transport.FrameTracer.
+func (tr *Transport) SetFrameHandler(fn transport.FrameHandler, limit int) {
+	tr.frames.SetFrameHandler(fn, limit)
+}
+
+// SetDialer implements transport.CustomDialer.
+func (tr *Transport) SetDialer(fn common.Dialer) {
+	tr.dial = fn
+}
+
+// pnpAPIVersion is the minimal api version supporting IoT Plug and Play.
+const pnpAPIVersion = "2020-09-30"
+
+// username returns the mqtt username, the model id
+// is passed along when it's set to announce a PnP device.
+func (tr *Transport) username(hostname, clientID string) string {
+	if tr.model == "" {
+		return hostname + "/" + clientID + "/api-version=" + common.APIVersion
+	}
+	return hostname + "/" + clientID + "/?api-version=" + pnpAPIVersion +
+		"&model-id=" + url.QueryEscape(tr.model)
+}
+
+// SetModelID sets the IoT Plug and Play model id announced on connect.
+func (tr *Transport) SetModelID(id string) {
+	tr.model = id
+}
+
+// SetMethodConcurrency implements transport.MethodConcurrencyLimiter,
+// methods are dispatched serially by default.
+func (tr *Transport) SetMethodConcurrency(n int) {
+	if n < 1 {
+		panic("concurrency must be positive")
+	}
+	if n == 1 {
+		tr.msem = nil
+		return
+	}
+	tr.msem = make(chan struct{}, n)
+}
+
+// prefix returns topics prefix of the connected device or module.
+func (tr *Transport) prefix() string {
+	if tr.mid != "" {
+		return "devices/" + tr.did + "/modules/" + tr.mid
+	}
+	return "devices/" + tr.did
+}
+
+// reconnect dials the broker until it succeeds or the transport is closed.
+func (tr *Transport) reconnect(min, max time.Duration) {
+	b := &common.Backoff{Min: min, Max: max}
+	for {
+		d := b.Next()
+		tr.debugf("reconnecting in %s", d)
+		select {
+		case <-time.After(d):
+		case <-tr.done:
+			return
+		}
+
+		tr.mu.RLock()
+		c := tr.conn
+		tr.mu.RUnlock()
+		if c.IsConnected() {
+			return // reconnected by a refresh in the meantime
+		}
+		t := c.Connect()
+		select {
+		case <-tr.done:
+			return
+		default:
+		}
+		if !t.WaitTimeout(max + 30*time.Second) {
+			tr.logf(common.LevelWarn, common.ComponentTransport, "reconnect timed out")
+			continue
+		}
+		if err := connectError(t.Error()); err != nil {
+			tr.logf(common.LevelWarn, common.ComponentTransport, "reconnect error: %s", err)
+			if errors.Is(err, common.ErrUnauthorized) {
+				// let the client know, e.g. to fail over to another hub
+				tr.dispatchState(transport.ConnectionDisconnected, err)
+			}
+			continue
+		}
+		return
+	}
+}
+
+func (tr *Transport) SubscribeConnectionState(ctx context.Context, mux transport.ConnectionStateDispatcher) error {
+	tr.csmu.Lock()
+	tr.csmux = mux
+	tr.csmu.Unlock()
 	return nil
 }
 
-type subFunc func() error
+func (tr *Transport) dispatchState(state transport.ConnectionState, err error) {
+	tr.csmu.RLock()
+	mux := tr.csmux
+	tr.csmu.RUnlock()
+	if mux != nil {
+		mux.Dispatch(state, err)
+	}
+}
+
+// subscription is a topic filter with its message handler.
+type subscription struct {
+	topic   string
+	handler mqtt.MessageHandler
+}
 
-// sub invokes the given sub function and if it passes with no error,
+// sub subscribes to the given topic and if it passes with no error,
 // pushes it to the on-re-connect subscriptions list, because the client
 // has to resubscribe every reconnect.
-func (tr *Transport) sub(sub subFunc) error {
-	if err := sub(); err != nil {
+//
+// The library doesn't expose the CONNACK session present flag, so it's
+// done even when the hub resumed a persistent session, subscribing to
+// the same filter again replaces the subscription keeping its queue.
+func (tr *Transport) sub(ctx context.Context, sub *subscription) error {
+	handler := sub.handler
+	sub.handler = func(c mqtt.Client, m mqtt.Message) {
+		tr.frames.Trace(transport.Inbound, "PUBLISH", m.Topic(), m.Payload(), nil)
+		handler(c, m)
+	}
+	if err := tr.subscribe(ctx, tr.conn, sub); err != nil {
 		return err
 	}
 	tr.subm.Lock()
@@ -151,37 +541,55 @@ func (tr *Transport) sub(sub subFunc) error {
 	return nil
 }
 
+// subscribe subscribes c to sub's topic.
+func (tr *Transport) subscribe(ctx context.Context, c mqtt.Client, sub *subscription) error {
+	tr.frames.Trace(transport.Outbound, "SUBSCRIBE", sub.topic, nil, nil)
+	return contextToken(ctx, c.Subscribe(sub.topic, DefaultQoS, sub.handler))
+}
+
+// newClient creates a client with routes to the handlers of current
+// subscriptions, because with a persistent session the hub delivers
+// messages queued during the outage straight after CONNACK, before
+// the on-connect handler resubscribes, that the library would
+// acknowledge and drop otherwise.
+func (tr *Transport) newClient(o *mqtt.ClientOptions) mqtt.Client {
+	c := mqtt.NewClient(o)
+	tr.subm.RLock()
+	for _, sub := range tr.subs {
+		c.AddRoute(sub.topic, sub.handler)
+	}
+	tr.subm.RUnlock()
+	return c
+}
+
 func (tr *Transport) SubscribeEvents(ctx context.Context, mux transport.MessageDispatcher) error {
-	return tr.sub(tr.subEvents(ctx, mux))
+	return tr.sub(ctx, tr.subEvents(mux))
 }
 
-func (tr *Transport) subEvents(ctx context.Context, mux transport.MessageDispatcher) subFunc {
-	return func() error {
-		return contextToken(ctx, tr.conn.Subscribe(
-			"devices/"+tr.did+"/messages/devicebound/#", DefaultQoS, func(_ mqtt.Client, m mqtt.Message) {
-				msg, err := parseEventMessage(m)
-				if err != nil {
-					tr.logf("message parse error: %s", err)
-					return
-				}
-				mux.Dispatch(msg)
-			},
-		))
+func (tr *Transport) subEvents(mux transport.MessageDispatcher) *subscription {
+	// modules receive messages routed to their inputs instead of c2d messages
+	topic := tr.prefix() + "/messages/devicebound/#"
+	if tr.mid != "" {
+		topic = tr.prefix() + "/inputs/#"
 	}
+	return &subscription{topic, func(_ mqtt.Client, m mqtt.Message) {
+		msg, err := parseEventMessage(m)
+		if err != nil {
+			tr.errorf("message parse error: %s", err)
+			return
+		}
+		mux.Dispatch(msg)
+	}}
 }
 
 func (tr *Transport) SubscribeTwinUpdates(ctx context.Context, mux transport.TwinStateDispatcher) error {
-	return tr.sub(tr.subTwinUpdates(ctx, mux))
+	return tr.sub(ctx, tr.subTwinUpdates(mux))
 }
 
-func (tr *Transport) subTwinUpdates(ctx context.Context, mux transport.TwinStateDispatcher) subFunc {
-	return func() error {
-		return contextToken(ctx, tr.conn.Subscribe(
-			"$iothub/twin/PATCH/properties/desired/#", DefaultQoS, func(_ mqtt.Client, m mqtt.Message) {
-				mux.Dispatch(m.Payload())
-			},
-		))
-	}
+func (tr *Transport) subTwinUpdates(mux transport.TwinStateDispatcher) *subscription {
+	return &subscription{"$iothub/twin/PATCH/properties/desired/#", func(_ mqtt.Client, m mqtt.Message) {
+		mux.Dispatch(m.Payload())
+	}}
 }
 
 func parseEventMessage(m mqtt.Message) (*common.Message, error) {
@@ -191,6 +599,7 @@ func parseEventMessage(m mqtt.Message) (*common.Message, error) {
 	}
 	e := &common.Message{
 		Payload:    m.Payload(),
+		InputName:  parseInputName(m.Topic()),
 		Properties: make(map[string]string, len(p)),
 	}
 	for k, v := range p {
@@ -203,12 +612,24 @@ func parseEventMessage(m mqtt.Message) (*common.Message, error) {
 			e.UserID = v
 		case "$.to":
 			e.To = v
+		case "$.on":
+			e.OutputName = v
+		case "$.ct":
+			e.ContentType = v
+		case "$.ce":
+			e.ContentEncoding = v
 		case "$.exp":
 			t, err := time.Parse(time.RFC3339, v)
 			if err != nil {
 				return nil, err
 			}
 			e.ExpiryTime = &t
+		case creationTimeProperty:
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, err
+			}
+			e.CreationTime = &t
 		default:
 			e.Properties[k] = v
 		}
@@ -216,59 +637,179 @@ func parseEventMessage(m mqtt.Message) (*common.Message, error) {
 	return e, nil
 }
 
+// parseInputName extracts input name from module input topics,
+// returns an empty string for regular cloud-to-device topics.
+// format: devices/{device}/modules/{module}/inputs/{input}/{properties}
+func parseInputName(s string) string {
+	const sep = "/inputs/"
+	i := strings.Index(s, sep)
+	if i == -1 {
+		return ""
+	}
+	s = s[i+len(sep):]
+	if i = strings.IndexByte(s, '/'); i != -1 {
+		s = s[:i]
+	}
+	return s
+}
+
+// topicBufs are scratch buffers for unescaping topic names,
+// only the parsed out values are allocated.
+var topicBufs = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 256)
+		return &b
+	},
+}
+
 // devices/{device}/messages/devicebound/%24.to=%2Fdevices%2F{device}%2Fmessages%2FdeviceBound&a=b&b=c
 func parseCloudToDeviceTopic(s string) (map[string]string, error) {
-	s, err := url.QueryUnescape(s)
+	bp := topicBufs.Get().(*[]byte)
+	defer topicBufs.Put(bp)
+	b, err := unescape((*bp)[:0], s)
+	*bp = b[:0]
 	if err != nil {
 		return nil, err
 	}
 
 	// attributes prefixed with $.,
 	// e.g. `messageId` becomes `$.mid`, `to` becomes `$.to`, etc.
-	i := strings.Index(s, "$.")
+	i := bytes.Index(b, []byte("$."))
 	if i == -1 {
 		return nil, errors.New("malformed cloud-to-device topic name")
 	}
-	q, err := url.ParseQuery(s[i:])
-	if err != nil {
+	p := map[string]string{}
+	if err = parseQuery(b[i:], func(k, v string) error {
+		if _, ok := p[k]; ok {
+			return fmt.Errorf("duplicate property %q", k)
+		}
+		p[k] = v
+		return nil
+	}); err != nil {
 		return nil, err
 	}
+	return p, nil
+}
 
-	p := make(map[string]string, len(q))
-	for k, v := range q {
-		if len(v) != 1 {
-			return nil, fmt.Errorf("unexpected number of property values: %d", len(q))
+// unescape appends query-unescaped s to b, like url.QueryUnescape.
+func unescape(b []byte, s string) ([]byte, error) {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '+':
+			b = append(b, ' ')
+		case '%':
+			if i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+				end := i + 3
+				if end > len(s) {
+					end = len(s)
+				}
+				return b, url.EscapeError(s[i:end])
+			}
+			b = append(b, unhex(s[i+1])<<4|unhex(s[i+2]))
+			i += 2
+		default:
+			b = append(b, c)
 		}
-		p[k] = v[0]
 	}
-	return p, nil
+	return b, nil
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c <= '9':
+		return c - '0'
+	case c <= 'F':
+		return c - 'A' + 10
+	default:
+		return c - 'a' + 10
+	}
+}
+
+// parseQuery calls fn for every key-value pair of the query, like
+// url.ParseQuery keys and values are unescaped and semicolons are rejected.
+func parseQuery(q []byte, fn func(k, v string) error) error {
+	for len(q) != 0 {
+		var kv []byte
+		if i := bytes.IndexByte(q, '&'); i != -1 {
+			kv, q = q[:i], q[i+1:]
+		} else {
+			kv, q = q, nil
+		}
+		if bytes.IndexByte(kv, ';') != -1 {
+			return errors.New("invalid semicolon separator in query")
+		}
+		if len(kv) == 0 {
+			continue
+		}
+		k, v := kv, []byte(nil)
+		if i := bytes.IndexByte(kv, '='); i != -1 {
+			k, v = kv[:i], kv[i+1:]
+		}
+		ks, err := unescapeString(k)
+		if err != nil {
+			return err
+		}
+		vs, err := unescapeString(v)
+		if err != nil {
+			return err
+		}
+		if err = fn(ks, vs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unescapeString converts b to a string unescaping it when needed.
+func unescapeString(b []byte) (string, error) {
+	if bytes.IndexAny(b, "%+") == -1 {
+		return string(b), nil
+	}
+	u, err := unescape(make([]byte, 0, len(b)), string(b))
+	if err != nil {
+		return "", err
+	}
+	return string(u), nil
 }
 
 func (tr *Transport) RegisterDirectMethods(ctx context.Context, mux transport.MethodDispatcher) error {
-	return tr.sub(tr.subDirectMethods(ctx, mux))
+	return tr.sub(ctx, tr.subDirectMethods(mux))
 }
 
-func (tr *Transport) subDirectMethods(ctx context.Context, mux transport.MethodDispatcher) subFunc {
-	return func() error {
-		return contextToken(ctx, tr.conn.Subscribe(
-			"$iothub/methods/POST/#", DefaultQoS, func(_ mqtt.Client, m mqtt.Message) {
-				method, rid, err := parseDirectMethodTopic(m.Topic())
-				if err != nil {
-					tr.logf("parse error: %s", err)
-					return
-				}
-				rc, b, err := mux.Dispatch(method, m.Payload())
-				if err != nil {
-					tr.logf("dispatch error: %s", err)
-					return
-				}
-				dst := fmt.Sprintf("$iothub/methods/res/%d/?$rid=%d", rc, rid)
-				if err = tr.send(ctx, dst, DefaultQoS, b); err != nil {
-					tr.logf("method response error: %s", err)
-					return
-				}
-			},
-		))
+func (tr *Transport) subDirectMethods(mux transport.MethodDispatcher) *subscription {
+	return &subscription{"$iothub/methods/POST/#", func(_ mqtt.Client, m mqtt.Message) {
+		method, rid, err := parseDirectMethodTopic(m.Topic())
+		if err != nil {
+			tr.errorf("parse error: %s", err)
+			return
+		}
+		if tr.msem == nil {
+			tr.handleMethod(mux, method, rid, m.Payload())
+			return
+		}
+		// block the library's router when the limit's reached
+		tr.msem <- struct{}{}
+		go func() {
+			defer func() { <-tr.msem }()
+			tr.handleMethod(mux, method, rid, m.Payload())
+		}()
+	}}
+}
+
+// handleMethod dispatches the direct method and publishes its response.
+func (tr *Transport) handleMethod(mux transport.MethodDispatcher, method string, rid int, b []byte) {
+	rc, b, err := mux.Dispatch(method, b)
+	if err != nil {
+		tr.errorf("dispatch error: %s", err)
+		return
+	}
+	dst := fmt.Sprintf("$iothub/methods/res/%d/?$rid=%d", rc, rid)
+	if err = tr.send(context.Background(), dst, DefaultQoS, b); err != nil {
+		tr.errorf("method response error: %s", err)
 	}
 }
 
@@ -277,29 +818,40 @@ func (tr *Transport) subDirectMethods(ctx context.Context, mux transport.MethodD
 func parseDirectMethodTopic(s string) (string, int, error) {
 	const prefix = "$iothub/methods/POST/"
 
-	s, err := url.QueryUnescape(s)
-	if err != nil {
-		return "", 0, err
-	}
-	u, err := url.Parse(s)
+	bp := topicBufs.Get().(*[]byte)
+	defer topicBufs.Put(bp)
+	b, err := unescape((*bp)[:0], s)
+	*bp = b[:0]
 	if err != nil {
 		return "", 0, err
 	}
 
-	p := strings.TrimRight(u.Path, "/")
-	if !strings.HasPrefix(p, prefix) {
+	var q []byte
+	if i := bytes.IndexByte(b, '?'); i != -1 {
+		b, q = b[:i], b[i+1:]
+	}
+	b = bytes.TrimRight(b, "/")
+	if !bytes.HasPrefix(b, []byte(prefix)) {
 		return "", 0, errors.New("malformed direct method topic")
 	}
 
-	q := u.Query()
-	if len(q["$rid"]) != 1 {
+	var rids []string
+	if err = parseQuery(q, func(k, v string) error {
+		if k == "$rid" {
+			rids = append(rids, v)
+		}
+		return nil
+	}); err != nil {
+		return "", 0, err
+	}
+	if len(rids) != 1 {
 		return "", 0, errors.New("$rid is not available")
 	}
-	rid, err := strconv.Atoi(q["$rid"][0])
+	rid, err := strconv.Atoi(rids[0])
 	if err != nil {
 		return "", 0, fmt.Errorf("$rid parse error: %s", err)
 	}
-	return p[len(prefix):], rid, nil
+	return string(b[len(prefix):]), rid, nil
 }
 
 func (tr *Transport) RetrieveTwinProperties(ctx context.Context) ([]byte, error) {
@@ -340,12 +892,12 @@ func (tr *Transport) request(ctx context.Context, topic string, b []byte) (*resp
 
 	select {
 	case r := <-rch:
-		if r.code < 200 && r.code > 299 {
-			return nil, fmt.Errorf("request failed with %d response code", r.code)
+		if r.code < 200 || r.code > 299 {
+			return nil, common.NewHubError(r.code, nil, r.body)
 		}
 		return r, nil
 	case <-time.After(30 * time.Second):
-		return nil, errors.New("request timed out")
+		return nil, errRequestTimeout
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	}
@@ -359,45 +911,41 @@ func (tr *Transport) enableTwinResponses(ctx context.Context) error {
 	if tr.resp != nil {
 		return nil
 	}
-	if err := tr.sub(tr.subTwinResponses(ctx)); err != nil {
+	if err := tr.sub(ctx, tr.subTwinResponses()); err != nil {
 		return err
 	}
 	tr.resp = make(map[uint32]chan *resp)
 	return nil
 }
 
-func (tr *Transport) subTwinResponses(ctx context.Context) subFunc {
-	return func() error {
-		return contextToken(ctx, tr.conn.Subscribe(
-			"$iothub/twin/res/#", DefaultQoS, func(_ mqtt.Client, m mqtt.Message) {
-				rc, rid, ver, err := parseTwinPropsTopic(m.Topic())
-				if err != nil {
-					fmt.Printf("parse twin props topic error: %s", err)
-					return
-				}
+func (tr *Transport) subTwinResponses() *subscription {
+	return &subscription{"$iothub/twin/res/#", func(_ mqtt.Client, m mqtt.Message) {
+		rc, rid, ver, err := parseTwinPropsTopic(m.Topic())
+		if err != nil {
+			tr.errorf("parse twin props topic error: %s", err)
+			return
+		}
 
-				tr.mu.RLock()
-				defer tr.mu.RUnlock()
-				for r, rch := range tr.resp {
-					if int(r) != rid {
-						continue
-					}
-					res := &resp{code: rc, ver: ver, body: m.Payload()}
-					select {
-					case rch <- res:
-						// try to push without a goroutine first
-						// if the channel buffer is not busy
-					default:
-						go func() {
-							rch <- res
-						}()
-					}
-					return
-				}
-				tr.logf("warn: unknown rid: %q", rid)
-			},
-		))
-	}
+		tr.mu.RLock()
+		defer tr.mu.RUnlock()
+		for r, rch := range tr.resp {
+			if int(r) != rid {
+				continue
+			}
+			res := &resp{code: rc, ver: ver, body: m.Payload()}
+			select {
+			case rch <- res:
+				// try to push without a goroutine first
+				// if the channel buffer is not busy
+			default:
+				go func() {
+					rch <- res
+				}()
+			}
+			return
+		}
+		tr.logf(common.LevelWarn, common.ComponentTransport, "unknown rid: %d", rid)
+	}}
 }
 
 // parseTwinPropsTopic parses the given topic name into rc, rid and ver.
@@ -438,7 +986,40 @@ func parseTwinPropsTopic(s string) (int, int, int, error) {
 	return rc, rid, ver, nil
 }
 
+// creationTimeProperty carries the message creation time, there's no
+// dedicated system property for it unlike in AMQP.
+const creationTimeProperty = "iothub-creation-time-utc"
+
 func (tr *Transport) Send(ctx context.Context, msg *common.Message) error {
+	topic, qos, err := tr.eventTopic(msg)
+	if err != nil {
+		return err
+	}
+	return tr.send(ctx, topic, qos, msg.Payload)
+}
+
+// SendAsync implements transport.AsyncSender, messages are published
+// in the order of calls without waiting for previous ones to complete.
+func (tr *Transport) SendAsync(ctx context.Context, msg *common.Message) <-chan error {
+	done := make(chan error, 1)
+	topic, qos, err := tr.eventTopic(msg)
+	if err != nil {
+		done <- err
+		return done
+	}
+	t, err := tr.publish(topic, qos, msg.Payload)
+	if err != nil {
+		done <- err
+		return done
+	}
+	go func() {
+		done <- tokenError(contextToken(ctx, t))
+	}()
+	return done
+}
+
+// eventTopic returns the publish topic and QoS of the device-to-cloud message.
+func (tr *Transport) eventTopic(msg *common.Message) (string, int, error) {
 	// this is just copying functionality from the nodejs sdk, but
 	// seems like adding meta attributes does nothing or in some cases,
 	// e.g. when $.exp is set the cloud just disconnects.
@@ -455,32 +1036,137 @@ func (tr *Transport) Send(ctx context.Context, msg *common.Message) error {
 	if msg.To != "" {
 		u["$.to"] = []string{msg.To}
 	}
-	if msg.ExpiryTime != nil && !msg.ExpiryTime.IsZero() {
-		u["$.exp"] = []string{msg.ExpiryTime.UTC().Format(time.RFC3339)}
+	if msg.OutputName != "" {
+		u["$.on"] = []string{msg.OutputName}
+	}
+	if msg.ComponentName != "" {
+		u["$.sub"] = []string{msg.ComponentName}
+	}
+	if msg.ContentType != "" {
+		u["$.ct"] = []string{msg.ContentType}
+	}
+	if msg.ContentEncoding != "" {
+		u["$.ce"] = []string{msg.ContentEncoding}
+	}
+	if t, ok := msg.Expiry(); ok {
+		u["$.exp"] = []string{t.UTC().Format(time.RFC3339)}
+	}
+	if t, ok := msg.Created(); ok {
+		u[creationTimeProperty] = []string{t.UTC().Format(time.RFC3339)}
 	}
 	for k, v := range msg.Properties {
 		u[k] = []string{v}
 	}
 
-	dst := "devices/" + tr.did + "/messages/events/" + u.Encode()
+	dst := tr.prefix() + "/messages/events/" + u.Encode()
 	qos := DefaultQoS
 	if q, ok := msg.TransportOptions["qos"]; ok {
 		qos = q.(int) // panic if it's not an int
 		if qos != 0 && qos != 1 {
-			return fmt.Errorf("invalid QoS value: %d", qos)
+			return "", 0, fmt.Errorf("invalid QoS value: %d", qos)
 		}
 	}
-	return tr.send(ctx, dst, qos, msg.Payload)
+	return dst, qos, nil
 }
 
+// send publishes b and waits until it's written to the connection
+// with QoS 0 or until the hub acknowledges it with QoS 1.
 func (tr *Transport) send(ctx context.Context, topic string, qos int, b []byte) error {
+	t, err := tr.publish(topic, qos, b)
+	if err != nil {
+		return err
+	}
+	return tokenError(contextToken(ctx, t))
+}
+
+func (tr *Transport) publish(topic string, qos int, b []byte) (mqtt.Token, error) {
 	tr.mu.RLock()
+	defer tr.mu.RUnlock()
 	if tr.conn == nil {
-		tr.mu.RUnlock()
-		return errors.New("not connected")
+		return nil, errors.New("not connected")
 	}
+	tr.frames.Trace(transport.Outbound, "PUBLISH", topic, b, nil)
+	return tr.conn.Publish(topic, byte(qos), false, b), nil
+}
+
+// Ping implements transport.Pinger.
+//
+// The library sends PINGREQ packets on its own for keepalives only, so
+// the round trip is an UNSUBSCRIBE of a filter that's never subscribed
+// to, that the broker acknowledges without changing the session.
+func (tr *Transport) Ping(ctx context.Context) error {
+	tr.mu.RLock()
+	c := tr.conn
 	tr.mu.RUnlock()
-	return contextToken(ctx, tr.conn.Publish(topic, byte(qos), false, b))
+	if c == nil || !c.IsConnected() {
+		return errNotConnected
+	}
+	topic := tr.prefix() + "/messages/devicebound/ping"
+	tr.frames.Trace(transport.Outbound, "UNSUBSCRIBE", topic, nil, nil)
+	return tokenError(contextToken(ctx, c.Unsubscribe(topic)))
+}
+
+// tokenError converts library errors into retriable ones when possible.
+func tokenError(err error) error {
+	if err == mqtt.ErrNotConnected {
+		// the client is reconnecting at the moment
+		return errNotConnected
+	}
+	return err
+}
+
+// connectError marks connections refused by the hub with common.ErrUnauthorized,
+// that's what happens when the device is moved to another hub.
+func connectError(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, rc := range []byte{
+		packets.ErrRefusedIDRejected,
+		packets.ErrRefusedBadUsernameOrPassword,
+		packets.ErrRefusedNotAuthorised,
+	} {
+		// sometimes the library appends the cause to the error
+		if strings.HasPrefix(err.Error(), packets.ConnErrors[rc].Error()) {
+			return &refusedError{err}
+		}
+	}
+	return err
+}
+
+// refusedError is a connection refused by the hub.
+type refusedError struct {
+	err error
+}
+
+func (e *refusedError) Error() string {
+	return "connection refused: " + e.err.Error()
+}
+
+func (e *refusedError) Unwrap() error {
+	return e.err
+}
+
+func (e *refusedError) Is(target error) bool {
+	return target == common.ErrUnauthorized
+}
+
+var (
+	errRequestTimeout = &temporaryError{"request timed out"}
+	errNotConnected   = &temporaryError{"connection is not available"}
+)
+
+// temporaryError is a failure that can be retried.
+type temporaryError struct {
+	s string
+}
+
+func (e *temporaryError) Error() string {
+	return e.s
+}
+
+func (e *temporaryError) Temporary() bool {
+	return true
 }
 
 // mqtt lib doesn't support contexts currently
@@ -517,5 +1203,9 @@ func (tr *Transport) Close() error {
 		tr.conn.Disconnect(250)
 		tr.debugf("disconnected")
 	}
+	if tr.tunnel != nil {
+		tr.tunnel.close()
+	}
+	tr.dispatchState(transport.ConnectionDisabled, nil)
 	return nil
 }
@@ -1,8 +1,21 @@
 package mqtt
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/iotdevice/transport"
 )
 
 func TestParseCloudToDeviceTopic(t *testing.T) {
@@ -24,6 +37,22 @@ func TestParseCloudToDeviceTopic(t *testing.T) {
 	}
 }
 
+func TestParseCloudToDeviceTopicErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, s := range []string{
+		"devices/mydev/messages/devicebound/a=b",
+		"devices/mydev/messages/devicebound/%24.mid=1&a=%zz",
+		"devices/mydev/messages/devicebound/%24.mid=1&a=b&a=c",
+		"devices/mydev/messages/devicebound/%24.mid=1;a=b",
+		"devices/mydev/messages/devicebound/%24.mid=1%2",
+	} {
+		if p, err := parseCloudToDeviceTopic(s); err == nil {
+			t.Errorf("parseCloudToDeviceTopic(%q) = %v, want an error", s, p)
+		}
+	}
+}
+
 func TestParseDirectMethodTopic(t *testing.T) {
 	t.Parallel()
 
@@ -33,7 +62,7 @@ func TestParseDirectMethodTopic(t *testing.T) {
 		t.Fatal(err)
 	}
 	if m != "add" || r != 666 {
-		t.Errorf("parseDirectMethodTopic(%q) = %q, %q, want %q, %q", s, m, r, "add", 666)
+		t.Errorf("parseDirectMethodTopic(%q) = %q, %d, want %q, %d", s, m, r, "add", 666)
 	}
 }
 
@@ -46,6 +75,381 @@ func TestParseTwinPropsTopic(t *testing.T) {
 		t.Fatal(err)
 	}
 	if c != 200 || r != 12 || v != 4 {
-		t.Errorf("ParseTwinPropsTopic(%q) = %d, %q, %d, _, want %d, %q, %d, _", s, c, r, v, 200, 12, 4)
+		t.Errorf("ParseTwinPropsTopic(%q) = %d, %d, %d, _, want %d, %d, %d, _", s, c, r, v, 200, 12, 4)
+	}
+}
+
+func TestParseInputName(t *testing.T) {
+	t.Parallel()
+
+	for s, w := range map[string]string{
+		"devices/mydev/modules/mymod/inputs/input1/%24.mid=1": "input1",
+		"devices/mydev/modules/mymod/inputs/input1":           "input1",
+		"devices/mydev/messages/devicebound/%24.mid=1":        "",
+	} {
+		if g := parseInputName(s); g != w {
+			t.Errorf("parseInputName(%q) = %q, want %q", s, g, w)
+		}
+	}
+}
+
+func TestUsername(t *testing.T) {
+	t.Parallel()
+
+	tr := &Transport{}
+	if g, w := tr.username("h", "dev"), "h/dev/api-version="+common.APIVersion; g != w {
+		t.Errorf("username() = %q, want %q", g, w)
+	}
+	tr.SetModelID("dtmi:com:example:Thermostat;1")
+	w := "h/dev/?api-version=" + pnpAPIVersion + "&model-id=dtmi%3Acom%3Aexample%3AThermostat%3B1"
+	if g := tr.username("h", "dev"); g != w {
+		t.Errorf("username() = %q, want %q", g, w)
+	}
+}
+
+func TestTokenLifetime(t *testing.T) {
+	t.Parallel()
+
+	tr := New().(*Transport)
+	if !tr.clean || tr.ttl != DefaultTokenLifetime || tr.margin != 0 {
+		t.Errorf("New() clean = %t, ttl = %s, margin = %s, want true, %s, 0s",
+			tr.clean, tr.ttl, tr.margin, DefaultTokenLifetime)
+	}
+	tr = New(WithCleanSession(false), WithTokenLifetime(time.Minute, time.Second)).(*Transport)
+	if tr.clean || tr.ttl != time.Minute || tr.margin != time.Second {
+		t.Errorf("New(...) clean = %t, ttl = %s, margin = %s, want false, 1m0s, 1s",
+			tr.clean, tr.ttl, tr.margin)
+	}
+
+	for _, s := range [][2]time.Duration{
+		{0, 0},
+		{time.Minute, -time.Second},
+		{time.Minute, time.Minute},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("WithTokenLifetime(%s, %s) didn't panic", s[0], s[1])
+				}
+			}()
+			WithTokenLifetime(s[0], s[1])
+		}()
+	}
+}
+
+func TestConnectError(t *testing.T) {
+	t.Parallel()
+
+	for err, w := range map[error]bool{
+		packets.ConnErrors[packets.ErrRefusedNotAuthorised]:                                       true,
+		packets.ConnErrors[packets.ErrRefusedIDRejected]:                                          true,
+		fmt.Errorf("%s : %s", packets.ConnErrors[packets.ErrRefusedBadUsernameOrPassword], "EOF"): true,
+		packets.ConnErrors[packets.ErrRefusedServerUnavailable]:                                   false,
+		errors.New("EOF"): false,
+	} {
+		if g := errors.Is(connectError(err), common.ErrUnauthorized); g != w {
+			t.Errorf("connectError(%q) is unauthorized = %t, want %t", err, g, w)
+		}
+	}
+	if err := connectError(nil); err != nil {
+		t.Errorf("connectError(nil) = %v, want nil", err)
+	}
+}
+
+type dispatchFunc func(msg *common.Message)
+
+func (f dispatchFunc) Dispatch(msg *common.Message) {
+	f(msg)
+}
+
+func TestPublishFrameTrace(t *testing.T) {
+	t.Parallel()
+
+	var got *transport.Frame
+	tr := New().(*Transport)
+	tr.SetFrameHandler(func(f *transport.Frame) {
+		got = f
+	}, 2)
+	tr.conn = mqtt.NewClient(mqtt.NewClientOptions())
+	if _, err := tr.publish("devices/dev/messages/events/", 1, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	want := &transport.Frame{
+		Direction: transport.Outbound,
+		Type:      "PUBLISH",
+		Address:   "devices/dev/messages/events/",
+		Size:      5,
+		Payload:   []byte("he"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("frame = %+v, want %+v", got, want)
+	}
+}
+
+// testMessage is an incoming message with the given topic.
+type testMessage string
+
+func (m testMessage) Duplicate() bool   { return false }
+func (m testMessage) Qos() byte         { return 1 }
+func (m testMessage) Retained() bool    { return false }
+func (m testMessage) Topic() string     { return string(m) }
+func (m testMessage) MessageID() uint16 { return 1 }
+func (m testMessage) Payload() []byte   { return nil }
+
+func TestTwinResponseParseError(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	tr := New(WithLogger(log.New(&buf, "", 0))).(*Transport)
+	tr.subTwinResponses().handler(nil, testMessage("$iothub/twin/res/?$rid=1"))
+	if !strings.Contains(buf.String(), "parse twin props topic error") {
+		t.Errorf("log = %q, want the parse error", buf.String())
+	}
+}
+
+func TestRefreshResumesSession(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// the broker resumes the session on the second connection and
+	// delivers a queued message straight after CONNACK without
+	// waiting for subscriptions
+	go func() {
+		for i := 0; ; i++ {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSession(t, c, i > 0)
+		}
+	}()
+
+	msgc := make(chan *common.Message, 1)
+	tr := &Transport{
+		done: make(chan struct{}),
+		did:  "dev",
+		opts: mqtt.NewClientOptions().
+			AddBroker("tcp://" + l.Addr().String()).
+			SetClientID("dev").
+			SetCleanSession(false).
+			SetAutoReconnect(false),
+	}
+	tr.subs = append(tr.subs, tr.subEvents(dispatchFunc(func(msg *common.Message) {
+		msgc <- msg
+	})))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tr.conn = tr.newClient(tr.opts)
+	if err = contextToken(ctx, tr.conn.Connect()); err != nil {
+		t.Fatal(err)
+	}
+	if err = tr.refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer tr.conn.Disconnect(0)
+
+	select {
+	case msg := <-msgc:
+		if string(msg.Payload) != "hello" || msg.MessageID != "1" {
+			t.Errorf("queued message = %q (%q), want %q (%q)", msg.Payload, msg.MessageID, "hello", "1")
+		}
+	case <-ctx.Done():
+		t.Fatal("queued message is not delivered")
+	}
+}
+
+func TestPing(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	unsubc := make(chan []string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if _, err = packets.ReadPacket(c); err != nil {
+			return
+		}
+		if err = packets.NewControlPacket(packets.Connack).Write(c); err != nil {
+			return
+		}
+		for {
+			p, err := packets.ReadPacket(c)
+			if err != nil {
+				return
+			}
+			if p, ok := p.(*packets.UnsubscribePacket); ok {
+				unsubc <- p.Topics
+				ack := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+				ack.MessageID = p.MessageID
+				if err = ack.Write(c); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	tr := New().(*Transport)
+	if err = tr.Ping(context.Background()); err != errNotConnected {
+		t.Fatalf("Ping() = %v, want %v", err, errNotConnected)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tr.did = "dev"
+	tr.conn = mqtt.NewClient(mqtt.NewClientOptions().
+		AddBroker("tcp://" + l.Addr().String()).
+		SetAutoReconnect(false))
+	if err = contextToken(ctx, tr.conn.Connect()); err != nil {
+		t.Fatal(err)
+	}
+	defer tr.conn.Disconnect(0)
+	if err = tr.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"devices/dev/messages/devicebound/ping"}
+	if got := <-unsubc; !reflect.DeepEqual(got, want) {
+		t.Errorf("unsubscribed from %v, want %v", got, want)
+	}
+}
+
+func serveSession(t *testing.T, c net.Conn, queued bool) {
+	defer c.Close()
+	if _, err := packets.ReadPacket(c); err != nil {
+		t.Error(err)
+		return
+	}
+	ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	ack.SessionPresent = queued
+	if err := ack.Write(c); err != nil {
+		t.Error(err)
+		return
+	}
+	if queued {
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.Qos = 1
+		pub.MessageID = 1
+		pub.TopicName = "devices/dev/messages/devicebound/%24.mid=1"
+		pub.Payload = []byte("hello")
+		if err := pub.Write(c); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+	for {
+		if _, err := packets.ReadPacket(c); err != nil {
+			return
+		}
+	}
+}
+
+func BenchmarkParseCloudToDeviceTopic(b *testing.B) {
+	const s = "devices/mydev/messages/devicebound/%24.mid=1&%24.to=%2Fdevices%2Fmydev%2Fmessages%2FdeviceBound&a=b"
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseCloudToDeviceTopic(s); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParseDirectMethodTopic(b *testing.B) {
+	const s = "$iothub/methods/POST/add/?$rid=666"
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := parseDirectMethodTopic(s); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRequestStatus(t *testing.T) {
+	t.Parallel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// the broker responds to twin requests with the queued status codes
+	codes := make(chan int, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		if _, err = packets.ReadPacket(c); err != nil {
+			return
+		}
+		if err = packets.NewControlPacket(packets.Connack).Write(c); err != nil {
+			return
+		}
+		for {
+			p, err := packets.ReadPacket(c)
+			if err != nil {
+				return
+			}
+			switch p := p.(type) {
+			case *packets.SubscribePacket:
+				ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+				ack.MessageID = p.MessageID
+				ack.ReturnCodes = p.Qoss
+				err = ack.Write(c)
+			case *packets.PublishPacket:
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				if err = ack.Write(c); err != nil {
+					return
+				}
+				res := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+				res.TopicName = fmt.Sprintf("$iothub/twin/res/%d/?%s", <-codes, p.TopicName[strings.Index(p.TopicName, "$rid="):])
+				err = res.Write(c)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tr := New().(*Transport)
+	tr.conn = mqtt.NewClient(mqtt.NewClientOptions().
+		AddBroker("tcp://" + l.Addr().String()).
+		SetAutoReconnect(false))
+	if err = contextToken(ctx, tr.conn.Connect()); err != nil {
+		t.Fatal(err)
+	}
+	defer tr.conn.Disconnect(0)
+
+	for code, ok := range map[int]bool{
+		100: false,
+		200: true,
+		204: true,
+		299: true,
+		300: false,
+		429: false,
+	} {
+		codes <- code
+		_, err := tr.request(ctx, "$iothub/twin/GET/?$rid=%d", nil)
+		var e *common.HubError
+		if ok && err != nil || !ok && (!errors.As(err, &e) || e.StatusCode != code) {
+			t.Errorf("request() with status %d = %v, want success %t", code, err, ok)
+		}
 	}
 }
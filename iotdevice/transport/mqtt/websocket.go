@@ -0,0 +1,373 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/goautomotive/iothub/common"
+	"golang.org/x/net/websocket"
+)
+
+// websocketPath is the hub's MQTT over WebSockets endpoint.
+const websocketPath = "/$iothub/websocket"
+
+// WithWebSocket makes the transport connect over WebSockets on port 443,
+// that's often the only port allowed in restricted networks.
+//
+// HTTP and HTTPS proxies are taken from the HTTPS_PROXY and NO_PROXY
+// environment variables unless WithProxy is used.
+func WithWebSocket(enable bool) TransportOption {
+	return func(tr *Transport) {
+		tr.ws = enable
+	}
+}
+
+// WithProxy sets the function that returns the proxy url for
+// WebSocket connections, nil url means no proxy, see http.Transport.Proxy.
+func WithProxy(fn func(*http.Request) (*url.URL, error)) TransportOption {
+	if fn == nil {
+		panic("fn is nil")
+	}
+	return func(tr *Transport) {
+		tr.proxy = fn
+	}
+}
+
+// websocketBroker returns the broker url and the tls config
+// to connect to over WebSockets.
+//
+// The mqtt library cannot dial through proxies, so in this case a loopback
+// tunnel is started that pipes accepted connections to the hub.
+func (tr *Transport) websocketBroker(host string, tlsConfig *tls.Config) (string, *tls.Config, error) {
+	uri := "wss://" + host + ":443" + websocketPath
+	proxy := tr.proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	req, err := http.NewRequest(http.MethodGet, "https://"+host+websocketPath, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	p, err := proxy(req)
+	if err != nil {
+		return "", nil, err
+	}
+	if p == nil && tr.dial == nil {
+		return uri, tlsConfig, nil
+	}
+	return tr.startTunnel(func() (net.Conn, error) {
+		return dialWebSocket(tr.dial, p, uri, tlsConfig)
+	})
+}
+
+// dialerBroker returns the broker url and the tls config to connect
+// to addr with the custom dialer, the mqtt library cannot use it,
+// so it's tunneled the same way.
+func (tr *Transport) dialerBroker(addr string, tlsConfig *tls.Config) (string, *tls.Config, error) {
+	return tr.startTunnel(func() (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		defer cancel()
+		return common.DialTLS(ctx, tr.dial, addr, tlsConfig)
+	})
+}
+
+func (tr *Transport) startTunnel(dial func() (net.Conn, error)) (string, *tls.Config, error) {
+	t, err := newTunnel(dial, tr.errorf)
+	if err != nil {
+		return "", nil, err
+	}
+	tr.tunnel = t
+	return "tls://" + t.addr(), t.clientConfig, nil
+}
+
+// dialTimeout limits establishing connections to proxies and the hub.
+const dialTimeout = 30 * time.Second
+
+// dialWebSocket establishes a WebSocket connection to uri through
+// the proxy when it's not nil, connections are made with dial if it's set.
+func dialWebSocket(dial common.Dialer, proxy *url.URL, uri string, tlsConfig *tls.Config) (net.Conn, error) {
+	config, err := websocket.NewConfig(uri, "https://"+tlsConfig.ServerName)
+	if err != nil {
+		return nil, err
+	}
+	config.Protocol = []string{"mqtt"}
+	config.TlsConfig = tlsConfig
+
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	var tc net.Conn
+	if proxy == nil {
+		tc, err = common.DialTLS(ctx, dial, config.Location.Host, tlsConfig)
+	} else {
+		var conn net.Conn
+		if conn, err = dialProxy(ctx, dial, proxy, config.Location.Host); err == nil {
+			tc, err = tlsHandshake(ctx, conn, tlsConfig)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	ws, err := websocket.NewClient(config, tc)
+	if err != nil {
+		tc.Close()
+		return nil, err
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// tlsHandshake starts a TLS session over conn.
+func tlsHandshake(ctx context.Context, conn net.Conn, config *tls.Config) (net.Conn, error) {
+	tc := tls.Client(conn, config)
+	if d, ok := ctx.Deadline(); ok {
+		tc.SetDeadline(d)
+	}
+	if err := tc.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+// dialProxy opens a tunnel to addr with the HTTP CONNECT method.
+func dialProxy(ctx context.Context, dial common.Dialer, proxy *url.URL, addr string) (net.Conn, error) {
+	host := proxy.Host
+	if proxy.Port() == "" {
+		switch proxy.Scheme {
+		case "https":
+			host = net.JoinHostPort(host, "443")
+		default:
+			host = net.JoinHostPort(host, "80")
+		}
+	}
+
+	var conn net.Conn
+	var err error
+	switch proxy.Scheme {
+	case "http":
+		conn, err = dial(ctx, "tcp", host)
+	case "https":
+		conn, err = common.DialTLS(ctx, dial, host, &tls.Config{
+			ServerName: proxy.Hostname(),
+		})
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", proxy.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if u := proxy.User; u != nil {
+		p, _ := u.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+
+			base64.StdEncoding.EncodeToString([]byte(u.Username()+":"+p)))
+	}
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// the proxy sends nothing after the response
+	// until the tls handshake is started
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy connect error: %s", res.Status)
+	}
+	return conn, nil
+}
+
+// tunnel pipes loopback connections to ones made with dial.
+//
+// Other local processes must neither read nor use it, so the listener
+// requires TLS with a key pair generated for the tunnel that only
+// clientConfig holds, the same certificate authenticates both ends.
+type tunnel struct {
+	ln           net.Listener
+	dial         func() (net.Conn, error)
+	errf         func(format string, v ...interface{})
+	clientConfig *tls.Config
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func newTunnel(dial func() (net.Conn, error), errf func(format string, v ...interface{})) (*tunnel, error) {
+	cert, err := tunnelCert()
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS13,
+	})
+	if err != nil {
+		return nil, err
+	}
+	t := &tunnel{
+		ln:   ln,
+		dial: dial,
+		errf: errf,
+		clientConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      pool,
+			ServerName:   tunnelName,
+			MinVersion:   tls.VersionTLS13,
+		},
+		conns: map[net.Conn]struct{}{},
+	}
+	go t.serve()
+	return t, nil
+}
+
+// tunnelName is the tunnel certificate's subject name.
+const tunnelName = "iothub-tunnel"
+
+// tunnelCert generates a self-signed certificate
+// for both server and client authentication.
+func tunnelCert() (tls.Certificate, error) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: tunnelName},
+		DNSNames:              []string{tunnelName},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(100 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+func (t *tunnel) addr() string {
+	return t.ln.Addr().String()
+}
+
+func (t *tunnel) serve() {
+	for {
+		c, err := t.ln.Accept()
+		if err != nil {
+			return
+		}
+		go t.pipe(c)
+	}
+}
+
+func (t *tunnel) pipe(c net.Conn) {
+	defer c.Close()
+	// authenticate the peer before dialing anywhere on its behalf
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	err := c.(*tls.Conn).HandshakeContext(ctx)
+	cancel()
+	if err != nil {
+		t.errf("tunnel handshake error: %s", err)
+		return
+	}
+	rc, err := t.dial()
+	if err != nil {
+		t.errf("websocket dial error: %s", err)
+		return
+	}
+	defer rc.Close()
+	if !t.track(c, rc) {
+		return
+	}
+	defer t.untrack(c, rc)
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(rc, c)
+		rc.Close()
+		close(done)
+	}()
+	io.Copy(c, rc)
+	c.Close()
+	<-done
+}
+
+// track registers connections, false means the tunnel is closed.
+func (t *tunnel) track(conns ...net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns == nil {
+		return false
+	}
+	for _, c := range conns {
+		t.conns[c] = struct{}{}
+	}
+	return true
+}
+
+func (t *tunnel) untrack(conns ...net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, c := range conns {
+		delete(t.conns, c)
+	}
+}
+
+// close stops accepting connections and closes active ones.
+func (t *tunnel) close() error {
+	t.mu.Lock()
+	if t.conns == nil {
+		t.mu.Unlock()
+		return errors.New("tunnel is already closed")
+	}
+	for c := range t.conns {
+		c.Close()
+	}
+	t.conns = nil
+	t.mu.Unlock()
+	return t.ln.Close()
+}
@@ -0,0 +1,286 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"golang.org/x/net/websocket"
+)
+
+func TestDialProxy(t *testing.T) {
+	t.Parallel()
+
+	// the proxy echoes everything back after the tunnel is established
+	var target string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect || r.Header.Get("Proxy-Authorization") == "" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		target = r.Host
+		c, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+		rw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+		rw.Flush()
+		io.Copy(c, rw)
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.User = url.UserPassword("user", "pass")
+
+	tn, err := newTunnel(func() (net.Conn, error) {
+		return dialProxy(context.Background(), (&net.Dialer{}).DialContext, u, "hub.example.com:443")
+	}, t.Errorf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tn.close()
+
+	c, err := tls.Dial("tcp", tn.addr(), tn.clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = c.Write([]byte("ping\n")); err != nil {
+		t.Fatal(err)
+	}
+	g, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g != "ping\n" {
+		t.Errorf("tunnel echo = %q, want %q", g, "ping\n")
+	}
+	if target != "hub.example.com:443" {
+		t.Errorf("CONNECT target = %q, want %q", target, "hub.example.com:443")
+	}
+}
+
+func TestDialerBroker(t *testing.T) {
+	t.Parallel()
+
+	// borrow the test certificate issued for example.com,
+	// the tls server echoes everything back
+	s := httptest.NewTLSServer(nil)
+	defer s.Close()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", s.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+
+	var dialed string
+	tr := &Transport{dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = addr
+		return (&net.Dialer{}).DialContext(ctx, network, l.Addr().String())
+	}}
+	uri, tc, err := tr.dialerBroker("example.com:8883", &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.tunnel.close()
+
+	c, err := tls.Dial("tcp", strings.TrimPrefix(uri, "tls://"), tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = c.Write([]byte("ping\n")); err != nil {
+		t.Fatal(err)
+	}
+	g, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g != "ping\n" {
+		t.Errorf("tunnel echo = %q, want %q", g, "ping\n")
+	}
+	if dialed != "example.com:8883" {
+		t.Errorf("dialed %q, want %q", dialed, "example.com:8883")
+	}
+}
+
+func TestTunnelAuth(t *testing.T) {
+	t.Parallel()
+
+	dialed := make(chan struct{}, 3)
+	tn, err := newTunnel(func() (net.Conn, error) {
+		dialed <- struct{}{}
+		return nil, errors.New("dialed")
+	}, func(string, ...interface{}) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tn.close()
+
+	// plaintext
+	c, err := net.Dial("tcp", tn.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("CONNECT\n"))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.ReadAll(c)
+	c.Close()
+
+	// no client certificate
+	cfg := tn.clientConfig.Clone()
+	cfg.Certificates = nil
+	if c, err := tls.Dial("tcp", tn.addr(), cfg); err == nil {
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = c.Read(make([]byte, 1))
+		c.Close()
+		if err == nil {
+			t.Error("tunnel accepted a connection without the client certificate")
+		}
+	}
+
+	// a foreign certificate
+	cert, err := tunnelCert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = tn.clientConfig.Clone()
+	cfg.Certificates = []tls.Certificate{cert}
+	if c, err := tls.Dial("tcp", tn.addr(), cfg); err == nil {
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = c.Read(make([]byte, 1))
+		c.Close()
+		if err == nil {
+			t.Error("tunnel accepted a connection with a foreign certificate")
+		}
+	}
+
+	select {
+	case <-dialed:
+		t.Error("tunnel dialed on behalf of an unauthenticated peer")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestTunnelForwarding(t *testing.T) {
+	t.Parallel()
+
+	// the hub accepts MQTT connections both over tls and WebSockets,
+	// test certificates are issued for example.com
+	ids := make(chan string, 1)
+	serve := func(c net.Conn) {
+		defer c.Close()
+		p, err := packets.ReadPacket(c)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ids <- p.(*packets.ConnectPacket).ClientIdentifier
+		if err = packets.NewControlPacket(packets.Connack).Write(c); err != nil {
+			return
+		}
+		for {
+			if _, err = packets.ReadPacket(c); err != nil {
+				return
+			}
+		}
+	}
+	s := httptest.NewTLSServer(websocket.Handler(func(ws *websocket.Conn) {
+		ws.PayloadType = websocket.BinaryFrame
+		serve(ws)
+	}))
+	defer s.Close()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", s.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(c)
+		}
+	}()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+	hubTLS := &tls.Config{RootCAs: pool, ServerName: "example.com"}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		switch addr {
+		case "example.com:8883":
+			addr = l.Addr().String()
+		case "example.com:443":
+			addr = s.Listener.Addr().String()
+		default:
+			return nil, fmt.Errorf("unexpected address %q", addr)
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+
+	for name, broker := range map[string]func(tr *Transport) (string, *tls.Config, error){
+		"dialer": func(tr *Transport) (string, *tls.Config, error) {
+			return tr.dialerBroker("example.com:8883", hubTLS)
+		},
+		"websocket": func(tr *Transport) (string, *tls.Config, error) {
+			tr.proxy = func(*http.Request) (*url.URL, error) { return nil, nil }
+			return tr.websocketBroker("example.com", hubTLS)
+		},
+	} {
+		tr := &Transport{dial: dial}
+		uri, tc, err := broker(tr)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		c := mqtt.NewClient(mqtt.NewClientOptions().
+			AddBroker(uri).
+			SetTLSConfig(tc).
+			SetClientID(name).
+			SetAutoReconnect(false))
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err = contextToken(ctx, c.Connect()); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		cancel()
+		if id := <-ids; id != name {
+			t.Errorf("%s: client id = %q, want %q", name, id, name)
+		}
+		c.Disconnect(0)
+		tr.tunnel.close()
+	}
+}
@@ -0,0 +1,193 @@
+// Package record implements a device transport middleware that records
+// sessions to JSON lines golden files and a transport that replays them,
+// so twin and direct method flows can be regression tested offline.
+//
+// Only calls of the transport.Transport interface are recorded, optional
+// interfaces like transport.Settler aren't exposed by the wrapper.
+package record
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/iotdevice/transport"
+)
+
+// Operation types, the first group is made by the device
+// and the second one is received from the hub.
+const (
+	OpConnect         = "connect"
+	OpSend            = "send"
+	OpRegisterMethods = "register-methods"
+	OpSubscribeEvents = "subscribe-events"
+	OpSubscribeTwin   = "subscribe-twin"
+	OpRetrieveTwin    = "retrieve-twin"
+	OpUpdateTwin      = "update-twin"
+	OpClose           = "close"
+	OpEvent           = "event"
+	OpTwinUpdate      = "twin-update"
+	OpMethodCall      = "method-call"
+	OpMethodResult    = "method-result"
+)
+
+// Entry is a recorded operation, one per line of a golden file.
+type Entry struct {
+	Op      string          `json:"op"`
+	Message *common.Message `json:"message,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Code    int             `json:"code,omitempty"` // method result code
+	Version int             `json:"version,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// inbound reports whether the operation is initiated by the hub.
+func (e *Entry) inbound() bool {
+	switch e.Op {
+	case OpEvent, OpTwinUpdate, OpMethodCall, OpMethodResult:
+		return true
+	default:
+		return false
+	}
+}
+
+// New creates a transport that passes all calls to tr and writes them
+// along with their results and everything received from the hub to w.
+func New(tr transport.Transport, w io.Writer) *Recorder {
+	if tr == nil {
+		panic("tr is nil")
+	}
+	if w == nil {
+		panic("w is nil")
+	}
+	return &Recorder{tr: tr, enc: json.NewEncoder(w)}
+}
+
+// Recorder is a recording transport.
+type Recorder struct {
+	tr  transport.Transport
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error
+}
+
+var _ transport.Transport = (*Recorder)(nil)
+
+// Err returns the first error happened while writing the recording.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *Recorder) write(e *Entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = r.enc.Encode(e)
+	}
+}
+
+func (r *Recorder) writeErr(e *Entry, err error) {
+	if err != nil {
+		e.Error = err.Error()
+	}
+	r.write(e)
+}
+
+// Connect implements transport.Transport, credentials aren't recorded.
+func (r *Recorder) Connect(ctx context.Context, creds transport.Credentials) error {
+	err := r.tr.Connect(ctx, creds)
+	r.writeErr(&Entry{Op: OpConnect}, err)
+	return err
+}
+
+// Send implements transport.Transport.
+func (r *Recorder) Send(ctx context.Context, msg *common.Message) error {
+	err := r.tr.Send(ctx, msg)
+	r.writeErr(&Entry{Op: OpSend, Message: msg}, err)
+	return err
+}
+
+// RegisterDirectMethods implements transport.Transport.
+func (r *Recorder) RegisterDirectMethods(ctx context.Context, mux transport.MethodDispatcher) error {
+	err := r.tr.RegisterDirectMethods(ctx, &methodRecorder{r, mux})
+	r.writeErr(&Entry{Op: OpRegisterMethods}, err)
+	return err
+}
+
+// SubscribeEvents implements transport.Transport.
+func (r *Recorder) SubscribeEvents(ctx context.Context, mux transport.MessageDispatcher) error {
+	err := r.tr.SubscribeEvents(ctx, &eventRecorder{r, mux})
+	r.writeErr(&Entry{Op: OpSubscribeEvents}, err)
+	return err
+}
+
+// SubscribeTwinUpdates implements transport.Transport.
+func (r *Recorder) SubscribeTwinUpdates(ctx context.Context, mux transport.TwinStateDispatcher) error {
+	err := r.tr.SubscribeTwinUpdates(ctx, &twinRecorder{r, mux})
+	r.writeErr(&Entry{Op: OpSubscribeTwin}, err)
+	return err
+}
+
+// RetrieveTwinProperties implements transport.Transport.
+func (r *Recorder) RetrieveTwinProperties(ctx context.Context) ([]byte, error) {
+	b, err := r.tr.RetrieveTwinProperties(ctx)
+	r.writeErr(&Entry{Op: OpRetrieveTwin, Payload: b}, err)
+	return b, err
+}
+
+// UpdateTwinProperties implements transport.Transport.
+func (r *Recorder) UpdateTwinProperties(ctx context.Context, payload []byte) (int, error) {
+	ver, err := r.tr.UpdateTwinProperties(ctx, payload)
+	r.writeErr(&Entry{Op: OpUpdateTwin, Payload: payload, Version: ver}, err)
+	return ver, err
+}
+
+// SubscribeConnectionState implements transport.Transport, connection
+// state changes depend on the network so they aren't recorded.
+func (r *Recorder) SubscribeConnectionState(ctx context.Context, mux transport.ConnectionStateDispatcher) error {
+	return r.tr.SubscribeConnectionState(ctx, mux)
+}
+
+// Close implements transport.Transport.
+func (r *Recorder) Close() error {
+	err := r.tr.Close()
+	r.writeErr(&Entry{Op: OpClose}, err)
+	return err
+}
+
+type methodRecorder struct {
+	r   *Recorder
+	mux transport.MethodDispatcher
+}
+
+func (m *methodRecorder) Dispatch(methodName string, b []byte) (int, []byte, error) {
+	m.r.write(&Entry{Op: OpMethodCall, Method: methodName, Payload: b})
+	rc, data, err := m.mux.Dispatch(methodName, b)
+	m.r.writeErr(&Entry{Op: OpMethodResult, Method: methodName, Code: rc, Payload: data}, err)
+	return rc, data, err
+}
+
+type eventRecorder struct {
+	r   *Recorder
+	mux transport.MessageDispatcher
+}
+
+func (m *eventRecorder) Dispatch(msg *common.Message) {
+	m.r.write(&Entry{Op: OpEvent, Message: msg})
+	m.mux.Dispatch(msg)
+}
+
+type twinRecorder struct {
+	r   *Recorder
+	mux transport.TwinStateDispatcher
+}
+
+func (m *twinRecorder) Dispatch(b []byte) {
+	m.r.write(&Entry{Op: OpTwinUpdate, Payload: b})
+	m.mux.Dispatch(b)
+}
@@ -0,0 +1,104 @@
+package record
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/goautomotive/iothub/iotdevice"
+	"github.com/goautomotive/iothub/iotdevice/transport"
+	"github.com/goautomotive/iothub/iothubtest"
+)
+
+func TestRecordReplay(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	h := iothubtest.NewHub()
+	defer h.Close()
+	cs, err := h.CreateDevice("dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	rec := New(h.Transport(), &b)
+	if err := session(ctx, rec, cs, []byte("hello"), func() error {
+		if _, _, err := h.Call(ctx, "dev", "ping", []byte(`{"n":1}`)); err != nil {
+			return err
+		}
+		_, err := h.UpdateDesired("dev", map[string]interface{}{"interval": 10})
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err = rec.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the hub's side is played back by the replayer
+	rp, err := NewReplayer(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = session(ctx, rp, cs, []byte("hello"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = rp.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	rp, err = NewReplayer(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = session(ctx, rp, cs, []byte("changed"), nil); err == nil {
+		t.Fatal("session with a different message succeeded")
+	}
+	if rp.Err() == nil {
+		t.Error("Err() = nil, want a mismatch")
+	}
+}
+
+// session connects a device that sends payload, answers a ping method
+// and reports back the desired interval, hub makes the hub's part.
+func session(ctx context.Context, tr transport.Transport, cs string, payload []byte, hub func() error) error {
+	c, err := iotdevice.NewClient(
+		iotdevice.WithTransport(tr),
+		iotdevice.WithConnectionString(cs),
+	)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err = c.Connect(ctx); err != nil {
+		return err
+	}
+	if err = c.RegisterMethod(ctx, "ping", func(p map[string]interface{}) (map[string]interface{}, error) {
+		return map[string]interface{}{"pong": p["n"]}, nil
+	}); err != nil {
+		return err
+	}
+	sub, err := c.SubscribeTwinUpdates(ctx)
+	if err != nil {
+		return err
+	}
+	if err = c.SendEvent(ctx, payload); err != nil {
+		return err
+	}
+	if hub != nil {
+		if err = hub(); err != nil {
+			return err
+		}
+	}
+	select {
+	case s := <-sub.C():
+		_, err = c.UpdateTwinState(ctx, iotdevice.TwinState{"interval": s["interval"]})
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
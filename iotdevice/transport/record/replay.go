@@ -0,0 +1,350 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+
+	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/iotdevice/transport"
+)
+
+// NewReplayer reads the recording made by Recorder from r.
+//
+// The replayer is a transport that expects calls to be made in the recorded
+// order, it returns recorded results and fails calls that don't match
+// the recording. Operations initiated by the hub are played back as soon
+// as all calls recorded before them are made, method results returned
+// by the device are compared with the recorded ones.
+//
+// Messages are matched by payload and properties,
+// twin patches and method payloads by their json values.
+func NewReplayer(r io.Reader) (*Replayer, error) {
+	var entries []*Entry
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		if len(bytes.TrimSpace(s.Bytes())) == 0 {
+			continue
+		}
+		e := &Entry{}
+		if err := json.Unmarshal(s.Bytes(), e); err != nil {
+			return nil, fmt.Errorf("record: entry %d: %s", len(entries), err)
+		}
+		entries = append(entries, e)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	rp := &Replayer{
+		entries: entries,
+		changed: make(chan struct{}),
+		results: make(chan methodResult, 16),
+		done:    make(chan struct{}),
+	}
+	go rp.play()
+	return rp, nil
+}
+
+// Replayer is a replaying transport, see NewReplayer.
+type Replayer struct {
+	entries []*Entry
+	results chan methodResult
+	done    chan struct{}
+	once    sync.Once
+
+	mu      sync.Mutex
+	pos     int           // next entry
+	changed chan struct{} // closed when pos or dispatchers change
+	err     error         // first mismatch
+	methods transport.MethodDispatcher
+	events  transport.MessageDispatcher
+	twin    transport.TwinStateDispatcher
+}
+
+var _ transport.Transport = (*Replayer)(nil)
+
+type methodResult struct {
+	rc   int
+	data []byte
+	err  error
+}
+
+var (
+	errEndOfRecording = errors.New("record: end of recording")
+	errClosed         = errors.New("record: transport is closed")
+)
+
+// Err returns the first mismatch or an error when
+// not all of the recorded operations have been replayed.
+func (rp *Replayer) Err() error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.err != nil {
+		return rp.err
+	}
+	if rp.pos < len(rp.entries) {
+		return fmt.Errorf("record: %d entries not replayed, next is %s",
+			len(rp.entries)-rp.pos, rp.entries[rp.pos].Op)
+	}
+	return nil
+}
+
+// fail stores the first mismatch, rp.mu must be held.
+func (rp *Replayer) fail(err error) error {
+	if rp.err == nil {
+		rp.err = err
+	}
+	return err
+}
+
+// notify wakes up waiters, rp.mu must be held.
+func (rp *Replayer) notify() {
+	close(rp.changed)
+	rp.changed = make(chan struct{})
+}
+
+// next waits until the current entry satisfies ok and consumes it.
+func (rp *Replayer) next(ctx context.Context, ok func(e *Entry) bool) (*Entry, error) {
+	for {
+		rp.mu.Lock()
+		if rp.pos >= len(rp.entries) {
+			rp.mu.Unlock()
+			return nil, errEndOfRecording
+		}
+		if e := rp.entries[rp.pos]; ok(e) {
+			rp.pos++
+			rp.notify()
+			rp.mu.Unlock()
+			return e, nil
+		}
+		ch := rp.changed
+		rp.mu.Unlock()
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-rp.done:
+			return nil, errClosed
+		}
+	}
+}
+
+// call consumes the entry of the outgoing operation.
+func (rp *Replayer) call(ctx context.Context, op string) (*Entry, error) {
+	e, err := rp.next(ctx, func(e *Entry) bool {
+		return !e.inbound()
+	})
+	if err == errEndOfRecording {
+		rp.mu.Lock()
+		defer rp.mu.Unlock()
+		return nil, rp.fail(fmt.Errorf("record: unexpected %s after the end of recording", op))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if e.Op != op {
+		return nil, rp.mismatch("got %s, want %s", op, e.Op)
+	}
+	return e, nil
+}
+
+func (rp *Replayer) mismatch(format string, v ...interface{}) error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return rp.fail(fmt.Errorf("record: "+format, v...))
+}
+
+// result is the recorded error of the operation.
+func result(e *Entry) error {
+	if e.Error == "" {
+		return nil
+	}
+	return errors.New(e.Error)
+}
+
+// play dispatches operations initiated by the hub.
+func (rp *Replayer) play() {
+	for {
+		e, err := rp.next(context.Background(), func(e *Entry) bool {
+			switch e.Op {
+			case OpEvent:
+				return rp.events != nil
+			case OpTwinUpdate:
+				return rp.twin != nil
+			case OpMethodCall:
+				return rp.methods != nil
+			case OpMethodResult:
+				return true
+			default:
+				return false
+			}
+		})
+		if err != nil {
+			return
+		}
+
+		rp.mu.Lock()
+		events, twin, methods := rp.events, rp.twin, rp.methods
+		rp.mu.Unlock()
+		switch e.Op {
+		case OpEvent:
+			events.Dispatch(e.Message)
+		case OpTwinUpdate:
+			twin.Dispatch(e.Payload)
+		case OpMethodCall:
+			// handlers may make calls recorded before the result
+			go func(e *Entry) {
+				rc, data, err := methods.Dispatch(e.Method, e.Payload)
+				rp.results <- methodResult{rc, data, err}
+			}(e)
+		case OpMethodResult:
+			var res methodResult
+			select {
+			case res = <-rp.results:
+			case <-rp.done:
+				return
+			}
+			if res.rc != e.Code || !jsonEqual(res.data, e.Payload) || errString(res.err) != e.Error {
+				rp.mismatch("%s result = %d %s %v, want %d %s %s",
+					e.Method, res.rc, res.data, res.err, e.Code, e.Payload, e.Error)
+			}
+		}
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func jsonEqual(a, b []byte) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	var x, y interface{}
+	if json.Unmarshal(a, &x) != nil || json.Unmarshal(b, &y) != nil {
+		return bytes.Equal(a, b)
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+// Connect implements transport.Transport, credentials are ignored.
+func (rp *Replayer) Connect(ctx context.Context, creds transport.Credentials) error {
+	e, err := rp.call(ctx, OpConnect)
+	if err != nil {
+		return err
+	}
+	return result(e)
+}
+
+// Send implements transport.Transport.
+func (rp *Replayer) Send(ctx context.Context, msg *common.Message) error {
+	e, err := rp.call(ctx, OpSend)
+	if err != nil {
+		return err
+	}
+	if e.Message == nil || !bytes.Equal(msg.Payload, e.Message.Payload) ||
+		!propsEqual(msg.Properties, e.Message.Properties) {
+		return rp.mismatch("got message %q %v, want %q %v",
+			msg.Payload, msg.Properties, e.Message.Payload, e.Message.Properties)
+	}
+	return result(e)
+}
+
+func propsEqual(a, b map[string]string) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// RegisterDirectMethods implements transport.Transport.
+func (rp *Replayer) RegisterDirectMethods(ctx context.Context, mux transport.MethodDispatcher) error {
+	rp.mu.Lock()
+	rp.methods = mux
+	rp.notify()
+	rp.mu.Unlock()
+	e, err := rp.call(ctx, OpRegisterMethods)
+	if err != nil {
+		return err
+	}
+	return result(e)
+}
+
+// SubscribeEvents implements transport.Transport.
+func (rp *Replayer) SubscribeEvents(ctx context.Context, mux transport.MessageDispatcher) error {
+	// recorded messages can be delivered before subscribing returns
+	rp.mu.Lock()
+	rp.events = mux
+	rp.notify()
+	rp.mu.Unlock()
+	e, err := rp.call(ctx, OpSubscribeEvents)
+	if err != nil {
+		return err
+	}
+	return result(e)
+}
+
+// SubscribeTwinUpdates implements transport.Transport.
+func (rp *Replayer) SubscribeTwinUpdates(ctx context.Context, mux transport.TwinStateDispatcher) error {
+	rp.mu.Lock()
+	rp.twin = mux
+	rp.notify()
+	rp.mu.Unlock()
+	e, err := rp.call(ctx, OpSubscribeTwin)
+	if err != nil {
+		return err
+	}
+	return result(e)
+}
+
+// RetrieveTwinProperties implements transport.Transport.
+func (rp *Replayer) RetrieveTwinProperties(ctx context.Context) ([]byte, error) {
+	e, err := rp.call(ctx, OpRetrieveTwin)
+	if err != nil {
+		return nil, err
+	}
+	return e.Payload, result(e)
+}
+
+// UpdateTwinProperties implements transport.Transport.
+func (rp *Replayer) UpdateTwinProperties(ctx context.Context, payload []byte) (int, error) {
+	e, err := rp.call(ctx, OpUpdateTwin)
+	if err != nil {
+		return 0, err
+	}
+	if !jsonEqual(payload, e.Payload) {
+		return 0, rp.mismatch("got twin patch %s, want %s", payload, e.Payload)
+	}
+	return e.Version, result(e)
+}
+
+// SubscribeConnectionState implements transport.Transport, it's a no-op.
+func (rp *Replayer) SubscribeConnectionState(ctx context.Context, mux transport.ConnectionStateDispatcher) error {
+	return nil
+}
+
+// Close implements transport.Transport, it stops
+// playing back operations initiated by the hub.
+func (rp *Replayer) Close() error {
+	rp.mu.Lock()
+	if rp.pos < len(rp.entries) && rp.entries[rp.pos].Op == OpClose {
+		rp.pos++
+		rp.notify()
+	}
+	rp.mu.Unlock()
+	rp.once.Do(func() {
+		close(rp.done)
+	})
+	return nil
+}
@@ -9,6 +9,9 @@ import (
 )
 
 // Transport interface.
+//
+// Messages passed to Send may be reused once it returns,
+// so transports must not retain them.
 type Transport interface {
 	Connect(ctx context.Context, creds Credentials) error
 	Send(ctx context.Context, msg *common.Message) error
@@ -17,14 +20,152 @@ type Transport interface {
 	SubscribeTwinUpdates(ctx context.Context, mux TwinStateDispatcher) error
 	RetrieveTwinProperties(ctx context.Context) (payload []byte, err error)
 	UpdateTwinProperties(ctx context.Context, payload []byte) (version int, err error)
+	SubscribeConnectionState(ctx context.Context, mux ConnectionStateDispatcher) error
 	Close() error
 }
 
+// ConnectionState is a transport connection state.
+type ConnectionState int
+
+const (
+	// ConnectionConnected connection is established.
+	ConnectionConnected ConnectionState = iota + 1
+
+	// ConnectionDisconnected connection is lost.
+	ConnectionDisconnected
+
+	// ConnectionReconnecting transport is trying to re-establish the connection.
+	ConnectionReconnecting
+
+	// ConnectionDisabled transport is closed and no reconnects
+	// are going to be made.
+	ConnectionDisabled
+
+	// ConnectionTokenExpired connection is dropped by the hub
+	// because the SAS token used for authentication has expired.
+	ConnectionTokenExpired
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case ConnectionConnected:
+		return "connected"
+	case ConnectionDisconnected:
+		return "disconnected"
+	case ConnectionReconnecting:
+		return "reconnecting"
+	case ConnectionDisabled:
+		return "disabled"
+	case ConnectionTokenExpired:
+		return "token-expired"
+	default:
+		return "unknown"
+	}
+}
+
+// ConnectionStateDispatcher handles connection state changes,
+// err is the cause of the change if any.
+type ConnectionStateDispatcher interface {
+	Dispatch(state ConnectionState, err error)
+}
+
+// ModelAnnouncer is implemented by transports that can announce
+// the IoT Plug and Play model id when connecting to the hub.
+type ModelAnnouncer interface {
+	SetModelID(id string)
+}
+
+// MethodConcurrencyLimiter is implemented by transports that can
+// dispatch direct methods concurrently, so a slow handler doesn't
+// hold up other invocations.
+type MethodConcurrencyLimiter interface {
+	// SetMethodConcurrency limits the number of concurrently running
+	// handlers, 1 dispatches methods one by one in the arrival order.
+	SetMethodConcurrency(n int)
+}
+
+// CustomDialer is implemented by transports that can establish
+// connections to the hub with a user-supplied dialer.
+type CustomDialer interface {
+	SetDialer(fn common.Dialer)
+}
+
+// Reauthenticator is implemented by transports that can re-authenticate
+// the live connection with a fresh token, e.g. after the key is rotated.
+// It's a no-op when the transport is not connected.
+type Reauthenticator interface {
+	Reauthenticate(ctx context.Context) error
+}
+
+// Redirector is implemented by transports that can move the live
+// connection to another hub, e.g. after the device is reassigned by DPS,
+// creds report the new hub's hostname. Subscriptions are kept.
+//
+// Transports mark connections refused by the hub that may be caused
+// by reassignments with common.ErrUnauthorized, dispatching
+// ConnectionDisconnected with it when it happens on reconnects.
+type Redirector interface {
+	Redirect(ctx context.Context, creds Credentials) error
+}
+
+// Pinger is implemented by transports that can check the connection
+// liveness with a protocol-level round trip to the hub that's not billed
+// as a message. It fails when the transport is not connected.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// AsyncSender is implemented by transports that can pipeline messages,
+// the returned channel receives the sending result once it's known,
+// e.g. when the hub acknowledges the message.
+type AsyncSender interface {
+	SendAsync(ctx context.Context, msg *common.Message) <-chan error
+}
+
+// BatchSender is implemented by transports that can send
+// multiple messages at once, e.g. AMQP and HTTP.
+type BatchSender interface {
+	SendBatch(ctx context.Context, msgs []*common.Message) error
+}
+
+// BatchSizer is implemented by batch senders that encode messages with
+// an overhead, e.g. HTTP sends base64 payloads in a JSON array,
+// BatchSize is the number of bytes msg takes in a batch.
+type BatchSizer interface {
+	BatchSize(msg *common.Message) int
+}
+
 // MessageDispatcher handles incoming messages.
 type MessageDispatcher interface {
 	Dispatch(msg *common.Message)
 }
 
+// Settlement is a cloud-to-device message settlement outcome.
+type Settlement int
+
+const (
+	// SettleComplete removes the message from the device queue.
+	SettleComplete Settlement = iota + 1
+
+	// SettleReject removes the message from the device queue
+	// and sends a negative feedback to the sender.
+	SettleReject
+
+	// SettleAbandon puts the message back into the device queue
+	// so it's delivered again later.
+	SettleAbandon
+)
+
+// Settler is implemented by transports that can explicitly settle
+// received cloud-to-device messages, e.g. AMQP and HTTP.
+type Settler interface {
+	// SetManualSettlement disables automatic completion of received messages.
+	SetManualSettlement(enable bool)
+
+	// Settle settles the given message received from the transport.
+	Settle(ctx context.Context, msg *common.Message, s Settlement) error
+}
+
 // TwinStateDispatcher handles twin state updates.
 type TwinStateDispatcher interface {
 	Dispatch(b []byte)
@@ -36,9 +177,14 @@ type MethodDispatcher interface {
 }
 
 // Credentials is connection credentials needed for x509 or sas authentication.
+//
+// ModuleID is empty for plain devices, GatewayHostName is empty
+// when the client connects straight to the hub.
 type Credentials interface {
 	DeviceID() string
+	ModuleID() string
 	Hostname() string
+	GatewayHostName() string
 	TLSConfig() *tls.Config
 	IsSAS() bool
 	Token(ctx context.Context, uri string, d time.Duration) (string, error)
@@ -0,0 +1,109 @@
+package twin
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Diff returns sorted paths of leaf attributes that differ between a and b,
+// including added and removed ones. Metadata attributes that start with $,
+// like $version and $metadata, are ignored.
+func Diff(a, b map[string]interface{}) []string {
+	var paths []string
+	diff(a, b, "", &paths)
+	sort.Strings(paths)
+
+	// a leaf replaced with an empty object is reported twice
+	n := 0
+	for i, p := range paths {
+		if i == 0 || p != paths[n-1] {
+			paths[n] = p
+			n++
+		}
+	}
+	return paths[:n]
+}
+
+func diff(a, b map[string]interface{}, prefix string, paths *[]string) {
+	for k, av := range a {
+		if strings.HasPrefix(k, "$") {
+			continue
+		}
+		bv, ok := b[k]
+		if !ok {
+			leaves(av, prefix+k, paths)
+			continue
+		}
+		am, aok := av.(map[string]interface{})
+		bm, bok := bv.(map[string]interface{})
+		switch {
+		case aok && bok:
+			diff(am, bm, prefix+k+".", paths)
+		case aok || bok:
+			// a leaf replaced with an object or vice versa
+			leaves(av, prefix+k, paths)
+			leaves(bv, prefix+k, paths)
+		case !reflect.DeepEqual(av, bv):
+			*paths = append(*paths, prefix+k)
+		}
+	}
+	for k, bv := range b {
+		if _, ok := a[k]; ok || strings.HasPrefix(k, "$") {
+			continue
+		}
+		leaves(bv, prefix+k, paths)
+	}
+}
+
+// leaves appends paths of all leaf attributes of v, v itself is a leaf
+// when it's not an object or it's an empty one.
+func leaves(v interface{}, path string, paths *[]string) {
+	m, ok := v.(map[string]interface{})
+	if !ok || len(m) == 0 {
+		*paths = append(*paths, path)
+		return
+	}
+	for k, v := range m {
+		if strings.HasPrefix(k, "$") {
+			continue
+		}
+		leaves(v, path+"."+k, paths)
+	}
+}
+
+// Get returns the attribute at the given dot-separated path.
+func Get(m map[string]interface{}, path string) (interface{}, bool) {
+	keys := strings.Split(path, ".")
+	for _, k := range keys[:len(keys)-1] {
+		n, ok := m[k].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		m = n
+	}
+	v, ok := m[keys[len(keys)-1]]
+	return v, ok
+}
+
+// Merge applies the JSON merge patch, like desired properties
+// updates received from the hub, to m and returns it.
+// Attributes set to null are removed, m can be nil.
+func Merge(m, patch map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		m = make(map[string]interface{}, len(patch))
+	}
+	for k, v := range patch {
+		if v == nil {
+			delete(m, k)
+			continue
+		}
+		if p, ok := v.(map[string]interface{}); ok {
+			n, _ := m[k].(map[string]interface{})
+			m[k] = Merge(n, p)
+			continue
+		}
+		m[k] = v
+	}
+	return m
+}
@@ -0,0 +1,55 @@
+package twin
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func decode(t *testing.T, s string) map[string]interface{} {
+	t.Helper()
+	var v map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestDiff(t *testing.T) {
+	t.Parallel()
+
+	a := decode(t, `{"a":{"b":1,"c":2},"d":"x","e":true,"f":1,"$version":1}`)
+	b := decode(t, `{"a":{"b":1,"c":3},"d":{"g":1},"f":{},"h":[1],"$version":2}`)
+	w := []string{"a.c", "d", "d.g", "e", "f", "h"}
+	if g := Diff(a, b); !reflect.DeepEqual(g, w) {
+		t.Errorf("Diff() = %v, want %v", g, w)
+	}
+	if g := Diff(a, a); len(g) != 0 {
+		t.Errorf("Diff(a, a) = %v, want none", g)
+	}
+}
+
+func TestGet(t *testing.T) {
+	t.Parallel()
+
+	m := decode(t, `{"a":{"b":{"c":1}}}`)
+	if v, ok := Get(m, "a.b.c"); !ok || v != float64(1) {
+		t.Errorf("Get(a.b.c) = %v, %t, want 1, true", v, ok)
+	}
+	if _, ok := Get(m, "a.x.c"); ok {
+		t.Errorf("Get(a.x.c) found, want not found")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	t.Parallel()
+
+	m := Merge(
+		decode(t, `{"a":{"b":1,"c":2},"d":1}`),
+		decode(t, `{"a":{"c":null,"e":3},"d":null,"f":"x"}`),
+	)
+	w := decode(t, `{"a":{"b":1,"e":3},"f":"x"}`)
+	if !reflect.DeepEqual(m, w) {
+		t.Errorf("Merge() = %v, want %v", m, w)
+	}
+}
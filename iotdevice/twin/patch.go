@@ -0,0 +1,65 @@
+// Package twin provides helpers for building device twin updates.
+package twin
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Patch is a reported properties JSON merge patch,
+// it contains only changed attributes with removed ones set to null.
+//
+// Paths are dot-separated attribute names, e.g. `a.b` stands for `{"a":{"b":...}}`.
+type Patch struct {
+	m map[string]interface{}
+}
+
+// NewPatch creates an empty patch.
+func NewPatch() *Patch {
+	return &Patch{m: map[string]interface{}{}}
+}
+
+// Set sets the attribute at the given path to v.
+func (p *Patch) Set(path string, v interface{}) *Patch {
+	p.put(path, v)
+	return p
+}
+
+// Delete removes the attribute at the given path.
+func (p *Patch) Delete(path string) *Patch {
+	p.put(path, nil)
+	return p
+}
+
+func (p *Patch) put(path string, v interface{}) {
+	if path == "" {
+		panic("path is blank")
+	}
+	keys := strings.Split(path, ".")
+	m := p.m
+	for _, k := range keys[:len(keys)-1] {
+		n, ok := m[k].(map[string]interface{})
+		if !ok {
+			// overwrites previously set leaf values
+			n = map[string]interface{}{}
+			m[k] = n
+		}
+		m = n
+	}
+	m[keys[len(keys)-1]] = v
+}
+
+// Empty reports whether the patch has no changes.
+func (p *Patch) Empty() bool {
+	return len(p.m) == 0
+}
+
+// Map returns the patch as a nested map.
+func (p *Patch) Map() map[string]interface{} {
+	return p.m
+}
+
+// MarshalJSON implements json.Marshaler.
+func (p *Patch) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.m)
+}
@@ -0,0 +1,28 @@
+package twin
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPatch(t *testing.T) {
+	t.Parallel()
+
+	p := NewPatch().
+		Set("a.b", 1).
+		Set("a.c.d", "x").
+		Delete("e").
+		Set("f", 1).
+		Set("f.g", true)
+	b, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := `{"a":{"b":1,"c":{"d":"x"}},"e":null,"f":{"g":true}}`
+	if string(b) != w {
+		t.Errorf("Marshal(patch) = %s, want %s", b, w)
+	}
+	if NewPatch().Empty() != true {
+		t.Errorf("Empty() = false for a new patch, want true")
+	}
+}
@@ -0,0 +1,71 @@
+package iotdevice
+
+import (
+	"strings"
+	"time"
+
+	"github.com/goautomotive/iothub/iotdevice/twin"
+)
+
+// PropertyMetadata is the hub's metadata of a twin property.
+type PropertyMetadata struct {
+	LastUpdated        time.Time
+	LastUpdatedVersion int // it's set only for desired properties
+}
+
+// Get returns the property at the given dot-separated path.
+func (s TwinState) Get(path string) (interface{}, bool) {
+	return twin.Get(s, path)
+}
+
+// Properties returns the state without metadata attributes, $version and $metadata.
+func (s TwinState) Properties() map[string]interface{} {
+	m := make(map[string]interface{}, len(s))
+	for k, v := range s {
+		if !strings.HasPrefix(k, "$") {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// LastUpdated returns when any of the properties was last updated,
+// it's zero when the state has no metadata, e.g. it's a change.
+func (s TwinState) LastUpdated() time.Time {
+	md, _ := s.Metadata("")
+	if md == nil {
+		return time.Time{}
+	}
+	return md.LastUpdated
+}
+
+// Metadata returns metadata of the property at the given dot-separated
+// path, that's helpful for acknowledging writable properties with
+// the version they were last updated with. Blank path stands for the
+// whole state.
+//
+// Only states retrieved with RetrieveTwinState and initial states
+// of subscriptions include metadata, changes don't.
+func (s TwinState) Metadata(path string) (*PropertyMetadata, bool) {
+	m, ok := s["$metadata"].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	if path != "" {
+		v, ok := twin.Get(m, path)
+		if !ok {
+			return nil, false
+		}
+		if m, ok = v.(map[string]interface{}); !ok {
+			return nil, false
+		}
+	}
+	md := &PropertyMetadata{}
+	if ts, ok := m["$lastUpdated"].(string); ok {
+		md.LastUpdated, _ = time.Parse(time.RFC3339Nano, ts)
+	}
+	if v, ok := m["$lastUpdatedVersion"].(float64); ok {
+		md.LastUpdatedVersion = int(v)
+	}
+	return md, true
+}
@@ -0,0 +1,47 @@
+package iotdevice
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTwinStateMetadata(t *testing.T) {
+	t.Parallel()
+
+	var s TwinState
+	if err := json.Unmarshal([]byte(`{
+		"config":{"interval":10},
+		"$metadata":{
+			"$lastUpdated":"2020-01-02T03:04:05.6Z",
+			"config":{
+				"$lastUpdated":"2020-01-02T03:04:05Z",
+				"$lastUpdatedVersion":3,
+				"interval":{"$lastUpdated":"2020-01-02T03:04:05Z","$lastUpdatedVersion":4}
+			}
+		},
+		"$version":4
+	}`), &s); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := time.Date(2020, 1, 2, 3, 4, 5, 6e8, time.UTC); !s.LastUpdated().Equal(w) {
+		t.Errorf("LastUpdated() = %s, want %s", s.LastUpdated(), w)
+	}
+	md, ok := s.Metadata("config.interval")
+	if !ok {
+		t.Fatal("Metadata(config.interval) not found")
+	}
+	if md.LastUpdatedVersion != 4 {
+		t.Errorf("LastUpdatedVersion = %d, want 4", md.LastUpdatedVersion)
+	}
+	if _, ok = s.Metadata("missing"); ok {
+		t.Error("Metadata(missing) found, want not found")
+	}
+	if v, _ := s.Get("config.interval"); v != float64(10) {
+		t.Errorf("Get(config.interval) = %v, want 10", v)
+	}
+	if p := s.Properties(); len(p) != 1 || p["config"] == nil {
+		t.Errorf("Properties() = %v, want only config", p)
+	}
+}
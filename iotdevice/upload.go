@@ -0,0 +1,193 @@
+package iotdevice
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/goautomotive/iothub/common"
+)
+
+// blockSize is the size of blob blocks uploaded at once,
+// it limits memory used for streaming files to the storage.
+const blockSize = 4 << 20
+
+// uploadRetry retries transient storage failures when there's
+// no retry policy set, uploading blocks can be repeated safely.
+var uploadRetry = common.ExponentialRetry(time.Second, 30*time.Second, 3)
+
+// WithHTTPClient changes default http client used for files uploading,
+// both with the hub and the storage.
+func WithHTTPClient(client *http.Client) ClientOption {
+	return func(c *Client) error {
+		c.http = client
+		c.blob = client
+		return nil
+	}
+}
+
+// UploadFile streams data read from r to the storage account associated
+// with the hub under the given blob name and notifies the hub about the result.
+//
+// Transient storage failures are retried according to WithRetryPolicy,
+// three times with exponential backoff when it's not set.
+//
+// It works regardless of the used transport and talks to the hub over HTTPS,
+// so there's no need to connect the client first.
+func (c *Client) UploadFile(ctx context.Context, blobName string, r io.Reader) error {
+	if blobName == "" {
+		return errors.New("blob name is blank")
+	}
+	if r == nil {
+		panic("r is nil")
+	}
+
+	var v struct {
+		CorrelationID string `json:"correlationId"`
+		HostName      string `json:"hostName"`
+		ContainerName string `json:"containerName"`
+		BlobName      string `json:"blobName"`
+		SASToken      string `json:"sasToken"`
+	}
+	if err := c.hubRequest(ctx, http.MethodPost, "files", map[string]string{
+		"blobName": blobName,
+	}, &v); err != nil {
+		return err
+	}
+
+	blobURL := "https://" + v.HostName + "/" + v.ContainerName + "/" + v.BlobName + v.SASToken
+	err := c.uploadBlob(ctx, blobURL, r)
+
+	n := map[string]interface{}{
+		"correlationId":     v.CorrelationID,
+		"isSuccess":         true,
+		"statusCode":        200,
+		"statusDescription": "uploaded",
+	}
+	if err != nil {
+		n["isSuccess"] = false
+		n["statusCode"] = 500
+		n["statusDescription"] = err.Error()
+	}
+	if nerr := c.hubRequest(ctx, http.MethodPost, "files/notifications", n, nil); nerr != nil && err == nil {
+		err = nerr
+	}
+	return err
+}
+
+// uploadBlob puts data as a sequence of blocks and commits them,
+// so it's not needed to know the stream length in advance.
+func (c *Client) uploadBlob(ctx context.Context, blobURL string, r io.Reader) error {
+	var ids []string
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%08d", len(ids))))
+		if err := c.blobRequest(ctx, blobURL+"&comp=block&blockid="+url.QueryEscape(id), buf[:n]); err != nil {
+			return err
+		}
+		ids = append(ids, id)
+		if n < blockSize {
+			break
+		}
+	}
+
+	l := struct {
+		XMLName xml.Name `xml:"BlockList"`
+		Latest  []string `xml:"Latest"`
+	}{Latest: ids}
+	b, err := xml.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return c.blobRequest(ctx, blobURL+"&comp=blocklist", b)
+}
+
+func (c *Client) blobRequest(ctx context.Context, uri string, b []byte) error {
+	p := c.retry
+	if p == nil {
+		p = uploadRetry
+	}
+	return common.Retry(ctx, p, func() error {
+		req, err := http.NewRequest(http.MethodPut, uri, bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("x-ms-version", "2018-03-28")
+		res, err := c.blob.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+		if res.StatusCode != http.StatusCreated {
+			// storage errors are transient the same way as the hub's ones
+			return fmt.Errorf("blob upload failed: %w", common.NewHubError(res.StatusCode, nil, body))
+		}
+		return nil
+	})
+}
+
+// hubRequest makes a REST request to the device resource on the hub.
+func (c *Client) hubRequest(ctx context.Context, method, path string, r, v interface{}) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	uri := "https://" + c.creds.Hostname() + "/devices/" + url.PathEscape(c.creds.DeviceID()) +
+		"/" + path + "?api-version=" + common.APIVersion
+	req, err := http.NewRequest(method, uri, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if c.creds.IsSAS() {
+		sas, err := c.creds.Token(ctx, c.creds.Hostname(), time.Hour)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", sas)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	c.debugf(common.ComponentClient, "%s %s %d: %s", method, uri, res.StatusCode, body)
+	if res.StatusCode == http.StatusTooManyRequests {
+		c.add(common.MetricThrottled)
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return common.NewHubError(res.StatusCode, res.Header, body)
+	}
+	if v == nil || len(body) == 0 {
+		return nil
+	}
+	return json.Unmarshal(body, v)
+}
@@ -0,0 +1,129 @@
+package iotdevice
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/iotdevice/transport/mqtt"
+)
+
+func TestUploadFile(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu     sync.Mutex
+		blocks [][]byte
+		commit []byte
+		notify map[string]interface{}
+		fails  int
+	)
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.URL.Path == "/devices/dev/files":
+			if r.Header.Get("Authorization") == "" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"correlationId":"cid","hostName":"` + r.Host +
+				`","containerName":"c","blobName":"dev/blob","sasToken":"?sig=x"}`))
+		case r.URL.Path == "/c/dev/blob" && r.URL.Query().Get("comp") == "block":
+			// the storage is busy on the first attempt
+			if fails == 0 {
+				fails++
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			blocks = append(blocks, b)
+			w.WriteHeader(http.StatusCreated)
+		case r.URL.Path == "/c/dev/blob" && r.URL.Query().Get("comp") == "blocklist":
+			commit = b
+			w.WriteHeader(http.StatusCreated)
+		case r.URL.Path == "/devices/dev/files/notifications":
+			if err := json.Unmarshal(b, &notify); err != nil {
+				t.Error(err)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+
+	c, err := NewClient(
+		WithTransport(mqtt.New()),
+		WithConnectionString("HostName="+strings.TrimPrefix(s.URL, "https://")+
+			";DeviceId=dev;SharedAccessKey=c2VjcmV0"),
+		WithHTTPClient(s.Client()),
+		WithRetryPolicy(common.LinearRetry(time.Millisecond, 1)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte{'a'}, blockSize+10)
+	if err := c.UploadFile(context.Background(), "blob", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	if fails != 1 {
+		t.Errorf("failed block uploads = %d, want 1", fails)
+	}
+	if len(blocks) != 2 || !bytes.Equal(bytes.Join(blocks, nil), data) {
+		t.Errorf("uploaded %d blocks and data mismatches", len(blocks))
+	}
+	if !bytes.Contains(commit, []byte("<Latest>")) {
+		t.Errorf("block list = %q, want committed blocks", commit)
+	}
+	if notify["correlationId"] != "cid" || notify["isSuccess"] != true {
+		t.Errorf("notification = %v, want successful notification", notify)
+	}
+}
+
+func TestUploadSystemRoots(t *testing.T) {
+	t.Parallel()
+
+	s := httptest.NewUnstartedServer(http.NotFoundHandler())
+	s.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	s.StartTLS()
+	defer s.Close()
+	pem := []byte("-----BEGIN CERTIFICATE-----\n" +
+		base64.StdEncoding.EncodeToString(s.Certificate().Raw) +
+		"\n-----END CERTIFICATE-----\n")
+
+	c, err := NewClient(
+		WithTransport(mqtt.New()),
+		WithConnectionString("HostName=test.azure-devices.net;DeviceId=dev;SharedAccessKey=c2VjcmV0"),
+		WithTrustBundle(pem),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.http.Transport.(*http.Transport).TLSClientConfig.RootCAs == nil {
+		t.Error("hub requests don't use the trust bundle")
+	}
+	// storage requests verify the certificate against system roots only
+	if tc := c.blob.Transport.(*http.Transport).TLSClientConfig; tc != nil && tc.RootCAs != nil {
+		t.Error("storage requests use hub root CAs")
+	}
+	if _, err = c.blob.Get(s.URL); err == nil {
+		t.Error("storage request trusts the hub's CA")
+	}
+}
@@ -0,0 +1,383 @@
+package iotdevice
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/goautomotive/iothub/common"
+)
+
+// Validator checks messages before they're sent or delivered.
+type Validator interface {
+	Validate(msg *common.Message) error
+}
+
+// ValidatorFunc is a function implementing Validator.
+type ValidatorFunc func(msg *common.Message) error
+
+// Validate implements Validator.
+func (fn ValidatorFunc) Validate(msg *common.Message) error {
+	return fn(msg)
+}
+
+// ErrInvalidMessage is matched with errors.Is by *ValidationError.
+var ErrInvalidMessage = errors.New("message is invalid")
+
+// ValidationError is returned when a message fails validation,
+// Inbound is true for cloud-to-device messages.
+type ValidationError struct {
+	Message *common.Message
+	Inbound bool
+	Err     error
+}
+
+func (e *ValidationError) Error() string {
+	if e.Inbound {
+		return "invalid cloud-to-device message: " + e.Err.Error()
+	}
+	return "invalid device-to-cloud message: " + e.Err.Error()
+}
+
+// Unwrap returns the validator's error.
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes the error match ErrInvalidMessage.
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrInvalidMessage
+}
+
+// WithOutboundValidator validates all device-to-cloud messages before
+// they're sent, invalid ones fail with *ValidationError.
+// Payloads are validated before compression.
+func WithOutboundValidator(v Validator) ClientOption {
+	return func(c *Client) error {
+		c.outbound = v
+		return nil
+	}
+}
+
+// WithInboundValidator validates cloud-to-device messages, invalid ones
+// are not delivered to subscriptions but reported to the logger, with
+// WithManualSettlement they're rejected so the hub doesn't redeliver them.
+// Payloads are validated after decompression.
+func WithInboundValidator(v Validator) ClientOption {
+	return func(c *Client) error {
+		c.evMux.validator = v
+		return nil
+	}
+}
+
+// validate runs the outbound validator if it's set.
+func (c *Client) validate(msg *common.Message) error {
+	if c.outbound == nil {
+		return nil
+	}
+	if err := c.outbound.Validate(msg); err != nil {
+		return &ValidationError{Message: msg, Err: err}
+	}
+	return nil
+}
+
+// JSONSchema validates message payloads against a JSON Schema, it
+// supports a subset of the draft 7 vocabulary sufficient for telemetry:
+// type, enum, const, properties, required, additionalProperties, items,
+// minItems, maxItems, minLength, maxLength, pattern, minimum, maximum,
+// exclusiveMinimum, exclusiveMaximum and multipleOf. Unknown keywords
+// are ignored.
+type JSONSchema struct {
+	root *schemaNode
+}
+
+// NewJSONSchema compiles the schema document.
+func NewJSONSchema(schema []byte) (*JSONSchema, error) {
+	var v interface{}
+	if err := json.Unmarshal(schema, &v); err != nil {
+		return nil, fmt.Errorf("schema: %s", err)
+	}
+	n, err := compileSchema(v, "#")
+	if err != nil {
+		return nil, err
+	}
+	return &JSONSchema{root: n}, nil
+}
+
+// Validate implements Validator, the payload has to be valid JSON.
+func (s *JSONSchema) Validate(msg *common.Message) error {
+	var v interface{}
+	if err := json.Unmarshal(msg.Payload, &v); err != nil {
+		return fmt.Errorf("payload is not valid json: %s", err)
+	}
+	return s.root.validate(v, "$")
+}
+
+type schemaNode struct {
+	always     *bool // true and false schemas
+	types      []string
+	enum       []interface{}
+	constant   interface{}
+	hasConst   bool
+	properties map[string]*schemaNode
+	required   []string
+	additional *schemaNode // nil allows any additional properties
+	items      *schemaNode
+	minItems   *float64
+	maxItems   *float64
+	minLength  *float64
+	maxLength  *float64
+	pattern    *regexp.Regexp
+	minimum    *float64
+	maximum    *float64
+	exMinimum  *float64
+	exMaximum  *float64
+	multipleOf *float64
+}
+
+func compileSchema(v interface{}, path string) (*schemaNode, error) {
+	if b, ok := v.(bool); ok {
+		return &schemaNode{always: &b}, nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("schema %s: must be an object or a boolean", path)
+	}
+	n := &schemaNode{}
+	switch t := m["type"].(type) {
+	case nil:
+	case string:
+		n.types = []string{t}
+	case []interface{}:
+		for _, x := range t {
+			s, ok := x.(string)
+			if !ok {
+				return nil, fmt.Errorf("schema %s/type: must be a string or an array of strings", path)
+			}
+			n.types = append(n.types, s)
+		}
+	default:
+		return nil, fmt.Errorf("schema %s/type: must be a string or an array of strings", path)
+	}
+	for _, typ := range n.types {
+		switch typ {
+		case "null", "boolean", "object", "array", "number", "string", "integer":
+		default:
+			return nil, fmt.Errorf("schema %s/type: unknown type %q", path, typ)
+		}
+	}
+	if e, ok := m["enum"]; ok {
+		if n.enum, ok = e.([]interface{}); !ok {
+			return nil, fmt.Errorf("schema %s/enum: must be an array", path)
+		}
+	}
+	n.constant, n.hasConst = m["const"]
+
+	if p, ok := m["properties"]; ok {
+		props, ok := p.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("schema %s/properties: must be an object", path)
+		}
+		n.properties = make(map[string]*schemaNode, len(props))
+		for k, x := range props {
+			var err error
+			if n.properties[k], err = compileSchema(x, path+"/properties/"+k); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if r, ok := m["required"]; ok {
+		l, ok := r.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("schema %s/required: must be an array of strings", path)
+		}
+		for _, x := range l {
+			s, ok := x.(string)
+			if !ok {
+				return nil, fmt.Errorf("schema %s/required: must be an array of strings", path)
+			}
+			n.required = append(n.required, s)
+		}
+	}
+	for k, dst := range map[string]**schemaNode{
+		"additionalProperties": &n.additional,
+		"items":                &n.items,
+	} {
+		if x, ok := m[k]; ok {
+			var err error
+			if *dst, err = compileSchema(x, path+"/"+k); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for k, dst := range map[string]**float64{
+		"minItems":         &n.minItems,
+		"maxItems":         &n.maxItems,
+		"minLength":        &n.minLength,
+		"maxLength":        &n.maxLength,
+		"minimum":          &n.minimum,
+		"maximum":          &n.maximum,
+		"exclusiveMinimum": &n.exMinimum,
+		"exclusiveMaximum": &n.exMaximum,
+		"multipleOf":       &n.multipleOf,
+	} {
+		if x, ok := m[k]; ok {
+			f, ok := x.(float64)
+			if !ok {
+				return nil, fmt.Errorf("schema %s/%s: must be a number", path, k)
+			}
+			*dst = &f
+		}
+	}
+	if p, ok := m["pattern"]; ok {
+		s, ok := p.(string)
+		if !ok {
+			return nil, fmt.Errorf("schema %s/pattern: must be a string", path)
+		}
+		var err error
+		if n.pattern, err = regexp.Compile(s); err != nil {
+			return nil, fmt.Errorf("schema %s/pattern: %s", path, err)
+		}
+	}
+	return n, nil
+}
+
+// jsonType returns the JSON Schema type of a decoded value.
+func jsonType(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if x == math.Trunc(x) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func (n *schemaNode) validate(v interface{}, path string) error {
+	if n.always != nil {
+		if !*n.always {
+			return fmt.Errorf("%s: not allowed", path)
+		}
+		return nil
+	}
+	if len(n.types) != 0 {
+		typ, ok := jsonType(v), false
+		for _, t := range n.types {
+			if t == typ || t == "number" && typ == "integer" {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%s: %s is not %s", path, typ, strings.Join(n.types, " or "))
+		}
+	}
+	if n.enum != nil {
+		ok := false
+		for _, x := range n.enum {
+			if jsonEqual(x, v) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%s: not one of the enum values", path)
+		}
+	}
+	if n.hasConst && !jsonEqual(n.constant, v) {
+		return fmt.Errorf("%s: doesn't equal the const value", path)
+	}
+
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for _, k := range n.required {
+			if _, ok := x[k]; !ok {
+				return fmt.Errorf("%s: missing required property %q", path, k)
+			}
+		}
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys) // report errors deterministically
+		for _, k := range keys {
+			s, ok := n.properties[k]
+			if !ok {
+				s = n.additional
+			}
+			if s == nil {
+				continue
+			}
+			if err := s.validate(x[k], path+"."+k); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		if n.minItems != nil && float64(len(x)) < *n.minItems {
+			return fmt.Errorf("%s: fewer than %v items", path, *n.minItems)
+		}
+		if n.maxItems != nil && float64(len(x)) > *n.maxItems {
+			return fmt.Errorf("%s: more than %v items", path, *n.maxItems)
+		}
+		if n.items != nil {
+			for i := range x {
+				if err := n.items.validate(x[i], fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		l := float64(utf8.RuneCountInString(x))
+		if n.minLength != nil && l < *n.minLength {
+			return fmt.Errorf("%s: shorter than %v characters", path, *n.minLength)
+		}
+		if n.maxLength != nil && l > *n.maxLength {
+			return fmt.Errorf("%s: longer than %v characters", path, *n.maxLength)
+		}
+		if n.pattern != nil && !n.pattern.MatchString(x) {
+			return fmt.Errorf("%s: doesn't match %q", path, n.pattern)
+		}
+	case float64:
+		switch {
+		case n.minimum != nil && x < *n.minimum:
+			return fmt.Errorf("%s: %v is less than %v", path, x, *n.minimum)
+		case n.maximum != nil && x > *n.maximum:
+			return fmt.Errorf("%s: %v is greater than %v", path, x, *n.maximum)
+		case n.exMinimum != nil && x <= *n.exMinimum:
+			return fmt.Errorf("%s: %v is not greater than %v", path, x, *n.exMinimum)
+		case n.exMaximum != nil && x >= *n.exMaximum:
+			return fmt.Errorf("%s: %v is not less than %v", path, x, *n.exMaximum)
+		case n.multipleOf != nil && *n.multipleOf != 0 &&
+			math.Abs(math.Remainder(x, *n.multipleOf)) > 1e-9:
+			return fmt.Errorf("%s: %v is not a multiple of %v", path, x, *n.multipleOf)
+		}
+	}
+	return nil
+}
+
+func jsonEqual(a, b interface{}) bool {
+	x, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	y, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return string(x) == string(y) // maps are marshaled with sorted keys
+}
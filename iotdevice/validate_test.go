@@ -0,0 +1,126 @@
+package iotdevice
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/goautomotive/iothub/common"
+)
+
+const testSchema = `{
+	"type": "object",
+	"required": ["temperature", "unit"],
+	"properties": {
+		"temperature": {"type": "number", "minimum": -50, "exclusiveMaximum": 100},
+		"unit": {"enum": ["C", "F"]},
+		"sensor": {"type": "string", "pattern": "^s[0-9]+$", "maxLength": 4},
+		"counts": {"type": "array", "items": {"type": "integer", "multipleOf": 2}, "maxItems": 2}
+	},
+	"additionalProperties": false
+}`
+
+func TestJSONSchema(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewJSONSchema([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for payload, want := range map[string]string{
+		`{"temperature":20.5,"unit":"C"}`:                          "",
+		`{"temperature":20,"unit":"F","sensor":"s1","counts":[2]}`: "",
+		`{"temperature":20}`:                                       `missing required property "unit"`,
+		`{"temperature":"20","unit":"C"}`:                          "$.temperature: string is not number",
+		`{"temperature":-51,"unit":"C"}`:                           "-51 is less than -50",
+		`{"temperature":100,"unit":"C"}`:                           "100 is not less than 100",
+		`{"temperature":1,"unit":"K"}`:                             "$.unit: not one of the enum values",
+		`{"temperature":1,"unit":"C","sensor":"x1"}`:               `doesn't match`,
+		`{"temperature":1,"unit":"C","sensor":"s1234"}`:            "longer than 4 characters",
+		`{"temperature":1,"unit":"C","counts":[2,3]}`:              "$.counts[1]: 3 is not a multiple of 2",
+		`{"temperature":1,"unit":"C","counts":[1.5]}`:              "$.counts[0]: number is not integer",
+		`{"temperature":1,"unit":"C","counts":[2,2,2]}`:            "more than 2 items",
+		`{"temperature":1,"unit":"C","extra":1}`:                   "$.extra: not allowed",
+		`[]`:                                                       "array is not object",
+		`{`:                                                        "not valid json",
+	} {
+		err := s.Validate(&common.Message{Payload: []byte(payload)})
+		if want == "" && err != nil {
+			t.Errorf("Validate(%s) = %v, want nil", payload, err)
+		} else if want != "" && (err == nil || !strings.Contains(err.Error(), want)) {
+			t.Errorf("Validate(%s) = %v, want %q", payload, err, want)
+		}
+	}
+
+	for _, schema := range []string{
+		`[]`,
+		`{"type":"float"}`,
+		`{"properties":{"a":1}}`,
+		`{"minimum":"1"}`,
+		`{"pattern":"("}`,
+		`{"required":[1]}`,
+	} {
+		if _, err := NewJSONSchema([]byte(schema)); err == nil {
+			t.Errorf("NewJSONSchema(%s) = nil error", schema)
+		}
+	}
+}
+
+func TestOutboundValidator(t *testing.T) {
+	t.Parallel()
+
+	s, err := NewJSONSchema([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &testTransport{}
+	c := newTestClient(t, tr, WithOutboundValidator(s), WithCompression(Gzip))
+
+	if err = c.SendEvent(context.Background(), []byte(`{"temperature":1,"unit":"C"}`)); err != nil {
+		t.Fatal(err)
+	}
+	err = c.SendEvent(context.Background(), []byte(`{"temperature":1}`))
+	var verr *ValidationError
+	if !errors.Is(err, ErrInvalidMessage) || !errors.As(err, &verr) || verr.Inbound {
+		t.Errorf("SendEvent(invalid) = %v, want *ValidationError", err)
+	}
+	if err = c.SendEventBatch(context.Background(), []*common.Message{
+		{Payload: []byte(`{"temperature":1,"unit":"C"}`)},
+		{Payload: []byte(`{}`)},
+	}); !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("SendEventBatch(invalid) = %v, want ErrInvalidMessage", err)
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if len(tr.sent) != 1 {
+		t.Errorf("sent %d messages, want 1", len(tr.sent))
+	}
+}
+
+func TestInboundValidator(t *testing.T) {
+	t.Parallel()
+
+	var invalid []*ValidationError
+	mux := &eventsMux{
+		validator: ValidatorFunc(func(msg *common.Message) error {
+			if string(msg.Payload) != "ok" {
+				return errors.New("not ok")
+			}
+			return nil
+		}),
+		onInvalid: func(err *ValidationError) {
+			invalid = append(invalid, err)
+		},
+	}
+	sub := subscribe(t, mux)
+	mux.Dispatch(&common.Message{Payload: []byte("bad")})
+	mux.Dispatch(&common.Message{Payload: []byte("ok")})
+	if msg := <-sub.C(); string(msg.Payload) != "ok" {
+		t.Errorf("received %q, want %q", msg.Payload, "ok")
+	}
+	if len(invalid) != 1 || !invalid[0].Inbound || string(invalid[0].Message.Payload) != "bad" {
+		t.Errorf("invalid messages = %v, want the bad one", invalid)
+	}
+}
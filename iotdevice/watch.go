@@ -0,0 +1,71 @@
+package iotdevice
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/goautomotive/iothub/iotdevice/twin"
+)
+
+// DesiredWatchFunc is called with the new value of the watched desired
+// property and the desired state version, that's used for acknowledging
+// writable properties, v is nil when the property is removed.
+type DesiredWatchFunc func(v interface{}, version int)
+
+// DesiredWatch is a desired property watch.
+type DesiredWatch struct {
+	sub *TwinStateSub
+}
+
+// Close stops the watch.
+func (w *DesiredWatch) Close() error {
+	return w.sub.Close()
+}
+
+// WatchDesired calls fn every time the desired property at the given
+// dot-separated path or any of its nested attributes changes, e.g.
+//
+//	c.WatchDesired(ctx, "config.telemetryInterval", func(v interface{}, version int) {
+//		interval, _ := v.(float64)
+//		...
+//	})
+//
+// fn is called first with the current value if the property is set,
+// calls are made sequentially in a separate goroutine.
+func (c *Client) WatchDesired(ctx context.Context, path string, fn DesiredWatchFunc) (*DesiredWatch, error) {
+	if fn == nil {
+		panic("fn is nil")
+	}
+	if path == "" {
+		return nil, errors.New("path is blank")
+	}
+	sub, err := c.SubscribeTwinUpdates(ctx, WithInitialDesiredState())
+	if err != nil {
+		return nil, err
+	}
+	go watchDesired(sub, path, fn)
+	return &DesiredWatch{sub: sub}, nil
+}
+
+// watchDesired tracks the desired state from the initial one and changes
+// received from sub and calls fn when the watched path is affected.
+func watchDesired(sub *TwinStateSub, path string, fn DesiredWatchFunc) {
+	var state map[string]interface{}
+	for {
+		// returns an error when the watch or the client is closed
+		patch, err := sub.Recv(context.Background())
+		if err != nil {
+			return
+		}
+		prev := twin.Merge(nil, state)
+		state = twin.Merge(state, patch)
+		for _, p := range twin.Diff(prev, state) {
+			if p == path || strings.HasPrefix(p, path+".") || strings.HasPrefix(path, p+".") {
+				v, _ := twin.Get(state, path)
+				fn(v, patch.Version())
+				break
+			}
+		}
+	}
+}
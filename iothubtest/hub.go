@@ -0,0 +1,344 @@
+// Package iothubtest provides an in-memory IoT Hub for tests.
+//
+// Device clients are connected to it with the Transport it creates,
+// service clients make REST calls to its local TLS server:
+//
+//	h := iothubtest.NewHub()
+//	defer h.Close()
+//
+//	dcs, _ := h.CreateDevice("dev")
+//	dc, _ := iotdevice.NewClient(
+//		iotdevice.WithTransport(h.Transport()),
+//		iotdevice.WithConnectionString(dcs),
+//	)
+//	sc, _ := iotservice.NewClient(
+//		iotservice.WithConnectionString(h.ConnectionString()),
+//		iotservice.WithHTTPClient(h.HTTPClient()),
+//	)
+//
+// Supported are telemetry capturing, cloud-to-device messages injection,
+// twins and direct methods, everything that goes over AMQP in the service
+// client, like sending messages and subscribing to events, is not.
+//
+// Code that depends on the client interfaces, like iotdevice.Sender or
+// iotservice.RegistryManager, can use the mocks of this package instead.
+package iothubtest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/iotdevice/transport"
+	"github.com/goautomotive/iothub/iotdevice/twin"
+)
+
+// Hub is an in-memory IoT Hub, it's safe for concurrent use.
+type Hub struct {
+	srv *httptest.Server
+	key string // iothubowner policy key
+
+	mu      sync.Mutex
+	devices map[string]*device
+	version int // etags generator
+}
+
+type device struct {
+	id     string
+	keys   [2]string
+	status string
+	etag   string
+
+	tags         map[string]interface{}
+	desired      map[string]interface{}
+	desiredVer   int
+	reported     map[string]interface{}
+	reportedVer  int
+	twinETag     string
+	telemetry    []*common.Message
+	queue        []*common.Message // cloud-to-device messages waiting for a subscription
+	conn         *Transport
+	methods      transport.MethodDispatcher
+	events       transport.MessageDispatcher
+	twinUpdates  transport.TwinStateDispatcher
+	lastActivity time.Time
+}
+
+// NewHub creates a new hub and starts its REST server.
+func NewHub() *Hub {
+	key, err := newKey()
+	if err != nil {
+		panic(err)
+	}
+	h := &Hub{
+		key:     key,
+		devices: map[string]*device{},
+	}
+	h.srv = httptest.NewTLSServer(http.HandlerFunc(h.serveHTTP))
+	return h
+}
+
+// Close stops the REST server and disconnects all devices.
+func (h *Hub) Close() {
+	h.srv.Close()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, d := range h.devices {
+		d.disconnect()
+	}
+}
+
+// HostName is the hub's hostname, i.e. host:port of the REST server.
+func (h *Hub) HostName() string {
+	return h.srv.Listener.Addr().String()
+}
+
+// ConnectionString is the iothubowner shared access policy connection string.
+func (h *Hub) ConnectionString() string {
+	return fmt.Sprintf("HostName=%s;SharedAccessKeyName=iothubowner;SharedAccessKey=%s", h.HostName(), h.key)
+}
+
+// HTTPClient returns a client that trusts the REST server's certificate.
+func (h *Hub) HTTPClient() *http.Client {
+	return h.srv.Client()
+}
+
+// Transport creates a device transport connected straight to the hub,
+// the device is identified by credentials it's connected with.
+func (h *Hub) Transport() *Transport {
+	return &Transport{h: h}
+}
+
+// CreateDevice registers a device with generated symmetric
+// keys and returns its connection string.
+func (h *Hub) CreateDevice(deviceID string) (string, error) {
+	if deviceID == "" {
+		return "", errors.New("deviceID is empty")
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.devices[deviceID]; ok {
+		return "", fmt.Errorf("device %q already exists", deviceID)
+	}
+	d, err := h.newDevice(deviceID, "", "")
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("HostName=%s;DeviceId=%s;SharedAccessKey=%s", h.HostName(), deviceID, d.keys[0]), nil
+}
+
+// newDevice registers a device, blank keys are generated, h.mu must be held.
+func (h *Hub) newDevice(deviceID, primary, secondary string) (*device, error) {
+	var err error
+	for _, k := range []*string{&primary, &secondary} {
+		if *k == "" {
+			if *k, err = newKey(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	d := &device{
+		id:       deviceID,
+		keys:     [2]string{primary, secondary},
+		status:   "enabled",
+		etag:     h.etag(),
+		twinETag: h.etag(),
+		desired:  map[string]interface{}{},
+		reported: map[string]interface{}{},
+	}
+	h.devices[deviceID] = d
+	return d, nil
+}
+
+func (h *Hub) etag() string {
+	h.version++
+	return base64.StdEncoding.EncodeToString([]byte(strconv.Itoa(h.version)))
+}
+
+func newKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// Telemetry returns a copy of device-to-cloud messages sent by the device.
+func (h *Hub) Telemetry(deviceID string) []*common.Message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	d, ok := h.devices[deviceID]
+	if !ok {
+		return nil
+	}
+	return append([]*common.Message(nil), d.telemetry...)
+}
+
+// SendMessage delivers the cloud-to-device message to the device, or queues
+// it until the device subscribes to messages, the same way the hub does.
+func (h *Hub) SendMessage(deviceID string, msg *common.Message) error {
+	if msg == nil {
+		panic("msg is nil")
+	}
+	h.mu.Lock()
+	d, ok := h.devices[deviceID]
+	if !ok {
+		h.mu.Unlock()
+		return common.ErrDeviceNotFound
+	}
+	msg.To = "/devices/" + deviceID + "/messages/devicebound"
+	if msg.EnqueuedTime == nil {
+		now := time.Now().UTC()
+		msg.EnqueuedTime = &now
+	}
+	mux := d.events
+	if mux == nil {
+		d.queue = append(d.queue, msg)
+	}
+	h.mu.Unlock()
+	if mux != nil {
+		mux.Dispatch(msg)
+	}
+	return nil
+}
+
+// UpdateDesired applies the merge patch to desired properties of the device
+// twin and notifies the device when it's subscribed to twin updates.
+func (h *Hub) UpdateDesired(deviceID string, patch map[string]interface{}) (int, error) {
+	h.mu.Lock()
+	d, ok := h.devices[deviceID]
+	if !ok {
+		h.mu.Unlock()
+		return 0, common.ErrDeviceNotFound
+	}
+	ver, b, mux := h.updateDesired(d, patch)
+	h.mu.Unlock()
+	if mux != nil {
+		mux.Dispatch(b)
+	}
+	return ver, nil
+}
+
+// updateDesired merges the patch and returns the new version and the
+// notification for mux if the device is subscribed, h.mu must be held.
+func (h *Hub) updateDesired(d *device, patch map[string]interface{}) (
+	int, []byte, transport.TwinStateDispatcher,
+) {
+	d.desired = twin.Merge(d.desired, patch)
+	d.desiredVer++
+	d.twinETag = h.etag()
+	if d.twinUpdates == nil {
+		return d.desiredVer, nil, nil
+	}
+	n := make(map[string]interface{}, len(patch)+1)
+	for k, v := range patch {
+		n[k] = v
+	}
+	n["$version"] = d.desiredVer
+	b, err := json.Marshal(n)
+	if err != nil {
+		panic(err) // patches are decoded json
+	}
+	return d.desiredVer, b, d.twinUpdates
+}
+
+// Reported returns a copy of reported properties of the device twin.
+func (h *Hub) Reported(deviceID string) (map[string]interface{}, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	d, ok := h.devices[deviceID]
+	if !ok {
+		return nil, common.ErrDeviceNotFound
+	}
+	return copyMap(d.reported), nil
+}
+
+// ErrDeviceOffline means the device isn't connected or doesn't handle direct methods.
+var ErrDeviceOffline = errors.New("device is not online")
+
+// Call invokes the direct method on the device, payload must be valid json.
+func (h *Hub) Call(ctx context.Context, deviceID, methodName string, payload []byte) (int, []byte, error) {
+	h.mu.Lock()
+	d, ok := h.devices[deviceID]
+	var mux transport.MethodDispatcher
+	if ok {
+		mux = d.methods
+	}
+	h.mu.Unlock()
+	if !ok {
+		return 0, nil, common.ErrDeviceNotFound
+	}
+	if mux == nil {
+		return 0, nil, ErrDeviceOffline
+	}
+
+	type result struct {
+		rc   int
+		data []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		rc, data, err := mux.Dispatch(methodName, payload)
+		done <- result{rc, data, err}
+	}()
+	select {
+	case r := <-done:
+		return r.rc, r.data, r.err
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+}
+
+// verifySAS checks that the token is signed for the resource
+// with one of the keys and hasn't expired.
+func verifySAS(token, resource string, keys ...string) error {
+	q, err := url.ParseQuery(strings.TrimPrefix(token, "SharedAccessSignature "))
+	if err != nil {
+		return err
+	}
+	se, err := strconv.ParseInt(q.Get("se"), 10, 64)
+	if err != nil {
+		return errors.New("malformed expiry")
+	}
+	if time.Unix(se, 0).Before(time.Now()) {
+		return errors.New("token expired")
+	}
+	sr := q.Get("sr")
+	if sr != resource && !strings.HasPrefix(resource, sr+"/") {
+		return fmt.Errorf("token is scoped to %q", sr)
+	}
+	for _, k := range keys {
+		sas, err := common.NewSharedAccessSignature(sr, q.Get("skn"), k, time.Unix(se, 0))
+		if err != nil {
+			return err
+		}
+		if sas.Signature == q.Get("sig") {
+			return nil
+		}
+	}
+	return errors.New("signature mismatch")
+}
+
+func copyMap(m map[string]interface{}) map[string]interface{} {
+	b, err := json.Marshal(m)
+	if err != nil {
+		panic(err)
+	}
+	var v map[string]interface{}
+	if err = json.Unmarshal(b, &v); err != nil {
+		panic(err)
+	}
+	return v
+}
@@ -0,0 +1,158 @@
+package iothubtest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/iotdevice"
+	"github.com/goautomotive/iothub/iotservice"
+)
+
+func TestHub(t *testing.T) {
+	t.Parallel()
+
+	h := NewHub()
+	defer h.Close()
+
+	dcs, err := h.CreateDevice("dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc, err := iotdevice.NewClient(
+		iotdevice.WithTransport(h.Transport()),
+		iotdevice.WithConnectionString(dcs),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dc.Close()
+	sc, err := iotservice.NewClient(
+		iotservice.WithConnectionString(h.ConnectionString()),
+		iotservice.WithHTTPClient(h.HTTPClient()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err = dc.Connect(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("telemetry", func(t *testing.T) {
+		if err := dc.SendEvent(ctx, []byte("hello"), iotdevice.WithSendProperty("k", "v1")); err != nil {
+			t.Fatal(err)
+		}
+		// later sends don't change recorded messages
+		if err := dc.SendEvent(ctx, []byte("world"), iotdevice.WithSendProperty("k", "v2")); err != nil {
+			t.Fatal(err)
+		}
+		l := h.Telemetry("dev")
+		if len(l) != 2 || !bytes.Equal(l[0].Payload, []byte("hello")) {
+			t.Fatalf("Telemetry() = %v, want hello and world messages", l)
+		}
+		for i, want := range []string{"v1", "v2"} {
+			if g := l[i].Properties["k"]; g != want {
+				t.Errorf("Telemetry()[%d] property k = %q, want %q", i, g, want)
+			}
+		}
+	})
+
+	t.Run("c2d", func(t *testing.T) {
+		if err := h.SendMessage("dev", &common.Message{Payload: []byte("queued")}); err != nil {
+			t.Fatal(err)
+		}
+		sub, err := dc.SubscribeEvents(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sub.Close()
+		msg, err := sub.Recv(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg.Payload) != "queued" {
+			t.Errorf("Payload = %q, want %q", msg.Payload, "queued")
+		}
+	})
+
+	t.Run("twin", func(t *testing.T) {
+		sub, err := dc.SubscribeTwinUpdates(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dc.UnsubscribeTwinUpdates(sub)
+
+		if _, err = sc.UpdateTwin(ctx, "dev", &iotservice.Twin{
+			Properties: &iotservice.Properties{
+				Desired: map[string]interface{}{"interval": 10},
+			},
+		}, "*"); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case s := <-sub.C():
+			if s["interval"] != float64(10) {
+				t.Errorf("desired = %v, want interval = 10", s)
+			}
+		case <-ctx.Done():
+			t.Fatal(ctx.Err())
+		}
+
+		if _, err = dc.UpdateTwinState(ctx, iotdevice.TwinState{"interval": 10}); err != nil {
+			t.Fatal(err)
+		}
+		tw, err := sc.GetTwin(ctx, "dev")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tw.Properties.Reported["interval"] != float64(10) {
+			t.Errorf("reported = %v, want interval = 10", tw.Properties.Reported)
+		}
+	})
+
+	t.Run("methods", func(t *testing.T) {
+		if err := dc.RegisterMethod(ctx, "sum", func(p map[string]interface{}) (map[string]interface{}, error) {
+			return map[string]interface{}{"sum": p["a"].(float64) + p["b"].(float64)}, nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		res, err := sc.Call(ctx, "dev", "sum", map[string]interface{}{"a": 1, "b": 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Status != 200 || res.Payload["sum"] != float64(3) {
+			t.Errorf("Call() = %v, want 200 and sum = 3", res)
+		}
+	})
+
+	t.Run("registry", func(t *testing.T) {
+		if _, err := sc.GetDevice(ctx, "missing"); !errors.Is(err, common.ErrDeviceNotFound) {
+			t.Errorf("GetDevice(missing) error = %v, want ErrDeviceNotFound", err)
+		}
+
+		// keys are echoed back verbatim whatever characters they contain
+		key := "k\x7f\u2028\"=="
+		if _, err := sc.CreateDevice(ctx, &iotservice.Device{
+			DeviceID: "keys",
+			Authentication: &iotservice.Authentication{
+				SymmetricKey: &iotservice.SymmetricKey{PrimaryKey: key, SecondaryKey: key},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		d, err := sc.GetDevice(ctx, "keys")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g := d.Authentication.SymmetricKey.PrimaryKey; g != key {
+			t.Errorf("PrimaryKey = %q, want %q", g, key)
+		}
+	})
+}
@@ -0,0 +1,268 @@
+package iothubtest
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/iotdevice"
+	"github.com/goautomotive/iothub/iotservice"
+)
+
+// Sender is a mock of iotdevice.Sender that records sent payloads,
+// SendEventFunc when set overrides the result of SendEvent.
+type Sender struct {
+	SendEventFunc func(ctx context.Context, payload []byte, opts ...iotdevice.SendOption) error
+
+	mu       sync.Mutex
+	payloads [][]byte
+}
+
+var _ iotdevice.Sender = (*Sender)(nil)
+
+// SendEvent implements iotdevice.Sender.
+func (m *Sender) SendEvent(ctx context.Context, payload []byte, opts ...iotdevice.SendOption) error {
+	m.mu.Lock()
+	m.payloads = append(m.payloads, payload)
+	m.mu.Unlock()
+	if m.SendEventFunc != nil {
+		return m.SendEventFunc(ctx, payload, opts...)
+	}
+	return nil
+}
+
+// Payloads returns all payloads passed to SendEvent.
+func (m *Sender) Payloads() [][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([][]byte(nil), m.payloads...)
+}
+
+// TwinClient is a mock of iotdevice.TwinClient that keeps the twin state
+// in memory, the Func fields when set override the corresponding methods.
+//
+// States are copied through json like they are on the wire,
+// so numbers are returned as float64.
+type TwinClient struct {
+	RetrieveTwinStateFunc func(ctx context.Context) (iotdevice.TwinState, iotdevice.TwinState, error)
+	UpdateTwinStateFunc   func(ctx context.Context, s iotdevice.TwinState) (int, error)
+
+	mu       sync.Mutex
+	desired  iotdevice.TwinState
+	reported iotdevice.TwinState
+	version  int
+}
+
+var _ iotdevice.TwinClient = (*TwinClient)(nil)
+
+// SetDesired replaces the desired state returned by RetrieveTwinState.
+func (m *TwinClient) SetDesired(s iotdevice.TwinState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.desired = iotdevice.TwinState(copyMap(s))
+}
+
+// Reported returns the reported state.
+func (m *TwinClient) Reported() iotdevice.TwinState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return iotdevice.TwinState(copyMap(m.reported))
+}
+
+// RetrieveTwinState implements iotdevice.TwinClient.
+func (m *TwinClient) RetrieveTwinState(ctx context.Context) (iotdevice.TwinState, iotdevice.TwinState, error) {
+	if m.RetrieveTwinStateFunc != nil {
+		return m.RetrieveTwinStateFunc(ctx)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return iotdevice.TwinState(copyMap(m.desired)), iotdevice.TwinState(copyMap(m.reported)), nil
+}
+
+// UpdateTwinState implements iotdevice.TwinClient, the state is merged
+// into the reported one the same way the hub does it, nil removes keys.
+func (m *TwinClient) UpdateTwinState(ctx context.Context, s iotdevice.TwinState) (int, error) {
+	if m.UpdateTwinStateFunc != nil {
+		return m.UpdateTwinStateFunc(ctx, s)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reported = iotdevice.TwinState(mergeTags(m.reported, s))
+	m.version++
+	return m.version, nil
+}
+
+// MethodCall is a direct method call recorded by MethodInvoker.
+type MethodCall struct {
+	DeviceID   string
+	ModuleID   string
+	MethodName string
+	Payload    map[string]interface{}
+}
+
+// MethodInvoker is a mock of iotservice.MethodInvoker that records calls,
+// CallFunc must be set, module calls are passed to it as well.
+type MethodInvoker struct {
+	CallFunc func(ctx context.Context, call *MethodCall) (*iotservice.Result, error)
+
+	mu    sync.Mutex
+	calls []*MethodCall
+}
+
+var _ iotservice.MethodInvoker = (*MethodInvoker)(nil)
+
+// Call implements iotservice.MethodInvoker, options are ignored.
+func (m *MethodInvoker) Call(
+	ctx context.Context,
+	deviceID string,
+	methodName string,
+	payload map[string]interface{},
+	opts ...iotservice.CallOption,
+) (*iotservice.Result, error) {
+	return m.CallModule(ctx, deviceID, "", methodName, payload, opts...)
+}
+
+// CallModule implements iotservice.MethodInvoker, options are ignored.
+func (m *MethodInvoker) CallModule(
+	ctx context.Context,
+	deviceID, moduleID string,
+	methodName string,
+	payload map[string]interface{},
+	opts ...iotservice.CallOption,
+) (*iotservice.Result, error) {
+	call := &MethodCall{
+		DeviceID:   deviceID,
+		ModuleID:   moduleID,
+		MethodName: methodName,
+		Payload:    payload,
+	}
+	m.mu.Lock()
+	m.calls = append(m.calls, call)
+	m.mu.Unlock()
+	if m.CallFunc == nil {
+		return nil, errors.New("iothubtest: CallFunc is nil")
+	}
+	return m.CallFunc(ctx, call)
+}
+
+// Calls returns all recorded calls.
+func (m *MethodInvoker) Calls() []*MethodCall {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*MethodCall(nil), m.calls...)
+}
+
+// RegistryManager is a mock of iotservice.RegistryManager
+// that keeps devices in memory, the zero value is ready to use.
+//
+// Errors match the ones returned by the service client, e.g.
+// common.ErrDeviceNotFound, update options are ignored so
+// devices with a blank ETag are updated unconditionally.
+type RegistryManager struct {
+	mu      sync.Mutex
+	devices map[string]*iotservice.Device
+	version int
+}
+
+var _ iotservice.RegistryManager = (*RegistryManager)(nil)
+
+// GetDevice implements iotservice.RegistryManager.
+func (m *RegistryManager) GetDevice(ctx context.Context, deviceID string) (*iotservice.Device, error) {
+	if deviceID == "" {
+		return nil, errors.New("deviceID is empty")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.devices[deviceID]
+	if !ok {
+		return nil, common.ErrDeviceNotFound
+	}
+	return copyDevice(d), nil
+}
+
+// CreateDevice implements iotservice.RegistryManager.
+func (m *RegistryManager) CreateDevice(ctx context.Context, device *iotservice.Device) (*iotservice.Device, error) {
+	if device == nil {
+		panic("device is nil")
+	}
+	if device.DeviceID == "" {
+		return nil, errors.New("deviceID is empty")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.devices[device.DeviceID]; ok {
+		return nil, common.ErrDeviceAlreadyExists
+	}
+	if m.devices == nil {
+		m.devices = map[string]*iotservice.Device{}
+	}
+	return m.store(device), nil
+}
+
+// UpdateDevice implements iotservice.RegistryManager.
+func (m *RegistryManager) UpdateDevice(
+	ctx context.Context, device *iotservice.Device, opts ...iotservice.UpdateOption,
+) (*iotservice.Device, error) {
+	if device == nil {
+		panic("device is nil")
+	}
+	if device.DeviceID == "" {
+		return nil, errors.New("deviceID is empty")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d, ok := m.devices[device.DeviceID]
+	if !ok {
+		return nil, common.ErrDeviceNotFound
+	}
+	if device.ETag != "" && device.ETag != d.ETag {
+		return nil, common.ErrPreconditionFailed
+	}
+	return m.store(device), nil
+}
+
+// store saves a copy of d with a new ETag, m.mu must be held.
+func (m *RegistryManager) store(d *iotservice.Device) *iotservice.Device {
+	m.version++
+	d = copyDevice(d)
+	d.ETag = strconv.Itoa(m.version)
+	m.devices[d.DeviceID] = d
+	return copyDevice(d)
+}
+
+// DeleteDevice implements iotservice.RegistryManager.
+func (m *RegistryManager) DeleteDevice(ctx context.Context, deviceID string) error {
+	if deviceID == "" {
+		return errors.New("deviceID is empty")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.devices[deviceID]; !ok {
+		return common.ErrDeviceNotFound
+	}
+	delete(m.devices, deviceID)
+	return nil
+}
+
+// ListDevices implements iotservice.RegistryManager, devices are sorted by id.
+func (m *RegistryManager) ListDevices(ctx context.Context) ([]*iotservice.Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l := make([]*iotservice.Device, 0, len(m.devices))
+	for _, d := range m.devices {
+		l = append(l, copyDevice(d))
+	}
+	sort.Slice(l, func(i, j int) bool {
+		return l[i].DeviceID < l[j].DeviceID
+	})
+	return l, nil
+}
+
+// copyDevice is a shallow copy so callers cannot change stored devices.
+func copyDevice(d *iotservice.Device) *iotservice.Device {
+	v := *d
+	return &v
+}
@@ -0,0 +1,74 @@
+package iothubtest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/iotdevice"
+	"github.com/goautomotive/iothub/iotservice"
+)
+
+func TestTwinClient(t *testing.T) {
+	t.Parallel()
+
+	m := &TwinClient{}
+	m.SetDesired(iotdevice.TwinState{"interval": 10})
+	if _, err := m.UpdateTwinState(context.Background(), iotdevice.TwinState{"interval": 10, "x": nil}); err != nil {
+		t.Fatal(err)
+	}
+	desired, reported, err := m.RetrieveTwinState(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desired["interval"] != float64(10) || reported["interval"] != float64(10) || len(reported) != 1 {
+		t.Errorf("RetrieveTwinState() = %v, %v, want interval = 10 in both", desired, reported)
+	}
+}
+
+func TestMethodInvoker(t *testing.T) {
+	t.Parallel()
+
+	m := &MethodInvoker{
+		CallFunc: func(ctx context.Context, call *MethodCall) (*iotservice.Result, error) {
+			return &iotservice.Result{Status: 200, Payload: call.Payload}, nil
+		},
+	}
+	res, err := m.Call(context.Background(), "dev", "echo", map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != 200 || res.Payload["a"] != 1 {
+		t.Errorf("Call() = %v, want 200 and a = 1", res)
+	}
+	if l := m.Calls(); len(l) != 1 || l[0].DeviceID != "dev" || l[0].MethodName != "echo" {
+		t.Errorf("Calls() = %v, want one echo call", l)
+	}
+}
+
+func TestRegistryManager(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	m := &RegistryManager{}
+	d, err := m.CreateDevice(ctx, &iotservice.Device{DeviceID: "dev"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.CreateDevice(ctx, d); !errors.Is(err, common.ErrDeviceAlreadyExists) {
+		t.Errorf("CreateDevice(dev) error = %v, want ErrDeviceAlreadyExists", err)
+	}
+	if _, err = m.UpdateDevice(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.UpdateDevice(ctx, d); !errors.Is(err, common.ErrPreconditionFailed) {
+		t.Errorf("UpdateDevice(stale) error = %v, want ErrPreconditionFailed", err)
+	}
+	if err = m.DeleteDevice(ctx, "dev"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m.GetDevice(ctx, "dev"); !errors.Is(err, common.ErrDeviceNotFound) {
+		t.Errorf("GetDevice(dev) error = %v, want ErrDeviceNotFound", err)
+	}
+}
@@ -0,0 +1,312 @@
+package iothubtest
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/goautomotive/iothub/iotdevice/transport"
+)
+
+// serveHTTP implements a subset of the hub's REST API: devices, twins and
+// direct methods of devices, other requests are answered with 404.
+func (h *Hub) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := verifySAS(r.Header.Get("Authorization"), h.HostName(), h.key); err != nil {
+		writeError(w, http.StatusUnauthorized, 401002, err.Error())
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, 400004, err.Error())
+		return
+	}
+
+	p := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(p) == 2 && p[0] == "devices":
+		h.serveDevice(w, r, p[1], body)
+	case len(p) == 2 && p[0] == "twins":
+		h.serveTwin(w, r, p[1], body)
+	case len(p) == 3 && p[0] == "twins" && p[2] == "methods" && r.Method == http.MethodPost:
+		h.serveMethod(w, r, p[1], body)
+	default:
+		writeError(w, http.StatusNotFound, 0, "not supported")
+	}
+}
+
+type jsonDevice struct {
+	DeviceID        string              `json:"deviceId"`
+	ETag            string              `json:"etag,omitempty"`
+	Status          string              `json:"status,omitempty"`
+	ConnectionState string              `json:"connectionState,omitempty"`
+	Authentication  *jsonAuthentication `json:"authentication,omitempty"`
+}
+
+type jsonAuthentication struct {
+	Type         string            `json:"type"`
+	SymmetricKey *jsonSymmetricKey `json:"symmetricKey,omitempty"`
+}
+
+type jsonSymmetricKey struct {
+	PrimaryKey   string `json:"primaryKey"`
+	SecondaryKey string `json:"secondaryKey"`
+}
+
+func (h *Hub) serveDevice(w http.ResponseWriter, r *http.Request, id string, body []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	d, ok := h.devices[id]
+	switch r.Method {
+	case http.MethodGet:
+		if !ok {
+			writeError(w, http.StatusNotFound, 404001, "device not found")
+			return
+		}
+		writeJSON(w, deviceJSON(d))
+	case http.MethodPut:
+		var v jsonDevice
+		if err := json.Unmarshal(body, &v); err != nil {
+			writeError(w, http.StatusBadRequest, 400004, err.Error())
+			return
+		}
+		var primary, secondary string
+		if v.Authentication != nil && v.Authentication.SymmetricKey != nil {
+			primary = v.Authentication.SymmetricKey.PrimaryKey
+			secondary = v.Authentication.SymmetricKey.SecondaryKey
+		}
+		if m := r.Header.Get("If-Match"); m == "" {
+			if ok {
+				writeError(w, http.StatusConflict, 409001, "device already exists")
+				return
+			}
+			var err error
+			if d, err = h.newDevice(id, primary, secondary); err != nil {
+				writeError(w, http.StatusInternalServerError, 500001, err.Error())
+				return
+			}
+		} else {
+			if !ok {
+				writeError(w, http.StatusNotFound, 404001, "device not found")
+				return
+			}
+			if m != "*" && m != d.etag {
+				writeError(w, http.StatusPreconditionFailed, 412002, "etag mismatch")
+				return
+			}
+			if primary != "" {
+				d.keys[0] = primary
+			}
+			if secondary != "" {
+				d.keys[1] = secondary
+			}
+			d.etag = h.etag()
+		}
+		if v.Status != "" {
+			d.status = v.Status
+		}
+		if d.status != "enabled" && d.conn != nil {
+			d.disconnect()
+		}
+		writeJSON(w, deviceJSON(d))
+	case http.MethodDelete:
+		if !ok {
+			writeError(w, http.StatusNotFound, 404001, "device not found")
+			return
+		}
+		if m := r.Header.Get("If-Match"); m != "*" && m != d.etag {
+			writeError(w, http.StatusPreconditionFailed, 412002, "etag mismatch")
+			return
+		}
+		d.disconnect()
+		delete(h.devices, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, 0, "method not allowed")
+	}
+}
+
+func deviceJSON(d *device) *jsonDevice {
+	v := &jsonDevice{
+		DeviceID:        d.id,
+		ETag:            d.etag,
+		Status:          d.status,
+		ConnectionState: "Disconnected",
+	}
+	if d.conn != nil {
+		v.ConnectionState = "Connected"
+	}
+	v.Authentication = &jsonAuthentication{
+		Type: "sas",
+		SymmetricKey: &jsonSymmetricKey{
+			PrimaryKey:   d.keys[0],
+			SecondaryKey: d.keys[1],
+		},
+	}
+	return v
+}
+
+type jsonTwin struct {
+	DeviceID   string                 `json:"deviceId"`
+	ETag       string                 `json:"etag"`
+	Status     string                 `json:"status"`
+	Version    int                    `json:"version"`
+	Tags       map[string]interface{} `json:"tags,omitempty"`
+	Properties struct {
+		Desired  map[string]interface{} `json:"desired"`
+		Reported map[string]interface{} `json:"reported"`
+	} `json:"properties"`
+}
+
+func (h *Hub) serveTwin(w http.ResponseWriter, r *http.Request, id string, body []byte) {
+	h.mu.Lock()
+	d, ok := h.devices[id]
+	if !ok {
+		h.mu.Unlock()
+		writeError(w, http.StatusNotFound, 404001, "device not found")
+		return
+	}
+	if r.Method == http.MethodGet {
+		v := twinJSON(d)
+		h.mu.Unlock()
+		writeJSON(w, v)
+		return
+	}
+	if r.Method != http.MethodPatch && r.Method != http.MethodPut {
+		h.mu.Unlock()
+		writeError(w, http.StatusMethodNotAllowed, 0, "method not allowed")
+		return
+	}
+	if m := r.Header.Get("If-Match"); m != "*" && m != d.twinETag {
+		h.mu.Unlock()
+		writeError(w, http.StatusPreconditionFailed, 412002, "etag mismatch")
+		return
+	}
+	var v jsonTwin
+	if err := json.Unmarshal(body, &v); err != nil {
+		h.mu.Unlock()
+		writeError(w, http.StatusBadRequest, 400004, err.Error())
+		return
+	}
+
+	patch := v.Properties.Desired
+	delete(patch, "$version")
+	if r.Method == http.MethodPut {
+		// replacing removes attributes that are missing in the new document
+		d.tags = v.Tags
+		if patch == nil {
+			patch = map[string]interface{}{}
+		}
+		for k := range d.desired {
+			if _, ok := patch[k]; !ok {
+				patch[k] = nil
+			}
+		}
+	} else if v.Tags != nil {
+		d.tags = mergeTags(d.tags, v.Tags)
+	}
+
+	var b []byte
+	var mux transport.TwinStateDispatcher
+	if len(patch) != 0 {
+		_, b, mux = h.updateDesired(d, patch)
+	} else {
+		d.twinETag = h.etag()
+	}
+	res := twinJSON(d)
+	h.mu.Unlock()
+
+	if mux != nil {
+		mux.Dispatch(b)
+	}
+	writeJSON(w, res)
+}
+
+func mergeTags(m, patch map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		m = map[string]interface{}{}
+	}
+	for k, v := range patch {
+		if v == nil {
+			delete(m, k)
+		} else {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+func twinJSON(d *device) *jsonTwin {
+	v := &jsonTwin{
+		DeviceID: d.id,
+		ETag:     d.twinETag,
+		Status:   d.status,
+		Version:  d.desiredVer + d.reportedVer + 1,
+		Tags:     copyMap(d.tags),
+	}
+	v.Properties.Desired = versioned(d.desired, d.desiredVer)
+	v.Properties.Reported = versioned(d.reported, d.reportedVer)
+	return v
+}
+
+func (h *Hub) serveMethod(w http.ResponseWriter, r *http.Request, id string, body []byte) {
+	var v struct {
+		MethodName      string          `json:"methodName"`
+		ResponseTimeout int             `json:"responseTimeoutInSeconds"`
+		Payload         json.RawMessage `json:"payload"`
+	}
+	if err := json.Unmarshal(body, &v); err != nil {
+		writeError(w, http.StatusBadRequest, 400004, err.Error())
+		return
+	}
+	timeout := 30 * time.Second
+	if v.ResponseTimeout != 0 {
+		timeout = time.Duration(v.ResponseTimeout) * time.Second
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	rc, data, err := h.Call(ctx, id, v.MethodName, v.Payload)
+	switch {
+	case err == ErrDeviceOffline:
+		writeError(w, http.StatusNotFound, 404103, err.Error())
+		return
+	case err == context.DeadlineExceeded:
+		writeError(w, http.StatusGatewayTimeout, 504101, "timed out waiting for the response from device")
+		return
+	case err != nil:
+		writeError(w, http.StatusNotFound, 404001, err.Error())
+		return
+	}
+	if len(data) == 0 {
+		data = []byte("null")
+	}
+	writeJSON(w, map[string]interface{}{
+		"status":  rc,
+		"payload": json.RawMessage(data),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, 500001, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Write(b)
+}
+
+// writeError responds with the newer api versions error format.
+func writeError(w http.ResponseWriter, status, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	b, _ := json.Marshal(map[string]interface{}{
+		"errorCode":  code,
+		"trackingId": "iothubtest",
+		"message":    msg,
+	})
+	w.Write(b)
+}
@@ -0,0 +1,202 @@
+package iothubtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/iotdevice/transport"
+	"github.com/goautomotive/iothub/iotdevice/twin"
+)
+
+// Transport is an in-process device transport, see Hub.Transport.
+type Transport struct {
+	h   *Hub
+	dev *device // nil until connected
+}
+
+var _ transport.Transport = (*Transport)(nil)
+
+var errNotConnected = errors.New("not connected")
+
+// Connect authenticates the device, only SAS credentials are supported.
+func (tr *Transport) Connect(ctx context.Context, creds transport.Credentials) error {
+	if !creds.IsSAS() {
+		return errors.New("only sas authentication is supported")
+	}
+	if creds.ModuleID() != "" {
+		return errors.New("modules are not supported")
+	}
+	uri := tr.h.HostName() + "/devices/" + creds.DeviceID()
+	token, err := creds.Token(ctx, uri, time.Hour)
+	if err != nil {
+		return err
+	}
+
+	tr.h.mu.Lock()
+	defer tr.h.mu.Unlock()
+	d, ok := tr.h.devices[creds.DeviceID()]
+	if !ok {
+		return common.ErrDeviceNotFound
+	}
+	if d.status != "enabled" {
+		return errors.New("device is disabled")
+	}
+	if err = verifySAS(token, uri, d.keys[0], d.keys[1]); err != nil {
+		return err
+	}
+	if d.conn != nil {
+		d.disconnect() // the hub drops the previous connection
+	}
+	d.conn, tr.dev = tr, d
+	d.lastActivity = time.Now()
+	return nil
+}
+
+// device returns the connected device, h.mu must be held.
+func (tr *Transport) device() (*device, error) {
+	if tr.dev == nil || tr.dev.conn != tr {
+		return nil, errNotConnected
+	}
+	return tr.dev, nil
+}
+
+// Send captures the device-to-cloud message, see Hub.Telemetry.
+func (tr *Transport) Send(ctx context.Context, msg *common.Message) error {
+	if err := msg.CheckSize(common.MaxDeviceToCloudSize); err != nil {
+		return err
+	}
+	tr.h.mu.Lock()
+	defer tr.h.mu.Unlock()
+	d, err := tr.device()
+	if err != nil {
+		return err
+	}
+	// the sender may reuse the message, see common.ReleaseMessage
+	m := *msg
+	if msg.Properties != nil {
+		m.Properties = make(map[string]string, len(msg.Properties))
+		for k, v := range msg.Properties {
+			m.Properties[k] = v
+		}
+	}
+	now := time.Now().UTC()
+	m.EnqueuedTime = &now
+	m.ConnectionDeviceID = d.id
+	d.telemetry = append(d.telemetry, &m)
+	d.lastActivity = now
+	return nil
+}
+
+// RegisterDirectMethods enables direct method invocations.
+func (tr *Transport) RegisterDirectMethods(ctx context.Context, mux transport.MethodDispatcher) error {
+	tr.h.mu.Lock()
+	defer tr.h.mu.Unlock()
+	d, err := tr.device()
+	if err != nil {
+		return err
+	}
+	d.methods = mux
+	return nil
+}
+
+// SubscribeEvents delivers queued and further cloud-to-device messages to mux.
+func (tr *Transport) SubscribeEvents(ctx context.Context, mux transport.MessageDispatcher) error {
+	tr.h.mu.Lock()
+	d, err := tr.device()
+	if err != nil {
+		tr.h.mu.Unlock()
+		return err
+	}
+	d.events = mux
+	queue := d.queue
+	d.queue = nil
+	tr.h.mu.Unlock()
+
+	// real transports deliver messages from their own goroutines as well
+	go func() {
+		for _, msg := range queue {
+			mux.Dispatch(msg)
+		}
+	}()
+	return nil
+}
+
+// SubscribeTwinUpdates delivers desired properties patches to mux.
+func (tr *Transport) SubscribeTwinUpdates(ctx context.Context, mux transport.TwinStateDispatcher) error {
+	tr.h.mu.Lock()
+	defer tr.h.mu.Unlock()
+	d, err := tr.device()
+	if err != nil {
+		return err
+	}
+	d.twinUpdates = mux
+	return nil
+}
+
+// RetrieveTwinProperties returns desired and reported properties.
+func (tr *Transport) RetrieveTwinProperties(ctx context.Context) ([]byte, error) {
+	tr.h.mu.Lock()
+	defer tr.h.mu.Unlock()
+	d, err := tr.device()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[string]interface{}{
+		"desired":  versioned(d.desired, d.desiredVer),
+		"reported": versioned(d.reported, d.reportedVer),
+	})
+}
+
+// UpdateTwinProperties applies the merge patch to reported properties.
+func (tr *Transport) UpdateTwinProperties(ctx context.Context, payload []byte) (int, error) {
+	var patch map[string]interface{}
+	if err := json.Unmarshal(payload, &patch); err != nil {
+		return 0, err
+	}
+	tr.h.mu.Lock()
+	defer tr.h.mu.Unlock()
+	d, err := tr.device()
+	if err != nil {
+		return 0, err
+	}
+	d.reported = twin.Merge(d.reported, patch)
+	d.reportedVer++
+	d.twinETag = tr.h.etag()
+	return d.reportedVer, nil
+}
+
+// SubscribeConnectionState is a no-op, connections are never lost.
+func (tr *Transport) SubscribeConnectionState(ctx context.Context, mux transport.ConnectionStateDispatcher) error {
+	return nil
+}
+
+// Close disconnects the device.
+func (tr *Transport) Close() error {
+	tr.h.mu.Lock()
+	defer tr.h.mu.Unlock()
+	if d, err := tr.device(); err == nil {
+		d.disconnect()
+	}
+	return nil
+}
+
+// disconnect drops the device's connection, h.mu must be held.
+func (d *device) disconnect() {
+	d.conn = nil
+	d.methods = nil
+	d.events = nil
+	d.twinUpdates = nil
+}
+
+// versioned returns a copy of properties with the $version attribute.
+func versioned(m map[string]interface{}, ver int) map[string]interface{} {
+	v := copyMap(m)
+	if v == nil {
+		v = map[string]interface{}{}
+	}
+	v["$version"] = ver
+	return v
+}
@@ -0,0 +1,98 @@
+package iotservice
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/goautomotive/iothub/common"
+)
+
+// AADScope is the Azure AD scope of IoT Hub service APIs.
+const AADScope = "https://iothubs.azure.net/.default"
+
+// TokenProvider issues Azure AD access tokens for the given scopes.
+//
+// It mirrors azidentity's TokenCredential, so any credential,
+// e.g. a managed identity, can be adapted with TokenProviderFunc:
+//
+//	cred, _ := azidentity.NewManagedIdentityCredential(nil)
+//	tp := iotservice.TokenProviderFunc(func(ctx context.Context, scopes []string) (string, time.Time, error) {
+//		t, err := cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: scopes})
+//		return t.Token, t.ExpiresOn, err
+//	})
+type TokenProvider interface {
+	Token(ctx context.Context, scopes []string) (token string, expiresOn time.Time, err error)
+}
+
+// TokenProviderFunc is an adapter to use ordinary functions as token providers.
+type TokenProviderFunc func(ctx context.Context, scopes []string) (string, time.Time, error)
+
+// Token implements TokenProvider.
+func (fn TokenProviderFunc) Token(ctx context.Context, scopes []string) (string, time.Time, error) {
+	return fn(ctx, scopes)
+}
+
+// WithTokenProvider authenticates the client against the named hub
+// with Azure AD tokens instead of shared access keys.
+//
+// Subscribing to events requires a shared access key still,
+// because the built-in eventhub endpoint doesn't support Azure AD.
+func WithTokenProvider(hostname string, tp TokenProvider) ClientOption {
+	if tp == nil {
+		panic("tp is nil")
+	}
+	return func(c *Client) error {
+		if hostname == "" {
+			return errors.New("hostname is blank")
+		}
+		c.creds = &common.Credentials{HostName: hostname}
+		c.tokens = tp
+		return nil
+	}
+}
+
+// WithAADScope overrides the Azure AD scope tokens are requested for,
+// it's AADScope by default that's the public cloud's IoT Hub audience.
+func WithAADScope(scope string) ClientOption {
+	return func(c *Client) error {
+		if scope == "" {
+			return errors.New("scope is blank")
+		}
+		c.scope = scope
+		return nil
+	}
+}
+
+// aadToken returns a cached access token or requests a new one
+// when the cached one is about to expire.
+func (c *Client) aadToken(ctx context.Context) (string, time.Time, error) {
+	c.tmu.Lock()
+	defer c.tmu.Unlock()
+	if c.token != "" && time.Until(c.texp) > tokenRefreshMargin {
+		return c.token, c.texp, nil
+	}
+	scope := c.scope
+	if scope == "" {
+		scope = AADScope
+	}
+	token, exp, err := c.tokens.Token(ctx, []string{scope})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	c.token, c.texp = token, exp
+	c.add(common.MetricTokenRenewals)
+	return token, exp, nil
+}
+
+// authorization returns the Authorization header value for REST requests.
+func (c *Client) authorization(ctx context.Context) (string, error) {
+	if c.tokens == nil {
+		return c.sas(c.creds.HostName, time.Hour)
+	}
+	token, _, err := c.aadToken(ctx)
+	if err != nil {
+		return "", err
+	}
+	return "Bearer " + token, nil
+}
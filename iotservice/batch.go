@@ -0,0 +1,224 @@
+package iotservice
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/common/commonamqp"
+	"github.com/goautomotive/iothub/eventhub"
+	"pack.ag/amqp"
+)
+
+// C2DMessage is a cloud-to-device message of a batch, see SendEvents.
+type C2DMessage struct {
+	DeviceID string
+	Payload  []byte
+	Options  []SendOption
+}
+
+// SendError is returned when some messages of a batch are not sent,
+// Errors is indexed the same way as the batch with nil for sent ones.
+type SendError struct {
+	Errors []error
+}
+
+func (e *SendError) Error() string {
+	var n int
+	var first error
+	for _, err := range e.Errors {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			n++
+		}
+	}
+	return fmt.Sprintf("%d of %d messages not sent: %s", n, len(e.Errors), first)
+}
+
+// sendWindow is the maximum number of messages awaiting settlement on a link.
+const sendWindow = 32
+
+// SendEvents sends the messages over a single link without waiting
+// for each of them to be settled before sending the next one.
+//
+// Messages failed because of connection loss are resent the same way
+// SendEvent does, others are reported with *SendError.
+func (c *Client) SendEvents(ctx context.Context, msgs []*C2DMessage) (err error) {
+	ctx, span := common.StartSpan(ctx, c.tracer, "iothub.SendEvents", map[string]string{
+		"iothub.hostname":      c.creds.HostName,
+		"iothub.message_count": strconv.Itoa(len(msgs)),
+	})
+	defer func() {
+		span.End(err)
+	}()
+
+	batch := make([]*common.Message, len(msgs))
+	pending := make([]int, len(msgs))
+	for i, m := range msgs {
+		if m == nil {
+			panic("message is nil")
+		}
+		if batch[i], err = c.newC2DMessage(span, m.DeviceID, m.Payload, m.Options); err != nil {
+			return fmt.Errorf("message %d: %s", i, err)
+		}
+		pending[i] = i
+	}
+
+	errs := make([]error, len(msgs))
+	b := c.backoff()
+	for attempt := 1; len(pending) != 0; attempt++ {
+		conn, err := c.amqpConn(ctx)
+		if err == nil {
+			err = c.sendBatch(ctx, conn, batch, pending, errs)
+		}
+		if err != nil {
+			for _, i := range pending {
+				errs[i] = err
+			}
+		}
+
+		var retry []int
+		for _, i := range pending {
+			if errs[i] == nil {
+				continue
+			}
+			if commonamqp.IsConnError(errs[i]) && conn != nil {
+				c.resetAMQP(conn, errs[i])
+			}
+			if recoverable(errs[i]) {
+				retry = append(retry, i)
+			}
+		}
+		if len(retry) == 0 || attempt == sendAttempts {
+			break
+		}
+		c.debugf(common.ComponentTransport, "resending %d of %d messages", len(retry), len(msgs))
+		if !c.wait(ctx, b) {
+			break
+		}
+		pending = retry
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return &SendError{Errors: errs}
+		}
+	}
+	return nil
+}
+
+// sendBatch sends the pending messages of batch over a new link of conn
+// and stores their settlement results in errs. It fails only when
+// the link cannot be open.
+func (c *Client) sendBatch(
+	ctx context.Context,
+	conn *eventhub.Client,
+	batch []*common.Message,
+	pending []int,
+	errs []error,
+) error {
+	send, err := conn.Sess().NewSender(
+		amqp.LinkTargetAddress("/messages/devicebound"),
+	)
+	if err != nil {
+		return err
+	}
+	defer send.Close(context.Background())
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, sendWindow)
+	for _, i := range pending {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = commonamqp.FromAMQPError(send.Send(ctx, commonamqp.ToAMQPMessage(batch[i])))
+			if errs[i] == nil {
+				c.add(common.MetricMessagesSent)
+			}
+		}(i)
+	}
+	wg.Wait()
+	return nil
+}
+
+// broadcastChunk is the number of messages a broadcast worker sends at once.
+const broadcastChunk = 100
+
+// Broadcast sends the same message to all the given devices with up to
+// concurrency batches sent in parallel, see SendEvents. Failures are
+// reported with *SendError indexed the same way as deviceIDs.
+//
+// Message ids are generated for each device unless WithSendMessageID is used.
+func (c *Client) Broadcast(
+	ctx context.Context,
+	deviceIDs []string,
+	payload []byte,
+	concurrency int,
+	opts ...SendOption,
+) error {
+	if concurrency < 1 {
+		panic("concurrency must be positive")
+	}
+
+	type chunk struct {
+		off  int
+		msgs []*C2DMessage
+	}
+	chunks := make(chan chunk)
+	go func() {
+		defer close(chunks)
+		for off := 0; off < len(deviceIDs); off += broadcastChunk {
+			end := off + broadcastChunk
+			if end > len(deviceIDs) {
+				end = len(deviceIDs)
+			}
+			msgs := make([]*C2DMessage, 0, end-off)
+			for _, id := range deviceIDs[off:end] {
+				msgs = append(msgs, &C2DMessage{DeviceID: id, Payload: payload, Options: opts})
+			}
+			chunks <- chunk{off, msgs}
+		}
+	}()
+
+	var mu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ch := range chunks {
+				err := c.SendEvents(ctx, ch.msgs)
+				if err == nil {
+					continue
+				}
+				mu.Lock()
+				if errs == nil {
+					errs = make([]error, len(deviceIDs))
+				}
+				if serr, ok := err.(*SendError); ok {
+					copy(errs[ch.off:], serr.Errors)
+				} else {
+					for j := range ch.msgs {
+						errs[ch.off+j] = err
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if errs != nil {
+		return &SendError{Errors: errs}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package iotservice
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func TestSendError(t *testing.T) {
+	t.Parallel()
+
+	err := &SendError{Errors: []error{nil, errors.New("a"), nil, errors.New("b")}}
+	if want := "2 of 4 messages not sent: a"; err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+}
+
+func TestSendEventsValidation(t *testing.T) {
+	t.Parallel()
+
+	c, _ := newTestClient(t, "{}")
+	err := c.SendEvents(context.Background(), []*C2DMessage{
+		{DeviceID: "dev", Payload: []byte("a")},
+		{DeviceID: "", Payload: []byte("b")},
+	})
+	if err == nil || err.Error() != "message 1: device id is empty" {
+		t.Errorf("SendEvents() = %v, want message 1 error", err)
+	}
+}
+
+func TestBroadcastErrors(t *testing.T) {
+	t.Parallel()
+
+	// every chunk fails validation before connecting
+	ids := make([]string, broadcastChunk+50)
+	for i := range ids {
+		ids[i] = "dev" + strconv.Itoa(i)
+	}
+	ids[5], ids[broadcastChunk+7] = "", ""
+
+	c, _ := newTestClient(t, "{}")
+	err := c.Broadcast(context.Background(), ids, []byte("hello"), 2)
+	var serr *SendError
+	if !errors.As(err, &serr) {
+		t.Fatalf("Broadcast() = %v, want *SendError", err)
+	}
+	if len(serr.Errors) != len(ids) {
+		t.Fatalf("len(Errors) = %d, want %d", len(serr.Errors), len(ids))
+	}
+	for i, want := range map[int]string{
+		0:                  "message 5: device id is empty",
+		broadcastChunk - 1: "message 5: device id is empty",
+		broadcastChunk:     "message 7: device id is empty",
+		len(ids) - 1:       "message 7: device id is empty",
+	} {
+		if err := serr.Errors[i]; err == nil || err.Error() != want {
+			t.Errorf("Errors[%d] = %v, want %q", i, err, want)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package iotservice
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Checkpoint is the position of the last processed event of a partition.
+type Checkpoint struct {
+	PartitionID    string
+	Offset         string
+	SequenceNumber int64
+}
+
+// Ownership is a claim of a partition by an event processor, claims that
+// haven't been renewed for a while are considered expired and can be taken
+// by other processors. ETag guards claims against concurrent modifications.
+type Ownership struct {
+	PartitionID  string
+	OwnerID      string
+	LastModified time.Time
+	ETag         string
+}
+
+// CheckpointStore persists partition ownership and checkpoints of
+// event processors in all consumer groups they're used in.
+type CheckpointStore interface {
+	// ListOwnership returns all ownership claims in the consumer group.
+	ListOwnership(ctx context.Context, group string) ([]*Ownership, error)
+
+	// ClaimOwnership creates or updates the given claims, claims with an ETag
+	// succeed only if it matches the stored one and blank ones only if the
+	// partition has never been owned. Only successful claims are returned
+	// with their new LastModified and ETag values.
+	ClaimOwnership(ctx context.Context, group string, claims []*Ownership) ([]*Ownership, error)
+
+	// ListCheckpoints returns all checkpoints in the consumer group.
+	ListCheckpoints(ctx context.Context, group string) ([]*Checkpoint, error)
+
+	// UpdateCheckpoint creates or overwrites the partition's checkpoint.
+	UpdateCheckpoint(ctx context.Context, group string, checkpoint *Checkpoint) error
+}
+
+// NewMemoryCheckpointStore creates a checkpoint store that keeps data
+// in memory, it's suitable for tests and processors in a single process.
+func NewMemoryCheckpointStore() *MemoryCheckpointStore {
+	return &MemoryCheckpointStore{
+		ownership:   map[string]Ownership{},
+		checkpoints: map[string]Checkpoint{},
+	}
+}
+
+// MemoryCheckpointStore is an in-memory checkpoint store.
+type MemoryCheckpointStore struct {
+	mu          sync.Mutex
+	ownership   map[string]Ownership  // group/partition
+	checkpoints map[string]Checkpoint // group/partition
+	version     int
+}
+
+// ListOwnership implements CheckpointStore.
+func (s *MemoryCheckpointStore) ListOwnership(ctx context.Context, group string) ([]*Ownership, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var l []*Ownership
+	for k, o := range s.ownership {
+		if strings.HasPrefix(k, group+"/") {
+			o := o
+			l = append(l, &o)
+		}
+	}
+	return l, nil
+}
+
+// ClaimOwnership implements CheckpointStore.
+func (s *MemoryCheckpointStore) ClaimOwnership(ctx context.Context, group string, claims []*Ownership) ([]*Ownership, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var l []*Ownership
+	for _, c := range claims {
+		k := group + "/" + c.PartitionID
+		if o, ok := s.ownership[k]; ok && o.ETag != c.ETag || !ok && c.ETag != "" {
+			continue
+		}
+		s.version++
+		o := Ownership{
+			PartitionID:  c.PartitionID,
+			OwnerID:      c.OwnerID,
+			LastModified: time.Now(),
+			ETag:         strconv.Itoa(s.version),
+		}
+		s.ownership[k] = o
+		l = append(l, &o)
+	}
+	return l, nil
+}
+
+// ListCheckpoints implements CheckpointStore.
+func (s *MemoryCheckpointStore) ListCheckpoints(ctx context.Context, group string) ([]*Checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var l []*Checkpoint
+	for k, c := range s.checkpoints {
+		if strings.HasPrefix(k, group+"/") {
+			c := c
+			l = append(l, &c)
+		}
+	}
+	return l, nil
+}
+
+// UpdateCheckpoint implements CheckpointStore.
+func (s *MemoryCheckpointStore) UpdateCheckpoint(ctx context.Context, group string, checkpoint *Checkpoint) error {
+	if checkpoint == nil {
+		panic("checkpoint is nil")
+	}
+	s.mu.Lock()
+	s.checkpoints[group+"/"+checkpoint.PartitionID] = *checkpoint
+	s.mu.Unlock()
+	return nil
+}
+
+// NewBlobCheckpointStore creates a checkpoint store backed by the Azure Storage
+// blob container, containerURL has to include a SAS token with read, write
+// and list permissions, e.g. https://acc.blob.core.windows.net/cnt?sv=...
+//
+// Data is kept in empty blobs metadata under {group}/ownership/{partition}
+// and {group}/checkpoint/{partition} names, so each hub needs its own container.
+func NewBlobCheckpointStore(containerURL string, client *http.Client) (*BlobCheckpointStore, error) {
+	u, err := url.Parse(containerURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("unsupported container url scheme %q", u.Scheme)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &BlobCheckpointStore{url: u, http: client}, nil
+}
+
+// BlobCheckpointStore is an Azure Storage blob checkpoint store.
+type BlobCheckpointStore struct {
+	url  *url.URL
+	http *http.Client
+}
+
+// blobVersion is the storage REST API version.
+const blobVersion = "2018-03-28"
+
+// ListOwnership implements CheckpointStore.
+func (s *BlobCheckpointStore) ListOwnership(ctx context.Context, group string) ([]*Ownership, error) {
+	blobs, err := s.list(ctx, group+"/ownership/")
+	if err != nil {
+		return nil, err
+	}
+	l := make([]*Ownership, 0, len(blobs))
+	for _, b := range blobs {
+		t, err := http.ParseTime(b.LastModified)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, &Ownership{
+			PartitionID:  path.Base(b.Name),
+			OwnerID:      b.meta("ownerid"),
+			LastModified: t,
+			ETag:         b.ETag,
+		})
+	}
+	return l, nil
+}
+
+// ClaimOwnership implements CheckpointStore.
+func (s *BlobCheckpointStore) ClaimOwnership(ctx context.Context, group string, claims []*Ownership) ([]*Ownership, error) {
+	var l []*Ownership
+	for _, c := range claims {
+		h := http.Header{"x-ms-meta-ownerid": {c.OwnerID}}
+		if c.ETag != "" {
+			h.Set("If-Match", c.ETag)
+		} else {
+			h.Set("If-None-Match", "*")
+		}
+		res, err := s.put(ctx, group+"/ownership/"+c.PartitionID, h)
+		if err != nil {
+			var e *blobError
+			if errors.As(err, &e) && (e.StatusCode == http.StatusPreconditionFailed ||
+				e.StatusCode == http.StatusConflict) {
+				continue // claimed by someone else
+			}
+			return nil, err
+		}
+		t, err := http.ParseTime(res.Get("Last-Modified"))
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, &Ownership{
+			PartitionID:  c.PartitionID,
+			OwnerID:      c.OwnerID,
+			LastModified: t,
+			ETag:         res.Get("ETag"),
+		})
+	}
+	return l, nil
+}
+
+// ListCheckpoints implements CheckpointStore.
+func (s *BlobCheckpointStore) ListCheckpoints(ctx context.Context, group string) ([]*Checkpoint, error) {
+	blobs, err := s.list(ctx, group+"/checkpoint/")
+	if err != nil {
+		return nil, err
+	}
+	l := make([]*Checkpoint, 0, len(blobs))
+	for _, b := range blobs {
+		seq, err := strconv.ParseInt(b.meta("sequencenumber"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed checkpoint %q: %s", b.Name, err)
+		}
+		l = append(l, &Checkpoint{
+			PartitionID:    path.Base(b.Name),
+			Offset:         b.meta("offset"),
+			SequenceNumber: seq,
+		})
+	}
+	return l, nil
+}
+
+// UpdateCheckpoint implements CheckpointStore.
+func (s *BlobCheckpointStore) UpdateCheckpoint(ctx context.Context, group string, checkpoint *Checkpoint) error {
+	if checkpoint == nil {
+		panic("checkpoint is nil")
+	}
+	_, err := s.put(ctx, group+"/checkpoint/"+checkpoint.PartitionID, http.Header{
+		"x-ms-meta-offset":         {checkpoint.Offset},
+		"x-ms-meta-sequencenumber": {strconv.FormatInt(checkpoint.SequenceNumber, 10)},
+	})
+	return err
+}
+
+type blobItem struct {
+	Name         string `xml:"Name"`
+	LastModified string `xml:"Properties>Last-Modified"`
+	ETag         string `xml:"Properties>Etag"`
+	Metadata     struct {
+		Items []struct {
+			XMLName xml.Name
+			Value   string `xml:",chardata"`
+		} `xml:",any"`
+	} `xml:"Metadata"`
+}
+
+// meta returns the named metadata value, names are case-insensitive.
+func (b *blobItem) meta(name string) string {
+	for _, m := range b.Metadata.Items {
+		if strings.EqualFold(m.XMLName.Local, name) {
+			return m.Value
+		}
+	}
+	return ""
+}
+
+// list returns all blobs with names starting with prefix.
+func (s *BlobCheckpointStore) list(ctx context.Context, prefix string) ([]*blobItem, error) {
+	var blobs []*blobItem
+	var marker string
+	for {
+		u := *s.url
+		q := u.Query()
+		q.Set("restype", "container")
+		q.Set("comp", "list")
+		q.Set("include", "metadata")
+		q.Set("prefix", prefix)
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		u.RawQuery = q.Encode()
+
+		_, body, err := s.do(ctx, http.MethodGet, u.String(), nil, http.StatusOK)
+		if err != nil {
+			return nil, err
+		}
+		var v struct {
+			Blobs      []*blobItem `xml:"Blobs>Blob"`
+			NextMarker string      `xml:"NextMarker"`
+		}
+		if err = xml.Unmarshal(body, &v); err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, v.Blobs...)
+		if v.NextMarker == "" {
+			return blobs, nil
+		}
+		marker = v.NextMarker
+	}
+}
+
+// put creates or overwrites the named empty block blob.
+func (s *BlobCheckpointStore) put(ctx context.Context, name string, h http.Header) (http.Header, error) {
+	u := *s.url
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + name
+	h.Set("x-ms-blob-type", "BlockBlob")
+	res, _, err := s.do(ctx, http.MethodPut, u.String(), h, http.StatusCreated)
+	return res, err
+}
+
+func (s *BlobCheckpointStore) do(
+	ctx context.Context, method, uri string,
+	h http.Header,
+	code int, // expected status code
+) (http.Header, []byte, error) {
+	req, err := http.NewRequest(method, uri, bytes.NewReader(nil))
+	if err != nil {
+		return nil, nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range h {
+		req.Header.Set(k, v[0])
+	}
+	req.Header.Set("x-ms-version", blobVersion)
+	res, err := s.http.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if res.StatusCode != code {
+		return nil, nil, &blobError{StatusCode: res.StatusCode, Body: body}
+	}
+	return res.Header, body, nil
+}
+
+// blobError is a storage request error.
+type blobError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (e *blobError) Error() string {
+	return fmt.Sprintf("blob request failed: code = %d, desc = %q", e.StatusCode, e.Body)
+}
@@ -0,0 +1,198 @@
+package iotservice
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryCheckpointStore(t *testing.T) {
+	t.Parallel()
+
+	testCheckpointStore(t, NewMemoryCheckpointStore())
+}
+
+func TestBlobCheckpointStore(t *testing.T) {
+	t.Parallel()
+
+	b := &blobServer{blobs: map[string]*blob{}}
+	srv := httptest.NewServer(b)
+	defer srv.Close()
+
+	s, err := NewBlobCheckpointStore(srv.URL+"/cnt?sv=token", srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCheckpointStore(t, s)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, r := range b.reqs {
+		if g := r.Header.Get("x-ms-version"); g != blobVersion {
+			t.Errorf("%s %s x-ms-version = %q, want %q", r.Method, r.URL, g, blobVersion)
+		}
+		if r.URL.Query().Get("sv") != "token" {
+			t.Errorf("%s %s has no SAS token", r.Method, r.URL)
+		}
+	}
+
+	if _, err = NewBlobCheckpointStore("ftp://host/cnt", nil); err == nil {
+		t.Error("NewBlobCheckpointStore() with ftp scheme = nil error")
+	}
+}
+
+func testCheckpointStore(t *testing.T, s CheckpointStore) {
+	t.Helper()
+
+	ctx := context.Background()
+	l, err := s.ClaimOwnership(ctx, "group", []*Ownership{
+		{PartitionID: "0", OwnerID: "a"},
+		{PartitionID: "1", OwnerID: "a"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(l) != 2 || l[0].ETag == "" || l[0].LastModified.IsZero() {
+		t.Fatalf("ClaimOwnership() = %v", l)
+	}
+
+	// blank etag fails when the partition is owned,
+	// stale etag fails when the claim has been renewed
+	res, err := s.ClaimOwnership(ctx, "group", []*Ownership{
+		{PartitionID: "0", OwnerID: "b"},
+		{PartitionID: "1", OwnerID: "b", ETag: l[1].ETag},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].PartitionID != "1" || res[0].OwnerID != "b" || res[0].ETag == l[1].ETag {
+		t.Fatalf("ClaimOwnership() = %v", res)
+	}
+	if res, err = s.ClaimOwnership(ctx, "group", []*Ownership{
+		{PartitionID: "1", OwnerID: "a", ETag: l[1].ETag},
+	}); err != nil {
+		t.Fatal(err)
+	} else if len(res) != 0 {
+		t.Fatalf("ClaimOwnership() with stale etag = %v", res)
+	}
+
+	if l, err = s.ListOwnership(ctx, "group"); err != nil {
+		t.Fatal(err)
+	}
+	owners := map[string]string{}
+	for _, o := range l {
+		owners[o.PartitionID] = o.OwnerID
+	}
+	if g := fmt.Sprint(owners); g != "map[0:a 1:b]" {
+		t.Errorf("ListOwnership() = %s, want map[0:a 1:b]", g)
+	}
+	if l, err = s.ListOwnership(ctx, "other"); err != nil {
+		t.Fatal(err)
+	} else if len(l) != 0 {
+		t.Errorf("ListOwnership() of other group = %v", l)
+	}
+
+	for _, c := range []*Checkpoint{
+		{PartitionID: "0", Offset: "10", SequenceNumber: 1},
+		{PartitionID: "0", Offset: "20", SequenceNumber: 2},
+	} {
+		if err = s.UpdateCheckpoint(ctx, "group", c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cl, err := s.ListCheckpoints(ctx, "group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cl) != 1 || *cl[0] != (Checkpoint{PartitionID: "0", Offset: "20", SequenceNumber: 2}) {
+		t.Errorf("ListCheckpoints() = %v", cl)
+	}
+}
+
+type blob struct {
+	meta     http.Header
+	etag     string
+	modified time.Time
+}
+
+// blobServer is a minimal in-memory implementation of the blob
+// storage REST API, list responses are split into pages of one blob.
+type blobServer struct {
+	mu      sync.Mutex
+	blobs   map[string]*blob
+	version int
+	reqs    []*http.Request
+}
+
+func (b *blobServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reqs = append(b.reqs, r)
+
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		if r.URL.Path != "/cnt" || q.Get("restype") != "container" ||
+			q.Get("comp") != "list" || q.Get("include") != "metadata" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var names []string
+		for name := range b.blobs {
+			if strings.HasPrefix(name, q.Get("prefix")) && name > q.Get("marker") {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		_, _ = io.WriteString(w, "<EnumerationResults><Blobs>")
+		if len(names) != 0 {
+			o := b.blobs[names[0]]
+			fmt.Fprintf(w, "<Blob><Name>%s</Name><Properties><Last-Modified>%s</Last-Modified>"+
+				"<Etag>%s</Etag></Properties><Metadata>", names[0], o.modified.UTC().Format(http.TimeFormat), o.etag)
+			for k := range o.meta {
+				fmt.Fprintf(w, "<%s>%s</%s>", k, o.meta.Get(k), k)
+			}
+			_, _ = io.WriteString(w, "</Metadata></Blob>")
+		}
+		_, _ = io.WriteString(w, "</Blobs><NextMarker>")
+		if len(names) > 1 {
+			_, _ = io.WriteString(w, names[0])
+		}
+		_, _ = io.WriteString(w, "</NextMarker></EnumerationResults>")
+	case http.MethodPut:
+		if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/cnt/")
+		o, ok := b.blobs[name]
+		if m := r.Header.Get("If-Match"); m != "" && (!ok || o.etag != m) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && ok {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		b.version++
+		o = &blob{meta: http.Header{}, etag: fmt.Sprintf(`"%d"`, b.version), modified: time.Now()}
+		for k, v := range r.Header {
+			if strings.HasPrefix(k, "X-Ms-Meta-") {
+				o.meta[strings.TrimPrefix(k, "X-Ms-Meta-")] = v
+			}
+		}
+		b.blobs[name] = o
+		w.Header().Set("ETag", o.etag)
+		w.Header().Set("Last-Modified", o.modified.UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
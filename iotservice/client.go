@@ -13,6 +13,7 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -54,8 +55,87 @@ func WithHTTPClient(client *http.Client) ClientOption {
 	}
 }
 
+// WithTLSConfig sets custom TLS configuration for AMQP and REST connections,
+// e.g. to pin a custom CA in sovereign clouds or enforce a minimal TLS version.
+// The server name and root CAs are filled in when they're not set.
+//
+// It doesn't affect clients set with WithHTTPClient.
+func WithTLSConfig(config *tls.Config) ClientOption {
+	if config == nil {
+		panic("config is nil")
+	}
+	return func(c *Client) error {
+		c.tls = config
+		return nil
+	}
+}
+
+// WithDialer sets the function for establishing AMQP and REST connections,
+// e.g. through SOCKS5 proxies or VPN tunnels, the TLS handshake is done
+// over them by the client.
+//
+// It doesn't affect clients set with WithHTTPClient.
+func WithDialer(fn common.Dialer) ClientOption {
+	if fn == nil {
+		panic("fn is nil")
+	}
+	return func(c *Client) error {
+		c.dial = fn
+		return nil
+	}
+}
+
+// WithEndpoint makes the client connect to addr, a host name or an IP
+// address, instead of the hub's hostname, e.g. to reach a private endpoint
+// when the hostname doesn't resolve to it. TLS server names and tokens are
+// issued for the hub's hostname still. It's based on WithDialer.
+//
+// Events are consumed from the eventhub-compatible endpoint that isn't affected.
+func WithEndpoint(addr string) ClientOption {
+	return func(c *Client) error {
+		if addr == "" {
+			return errors.New("endpoint is blank")
+		}
+		c.addr = addr
+		return nil
+	}
+}
+
+// WithRetryPolicy sets the policy for retrying transient REST failures
+// like throttling and server errors, by default nothing is retried.
+func WithRetryPolicy(p common.RetryPolicy) ClientOption {
+	return func(c *Client) error {
+		c.retry = p
+		return nil
+	}
+}
+
+// WithTracer enables tracing of REST calls and sending events, trace
+// context of sent events is propagated in their application properties.
+func WithTracer(t common.Tracer) ClientOption {
+	return func(c *Client) error {
+		c.tracer = t
+		return nil
+	}
+}
+
+// WithMetrics enables collecting REST requests latency,
+// throttling responses and sent and received messages metrics.
+func WithMetrics(m common.Metrics) ClientOption {
+	return func(c *Client) error {
+		c.metrics = m
+		return nil
+	}
+}
+
 // WithLogger sets client logger.
 func WithLogger(l *log.Logger) ClientOption {
+	return WithStructuredLogger(common.NewStdLogger(l))
+}
+
+// WithStructuredLogger sets a leveled logger, it receives
+// debug messages only when debug mode is enabled.
+func WithStructuredLogger(l common.Logger) ClientOption {
 	return func(c *Client) error {
 		c.logger = l
 		return nil
@@ -73,27 +153,44 @@ func WithDebug(d bool) ClientOption {
 // NewClient creates new iothub service client.
 func NewClient(opts ...ClientOption) (*Client, error) {
 	c := &Client{
-		done: make(chan struct{}),
+		done:  make(chan struct{}),
+		rcmin: time.Second,
+		rcmax: 30 * time.Second,
 	}
 	for _, opt := range opts {
 		if err := opt(c); err != nil {
 			return nil, err
 		}
 	}
+	c.feedback = &linkMux{
+		c:      c,
+		addr:   "/messages/servicebound/feedback",
+		decode: decodeFeedback,
+	}
+	c.files = &linkMux{
+		c:      c,
+		addr:   "/messages/serviceBound/filenotifications",
+		decode: decodeFileNotification,
+	}
 
 	if c.creds == nil {
 		return nil, errors.New("credentials are missing, consider using `WithCredentials` or `WithConnectionString` option")
 	}
 
+	if c.addr != "" {
+		c.dial = common.EndpointDialer(c.dial, c.creds.HostName, c.addr)
+	}
+
 	// set the default rest client, it uses only bundled ca-certificates
 	// it's useful when the ca-certificates package is not present on
 	// a very slim host systems like alpine or busybox.
 	if c.http == nil {
 		c.http = &http.Client{
 			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
+				TLSClientConfig: common.MergeTLSConfig(c.tls, &tls.Config{
 					RootCAs: common.RootCAs(),
-				},
+				}),
+				DialContext: c.dial,
 			},
 		}
 	}
@@ -101,62 +198,195 @@ func NewClient(opts ...ClientOption) (*Client, error) {
 }
 
 type Client struct {
-	mu     sync.Mutex
-	conn   *eventhub.Client
-	done   chan struct{}
-	creds  *common.Credentials
-	logger *log.Logger
-	debug  bool
-	http   *http.Client // REST client
+	mu      sync.Mutex
+	conn    *eventhub.Client
+	done    chan struct{}
+	creds   *common.Credentials
+	logger  common.Logger
+	debug   bool
+	http    *http.Client  // REST client
+	tls     *tls.Config   // custom tls configuration
+	dial    common.Dialer // custom dialer, nil when not set
+	addr    string        // address connections are made to instead of the hub
+	tokens  TokenProvider // azure ad tokens, nil when shared access keys are used
+	scope   string        // azure ad tokens scope, AADScope when blank
+	retry   common.RetryPolicy
+	tracer  common.Tracer
+	metrics common.Metrics
+	onState AMQPStateHandler
+	rcmin   time.Duration // reconnect backoff
+	rcmax   time.Duration
+
+	feedback *linkMux
+	files    *linkMux
+
+	kmu sync.RWMutex // protects creds.SharedAccessKey
+
+	tmu   sync.Mutex // cached azure ad token
+	token string
+	texp  time.Time
+
+	// needed for testing
+	now time.Time
 }
 
 // ConnectToAMQP connects to the iothub AMQP broker, it's done automatically before
 // publishing events or subscribing to the feedback topic.
+//
+// A lost connection is re-established the same way on the next use,
+// see WithAMQPReconnect and WithAMQPStateHandler.
 func (c *Client) ConnectToAMQP(ctx context.Context) error {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	connected, err := c.connectToAMQP(ctx)
+	c.mu.Unlock()
+	if connected {
+		c.dispatchState(AMQPConnected, nil)
+	}
+	return err
+}
+
+// connectToAMQP establishes a new connection unless it's already done,
+// the caller must hold c.mu.
+func (c *Client) connectToAMQP(ctx context.Context) (connected bool, err error) {
 	if c.conn != nil {
-		return nil // already connected
+		return false, nil // already connected
+	}
+	if c.closed() {
+		return false, ErrClosed
 	}
 
-	c.debugf("connecting to %s", c.creds.HostName)
-	eh, err := eventhub.Dial("amqps://"+c.creds.HostName, &tls.Config{
+	c.debugf(common.ComponentTransport, "connecting to %s", c.creds.HostName)
+	var eh *eventhub.Client
+	eh, err = eventhub.DialContext(ctx, "amqps://"+c.creds.HostName, common.MergeTLSConfig(c.tls, &tls.Config{
 		ServerName: c.creds.HostName,
 		RootCAs:    common.RootCAs(),
-	})
+	}), c.dial)
 	if err != nil {
-		return err
+		return false, err
 	}
+	eh.SetLogger(c.logger)
 	defer func() {
 		if err != nil {
 			eh.Close()
 		}
 	}()
 
-	sas, err := c.creds.SAS(c.creds.HostName, time.Hour)
+	if err = c.putTokenContinuously(ctx, eh); err != nil {
+		return false, err
+	}
+	c.conn = eh
+	return true, nil
+}
+
+// tokenRefreshMargin is how long before expiration tokens are refreshed.
+const tokenRefreshMargin = 5 * time.Minute
+
+// putToken authorizes the AMQP connection with a new token
+// and returns the time when it expires.
+func (c *Client) putToken(ctx context.Context, eh *eventhub.Client) (time.Time, error) {
+	if c.tokens != nil {
+		token, exp, err := c.aadToken(ctx)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return exp, eh.PutJWT(ctx, c.creds.HostName, token)
+	}
+	exp := time.Now().Add(time.Hour)
+	sas, err := c.sas(c.creds.HostName, time.Hour)
 	if err != nil {
-		return err
+		return time.Time{}, err
 	}
-	if err = eh.PutTokenContinuously(ctx, c.creds.HostName, sas, c.done); err != nil {
+	return exp, eh.PutToken(ctx, c.creds.HostName, sas)
+}
+
+// putTokenContinuously puts the first token in blocking mode and keeps
+// putting new ones before they expire until the client is closed.
+func (c *Client) putTokenContinuously(ctx context.Context, eh *eventhub.Client) error {
+	exp, err := c.putToken(ctx, eh)
+	if err != nil {
 		return err
 	}
-	c.conn = eh
+	go func() {
+		for {
+			d := time.Until(exp) - tokenRefreshMargin
+			if d < time.Minute {
+				d = time.Minute
+			}
+			select {
+			case <-time.After(d):
+			case <-c.done:
+				return
+			}
+			c.mu.Lock()
+			stale := c.conn != eh
+			c.mu.Unlock()
+			if stale {
+				return // the connection has been replaced
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			exp, err = c.putToken(ctx, eh)
+			cancel()
+			if err != nil {
+				c.logf(common.LevelError, common.ComponentAuth, "put token error: %s", err)
+				return
+			}
+		}
+	}()
 	return nil
 }
 
+// sas generates a SAS token signed with the current shared access key.
+func (c *Client) sas(uri string, d time.Duration) (string, error) {
+	c.kmu.RLock()
+	defer c.kmu.RUnlock()
+	return c.creds.SAS(uri, d)
+}
+
+// RotateKey replaces the shared access key used for signing SAS tokens,
+// the live AMQP connection is re-authenticated with a token signed with
+// the new key straight away. Events subscriptions established earlier
+// keep working until they're reconnected.
+func (c *Client) RotateKey(newKey string) error {
+	if c.tokens != nil {
+		return errors.New("client uses azure ad tokens")
+	}
+	if err := common.ValidateKey(newKey); err != nil {
+		return err
+	}
+	c.kmu.Lock()
+	c.creds.SharedAccessKey = newKey
+	c.kmu.Unlock()
+	c.logf(common.LevelInfo, common.ComponentAuth, "shared access key rotated")
+
+	c.mu.Lock()
+	eh := c.conn
+	c.mu.Unlock()
+	if eh == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := c.putToken(ctx, eh)
+	return err
+}
+
 // Subscribing to C2D events requires connection to an eventhub instance,
 // that's hostname and authentication mechanism is absolutely different
 // from raw connection to an AMQP broker.
 func (c *Client) connectToEventHub(ctx context.Context) (*amqp.Client, string, error) {
-	user := c.creds.SharedAccessKeyName + "@sas.root." + c.creds.HostName
-	user = user[:len(user)-18] // sub .azure-devices.net"
-	pass, err := c.creds.SAS(c.creds.HostName, time.Hour)
+	if c.tokens != nil {
+		return nil, "", errors.New("subscribing to events requires a shared access key")
+	}
+	// the hub name doesn't depend on the cloud's hostname suffix
+	user := c.creds.SharedAccessKeyName + "@sas.root." + common.HubName(c.creds.HostName)
+	pass, err := c.sas(c.creds.HostName, time.Hour)
 	if err != nil {
 		return nil, "", err
 	}
 
 	addr := "amqps://" + c.creds.HostName
-	conn, err := amqp.Dial(addr, amqp.ConnSASLPlain(user, pass))
+	conn, err := eventhub.DialAMQP(ctx, addr, nil, c.dial, amqp.ConnSASLPlain(user, pass))
 	if err != nil {
 		return nil, "", err
 	}
@@ -194,7 +424,10 @@ func (c *Client) connectToEventHub(ctx context.Context) (*amqp.Client, string, e
 	group = group[strings.Index(group, ":5671/")+6 : len(group)-1]
 
 	addr = "amqps://" + rerr.RemoteError.Info["hostname"].(string)
-	conn, err = amqp.Dial(addr, amqp.ConnSASLPlain(c.creds.SharedAccessKeyName, c.creds.SharedAccessKey))
+	c.kmu.RLock()
+	key := c.creds.SharedAccessKey
+	c.kmu.RUnlock()
+	conn, err = eventhub.DialAMQP(ctx, addr, nil, c.dial, amqp.ConnSASLPlain(c.creds.SharedAccessKeyName, key))
 	if err != nil {
 		return nil, "", err
 	}
@@ -221,6 +454,7 @@ func (c *Client) SubscribeEvents(ctx context.Context, fn MessageHandler) error {
 	defer sess.Close(context.Background())
 
 	return eventhub.SubscribePartitions(ctx, sess, group, "$Default", func(msg *amqp.Message) {
+		c.add(common.MetricMessagesReceived)
 		go fn(commonamqp.FromAMQPMessage(msg))
 	})
 }
@@ -252,6 +486,14 @@ func WithSendUserID(uid string) SendOption {
 	}
 }
 
+// WithSendContentType sets the payload's media type.
+func WithSendContentType(typ string) SendOption {
+	return func(msg *common.Message) error {
+		msg.ContentType = typ
+		return nil
+	}
+}
+
 const (
 	// AckNone no feedback.
 	AckNone = "none"
@@ -313,6 +555,25 @@ func WithSendProperties(m map[string]string) SendOption {
 	}
 }
 
+// SendValue encodes v with the codec registered for the content type
+// and sends it to the named device like SendEvent, the device can
+// decode the payload with common.Message.Decode.
+func (c *Client) SendValue(
+	ctx context.Context,
+	deviceID string,
+	contentType string,
+	v interface{},
+	opts ...SendOption,
+) error {
+	var msg common.Message
+	if err := msg.Encode(contentType, v); err != nil {
+		return err
+	}
+	return c.SendEvent(ctx, deviceID, msg.Payload, append([]SendOption{
+		WithSendContentType(msg.ContentType),
+	}, opts...)...)
+}
+
 // SendEvent sends the given cloud-to-device message and returns its id.
 // Panics when event is nil.
 func (c *Client) SendEvent(
@@ -320,16 +581,53 @@ func (c *Client) SendEvent(
 	deviceID string,
 	payload []byte,
 	opts ...SendOption,
-) error {
-	if deviceID == "" {
-		return errors.New("device id is empty")
+) (err error) {
+	ctx, span := common.StartSpan(ctx, c.tracer, "iothub.SendEvent", map[string]string{
+		"iothub.hostname":  c.creds.HostName,
+		"iothub.device_id": deviceID,
+	})
+	defer func() {
+		span.End(err)
+	}()
+	msg, err := c.newC2DMessage(span, deviceID, payload, opts)
+	if err != nil {
+		return err
 	}
-	if payload == nil {
-		return errors.New("payload is nil")
+
+	b := c.backoff()
+	for attempt := 1; ; attempt++ {
+		var conn *eventhub.Client
+		if conn, err = c.amqpConn(ctx); err == nil {
+			if err = c.send(ctx, conn, msg); err == nil {
+				c.add(common.MetricMessagesSent)
+				return nil
+			}
+			if commonamqp.IsConnError(err) {
+				c.resetAMQP(conn, err)
+			}
+		}
+		if !recoverable(err) || attempt == sendAttempts {
+			return err
+		}
+		c.debugf(common.ComponentTransport, "resending message %s: %s", msg.MessageID, err)
+		if !c.wait(ctx, b) {
+			return err
+		}
 	}
+}
 
-	if err := c.ConnectToAMQP(ctx); err != nil {
-		return err
+// newC2DMessage builds a cloud-to-device message addressed to the named device.
+func (c *Client) newC2DMessage(
+	span common.Span,
+	deviceID string,
+	payload []byte,
+	opts []SendOption,
+) (*common.Message, error) {
+	if deviceID == "" {
+		return nil, errors.New("device id is empty")
+	}
+	if payload == nil {
+		return nil, errors.New("payload is nil")
 	}
 
 	msg := &common.Message{
@@ -338,55 +636,122 @@ func (c *Client) SendEvent(
 	}
 	for _, opt := range opts {
 		if err := opt(msg); err != nil {
-			return err
+			return nil, err
+		}
+	}
+	if c.tracer != nil {
+		if msg.Properties == nil {
+			msg.Properties = map[string]string{}
+		}
+		span.Inject(msg.Properties)
+	}
+	if err := msg.CheckSize(common.MaxCloudToDeviceSize); err != nil {
+		return nil, err
+	}
+	if msg.MessageID == "" {
+		// resent messages keep the same id, so the hub can deduplicate them
+		mid, err := eventhub.RandString()
+		if err != nil {
+			return nil, err
 		}
+		msg.MessageID = mid
 	}
+	return msg, nil
+}
 
+// send sends msg over a new link of conn.
+func (c *Client) send(ctx context.Context, conn *eventhub.Client, msg *common.Message) error {
 	// opening a new link for every message is not the most efficient way
-	send, err := c.conn.Sess().NewSender(
+	send, err := conn.Sess().NewSender(
 		amqp.LinkTargetAddress("/messages/devicebound"),
 	)
 	if err != nil {
 		return err
 	}
 	defer send.Close(context.Background())
-	return send.Send(ctx, commonamqp.ToAMQPMessage(msg))
+	return commonamqp.FromAMQPError(send.Send(ctx, commonamqp.ToAMQPMessage(msg)))
+}
+
+// PurgeQueue deletes all pending cloud-to-device messages
+// of the named device and returns their number.
+func (c *Client) PurgeQueue(ctx context.Context, deviceID string) (int, error) {
+	if deviceID == "" {
+		return 0, errors.New("deviceID is empty")
+	}
+	var v struct {
+		TotalMessagesPurged int `json:"totalMessagesPurged"`
+	}
+	if err := c.call(ctx, http.MethodDelete, "devices/"+url.PathEscape(deviceID)+"/commands", nil, nil, &v); err != nil {
+		return 0, err
+	}
+	return v.TotalMessagesPurged, nil
 }
 
 // FeedbackHandler handles message feedback.
 type FeedbackHandler func(f *Feedback)
 
-// SubscribeFeedback subscribes to feedback of messages that ack was requested.
+// SubscribeFeedback subscribes to feedback of messages that ack was requested,
+// it blocks until ctx is done or the subscription fails.
 func (c *Client) SubscribeFeedback(ctx context.Context, fn FeedbackHandler) error {
-	if err := c.ConnectToAMQP(ctx); err != nil {
-		return err
-	}
-	recv, err := c.conn.Sess().NewReceiver(
-		amqp.LinkSourceAddress("/messages/servicebound/feedback"),
-	)
+	sub, err := c.ReceiveFeedback(ctx)
 	if err != nil {
 		return err
 	}
-	defer recv.Close(context.Background())
-
+	defer sub.Close()
 	for {
-		msg, err := recv.Receive(ctx)
+		f, err := sub.Recv(ctx)
 		if err != nil {
 			return err
 		}
-		msg.Accept()
+		go fn(f)
+	}
+}
 
-		var v []*Feedback
-		if err = json.Unmarshal(msg.Data[0], &v); err != nil {
-			return err
-		}
-		for _, f := range v {
-			go fn(f)
-		}
+// ReceiveFeedback subscribes to delivery feedback of cloud-to-device
+// messages sent with WithSendAck, all subscriptions share the same link.
+//
+// The hub sends feedback in batches so it may take up to a minute.
+func (c *Client) ReceiveFeedback(ctx context.Context, opts ...FeedbackOption) (*FeedbackSub, error) {
+	s := &FeedbackSub{
+		q:   newLinkQueue[*Feedback](),
+		mux: c.feedback,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if err := c.feedback.sub(ctx, s); err != nil {
+		s.q.close()
+		return nil, err
 	}
+	return s, nil
 }
 
-// Feedback is message feedback.
+func decodeFeedback(msg *amqp.Message) ([]interface{}, error) {
+	if len(msg.Data) == 0 {
+		return nil, errors.New("feedback message has no data")
+	}
+	var v []*Feedback
+	if err := json.Unmarshal(msg.Data[0], &v); err != nil {
+		return nil, err
+	}
+	vs := make([]interface{}, len(v))
+	for i := range v {
+		vs[i] = v[i]
+	}
+	return vs, nil
+}
+
+// Feedback status codes.
+const (
+	FeedbackSuccess               = "Success"
+	FeedbackExpired               = "Expired"
+	FeedbackDeliveryCountExceeded = "DeliveryCountExceeded"
+	FeedbackRejected              = "Rejected"
+	FeedbackPurged                = "Purged"
+)
+
+// Feedback is message feedback, OriginalMessageID is the ID
+// of the message it's about and StatusCode is its outcome.
 type Feedback struct {
 	OriginalMessageID  string    `json:"originalMessageId"`
 	Description        string    `json:"description"`
@@ -396,6 +761,41 @@ type Feedback struct {
 	StatusCode         string    `json:"statusCode"`
 }
 
+// SubscribeFileNotifications subscribes to notifications about files
+// uploaded by devices, file notifications have to be enabled on the hub.
+func (c *Client) SubscribeFileNotifications(ctx context.Context) (*FileNotificationSub, error) {
+	s := &FileNotificationSub{
+		q:   newLinkQueue[*FileNotification](),
+		mux: c.files,
+	}
+	if err := c.files.sub(ctx, s); err != nil {
+		s.q.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func decodeFileNotification(msg *amqp.Message) ([]interface{}, error) {
+	if len(msg.Data) == 0 {
+		return nil, errors.New("file notification message has no data")
+	}
+	n := &FileNotification{}
+	if err := json.Unmarshal(msg.Data[0], n); err != nil {
+		return nil, err
+	}
+	return []interface{}{n}, nil
+}
+
+// FileNotification is a notification about a file uploaded by a device.
+type FileNotification struct {
+	DeviceID        string    `json:"deviceId"`
+	BlobURI         string    `json:"blobUri"`
+	BlobName        string    `json:"blobName"`
+	BlobSizeInBytes int64     `json:"blobSizeInBytes"`
+	LastUpdatedTime time.Time `json:"lastUpdatedTime"`
+	EnqueuedTimeUTC time.Time `json:"enqueuedTimeUtc"`
+}
+
 // HostName returns service's hostname.
 func (c *Client) HostName() string {
 	return c.creds.HostName
@@ -414,7 +814,8 @@ func (c *Client) DeviceConnectionString(device *Device, secondary bool) (string,
 		c.creds.HostName, device.DeviceID, key), nil
 }
 
-// DeviceSAS generates a SAS token for the named device.
+// DeviceSAS generates a SAS token for the named device, it's scoped
+// to the device endpoint so it cannot be used to access others.
 func (c *Client) DeviceSAS(device *Device, duration time.Duration, secondary bool) (string, error) {
 	if device == nil {
 		panic("device is nil")
@@ -423,25 +824,73 @@ func (c *Client) DeviceSAS(device *Device, duration time.Duration, secondary boo
 	if err != nil {
 		return "", err
 	}
-	creds := common.Credentials{
-		HostName:        c.creds.HostName,
-		DeviceID:        device.DeviceID,
-		SharedAccessKey: key,
+	return c.scopedSAS(key, duration, device.DeviceID)
+}
+
+// ModuleSAS generates a SAS token for the named module, see DeviceSAS.
+func (c *Client) ModuleSAS(module *Module, duration time.Duration, secondary bool) (string, error) {
+	if module == nil {
+		panic("module is nil")
+	}
+	key, err := authKey(module.Authentication, secondary)
+	if err != nil {
+		return "", err
 	}
-	return creds.SAS(creds.HostName, duration)
+	return c.scopedSAS(key, duration, module.DeviceID, "modules", module.ModuleID)
+}
+
+// scopedSAS signs a token for {hostname}/devices/{elem...} with the given key.
+func (c *Client) scopedSAS(key string, duration time.Duration, elem ...string) (string, error) {
+	if duration <= 0 {
+		return "", errors.New("duration must be positive")
+	}
+	uri := c.creds.HostName + "/devices"
+	for _, e := range elem {
+		if e == "" {
+			return "", errors.New("identity is incomplete")
+		}
+		uri += "/" + url.PathEscape(e)
+	}
+	ts := time.Now()
+	if !c.now.IsZero() {
+		ts = c.now
+	}
+	sas, err := common.NewSharedAccessSignature(uri, "", key, ts.Add(duration))
+	if err != nil {
+		return "", err
+	}
+	return sas.String(), nil
 }
 
 func deviceKey(device *Device, secondary bool) (string, error) {
-	if device.Authentication == nil || device.Authentication.SymmetricKey == nil {
+	return authKey(device.Authentication, secondary)
+}
+
+// ModuleConnectionString builds up a connection string for the given module.
+func (c *Client) ModuleConnectionString(module *Module, secondary bool) (string, error) {
+	if module == nil {
+		panic("module is nil")
+	}
+	key, err := authKey(module.Authentication, secondary)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("HostName=%s;DeviceId=%s;ModuleId=%s;SharedAccessKey=%s",
+		c.creds.HostName, module.DeviceID, module.ModuleID, key), nil
+}
+
+func authKey(auth *Authentication, secondary bool) (string, error) {
+	if auth == nil || auth.SymmetricKey == nil {
 		return "", errors.New("symmetric key is not available")
 	}
 	if secondary {
-		return device.Authentication.SymmetricKey.SecondaryKey, nil
+		return auth.SymmetricKey.SecondaryKey, nil
 	}
-	return device.Authentication.SymmetricKey.PrimaryKey, nil
+	return auth.SymmetricKey.PrimaryKey, nil
 }
 
-type call struct {
+// MethodCall is a direct-method invocation request.
+type MethodCall struct {
 	MethodName      string                 `json:"methodName"`
 	ConnectTimeout  int                    `json:"connectTimeoutInSeconds,omitempty"`
 	ResponseTimeout int                    `json:"responseTimeoutInSeconds,omitempty"`
@@ -449,19 +898,27 @@ type call struct {
 }
 
 // CallOption is a direct-method invocation option.
-type CallOption func(c *call) error
+type CallOption func(c *MethodCall) error
 
-// ConnectTimeout is connection timeout in seconds.
+// WithCallConnectTimeout sets how long the hub waits for
+// the device to connect in seconds, allowed values are 0-300.
 func WithCallConnectTimeout(seconds int) CallOption {
-	return func(c *call) error {
+	return func(c *MethodCall) error {
+		if seconds < 0 || seconds > 300 {
+			return fmt.Errorf("connect timeout %ds is out of range 0-300s", seconds)
+		}
 		c.ConnectTimeout = seconds
 		return nil
 	}
 }
 
-// ResponseTimeout is response timeout in seconds.
+// WithCallResponseTimeout sets how long the hub waits for the method
+// response in seconds, allowed values are 5-300, defaults to 30.
 func WithCallResponseTimeout(seconds int) CallOption {
-	return func(c *call) error {
+	return func(c *MethodCall) error {
+		if seconds < 5 || seconds > 300 {
+			return fmt.Errorf("response timeout %ds is out of range 5-300s", seconds)
+		}
 		c.ResponseTimeout = seconds
 		return nil
 	}
@@ -478,6 +935,34 @@ func (c *Client) Call(
 	if deviceID == "" {
 		return nil, errors.New("deviceID is empty")
 	}
+	return c.callMethod(ctx, "twins/"+url.PathEscape(deviceID)+"/methods", methodName, payload, opts)
+}
+
+// CallModule is same as Call but it invokes the direct method
+// on the named module, e.g. an IoT Edge module.
+func (c *Client) CallModule(
+	ctx context.Context,
+	deviceID, moduleID string,
+	methodName string,
+	payload map[string]interface{},
+	opts ...CallOption,
+) (*Result, error) {
+	if deviceID == "" {
+		return nil, errors.New("deviceID is empty")
+	}
+	if moduleID == "" {
+		return nil, errors.New("moduleID is empty")
+	}
+	return c.callMethod(ctx, modulePath("twins", deviceID, moduleID)+"/methods", methodName, payload, opts)
+}
+
+func (c *Client) callMethod(
+	ctx context.Context,
+	path string,
+	methodName string,
+	payload map[string]interface{},
+	opts []CallOption,
+) (*Result, error) {
 	if methodName == "" {
 		return nil, errors.New("methodName is empty")
 	}
@@ -485,7 +970,7 @@ func (c *Client) Call(
 		return nil, errors.New("payload is empty")
 	}
 
-	v := &call{
+	v := &MethodCall{
 		MethodName: methodName,
 		Payload:    payload,
 	}
@@ -496,7 +981,7 @@ func (c *Client) Call(
 	}
 
 	r := &Result{}
-	if err := c.call(ctx, http.MethodPost, "twins/"+url.PathEscape(deviceID)+"/methods", nil, v, r); err != nil {
+	if err := c.call(ctx, http.MethodPost, path, nil, v, r); err != nil {
 		return nil, err
 	}
 	return r, nil
@@ -529,32 +1014,100 @@ func (c *Client) CreateDevice(ctx context.Context, device *Device) (*Device, err
 	return d, nil
 }
 
-// UpdateDevice updates the named device.
-func (c *Client) UpdateDevice(ctx context.Context, device *Device) (*Device, error) {
+// UpdateDevice updates the named device, e.g. its status or keys.
+//
+// The device is updated only if it hasn't been changed since it was
+// retrieved, otherwise the error matches common.ErrPreconditionFailed.
+// Blank ETag is an error unless WithIfMatch is given.
+func (c *Client) UpdateDevice(ctx context.Context, device *Device, opts ...UpdateOption) (*Device, error) {
 	if device == nil {
 		panic("device is nil")
 	}
 	if device.DeviceID == "" {
 		return nil, errors.New("deviceID is empty")
 	}
+	h, err := precondition(device.ETag, opts)
+	if err != nil {
+		return nil, err
+	}
 	d := &Device{}
-	if err := c.call(ctx, http.MethodPut, "devices/"+url.PathEscape(device.DeviceID), http.Header{
-		"If-Match": {"*"},
-	}, device, d); err != nil {
+	if err := c.call(ctx, http.MethodPut, "devices/"+url.PathEscape(device.DeviceID), h, device, d); err != nil {
 		return nil, err
 	}
 	return d, nil
 }
 
+// DeleteDevice deletes the named device unconditionally.
 func (c *Client) DeleteDevice(ctx context.Context, deviceID string) error {
+	return c.DeleteDeviceIfMatch(ctx, deviceID, "")
+}
+
+// DeleteDeviceIfMatch deletes the named device only if its ETag matches,
+// otherwise the error matches common.ErrPreconditionFailed.
+// Blank etag deletes the device unconditionally.
+func (c *Client) DeleteDeviceIfMatch(ctx context.Context, deviceID, etag string) error {
 	if deviceID == "" {
 		return errors.New("deviceID is empty")
 	}
 	return c.call(ctx, http.MethodDelete, "devices/"+url.PathEscape(deviceID), http.Header{
-		"If-Match": {"*"},
+		"If-Match": {ifMatch(etag)},
 	}, nil, nil)
 }
 
+// UpdateOption is an update request option.
+type UpdateOption func(o *updateOptions)
+
+type updateOptions struct {
+	etag string
+}
+
+// WithIfMatch overrides ETag of the updated object, "*" matches any ETag
+// and updates the object unconditionally, read-modify-write loops look like:
+//
+//	for {
+//		d, err := c.GetDevice(ctx, id)
+//		...
+//		d.Status = DeviceDisabled
+//		if _, err = c.UpdateDevice(ctx, d); errors.Is(err, common.ErrPreconditionFailed) {
+//			continue
+//		}
+//		...
+//	}
+func WithIfMatch(etag string) UpdateOption {
+	return func(o *updateOptions) {
+		o.etag = etag
+	}
+}
+
+// errNoETag is returned when neither the object's ETag nor WithIfMatch is set.
+var errNoETag = errors.New(`etag is empty, use WithIfMatch("*") to update unconditionally`)
+
+// precondition returns the update request If-Match header,
+// etag is the ETag of the object being updated.
+func precondition(etag string, opts []UpdateOption) (http.Header, error) {
+	o := &updateOptions{etag: etag}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.etag == "" {
+		return nil, errNoETag
+	}
+	return http.Header{"If-Match": {ifMatch(o.etag)}}, nil
+}
+
+// ifMatch returns the If-Match header value for the given etag,
+// the registry returns etags unquoted but expects them quoted,
+// blank etag matches any.
+func ifMatch(etag string) string {
+	if etag == "" {
+		return "*"
+	}
+	if strings.HasPrefix(etag, `"`) || etag == "*" {
+		return etag
+	}
+	return `"` + etag + `"`
+}
+
 // ListDevices lists all registered devices.
 func (c *Client) ListDevices(ctx context.Context) ([]*Device, error) {
 	l := make([]*Device, 0)
@@ -564,6 +1117,141 @@ func (c *Client) ListDevices(ctx context.Context) ([]*Device, error) {
 	return l, nil
 }
 
+// GetModule retrieves the named module of the device.
+func (c *Client) GetModule(ctx context.Context, deviceID, moduleID string) (*Module, error) {
+	if deviceID == "" {
+		return nil, errors.New("deviceID is empty")
+	}
+	if moduleID == "" {
+		return nil, errors.New("moduleID is empty")
+	}
+	m := &Module{}
+	if err := c.call(ctx, http.MethodGet, modulePath("devices", deviceID, moduleID), nil, nil, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// CreateModule creates a new module identity on the device,
+// it can authenticate on its own without IoT Edge when it uses
+// symmetric keys or X.509 certificates.
+func (c *Client) CreateModule(ctx context.Context, module *Module) (*Module, error) {
+	if module == nil {
+		panic("module is nil")
+	}
+	if module.DeviceID == "" {
+		return nil, errors.New("deviceID is empty")
+	}
+	if module.ModuleID == "" {
+		return nil, errors.New("moduleID is empty")
+	}
+	m := &Module{}
+	if err := c.call(ctx, http.MethodPut,
+		modulePath("devices", module.DeviceID, module.ModuleID), nil, module, m,
+	); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// UpdateModule updates the named module, ETag is handled same way as by UpdateDevice.
+func (c *Client) UpdateModule(ctx context.Context, module *Module, opts ...UpdateOption) (*Module, error) {
+	if module == nil {
+		panic("module is nil")
+	}
+	if module.DeviceID == "" {
+		return nil, errors.New("deviceID is empty")
+	}
+	if module.ModuleID == "" {
+		return nil, errors.New("moduleID is empty")
+	}
+	h, err := precondition(module.ETag, opts)
+	if err != nil {
+		return nil, err
+	}
+	m := &Module{}
+	if err := c.call(ctx, http.MethodPut,
+		modulePath("devices", module.DeviceID, module.ModuleID), h, module, m,
+	); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// DeleteModule deletes the named module of the device.
+func (c *Client) DeleteModule(ctx context.Context, deviceID, moduleID string) error {
+	if deviceID == "" {
+		return errors.New("deviceID is empty")
+	}
+	if moduleID == "" {
+		return errors.New("moduleID is empty")
+	}
+	return c.call(ctx, http.MethodDelete, modulePath("devices", deviceID, moduleID), http.Header{
+		"If-Match": {"*"},
+	}, nil, nil)
+}
+
+// ListModules lists all modules of the device including IoT Edge system ones.
+func (c *Client) ListModules(ctx context.Context, deviceID string) ([]*Module, error) {
+	if deviceID == "" {
+		return nil, errors.New("deviceID is empty")
+	}
+	l := make([]*Module, 0)
+	if err := c.call(ctx, http.MethodGet, "devices/"+url.PathEscape(deviceID)+"/modules", nil, nil, &l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// GetModuleTwin retrieves the named module twin.
+func (c *Client) GetModuleTwin(ctx context.Context, deviceID, moduleID string) (*Twin, error) {
+	if deviceID == "" {
+		return nil, errors.New("deviceID is empty")
+	}
+	if moduleID == "" {
+		return nil, errors.New("moduleID is empty")
+	}
+	t := &Twin{}
+	if err := c.call(ctx, http.MethodGet, modulePath("twins", deviceID, moduleID), nil, nil, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// UpdateModuleTwin updates the named module twin tags and desired properties,
+// ETag is handled same way as by UpdateDevice.
+func (c *Client) UpdateModuleTwin(
+	ctx context.Context,
+	deviceID, moduleID string,
+	twin *Twin,
+	opts ...UpdateOption,
+) (*Twin, error) {
+	if deviceID == "" {
+		return nil, errors.New("deviceID is empty")
+	}
+	if moduleID == "" {
+		return nil, errors.New("moduleID is empty")
+	}
+	if twin == nil {
+		panic("twin is nil")
+	}
+	h, err := precondition(twin.ETag, opts)
+	if err != nil {
+		return nil, err
+	}
+	t := &Twin{}
+	if err := c.call(ctx, http.MethodPatch, modulePath("twins", deviceID, moduleID), h, twin, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// modulePath returns the path of the module resource,
+// kind is either devices or twins.
+func modulePath(kind, deviceID, moduleID string) string {
+	return kind + "/" + url.PathEscape(deviceID) + "/modules/" + url.PathEscape(moduleID)
+}
+
 // GetTwin retrieves the named twin device from the registry.
 func (c *Client) GetTwin(ctx context.Context, deviceID string) (*Twin, error) {
 	t := &Twin{}
@@ -573,7 +1261,9 @@ func (c *Client) GetTwin(ctx context.Context, deviceID string) (*Twin, error) {
 	return t, nil
 }
 
-// UpdateTwin updates the named twin desired properties.
+// UpdateTwin updates the named twin tags and desired properties
+// if its ETag matches etag, blank etag falls back to the twin's ETag
+// and "*" updates it unconditionally, see UpdateDevice.
 func (c *Client) UpdateTwin(
 	ctx context.Context,
 	deviceID string,
@@ -586,31 +1276,140 @@ func (c *Client) UpdateTwin(
 	if twin == nil {
 		panic("twin is nil")
 	}
+	if etag == "" {
+		etag = twin.ETag
+	}
+	h, err := precondition(etag, nil)
+	if err != nil {
+		return nil, err
+	}
 	t := &Twin{}
-	if err := c.call(ctx, http.MethodPatch, "twins/"+url.PathEscape(deviceID), http.Header{
-		"If-Match": []string{etag},
-	}, twin, t); err != nil {
+	if err := c.call(ctx, http.MethodPatch, "twins/"+url.PathEscape(deviceID), h, twin, t); err != nil {
 		return nil, err
 	}
 	return t, nil
 }
 
-// Stats retrieves the device registry statistic.
+// GetConfiguration retrieves the named configuration.
+func (c *Client) GetConfiguration(ctx context.Context, configID string) (*Configuration, error) {
+	if configID == "" {
+		return nil, errors.New("configID is empty")
+	}
+	v := &Configuration{}
+	if err := c.call(ctx, http.MethodGet, "configurations/"+url.PathEscape(configID), nil, nil, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// CreateConfiguration creates a new configuration.
+func (c *Client) CreateConfiguration(ctx context.Context, config *Configuration) (*Configuration, error) {
+	if config == nil {
+		panic("config is nil")
+	}
+	if config.ID == "" {
+		return nil, errors.New("configID is empty")
+	}
+	v := &Configuration{}
+	if err := c.call(ctx, http.MethodPut, "configurations/"+url.PathEscape(config.ID), nil, config, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// UpdateConfiguration updates the named configuration, only its target
+// condition, priority, labels and metrics can be changed, not its content.
+//
+// ETag is handled the same way UpdateDevice does.
+func (c *Client) UpdateConfiguration(
+	ctx context.Context,
+	config *Configuration,
+	opts ...UpdateOption,
+) (*Configuration, error) {
+	if config == nil {
+		panic("config is nil")
+	}
+	if config.ID == "" {
+		return nil, errors.New("configID is empty")
+	}
+	h, err := precondition(config.ETag, opts)
+	if err != nil {
+		return nil, err
+	}
+	v := &Configuration{}
+	if err := c.call(ctx, http.MethodPut, "configurations/"+url.PathEscape(config.ID), h, config, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// DeleteConfiguration deletes the named configuration unconditionally.
+func (c *Client) DeleteConfiguration(ctx context.Context, configID string) error {
+	return c.DeleteConfigurationIfMatch(ctx, configID, "")
+}
+
+// DeleteConfigurationIfMatch deletes the named configuration only if
+// its ETag matches, see DeleteDeviceIfMatch.
+func (c *Client) DeleteConfigurationIfMatch(ctx context.Context, configID, etag string) error {
+	if configID == "" {
+		return errors.New("configID is empty")
+	}
+	return c.call(ctx, http.MethodDelete, "configurations/"+url.PathEscape(configID), http.Header{
+		"If-Match": {ifMatch(etag)},
+	}, nil, nil)
+}
+
+// ListConfigurations lists all configurations.
+func (c *Client) ListConfigurations(ctx context.Context) ([]*Configuration, error) {
+	l := make([]*Configuration, 0)
+	if err := c.call(ctx, http.MethodGet, "configurations", nil, nil, &l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// ApplyConfigurationContent applies the configuration content to the
+// named device directly, e.g. an IoT Edge deployment manifest to an
+// edge device, regardless of configurations targeting it.
+func (c *Client) ApplyConfigurationContent(
+	ctx context.Context,
+	deviceID string,
+	content *ConfigurationContent,
+) error {
+	if deviceID == "" {
+		return errors.New("deviceID is empty")
+	}
+	if content == nil {
+		panic("content is nil")
+	}
+	return c.call(ctx, http.MethodPost,
+		"devices/"+url.PathEscape(deviceID)+"/applyConfigurationContent", nil, content, nil,
+	)
+}
+
+// Stats retrieves the device registry and the service statistics.
 func (c *Client) Stats(ctx context.Context) (*Stats, error) {
 	v := &Stats{}
-	if err := c.call(ctx, http.MethodGet, "statistics/devices", nil, nil, &v); err != nil {
+	if err := c.call(ctx, http.MethodGet, "statistics/devices", nil, nil, v); err != nil {
+		return nil, err
+	}
+	// both responses are decoded into the same struct
+	if err := c.call(ctx, http.MethodGet, "statistics/service", nil, nil, v); err != nil {
 		return nil, err
 	}
 	return v, nil
 }
 
+// ImportDevicesFromBlob creates an import job.
+//
+// Deprecated: use ImportDevices.
 func (c *Client) ImportDevicesFromBlob(
 	ctx context.Context,
 	inputBlobURL string,
 	outputBlobURL string,
 ) (map[string]interface{}, error) {
 	var v map[string]interface{}
-	if err := c.call(ctx, http.MethodGet, "jobs/create", nil, map[string]interface{}{
+	if err := c.call(ctx, http.MethodPost, "jobs/create", nil, map[string]interface{}{
 		"type":                   "import",
 		"inputBlobContainerUri":  inputBlobURL,
 		"outputBlobContainerUri": outputBlobURL,
@@ -620,13 +1419,16 @@ func (c *Client) ImportDevicesFromBlob(
 	return v, nil
 }
 
+// ExportDevicesToBlob creates an export job.
+//
+// Deprecated: use ExportDevices.
 func (c *Client) ExportDevicesToBlob(
 	ctx context.Context,
 	outputBlobURL string,
 	excludeKeys bool,
 ) (map[string]interface{}, error) {
 	var v map[string]interface{}
-	if err := c.call(ctx, http.MethodGet, "jobs/create", nil, map[string]interface{}{
+	if err := c.call(ctx, http.MethodPost, "jobs/create", nil, map[string]interface{}{
 		"type": "export",
 		"outputBlobContainerUri": outputBlobURL,
 		"excludeKeysInExport":    excludeKeys,
@@ -636,6 +1438,83 @@ func (c *Client) ExportDevicesToBlob(
 	return v, nil
 }
 
+// ImportDevices starts a bulk job that creates, updates or deletes devices
+// listed in the devices.txt blob of the input container, see Azure docs for
+// its format. Errors are written to the importErrors.log blob of the output
+// container, both URIs have to include SAS tokens with write permissions.
+func (c *Client) ImportDevices(ctx context.Context, inputURI, outputURI string) (*Job, error) {
+	if inputURI == "" {
+		return nil, errors.New("input uri is empty")
+	}
+	if outputURI == "" {
+		return nil, errors.New("output uri is empty")
+	}
+	return c.createJob(ctx, &Job{
+		Type:                   JobTypeImport,
+		InputBlobContainerURI:  inputURI,
+		OutputBlobContainerURI: outputURI,
+	})
+}
+
+// ExportDevices starts a bulk job that writes all registry devices with
+// their twins to the devices.txt blob of the given container, its URI has
+// to include a SAS token with write permissions.
+func (c *Client) ExportDevices(ctx context.Context, blobContainerURI string, excludeKeys bool) (*Job, error) {
+	if blobContainerURI == "" {
+		return nil, errors.New("blob container uri is empty")
+	}
+	return c.createJob(ctx, &Job{
+		Type:                   JobTypeExport,
+		OutputBlobContainerURI: blobContainerURI,
+		ExcludeKeysInExport:    excludeKeys,
+	})
+}
+
+func (c *Client) createJob(ctx context.Context, job *Job) (*Job, error) {
+	v := &Job{}
+	if err := c.call(ctx, http.MethodPost, "jobs/create", nil, job, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// JobStatus retrieves the current state of the named import/export job.
+func (c *Client) JobStatus(ctx context.Context, jobID string) (*Job, error) {
+	if jobID == "" {
+		return nil, errors.New("jobID is empty")
+	}
+	v := &Job{}
+	if err := c.call(ctx, http.MethodGet, "jobs/"+url.PathEscape(jobID), nil, nil, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// WaitJob polls the named import/export job status every interval
+// until it's finished or ctx is done, it doesn't fail when the job
+// fails, that has to be checked with the returned job's status.
+func (c *Client) WaitJob(ctx context.Context, jobID string, interval time.Duration) (*Job, error) {
+	if interval <= 0 {
+		panic("interval must be positive")
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		job, err := c.JobStatus(ctx, jobID)
+		if err != nil {
+			return nil, err
+		}
+		if job.Done() {
+			return job, nil
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
 func (c *Client) ListJobs(ctx context.Context) ([]map[string]interface{}, error) {
 	var v []map[string]interface{}
 	if err := c.call(ctx, http.MethodGet, "jobs", nil, nil, &v); err != nil {
@@ -660,42 +1539,268 @@ func (c *Client) CancelJob(ctx context.Context, jobID string) (map[string]interf
 	return v, nil
 }
 
-// TODO: add the following registry operations:
-//   add/delete/update devices (bulk)
-//
-// see: https://github.com/Azure/azure-iot-sdk-node/blob/master/service/src/registry.ts
+// ScheduleOption is a scheduled job option.
+type ScheduleOption func(j *ScheduledJob)
+
+// WithScheduleStartTime sets when the job starts, it starts immediately by default.
+func WithScheduleStartTime(t time.Time) ScheduleOption {
+	return func(j *ScheduledJob) {
+		j.StartTime = t.UTC().Format(time.RFC3339)
+	}
+}
+
+// WithScheduleMaxExecutionTime sets the maximum job running time,
+// it's rounded to seconds.
+func WithScheduleMaxExecutionTime(d time.Duration) ScheduleOption {
+	return func(j *ScheduledJob) {
+		j.MaxExecutionTimeInSeconds = int(d / time.Second)
+	}
+}
+
+// ScheduleTwinUpdate creates the job that applies the twin patch,
+// tags and desired properties, to all devices matching the query condition.
+func (c *Client) ScheduleTwinUpdate(
+	ctx context.Context,
+	jobID string,
+	queryCondition string,
+	twin *Twin,
+	opts ...ScheduleOption,
+) (*ScheduledJob, error) {
+	if twin == nil {
+		panic("twin is nil")
+	}
+	return c.scheduleJob(ctx, &ScheduledJob{
+		JobID:          jobID,
+		Type:           JobTypeScheduleUpdateTwin,
+		QueryCondition: queryCondition,
+		UpdateTwin:     twin,
+	}, opts)
+}
+
+// ScheduleMethodCall creates the job that invokes the direct method
+// on all devices matching the query condition.
+func (c *Client) ScheduleMethodCall(
+	ctx context.Context,
+	jobID string,
+	queryCondition string,
+	call *MethodCall,
+	opts ...ScheduleOption,
+) (*ScheduledJob, error) {
+	if call == nil {
+		panic("call is nil")
+	}
+	if call.MethodName == "" {
+		return nil, errors.New("methodName is empty")
+	}
+	return c.scheduleJob(ctx, &ScheduledJob{
+		JobID:               jobID,
+		Type:                JobTypeScheduleDeviceMethod,
+		QueryCondition:      queryCondition,
+		CloudToDeviceMethod: call,
+	}, opts)
+}
+
+func (c *Client) scheduleJob(ctx context.Context, job *ScheduledJob, opts []ScheduleOption) (*ScheduledJob, error) {
+	if job.JobID == "" {
+		return nil, errors.New("jobID is empty")
+	}
+	if job.QueryCondition == "" {
+		return nil, errors.New("query condition is empty")
+	}
+	for _, opt := range opts {
+		opt(job)
+	}
+	v := &ScheduledJob{}
+	if err := c.call(ctx, http.MethodPut, "jobs/v2/"+url.PathEscape(job.JobID), nil, job, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// ScheduledJobStatus retrieves the current state of the named scheduled job.
+func (c *Client) ScheduledJobStatus(ctx context.Context, jobID string) (*ScheduledJob, error) {
+	if jobID == "" {
+		return nil, errors.New("jobID is empty")
+	}
+	v := &ScheduledJob{}
+	if err := c.call(ctx, http.MethodGet, "jobs/v2/"+url.PathEscape(jobID), nil, nil, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// CancelScheduledJob cancels the named scheduled job,
+// devices that are already processed are not reverted.
+func (c *Client) CancelScheduledJob(ctx context.Context, jobID string) (*ScheduledJob, error) {
+	if jobID == "" {
+		return nil, errors.New("jobID is empty")
+	}
+	v := &ScheduledJob{}
+	if err := c.call(ctx, http.MethodPost, "jobs/v2/"+url.PathEscape(jobID)+"/cancel", nil, nil, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// WaitScheduledJob polls the named scheduled job status every interval
+// until it's finished or ctx is done, per-device results can be retrieved
+// by querying `SELECT * FROM devices.jobs WHERE devices.jobs.jobId = 'ID'`.
+func (c *Client) WaitScheduledJob(ctx context.Context, jobID string, interval time.Duration) (*ScheduledJob, error) {
+	if interval <= 0 {
+		panic("interval must be positive")
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		job, err := c.ScheduledJobStatus(ctx, jobID)
+		if err != nil {
+			return nil, err
+		}
+		if job.Done() {
+			return job, nil
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// ListScheduledJobs lists scheduled jobs of the given type and status,
+// blank values match any, e.g. JobTypeScheduleDeviceMethod and JobStatusRunning.
+func (c *Client) ListScheduledJobs(ctx context.Context, jobType, jobStatus string) ([]*ScheduledJob, error) {
+	q := url.Values{}
+	if jobType != "" {
+		q.Set("jobType", jobType)
+	}
+	if jobStatus != "" {
+		q.Set("jobStatus", jobStatus)
+	}
+	path := "jobs/v2/query"
+	if len(q) != 0 {
+		path += "?" + q.Encode()
+	}
+
+	var l []*ScheduledJob
+	h := http.Header{}
+	for {
+		var v struct {
+			Items             []*ScheduledJob `json:"items"`
+			ContinuationToken string          `json:"continuationToken"`
+		}
+		res, err := c.request(ctx, http.MethodGet, path, h, nil, &v)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, v.Items...)
+		token := res.Get("x-ms-continuation")
+		if token == "" {
+			token = v.ContinuationToken
+		}
+		if token == "" {
+			return l, nil
+		}
+		h.Set("x-ms-continuation", token)
+	}
+}
+
+// ScheduledJobDevices returns per-device results of the named scheduled job.
+func (c *Client) ScheduledJobDevices(ctx context.Context, jobID string) ([]*DeviceJob, error) {
+	if jobID == "" {
+		return nil, errors.New("jobID is empty")
+	}
+	if strings.ContainsAny(jobID, `'\`) {
+		return nil, fmt.Errorf("malformed jobID %q", jobID)
+	}
+	it := c.QueryTwins(ctx, "SELECT * FROM devices.jobs WHERE devices.jobs.jobId = '"+jobID+"'")
+	var l []*DeviceJob
+	for it.Next() {
+		j := &DeviceJob{}
+		if err := it.ScanStruct(j); err != nil {
+			return nil, err
+		}
+		l = append(l, j)
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
 func (c *Client) call(
 	ctx context.Context, method, path string,
 	headers http.Header,
 	r, v interface{}, // request and response objects
 ) error {
+	_, err := c.request(ctx, method, path, headers, r, v)
+	return err
+}
+
+// request is same as call but it returns the response headers.
+func (c *Client) request(
+	ctx context.Context, method, path string,
+	headers http.Header,
+	r, v interface{},
+) (_ http.Header, err error) {
+	ctx, span := common.StartSpan(ctx, c.tracer, "iothub."+method, map[string]string{
+		"iothub.hostname": c.creds.HostName,
+		"http.method":     method,
+		"http.target":     path,
+	})
+	defer func() {
+		span.End(err)
+	}()
 	var b []byte
 	if r != nil {
 		var err error
 		b, err = json.Marshal(r)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
+	var h http.Header
+	if err = common.Retry(ctx, c.retry, func() error {
+		var err error
+		h, err = c.do(ctx, method, path, headers, b, v)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
 
-	uri := "https://" + c.creds.HostName + "/" + path + "?api-version=" + common.APIVersion
+// do makes one REST request attempt.
+func (c *Client) do(
+	ctx context.Context, method, path string,
+	headers http.Header,
+	b []byte, v interface{},
+) (http.Header, error) {
+	uri := "https://" + c.creds.HostName + "/" + path
+	if !strings.Contains(path, "api-version=") {
+		sep := "?"
+		if strings.Contains(path, "?") {
+			sep = "&"
+		}
+		uri += sep + "api-version=" + common.APIVersion
+	}
 	req, err := http.NewRequest(method, uri, bytes.NewReader(b))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	sas, err := c.creds.SAS(c.creds.HostName, time.Hour)
+	auth, err := c.authorization(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	rid, err := eventhub.RandString()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	req = req.WithContext(ctx)
 	req.Header.Set("Content-Type", "application/json; charset=utf-8")
-	req.Header.Set("Authorization", sas)
+	req.Header.Set("Authorization", auth)
 	req.Header.Set("Request-Id", rid)
 	if headers != nil {
 		for k, v := range headers {
@@ -706,24 +1811,37 @@ func (c *Client) call(
 		}
 	}
 
+	start := time.Now()
 	res, err := c.http.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer res.Body.Close()
+	if c.metrics != nil {
+		c.metrics.Observe(common.MetricRequestSeconds, time.Since(start).Seconds(), map[string]string{
+			"client": "service",
+			"method": method,
+			"code":   strconv.Itoa(res.StatusCode),
+		})
+		if res.StatusCode == http.StatusTooManyRequests {
+			c.add(common.MetricThrottled)
+		}
+	}
 
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	c.debugf("%s %s %d:\n%s\n%s", method, uri, res.StatusCode, prefix(b, "> "), prefix(body, "< "))
-	if v == nil && res.StatusCode == http.StatusNoContent {
-		return nil
+	c.debugf(common.ComponentClient, "%s %s %d:\n%s\n%s", method, uri, res.StatusCode, prefix(b, "> "), prefix(body, "< "))
+	if v == nil && (res.StatusCode == http.StatusNoContent ||
+		res.StatusCode == http.StatusOK || res.StatusCode == http.StatusAccepted) {
+		// response body is ignored, e.g. applyConfigurationContent returns an empty object
+		return res.Header, nil
 	}
 	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("code = %d, desc = %q", res.StatusCode, string(body))
+		return nil, common.NewHubError(res.StatusCode, res.Header, body)
 	}
-	return json.Unmarshal(body, v)
+	return res.Header, json.Unmarshal(body, v)
 }
 
 func prefix(s []byte, prefix string) string {
@@ -738,18 +1856,27 @@ func prefix(s []byte, prefix string) string {
 	return b.String()
 }
 
-func (c *Client) logf(format string, v ...interface{}) {
-	if c.logger != nil {
-		c.logger.Printf(format, v...)
+// add increments the named counter if metrics are enabled.
+func (c *Client) add(name string) {
+	if c.metrics != nil {
+		c.metrics.Add(name, 1, map[string]string{"client": "service"})
 	}
 }
 
-func (c *Client) debugf(format string, v ...interface{}) {
-	if c.debug {
-		c.logf(format, v...)
+func (c *Client) logf(level common.LogLevel, component, format string, v ...interface{}) {
+	if c.logger == nil || level == common.LevelDebug && !c.debug {
+		return
 	}
+	c.logger.Logf(level, component, format, v...)
 }
 
+func (c *Client) debugf(component, format string, v ...interface{}) {
+	c.logf(common.LevelDebug, component, format, v...)
+}
+
+// ErrClosed the client or the subscription is already closed.
+var ErrClosed = errors.New("closed")
+
 // Close closes transport.
 func (c *Client) Close() error {
 	c.mu.Lock()
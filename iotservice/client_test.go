@@ -0,0 +1,488 @@
+package iotservice
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goautomotive/iothub/common"
+)
+
+// testRequest is a request received by the test REST server.
+type testRequest struct {
+	Method string
+	Path   string
+	Query  string
+	Header http.Header
+	Body   string
+}
+
+// testServer records received requests and responds with body
+// unless reply is set, n is the number of the request starting from 0.
+type testServer struct {
+	mu    sync.Mutex
+	reqs  []*testRequest
+	body  string
+	reply func(w http.ResponseWriter, n int)
+}
+
+// newTestClient starts a REST server that responds to every request with
+// status 200 and body, and returns a client connected to it.
+func newTestClient(t *testing.T, body string) (*Client, *testServer) {
+	t.Helper()
+	s := &testServer{body: body}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		s.mu.Lock()
+		s.reqs = append(s.reqs, &testRequest{
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Query:  r.URL.RawQuery,
+			Header: r.Header,
+			Body:   string(b),
+		})
+		n, reply := len(s.reqs)-1, s.reply
+		s.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if reply != nil {
+			reply(w, n)
+			return
+		}
+		_, _ = io.WriteString(w, s.body)
+	}))
+	t.Cleanup(srv.Close)
+
+	c, err := NewClient(
+		WithConnectionString("HostName="+srv.Listener.Addr().String()+
+			";SharedAccessKeyName=iothubowner;SharedAccessKey=a2V5"),
+		WithHTTPClient(srv.Client()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, s
+}
+
+// respond sets the reply function.
+func (s *testServer) respond(fn func(w http.ResponseWriter, n int)) {
+	s.mu.Lock()
+	s.reply = fn
+	s.mu.Unlock()
+}
+
+// last returns the last received request.
+func (s *testServer) last(t *testing.T) *testRequest {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.reqs) == 0 {
+		t.Fatal("no requests received")
+	}
+	return s.reqs[len(s.reqs)-1]
+}
+
+func TestUpdatePreconditions(t *testing.T) {
+	t.Parallel()
+
+	c, s := newTestClient(t, "{}")
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name string
+		fn   func() error
+		want string
+	}{
+		{"blank etag WithIfMatch", func() error {
+			_, err := c.UpdateDevice(ctx, &Device{DeviceID: "dev"}, WithIfMatch("*"))
+			return err
+		}, "*"},
+		{"device etag", func() error {
+			_, err := c.UpdateDevice(ctx, &Device{DeviceID: "dev", ETag: "abc"})
+			return err
+		}, `"abc"`},
+		{"WithIfMatch", func() error {
+			_, err := c.UpdateDevice(ctx, &Device{DeviceID: "dev", ETag: "abc"}, WithIfMatch("*"))
+			return err
+		}, "*"},
+		{"twin etag", func() error {
+			_, err := c.UpdateTwin(ctx, "dev", &Twin{ETag: "abc"}, "")
+			return err
+		}, `"abc"`},
+		{"twin etag override", func() error {
+			_, err := c.UpdateTwin(ctx, "dev", &Twin{ETag: "abc"}, "*")
+			return err
+		}, "*"},
+		{"digital twin", func() error {
+			return c.UpdateDigitalTwin(ctx, "dev", []*PatchOperation{
+				{Op: "add", Path: "/x", Value: 1},
+			})
+		}, "*"},
+		{"digital twin WithIfMatch", func() error {
+			return c.UpdateDigitalTwin(ctx, "dev", []*PatchOperation{
+				{Op: "add", Path: "/x", Value: 1},
+			}, WithIfMatch(`"abc"`))
+		}, `"abc"`},
+	} {
+		if err := tc.fn(); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got := s.last(t).Header.Get("If-Match"); got != tc.want {
+			t.Errorf("%s: If-Match = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	// updates without any precondition are rejected before sending
+	if _, err := c.UpdateDevice(ctx, &Device{DeviceID: "dev"}); err != errNoETag {
+		t.Errorf("UpdateDevice(blank etag) = %v, want %v", err, errNoETag)
+	}
+	if _, err := c.UpdateTwin(ctx, "dev", &Twin{}, ""); err != errNoETag {
+		t.Errorf("UpdateTwin(blank etag) = %v, want %v", err, errNoETag)
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	t.Parallel()
+
+	c, _ := newTestClient(t, "{}")
+	before, err := c.sas(c.creds.HostName, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"", "not base64!"} {
+		if err := c.RotateKey(key); err == nil {
+			t.Errorf("RotateKey(%q) = nil, want an error", key)
+		}
+	}
+	if err = c.RotateKey("a2V5Mg=="); err != nil {
+		t.Fatal(err)
+	}
+	after, err := c.sas(c.creds.HostName, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before == after {
+		t.Error("token is signed with the old key after rotation")
+	}
+}
+
+func TestScopedSAS(t *testing.T) {
+	t.Parallel()
+
+	c, err := NewClient(WithConnectionString(
+		"HostName=test.azure-devices.net;SharedAccessKeyName=iothubowner;SharedAccessKey=a2V5",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.now = time.Date(2017, 1, 1, 1, 1, 1, 0, time.UTC)
+
+	auth := &Authentication{SymmetricKey: &SymmetricKey{
+		PrimaryKey:   "c2VjcmV0",
+		SecondaryKey: "c2Vjb25k",
+	}}
+	for name, s := range map[string]struct {
+		fn   func() (string, error)
+		want string
+	}{
+		"device": {func() (string, error) {
+			return c.DeviceSAS(&Device{DeviceID: "dev", Authentication: auth}, time.Hour, false)
+		}, "SharedAccessSignature sr=test.azure-devices.net%2Fdevices%2Fdev" +
+			"&sig=rMlgE3pE9rom4tfd0XygPo1srVywPY1zPNFQQsnus8U%3D&se=1483236061&skn="},
+		"device secondary": {func() (string, error) {
+			return c.DeviceSAS(&Device{DeviceID: "dev", Authentication: auth}, time.Hour, true)
+		}, "SharedAccessSignature sr=test.azure-devices.net%2Fdevices%2Fdev" +
+			"&sig=XPQ7iUOkyYaasxDBwSzpfQdCYnNtgEy5WiNCssyiIlg%3D&se=1483236061&skn="},
+		"device escaped": {func() (string, error) {
+			return c.DeviceSAS(&Device{DeviceID: "dev#1", Authentication: auth}, time.Hour, false)
+		}, "SharedAccessSignature sr=test.azure-devices.net%2Fdevices%2Fdev%25231" +
+			"&sig=BwKk6pFl1EDD4bOoJyCoTmsfTOJGnwZkz8MRIcET6GU%3D&se=1483236061&skn="},
+		"module": {func() (string, error) {
+			return c.ModuleSAS(&Module{DeviceID: "dev", ModuleID: "mod", Authentication: auth}, time.Hour, false)
+		}, "SharedAccessSignature sr=test.azure-devices.net%2Fdevices%2Fdev%2Fmodules%2Fmod" +
+			"&sig=gAgXBcfbWHB1clCYUSL%2Bqps1%2B1eHBuEAqNeesnikwqI%3D&se=1483236061&skn="},
+	} {
+		got, err := s.fn()
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if got != s.want {
+			t.Errorf("%s: SAS = %q, want %q", name, got, s.want)
+		}
+	}
+
+	for name, fn := range map[string]func() (string, error){
+		"no key": func() (string, error) {
+			return c.DeviceSAS(&Device{DeviceID: "dev"}, time.Hour, false)
+		},
+		"no module id": func() (string, error) {
+			return c.ModuleSAS(&Module{DeviceID: "dev", Authentication: auth}, time.Hour, false)
+		},
+		"zero duration": func() (string, error) {
+			return c.DeviceSAS(&Device{DeviceID: "dev", Authentication: auth}, 0, false)
+		},
+	} {
+		if _, err := fn(); err == nil {
+			t.Errorf("%s: error = nil, want an error", name)
+		}
+	}
+}
+
+func TestRequests(t *testing.T) {
+	t.Parallel()
+
+	c, s := newTestClient(t, "{}")
+	l, ls := newTestClient(t, "[]")
+	ctx := context.Background()
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	q := "api-version=" + common.APIVersion
+	for _, tc := range []struct {
+		name    string
+		s       *testServer
+		fn      func() error
+		method  string
+		path    string
+		ifMatch string
+		body    string // not checked when blank
+	}{
+		{"GetDevice", s, func() error {
+			_, err := c.GetDevice(ctx, "dev")
+			return err
+		}, http.MethodGet, "/devices/dev", "", ""},
+		{"CreateDevice", s, func() error {
+			_, err := c.CreateDevice(ctx, &Device{DeviceID: "dev", Authentication: NewCAAuthentication()})
+			return err
+		}, http.MethodPut, "/devices/dev", "", `{"deviceId":"dev","authentication":{"type":"certificateAuthority"}}`},
+		{"DeleteDevice", s, func() error {
+			return c.DeleteDevice(ctx, "dev")
+		}, http.MethodDelete, "/devices/dev", "*", ""},
+		{"ListDevices", ls, func() error {
+			_, err := l.ListDevices(ctx)
+			return err
+		}, http.MethodGet, "/devices", "", ""},
+		{"DeleteDeviceIfMatch", s, func() error {
+			return c.DeleteDeviceIfMatch(ctx, "dev", "abc")
+		}, http.MethodDelete, "/devices/dev", `"abc"`, ""},
+		{"GetModule", s, func() error {
+			_, err := c.GetModule(ctx, "dev", "mod")
+			return err
+		}, http.MethodGet, "/devices/dev/modules/mod", "", ""},
+		{"CreateModule", s, func() error {
+			_, err := c.CreateModule(ctx, &Module{DeviceID: "dev", ModuleID: "mod"})
+			return err
+		}, http.MethodPut, "/devices/dev/modules/mod", "", `{"moduleId":"mod","deviceId":"dev"}`},
+		{"UpdateModule", s, func() error {
+			_, err := c.UpdateModule(ctx, &Module{DeviceID: "dev", ModuleID: "mod", ETag: "abc"})
+			return err
+		}, http.MethodPut, "/devices/dev/modules/mod", `"abc"`, ""},
+		{"DeleteModule", s, func() error {
+			return c.DeleteModule(ctx, "dev", "mod")
+		}, http.MethodDelete, "/devices/dev/modules/mod", "*", ""},
+		{"ListModules", ls, func() error {
+			_, err := l.ListModules(ctx, "dev")
+			return err
+		}, http.MethodGet, "/devices/dev/modules", "", ""},
+		{"GetModuleTwin", s, func() error {
+			_, err := c.GetModuleTwin(ctx, "dev", "mod")
+			return err
+		}, http.MethodGet, "/twins/dev/modules/mod", "", ""},
+		{"UpdateModuleTwin", s, func() error {
+			_, err := c.UpdateModuleTwin(ctx, "dev", "mod", &Twin{Tags: map[string]interface{}{"a": 1}}, WithIfMatch("*"))
+			return err
+		}, http.MethodPatch, "/twins/dev/modules/mod", "*", `{"tags":{"a":1}}`},
+		{"CallModule", s, func() error {
+			_, err := c.CallModule(ctx, "dev", "mod", "reboot", map[string]interface{}{"a": 1},
+				WithCallResponseTimeout(10),
+			)
+			return err
+		}, http.MethodPost, "/twins/dev/modules/mod/methods", "",
+			`{"methodName":"reboot","responseTimeoutInSeconds":10,"payload":{"a":1}}`},
+		{"ImportDevices", s, func() error {
+			_, err := c.ImportDevices(ctx, "https://in", "https://out")
+			return err
+		}, http.MethodPost, "/jobs/create", "",
+			`{"type":"import","inputBlobContainerUri":"https://in","outputBlobContainerUri":"https://out"}`},
+		{"ExportDevices", s, func() error {
+			_, err := c.ExportDevices(ctx, "https://out", true)
+			return err
+		}, http.MethodPost, "/jobs/create", "",
+			`{"type":"export","outputBlobContainerUri":"https://out","excludeKeysInExport":true}`},
+		{"JobStatus", s, func() error {
+			_, err := c.JobStatus(ctx, "job")
+			return err
+		}, http.MethodGet, "/jobs/job", "", ""},
+		{"ScheduleTwinUpdate", s, func() error {
+			_, err := c.ScheduleTwinUpdate(ctx, "job", "tags.a = 1", &Twin{
+				Tags: map[string]interface{}{"b": 2},
+			}, WithScheduleStartTime(start), WithScheduleMaxExecutionTime(time.Minute))
+			return err
+		}, http.MethodPut, "/jobs/v2/job", "",
+			`{"jobId":"job","type":"scheduleUpdateTwin","queryCondition":"tags.a = 1",` +
+				`"startTime":"2020-01-01T00:00:00Z","maxExecutionTimeInSeconds":60,` +
+				`"updateTwin":{"tags":{"b":2}}}`},
+		{"ScheduleMethodCall", s, func() error {
+			_, err := c.ScheduleMethodCall(ctx, "job", "tags.a = 1", &MethodCall{
+				MethodName: "reboot",
+				Payload:    map[string]interface{}{"a": 1},
+			})
+			return err
+		}, http.MethodPut, "/jobs/v2/job", "",
+			`{"jobId":"job","type":"scheduleDeviceMethod","queryCondition":"tags.a = 1",` +
+				`"cloudToDeviceMethod":{"methodName":"reboot","payload":{"a":1}}}`},
+		{"ScheduledJobStatus", s, func() error {
+			_, err := c.ScheduledJobStatus(ctx, "job")
+			return err
+		}, http.MethodGet, "/jobs/v2/job", "", ""},
+		{"CancelScheduledJob", s, func() error {
+			_, err := c.CancelScheduledJob(ctx, "job")
+			return err
+		}, http.MethodPost, "/jobs/v2/job/cancel", "", ""},
+		{"GetConfiguration", s, func() error {
+			_, err := c.GetConfiguration(ctx, "cfg")
+			return err
+		}, http.MethodGet, "/configurations/cfg", "", ""},
+		{"CreateConfiguration", s, func() error {
+			_, err := c.CreateConfiguration(ctx, &Configuration{ID: "cfg", Priority: 1})
+			return err
+		}, http.MethodPut, "/configurations/cfg", "", `{"id":"cfg","priority":1}`},
+		{"UpdateConfiguration", s, func() error {
+			_, err := c.UpdateConfiguration(ctx, &Configuration{ID: "cfg", ETag: "abc"})
+			return err
+		}, http.MethodPut, "/configurations/cfg", `"abc"`, ""},
+		{"DeleteConfigurationIfMatch", s, func() error {
+			return c.DeleteConfigurationIfMatch(ctx, "cfg", "abc")
+		}, http.MethodDelete, "/configurations/cfg", `"abc"`, ""},
+		{"ListConfigurations", ls, func() error {
+			_, err := l.ListConfigurations(ctx)
+			return err
+		}, http.MethodGet, "/configurations", "", ""},
+		{"ApplyConfigurationContent", s, func() error {
+			return c.ApplyConfigurationContent(ctx, "dev", &ConfigurationContent{
+				ModulesContent: map[string]interface{}{"a": 1},
+			})
+		}, http.MethodPost, "/devices/dev/applyConfigurationContent", "", `{"modulesContent":{"a":1}}`},
+		{"PurgeQueue", s, func() error {
+			_, err := c.PurgeQueue(ctx, "dev")
+			return err
+		}, http.MethodDelete, "/devices/dev/commands", "", ""},
+	} {
+		if err := tc.fn(); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		r := tc.s.last(t)
+		if r.Method != tc.method || r.Path != tc.path || r.Query != q {
+			t.Errorf("%s: request = %s %s?%s, want %s %s?%s",
+				tc.name, r.Method, r.Path, r.Query, tc.method, tc.path, q)
+		}
+		if g := r.Header.Get("If-Match"); g != tc.ifMatch {
+			t.Errorf("%s: If-Match = %q, want %q", tc.name, g, tc.ifMatch)
+		}
+		if tc.body != "" && r.Body != tc.body {
+			t.Errorf("%s: body = %s, want %s", tc.name, r.Body, tc.body)
+		}
+	}
+}
+
+func TestWaitJob(t *testing.T) {
+	t.Parallel()
+
+	c, s := newTestClient(t, "")
+	s.respond(func(w http.ResponseWriter, n int) {
+		status := JobStatusRunning
+		if n == 2 {
+			status = JobStatusCompleted
+		}
+		fmt.Fprintf(w, `{"jobId":"job","status":%q}`, status)
+	})
+	job, err := c.WaitJob(context.Background(), "job", time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != JobStatusCompleted {
+		t.Errorf("Status = %q, want %q", job.Status, JobStatusCompleted)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := len(s.reqs); n != 3 {
+		t.Errorf("requests = %d, want 3", n)
+	}
+}
+
+func TestStats(t *testing.T) {
+	t.Parallel()
+
+	c, s := newTestClient(t, "")
+	s.respond(func(w http.ResponseWriter, n int) {
+		if n == 0 {
+			_, _ = io.WriteString(w, `{"totalDeviceCount":3,"enabledDeviceCount":2}`)
+			return
+		}
+		_, _ = io.WriteString(w, `{"connectedDeviceCount":1}`)
+	})
+	v, err := c.Stats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Stats{TotalDeviceCount: 3, EnabledDeviceCount: 2, ConnectedDeviceCount: 1}); *v != want {
+		t.Errorf("Stats() = %+v, want %+v", *v, want)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, path := range []string{"/statistics/devices", "/statistics/service"} {
+		if s.reqs[i].Path != path {
+			t.Errorf("request #%d path = %q, want %q", i, s.reqs[i].Path, path)
+		}
+	}
+}
+
+func TestPurgeQueue(t *testing.T) {
+	t.Parallel()
+
+	c, _ := newTestClient(t, `{"totalMessagesPurged":5}`)
+	n, err := c.PurgeQueue(context.Background(), "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 {
+		t.Errorf("PurgeQueue() = %d, want 5", n)
+	}
+}
+
+func TestModuleConnectionString(t *testing.T) {
+	t.Parallel()
+
+	c, _ := newTestClient(t, "{}")
+	m := &Module{
+		DeviceID:       "dev",
+		ModuleID:       "mod",
+		Authentication: NewSASAuthentication("a2V5", "a2V6"),
+	}
+	cs, err := c.ModuleConnectionString(m, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "HostName=" + c.creds.HostName + ";DeviceId=dev;ModuleId=mod;SharedAccessKey=a2V6"
+	if cs != want {
+		t.Errorf("ModuleConnectionString() = %q, want %q", cs, want)
+	}
+
+	for _, auth := range []*Authentication{
+		NewSelfSignedAuthentication("aa", "bb"),
+		NewCAAuthentication(),
+	} {
+		m.Authentication = auth
+		if _, err := c.ModuleConnectionString(m, false); err == nil {
+			t.Errorf("ModuleConnectionString() with %s authentication = nil error", auth.Type)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package iotservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Names of the IoT Edge runtime modules.
+const (
+	EdgeAgentModule = "$edgeAgent"
+	EdgeHubModule   = "$edgeHub"
+)
+
+// Edge module statuses and restart policies.
+const (
+	EdgeModuleRunning = "running"
+	EdgeModuleStopped = "stopped"
+
+	RestartNever       = "never"
+	RestartOnFailure   = "on-failure"
+	RestartOnUnhealthy = "on-unhealthy"
+	RestartAlways      = "always"
+)
+
+// Deployment is an IoT Edge deployment manifest, it sets desired
+// properties of the runtime modules and optionally of custom ones.
+type Deployment struct {
+	Agent *EdgeAgent
+	Hub   *EdgeHub
+
+	// ModuleProperties are desired properties of custom modules twins.
+	ModuleProperties map[string]map[string]interface{}
+}
+
+// EdgeAgent is the $edgeAgent desired properties,
+// it defines what modules run on the device.
+type EdgeAgent struct {
+	SchemaVersion string                 `json:"schemaVersion"`
+	Runtime       *EdgeRuntime           `json:"runtime"`
+	SystemModules *EdgeSystemModules     `json:"systemModules"`
+	Modules       map[string]*EdgeModule `json:"modules,omitempty"`
+}
+
+// EdgeRuntime is the container runtime configuration.
+type EdgeRuntime struct {
+	Type     string               `json:"type"`
+	Settings *EdgeRuntimeSettings `json:"settings"`
+}
+
+// EdgeRuntimeSettings are docker runtime settings,
+// registry credentials are keyed by arbitrary names.
+type EdgeRuntimeSettings struct {
+	MinDockerVersion    string                         `json:"minDockerVersion,omitempty"`
+	LoggingOptions      string                         `json:"loggingOptions,omitempty"`
+	RegistryCredentials map[string]*RegistryCredential `json:"registryCredentials,omitempty"`
+}
+
+// RegistryCredential is a private container registry credential.
+type RegistryCredential struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Address  string `json:"address"`
+}
+
+// EdgeSystemModules are the runtime modules.
+type EdgeSystemModules struct {
+	EdgeAgent *EdgeModule `json:"edgeAgent"`
+	EdgeHub   *EdgeModule `json:"edgeHub"`
+}
+
+// EdgeModule is a module definition, Status and RestartPolicy
+// are ignored for edgeAgent that always runs.
+type EdgeModule struct {
+	Version       string               `json:"version,omitempty"`
+	Type          string               `json:"type"`
+	Status        string               `json:"status,omitempty"`
+	RestartPolicy string               `json:"restartPolicy,omitempty"`
+	Env           map[string]*EnvValue `json:"env,omitempty"`
+	Settings      *EdgeModuleSettings  `json:"settings"`
+}
+
+// EnvValue is a module environment variable value.
+type EnvValue struct {
+	Value string `json:"value"`
+}
+
+// createOptionsChunk is the maximal length of a single createOptions value,
+// longer options are split into createOptions01, createOptions02, etc.
+const createOptionsChunk = 512
+
+// EdgeModuleSettings is the module image and the docker container create
+// options, they are stored as a json encoded string, see SetCreateOptions.
+type EdgeModuleSettings struct {
+	Image         string
+	CreateOptions string
+}
+
+// SetCreateOptions encodes v as docker container create
+// options, e.g. a map with HostConfig.PortBindings.
+func (s *EdgeModuleSettings) SetCreateOptions(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.CreateOptions = string(b)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler,
+// it splits long create options into chunks.
+func (s *EdgeModuleSettings) MarshalJSON() ([]byte, error) {
+	m := map[string]string{"image": s.Image}
+	opts := s.CreateOptions
+	for i := 0; opts != ""; i++ {
+		n := len(opts)
+		if n > createOptionsChunk {
+			n = createOptionsChunk
+		}
+		k := "createOptions"
+		if i != 0 {
+			k += fmt.Sprintf("%02d", i)
+		}
+		m[k], opts = opts[:n], opts[n:]
+	}
+	return json.Marshal(m)
+}
+
+// UnmarshalJSON implements json.Unmarshaler, it joins chunked create options.
+func (s *EdgeModuleSettings) UnmarshalJSON(b []byte) error {
+	var m map[string]string
+	if err := json.Unmarshal(b, &m); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		if strings.HasPrefix(k, "createOptions") {
+			keys = append(keys, k)
+		}
+	}
+	// createOptions sorts before createOptions01
+	sort.Strings(keys)
+	var opts strings.Builder
+	for _, k := range keys {
+		opts.WriteString(m[k])
+	}
+	s.Image = m["image"]
+	s.CreateOptions = opts.String()
+	return nil
+}
+
+// EdgeHub is the $edgeHub desired properties, routes are
+// keyed by names, e.g. "FROM /messages/* INTO $upstream".
+type EdgeHub struct {
+	SchemaVersion                string                  `json:"schemaVersion"`
+	Routes                       map[string]string       `json:"routes"`
+	StoreAndForwardConfiguration *EdgeStoreAndForwardCfg `json:"storeAndForwardConfiguration"`
+}
+
+// EdgeStoreAndForwardCfg is how long messages are stored on
+// the device when the hub is unreachable, 7200 seconds by default.
+type EdgeStoreAndForwardCfg struct {
+	TimeToLiveSecs int `json:"timeToLiveSecs"`
+}
+
+// NewDeployment creates a manifest running the given version
+// of runtime modules, e.g. "1.0", that routes all messages upstream.
+func NewDeployment(runtimeVersion string) *Deployment {
+	return &Deployment{
+		Agent: &EdgeAgent{
+			SchemaVersion: "1.0",
+			Runtime: &EdgeRuntime{
+				Type:     "docker",
+				Settings: &EdgeRuntimeSettings{},
+			},
+			SystemModules: &EdgeSystemModules{
+				EdgeAgent: &EdgeModule{
+					Type: "docker",
+					Settings: &EdgeModuleSettings{
+						Image: "mcr.microsoft.com/azureiotedge-agent:" + runtimeVersion,
+					},
+				},
+				EdgeHub: &EdgeModule{
+					Type:          "docker",
+					Status:        EdgeModuleRunning,
+					RestartPolicy: RestartAlways,
+					Settings: &EdgeModuleSettings{
+						Image: "mcr.microsoft.com/azureiotedge-hub:" + runtimeVersion,
+					},
+				},
+			},
+		},
+		Hub: &EdgeHub{
+			SchemaVersion: "1.0",
+			Routes: map[string]string{
+				"upstream": "FROM /messages/* INTO $upstream",
+			},
+			StoreAndForwardConfiguration: &EdgeStoreAndForwardCfg{
+				TimeToLiveSecs: 7200,
+			},
+		},
+	}
+}
+
+// AddModule adds a running docker module with the given image.
+func (d *Deployment) AddModule(name, image string) *EdgeModule {
+	m := &EdgeModule{
+		Version:       "1.0",
+		Type:          "docker",
+		Status:        EdgeModuleRunning,
+		RestartPolicy: RestartAlways,
+		Settings:      &EdgeModuleSettings{Image: image},
+	}
+	if d.Agent.Modules == nil {
+		d.Agent.Modules = map[string]*EdgeModule{}
+	}
+	d.Agent.Modules[name] = m
+	return m
+}
+
+// ParseDeployment parses a deployment manifest in
+// the {"modulesContent": {...}} form, e.g. deployment.json.
+func ParseDeployment(b []byte) (*Deployment, error) {
+	var v struct {
+		ModulesContent map[string]struct {
+			Desired json.RawMessage `json:"properties.desired"`
+		} `json:"modulesContent"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return nil, err
+	}
+	d := &Deployment{}
+	for name, m := range v.ModulesContent {
+		var err error
+		switch name {
+		case EdgeAgentModule:
+			err = json.Unmarshal(m.Desired, &d.Agent)
+		case EdgeHubModule:
+			err = json.Unmarshal(m.Desired, &d.Hub)
+		default:
+			var p map[string]interface{}
+			if err = json.Unmarshal(m.Desired, &p); err == nil {
+				if d.ModuleProperties == nil {
+					d.ModuleProperties = map[string]map[string]interface{}{}
+				}
+				d.ModuleProperties[name] = p
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Validate checks that the manifest can be applied, desired properties are
+// set only for modules defined in the manifest and all modules have images.
+func (d *Deployment) Validate() error {
+	if d.Agent == nil {
+		return errors.New("$edgeAgent is missing")
+	}
+	if d.Hub == nil {
+		return errors.New("$edgeHub is missing")
+	}
+	if d.Agent.Runtime == nil {
+		return errors.New("$edgeAgent runtime is missing")
+	}
+	if d.Agent.SystemModules == nil ||
+		d.Agent.SystemModules.EdgeAgent == nil || d.Agent.SystemModules.EdgeHub == nil {
+		return errors.New("$edgeAgent system modules are missing")
+	}
+	check := func(name string, m *EdgeModule) error {
+		if m == nil || m.Settings == nil || m.Settings.Image == "" {
+			return fmt.Errorf("module %q has no image", name)
+		}
+		if m.Settings.CreateOptions != "" && !json.Valid([]byte(m.Settings.CreateOptions)) {
+			return fmt.Errorf("module %q create options are not valid json", name)
+		}
+		return nil
+	}
+	if err := check("edgeAgent", d.Agent.SystemModules.EdgeAgent); err != nil {
+		return err
+	}
+	if err := check("edgeHub", d.Agent.SystemModules.EdgeHub); err != nil {
+		return err
+	}
+	for name, m := range d.Agent.Modules {
+		if err := check(name, m); err != nil {
+			return err
+		}
+	}
+	for name := range d.ModuleProperties {
+		if _, ok := d.Agent.Modules[name]; !ok {
+			return fmt.Errorf("module %q has properties but is not deployed", name)
+		}
+	}
+	return nil
+}
+
+// Content converts the manifest into a configuration content,
+// so it can be used in automatic deployments, see CreateConfiguration.
+func (d *Deployment) Content() (*ConfigurationContent, error) {
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+	m := map[string]interface{}{
+		EdgeAgentModule: map[string]interface{}{"properties.desired": d.Agent},
+		EdgeHubModule:   map[string]interface{}{"properties.desired": d.Hub},
+	}
+	for name, p := range d.ModuleProperties {
+		m[name] = map[string]interface{}{"properties.desired": p}
+	}
+	return &ConfigurationContent{ModulesContent: m}, nil
+}
+
+// ApplyDeployment applies the manifest to the named IoT Edge device.
+func (c *Client) ApplyDeployment(ctx context.Context, deviceID string, d *Deployment) error {
+	if d == nil {
+		panic("d is nil")
+	}
+	content, err := d.Content()
+	if err != nil {
+		return err
+	}
+	return c.ApplyConfigurationContent(ctx, deviceID, content)
+}
+
+// GetDeployment reads the manifest currently desired by the named
+// IoT Edge device from its runtime modules twins, module properties
+// aren't filled.
+func (c *Client) GetDeployment(ctx context.Context, deviceID string) (*Deployment, error) {
+	d := &Deployment{}
+	for _, v := range []struct {
+		module string
+		dst    interface{}
+	}{
+		{EdgeAgentModule, &d.Agent},
+		{EdgeHubModule, &d.Hub},
+	} {
+		t, err := c.GetModuleTwin(ctx, deviceID, v.module)
+		if err != nil {
+			return nil, err
+		}
+		if t.Properties == nil {
+			return nil, fmt.Errorf("%s twin has no properties", v.module)
+		}
+		b, err := json.Marshal(t.Properties.Desired)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(b, v.dst); err != nil {
+			return nil, fmt.Errorf("%s: %s", v.module, err)
+		}
+	}
+	return d, nil
+}
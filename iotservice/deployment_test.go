@@ -0,0 +1,101 @@
+package iotservice
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestEdgeModuleSettings(t *testing.T) {
+	t.Parallel()
+
+	s := &EdgeModuleSettings{Image: "img"}
+	if err := s.SetCreateOptions(map[string]string{"a": strings.Repeat("x", 2*createOptionsChunk)}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]string
+	if err = json.Unmarshal(b, &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 4 || len(m["createOptions"]) != createOptionsChunk ||
+		len(m["createOptions01"]) != createOptionsChunk || m["createOptions02"] == "" {
+		t.Errorf("MarshalJSON() = %s", b)
+	}
+
+	var g EdgeModuleSettings
+	if err = json.Unmarshal(b, &g); err != nil {
+		t.Fatal(err)
+	}
+	if g != *s {
+		t.Errorf("UnmarshalJSON() = %+v, want %+v", g, *s)
+	}
+}
+
+func TestParseDeployment(t *testing.T) {
+	t.Parallel()
+
+	d := NewDeployment("1.0")
+	d.AddModule("sensor", "sensor:1")
+	d.ModuleProperties = map[string]map[string]interface{}{"sensor": {"interval": 10.0}}
+	content, err := d.Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := ParseDeployment(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Agent.Modules["sensor"].Settings.Image != "sensor:1" ||
+		g.Hub.Routes["upstream"] != "FROM /messages/* INTO $upstream" ||
+		g.ModuleProperties["sensor"]["interval"] != 10.0 {
+		t.Errorf("ParseDeployment() = %+v", g)
+	}
+
+	for name, fn := range map[string]func(d *Deployment){
+		"no hub":           func(d *Deployment) { d.Hub = nil },
+		"no image":         func(d *Deployment) { d.AddModule("x", "") },
+		"bad options":      func(d *Deployment) { d.AddModule("x", "x").Settings.CreateOptions = "{" },
+		"unknown module":   func(d *Deployment) { d.ModuleProperties = map[string]map[string]interface{}{"x": {}} },
+		"no system module": func(d *Deployment) { d.Agent.SystemModules.EdgeHub = nil },
+	} {
+		d := NewDeployment("1.0")
+		fn(d)
+		if err := d.Validate(); err == nil {
+			t.Errorf("%s: Validate() = nil error", name)
+		}
+	}
+}
+
+func TestApplyDeployment(t *testing.T) {
+	t.Parallel()
+
+	c, s := newTestClient(t, "{}")
+	if err := c.ApplyDeployment(context.Background(), "dev", NewDeployment("1.0")); err != nil {
+		t.Fatal(err)
+	}
+	r := s.last(t)
+	if r.Method != http.MethodPost || r.Path != "/devices/dev/applyConfigurationContent" {
+		t.Errorf("request = %s %s", r.Method, r.Path)
+	}
+	var v struct {
+		ModulesContent map[string]map[string]json.RawMessage `json:"modulesContent"`
+	}
+	if err := json.Unmarshal([]byte(r.Body), &v); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{EdgeAgentModule, EdgeHubModule} {
+		if v.ModulesContent[name]["properties.desired"] == nil {
+			t.Errorf("%s desired properties are missing: %s", name, r.Body)
+		}
+	}
+}
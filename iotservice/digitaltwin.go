@@ -0,0 +1,163 @@
+package iotservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// digitalTwinAPIVersion is the first API version with digital twins support.
+const digitalTwinAPIVersion = "2020-09-30"
+
+// DigitalTwin is the Plug and Play representation of a device twin,
+// Properties contain root properties, components keyed by their names
+// and metadata attributes like $dtId and $metadata.
+type DigitalTwin struct {
+	ETag       string
+	Properties map[string]interface{}
+}
+
+// ID returns the digital twin id, that's the device id.
+func (t *DigitalTwin) ID() string {
+	id, _ := t.Properties["$dtId"].(string)
+	return id
+}
+
+// ModelID returns the DTDL model id the device announced, e.g. dtmi:com:example:Thermostat;1.
+func (t *DigitalTwin) ModelID() string {
+	m, _ := t.Properties["$metadata"].(map[string]interface{})
+	id, _ := m["$model"].(string)
+	return id
+}
+
+// PatchOperation is a JSON Patch (RFC 6902) operation, e.g.
+//
+//	&PatchOperation{Op: "add", Path: "/thermostat1/targetTemperature", Value: 42}
+//
+// writable properties of components are changed this way.
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// CommandResult is a digital twin command result.
+type CommandResult struct {
+	Status  int
+	Payload interface{}
+}
+
+func digitalTwinPath(id string, elem ...string) string {
+	p := "digitaltwins/" + url.PathEscape(id)
+	for _, e := range elem {
+		p += "/" + url.PathEscape(e)
+	}
+	return p
+}
+
+// GetDigitalTwin retrieves the digital twin of the named device.
+func (c *Client) GetDigitalTwin(ctx context.Context, deviceID string) (*DigitalTwin, error) {
+	if deviceID == "" {
+		return nil, errors.New("deviceID is empty")
+	}
+	t := &DigitalTwin{}
+	h, err := c.request(ctx, http.MethodGet,
+		digitalTwinPath(deviceID)+"?api-version="+digitalTwinAPIVersion, nil, nil, &t.Properties,
+	)
+	if err != nil {
+		return nil, err
+	}
+	t.ETag = h.Get("ETag")
+	return t, nil
+}
+
+// UpdateDigitalTwin applies the JSON Patch operations to the digital twin
+// of the named device unconditionally, pass the ETag of the retrieved
+// digital twin with WithIfMatch to update it only if it hasn't changed.
+func (c *Client) UpdateDigitalTwin(
+	ctx context.Context,
+	deviceID string,
+	ops []*PatchOperation,
+	opts ...UpdateOption,
+) error {
+	if deviceID == "" {
+		return errors.New("deviceID is empty")
+	}
+	if len(ops) == 0 {
+		return errors.New("patch is empty")
+	}
+	h, err := precondition("*", opts)
+	if err != nil {
+		return err
+	}
+	return c.call(ctx, http.MethodPatch,
+		digitalTwinPath(deviceID)+"?api-version="+digitalTwinAPIVersion, h, ops, nil,
+	)
+}
+
+// InvokeCommand invokes the named root command of the digital twin,
+// connect and response timeouts can be set with CallOption.
+func (c *Client) InvokeCommand(
+	ctx context.Context,
+	deviceID string,
+	commandName string,
+	payload interface{},
+	opts ...CallOption,
+) (*CommandResult, error) {
+	return c.InvokeComponentCommand(ctx, deviceID, "", commandName, payload, opts...)
+}
+
+// InvokeComponentCommand invokes the named command of the digital
+// twin component, blank componentName invokes a root command.
+func (c *Client) InvokeComponentCommand(
+	ctx context.Context,
+	deviceID string,
+	componentName string,
+	commandName string,
+	payload interface{},
+	opts ...CallOption,
+) (*CommandResult, error) {
+	if deviceID == "" {
+		return nil, errors.New("deviceID is empty")
+	}
+	if commandName == "" {
+		return nil, errors.New("commandName is empty")
+	}
+
+	m := &MethodCall{}
+	for _, opt := range opts {
+		if err := opt(m); err != nil {
+			return nil, err
+		}
+	}
+	q := url.Values{"api-version": {digitalTwinAPIVersion}}
+	if m.ConnectTimeout != 0 {
+		q.Set("connectTimeoutInSeconds", strconv.Itoa(m.ConnectTimeout))
+	}
+	if m.ResponseTimeout != 0 {
+		q.Set("responseTimeoutInSeconds", strconv.Itoa(m.ResponseTimeout))
+	}
+
+	path := digitalTwinPath(deviceID, "commands", commandName)
+	if componentName != "" {
+		path = digitalTwinPath(deviceID, "components", componentName, "commands", commandName)
+	}
+	var v json.RawMessage
+	h, err := c.request(ctx, http.MethodPost, path+"?"+q.Encode(), nil, payload, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &CommandResult{}
+	if r.Status, err = strconv.Atoi(h.Get("x-ms-command-statuscode")); err != nil {
+		return nil, errors.New("command status code is missing")
+	}
+	if err = json.Unmarshal(v, &r.Payload); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
@@ -0,0 +1,119 @@
+package iotservice
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestGetDigitalTwin(t *testing.T) {
+	t.Parallel()
+
+	c, s := newTestClient(t, "")
+	s.respond(func(w http.ResponseWriter, n int) {
+		w.Header().Set("ETag", `"abc"`)
+		_, _ = w.Write([]byte(`{"$dtId":"dev","$metadata":{"$model":"dtmi:com:example:Thermostat;1"}}`))
+	})
+	twin, err := c.GetDigitalTwin(context.Background(), "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if twin.ETag != `"abc"` || twin.ID() != "dev" || twin.ModelID() != "dtmi:com:example:Thermostat;1" {
+		t.Errorf("GetDigitalTwin() = %q %q %q", twin.ETag, twin.ID(), twin.ModelID())
+	}
+	r := s.last(t)
+	if r.Method != http.MethodGet || r.Path != "/digitaltwins/dev" || r.Query != "api-version="+digitalTwinAPIVersion {
+		t.Errorf("request = %s %s?%s", r.Method, r.Path, r.Query)
+	}
+}
+
+func TestUpdateDigitalTwin(t *testing.T) {
+	t.Parallel()
+
+	c, s := newTestClient(t, "")
+	if err := c.UpdateDigitalTwin(context.Background(), "dev", []*PatchOperation{
+		{Op: "add", Path: "/thermostat1/targetTemperature", Value: 42},
+	}, WithIfMatch(`"abc"`)); err != nil {
+		t.Fatal(err)
+	}
+	r := s.last(t)
+	if r.Method != http.MethodPatch || r.Path != "/digitaltwins/dev" || r.Query != "api-version="+digitalTwinAPIVersion {
+		t.Errorf("request = %s %s?%s", r.Method, r.Path, r.Query)
+	}
+	if g := r.Header.Get("If-Match"); g != `"abc"` {
+		t.Errorf("If-Match = %q, want %q", g, `"abc"`)
+	}
+	if want := `[{"op":"add","path":"/thermostat1/targetTemperature","value":42}]`; r.Body != want {
+		t.Errorf("body = %s, want %s", r.Body, want)
+	}
+
+	if err := c.UpdateDigitalTwin(context.Background(), "dev", nil); err == nil {
+		t.Error("UpdateDigitalTwin() with empty patch = nil error")
+	}
+}
+
+func TestInvokeComponentCommand(t *testing.T) {
+	t.Parallel()
+
+	c, s := newTestClient(t, "")
+	s.respond(func(w http.ResponseWriter, n int) {
+		if n == 0 {
+			w.Header().Set("x-ms-command-statuscode", "200")
+		}
+		_, _ = w.Write([]byte(`{"ok":true}`))
+	})
+	res, err := c.InvokeComponentCommand(context.Background(), "dev", "thermostat1", "reboot",
+		map[string]interface{}{"delay": 1}, WithCallConnectTimeout(5), WithCallResponseTimeout(10),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != 200 {
+		t.Errorf("Status = %d, want 200", res.Status)
+	}
+	if v, _ := res.Payload.(map[string]interface{}); v["ok"] != true {
+		t.Errorf("Payload = %v", res.Payload)
+	}
+	r := s.last(t)
+	if r.Method != http.MethodPost || r.Path != "/digitaltwins/dev/components/thermostat1/commands/reboot" {
+		t.Errorf("request = %s %s", r.Method, r.Path)
+	}
+	if want := "api-version=" + digitalTwinAPIVersion +
+		"&connectTimeoutInSeconds=5&responseTimeoutInSeconds=10"; r.Query != want {
+		t.Errorf("query = %s, want %s", r.Query, want)
+	}
+	if r.Body != `{"delay":1}` {
+		t.Errorf("body = %s", r.Body)
+	}
+
+	// root commands have no component and the status code is required
+	if _, err = c.InvokeCommand(context.Background(), "dev", "reboot", nil); err == nil {
+		t.Error("InvokeCommand() without status code = nil error")
+	}
+	if r = s.last(t); r.Path != "/digitaltwins/dev/commands/reboot" {
+		t.Errorf("path = %s", r.Path)
+	}
+}
+
+func TestDigitalTwinPath(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		id   string
+		elem []string
+		want string
+	}{
+		{"dev", nil, "digitaltwins/dev"},
+		{"dev/1", []string{"components", "a b", "commands", "reboot"},
+			"digitaltwins/dev%2F1/components/a%20b/commands/reboot"},
+	} {
+		if g := digitalTwinPath(tc.id, tc.elem...); g != tc.want {
+			t.Errorf("digitalTwinPath(%q, %q) = %q, want %q", tc.id, tc.elem, g, tc.want)
+		}
+	}
+
+	c, _ := newTestClient(t, "{}")
+	if _, err := c.GetDigitalTwin(context.Background(), ""); err == nil {
+		t.Error("GetDigitalTwin() with empty device id = nil error")
+	}
+}
@@ -0,0 +1,307 @@
+package iotservice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/common/commonamqp"
+	"github.com/goautomotive/iothub/eventhub"
+	"pack.ag/amqp"
+)
+
+// EventPosition is a position in a partition to start receiving events from.
+type EventPosition struct {
+	selector string
+}
+
+// EventsFromStart receives all events retained by the hub.
+func EventsFromStart() EventPosition {
+	return EventPosition{eventhub.OffsetSelector(eventhub.StartOfStream, false)}
+}
+
+// EventsFromLatest receives only events enqueued after the receiver is open.
+func EventsFromLatest() EventPosition {
+	return EventPosition{eventhub.OffsetSelector(eventhub.EndOfStream, false)}
+}
+
+// EventsFromOffset receives events following the one at the given offset,
+// that's a way to resume from a processed event, see Event.Offset.
+func EventsFromOffset(offset string) EventPosition {
+	if offset == "" {
+		panic("offset is empty")
+	}
+	return EventPosition{eventhub.OffsetSelector(offset, false)}
+}
+
+// EventsFromEnqueuedTime receives events enqueued after t.
+func EventsFromEnqueuedTime(t time.Time) EventPosition {
+	return EventPosition{eventhub.EnqueuedTimeSelector(t)}
+}
+
+// ConsumerOption is an event consumer option.
+type ConsumerOption func(c *EventConsumer) error
+
+// WithConsumerGroup sets the consumer group, defaults to $Default.
+func WithConsumerGroup(name string) ConsumerOption {
+	return func(c *EventConsumer) error {
+		if name == "" {
+			return errors.New("consumer group is empty")
+		}
+		c.group = name
+		return nil
+	}
+}
+
+// WithConsumerPosition sets the position all partitions are read from,
+// defaults to EventsFromLatest.
+func WithConsumerPosition(p EventPosition) ConsumerOption {
+	return func(c *EventConsumer) error {
+		c.position = p
+		return nil
+	}
+}
+
+// WithConsumerPartitionPosition overrides the position of the named partition.
+func WithConsumerPartitionPosition(partitionID string, p EventPosition) ConsumerOption {
+	return func(c *EventConsumer) error {
+		if c.positions == nil {
+			c.positions = map[string]EventPosition{}
+		}
+		c.positions[partitionID] = p
+		return nil
+	}
+}
+
+// WithConsumerBuffer sets capacity of partition channels, defaults to 10.
+func WithConsumerBuffer(n int) ConsumerOption {
+	return func(c *EventConsumer) error {
+		if n < 0 {
+			return fmt.Errorf("buffer size %d is negative", n)
+		}
+		c.buffer = n
+		return nil
+	}
+}
+
+// Event is a device-to-cloud message with its position in the partition.
+type Event struct {
+	*common.Message
+
+	PartitionID    string
+	Offset         string
+	SequenceNumber int64
+}
+
+// EventConsumer reads device-to-cloud messages from the hub's built-in
+// Event Hub-compatible endpoint, each partition is read independently.
+type EventConsumer struct {
+	group     string
+	position  EventPosition
+	positions map[string]EventPosition
+	buffer    int
+
+	c     *Client
+	conn  *amqp.Client
+	sess  *amqp.Session
+	name  string   // event hub name
+	ids   []string // partition ids
+	parts []*PartitionReceiver
+	done  chan struct{}
+	once  sync.Once
+}
+
+// NewEventConsumer opens receivers on all partitions of the events endpoint,
+// the consumer has its own connection and has to be closed separately.
+//
+// The hub allows up to 5 concurrent receivers per partition in a consumer group.
+func (c *Client) NewEventConsumer(ctx context.Context, opts ...ConsumerOption) (*EventConsumer, error) {
+	ec, err := c.dialEvents(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ec.ids {
+		p, err := ec.open(id, ec.startPosition(id))
+		if err != nil {
+			ec.Close()
+			return nil, err
+		}
+		ec.parts = append(ec.parts, p)
+	}
+	return ec, nil
+}
+
+// dialEvents connects to the events endpoint without opening any partitions.
+func (c *Client) dialEvents(ctx context.Context, opts []ConsumerOption) (*EventConsumer, error) {
+	ec := &EventConsumer{
+		group:    "$Default",
+		position: EventsFromLatest(),
+		buffer:   10,
+		c:        c,
+		done:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		if err := opt(ec); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, name, err := c.connectToEventHub(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := conn.NewSession()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ids, err := eventhub.PartitionIDs(ctx, sess, name)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ec.conn, ec.sess, ec.name, ec.ids = conn, sess, name, ids
+	return ec, nil
+}
+
+// partitionIDs returns ids of all partitions.
+func (ec *EventConsumer) partitionIDs() []string {
+	return ec.ids
+}
+
+// startPosition returns the configured position of the named partition.
+func (ec *EventConsumer) startPosition(id string) EventPosition {
+	if pos, ok := ec.positions[id]; ok {
+		return pos
+	}
+	return ec.position
+}
+
+// open opens a receiver on the named partition.
+func (ec *EventConsumer) open(id string, pos EventPosition) (*PartitionReceiver, error) {
+	recv, err := ec.sess.NewReceiver(
+		amqp.LinkSourceAddress(fmt.Sprintf("/%s/ConsumerGroups/%s/Partitions/%s", ec.name, ec.group, id)),
+		amqp.LinkSelectorFilter(pos.selector),
+	)
+	if err != nil {
+		return nil, err
+	}
+	p := &PartitionReceiver{
+		id:   id,
+		ch:   make(chan *Event, ec.buffer),
+		quit: make(chan struct{}),
+	}
+	go p.receive(recv, ec.done, ec.c.add)
+	return p, nil
+}
+
+// Partitions returns receivers of all partitions.
+func (ec *EventConsumer) Partitions() []*PartitionReceiver {
+	return ec.parts
+}
+
+// Close closes all receivers and the connection.
+func (ec *EventConsumer) Close() error {
+	var err error
+	ec.once.Do(func() {
+		close(ec.done)
+		err = ec.conn.Close()
+	})
+	return err
+}
+
+// PartitionReceiver receives events from a single partition in order.
+type PartitionReceiver struct {
+	id   string
+	ch   chan *Event
+	err  error
+	quit chan struct{}
+	once sync.Once
+}
+
+// ID returns the partition id.
+func (p *PartitionReceiver) ID() string {
+	return p.id
+}
+
+// C returns events channel, it's closed when the receiver fails or
+// the consumer is closed, the reason is available with Err.
+func (p *PartitionReceiver) C() <-chan *Event {
+	return p.ch
+}
+
+// Err is the receiver failure reason, it must be called only after C is closed.
+func (p *PartitionReceiver) Err() error {
+	return p.err
+}
+
+// close stops receiving and closes the partition link.
+func (p *PartitionReceiver) close() {
+	p.once.Do(func() {
+		close(p.quit)
+	})
+}
+
+func (p *PartitionReceiver) receive(recv *amqp.Receiver, done chan struct{}, add func(string)) {
+	defer close(p.ch)
+	defer recv.Close(context.Background())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-done:
+		case <-p.quit:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+
+	for {
+		msg, err := recv.Receive(ctx)
+		if err != nil {
+			if p.closed(done) {
+				err = ErrClosed
+			}
+			p.err = err
+			return
+		}
+		msg.Accept()
+		add(common.MetricMessagesReceived)
+
+		select {
+		case p.ch <- p.event(msg):
+		case <-done:
+			p.err = ErrClosed
+			return
+		case <-p.quit:
+			p.err = ErrClosed
+			return
+		}
+	}
+}
+
+// closed reports whether the receiver or the consumer is closed.
+func (p *PartitionReceiver) closed(done chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	case <-p.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *PartitionReceiver) event(msg *amqp.Message) *Event {
+	e := &Event{
+		Message:     commonamqp.FromAMQPMessage(msg),
+		PartitionID: p.id,
+	}
+	e.Offset, _ = msg.Annotations["x-opt-offset"].(string)
+	e.SequenceNumber, _ = msg.Annotations["x-opt-sequence-number"].(int64)
+	return e
+}
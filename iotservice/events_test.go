@@ -0,0 +1,81 @@
+package iotservice
+
+import (
+	"testing"
+	"time"
+
+	"pack.ag/amqp"
+)
+
+func TestEventPosition(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		pos  EventPosition
+		want string
+	}{
+		{EventsFromStart(), "amqp.annotation.x-opt-offset > '-1'"},
+		{EventsFromLatest(), "amqp.annotation.x-opt-offset > '@latest'"},
+		{EventsFromOffset("42"), "amqp.annotation.x-opt-offset > '42'"},
+		{EventsFromEnqueuedTime(time.Unix(1, 5e8)), "amqp.annotation.x-opt-enqueuedtimeutc > '1500'"},
+	} {
+		if tc.pos.selector != tc.want {
+			t.Errorf("selector = %q, want %q", tc.pos.selector, tc.want)
+		}
+	}
+}
+
+func TestPartitionReceiverEvent(t *testing.T) {
+	t.Parallel()
+
+	p := &PartitionReceiver{id: "3"}
+	e := p.event(&amqp.Message{
+		Data: [][]byte{[]byte("hello")},
+		Annotations: amqp.Annotations{
+			"x-opt-offset":          "1024",
+			"x-opt-sequence-number": int64(7),
+		},
+	})
+	if e.PartitionID != "3" || e.Offset != "1024" || e.SequenceNumber != 7 {
+		t.Errorf("event() = %q %q %d, want 3 1024 7", e.PartitionID, e.Offset, e.SequenceNumber)
+	}
+	if string(e.Payload) != "hello" {
+		t.Errorf("Payload = %q, want hello", e.Payload)
+	}
+}
+
+func TestConsumerOptions(t *testing.T) {
+	t.Parallel()
+
+	ec := &EventConsumer{group: "$Default", position: EventsFromLatest()}
+	for _, opt := range []ConsumerOption{
+		WithConsumerGroup("backend"),
+		WithConsumerPosition(EventsFromStart()),
+		WithConsumerPartitionPosition("1", EventsFromOffset("42")),
+		WithConsumerBuffer(0),
+	} {
+		if err := opt(ec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ec.group != "backend" || ec.buffer != 0 {
+		t.Errorf("group, buffer = %q, %d, want backend, 0", ec.group, ec.buffer)
+	}
+	for id, want := range map[string]EventPosition{
+		"0": EventsFromStart(),
+		"1": EventsFromOffset("42"),
+	} {
+		if got := ec.startPosition(id); got != want {
+			t.Errorf("partition %s position = %q, want %q", id, got.selector, want.selector)
+		}
+	}
+
+	for _, opt := range []ConsumerOption{
+		WithConsumerGroup(""),
+		WithConsumerBuffer(-1),
+	} {
+		if err := opt(ec); err == nil {
+			t.Error("invalid option error = nil, want an error")
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package iotservice
+
+import "context"
+
+// MethodInvoker invokes direct methods, applications can depend
+// on it instead of *Client to use a mock in tests, see iothubtest.
+type MethodInvoker interface {
+	Call(
+		ctx context.Context,
+		deviceID string,
+		methodName string,
+		payload map[string]interface{},
+		opts ...CallOption,
+	) (*Result, error)
+	CallModule(
+		ctx context.Context,
+		deviceID, moduleID string,
+		methodName string,
+		payload map[string]interface{},
+		opts ...CallOption,
+	) (*Result, error)
+}
+
+// RegistryManager manages device identities.
+type RegistryManager interface {
+	GetDevice(ctx context.Context, deviceID string) (*Device, error)
+	CreateDevice(ctx context.Context, device *Device) (*Device, error)
+	UpdateDevice(ctx context.Context, device *Device, opts ...UpdateOption) (*Device, error)
+	DeleteDevice(ctx context.Context, deviceID string) error
+	ListDevices(ctx context.Context) ([]*Device, error)
+}
+
+var (
+	_ MethodInvoker   = (*Client)(nil)
+	_ RegistryManager = (*Client)(nil)
+)
@@ -0,0 +1,147 @@
+package iotservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/goautomotive/iothub/common"
+)
+
+// Device connection states.
+const (
+	ConnectionStateConnected    = "Connected"
+	ConnectionStateDisconnected = "Disconnected"
+)
+
+// ConnectionState is the device presence as it's seen by the hub.
+type ConnectionState struct {
+	DeviceID         string
+	Connected        bool
+	UpdatedTime      time.Time // when the state changed last time
+	LastActivityTime time.Time
+}
+
+// GetConnectionState retrieves the named device connection state,
+// it's updated by the hub with a delay, see lifecycle events for
+// the real-time presence tracking.
+func (c *Client) GetConnectionState(ctx context.Context, deviceID string) (*ConnectionState, error) {
+	d, err := c.GetDevice(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	return &ConnectionState{
+		DeviceID:         d.DeviceID,
+		Connected:        d.ConnectionState == ConnectionStateConnected,
+		UpdatedTime:      parseRegistryTime(d.ConnectionStateUpdatedTime),
+		LastActivityTime: parseRegistryTime(d.LastActivityTime),
+	}, nil
+}
+
+// parseRegistryTime parses registry timestamps, that are zero
+// when an event never happened, e.g. 0001-01-01T00:00:00.
+func parseRegistryTime(s string) time.Time {
+	for _, layout := range []string{
+		time.RFC3339Nano,
+		"2006-01-02T15:04:05.999999999",
+	} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Notification message schemas.
+const (
+	SchemaDeviceLifecycle = "deviceLifecycleNotification"
+	SchemaTwinChange      = "twinChangeNotification"
+	SchemaConnectionState = "deviceConnectionStateNotification"
+)
+
+// Notification operation types.
+const (
+	OpCreateDeviceIdentity = "createDeviceIdentity"
+	OpDeleteDeviceIdentity = "deleteDeviceIdentity"
+	OpUpdateTwin           = "updateTwin"
+	OpReplaceTwin          = "replaceTwin"
+	OpDeviceConnected      = "deviceConnected"
+	OpDeviceDisconnected   = "deviceDisconnected"
+)
+
+// LifecycleEvent is a device lifecycle, twin change or connection state
+// notification routed to the events endpoint, that needs adding the
+// corresponding message routes to the hub.
+type LifecycleEvent struct {
+	Schema        string
+	OpType        string
+	HubName       string
+	DeviceID      string
+	ModuleID      string // blank for device events
+	OperationTime time.Time
+
+	// Body is the twin for lifecycle and twin change events,
+	// that's a patch when OpType is OpUpdateTwin.
+	Body map[string]interface{}
+}
+
+// errNotLifecycle means a message is a regular device-to-cloud message.
+var errNotLifecycle = errors.New("not a lifecycle event")
+
+// ParseLifecycleEvent decodes msg into a lifecycle event, it fails when
+// msg is a regular device-to-cloud message, see IsLifecycleEvent.
+func ParseLifecycleEvent(msg *common.Message) (*LifecycleEvent, error) {
+	if !IsLifecycleEvent(msg) {
+		return nil, errNotLifecycle
+	}
+	e := &LifecycleEvent{
+		Schema:   msg.Properties["iothub-message-schema"],
+		OpType:   msg.Properties["opType"],
+		HubName:  msg.Properties["hubName"],
+		DeviceID: msg.Properties["deviceId"],
+		ModuleID: msg.Properties["moduleId"],
+	}
+	if s := msg.Properties["operationTimestamp"]; s != "" {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, err
+		}
+		e.OperationTime = t
+	}
+	if len(msg.Payload) != 0 {
+		if err := json.Unmarshal(msg.Payload, &e.Body); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// IsLifecycleEvent reports whether msg is a hub notification.
+func IsLifecycleEvent(msg *common.Message) bool {
+	switch msg.Properties["iothub-message-schema"] {
+	case SchemaDeviceLifecycle, SchemaTwinChange, SchemaConnectionState:
+		return true
+	default:
+		return false
+	}
+}
+
+// LifecycleHandler handles lifecycle events.
+type LifecycleHandler func(e *LifecycleEvent)
+
+// SubscribeLifecycleEvents is same as SubscribeEvents but it delivers
+// only lifecycle, twin change and connection state notifications.
+func (c *Client) SubscribeLifecycleEvents(ctx context.Context, fn LifecycleHandler) error {
+	return c.SubscribeEvents(ctx, func(msg *common.Message) {
+		if !IsLifecycleEvent(msg) {
+			return
+		}
+		e, err := ParseLifecycleEvent(msg)
+		if err != nil {
+			c.logf(common.LevelWarn, common.ComponentClient, "malformed lifecycle event: %s", err)
+			return
+		}
+		fn(e)
+	})
+}
@@ -0,0 +1,104 @@
+package iotservice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/goautomotive/iothub/common"
+)
+
+func TestParseLifecycleEvent(t *testing.T) {
+	t.Parallel()
+
+	msg := &common.Message{
+		Payload: []byte(`{"properties":{"desired":{"a":1}}}`),
+		Properties: map[string]string{
+			"iothub-message-schema": SchemaTwinChange,
+			"opType":                OpUpdateTwin,
+			"hubName":               "hub",
+			"deviceId":              "dev",
+			"moduleId":              "mod",
+			"operationTimestamp":    "2020-01-02T03:04:05.5Z",
+		},
+	}
+	if !IsLifecycleEvent(msg) {
+		t.Fatal("IsLifecycleEvent() = false")
+	}
+	e, err := ParseLifecycleEvent(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Schema != SchemaTwinChange || e.OpType != OpUpdateTwin ||
+		e.HubName != "hub" || e.DeviceID != "dev" || e.ModuleID != "mod" {
+		t.Errorf("ParseLifecycleEvent() = %+v", e)
+	}
+	if want := time.Date(2020, 1, 2, 3, 4, 5, 5e8, time.UTC); !e.OperationTime.Equal(want) {
+		t.Errorf("OperationTime = %s, want %s", e.OperationTime, want)
+	}
+	if _, ok := e.Body["properties"]; !ok {
+		t.Errorf("Body = %v", e.Body)
+	}
+
+	msg = &common.Message{Payload: []byte("{}"), Properties: map[string]string{}}
+	if IsLifecycleEvent(msg) {
+		t.Error("IsLifecycleEvent() = true for a device-to-cloud message")
+	}
+	if _, err = ParseLifecycleEvent(msg); err != errNotLifecycle {
+		t.Errorf("ParseLifecycleEvent() = %v, want %v", err, errNotLifecycle)
+	}
+}
+
+func TestGetConnectionState(t *testing.T) {
+	t.Parallel()
+
+	c, s := newTestClient(t, `{"deviceId":"dev","connectionState":"Connected",`+
+		`"connectionStateUpdatedTime":"2020-01-02T03:04:05.123","lastActivityTime":"0001-01-01T00:00:00"}`)
+	v, err := c.GetConnectionState(context.Background(), "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.DeviceID != "dev" || !v.Connected {
+		t.Errorf("GetConnectionState() = %+v", v)
+	}
+	if want := time.Date(2020, 1, 2, 3, 4, 5, 123e6, time.UTC); !v.UpdatedTime.Equal(want) {
+		t.Errorf("UpdatedTime = %s, want %s", v.UpdatedTime, want)
+	}
+	if !v.LastActivityTime.IsZero() {
+		t.Errorf("LastActivityTime = %s, want zero", v.LastActivityTime)
+	}
+	if r := s.last(t); r.Path != "/devices/dev" {
+		t.Errorf("path = %s, want /devices/dev", r.Path)
+	}
+}
+
+func TestParseLifecycleEventConnectionState(t *testing.T) {
+	t.Parallel()
+
+	props := func(ts string) map[string]string {
+		return map[string]string{
+			"iothub-message-schema": SchemaConnectionState,
+			"opType":                OpDeviceDisconnected,
+			"deviceId":              "dev",
+			"operationTimestamp":    ts,
+		}
+	}
+
+	// connection state notifications may come without a body
+	e, err := ParseLifecycleEvent(&common.Message{Properties: props("2020-01-02T03:04:05Z")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.OpType != OpDeviceDisconnected || e.DeviceID != "dev" || e.ModuleID != "" || e.Body != nil {
+		t.Errorf("ParseLifecycleEvent() = %+v", e)
+	}
+
+	for name, msg := range map[string]*common.Message{
+		"timestamp": {Properties: props("yesterday")},
+		"body":      {Payload: []byte("{"), Properties: props("")},
+	} {
+		if _, err := ParseLifecycleEvent(msg); err == nil {
+			t.Errorf("ParseLifecycleEvent() with malformed %s = nil, want an error", name)
+		}
+	}
+}
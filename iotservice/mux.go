@@ -0,0 +1,411 @@
+package iotservice
+
+import (
+	"context"
+	"sync"
+
+	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/common/commonamqp"
+	"github.com/goautomotive/iothub/eventhub"
+	"pack.ag/amqp"
+)
+
+// linkSub is a linkMux subscription.
+type linkSub interface {
+	// deliver queues a decoded value for the subscription without
+	// blocking, ack is called once it's consumed or dropped.
+	deliver(v interface{}, ack func())
+
+	// shutdown makes the subscription fail with err and closes its channel.
+	shutdown(err error)
+}
+
+// linkMux receives messages from the named AMQP link and dispatches
+// decoded values to all subscriptions, the link is open while there
+// are any, messages received with no subscriptions are lost.
+type linkMux struct {
+	c      *Client
+	addr   string
+	decode func(msg *amqp.Message) ([]interface{}, error)
+
+	mu   sync.Mutex
+	subs []linkSub
+	done chan struct{} // stops receiving, nil when the link is closed
+}
+
+func (m *linkMux) sub(ctx context.Context, s linkSub) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.done == nil {
+		recv, conn, err := m.open(ctx)
+		if err != nil {
+			return err
+		}
+		m.done = make(chan struct{})
+		go m.receive(recv, conn, m.done)
+	}
+	m.subs = append(m.subs, s)
+	return nil
+}
+
+func (m *linkMux) unsub(s linkSub) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, ss := range m.subs {
+		if ss == s {
+			m.subs = append(m.subs[:i], m.subs[i+1:]...)
+			break
+		}
+	}
+	if len(m.subs) == 0 && m.done != nil {
+		close(m.done)
+		m.done = nil
+	}
+}
+
+// open opens the link on the live connection.
+func (m *linkMux) open(ctx context.Context) (*amqp.Receiver, *eventhub.Client, error) {
+	conn, err := m.c.amqpConn(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	recv, err := conn.Sess().NewReceiver(
+		amqp.LinkSourceAddress(m.addr),
+	)
+	if err != nil {
+		return nil, conn, err
+	}
+	return recv, conn, nil
+}
+
+// reopen re-opens the link lost because of cause, re-establishing the
+// connection when it's broken, until it succeeds or the link is closed.
+func (m *linkMux) reopen(ctx context.Context, conn *eventhub.Client, cause error) (
+	*amqp.Receiver, *eventhub.Client, error,
+) {
+	m.c.logf(common.LevelWarn, common.ComponentMux, "%s: link lost: %s", m.addr, cause)
+	b := m.c.backoff()
+	for {
+		if conn != nil && commonamqp.IsConnError(cause) {
+			m.c.resetAMQP(conn, cause)
+		}
+		if !m.c.wait(ctx, b) {
+			return nil, nil, ErrClosed
+		}
+		m.c.dispatchState(AMQPReconnecting, cause)
+		m.c.add(common.MetricReconnects)
+
+		recv, c, err := m.open(ctx)
+		if err == nil {
+			m.c.logf(common.LevelInfo, common.ComponentMux, "%s: link restored", m.addr)
+			return recv, c, nil
+		}
+		if !recoverable(err) {
+			return nil, nil, err
+		}
+		conn, cause = c, err
+	}
+}
+
+func (m *linkMux) receive(recv *amqp.Receiver, conn *eventhub.Client, done chan struct{}) {
+	defer func() {
+		if recv != nil {
+			recv.Close(context.Background())
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-done:
+		case <-m.c.done:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+
+	for {
+		msg, err := recv.Receive(ctx)
+		if err != nil && !m.c.closed() && recoverable(err) {
+			recv.Close(context.Background())
+			recv, conn, err = m.reopen(ctx, conn, err)
+			if err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			if m.c.closed() {
+				err = ErrClosed
+			}
+			m.fail(done, err)
+			return
+		}
+
+		vs, err := m.decode(msg)
+		if err != nil {
+			m.c.logf(common.LevelWarn, common.ComponentMux, "%s: malformed message: %s", m.addr, err)
+			msg.Accept()
+			continue
+		}
+		m.mu.Lock()
+		subs := append([]linkSub(nil), m.subs...)
+		m.mu.Unlock()
+		dispatch(vs, subs, msg.Accept)
+	}
+}
+
+// dispatch delivers vs to all subs and calls settle
+// when every one of them has consumed or dropped them.
+func dispatch(vs []interface{}, subs []linkSub, settle func()) {
+	n := len(vs) * len(subs)
+	if n == 0 {
+		settle()
+		return
+	}
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for _, v := range vs {
+		for _, s := range subs {
+			s.deliver(v, wg.Done)
+		}
+	}
+	go func() {
+		wg.Wait()
+		settle()
+	}()
+}
+
+// fail shuts down all subscriptions with err unless
+// the link has been closed because nobody listens to it.
+func (m *linkMux) fail(done chan struct{}, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.done != done {
+		return
+	}
+	close(m.done)
+	m.done = nil
+	for _, s := range m.subs {
+		s.shutdown(err)
+	}
+	m.subs = nil
+}
+
+// linkQueue buffers values delivered to a subscription and passes them
+// to its channel in order on its own goroutine, so a slow subscriber
+// never holds up others sharing the link.
+type linkQueue[T any] struct {
+	ch   chan T
+	err  error
+	quit chan struct{} // closed by the subscriber
+	stop chan struct{} // closed by the mux when the link fails
+	once sync.Once
+
+	mu      sync.Mutex
+	pending []queued[T]
+	stopped bool
+	wake    chan struct{}
+}
+
+type queued[T any] struct {
+	v   T
+	ack func()
+}
+
+func newLinkQueue[T any]() *linkQueue[T] {
+	q := &linkQueue[T]{
+		ch:   make(chan T),
+		quit: make(chan struct{}),
+		stop: make(chan struct{}),
+		wake: make(chan struct{}, 1),
+	}
+	go q.run()
+	return q
+}
+
+func (q *linkQueue[T]) push(v T, ack func()) {
+	q.mu.Lock()
+	if q.stopped {
+		q.mu.Unlock()
+		ack()
+		return
+	}
+	q.pending = append(q.pending, queued[T]{v, ack})
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *linkQueue[T]) run() {
+	for {
+		q.mu.Lock()
+		vs := q.pending
+		q.pending = nil
+		q.mu.Unlock()
+		for i, v := range vs {
+			select {
+			case q.ch <- v.v:
+				v.ack()
+			case <-q.quit:
+				q.drop(vs[i:])
+				return
+			case <-q.stop:
+				q.drop(vs[i:])
+				close(q.ch)
+				return
+			}
+		}
+		select {
+		case <-q.wake:
+		case <-q.quit:
+			q.drop(nil)
+			return
+		case <-q.stop:
+			q.drop(nil)
+			close(q.ch)
+			return
+		}
+	}
+}
+
+// drop acknowledges vs and everything still pending
+// and makes further pushes acknowledge right away.
+func (q *linkQueue[T]) drop(vs []queued[T]) {
+	q.mu.Lock()
+	vs = append(vs, q.pending...)
+	q.pending = nil
+	q.stopped = true
+	q.mu.Unlock()
+	for _, v := range vs {
+		v.ack()
+	}
+}
+
+func (q *linkQueue[T]) recv(ctx context.Context) (T, error) {
+	var zero T
+	select {
+	case v, ok := <-q.ch:
+		if !ok {
+			return zero, q.err
+		}
+		return v, nil
+	case <-q.quit:
+		return zero, ErrClosed
+	case <-ctx.Done():
+		return zero, ctx.Err()
+	}
+}
+
+func (q *linkQueue[T]) close() {
+	q.once.Do(func() {
+		close(q.quit)
+	})
+}
+
+func (q *linkQueue[T]) shutdown(err error) {
+	q.err = err
+	close(q.stop)
+}
+
+// FeedbackOption is a feedback subscription option.
+type FeedbackOption func(s *FeedbackSub)
+
+// WithFeedbackMessageIDs delivers only feedback of the messages
+// with the given IDs, that's set with WithSendMessageID.
+func WithFeedbackMessageIDs(ids ...string) FeedbackOption {
+	return func(s *FeedbackSub) {
+		if s.ids == nil {
+			s.ids = make(map[string]bool, len(ids))
+		}
+		for _, id := range ids {
+			s.ids[id] = true
+		}
+	}
+}
+
+// FeedbackSub is a feedback subscription.
+type FeedbackSub struct {
+	q   *linkQueue[*Feedback]
+	ids map[string]bool
+	mux *linkMux
+}
+
+// C returns feedback channel, it's closed when the subscription fails,
+// the reason is available with Err.
+func (s *FeedbackSub) C() <-chan *Feedback {
+	return s.q.ch
+}
+
+// Err is the subscription failure reason, it must be called only after C is closed.
+func (s *FeedbackSub) Err() error {
+	return s.q.err
+}
+
+// Recv waits for the next feedback, it returns ErrClosed
+// when the subscription or the client is closed.
+func (s *FeedbackSub) Recv(ctx context.Context) (*Feedback, error) {
+	return s.q.recv(ctx)
+}
+
+// Close unsubscribes, the feedback link is closed
+// when there are no subscriptions left.
+func (s *FeedbackSub) Close() error {
+	s.q.close()
+	s.mux.unsub(s)
+	return nil
+}
+
+func (s *FeedbackSub) deliver(v interface{}, ack func()) {
+	f := v.(*Feedback)
+	if s.ids != nil && !s.ids[f.OriginalMessageID] {
+		ack()
+		return
+	}
+	s.q.push(f, ack)
+}
+
+func (s *FeedbackSub) shutdown(err error) {
+	s.q.shutdown(err)
+}
+
+// FileNotificationSub is a file upload notifications subscription.
+type FileNotificationSub struct {
+	q   *linkQueue[*FileNotification]
+	mux *linkMux
+}
+
+// C returns notifications channel, it's closed when the subscription fails,
+// the reason is available with Err.
+func (s *FileNotificationSub) C() <-chan *FileNotification {
+	return s.q.ch
+}
+
+// Err is the subscription failure reason, it must be called only after C is closed.
+func (s *FileNotificationSub) Err() error {
+	return s.q.err
+}
+
+// Recv waits for the next notification, it returns ErrClosed
+// when the subscription or the client is closed.
+func (s *FileNotificationSub) Recv(ctx context.Context) (*FileNotification, error) {
+	return s.q.recv(ctx)
+}
+
+// Close unsubscribes, the notifications link is closed
+// when there are no subscriptions left.
+func (s *FileNotificationSub) Close() error {
+	s.q.close()
+	s.mux.unsub(s)
+	return nil
+}
+
+func (s *FileNotificationSub) deliver(v interface{}, ack func()) {
+	s.q.push(v.(*FileNotification), ack)
+}
+
+func (s *FileNotificationSub) shutdown(err error) {
+	s.q.shutdown(err)
+}
@@ -0,0 +1,123 @@
+package iotservice
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"pack.ag/amqp"
+)
+
+func TestDispatch(t *testing.T) {
+	t.Parallel()
+
+	slow := &FeedbackSub{q: newLinkQueue[*Feedback]()}
+	fast := &FeedbackSub{q: newLinkQueue[*Feedback]()}
+	defer slow.q.close()
+	defer fast.q.close()
+
+	settled := make(chan struct{})
+	vs := []interface{}{
+		&Feedback{OriginalMessageID: "1"},
+		&Feedback{OriginalMessageID: "2"},
+	}
+	dispatch(vs, []linkSub{slow, fast}, func() { close(settled) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, want := range []string{"1", "2"} {
+		f, err := fast.Recv(ctx)
+		if err != nil {
+			t.Fatalf("fast subscriber is blocked by the slow one: %v", err)
+		}
+		if f.OriginalMessageID != want {
+			t.Errorf("OriginalMessageID = %q, want %q", f.OriginalMessageID, want)
+		}
+	}
+	select {
+	case <-settled:
+		t.Fatal("message is settled before all subscribers consumed it")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := slow.Recv(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case <-settled:
+	case <-ctx.Done():
+		t.Fatal("message is not settled after delivery")
+	}
+}
+
+func TestDispatchDrop(t *testing.T) {
+	t.Parallel()
+
+	filtered := &FeedbackSub{q: newLinkQueue[*Feedback](), ids: map[string]bool{"2": true}}
+	failed := &FeedbackSub{q: newLinkQueue[*Feedback]()}
+	defer filtered.q.close()
+
+	settled := make(chan struct{})
+	dispatch([]interface{}{&Feedback{OriginalMessageID: "1"}}, []linkSub{filtered, failed}, func() {
+		close(settled)
+	})
+
+	select {
+	case <-settled:
+		t.Fatal("message is settled before all subscribers consumed it")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	errLost := errors.New("link lost")
+	failed.shutdown(errLost)
+	select {
+	case <-settled:
+	case <-time.After(time.Second):
+		t.Fatal("message is not settled after the subscription failed")
+	}
+	if _, err := failed.Recv(context.Background()); err != errLost {
+		t.Errorf("Recv() = %v, want %v", err, errLost)
+	}
+
+	// no subscribers
+	ok := false
+	dispatch([]interface{}{&Feedback{}}, nil, func() { ok = true })
+	if !ok {
+		t.Error("message with no subscribers is not settled")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	t.Parallel()
+
+	vs, err := decodeFeedback(&amqp.Message{Data: [][]byte{[]byte(
+		`[{"originalMessageId":"1","statusCode":"Success"},{"originalMessageId":"2","statusCode":"Expired"}]`,
+	)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vs) != 2 || vs[1].(*Feedback).OriginalMessageID != "2" || vs[1].(*Feedback).StatusCode != FeedbackExpired {
+		t.Errorf("decodeFeedback() = %v", vs)
+	}
+
+	if vs, err = decodeFileNotification(&amqp.Message{Data: [][]byte{[]byte(
+		`{"deviceId":"dev","blobName":"dev/file.txt","blobSizeInBytes":42}`,
+	)}}); err != nil {
+		t.Fatal(err)
+	}
+	if n := vs[0].(*FileNotification); len(vs) != 1 || n.DeviceID != "dev" || n.BlobSizeInBytes != 42 {
+		t.Errorf("decodeFileNotification() = %v", vs)
+	}
+
+	for _, msg := range []*amqp.Message{{}, {Data: [][]byte{[]byte("{")}}} {
+		if _, err = decodeFeedback(msg); err == nil {
+			t.Error("decodeFeedback() of a malformed message = nil error")
+		}
+		if _, err = decodeFileNotification(msg); err == nil {
+			t.Error("decodeFileNotification() of a malformed message = nil error")
+		}
+	}
+}
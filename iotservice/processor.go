@@ -0,0 +1,342 @@
+package iotservice
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/goautomotive/iothub/common"
+)
+
+// ProcessorOption is an event processor option.
+type ProcessorOption func(p *EventProcessor)
+
+// WithProcessorOwnerID sets the processor instance identifier,
+// it has to be unique and stable across restarts, e.g. the hostname.
+func WithProcessorOwnerID(id string) ProcessorOption {
+	if id == "" {
+		panic("owner id is empty")
+	}
+	return func(p *EventProcessor) {
+		p.owner = id
+	}
+}
+
+// WithProcessorConsumerOptions sets the underlying consumer options, like
+// the consumer group and the position used for partitions with no checkpoints.
+func WithProcessorConsumerOptions(opts ...ConsumerOption) ProcessorOption {
+	return func(p *EventProcessor) {
+		p.opts = append(p.opts, opts...)
+	}
+}
+
+// WithProcessorBalanceInterval sets how often ownership
+// is renewed and partitions are rebalanced, defaults to 10s.
+func WithProcessorBalanceInterval(d time.Duration) ProcessorOption {
+	if d <= 0 {
+		panic("interval must be positive")
+	}
+	return func(p *EventProcessor) {
+		p.interval = d
+	}
+}
+
+// WithProcessorOwnershipExpiry sets how long claims of a stopped processor
+// are valid before others take its partitions, defaults to 30s.
+func WithProcessorOwnershipExpiry(d time.Duration) ProcessorOption {
+	if d <= 0 {
+		panic("expiry must be positive")
+	}
+	return func(p *EventProcessor) {
+		p.expiry = d
+	}
+}
+
+// EventProcessor consumes events with a number of instances sharing the
+// same checkpoint store, partitions are evenly distributed among them
+// and each partition is resumed from its last checkpoint.
+type EventProcessor struct {
+	c        *Client
+	store    CheckpointStore
+	owner    string
+	opts     []ConsumerOption
+	group    string
+	interval time.Duration
+	expiry   time.Duration
+}
+
+// NewEventProcessor creates a new event processor, see Run.
+func (c *Client) NewEventProcessor(store CheckpointStore, opts ...ProcessorOption) *EventProcessor {
+	if store == nil {
+		panic("store is nil")
+	}
+	p := &EventProcessor{
+		c:        c,
+		store:    store,
+		interval: 10 * time.Second,
+		expiry:   30 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.owner == "" {
+		id, err := NewSymmetricKey() // random enough
+		if err != nil {
+			panic(err)
+		}
+		p.owner = id
+	}
+	return p
+}
+
+// EventHandler processes events sequentially in scope of a partition,
+// but handlers of different partitions are called concurrently.
+// An error returned from the handler stops the processor.
+type EventHandler func(e *Event) error
+
+// Run processes events of claimed partitions until ctx is done or fn
+// fails. Events are delivered at least once, call Checkpoint to save
+// progress, otherwise a partition is reprocessed from the last checkpoint
+// when it's taken by another processor.
+func (p *EventProcessor) Run(ctx context.Context, fn EventHandler) error {
+	if fn == nil {
+		panic("fn is nil")
+	}
+	ec, err := p.c.dialEvents(ctx, p.opts)
+	if err != nil {
+		return err
+	}
+	defer ec.Close()
+	p.group = ec.group
+	return p.run(ctx, ec, fn)
+}
+
+// partitionSource opens partition receivers, it's implemented by EventConsumer.
+type partitionSource interface {
+	partitionIDs() []string
+	startPosition(id string) EventPosition
+	open(id string, pos EventPosition) (*PartitionReceiver, error)
+}
+
+// run is Run that takes partitions from src.
+func (p *EventProcessor) run(ctx context.Context, src partitionSource, fn EventHandler) error {
+	type failure struct {
+		r   *PartitionReceiver
+		err error
+	}
+	failc := make(chan failure)
+	stop := make(chan struct{})
+	owned := map[string]*PartitionReceiver{}
+
+	var wg sync.WaitGroup
+	defer func() {
+		close(stop)
+		for _, r := range owned {
+			r.close()
+		}
+		wg.Wait()
+	}()
+	run := func(r *PartitionReceiver) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := p.process(r, fn)
+			select {
+			case failc <- failure{r, err}:
+			case <-stop:
+			}
+		}()
+	}
+
+	t := time.NewTicker(p.interval)
+	defer t.Stop()
+	for {
+		claimed, err := p.balance(ctx, src.partitionIDs())
+		if err == nil {
+			err = p.apply(ctx, src, owned, claimed, run)
+		}
+		if err != nil {
+			p.c.logf(common.LevelWarn, common.ComponentClient, "partitions balancing failed: %s", err)
+		}
+
+		for waiting := true; waiting; {
+			select {
+			case f := <-failc:
+				var herr *handlerError
+				if errors.As(f.err, &herr) {
+					return herr.err
+				}
+				if f.err != ErrClosed {
+					p.c.logf(common.LevelWarn, common.ComponentClient, "partition %s failed: %s", f.r.ID(), f.err)
+				}
+				// the receiver is reopened on the next balancing
+				if owned[f.r.ID()] == f.r {
+					delete(owned, f.r.ID())
+				}
+			case <-t.C:
+				waiting = false
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// Checkpoint saves the event's position, so processing of its partition
+// is resumed from the next one.
+func (p *EventProcessor) Checkpoint(ctx context.Context, e *Event) error {
+	if e == nil {
+		panic("e is nil")
+	}
+	return p.store.UpdateCheckpoint(ctx, p.group, &Checkpoint{
+		PartitionID:    e.PartitionID,
+		Offset:         e.Offset,
+		SequenceNumber: e.SequenceNumber,
+	})
+}
+
+// handlerError distinguishes handler failures from receiving errors.
+type handlerError struct {
+	err error
+}
+
+func (e *handlerError) Error() string {
+	return e.err.Error()
+}
+
+// process passes events of the partition to fn until it fails.
+func (p *EventProcessor) process(r *PartitionReceiver, fn EventHandler) error {
+	for {
+		select {
+		case e, ok := <-r.C():
+			if !ok {
+				return r.Err()
+			}
+			if err := fn(e); err != nil {
+				r.close()
+				return &handlerError{err}
+			}
+		case <-r.quit:
+			return ErrClosed
+		}
+	}
+}
+
+// apply closes receivers of lost partitions and opens newly claimed
+// ones from their checkpoints, processing them with run.
+func (p *EventProcessor) apply(
+	ctx context.Context,
+	src partitionSource,
+	owned map[string]*PartitionReceiver,
+	claimed map[string]bool,
+	run func(r *PartitionReceiver),
+) error {
+	for id, r := range owned {
+		if !claimed[id] {
+			r.close()
+			delete(owned, id)
+		}
+	}
+
+	var checkpoints map[string]*Checkpoint
+	for id := range claimed {
+		if _, ok := owned[id]; ok {
+			continue
+		}
+		if checkpoints == nil {
+			l, err := p.store.ListCheckpoints(ctx, p.group)
+			if err != nil {
+				return err
+			}
+			checkpoints = make(map[string]*Checkpoint, len(l))
+			for _, c := range l {
+				checkpoints[c.PartitionID] = c
+			}
+		}
+
+		pos := src.startPosition(id)
+		if c, ok := checkpoints[id]; ok && c.Offset != "" {
+			pos = EventsFromOffset(c.Offset)
+		}
+		r, err := src.open(id, pos)
+		if err != nil {
+			return err
+		}
+		owned[id] = r
+		run(r)
+	}
+	return nil
+}
+
+// balance renews claims of owned partitions and claims more partitions
+// until the processor owns its fair share, it returns all claimed partitions.
+func (p *EventProcessor) balance(ctx context.Context, ids []string) (map[string]bool, error) {
+	l, err := p.store.ListOwnership(ctx, p.group)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	known := make(map[string]*Ownership, len(l))
+	active := map[string][]*Ownership{p.owner: nil} // by owner
+	for _, o := range l {
+		known[o.PartitionID] = o
+		if now.Sub(o.LastModified) < p.expiry {
+			active[o.OwnerID] = append(active[o.OwnerID], o)
+		}
+	}
+
+	claims := make([]*Ownership, 0, len(ids))
+	for _, o := range active[p.owner] {
+		claims = append(claims, &Ownership{PartitionID: o.PartitionID, OwnerID: p.owner, ETag: o.ETag})
+	}
+
+	// at most one extra partition per owner when they're not divisible
+	share := len(ids) / len(active)
+	max := share
+	if len(ids)%len(active) != 0 {
+		max++
+	}
+
+	// free and expired partitions first
+	for _, id := range ids {
+		if len(claims) >= max {
+			break
+		}
+		o, ok := known[id]
+		switch {
+		case !ok:
+			claims = append(claims, &Ownership{PartitionID: id, OwnerID: p.owner})
+		case now.Sub(o.LastModified) >= p.expiry:
+			claims = append(claims, &Ownership{PartitionID: id, OwnerID: p.owner, ETag: o.ETag})
+		}
+	}
+
+	// steal a partition from the busiest owner, one per round to avoid thrashing
+	if len(claims) < share {
+		var owners []string
+		for id := range active {
+			if id != p.owner {
+				owners = append(owners, id)
+			}
+		}
+		sort.Slice(owners, func(i, j int) bool {
+			return len(active[owners[i]]) > len(active[owners[j]])
+		})
+		if len(owners) != 0 && len(active[owners[0]]) > max {
+			o := active[owners[0]][0]
+			claims = append(claims, &Ownership{PartitionID: o.PartitionID, OwnerID: p.owner, ETag: o.ETag})
+		}
+	}
+
+	res, err := p.store.ClaimOwnership(ctx, p.group, claims)
+	if err != nil {
+		return nil, err
+	}
+	claimed := make(map[string]bool, len(res))
+	for _, o := range res {
+		claimed[o.PartitionID] = true
+	}
+	return claimed, nil
+}
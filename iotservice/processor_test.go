@@ -0,0 +1,200 @@
+package iotservice
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/goautomotive/iothub/common"
+)
+
+func TestBalance(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ids := []string{"0", "1", "2", "3"}
+	store := NewMemoryCheckpointStore()
+	newProcessor := func(owner string) *EventProcessor {
+		return (&Client{}).NewEventProcessor(store,
+			WithProcessorOwnerID(owner),
+			WithProcessorOwnershipExpiry(time.Hour),
+		)
+	}
+	a, b := newProcessor("a"), newProcessor("b")
+
+	// the first processor takes everything
+	claimed, err := a.balance(ctx, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 4 {
+		t.Fatalf("a claimed %v, want all partitions", claimed)
+	}
+
+	// the second one steals a partition per round until it owns the fair share
+	for i := 1; i <= 3; i++ {
+		if claimed, err = b.balance(ctx, ids); err != nil {
+			t.Fatal(err)
+		}
+		want := i
+		if want > 2 {
+			want = 2
+		}
+		if len(claimed) != want {
+			t.Fatalf("round %d: b claimed %v, want %d partitions", i, claimed, want)
+		}
+	}
+	if claimed, err = a.balance(ctx, ids); err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 2 {
+		t.Fatalf("a claimed %v after rebalancing, want 2 partitions", claimed)
+	}
+
+	// claims of a stopped processor expire
+	a.expiry = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if claimed, err = a.balance(ctx, ids); err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 4 {
+		t.Errorf("a claimed %v after b's claims expired, want all partitions", claimed)
+	}
+}
+
+// testPartitions is a partition source with receivers fed by tests.
+type testPartitions struct {
+	mu     sync.Mutex
+	ids    []string
+	opened map[string]*PartitionReceiver
+	pos    map[string]string // selectors receivers are opened with
+}
+
+func newTestPartitions(ids ...string) *testPartitions {
+	return &testPartitions{ids: ids, opened: map[string]*PartitionReceiver{}, pos: map[string]string{}}
+}
+
+func (s *testPartitions) partitionIDs() []string {
+	return s.ids
+}
+
+func (s *testPartitions) startPosition(string) EventPosition {
+	return EventsFromLatest()
+}
+
+func (s *testPartitions) open(id string, pos EventPosition) (*PartitionReceiver, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := &PartitionReceiver{id: id, ch: make(chan *Event), quit: make(chan struct{})}
+	s.opened[id], s.pos[id] = r, pos.selector
+	return r, nil
+}
+
+// receiver waits until the named partition is opened.
+func (s *testPartitions) receiver(t *testing.T, id string) (*PartitionReceiver, string) {
+	t.Helper()
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		s.mu.Lock()
+		r, pos := s.opened[id], s.pos[id]
+		s.mu.Unlock()
+		if r != nil {
+			return r, pos
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("partition %s is not opened", id)
+		}
+	}
+}
+
+func TestProcessorRun(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	store := NewMemoryCheckpointStore()
+	if err := store.UpdateCheckpoint(ctx, "", &Checkpoint{PartitionID: "1", Offset: "42"}); err != nil {
+		t.Fatal(err)
+	}
+	p := (&Client{}).NewEventProcessor(store, WithProcessorOwnerID("a"))
+	src := newTestPartitions("0", "1")
+
+	errStop := errors.New("stop")
+	events := make(chan *Event, 1)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- p.run(ctx, src, func(e *Event) error {
+			if string(e.Payload) == "stop" {
+				return errStop
+			}
+			if err := p.Checkpoint(ctx, e); err != nil {
+				return err
+			}
+			events <- e
+			return nil
+		})
+	}()
+
+	// partitions without checkpoints start from the configured position
+	r0, pos := src.receiver(t, "0")
+	if want := EventsFromLatest().selector; pos != want {
+		t.Errorf("partition 0 selector = %q, want %q", pos, want)
+	}
+	r1, pos := src.receiver(t, "1")
+	if want := EventsFromOffset("42").selector; pos != want {
+		t.Errorf("partition 1 selector = %q, want %q", pos, want)
+	}
+
+	r0.ch <- &Event{Message: &common.Message{}, PartitionID: "0", Offset: "7"}
+	if e := <-events; e.PartitionID != "0" {
+		t.Errorf("event of partition %s, want 0", e.PartitionID)
+	}
+	l, err := store.ListCheckpoints(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var offset string
+	for _, c := range l {
+		if c.PartitionID == "0" {
+			offset = c.Offset
+		}
+	}
+	if offset != "7" {
+		t.Errorf("partition 0 checkpoint offset = %q, want 7", offset)
+	}
+
+	// a handler failure stops the processor and closes receivers
+	r1.ch <- &Event{Message: &common.Message{Payload: []byte("stop")}, PartitionID: "1"}
+	select {
+	case err := <-errc:
+		if err != errStop {
+			t.Errorf("run() = %v, want %v", err, errStop)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("processor is not stopped")
+	}
+	for _, r := range []*PartitionReceiver{r0, r1} {
+		select {
+		case <-r.quit:
+		default:
+			t.Errorf("partition %s receiver is not closed", r.ID())
+		}
+	}
+}
+
+func TestProcessorRunCancel(t *testing.T) {
+	t.Parallel()
+
+	p := (&Client{}).NewEventProcessor(NewMemoryCheckpointStore())
+	src := newTestPartitions("0")
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- p.run(ctx, src, func(*Event) error { return nil })
+	}()
+	src.receiver(t, "0")
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("run() = %v, want %v", err, context.Canceled)
+	}
+}
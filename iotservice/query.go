@@ -0,0 +1,133 @@
+package iotservice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// QueryOption is a query option.
+type QueryOption func(q *QueryIterator)
+
+// WithQueryPageSize sets the maximum number of rows fetched by
+// one request, the hub's default and maximum is 1000 rows.
+func WithQueryPageSize(n int) QueryOption {
+	if n <= 0 {
+		panic("page size must be positive")
+	}
+	return func(q *QueryIterator) {
+		q.size = n
+	}
+}
+
+// QueryTwins runs the IoT Hub query, following continuation tokens
+// while rows are consumed with the returned iterator:
+//
+//	it := c.QueryTwins(ctx, "SELECT * FROM devices WHERE tags.region = 'eu'")
+//	for it.Next() {
+//		twin, err := it.Twin()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+//
+// Aggregations and projections return arbitrary rows that can be
+// decoded with ScanStruct, queries are not limited to twins, e.g.
+// `SELECT * FROM devices.modules`, `SELECT * FROM devices.jobs`.
+func (c *Client) QueryTwins(ctx context.Context, query string, opts ...QueryOption) *QueryIterator {
+	q := &QueryIterator{c: c, ctx: ctx, query: query}
+	for _, opt := range opts {
+		opt(q)
+	}
+	if query == "" {
+		q.err = errors.New("query is empty")
+	}
+	return q
+}
+
+// QueryIterator iterates over query results, it's not safe for concurrent use.
+type QueryIterator struct {
+	c     *Client
+	ctx   context.Context
+	query string
+	size  int
+
+	page  []json.RawMessage
+	row   json.RawMessage
+	token string // continuation token
+	last  bool   // no more pages
+	err   error
+}
+
+// Next advances the iterator to the next row fetching the next page
+// when it's needed, false means there are no more rows or an error
+// occurred that's returned by Err.
+func (q *QueryIterator) Next() bool {
+	if q.err != nil {
+		return false
+	}
+	for len(q.page) == 0 {
+		if q.last {
+			q.row = nil
+			return false
+		}
+		if q.err = q.fetch(); q.err != nil {
+			q.row = nil
+			return false
+		}
+	}
+	q.row, q.page = q.page[0], q.page[1:]
+	return true
+}
+
+// fetch requests the next page of results.
+func (q *QueryIterator) fetch() error {
+	h := http.Header{}
+	if q.size != 0 {
+		h.Set("x-ms-max-item-count", strconv.Itoa(q.size))
+	}
+	if q.token != "" {
+		h.Set("x-ms-continuation", q.token)
+	}
+	var page []json.RawMessage
+	res, err := q.c.request(q.ctx, http.MethodPost, "devices/query", h, map[string]string{
+		"query": q.query,
+	}, &page)
+	if err != nil {
+		return err
+	}
+	q.page = page
+	q.token = res.Get("x-ms-continuation")
+	q.last = q.token == ""
+	return nil
+}
+
+// Raw returns the current row as is.
+func (q *QueryIterator) Raw() json.RawMessage {
+	return q.row
+}
+
+// ScanStruct decodes the current row into v honoring its json tags.
+func (q *QueryIterator) ScanStruct(v interface{}) error {
+	if q.row == nil {
+		return errors.New("no current row")
+	}
+	return json.Unmarshal(q.row, v)
+}
+
+// Twin decodes the current row as a twin.
+func (q *QueryIterator) Twin() (*Twin, error) {
+	t := &Twin{}
+	if err := q.ScanStruct(t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Err returns the first error occurred while iterating.
+func (q *QueryIterator) Err() error {
+	return q.err
+}
@@ -0,0 +1,125 @@
+package iotservice
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestQueryTwins(t *testing.T) {
+	t.Parallel()
+
+	c, s := newTestClient(t, "")
+	s.respond(func(w http.ResponseWriter, n int) {
+		if n == 0 {
+			w.Header().Set("x-ms-continuation", "next")
+			_, _ = io.WriteString(w, `[{"deviceId":"a"},{"deviceId":"b"}]`)
+			return
+		}
+		_, _ = io.WriteString(w, `[{"deviceId":"c"}]`)
+	})
+
+	const query = "SELECT * FROM devices"
+	it := c.QueryTwins(context.Background(), query, WithQueryPageSize(2))
+	var ids []string
+	for it.Next() {
+		twin, err := it.Twin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, twin.DeviceID)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if g := fmt.Sprint(ids); g != "[a b c]" {
+		t.Errorf("rows = %s, want [a b c]", g)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.reqs) != 2 {
+		t.Fatalf("requests = %d, want 2", len(s.reqs))
+	}
+	for i, token := range []string{"", "next"} {
+		r := s.reqs[i]
+		if r.Method != http.MethodPost || r.Path != "/devices/query" {
+			t.Errorf("request #%d = %s %s, want POST /devices/query", i, r.Method, r.Path)
+		}
+		if r.Body != `{"query":"SELECT * FROM devices"}` {
+			t.Errorf("request #%d body = %s", i, r.Body)
+		}
+		if g := r.Header.Get("x-ms-max-item-count"); g != "2" {
+			t.Errorf("request #%d x-ms-max-item-count = %q, want 2", i, g)
+		}
+		if g := r.Header.Get("x-ms-continuation"); g != token {
+			t.Errorf("request #%d x-ms-continuation = %q, want %q", i, g, token)
+		}
+	}
+}
+
+func TestQueryTwinsError(t *testing.T) {
+	t.Parallel()
+
+	c, _ := newTestClient(t, "[]")
+	it := c.QueryTwins(context.Background(), "")
+	if it.Next() || it.Err() == nil {
+		t.Error("empty query doesn't fail")
+	}
+
+	it = c.QueryTwins(context.Background(), "SELECT * FROM devices")
+	if it.Next() {
+		t.Error("Next() = true on empty result")
+	}
+	if err := it.ScanStruct(&struct{}{}); err == nil {
+		t.Error("ScanStruct() without a row = nil error")
+	}
+}
+
+func TestQueryScanStruct(t *testing.T) {
+	t.Parallel()
+
+	c, s := newTestClient(t, "")
+	s.respond(func(w http.ResponseWriter, n int) {
+		if n == 0 {
+			w.Header().Set("x-ms-continuation", "next")
+			_, _ = io.WriteString(w, `[{"region":"eu","n":3}]`)
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = io.WriteString(w, `{"Message":"boom"}`)
+	})
+
+	it := c.QueryTwins(context.Background(),
+		"SELECT tags.region, COUNT() AS n FROM devices GROUP BY tags.region",
+	)
+	if !it.Next() {
+		t.Fatal(it.Err())
+	}
+	var row struct {
+		Region string `json:"region"`
+		N      int    `json:"n"`
+	}
+	if err := it.ScanStruct(&row); err != nil {
+		t.Fatal(err)
+	}
+	if row.Region != "eu" || row.N != 3 {
+		t.Errorf("row = %+v, want eu 3", row)
+	}
+	if g := string(it.Raw()); g != `{"region":"eu","n":3}` {
+		t.Errorf("Raw() = %s", g)
+	}
+
+	// failed page requests stop iterating
+	if it.Next() {
+		t.Fatal("Next() = true after a failed page request")
+	}
+	if it.Err() == nil {
+		t.Error("Err() = nil after a failed page request")
+	}
+	if it.Next() {
+		t.Error("Next() = true after an error")
+	}
+}
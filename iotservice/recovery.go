@@ -0,0 +1,156 @@
+package iotservice
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/goautomotive/iothub/common"
+	"github.com/goautomotive/iothub/common/commonamqp"
+	"github.com/goautomotive/iothub/eventhub"
+)
+
+// AMQPState is the state of the client's AMQP connection.
+type AMQPState int
+
+const (
+	// AMQPConnected connection is established.
+	AMQPConnected AMQPState = iota + 1
+
+	// AMQPDisconnected connection is lost.
+	AMQPDisconnected
+
+	// AMQPReconnecting client is trying to re-open a lost link of an
+	// active subscription, re-establishing the connection if needed.
+	AMQPReconnecting
+)
+
+func (s AMQPState) String() string {
+	switch s {
+	case AMQPConnected:
+		return "connected"
+	case AMQPDisconnected:
+		return "disconnected"
+	case AMQPReconnecting:
+		return "reconnecting"
+	default:
+		return "unknown"
+	}
+}
+
+// AMQPStateHandler handles AMQP connection state changes,
+// err is the cause of the change if any.
+type AMQPStateHandler func(state AMQPState, err error)
+
+// WithAMQPStateHandler sets the connection state change handler,
+// it's called synchronously so it must not block.
+func WithAMQPStateHandler(fn AMQPStateHandler) ClientOption {
+	if fn == nil {
+		panic("fn is nil")
+	}
+	return func(c *Client) error {
+		c.onState = fn
+		return nil
+	}
+}
+
+// WithAMQPReconnect sets exponential backoff delays between attempts to
+// re-establish the AMQP connection and re-open links of feedback and file
+// notification subscriptions, defaults to 1s and 30s.
+//
+// Sending messages is retried the same way up to 5 times,
+// with the same message id so the hub can deduplicate them.
+func WithAMQPReconnect(min, max time.Duration) ClientOption {
+	if min <= 0 || max < min {
+		panic("invalid backoff intervals")
+	}
+	return func(c *Client) error {
+		c.rcmin, c.rcmax = min, max
+		return nil
+	}
+}
+
+// sendAttempts is the maximum number of attempts to send a message.
+const sendAttempts = 5
+
+// amqpConn returns the live AMQP connection establishing it when needed.
+func (c *Client) amqpConn(ctx context.Context) (*eventhub.Client, error) {
+	if err := c.ConnectToAMQP(ctx); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		select {
+		case <-c.done:
+			return nil, ErrClosed
+		default:
+			return nil, errConnLost
+		}
+	}
+	return c.conn, nil
+}
+
+// errConnLost means the connection is dropped right after it's established.
+var errConnLost = errors.New("connection lost")
+
+// resetAMQP drops the broken connection, so the next call of
+// ConnectToAMQP establishes a new one. It's a no-op when conn
+// has been already replaced or the client is closed.
+func (c *Client) resetAMQP(conn *eventhub.Client, err error) {
+	c.mu.Lock()
+	if c.conn != conn {
+		c.mu.Unlock()
+		return
+	}
+	c.conn = nil
+	c.mu.Unlock()
+
+	conn.Close()
+	if c.closed() {
+		return
+	}
+	c.logf(common.LevelWarn, common.ComponentTransport, "amqp connection lost: %s", err)
+	c.dispatchState(AMQPDisconnected, err)
+}
+
+func (c *Client) closed() bool {
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Client) dispatchState(state AMQPState, err error) {
+	if c.onState != nil {
+		c.onState(state, err)
+	}
+}
+
+// recoverable reports whether the operation
+// failed with err can succeed after reconnecting.
+func recoverable(err error) bool {
+	return err == errConnLost || commonamqp.IsConnError(err) || commonamqp.IsLinkError(err)
+}
+
+// backoff returns reconnect delays generator.
+func (c *Client) backoff() *common.Backoff {
+	return &common.Backoff{Min: c.rcmin, Max: c.rcmax}
+}
+
+// wait sleeps for the next backoff delay, it returns false when
+// ctx is done or the client is closed earlier.
+func (c *Client) wait(ctx context.Context, b *common.Backoff) bool {
+	t := time.NewTimer(b.Next())
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	case <-c.done:
+		return false
+	}
+}
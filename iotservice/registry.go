@@ -6,6 +6,8 @@ type Result struct {
 	Payload map[string]interface{} `json:"payload,omitempty"`
 }
 
+// Device is a device identity in the registry, Authentication can be
+// omitted on creation to make the hub generate symmetric keys.
 type Device struct {
 	DeviceID                   string                 `json:"deviceId,omitempty"`
 	GenerationID               string                 `json:"generationId,omitempty"`
@@ -21,6 +23,14 @@ type Device struct {
 	Capabilities               map[string]interface{} `json:"capabilities,omitempty"`
 }
 
+// Device statuses, disabled devices cannot connect to the hub.
+const (
+	DeviceEnabled  = "enabled"
+	DeviceDisabled = "disabled"
+)
+
+// Authentication is device authentication mechanism,
+// only the one corresponding to Type is used.
 type Authentication struct {
 	SymmetricKey   *SymmetricKey   `json:"symmetricKey,omitempty"`
 	X509Thumbprint *X509Thumbprint `json:"x509Thumbprint,omitempty"`
@@ -32,27 +42,78 @@ type AuthType string
 
 const (
 	// AuthSAS uses symmetric keys to sign requests.
-	AuthSAS = "sas"
+	AuthSAS AuthType = "sas"
 
 	// AuthSelfSigned self signed certificate with a thumbprint.
-	AuthSelfSigned = "selfSigned"
+	AuthSelfSigned AuthType = "selfSigned"
 
 	// AuthCA certificate signed by a registered certificate authority.
-	AuthCA = "certificateAuthority"
+	AuthCA AuthType = "certificateAuthority"
+
+	// AuthNone disables authentication, it's used by module identities
+	// authenticated by IoT Edge and can't be set for devices.
+	AuthNone AuthType = "none"
 )
 
+// NewSASAuthentication returns symmetric keys authentication,
+// blank keys are generated by the hub.
+func NewSASAuthentication(primary, secondary string) *Authentication {
+	return &Authentication{
+		Type: AuthSAS,
+		SymmetricKey: &SymmetricKey{
+			PrimaryKey:   primary,
+			SecondaryKey: secondary,
+		},
+	}
+}
+
+// NewSelfSignedAuthentication returns self-signed X.509 certificates
+// authentication, thumbprints are SHA1 or SHA256 certificate fingerprints.
+func NewSelfSignedAuthentication(primary, secondary string) *Authentication {
+	return &Authentication{
+		Type: AuthSelfSigned,
+		X509Thumbprint: &X509Thumbprint{
+			PrimaryThumbprint:   primary,
+			SecondaryThumbprint: secondary,
+		},
+	}
+}
+
+// NewCAAuthentication returns authentication with X.509 certificates
+// signed by a certificate authority registered on the hub.
+func NewCAAuthentication() *Authentication {
+	return &Authentication{Type: AuthCA}
+}
+
+// X509Thumbprint is a pair of X.509 certificate fingerprints.
 type X509Thumbprint struct {
 	PrimaryThumbprint   string `json:"primaryThumbprint,omitempty"`
 	SecondaryThumbprint string `json:"secondaryThumbprint,omitempty"`
 }
 
+// SymmetricKey is a pair of base64 encoded shared access keys.
 type SymmetricKey struct {
 	PrimaryKey   string `json:"primaryKey,omitempty"`
 	SecondaryKey string `json:"secondaryKey,omitempty"`
 }
 
+// Module is a module identity of a device in the registry.
+type Module struct {
+	ModuleID                   string          `json:"moduleId,omitempty"`
+	DeviceID                   string          `json:"deviceId,omitempty"`
+	GenerationID               string          `json:"generationId,omitempty"`
+	ETag                       string          `json:"etag,omitempty"`
+	ConnectionState            string          `json:"connectionState,omitempty"`
+	ConnectionStateUpdatedTime string          `json:"connectionStateUpdatedTime,omitempty"`
+	LastActivityTime           string          `json:"lastActivityTime,omitempty"`
+	CloudToDeviceMessageCount  int             `json:"cloudToDeviceMessageCount,omitempty"`
+	Authentication             *Authentication `json:"authentication,omitempty"`
+	ManagedBy                  string          `json:"managedBy,omitempty"` // e.g. IotEdge
+}
+
 type Twin struct {
 	DeviceID                  string                 `json:"deviceId,omitempty"`
+	ModuleID                  string                 `json:"moduleId,omitempty"`
 	ETag                      string                 `json:"etag,omitempty"`
 	DeviceETag                string                 `json:"deviceEtag,omitempty"`
 	Status                    string                 `json:"status,omitempty"`
@@ -74,8 +135,159 @@ type Properties struct {
 	Reported map[string]interface{} `json:"reported,omitempty"`
 }
 
+// Stats is the hub statistics, device counts are of the registry and
+// ConnectedDeviceCount is the number of devices currently connected.
 type Stats struct {
-	DisabledDeviceCount int `json:"disabledDeviceCount,omitempty"`
-	EnabledDeviceCount  int `json:"enabledDeviceCount,omitempty"`
-	TotalDeviceCount    int `json:"totalDeviceCount,omitempty"`
+	DisabledDeviceCount  int `json:"disabledDeviceCount"`
+	EnabledDeviceCount   int `json:"enabledDeviceCount"`
+	TotalDeviceCount     int `json:"totalDeviceCount"`
+	ConnectedDeviceCount int `json:"connectedDeviceCount"`
+}
+
+// Bulk job types.
+const (
+	JobTypeImport = "import"
+	JobTypeExport = "export"
+)
+
+// Bulk job statuses, completed, failed and cancelled are terminal.
+const (
+	JobStatusUnknown   = "unknown"
+	JobStatusEnqueued  = "enqueued"
+	JobStatusRunning   = "running"
+	JobStatusCompleted = "completed"
+	JobStatusFailed    = "failed"
+	JobStatusCancelled = "cancelled"
+)
+
+// Job is a registry import or export job.
+type Job struct {
+	JobID                  string `json:"jobId,omitempty"`
+	Type                   string `json:"type,omitempty"`
+	Status                 string `json:"status,omitempty"`
+	Progress               int    `json:"progress,omitempty"` // percents
+	InputBlobContainerURI  string `json:"inputBlobContainerUri,omitempty"`
+	OutputBlobContainerURI string `json:"outputBlobContainerUri,omitempty"`
+	ExcludeKeysInExport    bool   `json:"excludeKeysInExport,omitempty"`
+	FailureReason          string `json:"failureReason,omitempty"`
+	StartTimeUTC           string `json:"startTimeUtc,omitempty"`
+	EndTimeUTC             string `json:"endTimeUtc,omitempty"`
+}
+
+// Done reports whether the job is finished.
+func (j *Job) Done() bool {
+	switch j.Status {
+	case JobStatusCompleted, JobStatusFailed, JobStatusCancelled:
+		return true
+	default:
+		return false
+	}
+}
+
+// Scheduled job types.
+const (
+	JobTypeScheduleUpdateTwin   = "scheduleUpdateTwin"
+	JobTypeScheduleDeviceMethod = "scheduleDeviceMethod"
+)
+
+// Scheduled job statuses in addition to the bulk job ones.
+const (
+	JobStatusQueued    = "queued"
+	JobStatusScheduled = "scheduled"
+)
+
+// ScheduledJob is a job that updates twins or invokes a direct method
+// on all devices matching QueryCondition, e.g. "deviceId IN ['a', 'b']".
+type ScheduledJob struct {
+	JobID                     string          `json:"jobId,omitempty"`
+	Type                      string          `json:"type,omitempty"`
+	Status                    string          `json:"status,omitempty"`
+	QueryCondition            string          `json:"queryCondition,omitempty"`
+	CreatedTime               string          `json:"createdTime,omitempty"`
+	StartTime                 string          `json:"startTime,omitempty"`
+	EndTime                   string          `json:"endTime,omitempty"`
+	MaxExecutionTimeInSeconds int             `json:"maxExecutionTimeInSeconds,omitempty"`
+	UpdateTwin                *Twin           `json:"updateTwin,omitempty"`
+	CloudToDeviceMethod       *MethodCall     `json:"cloudToDeviceMethod,omitempty"`
+	FailureReason             string          `json:"failureReason,omitempty"`
+	StatusMessage             string          `json:"statusMessage,omitempty"`
+	DeviceJobStatistics       *DeviceJobStats `json:"deviceJobStatistics,omitempty"`
+}
+
+// Done reports whether the job is finished.
+func (j *ScheduledJob) Done() bool {
+	switch j.Status {
+	case JobStatusCompleted, JobStatusFailed, JobStatusCancelled:
+		return true
+	default:
+		return false
+	}
+}
+
+// DeviceJobStats is per-device progress of a scheduled job.
+type DeviceJobStats struct {
+	DeviceCount    int `json:"deviceCount"`
+	FailedCount    int `json:"failedCount"`
+	SucceededCount int `json:"succeededCount"`
+	RunningCount   int `json:"runningCount"`
+	PendingCount   int `json:"pendingCount"`
+}
+
+// DeviceJob is the result of a scheduled job on a single device.
+type DeviceJob struct {
+	DeviceID               string            `json:"deviceId"`
+	JobID                  string            `json:"jobId"`
+	JobType                string            `json:"jobType,omitempty"`
+	Status                 string            `json:"status"`
+	StartTimeUTC           string            `json:"startTimeUtc,omitempty"`
+	EndTimeUTC             string            `json:"endTimeUtc,omitempty"`
+	CreatedDateTimeUTC     string            `json:"createdDateTimeUtc,omitempty"`
+	LastUpdatedDateTimeUTC string            `json:"lastUpdatedDateTimeUtc,omitempty"`
+	Outcome                *DeviceJobOutcome `json:"outcome,omitempty"`
+	Error                  *DeviceJobError   `json:"error,omitempty"`
+}
+
+// DeviceJobOutcome is the direct method response of method jobs.
+type DeviceJobOutcome struct {
+	DeviceMethodResponse *Result `json:"deviceMethodResponse,omitempty"`
+}
+
+// DeviceJobError describes why the job failed on the device.
+type DeviceJobError struct {
+	Code        string `json:"code"`
+	Description string `json:"description"`
+}
+
+// Configuration is an automatic device management configuration that
+// applies Content to devices matching TargetCondition, e.g. "tags.env='prod'",
+// configurations with higher Priority win when several match a device.
+type Configuration struct {
+	ID                 string                `json:"id,omitempty"`
+	SchemaVersion      string                `json:"schemaVersion,omitempty"`
+	Labels             map[string]string     `json:"labels,omitempty"`
+	Content            *ConfigurationContent `json:"content,omitempty"`
+	TargetCondition    string                `json:"targetCondition,omitempty"`
+	CreatedTimeUTC     string                `json:"createdTimeUtc,omitempty"`
+	LastUpdatedTimeUTC string                `json:"lastUpdatedTimeUtc,omitempty"`
+	Priority           int                   `json:"priority,omitempty"`
+	SystemMetrics      *ConfigurationMetrics `json:"systemMetrics,omitempty"`
+	Metrics            *ConfigurationMetrics `json:"metrics,omitempty"`
+	ETag               string                `json:"etag,omitempty"`
+}
+
+// ConfigurationContent is a configuration payload, DeviceContent holds
+// twin patches keyed by paths like "properties.desired.x", ModulesContent
+// is an IoT Edge deployment manifest.
+type ConfigurationContent struct {
+	DeviceContent  map[string]interface{} `json:"deviceContent,omitempty"`
+	ModulesContent map[string]interface{} `json:"modulesContent,omitempty"`
+	ModuleContent  map[string]interface{} `json:"moduleContent,omitempty"`
+}
+
+// ConfigurationMetrics contains queries counting devices in particular
+// states, e.g. "SELECT deviceId FROM devices WHERE properties.reported.x=1",
+// and their results computed by the hub.
+type ConfigurationMetrics struct {
+	Results map[string]int    `json:"results,omitempty"`
+	Queries map[string]string `json:"queries,omitempty"`
 }
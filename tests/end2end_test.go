@@ -140,10 +140,18 @@ func (c *thirdPartyCreds) DeviceID() string {
 	return c.creds.DeviceID
 }
 
+func (c *thirdPartyCreds) ModuleID() string {
+	return c.creds.ModuleID
+}
+
 func (c *thirdPartyCreds) Hostname() string {
 	return c.creds.HostName
 }
 
+func (c *thirdPartyCreds) GatewayHostName() string {
+	return c.creds.GatewayHostName
+}
+
 func (c *thirdPartyCreds) IsSAS() bool {
 	return true
 }